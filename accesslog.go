@@ -0,0 +1,233 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Termination reasons of tunnels.
+const (
+	reasonClientClosed      = "client_closed"
+	reasonDestinationClosed = "destination_closed"
+	reasonIdleTimeout       = "idle_timeout"
+	reasonMaxLifetime       = "max_lifetime"
+	reasonShutdown          = "shutdown"
+	reasonClosed            = "closed"
+	reasonError             = "error"
+)
+
+// AccessLog records one entry per tunnel once it is closed.
+type AccessLog struct {
+	// Logger, if set, receives records as info level entries.
+	Logger *zap.Logger
+	// Writer, if set, receives records as JSON lines.
+	Writer io.Writer
+
+	mu sync.Mutex
+}
+
+// AccessRecord is the access log entry of a tunnel.
+type AccessRecord struct {
+	// Client is the IP address of the client.
+	Client string `json:"client"`
+	// User is the authenticated user, empty if authentication is disabled.
+	User string `json:"user,omitempty"`
+	// RequestID is the request ID chosen by the client, sent in the
+	// X-Request-Id header of CONNECT requests or as "request_id" SOCKS
+	// metadata.
+	RequestID string `json:"request_id,omitempty"`
+	// Metadata is the metadata sent by SOCKS clients, e.g. their app name.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Destination is the host and port connected to, or "udp" for SOCKS UDP
+	// associations.
+	Destination string    `json:"destination"`
+	Start       time.Time `json:"start"`
+	// Duration is the duration the tunnel was open in seconds.
+	Duration float64 `json:"duration"`
+	// BytesUp and BytesDown are the bytes relayed to the destination and to
+	// the client.
+	BytesUp   int64 `json:"bytes_up"`
+	BytesDown int64 `json:"bytes_down"`
+	// Reason is why the tunnel was closed: "client_closed",
+	// "destination_closed", "idle_timeout", "max_lifetime", "shutdown" if
+	// closed while shutting down, "closed" if closed via the admin API, or
+	// "error".
+	Reason string `json:"reason"`
+	// GracefulClose is set for idle tunnels closed gracefully, see
+	// Proxy.IdleCloseGrace, to which peers closed their side within the grace
+	// period: "both", "client", "destination" or "none".
+	GracefulClose string `json:"graceful_close,omitempty"`
+}
+
+func (l *AccessLog) log(rec *AccessRecord) {
+	if l == nil {
+		return
+	}
+	if l.Logger != nil {
+		fields := []zapcore.Field{
+			zap.String("client", rec.Client),
+			zap.String("user", rec.User),
+			zap.String("destination", rec.Destination),
+			zap.Time("start", rec.Start),
+			zap.Float64("duration", rec.Duration),
+			zap.Int64("bytes_up", rec.BytesUp),
+			zap.Int64("bytes_down", rec.BytesDown),
+			zap.String("reason", rec.Reason),
+		}
+		if rec.RequestID != "" {
+			fields = append(fields, zap.String("request_id", rec.RequestID))
+		}
+		if rec.GracefulClose != "" {
+			fields = append(fields, zap.String("graceful_close", rec.GracefulClose))
+		}
+		if len(rec.Metadata) > 0 {
+			fields = append(fields, zap.Any("metadata", rec.Metadata))
+		}
+		l.Logger.Info("Tunnel closed", fields...)
+	}
+	if l.Writer != nil {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		_, _ = l.Writer.Write(append(b, '\n'))
+		l.mu.Unlock()
+	}
+}
+
+// terminationReason returns why a direction of a tunnel ended with err,
+// where eofReason is the reason of its source closing the connection.
+func terminationReason(err error, eofReason string, activity *tunnelActivity) string {
+	switch {
+	case err == nil:
+		return eofReason
+	case isTimeout(err):
+		if !activity.end.IsZero() && !time.Now().Before(activity.end) {
+			return reasonMaxLifetime
+		}
+		return reasonIdleTimeout
+	default:
+		return reasonError
+	}
+}
+
+// clientIP returns the IP address of addr, or addr itself if it has no port.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// RotatingFile is an append-only file which is rotated once it exceeds
+// MaxSize. Rotated files are renamed by appending ".1", ".2" and so on to
+// Path, keeping at most MaxBackups of them.
+type RotatingFile struct {
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated, never if
+	// zero.
+	MaxSize    int64
+	MaxBackups int
+	// MaxAge is the age after which backups are removed on rotation, never
+	// if zero.
+	MaxAge time.Duration
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Write appends b to the file, rotating it first if b would exceed MaxSize.
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f != nil && f.MaxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file. It is reopened by the next write.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, fi.Size()
+	return nil
+}
+
+// rotate closes the file and shifts it and its backups by one, removing the
+// oldest one and those last written before MaxAge. It must be called with
+// f.mu held.
+func (f *RotatingFile) rotate() error {
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	f.f = nil
+
+	if f.MaxBackups <= 0 {
+		return os.Remove(f.Path)
+	}
+	if f.MaxAge > 0 {
+		for i := 1; i <= f.MaxBackups; i++ {
+			backup := f.Path + "." + strconv.Itoa(i)
+			if fi, err := os.Stat(backup); err == nil && time.Since(fi.ModTime()) > f.MaxAge {
+				if err := os.Remove(backup); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for i := f.MaxBackups - 1; i > 0; i-- {
+		from := f.Path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, f.Path+"."+strconv.Itoa(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(f.Path, f.Path+".1")
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogTunnel(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+
+	// Proxy server
+
+	var logs lockedBuffer
+	p := newTestProxy()
+	p.AccessLog = &AccessLog{Writer: &logs}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+
+	destAddr := destListener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Request-Id: 7f3c9a\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	_, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && logs.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	var observed AccessRecord
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &observed))
+	assert.Equal(t, "127.0.0.1", observed.Client)
+	assert.Equal(t, destAddr, observed.Destination)
+	assert.Equal(t, "7f3c9a", observed.RequestID)
+	assert.Equal(t, int64(4), observed.BytesUp)
+	assert.Equal(t, int64(4), observed.BytesDown)
+	assert.Equal(t, reasonClientClosed, observed.Reason)
+	assert.False(t, observed.Start.IsZero())
+	assert.True(t, observed.Duration > 0)
+}
+
+func TestTerminationReason(t *testing.T) {
+	// Arrange
+
+	now := time.Now()
+	cases := []struct {
+		name           string
+		givenErr       error
+		givenActivity  *tunnelActivity
+		expectedReason string
+	}{
+		{
+			name:           "Closed",
+			givenActivity:  &tunnelActivity{},
+			expectedReason: reasonClientClosed,
+		},
+		{
+			name:           "IdleTimeout",
+			givenErr:       &net.OpError{Op: "read", Err: timeoutError{}},
+			givenActivity:  &tunnelActivity{end: now.Add(time.Hour)},
+			expectedReason: reasonIdleTimeout,
+		},
+		{
+			name:           "MaxLifetime",
+			givenErr:       &net.OpError{Op: "read", Err: timeoutError{}},
+			givenActivity:  &tunnelActivity{end: now.Add(-time.Second)},
+			expectedReason: reasonMaxLifetime,
+		},
+		{
+			name:           "Error",
+			givenErr:       io.ErrUnexpectedEOF,
+			givenActivity:  &tunnelActivity{},
+			expectedReason: reasonError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := terminationReason(tc.givenErr, reasonClientClosed, tc.givenActivity)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedReason, observed)
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 2}
+	defer f.Close()
+
+	// Act
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// Assert
+
+	for name, expected := range map[string]string{
+		"access.log":   "fourth\n",
+		"access.log.1": "third\n",
+		"access.log.2": "second\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, string(b), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 3, MaxAge: time.Hour}
+	defer f.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, ioutil.WriteFile(path+".1", []byte("expired\n"), 0644))
+	require.NoError(t, os.Chtimes(path+".1", old, old))
+	require.NoError(t, ioutil.WriteFile(path+".2", []byte("older\n"), 0644))
+
+	// Act
+
+	for _, line := range []string{"current\n", "next line\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// Assert
+
+	b, err := ioutil.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "current\n", string(b))
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+	b, err = ioutil.ReadFile(path + ".3")
+	require.NoError(t, err)
+	assert.Equal(t, "older\n", string(b))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
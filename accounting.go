@@ -0,0 +1,260 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of Accounting.
+const (
+	defaultAccountingBatchSize  = 100
+	defaultAccountingMaxPending = 100000
+)
+
+// UsageRecord is the usage of a tunnel exported for billing and abuse
+// analysis.
+type UsageRecord struct {
+	User        string    `json:"user,omitempty"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Start       time.Time `json:"start"`
+	// Duration is the duration the tunnel was open in seconds.
+	Duration  float64 `json:"duration"`
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+}
+
+// AccountingSink receives batches of usage records.
+type AccountingSink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	// Export ships records. Records of a failed export are exported again
+	// with the next batch.
+	Export(ctx context.Context, records []UsageRecord) error
+}
+
+// Accounting batches the usage records of closed tunnels and exports them to
+// Sinks, once BatchSize records are pending or every FlushInterval. Each sink
+// gets every record, retried with later batches while the sink fails.
+type Accounting struct {
+	Logger *zap.Logger
+	Sinks  []AccountingSink
+	// BatchSize is the number of pending records triggering an export, 100
+	// if zero.
+	BatchSize int
+	// FlushInterval is the interval of exporting pending records regardless
+	// of their number, as run by Run.
+	FlushInterval time.Duration
+	// MaxPending bounds the records kept per sink while it fails, dropping
+	// the oldest ones, 100000 if zero.
+	MaxPending int
+
+	mu      sync.Mutex
+	pending [][]UsageRecord
+	full    chan struct{}
+
+	// flushMu serializes exports, keeping the order of records per sink.
+	flushMu sync.Mutex
+}
+
+// record queues the usage of a closed tunnel.
+func (a *Accounting) record(ctx context.Context, stats AccessRecord) {
+	if a == nil {
+		return
+	}
+	rec := UsageRecord{
+		User:        stats.User,
+		Client:      stats.Client,
+		Destination: stats.Destination,
+		Start:       stats.Start,
+		Duration:    stats.Duration,
+		BytesUp:     stats.BytesUp,
+		BytesDown:   stats.BytesDown,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.init()
+	maxPending := a.maxPending()
+	batchSize := a.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAccountingBatchSize
+	}
+	for i, pending := range a.pending {
+		if len(pending) >= maxPending {
+			pending = pending[len(pending)-maxPending+1:]
+		}
+		a.pending[i] = append(pending, rec)
+		if len(a.pending[i]) >= batchSize {
+			select {
+			case a.full <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (a *Accounting) maxPending() int {
+	if a.MaxPending <= 0 {
+		return defaultAccountingMaxPending
+	}
+	return a.MaxPending
+}
+
+// init allocates the pending records per sink. It must be called with a.mu
+// held.
+func (a *Accounting) init() {
+	if a.full == nil {
+		a.full = make(chan struct{}, 1)
+		a.pending = make([][]UsageRecord, len(a.Sinks))
+	}
+}
+
+// Run exports pending records once a batch is complete or FlushInterval
+// passed, until stop is closed. Records of tunnels closed later are exported
+// by Flush.
+func (a *Accounting) Run(stop <-chan struct{}) {
+	a.mu.Lock()
+	a.init()
+	full := a.full
+	a.mu.Unlock()
+
+	var tick <-chan time.Time
+	if a.FlushInterval > 0 {
+		t := time.NewTicker(a.FlushInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-full:
+		case <-tick:
+		}
+		ctx := context.Background()
+		if a.FlushInterval > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, a.FlushInterval)
+			_ = a.Flush(ctx)
+			cancel()
+		} else {
+			_ = a.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports all pending records, logging and returning the first error
+// of failing sinks, which keep their records.
+func (a *Accounting) Flush(ctx context.Context) error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	a.init()
+	batches := make([][]UsageRecord, len(a.pending))
+	copy(batches, a.pending)
+	for i := range a.pending {
+		a.pending[i] = nil
+	}
+	a.mu.Unlock()
+
+	var first error
+	for i, sink := range a.Sinks {
+		if len(batches[i]) == 0 {
+			continue
+		}
+		err := sink.Export(ctx, batches[i])
+		if err == nil {
+			continue
+		}
+		a.Logger.Warn("Exporting usage records failed", zap.String("sink", sink.Name()), zap.Int("records", len(batches[i])), zap.Error(err))
+		if first == nil {
+			first = err
+		}
+		// The failed records are exported ahead of those recorded since.
+		a.mu.Lock()
+		pending := append(batches[i], a.pending[i]...)
+		if n := a.maxPending(); len(pending) > n {
+			pending = pending[len(pending)-n:]
+		}
+		a.pending[i] = pending
+		a.mu.Unlock()
+	}
+	return first
+}
+
+// FileSink appends usage records as JSON lines to Writer, e.g. a
+// RotatingFile.
+type FileSink struct {
+	Writer io.Writer
+}
+
+// Name implements AccountingSink.
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Export implements AccountingSink.
+func (s *FileSink) Export(ctx context.Context, records []UsageRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	_, err := s.Writer.Write(buf.Bytes())
+	return err
+}
+
+// WebhookSink posts batches of usage records as JSON arrays to URL.
+type WebhookSink struct {
+	URL string
+	// Client posts the records, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Name implements AccountingSink.
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Export implements AccountingSink.
+func (s *WebhookSink) Export(ctx context.Context, records []UsageRecord) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
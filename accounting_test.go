@@ -0,0 +1,169 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeSink records exported batches, failing while err is set.
+type fakeSink struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]UsageRecord
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Export(ctx context.Context, records []UsageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, records)
+	return nil
+}
+
+func TestAccountingFlush(t *testing.T) {
+	// Arrange
+
+	healthy := &fakeSink{}
+	failing := &fakeSink{err: errors.New("unavailable")}
+	a := &Accounting{Logger: zap.NewNop(), Sinks: []AccountingSink{healthy, failing}, MaxPending: 2}
+
+	// Act
+
+	record := func(dest string) {
+		a.record(context.Background(), AccessRecord{User: "alice", Destination: dest, BytesUp: 1, BytesDown: 2})
+	}
+	record("a.example.com:443")
+	record("b.example.com:443")
+	firstErr := a.Flush(context.Background())
+	record("c.example.com:443")
+	failing.err = nil
+	secondErr := a.Flush(context.Background())
+
+	// Assert
+
+	assert.EqualError(t, firstErr, "unavailable")
+	assert.NoError(t, secondErr)
+	require.Len(t, healthy.batches, 2)
+	assert.Len(t, healthy.batches[0], 2)
+	assert.Len(t, healthy.batches[1], 1)
+	// The failing sink kept the latest MaxPending records.
+	require.Len(t, failing.batches, 1)
+	require.Len(t, failing.batches[0], 2)
+	assert.Equal(t, "b.example.com:443", failing.batches[0][0].Destination)
+	assert.Equal(t, "c.example.com:443", failing.batches[0][1].Destination)
+}
+
+func TestAccountingRunBatches(t *testing.T) {
+	// Arrange
+
+	sink := &fakeSink{}
+	a := &Accounting{Logger: zap.NewNop(), Sinks: []AccountingSink{sink}, BatchSize: 2}
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.Run(stop)
+
+	// Act
+
+	a.record(context.Background(), AccessRecord{Destination: "a.example.com:443"})
+	a.record(context.Background(), AccessRecord{Destination: "b.example.com:443"})
+
+	var n int
+	for i := 0; i < 100; i++ {
+		sink.mu.Lock()
+		n = len(sink.batches)
+		sink.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, 1, n)
+}
+
+func TestFileSink(t *testing.T) {
+	// Arrange
+
+	var buf bytes.Buffer
+	s := &FileSink{Writer: &buf}
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Act
+
+	err := s.Export(context.Background(), []UsageRecord{{User: "alice", Client: "192.0.2.10", Destination: "example.com:443", Start: start, Duration: 1.5, BytesUp: 10, BytesDown: 20}})
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, `{"user":"alice","client":"192.0.2.10","destination":"example.com:443","start":"2018-06-01T12:00:00Z","duration":1.5,"bytes_up":10,"bytes_down":20}`+"\n", buf.String())
+}
+
+func TestWebhookSink(t *testing.T) {
+	cases := []struct {
+		name        string
+		givenStatus int
+		expectedErr string
+	}{
+		{
+			name:        "Accepted",
+			givenStatus: http.StatusAccepted,
+		},
+		{
+			name:        "Failed",
+			givenStatus: http.StatusServiceUnavailable,
+			expectedErr: "webhook responded 503 Service Unavailable",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			var received []UsageRecord
+			var contentType string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contentType = r.Header.Get("Content-Type")
+				_ = json.NewDecoder(r.Body).Decode(&received)
+				w.WriteHeader(tc.givenStatus)
+			}))
+			defer server.Close()
+			s := &WebhookSink{URL: server.URL}
+
+			// Act
+
+			err := s.Export(context.Background(), []UsageRecord{{User: "alice", Destination: "example.com:443"}})
+
+			// Assert
+
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, "application/json", contentType)
+			require.Len(t, received, 1)
+			assert.Equal(t, "example.com:443", received[0].Destination)
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ACL decides which destinations clients may connect to. Rules are evaluated
+// in order and the first rule matching a destination decides whether it is
+// allowed. Destinations matching no rule are allowed.
+type ACL struct {
+	Rules []ACLRule
+	// GeoIP looks up the countries of destination addresses for rules on
+	// countries, which match no destination if GeoIP is nil.
+	GeoIP *GeoIP
+	// IPSets holds the IP range sets of cloud providers for rules on sets,
+	// which match no destination if IPSets is nil.
+	IPSets *IPRangeSets
+
+	// mu guards Rules, which may be replaced via SetRules while in use.
+	mu sync.RWMutex
+}
+
+// ACLRule allows or denies destinations matching either a host pattern, an IP
+// range, a country or an IP range set, and one of the port ranges.
+type ACLRule struct {
+	Allow bool
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	// It is empty if CIDR, Country or IPSet is set.
+	Host string
+	// CIDR is matched against the resolved addresses of destinations.
+	CIDR *net.IPNet
+	// Country is an ISO 3166-1 alpha-2 country code matched against the
+	// countries of the resolved addresses of destinations.
+	Country string
+	// IPSet is the name of an IP range set of a cloud provider matched
+	// against the resolved addresses of destinations, see IPRangeSets.
+	IPSet string
+	// Ports are the port ranges matched, any port if empty.
+	Ports []PortRange
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To int
+}
+
+// aclDeniedError is returned when a destination is denied by the ACL.
+type aclDeniedError struct {
+	Host string
+	Port int
+}
+
+func (e *aclDeniedError) Error() string {
+	return fmt.Sprintf("destination %s denied by access control rules", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)))
+}
+
+// LoadACL reads ACL rules from the file at path. Each non-empty line not
+// starting with '#' holds "allow" or "deny" followed by a host pattern, an
+// IP range, "country:" and a country code or "ipset:" and the name of an IP
+// range set, optionally followed by a colon and comma-separated ports or port
+// ranges, e.g.:
+//
+//	allow *.example.com:80,443
+//	deny 10.0.0.0/8
+//	allow [2001:db8::/32]:8000-8080
+//	deny country:KP
+//	allow ipset:aws.s3:443
+//	deny *
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACL{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLRule(line string) (ACLRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return ACLRule{}, fmt.Errorf("malformed rule %q", line)
+	}
+
+	var rule ACLRule
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return ACLRule{}, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	target := fields[1]
+	if strings.HasPrefix(strings.ToLower(target), "country:") {
+		country, ports := target[len("country:"):], ""
+		if c := strings.IndexByte(country, ':'); c >= 0 {
+			country, ports = country[:c], country[c+1:]
+		}
+		if len(country) != 2 {
+			return ACLRule{}, fmt.Errorf("invalid country %q", country)
+		}
+		rule.Country = strings.ToUpper(country)
+		var err error
+		if rule.Ports, err = parsePortRanges(ports); err != nil {
+			return ACLRule{}, err
+		}
+		return rule, nil
+	}
+	if strings.HasPrefix(strings.ToLower(target), "ipset:") {
+		name, ports := strings.ToLower(target[len("ipset:"):]), ""
+		if c := strings.IndexByte(name, ':'); c >= 0 {
+			name, ports = name[:c], name[c+1:]
+		}
+		if !validIPSetName(name) {
+			return ACLRule{}, fmt.Errorf("invalid IP range set %q", name)
+		}
+		rule.IPSet = name
+		var err error
+		if rule.Ports, err = parsePortRanges(ports); err != nil {
+			return ACLRule{}, err
+		}
+		return rule, nil
+	}
+	target, ports, err := splitRuleTarget(target)
+	if err != nil {
+		return ACLRule{}, err
+	}
+	if strings.Contains(target, "/") {
+		_, n, err := net.ParseCIDR(target)
+		if err != nil {
+			return ACLRule{}, err
+		}
+		rule.CIDR = n
+	} else if target == "" {
+		return ACLRule{}, fmt.Errorf("missing target in rule %q", line)
+	} else {
+		rule.Host = strings.ToLower(target)
+	}
+
+	if rule.Ports, err = parsePortRanges(ports); err != nil {
+		return ACLRule{}, err
+	}
+	return rule, nil
+}
+
+// splitRuleTarget splits the target of a rule into a host pattern or an IP
+// range, IPv6 ranges enclosed in brackets, and the ports following a colon.
+func splitRuleTarget(target string) (host, ports string, err error) {
+	switch {
+	case strings.HasPrefix(target, "["):
+		end := strings.IndexByte(target, ']')
+		if end < 0 {
+			return "", "", fmt.Errorf("malformed target %q", target)
+		}
+		rest := target[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("malformed target %q", target)
+		}
+		return target[1:end], strings.TrimPrefix(rest, ":"), nil
+	case strings.Count(target, ":") == 1:
+		c := strings.IndexByte(target, ':')
+		return target[:c], target[c+1:], nil
+	}
+	return target, "", nil
+}
+
+// parsePortRanges parses comma-separated ports or port ranges, returning no
+// ranges, i.e. any port, if ports is empty or "*".
+func parsePortRanges(ports string) ([]PortRange, error) {
+	if ports == "" || ports == "*" {
+		return nil, nil
+	}
+	var ranges []PortRange
+	for _, p := range strings.Split(ports, ",") {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, pr)
+	}
+	return ranges, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if d := strings.IndexByte(s, '-'); d >= 0 {
+		from, to = s[:d], s[d+1:]
+	}
+	f, err := strconv.Atoi(from)
+	if err != nil || f < 1 || f > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q", from)
+	}
+	t, err := strconv.Atoi(to)
+	if err != nil || t < f || t > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q", to)
+	}
+	return PortRange{From: f, To: t}, nil
+}
+
+// decide returns whether the destination host and port, resolved to ip, is
+// allowed. If ip is nil, i.e. host has not been resolved yet, decided is
+// false if the first possibly matching rule is an IP range, a country or an
+// IP range set.
+func (a *ACL) decide(host string, port int, ip net.IP) (allow, decided bool) {
+	return a.evaluate(host, port, ip, false)
+}
+
+// decideUnresolved returns whether the destination host and port is allowed,
+// skipping rules on IP ranges, countries and IP range sets unless host is an
+// IP address. It is used for destinations resolved by upstream proxies.
+func (a *ACL) decideUnresolved(host string, port int) bool {
+	allow, _ := a.evaluate(host, port, nil, true)
+	return allow
+}
+
+// rules returns the current rules of a.
+func (a *ACL) rules() []ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.Rules
+}
+
+// SetRules replaces the rules of a, e.g. after the rules file changed.
+func (a *ACL) SetRules(rules []ACLRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.Rules = rules
+}
+
+func (a *ACL) evaluate(host string, port int, ip net.IP, skipCIDRs bool) (allow, decided bool) {
+	rule, i, decided := a.match(host, port, ip, skipCIDRs)
+	if !decided {
+		return false, false
+	}
+	return i < 0 || rule.Allow, true
+}
+
+// match returns the first rule matching the destination like evaluate and
+// its index, which is -1 if no rule matched.
+func (a *ACL) match(host string, port int, ip net.IP, skipCIDRs bool) (ACLRule, int, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for i, rule := range a.Rules {
+		if !matchPorts(rule.Ports, port) {
+			continue
+		}
+		if rule.CIDR != nil || rule.Country != "" || rule.IPSet != "" {
+			if ip == nil {
+				if literal := net.ParseIP(host); literal != nil {
+					ip = literal
+				} else if skipCIDRs {
+					continue
+				} else {
+					return ACLRule{}, -1, false
+				}
+			}
+			if rule.CIDR != nil && rule.CIDR.Contains(ip) {
+				return rule, i, true
+			}
+			if rule.Country != "" && a.GeoIP.Country(ip) == rule.Country {
+				return rule, i, true
+			}
+			if rule.IPSet != "" && a.IPSets.contains(rule.IPSet, ip) {
+				return rule, i, true
+			}
+			continue
+		}
+		if matchHostPattern(rule.Host, host) {
+			return rule, i, true
+		}
+	}
+	return ACLRule{}, -1, true
+}
+
+// String returns r in the syntax of rules files, see LoadACL.
+func (r ACLRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	target := r.Host
+	if r.Country != "" {
+		target = "country:" + r.Country
+	}
+	if r.IPSet != "" {
+		target = "ipset:" + r.IPSet
+	}
+	if r.CIDR != nil {
+		target = r.CIDR.String()
+		if r.CIDR.IP.To4() == nil {
+			target = "[" + target + "]"
+		}
+	}
+	if len(r.Ports) == 0 {
+		return action + " " + target
+	}
+	ports := make([]string, len(r.Ports))
+	for i, pr := range r.Ports {
+		ports[i] = strconv.Itoa(pr.From)
+		if pr.To != pr.From {
+			ports[i] += "-" + strconv.Itoa(pr.To)
+		}
+	}
+	return action + " " + target + ":" + strings.Join(ports, ",")
+}
+
+// matchPorts returns whether port is within any of ranges, or ranges is
+// empty.
+func matchPorts(ranges []PortRange, port int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, pr := range ranges {
+		if port >= pr.From && port <= pr.To {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseACLRule(t *testing.T) {
+	// Arrange
+
+	_, ipv4Net, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ipv6Net, _ := net.ParseCIDR("2001:db8::/32")
+
+	cases := []struct {
+		name          string
+		givenLine     string
+		expectedRule  ACLRule
+		expectedError bool
+	}{
+		{
+			name:         "HostWithPorts",
+			givenLine:    "allow *.Example.com:80,443",
+			expectedRule: ACLRule{Allow: true, Host: "*.example.com", Ports: []PortRange{{80, 80}, {443, 443}}},
+		},
+		{
+			name:         "AnyHost",
+			givenLine:    "deny *",
+			expectedRule: ACLRule{Host: "*"},
+		},
+		{
+			name:         "AnyPort",
+			givenLine:    "deny example.com:*",
+			expectedRule: ACLRule{Host: "example.com"},
+		},
+		{
+			name:         "IPv4CIDR",
+			givenLine:    "deny 10.0.0.0/8",
+			expectedRule: ACLRule{CIDR: ipv4Net},
+		},
+		{
+			name:         "IPv6CIDR",
+			givenLine:    "deny 2001:db8::/32",
+			expectedRule: ACLRule{CIDR: ipv6Net},
+		},
+		{
+			name:         "IPv6CIDRWithPortRange",
+			givenLine:    "allow [2001:db8::/32]:8000-8080",
+			expectedRule: ACLRule{Allow: true, CIDR: ipv6Net, Ports: []PortRange{{8000, 8080}}},
+		},
+		{
+			name:         "Country",
+			givenLine:    "deny country:kp",
+			expectedRule: ACLRule{Country: "KP"},
+		},
+		{
+			name:         "CountryWithPorts",
+			givenLine:    "allow country:SE:443",
+			expectedRule: ACLRule{Allow: true, Country: "SE", Ports: []PortRange{{443, 443}}},
+		},
+		{
+			name:         "IPSetWithPorts",
+			givenLine:    "allow ipset:AWS.s3.eu-west-1:443",
+			expectedRule: ACLRule{Allow: true, IPSet: "aws.s3.eu-west-1", Ports: []PortRange{{443, 443}}},
+		},
+		{
+			name:          "InvalidIPSet",
+			givenLine:     "allow ipset:aws/s3",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidCountry",
+			givenLine:     "deny country:Sweden",
+			expectedError: true,
+		},
+		{
+			name:          "UnknownAction",
+			givenLine:     "permit example.com",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidPort",
+			givenLine:     "allow example.com:http",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidPortRange",
+			givenLine:     "allow example.com:443-80",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidCIDR",
+			givenLine:     "deny 10.0.0.0/33",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedRule, err := parseACLRule(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRule, observedRule)
+		})
+	}
+}
+
+func TestACLRuleString(t *testing.T) {
+	for _, line := range []string{
+		"allow *.example.com:80,443",
+		"deny *",
+		"deny 10.0.0.0/8:25",
+		"deny [2001:db8::/32]",
+		"allow [2001:db8::/32]:8000-8080",
+		"deny country:KP:80,443",
+		"allow ipset:gcp.europe-west1:443",
+	} {
+		t.Run(line, func(t *testing.T) {
+			// Arrange
+
+			rule, err := parseACLRule(line)
+			require.NoError(t, err)
+
+			// Act
+
+			observed := rule.String()
+
+			// Assert
+
+			assert.Equal(t, line, observed)
+		})
+	}
+}
+
+func TestACLDecide(t *testing.T) {
+	// Arrange
+
+	acl := &ACL{}
+	for _, line := range []string{
+		"deny *:25",
+		"allow *.example.com:443",
+		"deny 10.0.0.0/8",
+		"allow example.org",
+		"deny *",
+	} {
+		rule, err := parseACLRule(line)
+		require.NoError(t, err)
+		acl.Rules = append(acl.Rules, rule)
+	}
+
+	cases := []struct {
+		name            string
+		givenHost       string
+		givenPort       int
+		givenIP         string
+		expectedAllow   bool
+		expectedDecided bool
+	}{
+		{
+			name:            "DeniedPort",
+			givenHost:       "www.example.com",
+			givenPort:       25,
+			expectedDecided: true,
+		},
+		{
+			name:            "AllowedHost",
+			givenHost:       "www.example.com",
+			givenPort:       443,
+			expectedAllow:   true,
+			expectedDecided: true,
+		},
+		{
+			name:      "UnresolvedBeforeCIDR",
+			givenHost: "example.org",
+			givenPort: 443,
+		},
+		{
+			name:            "ResolvedDeniedCIDR",
+			givenHost:       "example.org",
+			givenPort:       443,
+			givenIP:         "10.1.2.3",
+			expectedDecided: true,
+		},
+		{
+			name:            "ResolvedAllowedHost",
+			givenHost:       "example.org",
+			givenPort:       443,
+			givenIP:         "192.0.2.1",
+			expectedAllow:   true,
+			expectedDecided: true,
+		},
+		{
+			name:            "LiteralDeniedCIDR",
+			givenHost:       "10.1.2.3",
+			givenPort:       443,
+			expectedDecided: true,
+		},
+		{
+			name:            "Default",
+			givenHost:       "example.net",
+			givenPort:       443,
+			givenIP:         "192.0.2.1",
+			expectedDecided: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedAllow, observedDecided := acl.decide(tc.givenHost, tc.givenPort, net.ParseIP(tc.givenIP))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedAllow, observedAllow)
+			assert.Equal(t, tc.expectedDecided, observedDecided)
+		})
+	}
+}
+
+func TestACLDecideCountry(t *testing.T) {
+	// Arrange
+
+	db, err := parseMMDB(buildTestMMDB(t, 6, map[string]string{"198.51.100.0/24": "KP"}))
+	require.NoError(t, err)
+	acl := &ACL{GeoIP: &GeoIP{logger: zap.NewNop(), db: db, countries: make(map[uint]string)}}
+	for _, line := range []string{
+		"deny country:KP",
+		"allow *",
+	} {
+		rule, err := parseACLRule(line)
+		require.NoError(t, err)
+		acl.Rules = append(acl.Rules, rule)
+	}
+
+	cases := []struct {
+		name            string
+		givenIP         string
+		expectedAllow   bool
+		expectedDecided bool
+	}{
+		{
+			name: "Unresolved",
+		},
+		{
+			name:            "DeniedCountry",
+			givenIP:         "198.51.100.7",
+			expectedDecided: true,
+		},
+		{
+			name:            "OtherCountry",
+			givenIP:         "192.0.2.1",
+			expectedAllow:   true,
+			expectedDecided: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedAllow, observedDecided := acl.decide("example.com", 443, net.ParseIP(tc.givenIP))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedAllow, observedAllow)
+			assert.Equal(t, tc.expectedDecided, observedDecided)
+		})
+	}
+}
+
+func TestProxyConnectDeniedByACL(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	rule, err := parseACLRule("deny 127.0.0.0/8")
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.ACL = &ACL{Rules: []ACLRule{rule}}
+
+	r := httptest.NewRequest(http.MethodConnect, echoListener.Addr().String(), nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, r)
+
+	// Assert
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "denied by access control rules"))
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultACMEDirectoryURL is the directory of the Let's Encrypt production
+// ACME server.
+const DefaultACMEDirectoryURL = acme.LetsEncryptURL
+
+// Challenge types AutoCert proves control of its hosts with.
+const (
+	// ACMEChallengeTLSALPN01 answers challenges on port 443 during TLS
+	// handshakes negotiating the acme-tls/1 protocol, see RFC 8737.
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+	// ACMEChallengeHTTP01 answers challenges on port 80 via ServeHTTP.
+	ACMEChallengeHTTP01 = "http-01"
+)
+
+const (
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = 10 * time.Minute
+)
+
+// AutoCert obtains and renews the TLS certificates of the proxy for its host
+// names from an ACME server, e.g. Let's Encrypt (RFC 8555), via
+// golang.org/x/crypto/acme/autocert. Its GetCertificate method is meant to be
+// used as tls.Config.GetCertificate of the proxy listener, which answers
+// TLS-ALPN-01 challenges. HTTP-01 challenges are answered by ServeHTTP, which
+// must be served on port 80 of the hosts.
+//
+// The account key and the certificates are cached in CacheDir, so restarts
+// neither register new accounts nor order new certificates.
+type AutoCert struct {
+	Logger *zap.Logger
+	// Hosts are the host names certificates are obtained for. Clients not
+	// indicating a server name are served the certificate of the first.
+	Hosts []string
+	// Email is the contact of the ACME account, none if empty.
+	Email string
+	// DirectoryURL is the directory of the ACME server,
+	// DefaultACMEDirectoryURL if empty.
+	DirectoryURL string
+	// Challenge is the challenge type, ACMEChallengeTLSALPN01 if empty.
+	// TLS-ALPN-01 challenges are answered either way, HTTP-01 challenges
+	// only if Challenge is ACMEChallengeHTTP01.
+	Challenge string
+	// CacheDir is the directory caching the account key and certificates.
+	CacheDir string
+	// RenewBefore is the duration before expiry certificates are renewed
+	// at, 30 days if zero.
+	RenewBefore time.Duration
+	// Client makes requests to the ACME server, http.DefaultClient if nil.
+	Client *http.Client
+	// AcceptTOS agrees to the terms of service of the ACME server on behalf
+	// of the operator, which registering an account requires. Without it,
+	// certificates are only obtained with accounts registered before.
+	AcceptTOS bool
+
+	once        sync.Once
+	manager     *autocert.Manager
+	httpHandler http.Handler
+}
+
+// init sets up the autocert manager of a.
+func (a *AutoCert) init() {
+	a.once.Do(func() {
+		directoryURL := a.DirectoryURL
+		if directoryURL == "" {
+			directoryURL = DefaultACMEDirectoryURL
+		}
+		a.manager = &autocert.Manager{
+			Prompt:      a.prompt,
+			Cache:       autocert.DirCache(a.CacheDir),
+			HostPolicy:  autocert.HostWhitelist(a.Hosts...),
+			RenewBefore: a.RenewBefore,
+			Client:      &acme.Client{DirectoryURL: directoryURL, HTTPClient: a.Client},
+			Email:       a.Email,
+		}
+		// The manager only tries HTTP-01 challenges once its handler was
+		// requested.
+		if a.Challenge == ACMEChallengeHTTP01 {
+			a.httpHandler = a.manager.HTTPHandler(http.NotFoundHandler())
+		} else {
+			a.httpHandler = http.NotFoundHandler()
+		}
+	})
+}
+
+// prompt agrees to the terms of service at tosURL if AcceptTOS is set.
+func (a *AutoCert) prompt(tosURL string) bool {
+	if !a.AcceptTOS {
+		a.Logger.Error("Terms of service of the ACME server not accepted", zap.String("url", tosURL))
+	}
+	return a.AcceptTOS
+}
+
+// GetCertificate returns the certificate of hello.ServerName, obtaining it if
+// none is cached, or the challenge certificate of hello.ServerName for
+// TLS-ALPN-01 challenges.
+func (a *AutoCert) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	a.init()
+	if hello.ServerName == "" && len(a.Hosts) > 0 {
+		named := *hello
+		named.ServerName = a.Hosts[0]
+		hello = &named
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// TLSConfig returns a TLS config serving the certificates of a, negotiating
+// HTTP/2 too if http2 is set.
+func (a *AutoCert) TLSConfig(http2 bool) *tls.Config {
+	config := &tls.Config{GetCertificate: a.GetCertificate, NextProtos: []string{"http/1.1"}}
+	if http2 {
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	}
+	if a.challenge() == ACMEChallengeTLSALPN01 {
+		// The ACME protocol is offered last, so it is only negotiated by
+		// ACME servers validating challenges, which offer nothing else.
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	return config
+}
+
+// ServeHTTP answers HTTP-01 challenges.
+func (a *AutoCert) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.init()
+	a.httpHandler.ServeHTTP(w, r)
+}
+
+func (a *AutoCert) challenge() string {
+	if a.Challenge == "" {
+		return ACMEChallengeTLSALPN01
+	}
+	return a.Challenge
+}
+
+// Run obtains a certificate for every host unless a valid one is cached,
+// until stop is closed. Obtained certificates are renewed by the autocert
+// manager before they expire, and checked again every 12 hours. Failures are
+// logged and retried every 10 minutes.
+func (a *AutoCert) Run(stop <-chan struct{}) {
+	for {
+		wait := acmeCheckInterval
+		if err := a.obtain(); err != nil {
+			wait = acmeRetryInterval
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// obtain gets the certificates of all hosts, loading them from the cache or
+// ordering them, and returns the first error.
+func (a *AutoCert) obtain() error {
+	var firstErr error
+	for _, host := range a.Hosts {
+		cert, err := a.GetCertificate(ecdsaHello(host))
+		if err != nil {
+			a.Logger.Error("Obtaining ACME certificate failed", zap.String("host", host), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		a.Logger.Debug("ACME certificate valid", zap.String("host", host), zap.Time("expires", cert.Leaf.NotAfter))
+	}
+	return firstErr
+}
+
+// ecdsaHello returns the handshake of an ECDSA capable client for host, as
+// most clients are.
+func ecdsaHello(host string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       host,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+}
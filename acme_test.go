@@ -0,0 +1,315 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+// oidACMEIdentifier is the acmeIdentifier extension of TLS-ALPN-01 challenge
+// certificates.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// fakeACME is an ACME server issuing certificates for a single host once its
+// challenge of type challenge is answered by client.
+type fakeACME struct {
+	t         *testing.T
+	server    *httptest.Server
+	client    *AutoCert
+	host      string
+	challenge string
+
+	mu         sync.Mutex
+	thumbprint string
+	authzValid bool
+	certPEM    []byte
+	orders     int
+	badNonces  int
+}
+
+func newFakeACME(t *testing.T, host, challenge string) *fakeACME {
+	f := &fakeACME{t: t, host: host, challenge: challenge, badNonces: 1}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", "nonce")
+	if r.URL.Path == "/directory" {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   f.server.URL + "/nonce",
+			"newAccount": f.server.URL + "/account",
+			"newOrder":   f.server.URL + "/order",
+			"meta":       map[string]string{"termsOfService": f.server.URL + "/terms"},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var jws struct{ Protected, Payload, Signature string }
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&jws))
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	require.NoError(f.t, err)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	require.NoError(f.t, json.Unmarshal(protectedJSON, &protected))
+	assert.Equal(f.t, "ES256", protected.Alg)
+	assert.Equal(f.t, f.server.URL+r.URL.Path, protected.URL)
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	require.NoError(f.t, err)
+
+	if f.badNonces > 0 {
+		f.badNonces--
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce","detail":"stale"}`))
+		return
+	}
+
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": f.host}},
+		"authorizations": []string{f.server.URL + "/authz"},
+		"finalize":       f.server.URL + "/finalize",
+	}
+	switch {
+	case f.certPEM != nil:
+		order["status"] = "valid"
+		order["certificate"] = f.server.URL + "/cert"
+	case f.authzValid:
+		order["status"] = "ready"
+	}
+	challenges := map[string]map[string]string{
+		ACMEChallengeHTTP01:    {"type": ACMEChallengeHTTP01, "url": f.server.URL + "/challenge/http", "token": "http-token", "status": "pending"},
+		ACMEChallengeTLSALPN01: {"type": ACMEChallengeTLSALPN01, "url": f.server.URL + "/challenge/alpn", "token": "alpn-token", "status": "pending"},
+	}
+	authz := map[string]interface{}{
+		"status":     "pending",
+		"identifier": map[string]string{"type": "dns", "value": f.host},
+		"challenges": []map[string]string{challenges[f.challenge]},
+	}
+	if f.authzValid {
+		authz["status"] = "valid"
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		require.NotNil(f.t, protected.JWK)
+		var req struct {
+			TermsOfServiceAgreed bool
+		}
+		require.NoError(f.t, json.Unmarshal(payload, &req))
+		if !req.TermsOfServiceAgreed {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:userActionRequired","detail":"terms of service not agreed"}`))
+			return
+		}
+		b, _ := json.Marshal(protected.JWK)
+		digest := sha256.Sum256(b)
+		f.thumbprint = base64.RawURLEncoding.EncodeToString(digest[:])
+		w.Header().Set("Location", f.server.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		assert.Equal(f.t, f.server.URL+"/account/1", protected.Kid)
+		f.orders++
+		w.Header().Set("Location", f.server.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(order)
+	case "/order/1":
+		w.Header().Set("Location", f.server.URL+"/order/1")
+		_ = json.NewEncoder(w).Encode(order)
+	case "/authz":
+		_ = json.NewEncoder(w).Encode(authz)
+	case "/challenge/http":
+		rec := httptest.NewRecorder()
+		f.client.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+f.host+"/.well-known/acme-challenge/http-token", nil))
+		f.authzValid = rec.Body.String() == "http-token."+f.thumbprint
+		_ = json.NewEncoder(w).Encode(challenges[ACMEChallengeHTTP01])
+	case "/challenge/alpn":
+		cert, err := f.client.GetCertificate(&tls.ClientHelloInfo{ServerName: f.host, SupportedProtos: []string{acme.ALPNProto}})
+		require.NoError(f.t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(f.t, err)
+		digest := sha256.Sum256([]byte("alpn-token." + f.thumbprint))
+		expected, _ := asn1.Marshal(digest[:])
+		for _, ext := range leaf.Extensions {
+			if ext.Id.Equal(oidACMEIdentifier) {
+				f.authzValid = ext.Critical && bytes.Equal(ext.Value, expected)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(challenges[ACMEChallengeTLSALPN01])
+	case "/finalize":
+		var req struct{ CSR string }
+		require.NoError(f.t, json.Unmarshal(payload, &req))
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		require.NoError(f.t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		require.NoError(f.t, err)
+		f.certPEM = f.issue(csr)
+		// The order is processed asynchronously, so clients poll it.
+		order["status"] = "processing"
+		w.Header().Set("Location", f.server.URL+"/order/1")
+		_ = json.NewEncoder(w).Encode(order)
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(f.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// issue returns a certificate for csr, signed by a throwaway CA.
+func (f *fakeACME) issue(csr *x509.CertificateRequest) []byte {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(f.t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	require.NoError(f.t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		// Like Let's Encrypt, the subject common name is added to the names.
+		DNSNames:  []string{csr.Subject.CommonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, caKey)
+	require.NoError(f.t, err)
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+}
+
+func TestAutoCertObtain(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenChallenge string
+		givenAcceptTOS bool
+		expectedError  bool
+	}{
+		{name: "TLSALPN01", givenChallenge: ACMEChallengeTLSALPN01, givenAcceptTOS: true},
+		{name: "HTTP01", givenChallenge: ACMEChallengeHTTP01, givenAcceptTOS: true},
+		{name: "TermsNotAccepted", givenChallenge: ACMEChallengeTLSALPN01, expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			dir, err := ioutil.TempDir("", "acme")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			acmeServer := newFakeACME(t, "proxy.example.com", tc.givenChallenge)
+			defer acmeServer.server.Close()
+			newAutoCert := func() *AutoCert {
+				return &AutoCert{
+					Logger:       zap.NewNop(),
+					Hosts:        []string{"proxy.example.com"},
+					DirectoryURL: acmeServer.server.URL + "/directory",
+					Challenge:    tc.givenChallenge,
+					CacheDir:     dir,
+					AcceptTOS:    tc.givenAcceptTOS,
+				}
+			}
+			a := newAutoCert()
+			acmeServer.client = a
+			restarted := newAutoCert()
+
+			// Act
+
+			err = a.obtain()
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				assert.Equal(t, 0, acmeServer.orders)
+				return
+			}
+			require.NoError(t, err)
+			cert, err := a.GetCertificate(ecdsaHello(""))
+			require.NoError(t, err, "clients without server name get the certificate of the first host")
+			assert.Equal(t, []string{"proxy.example.com"}, cert.Leaf.DNSNames)
+			assert.Len(t, cert.Certificate, 2)
+			_, err = a.GetCertificate(&tls.ClientHelloInfo{ServerName: "proxy.example.com", SupportedProtos: []string{acme.ALPNProto}})
+			assert.Error(t, err, "no challenge is pending")
+
+			require.NoError(t, restarted.obtain())
+			cached, err := restarted.GetCertificate(ecdsaHello("proxy.example.com"))
+			require.NoError(t, err)
+			assert.Equal(t, cert.Certificate, cached.Certificate)
+			assert.Equal(t, 1, acmeServer.orders, "the cached certificate is not renewed")
+			_, err = os.Stat(filepath.Join(dir, "acme_account+key"))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAutoCertTLSConfig(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenChallenge string
+		givenHTTP2     bool
+		expected       []string
+	}{
+		{name: "TLSALPN01", expected: []string{"http/1.1", acme.ALPNProto}},
+		{name: "HTTP2", givenHTTP2: true, expected: []string{"h2", "http/1.1", acme.ALPNProto}},
+		{name: "HTTP01", givenChallenge: ACMEChallengeHTTP01, expected: []string{"http/1.1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &AutoCert{Challenge: tc.givenChallenge}
+
+			// Act
+
+			observed := a.TLSConfig(tc.givenHTTP2)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed.NextProtos)
+		})
+	}
+}
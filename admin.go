@@ -0,0 +1,883 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tunnelReport is an open tunnel as listed by the admin API.
+type tunnelReport struct {
+	ID          uint64 `json:"id"`
+	Client      string `json:"client"`
+	User        string `json:"user,omitempty"`
+	Destination string `json:"destination"`
+	Intercepted bool   `json:"intercepted"`
+	// BytesUp and BytesDown are the bytes received from and sent to the
+	// client so far.
+	BytesUp    uint64    `json:"bytes_up"`
+	BytesDown  uint64    `json:"bytes_down"`
+	Start      time.Time `json:"start"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+// grantRequest adds a grant via the admin API. Exactly one of Expires and
+// TTL must be set.
+type grantRequest struct {
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Port    int       `json:"port"`
+	Expires time.Time `json:"expires"`
+	TTL     string    `json:"ttl"`
+	Reason  string    `json:"reason"`
+}
+
+// debugCaptureRequest adds a debug capture via the admin API. Exactly one of
+// User and Client, and exactly one of Expires and TTL must be set.
+type debugCaptureRequest struct {
+	User    string    `json:"user"`
+	Client  string    `json:"client"`
+	Expires time.Time `json:"expires"`
+	TTL     string    `json:"ttl"`
+	Reason  string    `json:"reason"`
+}
+
+// tunnelDumpRequest adds a tunnel dump via the admin API. At least one of
+// User and Host, and exactly one of Expires and TTL must be set.
+type tunnelDumpRequest struct {
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Expires time.Time `json:"expires"`
+	TTL     string    `json:"ttl"`
+	Reason  string    `json:"reason"`
+}
+
+// aclReport holds ACL rules in the syntax of rules files, see LoadACL.
+type aclReport struct {
+	Rules []string `json:"rules"`
+}
+
+// aclTestRequest is a hypothetical request to evaluate the ACL for.
+type aclTestRequest struct {
+	User        string    `json:"user"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Time        time.Time `json:"time"`
+}
+
+// aclTestReport is the decision on an aclTestRequest.
+type aclTestReport struct {
+	Action string `json:"action"`
+	// Reason is "client" if the client is not allowed, "rule" if Rule
+	// decided, "grant" if Grant allowed a denied destination, and
+	// "default" if no rule matched.
+	Reason     string `json:"reason"`
+	Rule       string `json:"rule,omitempty"`
+	RuleNumber int    `json:"rule_number,omitempty"`
+	Grant      *Grant `json:"grant,omitempty"`
+	// Address is the resolved address the rule matched, if it is on IP
+	// ranges, countries or IP range sets.
+	Address string `json:"address,omitempty"`
+}
+
+// AdminHandler returns a handler of the admin API of p, which must only be
+// served on a listener reachable by operators, and requires AdminToken if
+// set. It serves:
+//
+//	GET    /tunnels       the open tunnels
+//	DELETE /tunnels/{id}  closes the open tunnel id
+//	GET    /acl           the rules of the ACL
+//	PUT    /acl           replaces the rules of the ACL
+//	POST   /acl/test      evaluates the ACL for a hypothetical request
+//	GET    /usage/{user}  the usage of user
+//	GET    /circuits      the open and half-open circuits of the circuit breaker
+//	GET    /recent        the recent closed tunnels and denied destinations
+//	GET    /mitmfallbacks the intercepted hosts relayed untouched after failing
+//	GET    /grants        the temporary grants not expired yet
+//	POST   /grants        adds a temporary grant
+//	DELETE /grants/{id}   revokes the grant id
+//	GET    /captures      the debug captures not expired yet
+//	POST   /captures      adds a debug capture
+//	DELETE /captures/{id} stops the debug capture id
+//	GET    /dumps         the tunnel dumps not expired yet
+//	POST   /dumps         adds a tunnel dump
+//	DELETE /dumps/{id}    stops the tunnel dump id
+//	GET    /tuning        the relay buffer size, tunnel cap and connection limit
+//	PUT    /tuning        changes the relay buffer size, tunnel cap or connection limit
+//
+// Responses are JSON, and so must the bodies of PUT and POST requests be, as
+// declared by their Content-Type, so browsers can not be made to send them
+// cross-origin without a CORS preflight. Rules of the ACL are given in the syntax of rules
+// files, e.g. {"rules": ["allow *.example.com:443", "deny *"]}. Grants are
+// added with either an expiry time or a TTL, e.g. {"user": "alice", "host":
+// "blocked-host.example.com", "port": 443, "ttl": "2h", "reason": "INC-42"},
+// and so are debug captures of either a user or a client IP address, e.g.
+// {"client": "192.0.2.1", "ttl": "15m", "reason": "INC-43"}, and tunnel
+// dumps of a user, destinations matching a host pattern or both. ACL tests
+// are given the user, client IP address, destination host and port and time
+// of a request, e.g. {"user": "alice", "client": "192.0.2.1",
+// "destination": "www.example.com:443", "time": "2018-06-01T09:00:00Z"},
+// each optional but the destination, and need the read scope only. Tuning
+// changes only the limits given, e.g. {"max_tunnels": 5000}, within bounds,
+// and lasts until the proxy restarts.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", p.serveAdminTunnels)
+	mux.HandleFunc("/tunnels/", p.serveAdminTunnel)
+	mux.HandleFunc("/acl", p.serveAdminACL)
+	mux.HandleFunc("/acl/test", p.serveAdminACLTest)
+	mux.HandleFunc("/usage/", p.serveAdminUsage)
+	mux.HandleFunc("/circuits", p.serveAdminCircuits)
+	mux.HandleFunc("/recent", p.serveAdminRecent)
+	mux.HandleFunc("/mitmfallbacks", p.serveAdminInterceptFallbacks)
+	mux.HandleFunc("/grants", p.serveAdminGrants)
+	mux.HandleFunc("/grants/", p.serveAdminGrant)
+	mux.HandleFunc("/captures", p.serveAdminCaptures)
+	mux.HandleFunc("/captures/", p.serveAdminCapture)
+	mux.HandleFunc("/dumps", p.serveAdminDumps)
+	mux.HandleFunc("/dumps/", p.serveAdminDump)
+	mux.HandleFunc("/tuning", p.serveAdminTuning)
+	return p.RequireAdminToken(mux)
+}
+
+// AdminScope is the scope of an admin API token, each scope including the
+// lower ones.
+type AdminScope int
+
+// Scopes of admin API tokens.
+const (
+	// AdminScopeRead allows GET and HEAD requests, except for profiles,
+	// e.g. for dashboards.
+	AdminScopeRead AdminScope = iota + 1
+	// AdminScopeWrite also allows changing the ACL, grants, debug
+	// captures, tunnel dumps and tuning.
+	AdminScopeWrite
+	// AdminScopeKill also allows closing tunnels and reading profiles, as
+	// AdminToken does.
+	AdminScopeKill
+)
+
+var adminScopeNames = map[string]AdminScope{
+	"read":  AdminScopeRead,
+	"write": AdminScopeWrite,
+	"kill":  AdminScopeKill,
+}
+
+// LoadAdminTokens reads scoped admin API tokens from the file at path, see
+// Proxy.AdminTokens. Each non-empty line not starting with '#' holds a scope,
+// "read", "write" or "kill", followed by a token, e.g.:
+//
+//	read 6f1c8e0a2b5d4f7e9a3c1b0d8e6f4a2c
+//	kill 9b7d5f3e1a0c8e6b4d2f0a9c7e5b3d1f
+func LoadAdminTokens(path string) (map[string]AdminScope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]AdminScope{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed token", path, n)
+		}
+		scope, ok := adminScopeNames[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown scope %q", path, n, fields[0])
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, n)
+		}
+		tokens[fields[1]] = scope
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// adminScopeOf returns the scope required by the admin API request r.
+func adminScopeOf(r *http.Request) AdminScope {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/debug/"):
+		return AdminScopeKill
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return AdminScopeRead
+	case r.URL.Path == "/acl/test":
+		// Dry runs change nothing.
+		return AdminScopeRead
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/tunnels/"):
+		return AdminScopeKill
+	}
+	return AdminScopeWrite
+}
+
+// adminTokenScope returns the scope of the bearer token of the Authorization
+// header value auth, or 0 if it is no valid token. All tokens are compared in
+// constant time.
+func (p *Proxy) adminTokenScope(auth string) AdminScope {
+	var scope AdminScope
+	if p.AdminToken != "" && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+p.AdminToken)) == 1 {
+		scope = AdminScopeKill
+	}
+	for token, s := range p.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1 && s > scope {
+			scope = s
+		}
+	}
+	return scope
+}
+
+// RequireAdminToken returns a handler serving requests via h only if they
+// carry AdminToken, or one of AdminTokens of a scope allowing them, as bearer
+// token in their Authorization header. Requests without a valid token are
+// answered with 401 Unauthorized, and requests beyond the scope of their
+// token with 403 Forbidden. All requests are served if neither AdminToken
+// nor AdminTokens are set.
+func (p *Proxy) RequireAdminToken(h http.Handler) http.Handler {
+	if p.AdminToken == "" && len(p.AdminTokens) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := p.adminTokenScope(r.Header.Get("Authorization"))
+		if scope == 0 {
+			p.Logger.Warn("Admin API request with invalid token", zap.String("client", r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if scope < adminScopeOf(r) {
+			p.Logger.Warn("Admin API request beyond the scope of its token",
+				zap.String("client", r.RemoteAddr), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) serveAdminTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	tunnels := p.tunnels.list()
+	reports := make([]tunnelReport, len(tunnels))
+	for i, t := range tunnels {
+		reports[i] = tunnelReport{
+			ID:          t.id,
+			User:        t.user,
+			Destination: t.host,
+			Intercepted: t.dest == nil,
+			BytesUp:     atomic.LoadUint64(&t.bytesUp),
+			BytesDown:   atomic.LoadUint64(&t.bytesDown),
+			Start:       t.start,
+			AgeSeconds:  now.Sub(t.start).Seconds(),
+		}
+		if t.client != nil {
+			reports[i].Client = t.client.RemoteAddr().String()
+		}
+	}
+	p.writeAdminJSON(w, reports)
+}
+
+func (p *Proxy) serveAdminTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/tunnels/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.tunnels.close(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p.Logger.Info("Tunnel closed via admin API", zap.Uint64("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) serveAdminACL(w http.ResponseWriter, r *http.Request) {
+	if p.ACL == nil {
+		http.Error(w, "No ACL configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req aclReport
+		if !decodeAdminJSON(w, r, &req) {
+			return
+		}
+		rules := make([]ACLRule, len(req.Rules))
+		for i, line := range req.Rules {
+			rule, err := parseACLRule(line)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("rule %d: %v", i+1, err), http.StatusBadRequest)
+				return
+			}
+			rules[i] = rule
+		}
+		p.ACL.SetRules(rules)
+		p.Logger.Info("ACL rules replaced via admin API", zap.Int("rules", len(rules)))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := p.ACL.rules()
+	report := aclReport{Rules: make([]string, len(rules))}
+	for i, rule := range rules {
+		report.Rules[i] = rule.String()
+	}
+	p.writeAdminJSON(w, report)
+}
+
+func (p *Proxy) serveAdminACLTest(w http.ResponseWriter, r *http.Request) {
+	if p.ACL == nil {
+		http.Error(w, "No ACL configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req aclTestRequest
+	if !decodeAdminJSON(w, r, &req) {
+		return
+	}
+	host, portName, err := net.SplitHostPort(req.Destination)
+	if err != nil || host == "" {
+		http.Error(w, "destination must be a host and port", http.StatusBadRequest)
+		return
+	}
+	port, err := net.LookupPort("tcp", portName)
+	if err != nil {
+		http.Error(w, "invalid destination port: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var clientIP net.IP
+	if req.Client != "" {
+		if clientIP = net.ParseIP(req.Client); clientIP == nil {
+			http.Error(w, "client must be an IP address", http.StatusBadRequest)
+			return
+		}
+	}
+	at := req.Time
+	if at.IsZero() && p.Grants != nil {
+		at = p.Grants.clock()
+	}
+
+	report, err := p.testACL(r.Context(), req.User, clientIP, host, port, at)
+	if err != nil {
+		http.Error(w, "resolving destination failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	p.writeAdminJSON(w, report)
+}
+
+// testACL evaluates the ACL like checkDestACL for a request of user from
+// clientIP, if not nil, to host and port at the given time, without logging
+// or counting it.
+func (p *Proxy) testACL(ctx context.Context, user string, clientIP net.IP, host string, port int, at time.Time) (aclTestReport, error) {
+	if clientIP != nil {
+		if len(p.AllowedClientCIDRs) > 0 && !containsIP(p.AllowedClientCIDRs, clientIP) {
+			return aclTestReport{Action: "deny", Reason: "client"}, nil
+		}
+		if len(p.AllowedClientCountries) > 0 && !containsCountry(p.AllowedClientCountries, p.GeoIP.Country(clientIP)) {
+			return aclTestReport{Action: "deny", Reason: "client"}, nil
+		}
+	}
+
+	var address string
+	rule, i, decided := p.ACL.match(host, port, nil, false)
+	if !decided && p.Upstream != nil {
+		rule, i, _ = p.ACL.match(host, port, nil, true)
+	} else if !decided {
+		ips, err := p.lookupIPAddr(ctx, host)
+		if err != nil {
+			return aclTestReport{}, err
+		}
+		// The first address denied decides, as in checkDestACL, or else the
+		// first address.
+		for j, ip := range ips {
+			ipRule, n, _ := p.ACL.match(host, port, ip.IP, false)
+			denied := n >= 0 && !ipRule.Allow
+			if j == 0 || denied {
+				rule, i, address = ipRule, n, ""
+				if n >= 0 && ipRule.Host == "" {
+					address = ip.IP.String()
+				}
+			}
+			if denied {
+				break
+			}
+		}
+	}
+
+	report := aclTestReport{Action: "allow", Reason: "default"}
+	if i >= 0 {
+		report = aclTestReport{Action: "deny", Reason: "rule", Rule: rule.String(), RuleNumber: i + 1, Address: address}
+		if rule.Allow {
+			report.Action = "allow"
+		}
+	}
+	if report.Action == "deny" {
+		if grant, ok := p.Grants.findAt(user, host, port, at); ok {
+			report.Action, report.Reason, report.Grant = "allow", "grant", &grant
+		}
+	}
+	return report, nil
+}
+
+func (p *Proxy) serveAdminUsage(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(r.URL.Path, "/usage/")
+	if user == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.writeAdminJSON(w, p.usage(user))
+}
+
+func (p *Proxy) serveAdminCircuits(w http.ResponseWriter, r *http.Request) {
+	if p.CircuitBreaker == nil {
+		http.Error(w, "No circuit breaker configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	reports := p.CircuitBreaker.open()
+	if reports == nil {
+		reports = []circuitReport{}
+	}
+	p.writeAdminJSON(w, reports)
+}
+
+func (p *Proxy) serveAdminRecent(w http.ResponseWriter, r *http.Request) {
+	if p.Recent == nil {
+		http.Error(w, "No recent events kept", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.writeAdminJSON(w, p.Recent.List())
+}
+
+func (p *Proxy) serveAdminInterceptFallbacks(w http.ResponseWriter, r *http.Request) {
+	if p.Interceptor == nil || p.Interceptor.Fallbacks == nil {
+		http.Error(w, "No interception fallbacks configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.writeAdminJSON(w, p.Interceptor.Fallbacks.List())
+}
+
+func (p *Proxy) serveAdminGrants(w http.ResponseWriter, r *http.Request) {
+	if p.Grants == nil {
+		http.Error(w, "No grants configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.writeAdminJSON(w, p.Grants.List())
+	case http.MethodPost:
+		var req grantRequest
+		if !decodeAdminJSON(w, r, &req) {
+			return
+		}
+		grant, err := req.grant(p.Grants.clock())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		grant = p.Grants.Add(grant)
+		p.Logger.Info("Grant added via admin API",
+			zap.Uint64("id", grant.ID),
+			zap.String("user", grant.User),
+			zap.String("host", grant.Host),
+			zap.Int("port", grant.Port),
+			zap.Time("expires", grant.Expires),
+			zap.String("reason", grant.Reason))
+		w.WriteHeader(http.StatusCreated)
+		p.writeAdminJSON(w, grant)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) serveAdminGrant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/grants/"), 10, 64)
+	if err != nil || p.Grants == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.Grants.Revoke(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p.Logger.Info("Grant revoked via admin API", zap.Uint64("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) serveAdminCaptures(w http.ResponseWriter, r *http.Request) {
+	if p.DebugCaptures == nil {
+		http.Error(w, "No debug captures configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.writeAdminJSON(w, p.DebugCaptures.List())
+	case http.MethodPost:
+		var req debugCaptureRequest
+		if !decodeAdminJSON(w, r, &req) {
+			return
+		}
+		capture, err := req.capture(p.DebugCaptures.clock())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		capture = p.DebugCaptures.Add(capture)
+		p.Logger.Info("Debug capture added via admin API",
+			zap.Uint64("id", capture.ID),
+			zap.String("user", capture.User),
+			zap.String("client", capture.Client),
+			zap.Time("expires", capture.Expires),
+			zap.String("reason", capture.Reason))
+		w.WriteHeader(http.StatusCreated)
+		p.writeAdminJSON(w, capture)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) serveAdminCapture(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/captures/"), 10, 64)
+	if err != nil || p.DebugCaptures == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.DebugCaptures.Stop(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p.Logger.Info("Debug capture stopped via admin API", zap.Uint64("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) serveAdminDumps(w http.ResponseWriter, r *http.Request) {
+	if p.TunnelDumps == nil {
+		http.Error(w, "No tunnel dumps configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.writeAdminJSON(w, p.TunnelDumps.List())
+	case http.MethodPost:
+		var req tunnelDumpRequest
+		if !decodeAdminJSON(w, r, &req) {
+			return
+		}
+		dump, err := req.dump(p.TunnelDumps.clock())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dump = p.TunnelDumps.Add(dump)
+		p.Logger.Warn("Tunnel dump added via admin API",
+			zap.Uint64("id", dump.ID),
+			zap.String("user", dump.User),
+			zap.String("host", dump.Host),
+			zap.Time("expires", dump.Expires),
+			zap.String("reason", dump.Reason))
+		w.WriteHeader(http.StatusCreated)
+		p.writeAdminJSON(w, dump)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) serveAdminDump(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/dumps/"), 10, 64)
+	if err != nil || p.TunnelDumps == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.TunnelDumps.Stop(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p.Logger.Info("Tunnel dump stopped via admin API", zap.Uint64("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grant returns the grant requested by req at now.
+func (req *grantRequest) grant(now time.Time) (Grant, error) {
+	grant := Grant{
+		User:    req.User,
+		Host:    strings.ToLower(req.Host),
+		Port:    req.Port,
+		Expires: req.Expires,
+		Reason:  req.Reason,
+	}
+	if grant.User == "" || grant.Host == "" {
+		return Grant{}, fmt.Errorf("user and host are required")
+	}
+	if grant.Port < 0 || grant.Port > 65535 {
+		return Grant{}, fmt.Errorf("invalid port %d", grant.Port)
+	}
+	if (req.TTL == "") == req.Expires.IsZero() {
+		return Grant{}, fmt.Errorf("either expires or ttl is required")
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return Grant{}, err
+		}
+		grant.Expires = now.Add(ttl)
+	}
+	if !now.Before(grant.Expires) {
+		return Grant{}, fmt.Errorf("grant expires in the past")
+	}
+	return grant, nil
+}
+
+// capture returns the capture requested by req at now.
+func (req *debugCaptureRequest) capture(now time.Time) (DebugCapture, error) {
+	capture := DebugCapture{User: req.User, Expires: req.Expires, Reason: req.Reason}
+	if (req.User == "") == (req.Client == "") {
+		return DebugCapture{}, fmt.Errorf("either user or client is required")
+	}
+	if req.Client != "" {
+		ip := net.ParseIP(req.Client)
+		if ip == nil {
+			return DebugCapture{}, fmt.Errorf("invalid client IP address %q", req.Client)
+		}
+		capture.Client = ip.String()
+	}
+	if (req.TTL == "") == req.Expires.IsZero() {
+		return DebugCapture{}, fmt.Errorf("either expires or ttl is required")
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return DebugCapture{}, err
+		}
+		capture.Expires = now.Add(ttl)
+	}
+	if !now.Before(capture.Expires) {
+		return DebugCapture{}, fmt.Errorf("capture expires in the past")
+	}
+	if capture.Expires.Sub(now) > MaxDebugCaptureTTL {
+		return DebugCapture{}, fmt.Errorf("capture exceeds the maximum duration of %s", MaxDebugCaptureTTL)
+	}
+	return capture, nil
+}
+
+// dump returns the tunnel dump requested by req at now.
+func (req *tunnelDumpRequest) dump(now time.Time) (TunnelDump, error) {
+	dump := TunnelDump{User: req.User, Host: strings.ToLower(req.Host), Expires: req.Expires, Reason: req.Reason}
+	if dump.User == "" && dump.Host == "" {
+		return TunnelDump{}, fmt.Errorf("user or host is required")
+	}
+	if (req.TTL == "") == req.Expires.IsZero() {
+		return TunnelDump{}, fmt.Errorf("either expires or ttl is required")
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return TunnelDump{}, err
+		}
+		dump.Expires = now.Add(ttl)
+	}
+	if !now.Before(dump.Expires) {
+		return TunnelDump{}, fmt.Errorf("dump expires in the past")
+	}
+	if dump.Expires.Sub(now) > MaxTunnelDumpTTL {
+		return TunnelDump{}, fmt.Errorf("dump exceeds the maximum duration of %s", MaxTunnelDumpTTL)
+	}
+	return dump, nil
+}
+
+// Bounds of the limits changed via the admin API, besides the relay buffer
+// size bounded by MinRelayBufferSize and MaxRelayBufferSize.
+const (
+	maxTunedTunnels           = 1 << 20
+	maxTunedConns             = 1 << 20
+	maxTunedConnsQueueTimeout = time.Minute
+)
+
+// tuningReport holds the limits of a proxy changeable at runtime, omitting
+// those of subsystems not configured.
+type tuningReport struct {
+	RelayBufferSize      *int   `json:"relay_buffer_size,omitempty"`
+	MaxTunnels           *int   `json:"max_tunnels,omitempty"`
+	MaxConns             *int   `json:"max_conns,omitempty"`
+	MaxConnsQueueTimeout string `json:"max_conns_queue_timeout,omitempty"`
+}
+
+func (p *Proxy) serveAdminTuning(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req tuningReport
+		if !decodeAdminJSON(w, r, &req) {
+			return
+		}
+		if err := p.tune(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	size := p.relayBufferSize()
+	report := tuningReport{RelayBufferSize: &size}
+	if p.TunnelCap != nil {
+		max := p.TunnelCap.Limit()
+		report.MaxTunnels = &max
+	}
+	if p.ConnLimit != nil {
+		max, queueTimeout := p.ConnLimit.Limits()
+		report.MaxConns = &max
+		report.MaxConnsQueueTimeout = queueTimeout.String()
+	}
+	p.writeAdminJSON(w, report)
+}
+
+// tune applies the limits given by req, or none of them if any is out of
+// bounds or of a subsystem not configured.
+func (p *Proxy) tune(req *tuningReport) error {
+	if req.RelayBufferSize != nil && (*req.RelayBufferSize < MinRelayBufferSize || *req.RelayBufferSize > MaxRelayBufferSize) {
+		return fmt.Errorf("relay_buffer_size must be between %d and %d", MinRelayBufferSize, MaxRelayBufferSize)
+	}
+	if req.MaxTunnels != nil {
+		if p.TunnelCap == nil {
+			return fmt.Errorf("no tunnel cap configured")
+		}
+		if *req.MaxTunnels < 1 || *req.MaxTunnels > maxTunedTunnels {
+			return fmt.Errorf("max_tunnels must be between 1 and %d", maxTunedTunnels)
+		}
+	}
+	var queueTimeout time.Duration
+	if req.MaxConns != nil || req.MaxConnsQueueTimeout != "" {
+		if p.ConnLimit == nil {
+			return fmt.Errorf("no connection limit configured")
+		}
+		if req.MaxConns != nil && (*req.MaxConns < 1 || *req.MaxConns > maxTunedConns) {
+			return fmt.Errorf("max_conns must be between 1 and %d", maxTunedConns)
+		}
+		if req.MaxConnsQueueTimeout != "" {
+			var err error
+			if queueTimeout, err = time.ParseDuration(req.MaxConnsQueueTimeout); err != nil {
+				return err
+			}
+			if queueTimeout < 0 || queueTimeout > maxTunedConnsQueueTimeout {
+				return fmt.Errorf("max_conns_queue_timeout must be between 0s and %s", maxTunedConnsQueueTimeout)
+			}
+		}
+	}
+
+	if req.RelayBufferSize != nil {
+		p.SetRelayBufferSize(*req.RelayBufferSize)
+		p.Logger.Info("Relay buffer size changed via admin API", zap.Int("size", *req.RelayBufferSize))
+	}
+	if req.MaxTunnels != nil {
+		p.TunnelCap.SetMax(*req.MaxTunnels)
+		p.Logger.Info("Tunnel cap changed via admin API", zap.Int("max", *req.MaxTunnels))
+	}
+	if req.MaxConns != nil || req.MaxConnsQueueTimeout != "" {
+		max, oldQueueTimeout := p.ConnLimit.Limits()
+		if req.MaxConns != nil {
+			max = *req.MaxConns
+		}
+		if req.MaxConnsQueueTimeout == "" {
+			queueTimeout = oldQueueTimeout
+		}
+		p.ConnLimit.SetLimits(max, queueTimeout)
+		p.Logger.Info("Connection limit changed via admin API", zap.Int("max", max), zap.Duration("queue_timeout", queueTimeout))
+	}
+	return nil
+}
+
+// decodeAdminJSON decodes the JSON body of r into v, answering r with an error
+// and returning false if the body is not declared as JSON or malformed.
+func decodeAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.Logger.Warn("Writing admin API response failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,589 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminTunnels(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	p := newTestProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	admin := p.AdminHandler()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	dest := echoListener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	fmt.Fprint(conn, "ping\n")
+	_, err = br.ReadString('\n')
+	require.NoError(t, err)
+
+	// Act
+
+	// The echoed bytes are counted only once written, which races with the
+	// client reading them.
+	var w *httptest.ResponseRecorder
+	var listed []tunnelReport
+	for deadline := time.Now().Add(time.Second); ; {
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tunnels", nil))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+		if len(listed) != 1 || listed[0].BytesDown == 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closeTunnel := func(id uint64) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/tunnels/%d", id), nil))
+		return w.Code
+	}
+	require.Len(t, listed, 1)
+	closedCode := closeTunnel(listed[0].ID)
+	missingCode := closeTunnel(listed[0].ID + 1)
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, dest, listed[0].Destination)
+	assert.Equal(t, conn.LocalAddr().String(), listed[0].Client)
+	assert.False(t, listed[0].Intercepted)
+	assert.Equal(t, uint64(5), listed[0].BytesUp)
+	assert.Equal(t, uint64(5), listed[0].BytesDown)
+	assert.True(t, listed[0].AgeSeconds >= 0)
+	assert.Equal(t, http.StatusNoContent, closedCode)
+	assert.Equal(t, http.StatusNotFound, missingCode)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.Error(t, err, "closed tunnel")
+}
+
+func TestAdminACL(t *testing.T) {
+	cases := []struct {
+		name             string
+		givenMethod      string
+		givenContentType string
+		givenBody        string
+		expectedStatus   int
+		expectedRules    []string
+	}{
+		{
+			name:           "Get",
+			givenMethod:    http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expectedRules:  []string{"deny 10.0.0.0/8"},
+		},
+		{
+			name:             "Put",
+			givenMethod:      http.MethodPut,
+			givenContentType: "application/json; charset=utf-8",
+			givenBody:        `{"rules": ["allow *.Example.com:443", "deny *"]}`,
+			expectedStatus:   http.StatusOK,
+			expectedRules:    []string{"allow *.example.com:443", "deny *"},
+		},
+		{
+			name:             "PutMalformed",
+			givenMethod:      http.MethodPut,
+			givenContentType: "application/json",
+			givenBody:        `{"rules": ["allow *.example.com:443", "permit *"]}`,
+			expectedStatus:   http.StatusBadRequest,
+			expectedRules:    []string{"deny 10.0.0.0/8"},
+		},
+		{
+			name:             "PutNotJSON",
+			givenMethod:      http.MethodPut,
+			givenContentType: "text/plain",
+			givenBody:        `{"rules": ["allow *"]}`,
+			expectedStatus:   http.StatusUnsupportedMediaType,
+			expectedRules:    []string{"deny 10.0.0.0/8"},
+		},
+		{
+			name:           "PutUndeclared",
+			givenMethod:    http.MethodPut,
+			givenBody:      `{"rules": ["allow *"]}`,
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedRules:  []string{"deny 10.0.0.0/8"},
+		},
+		{
+			name:           "Delete",
+			givenMethod:    http.MethodDelete,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedRules:  []string{"deny 10.0.0.0/8"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			rule, err := parseACLRule("deny 10.0.0.0/8")
+			require.NoError(t, err)
+			p := newTestProxy()
+			p.ACL = &ACL{Rules: []ACLRule{rule}}
+			r := httptest.NewRequest(tc.givenMethod, "/acl", strings.NewReader(tc.givenBody))
+			if tc.givenContentType != "" {
+				r.Header.Set("Content-Type", tc.givenContentType)
+			}
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.AdminHandler().ServeHTTP(w, r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			rules := p.ACL.rules()
+			observed := make([]string, len(rules))
+			for i, rule := range rules {
+				observed[i] = rule.String()
+			}
+			assert.Equal(t, tc.expectedRules, observed)
+		})
+	}
+}
+
+func TestAdminACLTest(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenBody      string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "Rule",
+			givenBody:      `{"destination": "www.example.com:443"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"action": "allow", "reason": "rule", "rule": "allow *.example.com:443", "rule_number": 1}`,
+		},
+		{
+			name:           "Resolved",
+			givenBody:      `{"destination": "api.internal.test:https"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"action": "deny", "reason": "rule", "rule": "deny 198.51.100.0/24", "rule_number": 2, "address": "198.51.100.1"}`,
+		},
+		{
+			name:           "Grant",
+			givenBody:      `{"user": "alice", "destination": "api.internal.test:443", "time": "2018-06-01T11:00:00Z"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"action": "allow", "reason": "grant", "rule": "deny 198.51.100.0/24", "rule_number": 2, "address": "198.51.100.1", "grant": {"id": 1, "user": "alice", "host": "api.internal.test", "expires": "2018-06-01T12:00:00Z"}}`,
+		},
+		{
+			name:           "GrantExpired",
+			givenBody:      `{"user": "alice", "destination": "api.internal.test:443", "time": "2018-06-01T13:00:00Z"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"action": "deny", "reason": "rule", "rule": "deny 198.51.100.0/24", "rule_number": 2, "address": "198.51.100.1"}`,
+		},
+		{
+			name:           "Client",
+			givenBody:      `{"client": "192.0.2.9", "destination": "www.example.com:443"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"action": "deny", "reason": "client"}`,
+		},
+		{
+			name:           "NoPort",
+			givenBody:      `{"destination": "www.example.com"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.ACL = &ACL{}
+			for _, line := range []string{"allow *.example.com:443", "deny 198.51.100.0/24", "allow *"} {
+				rule, err := parseACLRule(line)
+				require.NoError(t, err)
+				p.ACL.Rules = append(p.ACL.Rules, rule)
+			}
+			p.Resolver = &Resolver{Workers: 1, QueueSize: 1, lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 1)}, {IP: net.IPv4(198, 51, 100, 1)}}, nil
+			}}
+			p.AllowedClientCIDRs, _ = ParseCIDRs("10.0.0.0/8")
+			p.Grants = &Grants{}
+			p.Grants.Add(Grant{User: "alice", Host: "api.internal.test", Expires: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)})
+			r := httptest.NewRequest(http.MethodPost, "/acl/test", strings.NewReader(tc.givenBody))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.AdminHandler().ServeHTTP(w, r)
+
+			// Assert
+
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			if tc.expected != "" {
+				assert.JSONEq(t, tc.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminTuning(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenMethod    string
+		givenBody      string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "Get",
+			givenMethod:    http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expected:       `{"relay_buffer_size":32768,"max_tunnels":100,"max_conns":200,"max_conns_queue_timeout":"1s"}`,
+		},
+		{
+			name:           "Put",
+			givenMethod:    http.MethodPut,
+			givenBody:      `{"relay_buffer_size": 65536, "max_tunnels": 500, "max_conns_queue_timeout": "5s"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"relay_buffer_size":65536,"max_tunnels":500,"max_conns":200,"max_conns_queue_timeout":"5s"}`,
+		},
+		{
+			name:           "PutRelayBufferSizeOutOfBounds",
+			givenMethod:    http.MethodPut,
+			givenBody:      `{"relay_buffer_size": 512, "max_tunnels": 500}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "PutMaxConnsOutOfBounds",
+			givenMethod:    http.MethodPut,
+			givenBody:      `{"max_conns": 0}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "PutQueueTimeoutOutOfBounds",
+			givenMethod:    http.MethodPut,
+			givenBody:      `{"max_conns_queue_timeout": "1h"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Delete",
+			givenMethod:    http.MethodDelete,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.TunnelCap = NewTunnelCap(100)
+			p.ConnLimit = &ConnLimit{Max: 200, QueueTimeout: time.Second}
+			r := httptest.NewRequest(tc.givenMethod, "/tuning", strings.NewReader(tc.givenBody))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.AdminHandler().ServeHTTP(w, r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expected != "" {
+				assert.JSONEq(t, tc.expected, w.Body.String())
+			}
+			if tc.expectedStatus == http.StatusBadRequest {
+				assert.Equal(t, DefaultRelayBufferSize, p.relayBufferSize(), "out of bounds requests change nothing")
+				assert.Equal(t, 100, p.TunnelCap.Limit())
+			}
+		})
+	}
+}
+
+func TestAdminTuningNotConfigured(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	r := httptest.NewRequest(http.MethodPut, "/tuning", strings.NewReader(`{"max_tunnels": 500}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.AdminHandler().ServeHTTP(w, r)
+
+	// Assert
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "no tunnel cap configured")
+}
+
+func TestAdminUsage(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.tunnels.add(context.Background(), &tunnelConns{user: "alice"})
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/usage/alice", nil))
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var observed usageReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &observed))
+	assert.Equal(t, "alice", observed.User)
+	assert.Equal(t, 1, observed.ActiveTunnels)
+}
+
+func TestAdminCircuits(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.CircuitBreaker = NewCircuitBreaker(1, time.Minute)
+	p.CircuitBreaker.failed("down.example.com")
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/circuits", nil))
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var observed []circuitReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &observed))
+	require.Len(t, observed, 1)
+	assert.Equal(t, "down.example.com", observed[0].Destination)
+	assert.Equal(t, circuitOpen, observed[0].State)
+}
+
+func TestAdminRecent(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.Recent = NewRecentEvents(10)
+	var err error
+	p.Blocklist, err = NewBlocklist([]string{"blocked.example.com"})
+	require.NoError(t, err)
+	p.Recent.tunnelClosed(&AccessRecord{Client: "192.0.2.1", User: "alice", Destination: "example.com:443", Reason: reasonClientClosed})
+	_, err = p.DialContext(p.withDialUser(context.Background(), "bob"), "tcp", "blocked.example.com:443")
+	require.Error(t, err)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/recent", nil))
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var observed []RecentEvent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &observed))
+	require.Len(t, observed, 2)
+	assert.Equal(t, recentTunnel, observed[0].Kind)
+	assert.Equal(t, "alice", observed[0].User)
+	assert.Equal(t, reasonClientClosed, observed[0].Reason)
+	assert.Equal(t, recentDenied, observed[1].Kind)
+	assert.Equal(t, "bob", observed[1].User)
+	assert.Equal(t, "blocked.example.com:443", observed[1].Destination)
+	assert.Equal(t, err.Error(), observed[1].Reason)
+}
+
+func TestAdminToken(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenToken     string
+		givenHeader    string
+		expectedStatus int
+	}{
+		{
+			name:           "Disabled",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Valid",
+			givenToken:     "s3cret",
+			givenHeader:    "Bearer s3cret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Invalid",
+			givenToken:     "s3cret",
+			givenHeader:    "Bearer s3cre",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Missing",
+			givenToken:     "s3cret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.AdminToken = tc.givenToken
+			r := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+			if tc.givenHeader != "" {
+				r.Header.Set("Authorization", tc.givenHeader)
+			}
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.AdminHandler().ServeHTTP(w, r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedStatus == http.StatusUnauthorized {
+				assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAdminTokenScopes(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenToken     string
+		givenMethod    string
+		givenPath      string
+		expectedStatus int
+	}{
+		{
+			name:           "ReadGet",
+			givenToken:     "reader",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/tunnels",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "ReadPut",
+			givenToken:     "reader",
+			givenMethod:    http.MethodPut,
+			givenPath:      "/tuning",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "ReadProfiles",
+			givenToken:     "reader",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/debug/pprof/",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "WritePut",
+			givenToken:     "writer",
+			givenMethod:    http.MethodPut,
+			givenPath:      "/tuning",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "WriteKill",
+			givenToken:     "writer",
+			givenMethod:    http.MethodDelete,
+			givenPath:      "/tunnels/1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "KillKill",
+			givenToken:     "killer",
+			givenMethod:    http.MethodDelete,
+			givenPath:      "/tunnels/1",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "AdminTokenKill",
+			givenToken:     "s3cret",
+			givenMethod:    http.MethodDelete,
+			givenPath:      "/tunnels/1",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Unknown",
+			givenToken:     "guesser",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/tunnels",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.AdminToken = "s3cret"
+			p.AdminTokens = map[string]AdminScope{"reader": AdminScopeRead, "writer": AdminScopeWrite, "killer": AdminScopeKill}
+			mux := http.NewServeMux()
+			mux.Handle("/", p.AdminHandler())
+			mux.Handle("/debug/", p.RequireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			r := httptest.NewRequest(tc.givenMethod, tc.givenPath, strings.NewReader("{}"))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", "Bearer "+tc.givenToken)
+			w := httptest.NewRecorder()
+
+			// Act
+
+			mux.ServeHTTP(w, r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestLoadAdminTokens(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "admintokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Dashboards\nread r3ad\n\nKILL k1ll\n"), 0600))
+	invalidPath := filepath.Join(dir, "invalid")
+	require.NoError(t, ioutil.WriteFile(invalidPath, []byte("admin s3cret\n"), 0600))
+
+	// Act
+
+	tokens, err := LoadAdminTokens(path)
+	_, invalidErr := LoadAdminTokens(invalidPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AdminScope{"r3ad": AdminScopeRead, "k1ll": AdminScopeKill}, tokens)
+	assert.Error(t, invalidErr)
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// ErrInvalidCredentials is returned by authenticators when the credentials
+// of a client are not valid, as opposed to the credential store failing.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is the identity of an authenticated client.
+type Identity struct {
+	// User is the name the client is known by, e.g. in logs, egress budgets
+	// and identity assertions.
+	User string
+}
+
+// Authenticator checks the credentials of proxy clients against a credential
+// store.
+type Authenticator interface {
+	// Authenticate returns the identity of the client authenticating as user
+	// with pass, or ErrInvalidCredentials if the credentials are not valid.
+	// r is the request being authenticated, or nil for SOCKS clients.
+	Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error)
+}
+
+// StaticAuthenticator authenticates clients against a single pair of
+// credentials.
+type StaticAuthenticator struct {
+	User string
+	Pass string
+}
+
+// Authenticate implements Authenticator.
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error) {
+	// Both comparisons are always made, so timing does not reveal which one
+	// failed.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Pass)) == 1
+	if !userOK || !passOK {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: user}, nil
+}
+
+// HandshakeAuthenticator authenticates clients via a connection-oriented
+// scheme which may take several round trips, e.g. NTLM or Negotiate
+// (Kerberos via SPNEGO). The handshake steps are exchanged via 407 responses
+// on the same keep-alive client connection, and a completed handshake
+// authenticates the connection rather than single requests, so handshakes
+// of more than one round trip require http.Server.ConnState to be set to
+// Proxy.ConnState.
+type HandshakeAuthenticator interface {
+	// Scheme is the name of the scheme in Proxy-Authenticate and
+	// Proxy-Authorization headers, e.g. "NTLM" or "Negotiate".
+	Scheme() string
+	// NewHandshake starts the handshake of a client connection.
+	NewHandshake() AuthHandshake
+}
+
+// AuthHandshake is the handshake of a HandshakeAuthenticator with a single
+// client connection.
+type AuthHandshake interface {
+	// Step processes the token sent by the client with the request r. It
+	// returns the identity of the client once the handshake completed, or
+	// the token to challenge the client with next otherwise. Failed
+	// handshakes return ErrInvalidCredentials.
+	Step(ctx context.Context, token []byte, r *http.Request) (*Identity, []byte, error)
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	// Arrange
+
+	a := &StaticAuthenticator{User: "user", Pass: "pass"}
+
+	cases := []struct {
+		name          string
+		givenUser     string
+		givenPass     string
+		expectedError error
+	}{
+		{
+			name:      "Valid",
+			givenUser: "user",
+			givenPass: "pass",
+		},
+		{
+			name:          "InvalidUser",
+			givenUser:     "other",
+			givenPass:     "pass",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "InvalidPass",
+			givenUser:     "user",
+			givenPass:     "wrong",
+			expectedError: ErrInvalidCredentials,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedIdentity, err := a.Authenticate(context.Background(), tc.givenUser, tc.givenPass, nil)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, err)
+			if err == nil {
+				assert.Equal(t, Identity{User: tc.givenUser}, observedIdentity)
+			}
+		})
+	}
+}
+
+// authenticatorFunc adapts a function to the Authenticator interface.
+type authenticatorFunc func(user, pass string) (Identity, error)
+
+func (f authenticatorFunc) Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error) {
+	return f(user, pass)
+}
+
+func TestProxyAuthorizeWithAuthenticator(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.Authenticator = authenticatorFunc(func(user, pass string) (Identity, error) {
+		switch {
+		case user == "backend":
+			return Identity{}, errors.New("connection refused")
+		case pass != "secret":
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{User: "canonical-" + user}, nil
+	})
+
+	cases := []struct {
+		name         string
+		givenUser    string
+		givenPass    string
+		expectedUser string
+		expectedOK   bool
+	}{
+		{
+			name:         "Valid",
+			givenUser:    "user",
+			givenPass:    "secret",
+			expectedUser: "canonical-user",
+			expectedOK:   true,
+		},
+		{
+			name:      "InvalidCredentials",
+			givenUser: "user",
+			givenPass: "wrong",
+		},
+		{
+			name:      "BackendFailure",
+			givenUser: "backend",
+			givenPass: "secret",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			r.SetBasicAuth(tc.givenUser, tc.givenPass)
+			r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+
+			// Act
+
+			observedUser, observedOK := p.authorize(r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedUser, observedUser)
+			assert.Equal(t, tc.expectedOK, observedOK)
+		})
+	}
+}
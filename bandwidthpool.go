@@ -0,0 +1,155 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BandwidthPool is a bandwidth limit shared by all tunnels of the users
+// assigned to it, e.g. capping guests at 50 Mbit/s in aggregate regardless of
+// their rates per user.
+type BandwidthPool struct {
+	// Name identifies the pool.
+	Name string
+	// Rate is the rate of all tunnels of the users of the pool, in bytes per
+	// second relayed in either direction.
+	Rate int64
+	// Users are the names of the users of the pool. User "*" assigns users
+	// not assigned to any other pool.
+	Users []string
+}
+
+// LoadBandwidthPools reads bandwidth pools from the file at path. Each
+// non-empty line not starting with '#' holds the name of a pool followed by
+// its rate and users, e.g.:
+//
+//	guests rate=6250000 users=guest,visitor
+//	staff  rate=125000000 users=*
+//
+// A user may be assigned to one pool only.
+func LoadBandwidthPools(path string) ([]BandwidthPool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pools []BandwidthPool
+	names := map[string]bool{}
+	users := map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pool, err := parseBandwidthPool(line)
+		if err == nil && names[pool.Name] {
+			err = fmt.Errorf("duplicate pool %q", pool.Name)
+		}
+		if err == nil {
+			for _, user := range pool.Users {
+				if other, ok := users[user]; ok {
+					err = fmt.Errorf("user %q assigned to pools %q and %q", user, other, pool.Name)
+					break
+				}
+				users[user] = pool.Name
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		names[pool.Name] = true
+		pools = append(pools, pool)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func parseBandwidthPool(line string) (BandwidthPool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return BandwidthPool{}, fmt.Errorf("malformed pool %q", line)
+	}
+
+	pool := BandwidthPool{Name: fields[0]}
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return BandwidthPool{}, fmt.Errorf("malformed setting %q", field)
+		}
+		key, value := strings.ToLower(field[:i]), field[i+1:]
+		var err error
+		switch key {
+		case "rate":
+			pool.Rate, err = strconv.ParseInt(value, 10, 64)
+		case "users":
+			pool.Users = SplitList(value)
+		default:
+			return BandwidthPool{}, fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return BandwidthPool{}, fmt.Errorf("malformed value of %s: %v", key, err)
+		}
+	}
+	if pool.Rate <= 0 {
+		return BandwidthPool{}, fmt.Errorf("pool %q without rate", pool.Name)
+	}
+	if len(pool.Users) == 0 {
+		return BandwidthPool{}, fmt.Errorf("pool %q without users", pool.Name)
+	}
+	return pool, nil
+}
+
+// SetPools replaces the bandwidth pools of t, e.g. after the pool file
+// changed. Open tunnels of a pool get the new rate of the pool of the same
+// name, and are no longer limited by it if it was removed, while tunnels of
+// users assigned to other pools keep their pool until they are closed.
+func (t *Throttle) SetPools(pools []BandwidthPool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Pools = pools
+	for name, pb := range t.pools {
+		var rate int64
+		if pool := t.poolNamed(name); pool != nil {
+			rate = pool.Rate
+		}
+		pb.bucket.setRate(rate)
+	}
+}
+
+// poolOf returns the pool user is assigned to, or nil if there is none. It
+// must be called with t.mu held.
+func (t *Throttle) poolOf(user string) *BandwidthPool {
+	var fallback *BandwidthPool
+	for i, pool := range t.Pools {
+		for _, u := range pool.Users {
+			if u == user {
+				return &t.Pools[i]
+			}
+			if u == defaultPolicyUser && fallback == nil {
+				fallback = &t.Pools[i]
+			}
+		}
+	}
+	return fallback
+}
+
+// poolNamed returns the pool named name, or nil if there is none. It must be
+// called with t.mu held.
+func (t *Throttle) poolNamed(name string) *BandwidthPool {
+	for i := range t.Pools {
+		if t.Pools[i].Name == name {
+			return &t.Pools[i]
+		}
+	}
+	return nil
+}
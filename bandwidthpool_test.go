@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBandwidthPools(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenContent  string
+		expectedPools []BandwidthPool
+		expectedErr   bool
+	}{
+		{
+			name:         "Valid",
+			givenContent: "# Guests\nguests rate=6250000 users=guest,visitor\nstaff rate=125000000 users=*\n",
+			expectedPools: []BandwidthPool{
+				{Name: "guests", Rate: 6250000, Users: []string{"guest", "visitor"}},
+				{Name: "staff", Rate: 125000000, Users: []string{"*"}},
+			},
+		},
+		{name: "DuplicatePool", givenContent: "guests rate=1 users=a\nguests rate=2 users=b\n", expectedErr: true},
+		{name: "DuplicateUser", givenContent: "guests rate=1 users=a\nstaff rate=2 users=b,a\n", expectedErr: true},
+		{name: "NoRate", givenContent: "guests users=a\n", expectedErr: true},
+		{name: "NoUsers", givenContent: "guests rate=1\n", expectedErr: true},
+		{name: "Unknown", givenContent: "guests rate=1 users=a burst=2\n", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			dir, err := ioutil.TempDir("", "bandwidthpool")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "pools")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.givenContent), 0600))
+
+			// Act
+
+			pools, err := LoadBandwidthPools(path)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedPools, pools)
+		})
+	}
+}
+
+func TestThrottleOpenPools(t *testing.T) {
+	// Arrange
+
+	th := &Throttle{
+		UserRate: 200,
+		Pools: []BandwidthPool{
+			{Name: "guests", Rate: 500, Users: []string{"guest", "visitor"}},
+			{Name: "staff", Rate: 1000, Users: []string{"*"}},
+		},
+	}
+
+	// Act
+
+	guest := th.open("guest")
+	visitor := th.open("visitor")
+	alice := th.open("alice")
+	anonymous := th.open("")
+
+	// Assert
+
+	require.Len(t, guest.buckets, 2)
+	require.Len(t, visitor.buckets, 2)
+	require.Len(t, alice.buckets, 2)
+	assert.Empty(t, anonymous.buckets, "unauthenticated tunnels are not part of any pool")
+	assert.True(t, guest.buckets[0] != visitor.buckets[0], "user buckets are per user")
+	assert.True(t, guest.buckets[1] == visitor.buckets[1], "pool buckets are shared")
+	assert.Equal(t, float64(1000), alice.buckets[1].rate, "other users are assigned to the * pool")
+
+	th.SetPools([]BandwidthPool{{Name: "guests", Rate: 250, Users: []string{"guest"}}})
+	assert.Equal(t, float64(250), guest.buckets[1].rate)
+	assert.Equal(t, float64(0), alice.buckets[1].rate, "removed pools no longer limit open tunnels")
+
+	guest.close()
+	assert.Len(t, th.pools, 2)
+	visitor.close()
+	alice.close()
+	anonymous.close()
+	assert.Empty(t, th.pools)
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// blocklistEntryOverhead approximates the memory used per entry by the maps
+// of a Blocklist in addition to the entry itself: the string header, the
+// empty value, hash bucket slots and load factor slack.
+const blocklistEntryOverhead = 48
+
+// Blocklist is a set of host patterns denied as destinations. Unlike ACL
+// rules, which are evaluated in order, lookups take time proportional to the
+// number of labels of a host rather than to the number of patterns, which
+// makes it suited for lists of millions of entries.
+type Blocklist struct {
+	all bool
+	// exact holds exact host names, suffixes the domains of wildcard
+	// patterns without the leading "*.".
+	exact    map[string]struct{}
+	suffixes map[string]struct{}
+	size     int64
+}
+
+// NewBlocklist returns a blocklist of patterns, see ResponseHeaderRule.Host
+// for the syntax.
+func NewBlocklist(patterns []string) (*Blocklist, error) {
+	b := newBlocklist()
+	for _, pattern := range patterns {
+		if err := b.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// LoadBlocklist reads a blocklist from the file at path. Each non-empty line
+// not starting with '#' holds a host pattern, e.g.:
+//
+//	ads.example.com
+//	*.tracker.example.net
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := newBlocklist()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := b.add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newBlocklist() *Blocklist {
+	return &Blocklist{exact: map[string]struct{}{}, suffixes: map[string]struct{}{}}
+}
+
+func (b *Blocklist) add(pattern string) error {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if pattern == "" || strings.ContainsAny(pattern, " \t/") || strings.Contains(pattern[1:], "*") {
+		return fmt.Errorf("malformed pattern %q", pattern)
+	}
+	switch {
+	case pattern == "*":
+		b.all = true
+	case strings.HasPrefix(pattern, "*."):
+		if _, ok := b.suffixes[pattern[2:]]; !ok {
+			b.suffixes[pattern[2:]] = struct{}{}
+			b.size += int64(len(pattern)-2) + blocklistEntryOverhead
+		}
+	case strings.HasPrefix(pattern, "*"):
+		return fmt.Errorf("malformed pattern %q", pattern)
+	default:
+		if _, ok := b.exact[pattern]; !ok {
+			b.exact[pattern] = struct{}{}
+			b.size += int64(len(pattern)) + blocklistEntryOverhead
+		}
+	}
+	return nil
+}
+
+// Contains reports whether host, optionally including a port, matches a
+// pattern of b.
+func (b *Blocklist) Contains(host string) bool {
+	if b == nil {
+		return false
+	}
+	if b.all {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := b.exact[host]; ok {
+		return true
+	}
+	// Wildcard patterns match subdomains only, so host itself is skipped.
+	for i := 0; i < len(host); i++ {
+		if host[i] != '.' {
+			continue
+		}
+		if _, ok := b.suffixes[host[i+1:]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of distinct patterns of b.
+func (b *Blocklist) Len() int {
+	n := len(b.exact) + len(b.suffixes)
+	if b.all {
+		n++
+	}
+	return n
+}
+
+// MemoryUsage returns the approximate number of bytes used by b.
+func (b *Blocklist) MemoryUsage() int64 {
+	return b.size
+}
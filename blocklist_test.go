@@ -0,0 +1,142 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocklistContains(t *testing.T) {
+	// Arrange
+
+	b, err := NewBlocklist([]string{"ads.example.com", "*.Tracker.example.net", "*.tracker.example.net"})
+	require.NoError(t, err)
+
+	cases := []struct {
+		givenHost     string
+		expectedMatch bool
+	}{
+		{givenHost: "ads.example.com", expectedMatch: true},
+		{givenHost: "ADS.example.com.:443", expectedMatch: true},
+		{givenHost: "www.ads.example.com", expectedMatch: false},
+		{givenHost: "example.com", expectedMatch: false},
+		{givenHost: "a.tracker.example.net", expectedMatch: true},
+		{givenHost: "a.b.tracker.example.net:80", expectedMatch: true},
+		{givenHost: "tracker.example.net", expectedMatch: false},
+		{givenHost: "eviltracker.example.net", expectedMatch: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenHost, func(t *testing.T) {
+			// Act
+
+			observedMatch := b.Contains(tc.givenHost)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedMatch, observedMatch)
+		})
+	}
+
+	assert.Equal(t, 2, b.Len())
+	assert.Equal(t, int64(len("ads.example.com")+len("tracker.example.net")+2*blocklistEntryOverhead), b.MemoryUsage())
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "blocklist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocklist")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Ads\n\nads.example.com\n*.tracker.example.net\n"), 0600))
+	malformedPath := filepath.Join(dir, "malformed")
+	require.NoError(t, ioutil.WriteFile(malformedPath, []byte("ads.example.com\n*tracker.example.net\n"), 0600))
+
+	// Act
+
+	b, err := LoadBlocklist(path)
+	_, malformedErr := LoadBlocklist(malformedPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, b.Len())
+	assert.True(t, b.Contains("x.tracker.example.net"))
+	require.Error(t, malformedErr)
+	assert.Contains(t, malformedErr.Error(), "malformed:2:")
+}
+
+func TestDialContextBlocklist(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	b, err := NewBlocklist([]string{"*"})
+	require.NoError(t, err)
+	p.Blocklist = b
+
+	// Act
+
+	_, err = p.DialContext(context.Background(), "tcp", "example.com:443")
+
+	// Assert
+
+	require.Error(t, err)
+	assert.True(t, isDeniedAddrError(err))
+}
+
+// benchmarkBlocklistSize is the number of patterns of benchmarked blocklists.
+const benchmarkBlocklistSize = 100000
+
+func BenchmarkBlocklistContains(b *testing.B) {
+	patterns := benchmarkBlocklistPatterns()
+	bl, err := NewBlocklist(patterns)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if bl.Contains("www.allowed.example.com:443") {
+			b.Fatal("blocked")
+		}
+	}
+}
+
+// BenchmarkBlocklistContainsNaive matches the same patterns one by one as
+// ACL rules are evaluated.
+func BenchmarkBlocklistContainsNaive(b *testing.B) {
+	patterns := benchmarkBlocklistPatterns()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pattern := range patterns {
+			if matchHostPattern(pattern, "www.allowed.example.com:443") {
+				b.Fatal("blocked")
+			}
+		}
+	}
+}
+
+func benchmarkBlocklistPatterns() []string {
+	patterns := make([]string, benchmarkBlocklistSize)
+	for i := range patterns {
+		if i%2 == 0 {
+			patterns[i] = fmt.Sprintf("host%d.blocked.example.com", i)
+		} else {
+			patterns[i] = fmt.Sprintf("*.domain%d.blocked.example.com", i)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// budgetWarnRatio is the share of a budget after which a warning is logged.
+const budgetWarnRatio = 0.8
+
+// EgressBudget tracks the approximate number of bytes sent by the proxy per
+// time window, globally and per authenticated user, against configured
+// limits. All bytes relayed in either direction count, as they all leave the
+// proxy host.
+//
+// A warning is logged once per window as a budget is approached. Once a
+// budget is exhausted, new requests are refused until the window ends;
+// established tunnels are not interrupted.
+type EgressBudget struct {
+	Logger *zap.Logger
+	// Window is the duration after which consumption is reset.
+	Window time.Duration
+	// Limit is the global number of bytes per window, unlimited if zero.
+	Limit int64
+	// UserLimit is the number of bytes per window and user, unlimited if
+	// zero. Unauthenticated requests are only subject to the global limit.
+	UserLimit int64
+
+	mu          sync.Mutex
+	now         func() time.Time
+	windowStart time.Time
+	total       int64
+	users       map[string]int64
+	warned      map[string]bool
+}
+
+// Allow reports whether neither the global nor the budget of user is
+// exhausted.
+func (b *EgressBudget) Allow(user string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotate()
+	if b.Limit > 0 && b.total >= b.Limit {
+		return false
+	}
+	return user == "" || b.UserLimit <= 0 || b.users[user] < b.UserLimit
+}
+
+// SetLimits changes the global and per user limits of b, taking effect in the
+// current window.
+func (b *EgressBudget) SetLimits(limit, userLimit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Limit, b.UserLimit = limit, userLimit
+}
+
+// Add records n bytes sent on behalf of user.
+func (b *EgressBudget) Add(user string, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotate()
+	b.total += n
+	b.warn("", b.total, b.Limit)
+	if user != "" {
+		b.users[user] += n
+		b.warn(user, b.users[user], b.UserLimit)
+	}
+}
+
+// consumed returns the number of bytes sent on behalf of user in the current
+// window, or zero if b is nil.
+func (b *EgressBudget) consumed(user string) int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotate()
+	return b.users[user]
+}
+
+// errQuotaExhausted refuses clients of users who exhausted a quota.
+var errQuotaExhausted = &RefusalError{StatusCode: http.StatusTooManyRequests, Err: errors.New("quota exhausted")}
+
+// checkQuota is the OnConnect hook refusing clients once the egress budget or
+// the byte quota of their user is exhausted.
+func (p *Proxy) checkQuota(ctx context.Context, client ClientInfo, target string) error {
+	if p.EgressBudget != nil && !p.EgressBudget.Allow(client.User) {
+		p.Logger.Warn("Egress budget exhausted", zap.String("user", client.User))
+		return errQuotaExhausted
+	}
+	if !p.UserPolicies.allowBytes(client.User, p.EgressBudget.consumed(client.User)) {
+		p.Logger.Warn("User byte quota exhausted", zap.String("user", client.User))
+		return errQuotaExhausted
+	}
+	return nil
+}
+
+// usage returns the number of bytes sent on behalf of user in the current
+// window, the limit of user and the end of the window. It returns zeros if b
+// is nil.
+func (b *EgressBudget) usage(user string) (int64, int64, time.Time) {
+	if b == nil {
+		return 0, 0, time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotate()
+	return b.users[user], b.UserLimit, b.windowStart.Add(b.Window)
+}
+
+// rotate starts a new window if the current one ended. It must be called with
+// b.mu held.
+func (b *EgressBudget) rotate() {
+	if b.now == nil {
+		b.now = time.Now
+	}
+	now := b.now()
+	if b.users != nil && now.Sub(b.windowStart) < b.Window {
+		return
+	}
+	b.windowStart = now
+	b.total = 0
+	b.users = map[string]int64{}
+	b.warned = map[string]bool{}
+}
+
+// warn logs a warning when consumed approaches limit for the first time in
+// the current window. It must be called with b.mu held.
+func (b *EgressBudget) warn(user string, consumed, limit int64) {
+	if limit <= 0 || b.warned[user] || float64(consumed) < budgetWarnRatio*float64(limit) {
+		return
+	}
+	b.warned[user] = true
+	b.Logger.Warn("Egress budget approached",
+		zap.String("user", user),
+		zap.Int64("consumed", consumed),
+		zap.Int64("limit", limit),
+		zap.Time("windowEnd", b.windowStart.Add(b.Window)))
+}
+
+// budgetWriter records all bytes written to w in budget.
+type budgetWriter struct {
+	w      io.Writer
+	budget *EgressBudget
+	user   string
+}
+
+func (w *budgetWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.budget.Add(w.user, int64(n))
+	return n, err
+}
+
+// budgetReadCloser records all bytes read from r in budget.
+type budgetReadCloser struct {
+	io.ReadCloser
+	budget *EgressBudget
+	user   string
+}
+
+func (r *budgetReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.budget.Add(r.user, int64(n))
+	return n, err
+}
+
+// budgetResponseWriter records all bytes of a response body in budget.
+type budgetResponseWriter struct {
+	http.ResponseWriter
+	budget *EgressBudget
+	user   string
+}
+
+func (w *budgetResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.budget.Add(w.user, int64(n))
+	return n, err
+}
+
+func (w *budgetResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestEgressBudget(t *testing.T) {
+	// Arrange
+
+	var logs bytes.Buffer
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	b := &EgressBudget{
+		Logger:    newBufferLogger(&logs),
+		Window:    time.Hour,
+		Limit:     100,
+		UserLimit: 50,
+		now:       func() time.Time { return now },
+	}
+
+	// Act & Assert
+
+	b.Add("alice", 39)
+	assert.True(t, b.Allow("alice"))
+	assert.Empty(t, logs.String())
+
+	b.Add("alice", 1)
+	assert.True(t, b.Allow("alice"))
+	assert.Equal(t, 1, strings.Count(logs.String(), "Egress budget approached"))
+
+	b.Add("alice", 10)
+	assert.False(t, b.Allow("alice"))
+	assert.True(t, b.Allow("bob"))
+	assert.True(t, b.Allow(""))
+	assert.Equal(t, 1, strings.Count(logs.String(), "Egress budget approached"))
+
+	b.Add("", 50)
+	assert.False(t, b.Allow("bob"))
+	assert.False(t, b.Allow(""))
+	assert.Equal(t, 2, strings.Count(logs.String(), "Egress budget approached"))
+
+	now = now.Add(time.Hour)
+	assert.True(t, b.Allow("alice"))
+	assert.True(t, b.Allow(""))
+}
+
+func TestServeHTTPEgressBudgetExhausted(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.EgressBudget = &EgressBudget{Logger: zap.NewNop(), Window: time.Hour, Limit: 1}
+	p.EgressBudget.Add("", 1)
+
+	req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, req)
+
+	// Assert
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+// newBufferLogger returns a logger writing JSON encoded entries of all levels
+// to w.
+func newBufferLogger(w io.Writer) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(w), zapcore.DebugLevel))
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// egressBudgetState is the consumption of the current window of an
+// EgressBudget as saved to disk.
+type egressBudgetState struct {
+	WindowStart time.Time        `json:"window_start"`
+	Total       int64            `json:"total"`
+	Users       map[string]int64 `json:"users"`
+	// Warned are the users warned about approaching their budget in the
+	// window, "" for the global budget.
+	Warned []string `json:"warned,omitempty"`
+}
+
+// SaveState writes the consumption of the current window of b to the file at
+// path, replacing it atomically, so budgets and byte quotas are not reset by
+// a restart.
+func (b *EgressBudget) SaveState(path string) error {
+	b.mu.Lock()
+	b.rotate()
+	state := egressBudgetState{WindowStart: b.windowStart, Total: b.total, Users: make(map[string]int64, len(b.users))}
+	for user, n := range b.users {
+		state.Users[user] = n
+	}
+	for user := range b.warned {
+		state.Warned = append(state.Warned, user)
+	}
+	b.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// LoadState restores the consumption saved to the file at path by SaveState,
+// unless its window ended meanwhile.
+func (b *EgressBudget) LoadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var state egressBudgetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.now == nil {
+		b.now = time.Now
+	}
+	now := b.now()
+	if now.Before(state.WindowStart) || now.Sub(state.WindowStart) >= b.Window {
+		return nil
+	}
+	b.windowStart = state.WindowStart
+	b.total = state.Total
+	b.users = map[string]int64{}
+	for user, n := range state.Users {
+		b.users[user] = n
+	}
+	b.warned = map[string]bool{}
+	for _, user := range state.Warned {
+		b.warned[user] = true
+	}
+	return nil
+}
+
+// PersistState saves the consumption of b to the file at path every interval
+// until stop is closed.
+func (b *EgressBudget) PersistState(logger *zap.Logger, path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.SaveState(path); err != nil {
+				logger.Error("Saving egress budget state failed", zap.String("path", path), zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
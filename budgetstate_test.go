@@ -0,0 +1,79 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEgressBudgetSaveLoadState(t *testing.T) {
+	cases := []struct {
+		name             string
+		givenElapsed     time.Duration
+		expectedConsumed int64
+		expectedAllowed  bool
+	}{
+		{name: "SameWindow", givenElapsed: 30 * time.Minute, expectedConsumed: 50},
+		{name: "WindowEnded", givenElapsed: time.Hour, expectedAllowed: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			dir, err := ioutil.TempDir("", "budgetstate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "budget.json")
+
+			now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+			clock := func() time.Time { return now }
+			saved := &EgressBudget{Logger: zap.NewNop(), Window: time.Hour, UserLimit: 50, now: clock}
+			saved.Add("alice", 50)
+			saved.Add("bob", 10)
+			require.NoError(t, saved.SaveState(path))
+
+			// Act
+
+			now = now.Add(tc.givenElapsed)
+			loaded := &EgressBudget{Logger: zap.NewNop(), Window: time.Hour, UserLimit: 50, now: clock}
+			err = loaded.LoadState(path)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConsumed, loaded.consumed("alice"))
+			assert.Equal(t, tc.expectedAllowed, loaded.Allow("alice"))
+			_, _, windowEnd := loaded.usage("alice")
+			if tc.expectedAllowed {
+				assert.Equal(t, now.Add(time.Hour), windowEnd, "a new window starts")
+				return
+			}
+			assert.Equal(t, now.Add(-tc.givenElapsed).Add(time.Hour), windowEnd, "the saved window continues")
+			assert.Equal(t, int64(10), loaded.consumed("bob"))
+			assert.True(t, loaded.warned["alice"], "users warned already are not warned again")
+		})
+	}
+}
+
+func TestEgressBudgetLoadStateMissing(t *testing.T) {
+	// Arrange
+
+	b := &EgressBudget{Logger: zap.NewNop(), Window: time.Hour}
+
+	// Act
+
+	err := b.LoadState(filepath.Join(os.TempDir(), "missing-budget-state.json"))
+
+	// Assert
+
+	assert.True(t, os.IsNotExist(err))
+}
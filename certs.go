@@ -0,0 +1,127 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertReloader serves a TLS certificate loaded from a certificate and a
+// private key file, reloading them once they change, so renewed certificates
+// take effect without restarting listeners. Its GetCertificate method is
+// meant to be used as tls.Config.GetCertificate.
+type CertReloader struct {
+	logger   *zap.Logger
+	certPath string
+	keyPath  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// NewCertReloader returns a CertReloader for the PEM encoded certificate and
+// private key files at certPath and keyPath, failing if they can not be
+// loaded.
+func NewCertReloader(logger *zap.Logger, certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{
+		logger:   logger,
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the current certificate, meant to be used as
+// tls.Config.GetClientCertificate of connections to destinations requiring
+// client certificates.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(nil)
+}
+
+// Reload loads the certificate and private key files. The current certificate
+// is kept if loading fails.
+func (r *CertReloader) Reload() error {
+	certTime, keyTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certTime, r.keyTime = certTime, keyTime
+	return nil
+}
+
+// Watch checks the certificate and private key files for changes every
+// interval until stop is closed, and reloads them once either changed. Tools
+// renewing certificates usually replace both files one after the other, so
+// failures to load them are logged and retried on the next check.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			r.logger.Error("Reloading certificate failed", zap.String("cert", r.certPath), zap.Error(err))
+			continue
+		}
+		r.logger.Info("Certificate reloaded", zap.String("cert", r.certPath))
+	}
+}
+
+// changed reports whether the certificate or private key file was modified
+// since they were last loaded.
+func (r *CertReloader) changed() bool {
+	certTime, keyTime, err := r.modTimes()
+	if err != nil {
+		r.logger.Warn("Checking certificate for changes failed", zap.Error(err))
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !certTime.Equal(r.certTime) || !keyTime.Equal(r.keyTime)
+}
+
+func (r *CertReloader) modTimes() (certTime, keyTime time.Time, err error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCertReloaderWatch(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first", time.Now().Add(-time.Hour))
+
+	r, err := NewCertReloader(zap.NewNop(), certPath, keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, "first", leafCommonName(t, r))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(10*time.Millisecond, stop)
+
+	// Act
+
+	writeTestCert(t, certPath, keyPath, "second", time.Now())
+
+	// Assert
+
+	deadline := time.Now().Add(5 * time.Second)
+	for leafCommonName(t, r) != "second" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "second", leafCommonName(t, r))
+}
+
+func TestCertReloaderReloadKeepsCertificateOnFailure(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first", time.Now())
+
+	r, err := NewCertReloader(zap.NewNop(), certPath, keyPath)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("garbage"), 0600))
+
+	// Act
+
+	err = r.Reload()
+
+	// Assert
+
+	assert.Error(t, err)
+	assert.Equal(t, "first", leafCommonName(t, r))
+}
+
+// writeTestCert writes a self-signed certificate for commonName and its
+// private key, and sets their modification times to modTime.
+func writeTestCert(t *testing.T, certPath, keyPath, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+func leafCommonName(t *testing.T, r *CertReloader) string {
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxCircuits is the number of circuits after which closed circuits are
+// removed.
+const maxCircuits = 10000
+
+// States of circuits.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// circuitOpenError is returned when dials to a destination host and port fail
+// fast as its circuit is open.
+type circuitOpenError struct {
+	Host string
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for destination %s", e.Host)
+}
+
+// CircuitBreaker fails dials to a destination host and port fast once a number
+// of consecutive dials to it failed, so clients do not pile up on unreachable
+// destinations. Circuits are kept per port, so refused dials to a port a host
+// does not listen on do not fail dials to its other ports. The circuit of the
+// destination is then open for a cool-down, after which it is half-open: a
+// single probe dial is let through, closing the circuit again if it succeeds
+// and opening it for another cool-down otherwise. All methods of a nil
+// CircuitBreaker let all dials through.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failed dials to a host opening
+	// its circuit.
+	Failures int
+	// CoolDown is the duration dials to a host fail fast once its circuit
+	// opened.
+	CoolDown time.Duration
+
+	mu       sync.Mutex
+	now      func() time.Time
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    string
+	failures int
+	openedAt time.Time
+	// probing is set while the probe dial of a half-open circuit is
+	// pending.
+	probing bool
+}
+
+// NewCircuitBreaker returns a breaker opening the circuit of a host after
+// failures consecutive failed dials, for coolDown.
+func NewCircuitBreaker(failures int, coolDown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Failures: failures, CoolDown: coolDown, now: time.Now, circuits: map[string]*circuit{}}
+}
+
+// allow reports whether host may be dialed now. Each allowed dial must be
+// followed by a call of succeeded, failed or abandoned.
+func (b *CircuitBreaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case circuitOpen:
+		if b.now().Sub(c.openedAt) < b.CoolDown {
+			return false
+		}
+		c.state = circuitHalfOpen
+		c.probing = true
+		return true
+	case circuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+// succeeded records a successful dial to host, closing its circuit. It
+// reports whether the circuit was open or half-open.
+func (b *CircuitBreaker) succeeded(host string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		return false
+	}
+	delete(b.circuits, host)
+	return c.state != circuitClosed
+}
+
+// failed records a failed dial to host. It reports whether the circuit of host
+// opened, but not whether a half-open circuit opened again.
+func (b *CircuitBreaker) failed(host string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	c, ok := b.circuits[host]
+	if !ok {
+		if len(b.circuits) >= maxCircuits {
+			b.removeClosed()
+		}
+		c = &circuit{state: circuitClosed}
+		b.circuits[host] = c
+	}
+	c.failures++
+	switch c.state {
+	case circuitClosed:
+		if c.failures < b.Failures {
+			return false
+		}
+		c.state, c.openedAt = circuitOpen, now
+		return true
+	case circuitHalfOpen:
+		c.state, c.openedAt, c.probing = circuitOpen, now, false
+	}
+	return false
+}
+
+// abandoned records a dial to host which neither succeeded nor failed on
+// behalf of host, e.g. as it was denied or canceled by the client, so the
+// probe of a half-open circuit can be retried.
+func (b *CircuitBreaker) abandoned(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.circuits[host]; ok {
+		c.probing = false
+	}
+}
+
+// removeClosed removes the closed circuits, which only count failures yet. It
+// must be called with b.mu held.
+func (b *CircuitBreaker) removeClosed() {
+	for host, c := range b.circuits {
+		if c.state == circuitClosed {
+			delete(b.circuits, host)
+		}
+	}
+}
+
+// circuitReport is a circuit which is not closed, as listed by the admin API.
+type circuitReport struct {
+	Destination string    `json:"destination"`
+	State       string    `json:"state"`
+	Failures    int       `json:"failures"`
+	OpenedAt    time.Time `json:"opened_at"`
+	// RetryAt is the time after which a probe dial is let through.
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// open returns the circuits which are open or half-open, sorted by
+// destination.
+func (b *CircuitBreaker) open() []circuitReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var reports []circuitReport
+	for host, c := range b.circuits {
+		if c.state == circuitClosed {
+			continue
+		}
+		reports = append(reports, circuitReport{
+			Destination: host,
+			State:       c.state,
+			Failures:    c.failures,
+			OpenedAt:    c.openedAt,
+			RetryAt:     c.openedAt.Add(b.CoolDown),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Destination < reports[j].Destination })
+	return reports
+}
+
+// dialed records the outcome err of dialing host for ctx with the circuit
+// breaker, if any.
+func (p *Proxy) dialed(ctx context.Context, host string, err error) {
+	if p.CircuitBreaker == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		if p.CircuitBreaker.succeeded(host) {
+			p.Metrics.circuitClosed()
+			p.Logger.Info("Destination circuit closed", zap.String("host", host))
+		}
+	case isDeniedAddrError(err) || ctx.Err() == context.Canceled:
+		p.CircuitBreaker.abandoned(host)
+	default:
+		if p.CircuitBreaker.failed(host) {
+			p.Metrics.circuitOpened()
+			p.Logger.Warn("Destination circuit opened", zap.String("host", host), zap.Duration("coolDown", p.CircuitBreaker.CoolDown))
+		}
+	}
+}
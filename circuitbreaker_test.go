@@ -0,0 +1,165 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Arrange
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// Act & Assert
+
+	assert.True(t, b.allow("a"))
+	assert.False(t, b.failed("a"))
+	assert.False(t, b.succeeded("a"), "successes reset the failures of closed circuits")
+	assert.False(t, b.failed("a"))
+	assert.True(t, b.failed("a"), "circuit opens after consecutive failures")
+	assert.False(t, b.allow("a"))
+	assert.True(t, b.allow("b"))
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow("a"), "half-open circuit lets a probe through")
+	assert.False(t, b.allow("a"), "only a single probe is let through")
+	b.abandoned("a")
+	assert.True(t, b.allow("a"), "abandoned probes are retried")
+	assert.False(t, b.failed("a"), "failed probes open the circuit again")
+	assert.False(t, b.allow("a"))
+	assert.Equal(t, []circuitReport{{
+		Destination: "a",
+		State:       circuitOpen,
+		Failures:    3,
+		OpenedAt:    now,
+		RetryAt:     now.Add(time.Minute),
+	}}, b.open())
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow("a"))
+	assert.True(t, b.succeeded("a"), "successful probes close the circuit")
+	assert.True(t, b.allow("a"))
+	assert.Empty(t, b.open())
+}
+
+func TestCircuitBreakerRemovesClosedCircuits(t *testing.T) {
+	// Arrange
+
+	b := NewCircuitBreaker(2, time.Minute)
+	b.failed("open")
+	b.failed("open")
+	for i := 1; len(b.circuits) < maxCircuits; i++ {
+		b.failed(fmt.Sprint(i))
+	}
+
+	// Act
+
+	b.failed("new")
+
+	// Assert
+
+	assert.Len(t, b.circuits, 2)
+	assert.False(t, b.allow("open"), "open circuits are kept")
+}
+
+func TestProxyConnectCircuitOpen(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	p := newTestProxy()
+	p.Metrics = NewMetrics()
+	p.CircuitBreaker = NewCircuitBreaker(1, time.Minute)
+
+	connect := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, addr, nil))
+		return w
+	}
+
+	// Act
+
+	failed := connect()
+	rejected := connect()
+
+	// Assert
+
+	assert.Equal(t, http.StatusServiceUnavailable, failed.Code)
+	assert.NotContains(t, failed.Body.String(), "circuit breaker open")
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Contains(t, rejected.Body.String(), "circuit breaker open for destination "+addr)
+	assert.Equal(t, int64(1), p.Metrics.openCircuits)
+	assert.Equal(t, uint64(1), p.Metrics.circuitRejects)
+}
+
+func TestProxyHTTPCircuitOpen(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	p := newTestProxy()
+	p.CircuitBreaker = NewCircuitBreaker(1, time.Minute)
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+addr+"/", nil))
+		return w
+	}
+
+	// Act
+
+	failed := get()
+	rejected := get()
+
+	// Assert
+
+	assert.Equal(t, http.StatusBadGateway, failed.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Contains(t, rejected.Body.String(), "circuit breaker open for destination "+addr)
+}
+
+func TestProxyConnectCircuitPerPort(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := l.Addr().String()
+	l.Close()
+	listening := startEchoServer(t).Addr().String()
+
+	p := newTestProxy()
+	p.CircuitBreaker = NewCircuitBreaker(1, time.Minute)
+
+	// Act
+
+	_, refusedErr := p.DialContext(context.Background(), "tcp", refused)
+	_, rejectedErr := p.DialContext(context.Background(), "tcp", refused)
+	conn, err := p.DialContext(context.Background(), "tcp", listening)
+
+	// Assert
+
+	require.Error(t, refusedErr)
+	assert.Equal(t, &circuitOpenError{Host: refused}, rejectedErr)
+	require.NoError(t, err, "circuits of other ports stay closed")
+	conn.Close()
+}
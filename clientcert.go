@@ -0,0 +1,56 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// ClientCertAuth authenticates clients by the TLS client certificates they
+// present, so machines need not be given passwords. Certificates are
+// verified by the TLS config of the listener, see ClientCertPool, and only
+// verified certificates authenticate clients.
+type ClientCertAuth struct {
+	// UseSAN maps certificates to the first DNS name, email address or URI
+	// of their subject alternative names, in that order, instead of their
+	// common name.
+	UseSAN bool
+}
+
+// user returns the user of the verified client certificate of cs, or "" if
+// there is none.
+func (a *ClientCertAuth) user(cs *tls.ConnectionState) string {
+	if a == nil || cs == nil || len(cs.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	if !a.UseSAN {
+		return cert.Subject.CommonName
+	}
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// ClientCertPool reads the PEM encoded CA certificates verifying client
+// certificates from the file at path, e.g. for tls.Config.ClientCAs.
+func ClientCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no CA certificates found in " + path)
+	}
+	return pool, nil
+}
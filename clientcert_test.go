@@ -0,0 +1,235 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertAuthUser(t *testing.T) {
+	// Arrange
+
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	cases := []struct {
+		name         string
+		givenUseSAN  bool
+		givenCert    *x509.Certificate
+		expectedUser string
+	}{
+		{
+			name:         "CommonName",
+			givenCert:    &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"billing.example.com"}},
+			expectedUser: "billing",
+		},
+		{
+			name:         "DNSName",
+			givenUseSAN:  true,
+			givenCert:    &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"billing.example.com"}, EmailAddresses: []string{"billing@example.com"}},
+			expectedUser: "billing.example.com",
+		},
+		{
+			name:         "EmailAddress",
+			givenUseSAN:  true,
+			givenCert:    &x509.Certificate{EmailAddresses: []string{"billing@example.com"}, URIs: []*url.URL{spiffe}},
+			expectedUser: "billing@example.com",
+		},
+		{
+			name:         "URI",
+			givenUseSAN:  true,
+			givenCert:    &x509.Certificate{URIs: []*url.URL{spiffe}},
+			expectedUser: "spiffe://example.com/billing",
+		},
+		{
+			name:        "NoSAN",
+			givenUseSAN: true,
+			givenCert:   &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ClientCertAuth{UseSAN: tc.givenUseSAN}
+			cs := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.givenCert}}}
+
+			// Act
+
+			observed := a.user(cs)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedUser, observed)
+		})
+	}
+}
+
+func TestProxyAuthorizeClientCert(t *testing.T) {
+	// Arrange
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}
+	cases := []struct {
+		name         string
+		givenTLS     *tls.ConnectionState
+		givenAuthz   string
+		expectedUser string
+		expectedOK   bool
+	}{
+		{
+			name:         "VerifiedCert",
+			givenTLS:     &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expectedUser: "billing",
+			expectedOK:   true,
+		},
+		{
+			name:     "UnverifiedCert",
+			givenTLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+		},
+		{
+			name: "NoTLS",
+		},
+		{
+			// Without static credentials, empty credentials must not
+			// authenticate clients either.
+			name:       "EmptyCredentials",
+			givenAuthz: "Basic Og==",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProxy()
+			p.ClientCertAuth = &ClientCertAuth{}
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			r.TLS = tc.givenTLS
+			if tc.givenAuthz != "" {
+				r.Header.Set("Proxy-Authorization", tc.givenAuthz)
+			}
+
+			// Act
+
+			observedUser, observedOK := p.authorize(r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedUser, observedUser)
+			assert.Equal(t, tc.expectedOK, observedOK)
+		})
+	}
+}
+
+func TestProxyAuthorizeCertAndCredentials(t *testing.T) {
+	// Arrange
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "laptop-17"}}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	cases := []struct {
+		name         string
+		givenPolicy  *ListenerPolicy
+		givenTLS     *tls.ConnectionState
+		givenAuthz   string
+		expectedUser string
+		expectedOK   bool
+	}{
+		{
+			name:         "EitherCert",
+			givenPolicy:  &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}},
+			givenTLS:     verified,
+			expectedUser: "laptop-17",
+			expectedOK:   true,
+		},
+		{
+			name:         "EitherCredentials",
+			givenPolicy:  &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}},
+			givenAuthz:   "Basic dXNlcjpwYXNz",
+			expectedUser: "user",
+			expectedOK:   true,
+		},
+		{
+			name:         "Both",
+			givenPolicy:  &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}, RequireCertAndCredentials: true},
+			givenTLS:     verified,
+			givenAuthz:   "Basic dXNlcjpwYXNz",
+			expectedUser: "user",
+			expectedOK:   true,
+		},
+		{
+			name:        "BothWithoutCert",
+			givenPolicy: &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}, RequireCertAndCredentials: true},
+			givenAuthz:  "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:        "BothWithoutCredentials",
+			givenPolicy: &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}, RequireCertAndCredentials: true},
+			givenTLS:    verified,
+		},
+		{
+			name:        "BothWithInvalidCredentials",
+			givenPolicy: &ListenerPolicy{ClientCertAuth: &ClientCertAuth{}, RequireCertAndCredentials: true},
+			givenTLS:    verified,
+			givenAuthz:  "Basic dXNlcjp3cm9uZw==",
+		},
+		{
+			name:        "OtherListener",
+			givenPolicy: &ListenerPolicy{},
+			givenTLS:    verified,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProxy()
+			p.AuthUser, p.AuthPass = "user", "pass"
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			r = r.WithContext(withListenerPolicy(r.Context(), tc.givenPolicy))
+			r.TLS = tc.givenTLS
+			if tc.givenAuthz != "" {
+				r.Header.Set("Proxy-Authorization", tc.givenAuthz)
+			}
+
+			// Act
+
+			observedUser, observedOK := p.authorize(r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedUser, observedUser)
+			assert.Equal(t, tc.expectedOK, observedOK)
+		})
+	}
+}
+
+func TestClientCertPool(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "clientca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	ca := newTestCA(t)
+	require.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600))
+	emptyPath := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(emptyPath, nil, 0600))
+
+	// Act
+
+	pool, err := ClientCertPool(caPath)
+	_, emptyErr := ClientCertPool(emptyPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Len(t, pool.Subjects(), 1)
+	assert.Error(t, emptyErr)
+}
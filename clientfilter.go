@@ -0,0 +1,62 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// errClientNotAllowed is returned for clients outside of
+	// Proxy.AllowedClientCIDRs or Proxy.AllowedClientCountries.
+	errClientNotAllowed = errors.New("client not allowed")
+	// errClientRateLimited is returned for clients exceeding the rate of
+	// Proxy.ClientRateLimiter.
+	errClientRateLimited = errors.New("client rate limit exceeded")
+)
+
+// admitClient returns an error if the client at the remote address addr may
+// not use the proxy. It is checked ahead of authentication, so clients
+// guessing credentials are slowed down.
+func (p *Proxy) admitClient(addr string) error {
+	if len(p.AllowedClientCIDRs) == 0 && len(p.AllowedClientCountries) == 0 && p.ClientRateLimiter == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+
+	if len(p.AllowedClientCIDRs) > 0 && (ip == nil || !containsIP(p.AllowedClientCIDRs, ip)) {
+		p.Logger.Info("Client not allowed", zap.String("client", host))
+		return errClientNotAllowed
+	}
+	if len(p.AllowedClientCountries) > 0 {
+		country := p.GeoIP.Country(ip)
+		if country == "" || !containsCountry(p.AllowedClientCountries, country) {
+			p.Logger.Info("Client country not allowed", zap.String("client", host), zap.String("country", country))
+			return errClientNotAllowed
+		}
+	}
+	// Buckets are kept per address rather than per remote address, as
+	// clients open new connections from new ports.
+	if p.ClientRateLimiter != nil && !p.ClientRateLimiter.Allow(host) {
+		p.Logger.Warn("Client rate limit exceeded", zap.String("client", host))
+		return errClientRateLimited
+	}
+	return nil
+}
+
+func containsCountry(countries []string, country string) bool {
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
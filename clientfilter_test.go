@@ -0,0 +1,115 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServeHTTPClientFilter(t *testing.T) {
+	cases := []struct {
+		name             string
+		givenRemoteAddrs []string
+		expectedStatus   int
+	}{
+		{name: "Allowed", givenRemoteAddrs: []string{"192.0.2.1:1234"}, expectedStatus: http.StatusProxyAuthRequired},
+		{name: "NotAllowed", givenRemoteAddrs: []string{"198.51.100.1:1234"}, expectedStatus: http.StatusForbidden},
+		// Buckets are shared by all ports of a client.
+		{name: "RateLimited", givenRemoteAddrs: []string{"192.0.2.1:1234", "192.0.2.1:1235"}, expectedStatus: http.StatusTooManyRequests},
+		{name: "OtherClient", givenRemoteAddrs: []string{"192.0.2.1:1234", "192.0.2.2:1234"}, expectedStatus: http.StatusProxyAuthRequired},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			allowed, err := ParseCIDRs("192.0.2.0/24")
+			require.NoError(t, err)
+			p := newTestProxy()
+			p.AuthUser = "user"
+			p.AuthPass = "pass"
+			p.AllowedClientCIDRs = allowed
+			p.ClientRateLimiter = NewRateLimiter(0.001, 1)
+
+			// Act
+
+			var w *httptest.ResponseRecorder
+			for _, addr := range tc.givenRemoteAddrs {
+				req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+				req.RemoteAddr = addr
+				w = httptest.NewRecorder()
+				p.ServeHTTP(w, req)
+			}
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestServeHTTPClientCountries(t *testing.T) {
+	cases := []struct {
+		name            string
+		givenRemoteAddr string
+		expectedStatus  int
+	}{
+		{name: "AllowedCountry", givenRemoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusProxyAuthRequired},
+		{name: "OtherCountry", givenRemoteAddr: "198.51.100.1:1234", expectedStatus: http.StatusForbidden},
+		{name: "UnknownCountry", givenRemoteAddr: "203.0.113.1:1234", expectedStatus: http.StatusForbidden},
+	}
+
+	db, err := parseMMDB(buildTestMMDB(t, 6, map[string]string{"192.0.2.0/24": "SE", "198.51.100.0/24": "NO"}))
+	require.NoError(t, err)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.AuthUser = "user"
+			p.AuthPass = "pass"
+			p.AllowedClientCountries = []string{"se"}
+			p.GeoIP = &GeoIP{logger: zap.NewNop(), db: db, countries: make(map[uint]string)}
+
+			// Act
+
+			req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			req.RemoteAddr = tc.givenRemoteAddr
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestHandleSOCKSClientNotAllowed(t *testing.T) {
+	// Arrange
+
+	allowed, err := ParseCIDRs("192.0.2.0/24")
+	require.NoError(t, err)
+	p := newTestProxy()
+	p.AllowedClientCIDRs = allowed
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Act
+
+	go p.handleSOCKS(server)
+	_, err = client.Read(make([]byte, 1))
+
+	// Assert
+
+	assert.Equal(t, io.EOF, err, "connection is closed without a reply")
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// requestIDHeader is the header of CONNECT requests carrying the request
+	// ID chosen by the client. SOCKS clients send it as "request_id"
+	// metadata.
+	requestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLength bounds the length of request IDs recorded.
+	maxRequestIDLength = 128
+
+	// failureReportPath is the path under Proxy.UsageHost accepting failure
+	// reports.
+	failureReportPath = "/me/failures"
+
+	// maxFailureReportSize bounds the size of failure reports.
+	maxFailureReportSize = 4 << 10
+
+	// maxFailureMessageLength bounds the length of messages of failure
+	// reports logged.
+	maxFailureMessageLength = 256
+)
+
+// Kinds of tunnel failures reported by clients.
+var failureKinds = []string{"timeout", "reset", "refused", "tls", "dns", "other"}
+
+type requestIDKey struct{}
+
+// withRequestID returns ctx holding the request ID id chosen by the client,
+// unless id is empty or malformed.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if !validRequestID(id) {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID of ctx, or "".
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether id is a non-empty request ID of printable
+// ASCII characters other than space, of up to maxRequestIDLength characters,
+// so it can be logged safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// failureReport is a tunnel failure observed by a client.
+type failureReport struct {
+	// RequestID is the ID of the request of the tunnel, as sent in the
+	// X-Request-Id header or the "request_id" SOCKS metadata.
+	RequestID   string `json:"request_id"`
+	Destination string `json:"destination"`
+	// Kind is one of failureKinds.
+	Kind    string `json:"kind"`
+	Message string `json:"message,omitempty"`
+}
+
+// serveFailureReport accepts the report of a tunnel failure observed by the
+// client of user, logging it for correlation with the access log by its
+// request ID and counting it by kind.
+func (p *Proxy) serveFailureReport(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report failureReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFailureReportSize)).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.RequestID != "" && !validRequestID(report.RequestID) {
+		http.Error(w, "Malformed request ID", http.StatusBadRequest)
+		return
+	}
+	if !isFailureKind(report.Kind) {
+		http.Error(w, "Unknown failure kind", http.StatusBadRequest)
+		return
+	}
+	if len(report.Message) > maxFailureMessageLength {
+		report.Message = report.Message[:maxFailureMessageLength]
+	}
+
+	p.Metrics.clientFailure(report.Kind)
+	p.Logger.Info("Client reported tunnel failure",
+		zap.String("user", user),
+		zap.String("requestID", report.RequestID),
+		zap.String("destination", report.Destination),
+		zap.String("kind", report.Kind),
+		zap.String("message", report.Message))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isFailureKind(kind string) bool {
+	for _, k := range failureKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
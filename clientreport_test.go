@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRequestID(t *testing.T) {
+	cases := []struct {
+		givenID    string
+		expectedID string
+	}{
+		{givenID: "7f3c9a", expectedID: "7f3c9a"},
+		{givenID: "req:2018-06-01/42", expectedID: "req:2018-06-01/42"},
+		{givenID: ""},
+		{givenID: "with space"},
+		{givenID: "line\nbreak"},
+		{givenID: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenID, func(t *testing.T) {
+			// Act
+
+			observed := requestIDFromContext(withRequestID(context.Background(), tc.givenID))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedID, observed)
+		})
+	}
+}
+
+func TestServeFailureReport(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenMethod    string
+		givenBody      string
+		expectedStatus int
+		expectedCount  uint64
+	}{
+		{
+			name:           "Reported",
+			givenMethod:    http.MethodPost,
+			givenBody:      `{"request_id":"7f3c9a","destination":"example.com:443","kind":"reset","message":"connection reset by peer"}`,
+			expectedStatus: http.StatusNoContent,
+			expectedCount:  1,
+		},
+		{
+			name:           "UnknownKind",
+			givenMethod:    http.MethodPost,
+			givenBody:      `{"request_id":"7f3c9a","kind":"cosmic_rays"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "MalformedRequestID",
+			givenMethod:    http.MethodPost,
+			givenBody:      `{"request_id":"with space","kind":"reset"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Malformed",
+			givenMethod:    http.MethodPost,
+			givenBody:      `reset`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Get",
+			givenMethod:    http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.UsageHost = "proxy.internal"
+			p.Metrics = NewMetrics()
+			req := httptest.NewRequest(tc.givenMethod, "http://proxy.internal/me/failures", strings.NewReader(tc.givenBody))
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.ServeHTTP(w, req)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedCount, p.Metrics.clientFailures["reset"])
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor of inherited listening
+// sockets, following standard input, output and error.
+const listenFDsStart = 3
+
+// upgradedFromEnv names the environment variable holding the PID of the
+// process a process was started by to replace it, see upgrade.
+const upgradedFromEnv = "FORWARDINGPROXY_UPGRADED_FROM"
+
+// socketActivation holds the listening sockets inherited via systemd socket
+// activation or from the process replaced by an upgrade, and the sockets
+// opened since, which are passed on to the next upgrade.
+type socketActivation struct {
+	mu sync.Mutex
+	// inherited are the inherited sockets not taken by a listener yet.
+	inherited []*net.TCPListener
+	opened    []*net.TCPListener
+}
+
+// inheritListeners returns the listening sockets passed to the process via
+// the LISTEN_FDS protocol of systemd socket activation. They are ignored if
+// LISTEN_PID names another process, e.g. if the variables were inherited
+// from a parent process, while upgrades do not set LISTEN_PID at all, as the
+// PID of the new process is unknown until it is started. The variables are
+// unset, so processes started later do not inherit them.
+func inheritListeners() (*socketActivation, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	a := &socketActivation{}
+	n, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if err != nil || n == 0 {
+		return a, err
+	}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			a.closeInherited()
+			return nil, fmt.Errorf("inherited file descriptor %d: %v", fd, err)
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			a.closeInherited()
+			return nil, fmt.Errorf("inherited file descriptor %d is no TCP listener", fd)
+		}
+		a.inherited = append(a.inherited, tl)
+	}
+	return a, nil
+}
+
+// listenFDs returns the number of inherited listening sockets announced by
+// the values of LISTEN_PID and LISTEN_FDS to the process pid.
+func listenFDs(listenPID, listenFDs string, pid int) (int, error) {
+	if listenFDs == "" {
+		return 0, nil
+	}
+	if listenPID != "" && listenPID != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+	return n, nil
+}
+
+// listen returns the inherited socket listening on addr, or opens one.
+func (a *socketActivation) listen(addr string) (net.Listener, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, l := range a.inherited {
+		if sameListenAddr(l.Addr(), addr) {
+			a.inherited = append(a.inherited[:i], a.inherited[i+1:]...)
+			a.opened = append(a.opened, l)
+			return l, nil
+		}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tl := l.(*net.TCPListener)
+	a.opened = append(a.opened, tl)
+	return tl, nil
+}
+
+// sameListenAddr reports whether a socket listening on bound serves the
+// listen address addr, e.g. ":8080" is served by "[::]:8080".
+func sameListenAddr(bound net.Addr, addr string) bool {
+	b, ok := bound.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || want.Port == 0 || want.Port != b.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return b.IP == nil || b.IP.IsUnspecified()
+	}
+	return want.IP.Equal(b.IP)
+}
+
+// closeInherited closes the inherited sockets no listener took, and returns
+// their addresses.
+func (a *socketActivation) closeInherited() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var addrs []string
+	for _, l := range a.inherited {
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+	a.inherited = nil
+	return addrs
+}
+
+// upgrade starts the executable of the process anew with the same arguments,
+// passing it the listening sockets opened. The new process terminates this
+// one once it listens, which then drains like on SIGTERM, so no connection
+// attempt is refused meanwhile. If the new process fails to start or to
+// listen, this one keeps serving. exited receives the error the new process
+// exits with.
+func (a *socketActivation) upgrade(exited chan<- error) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	files := make([]*os.File, 0, len(a.opened))
+	for _, l := range a.opened {
+		f, err := l.File()
+		if err != nil {
+			a.mu.Unlock()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, f)
+	}
+	a.mu.Unlock()
+	defer closeFiles(files)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		upgradedFromEnv+"="+strconv.Itoa(os.Getpid()))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// replaceUpgraded terminates the process this process was started by to
+// replace it, if any, once this process listens.
+func replaceUpgraded() error {
+	pid := os.Getenv(upgradedFromEnv)
+	_ = os.Unsetenv(upgradedFromEnv)
+	if pid == "" || pid != strconv.Itoa(os.Getppid()) {
+		return nil
+	}
+	return syscall.Kill(os.Getppid(), syscall.SIGTERM)
+}
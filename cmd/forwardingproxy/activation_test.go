@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFDs(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenPID      string
+		givenFDs      string
+		expected      int
+		expectedError bool
+	}{
+		{name: "None"},
+		{name: "SocketActivation", givenPID: "42", givenFDs: "2", expected: 2},
+		{name: "OtherProcess", givenPID: "43", givenFDs: "2"},
+		{name: "Upgrade", givenFDs: "3", expected: 3},
+		{name: "Invalid", givenPID: "42", givenFDs: "two", expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, err := listenFDs(tc.givenPID, tc.givenFDs, 42)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestSameListenAddr(t *testing.T) {
+	cases := []struct {
+		name      string
+		givenAddr string
+		expected  bool
+	}{
+		{name: "AnyAddress", givenAddr: ":8080", expected: true},
+		{name: "UnspecifiedAddress", givenAddr: "0.0.0.0:8080", expected: true},
+		{name: "OtherPort", givenAddr: ":8081"},
+		{name: "SpecificAddress", givenAddr: "127.0.0.1:8080"},
+		{name: "AnyPort", givenAddr: ":0"},
+	}
+
+	bound := &net.TCPAddr{IP: net.IPv6unspecified, Port: 8080}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := sameListenAddr(bound, tc.givenAddr)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestSocketActivationListen(t *testing.T) {
+	// Arrange
+
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unclaimed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	a := &socketActivation{inherited: []*net.TCPListener{inherited.(*net.TCPListener), unclaimed.(*net.TCPListener)}}
+
+	// Act
+
+	taken, err := a.listen(inherited.Addr().String())
+	require.NoError(t, err)
+	defer taken.Close()
+	opened, err := a.listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer opened.Close()
+	closed := a.closeInherited()
+
+	// Assert
+
+	assert.Equal(t, inherited, taken)
+	assert.NotEqual(t, unclaimed.Addr(), opened.Addr())
+	assert.Equal(t, []string{unclaimed.Addr().String()}, closed)
+	_, err = unclaimed.Accept()
+	assert.Error(t, err, "unclaimed listeners are closed")
+	assert.Len(t, a.opened, 2, "opened listeners are passed on to upgrades")
+}
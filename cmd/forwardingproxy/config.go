@@ -0,0 +1,344 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// loadConfig reads the settings of the config file at path. The file is a
+// flat subset of TOML, assigning values to flags by their names, e.g.:
+//
+//	# Listeners
+//	addr = "0.0.0.0:8080"
+//	socksaddr = ":1080"
+//
+//	idletimeout = "5m"
+//	verbose = true
+//
+// Values may be quoted strings or bare numbers and booleans, and ${NAME}
+// within them is replaced by the value of the environment variable NAME,
+// e.g. pass = "${PROXY_PASS}", while $${ stands for a literal ${. The key
+// include reads the settings of another config file, relative to the
+// directory of the including file, e.g. include = "secrets.toml".
+//
+// The key version declares the version of the format a file is written for,
+// 1 if missing. Files of older versions are upgraded by configMigrations,
+// each file on its own, and descriptions of the changes made are returned
+// for logging.
+func loadConfig(path string) (map[string]string, []string, error) {
+	values := map[string]string{}
+	var migrated []string
+	if err := loadConfigFile(path, values, &migrated, map[string]bool{}); err != nil {
+		return nil, nil, err
+	}
+	return values, migrated, nil
+}
+
+// configMigration upgrades the settings of a config file by one version and
+// returns descriptions of the changes made.
+type configMigration func(values map[string]string) []string
+
+// configMigrations upgrade the settings of config files of older versions,
+// the one at index i from version i+1 to i+2, e.g. renaming keys of renamed
+// flags, so files written for older versions keep working.
+var configMigrations []configMigration
+
+// configVersion returns the current version of the config file format.
+func configVersion() int {
+	return len(configMigrations) + 1
+}
+
+// migrateConfig upgrades the settings of the config file at path from version
+// to the current version, appending descriptions of the changes made to
+// migrated.
+func migrateConfig(path string, values map[string]string, version int, migrated *[]string) {
+	for v := version; v < configVersion(); v++ {
+		for _, change := range configMigrations[v-1](values) {
+			*migrated = append(*migrated, fmt.Sprintf("%s: version %d to %d: %s", path, v, v+1, change))
+		}
+	}
+}
+
+// parseConfigVersion parses the value of the key version.
+func parseConfigVersion(value string) (int, error) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("malformed version %q", value)
+	}
+	if version > configVersion() {
+		return 0, fmt.Errorf("version %d is newer than the supported version %d", version, configVersion())
+	}
+	return version, nil
+}
+
+// loadConfigFile adds the settings of the config file at path to values,
+// migrated to the current version, see loadConfig. Including is the set of
+// files being read, to detect include cycles.
+func loadConfigFile(path string, values map[string]string, migrated *[]string, including map[string]bool) error {
+	if including[filepath.Clean(path)] {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+	including[filepath.Clean(path)] = true
+	defer delete(including, filepath.Clean(path))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The settings of the file are migrated before they are merged with the
+	// ones of other files, which may be of other versions.
+	own := map[string]string{}
+	var keys []string
+	version := 1
+	versionSet := false
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := parseConfigLine(line)
+		if err == nil {
+			value, err = expandConfigEnv(value)
+		}
+		if err == nil && key == "version" {
+			if versionSet {
+				err = fmt.Errorf("duplicate key %q", key)
+			} else {
+				version, err = parseConfigVersion(value)
+				versionSet = true
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		switch key {
+		case "version":
+			continue
+		case "include":
+			if !filepath.IsAbs(value) {
+				value = filepath.Join(filepath.Dir(path), value)
+			}
+			if err := loadConfigFile(value, values, migrated, including); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := own[key]; ok {
+			return fmt.Errorf("%s:%d: duplicate key %q", path, n, key)
+		}
+		own[key] = value
+		keys = append(keys, key)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	migrateConfig(path, own, version, migrated)
+	for _, key := range keys {
+		if _, ok := own[key]; !ok {
+			continue
+		}
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("%s: duplicate key %q", path, key)
+		}
+		values[key] = own[key]
+		delete(own, key)
+	}
+	// Keys added by migrations.
+	for key, value := range own {
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("%s: duplicate key %q", path, key)
+		}
+		values[key] = value
+	}
+	return nil
+}
+
+// expandConfigEnv replaces ${NAME} in the config value s by the value of the
+// environment variable NAME, and $${ by ${.
+func expandConfigEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		name := s[i+2 : i+end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q not set", name)
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+func parseConfigLine(line string) (key, value string, err error) {
+	i := strings.Index(line, "=")
+	if i < 0 {
+		if strings.HasPrefix(line, "[") {
+			return "", "", fmt.Errorf("tables are not supported")
+		}
+		return "", "", fmt.Errorf("missing '=' in %q", line)
+	}
+	key = strings.TrimSpace(line[:i])
+	value = strings.TrimSpace(line[i+1:])
+	if key == "" {
+		return "", "", fmt.Errorf("missing key in %q", line)
+	}
+
+	if strings.HasPrefix(value, `"`) {
+		// Comments may follow the closing quote.
+		end := closingQuote(value)
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string for key %q", key)
+		}
+		if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", "", fmt.Errorf("unexpected %q after value of key %q", rest, key)
+		}
+		value, err = strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", "", fmt.Errorf("malformed string for key %q: %v", key, err)
+		}
+		return key, value, nil
+	}
+
+	if i := strings.Index(value, "#"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	if value == "" || strings.ContainsAny(value, " \t'") {
+		return "", "", fmt.Errorf("malformed value for key %q", key)
+	}
+	return key, value, nil
+}
+
+// closingQuote returns the index of the quote closing the string starting at
+// the beginning of s, or -1 if there is none.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// applyConfig sets the flags of fs to values, except for the flags in
+// explicit, which were set on the command line and take precedence.
+func applyConfig(fs *flag.FlagSet, values map[string]string, explicit map[string]bool) error {
+	for key, value := range values {
+		if key == "config" {
+			return fmt.Errorf("key %q is not supported in config files", key)
+		}
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("invalid value %q for key %q: %v", value, key, err)
+		}
+	}
+	return nil
+}
+
+// flagValues returns the current values of the flags of fs by name.
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// reloadConfig reads the config file at path again, resetting the flags of fs
+// missing from it to their defaults, and returns the names of the flags with
+// changed values and the changes made migrating it, see loadConfig. Flags in
+// explicit are left untouched.
+func reloadConfig(fs *flag.FlagSet, path string, explicit map[string]bool) (changed, migrated []string, err error) {
+	values, migrated, err := loadConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	before := flagValues(fs)
+	var resetErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := values[f.Name]; ok || explicit[f.Name] || resetErr != nil {
+			return
+		}
+		resetErr = fs.Set(f.Name, f.DefValue)
+	})
+	if resetErr != nil {
+		return nil, nil, resetErr
+	}
+	if err = applyConfig(fs, values, explicit); err != nil {
+		return nil, nil, err
+	}
+
+	for name, value := range flagValues(fs) {
+		if value != before[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed, migrated, nil
+}
+
+// logConfigMigrated logs the changes made migrating the config file, so
+// operators can update it.
+func logConfigMigrated(logger *zap.Logger, migrated []string) {
+	for _, change := range migrated {
+		logger.Warn("Config file migrated, update it to the current version", zap.String("change", change), zap.Int("version", configVersion()))
+	}
+}
+
+// reloader applies the current values of flags to a running subsystem.
+type reloader struct {
+	flags  []string
+	reload func() error
+}
+
+// runReloaders runs all reloaders, as files named by unchanged flags may have
+// changed too, and warns about changed flags only applied on restart.
+func runReloaders(logger *zap.Logger, reloaders []reloader, changed []string) {
+	reloaded := map[string]bool{}
+	for _, r := range reloaders {
+		if err := r.reload(); err != nil {
+			logger.Error("Reloading setting failed", zap.Strings("flags", r.flags), zap.Error(err))
+		}
+		for _, name := range r.flags {
+			reloaded[name] = true
+		}
+	}
+	for _, name := range changed {
+		if !reloaded[name] {
+			logger.Warn("Changed setting requires a restart", zap.String("flag", name))
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigLine(t *testing.T) {
+	cases := []struct {
+		givenLine     string
+		expectedKey   string
+		expectedValue string
+		expectedErr   bool
+	}{
+		{givenLine: `addr = ":8080"`, expectedKey: "addr", expectedValue: ":8080"},
+		{givenLine: `proxyagent="a \"b\" # c" # Comment`, expectedKey: "proxyagent", expectedValue: `a "b" # c`},
+		{givenLine: `verbose = true`, expectedKey: "verbose", expectedValue: "true"},
+		{givenLine: `maxratetotal = 1048576 # 1 MiB/s`, expectedKey: "maxratetotal", expectedValue: "1048576"},
+		{givenLine: `[server]`, expectedErr: true},
+		{givenLine: `addr ":8080"`, expectedErr: true},
+		{givenLine: `= ":8080"`, expectedErr: true},
+		{givenLine: `addr = ":8080`, expectedErr: true},
+		{givenLine: `addr = ":8080" :8081`, expectedErr: true},
+		{givenLine: `addr = :8080 :8081`, expectedErr: true},
+		{givenLine: `addr = ':8080'`, expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenLine, func(t *testing.T) {
+			// Act
+
+			observedKey, observedValue, err := parseConfigLine(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedKey, observedKey)
+			assert.Equal(t, tc.expectedValue, observedValue)
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forwardingproxy.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Proxy\naddr = \":8080\"\nidletimeout = \"5m\"\nverbose = true\n"), 0600))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("addr", "", "")
+	idleTimeout := fs.Duration("idletimeout", time.Minute, "")
+	verbose := fs.Bool("verbose", false, "")
+	require.NoError(t, fs.Parse([]string{"-addr", ":9090"}))
+	explicit := map[string]bool{"addr": true}
+
+	values, _, err := loadConfig(path)
+	require.NoError(t, err)
+	require.NoError(t, applyConfig(fs, values, explicit))
+	require.NoError(t, ioutil.WriteFile(path, []byte("addr = \":8080\"\nidletimeout = \"10m\"\n"), 0600))
+
+	// Act
+
+	changed, _, err := reloadConfig(fs, path, explicit)
+
+	// Assert
+
+	require.NoError(t, err)
+	sort.Strings(changed)
+	assert.Equal(t, []string{"idletimeout", "verbose"}, changed)
+	assert.Equal(t, ":9090", *addr)
+	assert.Equal(t, 10*time.Minute, *idleTimeout)
+	assert.False(t, *verbose)
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	// Arrange
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("idletimeout", time.Minute, "")
+
+	cases := []struct {
+		name        string
+		givenValues map[string]string
+	}{
+		{name: "Unknown", givenValues: map[string]string{"unknown": "1"}},
+		{name: "Invalid", givenValues: map[string]string{"idletimeout": "1 minute"}},
+		{name: "Config", givenValues: map[string]string{"config": "other.toml"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			err := applyConfig(fs, tc.givenValues, nil)
+
+			// Assert
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	// Arrange
+
+	require.NoError(t, os.Setenv("FORWARDINGPROXY_TEST_PASS", "s3cret"))
+	defer os.Unsetenv("FORWARDINGPROXY_TEST_PASS")
+
+	cases := []struct {
+		givenValue    string
+		expectedValue string
+		expectedErr   bool
+	}{
+		{givenValue: "plain", expectedValue: "plain"},
+		{givenValue: "${FORWARDINGPROXY_TEST_PASS}", expectedValue: "s3cret"},
+		{givenValue: "user:${FORWARDINGPROXY_TEST_PASS}@host", expectedValue: "user:s3cret@host"},
+		{givenValue: "pa$$word $${FORWARDINGPROXY_TEST_PASS}", expectedValue: "pa$$word ${FORWARDINGPROXY_TEST_PASS}"},
+		{givenValue: "${FORWARDINGPROXY_TEST_UNSET}", expectedErr: true},
+		{givenValue: "${FORWARDINGPROXY_TEST_PASS", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenValue, func(t *testing.T) {
+			// Act
+
+			observed, err := expandConfigEnv(tc.givenValue)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedValue, observed)
+		})
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	// Arrange
+
+	require.NoError(t, os.Setenv("FORWARDINGPROXY_TEST_PASS", "s3cret"))
+	defer os.Unsetenv("FORWARDINGPROXY_TEST_PASS")
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forwardingproxy.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("addr = \":8080\"\ninclude = \"secrets.toml\"\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secrets.toml"), []byte("pass = \"${FORWARDINGPROXY_TEST_PASS}\"\n"), 0600))
+	cyclic := filepath.Join(dir, "cyclic.toml")
+	require.NoError(t, ioutil.WriteFile(cyclic, []byte("include = \"cyclic.toml\"\n"), 0600))
+
+	// Act
+
+	values, _, err := loadConfig(path)
+	_, _, cyclicErr := loadConfig(cyclic)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"addr": ":8080", "pass": "s3cret"}, values)
+	assert.Error(t, cyclicErr)
+}
+
+func TestLoadConfigVersion(t *testing.T) {
+	// Arrange
+
+	defer func(migrations []configMigration) { configMigrations = migrations }(configMigrations)
+	configMigrations = []configMigration{
+		func(values map[string]string) []string {
+			value, ok := values["timeout"]
+			if !ok {
+				return nil
+			}
+			delete(values, "timeout")
+			values["idletimeout"] = value
+			return []string{"timeout renamed to idletimeout"}
+		},
+	}
+
+	cases := []struct {
+		name             string
+		givenContent     string
+		expectedValues   map[string]string
+		expectedMigrated []string
+		expectedErr      bool
+	}{
+		{
+			name:             "Older",
+			givenContent:     "timeout = \"5m\"\n",
+			expectedValues:   map[string]string{"idletimeout": "5m"},
+			expectedMigrated: []string{"version 1 to 2: timeout renamed to idletimeout"},
+		},
+		{
+			name:           "Current",
+			givenContent:   "version = 2\ntimeout = \"5m\"\n",
+			expectedValues: map[string]string{"timeout": "5m"},
+		},
+		{name: "Newer", givenContent: "version = 3\n", expectedErr: true},
+		{name: "Malformed", givenContent: "version = \"two\"\n", expectedErr: true},
+		{name: "Duplicate", givenContent: "version = 1\nversion = 2\n", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "forwardingproxy.toml")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.givenContent), 0600))
+
+			// Act
+
+			values, migrated, err := loadConfig(path)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedValues, values)
+			var expectedMigrated []string
+			for _, change := range tc.expectedMigrated {
+				expectedMigrated = append(expectedMigrated, path+": "+change)
+			}
+			assert.Equal(t, expectedMigrated, migrated)
+		})
+	}
+}
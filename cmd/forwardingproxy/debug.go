@@ -0,0 +1,39 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// debugHandler returns a handler serving the profiles of net/http/pprof under
+// /debug/pprof/ and the variables of expvar at /debug/vars.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// tuneRuntime sets GOMAXPROCS to maxProcs and the GC percent to gcPercent,
+// keeping the ones of the environment for zero values.
+func tuneRuntime(logger *zap.Logger, maxProcs, gcPercent int) {
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+		logger.Info("GOMAXPROCS set", zap.Int("gomaxprocs", maxProcs))
+	}
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+		logger.Info("GC percent set", zap.Int("gcpercent", gcPercent))
+	}
+}
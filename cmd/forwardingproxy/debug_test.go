@@ -0,0 +1,88 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDebugHandler(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenPath      string
+		expectedStatus int
+	}{
+		{name: "Index", givenPath: "/debug/pprof/", expectedStatus: http.StatusOK},
+		{name: "Heap", givenPath: "/debug/pprof/heap", expectedStatus: http.StatusOK},
+		{name: "Goroutines", givenPath: "/debug/pprof/goroutine?debug=1", expectedStatus: http.StatusOK},
+		{name: "Vars", givenPath: "/debug/vars", expectedStatus: http.StatusOK},
+		{name: "Unknown", givenPath: "/debug/unknown", expectedStatus: http.StatusNotFound},
+	}
+
+	h := debugHandler()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			w := httptest.NewRecorder()
+
+			// Act
+
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.givenPath, nil))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestDebugHandlerVars(t *testing.T) {
+	// Arrange
+
+	w := httptest.NewRecorder()
+
+	// Act
+
+	debugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+
+	// Assert
+
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.Contains(t, vars, "memstats")
+	assert.Contains(t, vars, "cmdline")
+}
+
+func TestTuneRuntime(t *testing.T) {
+	// Arrange
+
+	maxProcs := runtime.GOMAXPROCS(0)
+	gcPercent := debug.SetGCPercent(100)
+	defer runtime.GOMAXPROCS(maxProcs)
+	defer debug.SetGCPercent(gcPercent)
+
+	// Act
+
+	tuneRuntime(zap.NewNop(), 1, 200)
+
+	// Assert
+
+	assert.Equal(t, 1, runtime.GOMAXPROCS(0))
+	assert.Equal(t, 200, debug.SetGCPercent(200))
+
+	// Zero values keep the current settings.
+	tuneRuntime(zap.NewNop(), 0, 0)
+	assert.Equal(t, 1, runtime.GOMAXPROCS(0))
+	assert.Equal(t, 200, debug.SetGCPercent(200))
+}
@@ -0,0 +1,240 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/betalo-sweden/forwardingproxy"
+)
+
+// listenerConfig is an additional listener of the proxy with policies of its
+// own.
+type listenerConfig struct {
+	addr     string
+	certPath string
+	keyPath  string
+	noAuth   bool
+	aclPath  string
+	// clientCAPath verifies the TLS client certificates of clients, which
+	// authenticate them.
+	clientCAPath string
+	// certAndCredentials requires clients to present both a client
+	// certificate and valid credentials.
+	certAndCredentials bool
+	// authSchemes are the authentication schemes offered on the listener,
+	// the ones of -authschemes if nil.
+	authSchemes []string
+}
+
+// loadListenerConfigs reads additional listeners from the file at path. Each
+// non-empty line not starting with '#' holds an address followed by optional
+// settings: a TLS certificate and key, CA certificates verifying client
+// certificates, whether clients must authenticate with either a client
+// certificate or credentials ("required", the default), with both ("all") or
+// not at all ("none"), the authentication schemes offered instead of the ones
+// of -authschemes, and an ACL file replacing the one of -acl, e.g.:
+//
+//	:443          cert=/etc/proxy/cert.pem key=/etc/proxy/key.pem acl=/etc/proxy/public.acl
+//	:8443         cert=/etc/proxy/cert.pem key=/etc/proxy/key.pem clientca=/etc/proxy/devices.pem auth=all
+//	:3128         schemes=digest
+//	10.0.0.1:3128 auth=none acl=/etc/proxy/internal.acl
+func loadListenerConfigs(path string) ([]listenerConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var configs []listenerConfig
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lc, err := parseListenerConfig(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		configs = append(configs, lc)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func parseListenerConfig(line string) (listenerConfig, error) {
+	fields := strings.Fields(line)
+	lc := listenerConfig{addr: fields[0]}
+	if _, _, err := net.SplitHostPort(lc.addr); err != nil {
+		return listenerConfig{}, fmt.Errorf("malformed address %q", lc.addr)
+	}
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return listenerConfig{}, fmt.Errorf("malformed setting %q", field)
+		}
+		key, value := strings.ToLower(field[:i]), field[i+1:]
+		switch key {
+		case "cert":
+			lc.certPath = value
+		case "key":
+			lc.keyPath = value
+		case "acl":
+			lc.aclPath = value
+		case "clientca":
+			lc.clientCAPath = value
+		case "schemes":
+			schemes, err := parseAuthSchemes(value)
+			if err != nil {
+				return listenerConfig{}, err
+			}
+			if schemes == nil {
+				return listenerConfig{}, errors.New("empty schemes")
+			}
+			lc.authSchemes = schemes
+		case "auth":
+			switch value {
+			case "required":
+				lc.noAuth, lc.certAndCredentials = false, false
+			case "all":
+				lc.noAuth, lc.certAndCredentials = false, true
+			case "none":
+				lc.noAuth, lc.certAndCredentials = true, false
+			default:
+				return listenerConfig{}, fmt.Errorf("malformed value of auth %q", value)
+			}
+		default:
+			return listenerConfig{}, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if (lc.certPath == "") != (lc.keyPath == "") {
+		return listenerConfig{}, errors.New("cert and key must be set together")
+	}
+	if lc.clientCAPath != "" && lc.certPath == "" {
+		return listenerConfig{}, errors.New("clientca requires cert and key")
+	}
+	if lc.certAndCredentials && lc.clientCAPath == "" {
+		return listenerConfig{}, errors.New("auth=all requires clientca")
+	}
+	return lc, nil
+}
+
+// parseAuthSchemes parses a comma-separated list of authentication scheme
+// names, returning nil if empty.
+func parseAuthSchemes(s string) ([]string, error) {
+	var schemes []string
+	for _, scheme := range forwardingproxy.SplitList(s) {
+		scheme = strings.ToLower(scheme)
+		switch scheme {
+		case forwardingproxy.AuthSchemeBasic, forwardingproxy.AuthSchemeBearer, forwardingproxy.AuthSchemeDigest:
+			schemes = append(schemes, scheme)
+		default:
+			return nil, fmt.Errorf("unknown authentication scheme %q", scheme)
+		}
+	}
+	return schemes, nil
+}
+
+// listenerSpec describes a listener of the process.
+type listenerSpec struct {
+	name   string
+	addr   string
+	listen func(addr string) (net.Listener, error)
+}
+
+// listenAll opens the listeners of specs by name. Either all listeners are
+// opened, or the ones opened already are closed again and an error naming
+// every listener failing to open is returned, so the process never runs with
+// only some of its listeners.
+func listenAll(specs []listenerSpec) (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+	var failures []string
+	for _, spec := range specs {
+		l, err := spec.listen(spec.addr)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s listener on %s: %v", spec.name, spec.addr, err))
+			continue
+		}
+		listeners[spec.name] = l
+	}
+	if len(failures) == 0 {
+		return listeners, nil
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	return nil, errors.New(strings.Join(failures, "; "))
+}
+
+// listenerHealth reports whether the listeners of the process are still
+// serving.
+type listenerHealth struct {
+	mu        sync.Mutex
+	listeners map[string]*listenerStatus
+}
+
+type listenerStatus struct {
+	Address string `json:"address"`
+	Serving bool   `json:"serving"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newListenerHealth returns the health of the opened listeners, all of which
+// are serving initially.
+func newListenerHealth(listeners map[string]net.Listener) *listenerHealth {
+	h := &listenerHealth{listeners: map[string]*listenerStatus{}}
+	for name, l := range listeners {
+		h.listeners[name] = &listenerStatus{Address: l.Addr().String(), Serving: true}
+	}
+	return h
+}
+
+// failed records that the listener name stopped serving with err.
+func (h *listenerHealth) failed(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.listeners[name]; ok {
+		s.Serving = false
+		s.Error = err.Error()
+	}
+}
+
+// statuses returns the status of all listeners and whether all of them are
+// serving.
+func (h *listenerHealth) statuses() (map[string]listenerStatus, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make(map[string]listenerStatus, len(h.listeners))
+	serving := true
+	for name, s := range h.listeners {
+		statuses[name] = *s
+		serving = serving && s.Serving
+	}
+	return statuses, serving
+}
+
+// ServeHTTP reports the status of all listeners as JSON, with status 503 if
+// any of them stopped serving.
+func (h *listenerHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses, serving := h.statuses()
+	status := http.StatusOK
+	if !serving {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(statuses)
+}
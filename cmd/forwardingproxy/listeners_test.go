@@ -0,0 +1,146 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAll(t *testing.T) {
+	// Arrange
+
+	listen := func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	var opened net.Listener
+	recordingListen := func(addr string) (net.Listener, error) {
+		l, err := listen(addr)
+		opened = l
+		return l, err
+	}
+
+	// Act
+
+	listeners, err := listenAll([]listenerSpec{
+		{name: "proxy", addr: "127.0.0.1:0", listen: recordingListen},
+		{name: "socks", addr: taken.Addr().String(), listen: listen},
+		{name: "metrics", addr: "127.0.0.1:-1", listen: listen},
+	})
+
+	// Assert
+
+	require.Error(t, err)
+	assert.Nil(t, listeners)
+	assert.Contains(t, err.Error(), "socks listener on "+taken.Addr().String())
+	assert.Contains(t, err.Error(), "metrics listener on 127.0.0.1:-1")
+	assert.NotContains(t, err.Error(), "proxy")
+	_, err = opened.Accept()
+	assert.Error(t, err, "opened listeners are closed again")
+
+	listeners, err = listenAll([]listenerSpec{
+		{name: "proxy", addr: "127.0.0.1:0", listen: listen},
+		{name: "socks", addr: "127.0.0.1:0", listen: listen},
+	})
+	require.NoError(t, err)
+	assert.Len(t, listeners, 2)
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func TestListenerHealth(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	h := newListenerHealth(map[string]net.Listener{"socks": l})
+
+	get := func() (int, map[string]listenerStatus) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var statuses map[string]listenerStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		return w.Code, statuses
+	}
+
+	// Act
+
+	servingCode, serving := get()
+	h.failed("socks", errors.New("accept failed"))
+	failedCode, failed := get()
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, servingCode)
+	assert.Equal(t, listenerStatus{Address: l.Addr().String(), Serving: true}, serving["socks"])
+	assert.Equal(t, http.StatusServiceUnavailable, failedCode)
+	assert.Equal(t, listenerStatus{Address: l.Addr().String(), Error: "accept failed"}, failed["socks"])
+}
+
+func TestParseListenerConfig(t *testing.T) {
+	cases := []struct {
+		givenLine      string
+		expectedConfig listenerConfig
+		expectedErr    bool
+	}{
+		{
+			givenLine:      ":443 cert=cert.pem key=key.pem acl=public.acl",
+			expectedConfig: listenerConfig{addr: ":443", certPath: "cert.pem", keyPath: "key.pem", aclPath: "public.acl"},
+		},
+		{
+			givenLine:      "10.0.0.1:3128 auth=none",
+			expectedConfig: listenerConfig{addr: "10.0.0.1:3128", noAuth: true},
+		},
+		{
+			givenLine:      ":8443 cert=cert.pem key=key.pem clientca=ca.pem auth=all",
+			expectedConfig: listenerConfig{addr: ":8443", certPath: "cert.pem", keyPath: "key.pem", clientCAPath: "ca.pem", certAndCredentials: true},
+		},
+		{
+			givenLine:      ":8443 cert=cert.pem key=key.pem clientca=ca.pem",
+			expectedConfig: listenerConfig{addr: ":8443", certPath: "cert.pem", keyPath: "key.pem", clientCAPath: "ca.pem"},
+		},
+		{
+			givenLine:      ":3128 schemes=Digest,bearer",
+			expectedConfig: listenerConfig{addr: ":3128", authSchemes: []string{"digest", "bearer"}},
+		},
+		{givenLine: "10.0.0.1", expectedErr: true},
+		{givenLine: ":443 cert=cert.pem", expectedErr: true},
+		{givenLine: ":443 auth=optional", expectedErr: true},
+		{givenLine: ":443 clientca=ca.pem", expectedErr: true},
+		{givenLine: ":443 cert=cert.pem key=key.pem auth=all", expectedErr: true},
+		{givenLine: ":443 timeout=5s", expectedErr: true},
+		{givenLine: ":443 auth", expectedErr: true},
+		{givenLine: ":3128 schemes=ntlm", expectedErr: true},
+		{givenLine: ":3128 schemes=", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenLine, func(t *testing.T) {
+			// Act
+
+			observed, err := parseListenerConfig(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, observed)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/betalo-sweden/forwardingproxy"
+)
+
+// startupProbes returns the probes of the dependencies of p named by names:
+// "upstream" for the upstream proxy, "resolver" for the resolver, probed by
+// looking up resolverHost, "ldap" for the LDAP server and "jwks" for the JWKS
+// endpoint of bearer token keys. Naming a dependency p is not configured
+// with is an error.
+func startupProbes(p *forwardingproxy.Proxy, names []string, resolverHost string) ([]forwardingproxy.StartupProbe, error) {
+	var probes []forwardingproxy.StartupProbe
+	for _, name := range names {
+		var check func(ctx context.Context) error
+		switch name {
+		case "upstream":
+			if p.Upstream != nil {
+				check = p.Upstream.Probe
+			}
+		case "resolver":
+			lookup := net.DefaultResolver.LookupIPAddr
+			if p.Resolver != nil {
+				lookup = p.Resolver.LookupIPAddr
+			}
+			check = func(ctx context.Context) error {
+				_, err := lookup(ctx, resolverHost)
+				return err
+			}
+		case "ldap":
+			if a, ok := p.Authenticator.(*forwardingproxy.LDAPAuthenticator); ok {
+				check = a.Probe
+			}
+		case "jwks":
+			if p.TokenAuth != nil && p.TokenAuth.KeySet != nil {
+				check = p.TokenAuth.KeySet.Probe
+			}
+		default:
+			return nil, fmt.Errorf("unknown dependency %q", name)
+		}
+		if check == nil {
+			return nil, fmt.Errorf("dependency %q not configured", name)
+		}
+		probes = append(probes, forwardingproxy.StartupProbe{Name: name, Check: check})
+	}
+	return probes, nil
+}
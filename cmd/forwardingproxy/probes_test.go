@@ -0,0 +1,68 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"testing"
+
+	"github.com/betalo-sweden/forwardingproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStartupProbes(t *testing.T) {
+	upstream, err := forwardingproxy.ParseUpstreamProxy("http://proxy.example.com:3128")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name           string
+		givenNames     []string
+		givenUpstream  *forwardingproxy.UpstreamProxy
+		expectedProbes []string
+		expectedErr    string
+	}{
+		{
+			name:           "Configured",
+			givenNames:     []string{"upstream", "resolver"},
+			givenUpstream:  upstream,
+			expectedProbes: []string{"upstream", "resolver"},
+		},
+		{
+			name:        "NotConfigured",
+			givenNames:  []string{"upstream"},
+			expectedErr: `dependency "upstream" not configured`,
+		},
+		{
+			name:        "Unknown",
+			givenNames:  []string{"geoip"},
+			expectedErr: `unknown dependency "geoip"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := forwardingproxy.New(zap.NewNop())
+			p.Upstream = tc.givenUpstream
+
+			// Act
+
+			probes, err := startupProbes(p, tc.givenNames, "example.com")
+
+			// Assert
+
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, probe := range probes {
+				names = append(names, probe.Name)
+			}
+			assert.Equal(t, tc.expectedProbes, names)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/betalo-sweden/forwardingproxy"
+)
+
+// readiness reports whether the process should receive traffic: all of its
+// listeners are serving, it is not draining for shutdown, and its
+// dependencies were reachable when last checked. Unlike the health of the
+// listeners, readiness is reported as not ready while draining, so load
+// balancers stop sending new clients before the listeners close.
+type readiness struct {
+	health *listenerHealth
+	// probes check the dependencies, e.g. the upstream proxy.
+	probes []forwardingproxy.StartupProbe
+
+	mu       sync.Mutex
+	draining bool
+	// checked is set once the dependencies were checked, as the process
+	// is not ready before.
+	checked      bool
+	dependencies map[string]dependencyStatus
+}
+
+type dependencyStatus struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// readinessReport is the JSON body of readiness responses.
+type readinessReport struct {
+	Ready        bool                        `json:"ready"`
+	Draining     bool                        `json:"draining"`
+	Listeners    map[string]listenerStatus   `json:"listeners"`
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+}
+
+// drain records that the process started draining for shutdown.
+func (r *readiness) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+}
+
+// check probes the dependencies concurrently, each within timeout, and
+// records their status.
+func (r *readiness) check(ctx context.Context, timeout time.Duration) {
+	statuses := make([]dependencyStatus, len(r.probes))
+	var wg sync.WaitGroup
+	for i, probe := range r.probes {
+		wg.Add(1)
+		go func(i int, probe forwardingproxy.StartupProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if err := probe.Check(ctx); err != nil {
+				statuses[i] = dependencyStatus{Error: err.Error()}
+			} else {
+				statuses[i] = dependencyStatus{Reachable: true}
+			}
+		}(i, probe)
+	}
+	wg.Wait()
+
+	dependencies := make(map[string]dependencyStatus, len(r.probes))
+	for i, probe := range r.probes {
+		dependencies[probe.Name] = statuses[i]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checked = true
+	r.dependencies = dependencies
+}
+
+// run checks the dependencies right away and then every interval until stop
+// is closed, bounding every check by interval.
+func (r *readiness) run(interval time.Duration, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		r.check(ctx, interval)
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// report returns the readiness of the process.
+func (r *readiness) report() readinessReport {
+	listeners, serving := r.health.statuses()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := readinessReport{
+		Ready:        serving && !r.draining && (r.checked || len(r.probes) == 0),
+		Draining:     r.draining,
+		Listeners:    listeners,
+		Dependencies: r.dependencies,
+	}
+	for _, d := range r.dependencies {
+		report.Ready = report.Ready && d.Reachable
+	}
+	return report
+}
+
+// ServeHTTP reports the readiness of the process as JSON, with status 503 if
+// it is not ready.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.report()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/betalo-sweden/forwardingproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	reachable := func(ctx context.Context) error { return nil }
+	unreachable := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	cases := []struct {
+		name               string
+		givenCheck         func(ctx context.Context) error
+		givenChecked       bool
+		givenDraining      bool
+		givenFailed        bool
+		expectedCode       int
+		expectedDependency dependencyStatus
+	}{
+		{name: "Ready", expectedCode: http.StatusOK},
+		{name: "UpstreamReachable", givenCheck: reachable, givenChecked: true, expectedCode: http.StatusOK, expectedDependency: dependencyStatus{Reachable: true}},
+		{name: "UpstreamUnreachable", givenCheck: unreachable, givenChecked: true, expectedCode: http.StatusServiceUnavailable, expectedDependency: dependencyStatus{Error: "connection refused"}},
+		{name: "UpstreamNotCheckedYet", givenCheck: reachable, expectedCode: http.StatusServiceUnavailable},
+		{name: "Draining", givenDraining: true, expectedCode: http.StatusServiceUnavailable},
+		{name: "ListenerFailed", givenFailed: true, expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			r := &readiness{health: newListenerHealth(map[string]net.Listener{"proxy": l})}
+			if tc.givenCheck != nil {
+				r.probes = []forwardingproxy.StartupProbe{{Name: "upstream", Check: tc.givenCheck}}
+			}
+			if tc.givenChecked {
+				r.check(context.Background(), time.Second)
+			}
+			if tc.givenDraining {
+				r.drain()
+			}
+			if tc.givenFailed {
+				r.health.failed("proxy", errors.New("accept failed"))
+			}
+
+			// Act
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			var report readinessReport
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+			assert.Equal(t, tc.expectedCode == http.StatusOK, report.Ready)
+			assert.Equal(t, tc.givenDraining, report.Draining)
+			assert.Equal(t, !tc.givenFailed, report.Listeners["proxy"].Serving)
+			if tc.givenChecked {
+				assert.Equal(t, tc.expectedDependency, report.Dependencies["upstream"])
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/betalo-sweden/forwardingproxy"
+)
+
+// headerFlag collects repeated "Name: value" header fields of a flag.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var fields []string
+	for name, values := range h {
+		for _, value := range values {
+			fields = append(fields, name+": "+value)
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return errors.New("header field must be given as Name: value")
+	}
+	name := http.CanonicalHeaderKey(strings.TrimSpace(s[:i]))
+	h[name] = append(h[name], strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// runReplay replays the requests recorded via -mitmrecord given as args, e.g.
+// "replay -target https://staging.example.com requests.jsonl", writing the
+// outcome of each to stdout. It returns the exit code of the command.
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage of forwardingproxy replay [flags] file:")
+		fs.PrintDefaults()
+	}
+	header := headerFlag{}
+	fs.Var(header, "header", "Header field as Name: value overriding the recorded one, or removing it if the value is empty (repeatable)")
+	var (
+		flagInsecure = fs.Bool("insecure", false, "Skip verifying the TLS certificates of destinations, e.g. of staging hosts")
+		flagMatch    = fs.String("match", "", "Regular expression of the URLs of the recorded requests to replay (all if empty)")
+		flagTarget   = fs.String("target", "", "URL of the scheme and host to send the requests to instead of their origins, e.g. https://staging.example.com")
+		flagTimeout  = fs.Duration("timeout", 30*time.Second, "Timeout of each replayed request")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var target *url.URL
+	if *flagTarget != "" {
+		var err error
+		target, err = url.Parse(*flagTarget)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			fmt.Fprintf(stderr, "Invalid target %q, must be a URL such as https://staging.example.com\n", *flagTarget)
+			return 2
+		}
+	}
+	var match *regexp.Regexp
+	if *flagMatch != "" {
+		var err error
+		match, err = regexp.Compile(*flagMatch)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid match: %v\n", err)
+			return 2
+		}
+	}
+	recs, err := forwardingproxy.LoadRecordedRequests(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Loading recorded requests failed: %v\n", err)
+		return 1
+	}
+
+	// Redirects are reported rather than followed, as they are responses to
+	// the replayed request too.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *flagInsecure},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       *flagTimeout,
+	}
+	code := 0
+	for i := range recs {
+		rec := &recs[i]
+		if match != nil && !match.MatchString(rec.URL) {
+			continue
+		}
+		r, err := rec.NewRequest(target, http.Header(header))
+		if err != nil {
+			fmt.Fprintf(stdout, "%s %s: %v\n", rec.Method, rec.URL, err)
+			code = 1
+			continue
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			fmt.Fprintf(stdout, "%s %s: %v\n", r.Method, r.URL, err)
+			code = 1
+			continue
+		}
+		n, _ := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		fmt.Fprintf(stdout, "%s %s: %s (%d bytes)\n", r.Method, r.URL, resp.Status, n)
+	}
+	return code
+}
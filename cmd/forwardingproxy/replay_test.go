@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/betalo-sweden/forwardingproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunReplay(t *testing.T) {
+	// Arrange
+
+	var (
+		mu       sync.Mutex
+		observed []string
+	)
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		observed = append(observed, r.Method+" "+r.Host+r.URL.String()+" "+r.Header.Get("Authorization")+" "+string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer staging.Close()
+
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "requests.jsonl")
+	var recorded bytes.Buffer
+	for _, rec := range []forwardingproxy.RecordedRequest{
+		{Method: http.MethodPost, URL: "https://api.example.com/v1/items", Header: http.Header{"Authorization": {"Bearer production"}}, Body: []byte("ping")},
+		{Method: http.MethodGet, URL: "https://www.example.com/"},
+		{Method: http.MethodPost, URL: "https://api.example.com/v1/uploads", Truncated: true},
+	} {
+		b, err := json.Marshal(rec)
+		require.NoError(t, err)
+		recorded.Write(append(b, '\n'))
+	}
+	require.NoError(t, ioutil.WriteFile(path, recorded.Bytes(), 0600))
+
+	var stdout, stderr bytes.Buffer
+
+	// Act
+
+	code := runReplay([]string{
+		"-target", staging.URL,
+		"-match", "^https://api\\.example\\.com/",
+		"-header", "Authorization: Bearer staging",
+		"-header", "Host: api.example.com",
+		path,
+	}, &stdout, &stderr)
+
+	// Assert
+
+	assert.Equal(t, 1, code, "truncated requests fail the replay")
+	assert.Empty(t, stderr.String())
+	assert.Equal(t, []string{"POST api.example.com/v1/items Bearer staging ping"}, observed)
+	assert.Contains(t, stdout.String(), "POST "+staging.URL+"/v1/items: 201 Created (0 bytes)\n")
+	assert.Contains(t, stdout.String(), "POST https://api.example.com/v1/uploads: request body not recorded completely\n")
+	assert.NotContains(t, stdout.String(), "www.example.com")
+}
+
+func TestRunReplayUsage(t *testing.T) {
+	cases := []struct {
+		name      string
+		givenArgs []string
+	}{
+		{name: "NoFile", givenArgs: nil},
+		{name: "InvalidTarget", givenArgs: []string{"-target", "staging.example.com", "requests.jsonl"}},
+		{name: "InvalidMatch", givenArgs: []string{"-match", "(", "requests.jsonl"}},
+		{name: "InvalidHeader", givenArgs: []string{"-header", "Authorization", "requests.jsonl"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			var stdout, stderr bytes.Buffer
+			code := runReplay(tc.givenArgs, &stdout, &stderr)
+
+			// Assert
+
+			assert.Equal(t, 2, code)
+			assert.NotEmpty(t, stderr.String())
+		})
+	}
+}
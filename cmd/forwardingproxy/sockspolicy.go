@@ -0,0 +1,89 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// socksCommandConfig is the policy of a SOCKS command.
+type socksCommandConfig struct {
+	command string
+	users   []string
+	aclPath string
+}
+
+// loadSOCKSCommandConfigs reads the policies of SOCKS commands from the file
+// at path. Each non-empty line not starting with '#' enables a command
+// ("connect", "bind" or "udpassociate") followed by optional settings: the
+// comma separated users allowed to use it, all if not set, and an ACL file
+// further restricting its destinations, e.g.:
+//
+//	connect
+//	udpassociate users=alice,bob acl=/etc/proxy/udp.acl
+//
+// Commands not listed are disabled.
+func loadSOCKSCommandConfigs(path string) ([]socksCommandConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var configs []socksCommandConfig
+	seen := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cc, err := parseSOCKSCommandConfig(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if seen[cc.command] {
+			return nil, fmt.Errorf("%s:%d: duplicate command %q", path, n, cc.command)
+		}
+		seen[cc.command] = true
+		configs = append(configs, cc)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func parseSOCKSCommandConfig(line string) (socksCommandConfig, error) {
+	fields := strings.Fields(line)
+	cc := socksCommandConfig{command: strings.ToLower(fields[0])}
+	switch cc.command {
+	case "connect", "bind", "udpassociate":
+	default:
+		return socksCommandConfig{}, fmt.Errorf("unknown command %q", fields[0])
+	}
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return socksCommandConfig{}, fmt.Errorf("malformed setting %q", field)
+		}
+		key, value := strings.ToLower(field[:i]), field[i+1:]
+		switch key {
+		case "users":
+			for _, u := range strings.Split(value, ",") {
+				if u == "" {
+					return socksCommandConfig{}, fmt.Errorf("malformed value of users %q", value)
+				}
+				cc.users = append(cc.users, u)
+			}
+		case "acl":
+			cc.aclPath = value
+		default:
+			return socksCommandConfig{}, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return cc, nil
+}
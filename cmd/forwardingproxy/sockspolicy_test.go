@@ -0,0 +1,52 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSOCKSCommandConfig(t *testing.T) {
+	cases := []struct {
+		givenLine      string
+		expectedConfig socksCommandConfig
+		expectedErr    bool
+	}{
+		{
+			givenLine:      "connect",
+			expectedConfig: socksCommandConfig{command: "connect"},
+		},
+		{
+			givenLine:      "UDPAssociate users=alice,bob acl=udp.acl",
+			expectedConfig: socksCommandConfig{command: "udpassociate", users: []string{"alice", "bob"}, aclPath: "udp.acl"},
+		},
+		{
+			givenLine:      "bind acl=bind.acl",
+			expectedConfig: socksCommandConfig{command: "bind", aclPath: "bind.acl"},
+		},
+		{givenLine: "resolve", expectedErr: true},
+		{givenLine: "connect users=alice,,bob", expectedErr: true},
+		{givenLine: "connect timeout=5s", expectedErr: true},
+		{givenLine: "connect users", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenLine, func(t *testing.T) {
+			// Act
+
+			observed, err := parseSOCKSCommandConfig(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, observed)
+		})
+	}
+}
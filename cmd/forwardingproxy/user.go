@@ -0,0 +1,240 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userCommands are the subcommands of the user command and whether they take
+// a user name.
+var userCommands = map[string]bool{
+	"add":    true,
+	"passwd": true,
+	"remove": true,
+	"list":   false,
+}
+
+// runUser manages the users of the htpasswd file of -htpasswd given as args,
+// e.g. "user add -htpasswd /etc/forwardingproxy/htpasswd alice", reading new
+// passwords from the first line of stdin. It returns the exit code of the
+// command. The file is replaced atomically, so a proxy watching it reloads it
+// via -htpasswdreloadinterval or SIGHUP.
+func runUser(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	usage := func() {
+		fmt.Fprintln(stderr, "Usage of forwardingproxy user add|passwd|remove [flags] name, or user list [flags]:")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	cmd := args[0]
+	takesName, ok := userCommands[cmd]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown user command %q\n", cmd)
+		usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("user "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	var (
+		flagCost = fs.Int("cost", bcrypt.DefaultCost, "Cost of the bcrypt hashes of new passwords")
+		flagPath = fs.String("htpasswd", "", "Filepath to the htpasswd file of the users, created by add if missing")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	wantArgs := 0
+	if takesName {
+		wantArgs = 1
+	}
+	if *flagPath == "" || fs.NArg() != wantArgs {
+		fs.Usage()
+		return 2
+	}
+	if *flagCost < bcrypt.MinCost || *flagCost > bcrypt.MaxCost {
+		fmt.Fprintf(stderr, "Invalid cost %d, must be between %d and %d\n", *flagCost, bcrypt.MinCost, bcrypt.MaxCost)
+		return 2
+	}
+	user := fs.Arg(0)
+	if takesName && !validHtpasswdUser(user) {
+		fmt.Fprintf(stderr, "Invalid user name %q, must not be empty or contain colons or whitespace\n", user)
+		return 2
+	}
+
+	f, err := readHtpasswdFile(*flagPath, cmd == "add")
+	if err != nil {
+		fmt.Fprintf(stderr, "Reading htpasswd file failed: %v\n", err)
+		return 1
+	}
+	i := f.index(user)
+	switch cmd {
+	case "list":
+		for _, user := range f.users() {
+			fmt.Fprintln(stdout, user)
+		}
+		return 0
+	case "add":
+		if i >= 0 {
+			fmt.Fprintf(stderr, "User %q exists already, use passwd to change the password\n", user)
+			return 1
+		}
+	case "passwd", "remove":
+		if i < 0 {
+			fmt.Fprintf(stderr, "User %q does not exist\n", user)
+			return 1
+		}
+	}
+
+	if cmd == "remove" {
+		f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	} else {
+		pass, err := readPassword(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "Reading password failed: %v\n", err)
+			return 1
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), *flagCost)
+		if err != nil {
+			fmt.Fprintf(stderr, "Hashing password failed: %v\n", err)
+			return 1
+		}
+		line := user + ":" + string(hash)
+		if i < 0 {
+			f.lines = append(f.lines, line)
+		} else {
+			f.lines[i] = line
+		}
+	}
+	if err := f.write(); err != nil {
+		fmt.Fprintf(stderr, "Writing htpasswd file failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// validHtpasswdUser reports whether user can be stored in an htpasswd file.
+func validHtpasswdUser(user string) bool {
+	return user != "" && !strings.ContainsAny(user, ": \t\r\n")
+}
+
+// readPassword returns the first line of r as password.
+func readPassword(r io.Reader) (string, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("no password given on standard input")
+	}
+	pass := strings.TrimSuffix(s.Text(), "\r")
+	if pass == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return pass, nil
+}
+
+// htpasswdFile is an htpasswd file as its lines, kept verbatim besides the
+// entries changed, so comments and the order of users are preserved.
+type htpasswdFile struct {
+	path  string
+	mode  os.FileMode
+	lines []string
+}
+
+// readHtpasswdFile reads the htpasswd file at path, or returns an empty file
+// if create is set and the file does not exist.
+func readHtpasswdFile(path string, create bool) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: path, mode: 0600}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f.mode = fi.Mode().Perm()
+	if s := strings.TrimRight(string(b), "\n"); s != "" {
+		f.lines = strings.Split(s, "\n")
+	}
+	return f, nil
+}
+
+// entryUser returns the user of the entry line, or "" if line is no entry.
+func entryUser(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	if i := strings.IndexByte(line, ':'); i > 0 {
+		return line[:i]
+	}
+	return ""
+}
+
+// index returns the line of the entry of user, or -1 if there is none.
+func (f *htpasswdFile) index(user string) int {
+	for i, line := range f.lines {
+		if user != "" && entryUser(line) == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// users returns the users of f in the order of their entries.
+func (f *htpasswdFile) users() []string {
+	var users []string
+	for _, line := range f.lines {
+		if user := entryUser(line); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// write replaces the file at f.path by f via a temporary file in the same
+// directory, so readers never see a partially written file.
+func (f *htpasswdFile) write() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var content string
+	if len(f.lines) > 0 {
+		content = strings.Join(f.lines, "\n") + "\n"
+	}
+	if _, err := io.WriteString(tmp, content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(f.mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/betalo-sweden/forwardingproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunUser(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "user")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Operators\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0640))
+
+	run := func(stdin string, args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := runUser(append(args[:1:1], append([]string{"-htpasswd", path, "-cost", "4"}, args[1:]...)...), strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String() + stderr.String()
+	}
+
+	// Act & Assert
+
+	code, out := run("s3cret\n", "add", "alice")
+	require.Equal(t, 0, code, out)
+	code, out = run("s3cret\n", "add", "alice")
+	assert.Equal(t, 1, code, "users are added once")
+	assert.Contains(t, out, "exists already")
+
+	a, err := forwardingproxy.LoadHtpasswd(path)
+	require.NoError(t, err)
+	_, err = a.Authenticate(context.Background(), "alice", "s3cret", nil)
+	assert.NoError(t, err)
+
+	code, out = run("n3w\n", "passwd", "alice")
+	require.Equal(t, 0, code, out)
+	require.NoError(t, a.Reload(path))
+	_, err = a.Authenticate(context.Background(), "alice", "n3w", nil)
+	assert.NoError(t, err)
+
+	code, out = run("", "list")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "bob\nalice\n", out)
+
+	code, out = run("", "remove", "bob")
+	require.Equal(t, 0, code, out)
+	code, _ = run("", "remove", "bob")
+	assert.Equal(t, 1, code, "missing users are not removed")
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "# Operators\nalice:$2a$04$"), "comments are kept")
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}
+
+func TestRunUserUsage(t *testing.T) {
+	cases := []struct {
+		name      string
+		givenArgs []string
+	}{
+		{name: "NoCommand", givenArgs: nil},
+		{name: "UnknownCommand", givenArgs: []string{"rename", "-htpasswd", "htpasswd", "alice"}},
+		{name: "NoFile", givenArgs: []string{"add", "alice"}},
+		{name: "NoName", givenArgs: []string{"add", "-htpasswd", "htpasswd"}},
+		{name: "InvalidName", givenArgs: []string{"add", "-htpasswd", "htpasswd", "al:ice"}},
+		{name: "InvalidCost", givenArgs: []string{"add", "-htpasswd", "htpasswd", "-cost", "99", "alice"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			var stdout, stderr bytes.Buffer
+			code := runUser(tc.givenArgs, strings.NewReader("s3cret\n"), &stdout, &stderr)
+
+			// Assert
+
+			assert.Equal(t, 2, code)
+			assert.NotEmpty(t, stderr.String())
+		})
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultRealm is the realm of authentication challenges if Proxy.Realm
+	// is empty.
+	defaultRealm = "proxy"
+	// connCredentialsTTL bounds how long credentials are cached per client
+	// connection, so revoked credentials stop working on long-lived
+	// keep-alive connections too.
+	connCredentialsTTL = time.Minute
+)
+
+// Names of the authentication schemes of Proxy.AuthSchemes and
+// ListenerPolicy.AuthSchemes. Schemes of HandshakeAuthenticators are named
+// by their Scheme.
+const (
+	AuthSchemeBasic  = "basic"
+	AuthSchemeBearer = "bearer"
+	AuthSchemeDigest = "digest"
+)
+
+var realmReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func (p *Proxy) realm() string {
+	if p.Realm == "" {
+		return defaultRealm
+	}
+	return p.Realm
+}
+
+// basicAuth reports whether clients can authenticate with Basic credentials.
+func (p *Proxy) basicAuth() bool {
+	return p.Authenticator != nil || p.staticAuth()
+}
+
+// offersScheme reports whether the authentication scheme is offered to the
+// client of r, by the schemes of its listener policy or AuthSchemes.
+func (p *Proxy) offersScheme(r *http.Request, scheme string) bool {
+	schemes := p.AuthSchemes
+	if lp := listenerPolicyFromContext(r.Context()); lp != nil && lp.AuthSchemes != nil {
+		schemes = lp.AuthSchemes
+	}
+	if len(schemes) == 0 {
+		return true
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge asks the client of r for proxy credentials via every scheme
+// offered to it, strongest first. Clients retry with credentials sent via
+// the Proxy-Authorization header. Clients amid a handshake are only sent its
+// next token.
+func (p *Proxy) challenge(w http.ResponseWriter, r *http.Request) {
+	if scheme, token := p.connCredentials.pendingChallenge(r.RemoteAddr); scheme != "" {
+		w.Header().Set("Proxy-Authenticate", scheme+" "+base64.StdEncoding.EncodeToString(token))
+		return
+	}
+	realm := realmReplacer.Replace(p.realm())
+	h := w.Header()
+	h.Del("Proxy-Authenticate")
+	for _, a := range p.HandshakeAuthenticators {
+		if p.offersScheme(r, a.Scheme()) {
+			h.Add("Proxy-Authenticate", a.Scheme())
+		}
+	}
+	if p.Digest != nil && p.offersScheme(r, AuthSchemeDigest) {
+		h.Add("Proxy-Authenticate", p.Digest.challenge(r, p.realm()))
+	}
+	if p.basicAuth() && p.offersScheme(r, AuthSchemeBasic) {
+		h.Add("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+	}
+	if p.TokenAuth != nil && p.offersScheme(r, AuthSchemeBearer) {
+		h.Add("Proxy-Authenticate", `Bearer realm="`+realm+`"`)
+	}
+}
+
+// authenticateDigest checks the Digest credentials creds of r, and returns
+// the authenticated user.
+func (p *Proxy) authenticateDigest(r *http.Request, creds string) (string, bool) {
+	user, err := p.Digest.authenticate(r.Context(), r, creds, p.realm())
+	if err != nil {
+		if err != ErrInvalidCredentials {
+			p.Logger.Error("Digest authentication failed", zap.Error(err))
+		}
+		return "", false
+	}
+	return user, true
+}
+
+// authenticateHandshake continues the handshake of the connection of r with
+// the Proxy-Authorization header authz, if any of HandshakeAuthenticators is
+// offered for its scheme. Requests without credentials on a connection
+// authenticated by a handshake are authenticated as its user. handled is
+// false if authz is not part of a handshake.
+func (p *Proxy) authenticateHandshake(r *http.Request, authz string) (user string, ok, handled bool) {
+	if authz == "" {
+		user, ok := p.connCredentials.handshakeUser(r.RemoteAddr)
+		return user, ok, ok
+	}
+	for _, a := range p.HandshakeAuthenticators {
+		scheme := a.Scheme()
+		if len(authz) <= len(scheme) || authz[len(scheme)] != ' ' || !strings.EqualFold(authz[:len(scheme)], scheme) ||
+			!p.offersScheme(r, scheme) {
+			continue
+		}
+		token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(authz[len(scheme)+1:]))
+		if err != nil {
+			p.connCredentials.endHandshake(r.RemoteAddr)
+			return "", false, true
+		}
+		hs := p.connCredentials.handshake(r.RemoteAddr, scheme)
+		if hs == nil {
+			hs = a.NewHandshake()
+		}
+		id, next, err := hs.Step(r.Context(), token, r)
+		switch {
+		case err != nil:
+			if err != ErrInvalidCredentials {
+				p.Logger.Error("Authentication handshake failed", zap.String("scheme", scheme), zap.Error(err))
+			}
+			p.connCredentials.endHandshake(r.RemoteAddr)
+			return "", false, true
+		case id != nil:
+			p.connCredentials.completeHandshake(r.RemoteAddr, id.User)
+			return id.User, true, true
+		default:
+			p.connCredentials.continueHandshake(r.RemoteAddr, scheme, hs, next)
+			return "", false, true
+		}
+	}
+	return "", false, false
+}
+
+// ConnState caches the credentials authenticated on each keep-alive client
+// connection, so clients resending the same credentials with every request
+// are not authenticated against the credential store again, and keeps the
+// state of connection-oriented handshakes, see HandshakeAuthenticator. It is
+// meant to be set as http.Server.ConnState of servers serving the proxy;
+// credentials are not cached and handshakes can not continue otherwise.
+func (p *Proxy) ConnState(conn net.Conn, state http.ConnState) {
+	p.connCredentials.track(conn.RemoteAddr().String(), state)
+}
+
+// connCredentials are the credentials authenticated per client connection,
+// by the remote address of the connection. A cached credential only
+// authenticates requests sending the very same Proxy-Authorization header on
+// the same connection, so it can not be replayed via other connections, and
+// requests without credentials are challenged as before. Connections
+// authenticated by a handshake are authenticated for their lifetime, as
+// connection-oriented schemes do not send credentials with every request.
+type connCredentials struct {
+	mu    sync.Mutex
+	conns map[string]*connCredential
+}
+
+type connCredential struct {
+	authz   string
+	user    string
+	expires time.Time
+
+	// handshake is the handshake in progress of scheme, with the token the
+	// client is challenged with next.
+	scheme    string
+	handshake AuthHandshake
+	next      []byte
+	// handshakeUser is the user authenticated by a completed handshake.
+	handshakeUser string
+}
+
+// track adds the connection from addr once new and removes it once closed or
+// hijacked, as hijacked connections are not served as HTTP anymore.
+func (c *connCredentials) track(addr string, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		if c.conns == nil {
+			c.conns = make(map[string]*connCredential)
+		}
+		c.conns[addr] = &connCredential{}
+	case http.StateClosed, http.StateHijacked:
+		delete(c.conns, addr)
+	}
+}
+
+// lookup returns the user authenticated on the connection from addr with the
+// Proxy-Authorization header authz, if cached.
+func (c *connCredentials) lookup(addr, authz string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.conns[addr]
+	if !ok || cred.authz == "" || !time.Now().Before(cred.expires) || subtle.ConstantTimeCompare([]byte(cred.authz), []byte(authz)) != 1 {
+		return "", false
+	}
+	return cred.user, true
+}
+
+// store caches the user authenticated on the connection from addr with the
+// Proxy-Authorization header authz, if the connection is tracked.
+func (c *connCredentials) store(addr, authz, user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok {
+		cred.authz, cred.user, cred.expires = authz, user, time.Now().Add(connCredentialsTTL)
+	}
+}
+
+// handshake returns the handshake of scheme in progress on the connection
+// from addr, or nil.
+func (c *connCredentials) handshake(addr, scheme string) AuthHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok && cred.scheme == scheme {
+		return cred.handshake
+	}
+	return nil
+}
+
+// continueHandshake records the handshake hs of scheme in progress on the
+// connection from addr, whose client is challenged with next.
+func (c *connCredentials) continueHandshake(addr, scheme string, hs AuthHandshake, next []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok {
+		cred.scheme, cred.handshake, cred.next = scheme, hs, next
+		cred.handshakeUser = ""
+	}
+}
+
+// pendingChallenge returns the scheme and the next token of the handshake in
+// progress on the connection from addr, if any.
+func (c *connCredentials) pendingChallenge(addr string) (string, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok && cred.handshake != nil {
+		return cred.scheme, cred.next
+	}
+	return "", nil
+}
+
+// completeHandshake authenticates the connection from addr as user.
+func (c *connCredentials) completeHandshake(addr, user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok {
+		cred.scheme, cred.handshake, cred.next = "", nil, nil
+		cred.handshakeUser = user
+	}
+}
+
+// endHandshake ends the failed handshake of the connection from addr, which
+// is not authenticated anymore.
+func (c *connCredentials) endHandshake(addr string) {
+	c.completeHandshake(addr, "")
+}
+
+// handshakeUser returns the user the connection from addr was authenticated
+// as by a handshake, if any.
+func (c *connCredentials) handshakeUser(addr string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cred, ok := c.conns[addr]; ok && cred.handshakeUser != "" {
+		return cred.handshakeUser, true
+	}
+	return "", false
+}
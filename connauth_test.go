@@ -0,0 +1,224 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingAuthenticator counts the authentications of the wrapped
+// authenticator.
+type countingAuthenticator struct {
+	Authenticator
+	n int32
+}
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error) {
+	atomic.AddInt32(&a.n, 1)
+	return a.Authenticator.Authenticate(ctx, user, pass, r)
+}
+
+func TestServeHTTPChallenge(t *testing.T) {
+	cases := []struct {
+		name            string
+		givenRealm      string
+		givenTokenAuth  *TokenAuth
+		expectedHeaders []string
+	}{
+		{name: "DefaultRealm", expectedHeaders: []string{`Basic realm="proxy"`}},
+		{name: "Realm", givenRealm: `Corp "Egress"`, expectedHeaders: []string{`Basic realm="Corp \"Egress\""`}},
+		{name: "TokenAuth", givenTokenAuth: &TokenAuth{}, expectedHeaders: []string{`Basic realm="proxy"`, `Bearer realm="proxy"`}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.AuthUser, p.AuthPass = "user", "pass"
+			p.Realm = tc.givenRealm
+			p.TokenAuth = tc.givenTokenAuth
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "example.com:443", nil))
+
+			// Assert
+
+			assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+			assert.Equal(t, tc.expectedHeaders, w.Header()["Proxy-Authenticate"])
+		})
+	}
+}
+
+func TestProxyCachesConnCredentials(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	authenticator := &countingAuthenticator{Authenticator: &StaticAuthenticator{User: "user", Pass: "pass"}}
+	p := newTestProxy()
+	p.Authenticator = authenticator
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	proxyServer := httptest.NewUnstartedServer(p)
+	proxyServer.Config.ConnState = p.ConnState
+	proxyServer.Start()
+	defer proxyServer.Close()
+
+	get := func(client *http.Client, authz string) int {
+		req, err := http.NewRequest(http.MethodGet, destServer.URL, nil)
+		require.NoError(t, err)
+		if authz != "" {
+			req.Header.Set("Proxy-Authorization", authz)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	newClient := func() *http.Client {
+		proxyURL, err := url.Parse(proxyServer.URL)
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	}
+	valid := "Basic dXNlcjpwYXNz"
+	invalid := "Basic dXNlcjp3cm9uZw=="
+
+	// Act
+
+	client := newClient()
+	var statuses []int
+	statuses = append(statuses, get(client, ""))
+	statuses = append(statuses, get(client, valid))
+	statuses = append(statuses, get(client, valid))
+	cached := atomic.LoadInt32(&authenticator.n)
+	statuses = append(statuses, get(client, invalid))
+	statuses = append(statuses, get(client, ""))
+	statuses = append(statuses, get(newClient(), valid))
+
+	// Assert
+
+	assert.Equal(t, []int{
+		http.StatusProxyAuthRequired,
+		http.StatusOK,
+		http.StatusOK,
+		http.StatusProxyAuthRequired,
+		http.StatusProxyAuthRequired,
+		http.StatusOK,
+	}, statuses)
+	assert.Equal(t, int32(1), cached, "credentials are authenticated once per connection")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&authenticator.n), "other credentials and connections are authenticated")
+}
+
+// testHandshakeAuthenticator authenticates clients sending "hello" and then
+// "response" as alice, challenging them with "challenge" in between.
+type testHandshakeAuthenticator struct{}
+
+func (testHandshakeAuthenticator) Scheme() string {
+	return "Test"
+}
+
+func (testHandshakeAuthenticator) NewHandshake() AuthHandshake {
+	return &testHandshake{}
+}
+
+type testHandshake struct {
+	challenged bool
+}
+
+func (h *testHandshake) Step(ctx context.Context, token []byte, r *http.Request) (*Identity, []byte, error) {
+	switch {
+	case !h.challenged && string(token) == "hello":
+		h.challenged = true
+		return nil, []byte("challenge"), nil
+	case h.challenged && string(token) == "response":
+		return &Identity{User: "alice"}, nil, nil
+	default:
+		return nil, nil, ErrInvalidCredentials
+	}
+}
+
+func TestProxyAuthHandshake(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	p := newTestProxy()
+	p.AuthUser, p.AuthPass = "user", "pass"
+	p.HandshakeAuthenticators = []HandshakeAuthenticator{testHandshakeAuthenticator{}}
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	proxyServer := httptest.NewUnstartedServer(p)
+	proxyServer.Config.ConnState = p.ConnState
+	proxyServer.Start()
+	defer proxyServer.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		return conn, bufio.NewReader(conn)
+	}
+	get := func(conn net.Conn, br *bufio.Reader, authz string) *http.Response {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n", destServer.URL, destServer.Listener.Addr())
+		if authz != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", authz)
+		}
+		fmt.Fprint(conn, "\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	token := func(s string) string {
+		return "Test " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	// Act
+
+	conn, br := dial()
+	defer conn.Close()
+	challenged := get(conn, br, "")
+	started := get(conn, br, token("hello"))
+	completed := get(conn, br, token("response"))
+	authenticated := get(conn, br, "")
+
+	otherConn, otherBR := dial()
+	defer otherConn.Close()
+	other := get(otherConn, otherBR, "")
+	failed := get(otherConn, otherBR, token("response"))
+
+	// Assert
+
+	assert.Equal(t, http.StatusProxyAuthRequired, challenged.StatusCode)
+	assert.Equal(t, []string{"Test", `Basic realm="proxy"`}, challenged.Header["Proxy-Authenticate"])
+	assert.Equal(t, http.StatusProxyAuthRequired, started.StatusCode)
+	assert.Equal(t, []string{token("challenge")}, started.Header["Proxy-Authenticate"])
+	assert.Equal(t, http.StatusOK, completed.StatusCode)
+	assert.Equal(t, http.StatusOK, authenticated.StatusCode, "the connection is authenticated")
+	assert.Equal(t, http.StatusProxyAuthRequired, other.StatusCode, "other connections are not authenticated")
+	assert.Equal(t, http.StatusProxyAuthRequired, failed.StatusCode)
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// connectUDPProtocol is the upgrade token of CONNECT-UDP requests.
+	connectUDPProtocol = "connect-udp"
+	// connectUDPPath is the prefix of the default URI template of
+	// CONNECT-UDP, "/.well-known/masque/udp/{target_host}/{target_port}/".
+	connectUDPPath = "/.well-known/masque/udp/"
+	// capsuleDatagram is the type of DATAGRAM capsules.
+	capsuleDatagram = 0x00
+	// maxCapsule bounds the length of capsules, which is that of a context
+	// ID and the largest UDP datagram for DATAGRAM capsules.
+	maxCapsule = 8 + maxUDPDatagram
+	// datagramHeaderLen is the length of the longest header of the DATAGRAM
+	// capsules of received datagrams: a type, a length of up to four bytes
+	// and a context ID.
+	datagramHeaderLen = 6
+)
+
+var errCapsuleTooLarge = errors.New("connect-udp: capsule too large")
+
+// isConnectUDP reports whether r is a CONNECT-UDP request to the proxy
+// itself rather than a request to forward.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9298#section-3.4
+func isConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Host == "" && upgradeType(r) == connectUDPProtocol && strings.HasPrefix(r.URL.Path, connectUDPPath)
+}
+
+// connectUDPTarget returns the host and port of the destination of a
+// CONNECT-UDP request to u. IPv6 addresses are percent-encoded in the path,
+// e.g. "/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/".
+func connectUDPTarget(u *url.URL) (string, bool) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(u.EscapedPath(), connectUDPPath), "/"), "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" {
+		return "", false
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
+
+// handleConnectUDP serves the CONNECT-UDP request r over HTTP/1.1, relaying
+// the datagrams the client sends in DATAGRAM capsules to the destination and
+// those the destination replies with back in DATAGRAM capsules. The tunnel
+// is subject to the same checks, limits, timeouts and accounting as TCP
+// tunnels.
+func (p *Proxy) handleConnectUDP(w http.ResponseWriter, r *http.Request, user string) {
+	host, ok := connectUDPTarget(r.URL)
+	if !ok {
+		p.Logger.Info("Invalid CONNECT-UDP target", zap.String("target", r.RequestURI))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Capsule-Protocol") != "?1" {
+		http.Error(w, "Capsule-Protocol required", http.StatusBadRequest)
+		return
+	}
+	if p.udpViaUpstream(r.Context(), host) {
+		p.logHost(zap.InfoLevel, "Refusing CONNECT-UDP routed via upstream proxy", host)
+		http.Error(w, errUpstreamNetwork.Error(), http.StatusNotImplemented)
+		return
+	}
+	spanFromContext(r.Context()).setDestination(host)
+
+	if !p.connectHTTP(w, r, user, host) {
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.Logger.Error("Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	userTunnel, err := p.openTunnel(user, clientIP(requestAddr(r.RemoteAddr)))
+	if err == errTunnelCapReached {
+		if v := retryAfterValue(p.RetryAfter); v != "" {
+			w.Header().Set("Retry-After", v)
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	setup := &tunnelSetup{userTunnel: userTunnel}
+	defer setup.release()
+
+	destConn, err := p.dialTunnel(r.Context(), "udp", host)
+	if err != nil {
+		spanFromContext(r.Context()).fail(err)
+		p.captureTunnelRefused(r.Context(), clientIP(requestAddr(r.RemoteAddr)), user, host, err)
+		if err == errUpstreamNetwork {
+			// Routes on IP ranges are only known once resolved.
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		switch err.(type) {
+		case *deniedAddrError:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		case *aclDeniedError:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case *rateExceededError:
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	setup.destConn = destConn
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		p.Logger.Error("Hijacking failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	setup.clientConn = clientConn
+
+	head := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n"
+	if p.ProxyAgent != "" {
+		head += "Proxy-Agent: " + p.ProxyAgent + "\r\n"
+	}
+	if _, err := clientConn.Write([]byte(head + "\r\n")); err != nil {
+		p.Logger.Error("Writing CONNECT-UDP response failed", zap.Error(err))
+		return
+	}
+
+	setup.handOver()
+	p.relay(r.Context(),
+		&bufferedConn{Conn: clientConn, r: clientBuf.Reader},
+		&capsuleConn{Conn: destConn},
+		host, user, nil, userTunnel, p.tunnelTimeouts(r))
+}
+
+// capsuleConn adapts a UDP connection to the capsule stream of a CONNECT-UDP
+// tunnel: the payloads of the DATAGRAM capsules written are sent as
+// datagrams, while datagrams received are read as DATAGRAM capsules. Other
+// capsules and datagrams of other contexts are dropped.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9297#section-3.2
+type capsuleConn struct {
+	net.Conn
+
+	// in holds the start of a capsule written but not complete yet.
+	in []byte
+	// out holds the rest of the capsule read last.
+	out []byte
+	buf []byte
+}
+
+func (c *capsuleConn) Write(b []byte) (int, error) {
+	c.in = append(c.in, b...)
+	off := 0
+	for {
+		typ, n := readVarint(c.in[off:])
+		if n == 0 {
+			break
+		}
+		length, m := readVarint(c.in[off+n:])
+		if m == 0 {
+			break
+		}
+		if length > maxCapsule {
+			return 0, errCapsuleTooLarge
+		}
+		end := off + n + m + int(length)
+		if len(c.in) < end {
+			break
+		}
+		value := c.in[off+n+m : end]
+		if typ == capsuleDatagram {
+			if context, k := readVarint(value); k > 0 && context == 0 {
+				if _, err := c.Conn.Write(value[k:]); err != nil {
+					return 0, err
+				}
+			}
+		}
+		off = end
+	}
+	// The start of an incomplete capsule is kept for the next write.
+	c.in = append(c.in[:0], c.in[off:]...)
+	return len(b), nil
+}
+
+func (c *capsuleConn) Read(b []byte) (int, error) {
+	if len(c.out) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, datagramHeaderLen+maxUDPDatagram)
+		}
+		// Datagrams are read past the room of the longest header, which is
+		// then written right in front of them.
+		n, err := c.Conn.Read(c.buf[datagramHeaderLen:])
+		if err != nil {
+			return 0, err
+		}
+		hdr := append(appendVarint([]byte{capsuleDatagram}, uint64(1+n)), 0)
+		start := datagramHeaderLen - len(hdr)
+		copy(c.buf[start:], hdr)
+		c.out = c.buf[start : datagramHeaderLen+n]
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// readVarint returns the QUIC variable-length integer b starts with and its
+// length, or a length of zero if b is too short.
+//
+// See: https://www.rfc-editor.org/rfc/rfc9000#section-16
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// appendVarint appends v, which must be less than 2^62, as a QUIC
+// variable-length integer to b.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectUDPTarget(t *testing.T) {
+	cases := []struct {
+		name     string
+		givenURL string
+		expected string
+	}{
+		{name: "IPv4", givenURL: "/.well-known/masque/udp/192.0.2.6/443/", expected: "192.0.2.6:443"},
+		{name: "IPv6", givenURL: "/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/", expected: "[2001:db8::42]:53"},
+		{name: "HostName", givenURL: "/.well-known/masque/udp/dns.example.com/53", expected: "dns.example.com:53"},
+		{name: "MissingPort", givenURL: "/.well-known/masque/udp/192.0.2.6/"},
+		{name: "InvalidPort", givenURL: "/.well-known/masque/udp/192.0.2.6/65536/"},
+		{name: "ExtraSegment", givenURL: "/.well-known/masque/udp/192.0.2.6/443/extra/"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			u, err := url.Parse(tc.givenURL)
+			require.NoError(t, err)
+
+			// Act
+
+			observed, ok := connectUDPTarget(u)
+
+			// Assert
+
+			assert.Equal(t, tc.expected != "", ok)
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 37, 63, 64, 15293, 16383, 16384, 494878333, 1 << 30, 151288809941952652} {
+		// Act
+
+		b := appendVarint(nil, v)
+		observed, n := readVarint(b)
+		_, short := readVarint(b[:len(b)-1])
+
+		// Assert
+
+		assert.Equal(t, v, observed)
+		assert.Equal(t, len(b), n)
+		assert.Zero(t, short, "truncated varints are not read")
+	}
+}
+
+func TestCapsuleConn(t *testing.T) {
+	// Arrange
+
+	proxySide, destSide := net.Pipe()
+	defer destSide.Close()
+	c := &capsuleConn{Conn: proxySide}
+	defer c.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		buf := make([]byte, maxUDPDatagram)
+		for {
+			n, err := destSide.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+
+	stream := []byte{capsuleDatagram, 5, 0, 'p', 'i', 'n', 'g'}
+	// Unknown capsules and datagrams of other contexts are dropped.
+	stream = append(stream, 0x17, 2, 'x', 'y')
+	stream = append(stream, capsuleDatagram, 3, 1, 'x', 'y')
+	stream = append(stream, capsuleDatagram, 5, 0, 'p', 'o', 'n', 'g')
+
+	// Act
+
+	// Capsules are split across writes.
+	for _, b := range [][]byte{stream[:2], stream[2:9], stream[9:]} {
+		n, err := c.Write(b)
+		require.NoError(t, err)
+		require.Equal(t, len(b), n)
+	}
+	go func() {
+		_, _ = destSide.Write([]byte("reply"))
+	}()
+	reply := make([]byte, 8)
+	_, err := io.ReadFull(c, reply)
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, "ping", <-received)
+	assert.Equal(t, "pong", <-received)
+	assert.Equal(t, []byte{capsuleDatagram, 6, 0, 'r', 'e', 'p', 'l', 'y'}, reply)
+}
+
+func TestProxyConnectUDP(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	dest, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer dest.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := dest.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			dest.WriteToUDP(buf[:n], from)
+		}
+	}()
+	destAddr := dest.LocalAddr().(*net.UDPAddr)
+
+	// Proxy server
+
+	p := newTestProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = fmt.Fprintf(conn, "GET /.well-known/masque/udp/127.0.0.1/%d/ HTTP/1.1\r\n"+
+		"Host: proxy.example.com\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", destAddr.Port)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{capsuleDatagram, 5, 0, 'p', 'i', 'n', 'g'})
+	require.NoError(t, err)
+	echoed := make([]byte, 7)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "connect-udp", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "?1", resp.Header.Get("Capsule-Protocol"))
+	assert.Equal(t, []byte{capsuleDatagram, 5, 0, 'p', 'i', 'n', 'g'}, echoed)
+	tunnels := p.tunnels.list()
+	require.Len(t, tunnels, 1)
+	assert.Equal(t, destAddr.String(), tunnels[0].host)
+}
+
+func TestProxyConnectUDPRoutedUpstream(t *testing.T) {
+	// Arrange
+
+	upstream, err := ParseUpstreamProxy("http://127.0.0.1:1")
+	require.NoError(t, err)
+	p := newTestProxy()
+	p.Routes = []Route{{Host: "*.example.com", Action: RouteUpstream, Upstream: upstream}}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.WriteString(conn, "GET /.well-known/masque/udp/dns.example.com/53/ HTTP/1.1\r\n"+
+		"Host: proxy.example.com\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodGet})
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connRejectWriteTimeout bounds writing the response to rejected connections.
+const connRejectWriteTimeout = time.Second
+
+// ConnLimit limits the client connections open concurrently across all
+// listeners wrapped by it, so a traffic spike can not exhaust file descriptors
+// and memory. Once Max connections are open, listeners stop accepting,
+// leaving new connections in the accept queue of the kernel, until a
+// connection closes or QueueTimeout passes. Connections still not admitted by
+// then are rejected. Max and QueueTimeout are changed via SetLimits once the
+// listeners are serving.
+type ConnLimit struct {
+	Logger  *zap.Logger
+	Metrics *Metrics
+	// Max is the number of concurrently open connections.
+	Max int
+	// QueueTimeout is how long accepting waits for an open connection to
+	// close once Max is reached, rejecting the next connection right away if
+	// zero.
+	QueueTimeout time.Duration
+	// RetryAfter is the delay rejected HTTP clients are asked to retry after
+	// via the Retry-After header, omitted if zero.
+	RetryAfter time.Duration
+
+	mu   sync.Mutex
+	open int
+	// freed is closed once a connection is released or the limits change.
+	freed chan struct{}
+}
+
+// Limits returns Max and QueueTimeout.
+func (c *ConnLimit) Limits() (max int, queueTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Max, c.QueueTimeout
+}
+
+// SetLimits changes Max and QueueTimeout. Lowering Max below the number of
+// open connections closes none of them, but admits no new connections until
+// enough have closed.
+func (c *ConnLimit) SetLimits(max int, queueTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Max, c.QueueTimeout = max, queueTimeout
+	c.wake()
+}
+
+// wake wakes the connections waiting for admission. c.mu must be held.
+func (c *ConnLimit) wake() {
+	if c.freed != nil {
+		close(c.freed)
+		c.freed = nil
+	}
+}
+
+// acquire reserves a connection, waiting for up to QueueTimeout if Max
+// connections are open. It reports false if no connection was reserved.
+func (c *ConnLimit) acquire() bool {
+	var timeout <-chan time.Time
+	for {
+		c.mu.Lock()
+		if c.open < c.Max {
+			c.open++
+			c.mu.Unlock()
+			return true
+		}
+		if timeout == nil {
+			if c.QueueTimeout <= 0 {
+				c.mu.Unlock()
+				return false
+			}
+			t := time.NewTimer(c.QueueTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		if c.freed == nil {
+			c.freed = make(chan struct{})
+		}
+		freed := c.freed
+		c.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func (c *ConnLimit) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+	c.wake()
+}
+
+// Listener returns l limited by c. Rejected connections are answered with
+// "503 Service Unavailable" if http is set, or closed right away otherwise,
+// e.g. for SOCKS listeners.
+func (c *ConnLimit) Listener(l net.Listener, http bool) net.Listener {
+	if c == nil {
+		return l
+	}
+	return &connLimitListener{Listener: l, limit: c, http: http}
+}
+
+// connLimitListener is a listener whose accepted connections count towards a
+// connection limit.
+type connLimitListener struct {
+	net.Listener
+	limit *ConnLimit
+	http  bool
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		if l.limit.acquire() {
+			conn, err := l.Listener.Accept()
+			if err != nil {
+				l.limit.release()
+				return nil, err
+			}
+			return &connLimitConn{Conn: conn, limit: l.limit}, nil
+		}
+
+		// The queue is saturated: the oldest queued connection is rejected
+		// so clients learn about it rather than timing out.
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.limit.Metrics.connRejected()
+		max, _ := l.limit.Limits()
+		l.limit.Logger.Warn("Connection limit reached, rejecting connection",
+			zap.String("client", conn.RemoteAddr().String()),
+			zap.Int("max", max))
+		go l.reject(conn)
+	}
+}
+
+// reject answers conn as saturated and closes it.
+func (l *connLimitListener) reject(conn net.Conn) {
+	defer conn.Close()
+	if !l.http {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(connRejectWriteTimeout))
+	body := "Service Unavailable\n"
+	resp := "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\n"
+	if v := retryAfterValue(l.limit.RetryAfter); v != "" {
+		resp += "Retry-After: " + v + "\r\n"
+	}
+	resp += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	conn.Write([]byte(resp))
+}
+
+// connLimitConn is a connection counted towards a connection limit until it
+// is closed.
+type connLimitConn struct {
+	net.Conn
+	limit *ConnLimit
+	once  sync.Once
+}
+
+func (c *connLimitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.limit.release)
+	return err
+}
+
+// retryAfterValue returns the Retry-After header value of d in whole seconds,
+// rounded up, or "" if d is not positive.
+func retryAfterValue(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
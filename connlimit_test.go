@@ -0,0 +1,180 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConnLimitListener(t *testing.T) {
+	cases := []struct {
+		name               string
+		givenHTTP          bool
+		expectedStatus     int
+		expectedRetryAfter string
+	}{
+		{
+			name:               "HTTP",
+			givenHTTP:          true,
+			expectedStatus:     http.StatusServiceUnavailable,
+			expectedRetryAfter: "3",
+		},
+		{
+			name: "SOCKS",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			limit := &ConnLimit{
+				Logger:       zap.NewNop(),
+				Metrics:      NewMetrics(),
+				Max:          1,
+				QueueTimeout: 10 * time.Millisecond,
+				RetryAfter:   2500 * time.Millisecond,
+			}
+			l := limit.Listener(inner, tc.givenHTTP)
+			defer l.Close()
+
+			accepted := make(chan net.Conn, 2)
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+
+			first, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer first.Close()
+			firstAccepted := <-accepted
+
+			// Act
+
+			rejected, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer rejected.Close()
+			require.NoError(t, rejected.SetDeadline(time.Now().Add(5*time.Second)))
+			var resp *http.Response
+			if tc.givenHTTP {
+				resp, err = http.ReadResponse(bufio.NewReader(rejected), nil)
+				require.NoError(t, err)
+			} else {
+				b, err := ioutil.ReadAll(rejected)
+				require.NoError(t, err)
+				assert.Empty(t, b)
+			}
+
+			firstAccepted.Close()
+			third, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer third.Close()
+			var thirdAccepted net.Conn
+			select {
+			case thirdAccepted = <-accepted:
+				thirdAccepted.Close()
+			case <-time.After(5 * time.Second):
+			}
+
+			// Assert
+
+			if tc.givenHTTP {
+				assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+				assert.Equal(t, tc.expectedRetryAfter, resp.Header.Get("Retry-After"))
+			}
+			assert.NotNil(t, thirdAccepted, "connections are accepted again once one closes")
+			assert.Equal(t, uint64(1), atomic.LoadUint64(&limit.Metrics.rejectedConns))
+		})
+	}
+}
+
+func TestConnLimitQueue(t *testing.T) {
+	// Arrange
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	limit := &ConnLimit{Logger: zap.NewNop(), Max: 1, QueueTimeout: 5 * time.Second}
+	l := limit.Listener(inner, true)
+	defer l.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	firstAccepted, err := l.Accept()
+	require.NoError(t, err)
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Act
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		firstAccepted.Close()
+	}()
+	start := time.Now()
+	secondAccepted, err := l.Accept()
+
+	// Assert
+
+	require.NoError(t, err)
+	defer secondAccepted.Close()
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "accepting waits for a connection to close")
+}
+
+func TestConnLimitSetLimits(t *testing.T) {
+	// Arrange
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	limit := &ConnLimit{Logger: zap.NewNop(), Max: 1, QueueTimeout: 5 * time.Second}
+	l := limit.Listener(inner, true)
+	defer l.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	firstAccepted, err := l.Accept()
+	require.NoError(t, err)
+	defer firstAccepted.Close()
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Act
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limit.SetLimits(2, time.Second)
+	}()
+	start := time.Now()
+	secondAccepted, err := l.Accept()
+
+	// Assert
+
+	require.NoError(t, err)
+	defer secondAccepted.Close()
+	assert.True(t, time.Since(start) < 5*time.Second, "raising the limit admits waiting connections")
+	max, queueTimeout := limit.Limits()
+	assert.Equal(t, 2, max)
+	assert.Equal(t, time.Second, queueTimeout)
+}
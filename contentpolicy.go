@@ -0,0 +1,170 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// sniffLen is the number of bytes of response bodies sniffed for their
+// content type, as by http.DetectContentType.
+const sniffLen = 512
+
+// contentSignatures are the magic bytes of executables and archives not
+// detected by http.DetectContentType.
+var contentSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-elf"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{"\xfd7zXZ\x00", "application/x-xz"},
+	{"BZh", "application/x-bzip2"},
+}
+
+// sniffContentType returns the content type of a body starting with b.
+func sniffContentType(b []byte) string {
+	for _, sig := range contentSignatures {
+		if bytes.HasPrefix(b, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+	return contentType
+}
+
+// matchContentType reports whether contentType matches pattern, which is
+// either a media type such as "application/zip" or a wildcard of all subtypes
+// such as "video/*".
+func matchContentType(pattern, contentType string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(contentType, pattern[:len(pattern)-1])
+	}
+	return pattern == contentType
+}
+
+// contentPolicy blocks responses to intercepted requests by their content
+// type.
+type contentPolicy struct {
+	logger  *zap.Logger
+	blocked []string
+	host    string
+	user    string
+}
+
+type contentPolicyKey struct{}
+
+func withContentPolicy(ctx context.Context, cp *contentPolicy) context.Context {
+	return context.WithValue(ctx, contentPolicyKey{}, cp)
+}
+
+// contentPolicyFromContext returns the content policy of ctx, or nil.
+func contentPolicyFromContext(ctx context.Context) *contentPolicy {
+	cp, _ := ctx.Value(contentPolicyKey{}).(*contentPolicy)
+	return cp
+}
+
+var blockPageTemplate = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Download blocked</title></head>
+<body>
+<h1>Download blocked</h1>
+<p>The response of {{.Host}} was blocked, as content of type {{.ContentType}} is not allowed.</p>
+</body>
+</html>
+`))
+
+// apply replaces resp with a block page if either its declared content type
+// or the content type sniffed from its body is blocked.
+func (cp *contentPolicy) apply(resp *http.Response) error {
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	declared = strings.ToLower(declared)
+	contentType := cp.blockedType(declared)
+
+	// Encoded bodies are not sniffed, as only their encoding could be
+	// detected, nor are streams, which would be delayed.
+	encoding := resp.Header.Get("Content-Encoding")
+	if contentType == "" && (encoding == "" || encoding == "identity") && declared != "text/event-stream" {
+		var sniffed string
+		resp.Body, sniffed = sniffBody(resp.Body)
+		contentType = cp.blockedType(sniffed)
+	}
+	if contentType == "" {
+		return nil
+	}
+
+	cp.logger.Warn("Intercepted response blocked",
+		zap.String("host", cp.host),
+		zap.String("user", cp.user),
+		zap.String("path", resp.Request.URL.Path),
+		zap.String("declaredType", declared),
+		zap.String("contentType", contentType))
+
+	var page bytes.Buffer
+	if err := blockPageTemplate.Execute(&page, struct{ Host, ContentType string }{cp.host, contentType}); err != nil {
+		return err
+	}
+	replaceWithBlockPage(resp, &page)
+	return nil
+}
+
+// sniffBody returns the content type sniffed from the first bytes of body,
+// or "" if it is empty, and a body reading all of body including those.
+func sniffBody(body io.ReadCloser) (io.ReadCloser, string) {
+	br := bufio.NewReaderSize(body, sniffLen)
+	b, _ := br.Peek(sniffLen)
+	sniffed := struct {
+		io.Reader
+		io.Closer
+	}{br, body}
+	if len(b) == 0 {
+		return sniffed, ""
+	}
+	return sniffed, sniffContentType(b)
+}
+
+// replaceWithBlockPage replaces resp with a 403 Forbidden response serving
+// page.
+func replaceWithBlockPage(resp *http.Response, page *bytes.Buffer) {
+	resp.Body.Close()
+	resp.StatusCode = http.StatusForbidden
+	resp.Status = strconv.Itoa(http.StatusForbidden) + " " + http.StatusText(http.StatusForbidden)
+	// Headers of the destination, e.g. Content-Disposition, must not apply
+	// to the block page.
+	resp.Header = http.Header{
+		"Content-Type":   {"text/html; charset=utf-8"},
+		"Content-Length": {strconv.Itoa(page.Len())},
+	}
+	resp.Trailer = nil
+	resp.ContentLength = int64(page.Len())
+	resp.Body = ioutil.NopCloser(page)
+}
+
+// blockedType returns contentType if it is blocked, or "".
+func (cp *contentPolicy) blockedType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	for _, pattern := range cp.blocked {
+		if matchContentType(strings.ToLower(pattern), contentType) {
+			return contentType
+		}
+	}
+	return ""
+}
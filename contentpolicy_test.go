@@ -0,0 +1,115 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContentPolicyApply(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenType      string
+		givenEncoding  string
+		givenBody      string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Allowed",
+			givenType:      "text/plain",
+			givenBody:      "hello",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello",
+		},
+		{
+			name:           "DeclaredType",
+			givenType:      "Application/X-MSDownload; charset=binary",
+			givenBody:      "hello",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Wildcard",
+			givenType:      "video/mp4",
+			givenBody:      "hello",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "SniffedExecutable",
+			givenType:      "image/png",
+			givenBody:      "MZ\x90\x00\x03\x00\x00\x00",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "SniffedArchive",
+			givenType:      "text/plain",
+			givenBody:      "PK\x03\x04\x14\x00\x00\x00",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "UntypedELF",
+			givenBody:      "\x7fELF\x02\x01\x01\x00",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "EncodedNotSniffed",
+			givenType:      "text/plain",
+			givenEncoding:  "br",
+			givenBody:      "MZ\x90\x00\x03\x00\x00\x00",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "MZ\x90\x00\x03\x00\x00\x00",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			cp := &contentPolicy{
+				logger:  zap.NewNop(),
+				blocked: []string{"application/x-msdownload", "application/x-elf", "application/zip", "Video/*"},
+				host:    "example.com:443",
+				user:    "alice",
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Disposition": {"attachment"}},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(tc.givenBody))),
+				Request:    httptest.NewRequest(http.MethodGet, "https://example.com/download", nil),
+			}
+			if tc.givenType != "" {
+				resp.Header.Set("Content-Type", tc.givenType)
+			}
+			if tc.givenEncoding != "" {
+				resp.Header.Set("Content-Encoding", tc.givenEncoding)
+			}
+
+			// Act
+
+			err := cp.apply(resp)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			if tc.expectedStatus == http.StatusOK {
+				assert.Equal(t, tc.expectedBody, string(body), "sniffed bytes are still relayed")
+				return
+			}
+			assert.Contains(t, string(body), "Download blocked")
+			assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+			assert.Empty(t, resp.Header.Get("Content-Disposition"))
+			assert.Equal(t, int64(len(body)), resp.ContentLength)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// expiredDeadline is a deadline in the past, failing pending I/O at once.
+var expiredDeadline = time.Unix(1, 0)
+
+// watchConn bounds the I/O on conn by ctx until the returned function is
+// called: the deadline of ctx, if any, is set on conn, and pending I/O fails
+// once ctx is canceled. Calling the returned function clears the deadline of
+// conn again.
+func watchConn(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return func() { conn.SetDeadline(time.Time{}) }
+	}
+
+	stopc := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(expiredDeadline)
+		case <-stopc:
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// contextError returns the error of ctx if it is done, as I/O interrupted by
+// watchConn fails with a timeout instead, or err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// valuesContext is a Context holding the values of values besides the ones
+// of the embedded Context, whose deadline and cancellation apply.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
+
+// withValues returns ctx also holding the values of values, e.g. to keep the
+// values of a request in contexts outliving it.
+func withValues(ctx, values context.Context) context.Context {
+	return valuesContext{Context: ctx, values: values}
+}
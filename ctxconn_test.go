@@ -0,0 +1,36 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchConn(t *testing.T) {
+	// Arrange
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := watchConn(ctx, c1)
+
+	// Act
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, canceledErr := c1.Read(make([]byte, 1))
+	stop()
+	go c2.Write([]byte{1})
+	_, stoppedErr := c1.Read(make([]byte, 1))
+
+	// Assert
+
+	assert.Error(t, canceledErr)
+	assert.Equal(t, context.Canceled, contextError(ctx, canceledErr))
+	assert.NoError(t, stoppedErr, "deadline cleared once stopped")
+}
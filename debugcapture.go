@@ -0,0 +1,284 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// MaxDebugCaptureTTL bounds the lifetime of debug captures, so a forgotten
+// capture does not log verbosely for good.
+const MaxDebugCaptureTTL = 24 * time.Hour
+
+// DebugCapture logs the requests and tunnels of a single user or client IP
+// address verbosely until it expires, e.g. to debug a specific complaint
+// without enabling debug logging for all clients.
+type DebugCapture struct {
+	ID uint64 `json:"id"`
+	// User is the authenticated user captured. It is empty if Client is
+	// set.
+	User string `json:"user,omitempty"`
+	// Client is the IP address of the clients captured, including their
+	// failed authentication attempts. It is empty if User is set.
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// DebugCaptures are the debug captures of a proxy. The metadata of captured
+// requests and tunnels is logged at debug level regardless of the level and
+// sampling of Proxy.Logger, see Proxy.DebugCaptures. Expired captures are
+// removed.
+type DebugCaptures struct {
+	// n is the number of captures, accessed atomically, so requests are not
+	// serialized on mu while nothing is captured.
+	n int32
+
+	mu       sync.Mutex
+	now      func() time.Time
+	lastID   uint64
+	captures []DebugCapture
+
+	loggerOnce sync.Once
+	logger     *zap.Logger
+}
+
+func (c *DebugCaptures) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Add adds capture, whose ID is assigned, and returns it.
+func (c *DebugCaptures) Add(capture DebugCapture) DebugCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastID++
+	capture.ID = c.lastID
+	c.setCaptures(append(c.removeExpired(), capture))
+	return capture
+}
+
+// Stop removes the capture id and reports whether it existed.
+func (c *DebugCaptures) Stop(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, capture := range c.captures {
+		if capture.ID == id {
+			c.setCaptures(append(c.captures[:i], c.captures[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the captures not expired yet, ordered by ID.
+func (c *DebugCaptures) List() []DebugCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setCaptures(c.removeExpired())
+	captures := make([]DebugCapture, len(c.captures))
+	copy(captures, c.captures)
+	sort.Slice(captures, func(i, j int) bool { return captures[i].ID < captures[j].ID })
+	return captures
+}
+
+func (c *DebugCaptures) setCaptures(captures []DebugCapture) {
+	c.captures = captures
+	atomic.StoreInt32(&c.n, int32(len(captures)))
+}
+
+// removeExpired returns the captures of c not expired yet, reusing the slice.
+func (c *DebugCaptures) removeExpired() []DebugCapture {
+	now := c.clock()
+	captures := c.captures[:0]
+	for _, capture := range c.captures {
+		if now.Before(capture.Expires) {
+			captures = append(captures, capture)
+		}
+	}
+	return captures
+}
+
+// active reports whether c has any captures, possibly expired.
+func (c *DebugCaptures) active() bool {
+	return c != nil && atomic.LoadInt32(&c.n) > 0
+}
+
+// find returns the capture of the client IP address client or user, if any.
+func (c *DebugCaptures) find(client, user string) (DebugCapture, bool) {
+	if !c.active() {
+		return DebugCapture{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	for _, capture := range c.captures {
+		if ((capture.User != "" && capture.User == user) || (capture.Client != "" && capture.Client == client)) &&
+			now.Before(capture.Expires) {
+			return capture, true
+		}
+	}
+	return DebugCapture{}, false
+}
+
+// verboseLogger returns logger writing entries of all levels, without
+// sampling.
+func (c *DebugCaptures) verboseLogger(logger *zap.Logger) *zap.Logger {
+	c.loggerOnce.Do(func() {
+		c.logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return verboseCore{Core: core}
+		}))
+	})
+	return c.logger
+}
+
+// verboseCore writes entries of all levels to the wrapped core, bypassing its
+// level and any sampling in Check.
+type verboseCore struct {
+	zapcore.Core
+}
+
+func (c verboseCore) Enabled(zapcore.Level) bool {
+	return true
+}
+
+func (c verboseCore) With(fields []zapcore.Field) zapcore.Core {
+	return verboseCore{Core: c.Core.With(fields)}
+}
+
+func (c verboseCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
+
+// logCaptured logs msg with fields if the client IP address client or user
+// is captured.
+func (p *Proxy) logCaptured(client, user, msg string, fields ...zapcore.Field) {
+	capture, ok := p.DebugCaptures.find(client, user)
+	if !ok {
+		return
+	}
+	fields = append(fields, zap.Uint64("capture", capture.ID), zap.String("client", client), zap.String("user", user))
+	p.DebugCaptures.verboseLogger(p.Logger).Debug(msg, fields...)
+}
+
+// captureRequest logs the metadata of the request r of user if captured. The
+// values of headers are omitted, as they may hold credentials.
+func (p *Proxy) captureRequest(r *http.Request, user string) {
+	if !p.DebugCaptures.active() {
+		return
+	}
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	p.logCaptured(clientIP(requestAddr(r.RemoteAddr)), user, "Captured request",
+		zap.String("method", r.Method),
+		zap.String("url", r.URL.String()),
+		zap.String("host", r.Host),
+		zap.String("proto", r.Proto),
+		zap.String("userAgent", r.UserAgent()),
+		zap.Int64("contentLength", r.ContentLength),
+		zap.String("headers", strings.Join(names, ",")))
+}
+
+// captureAuthFailure logs the failed authentication attempt of the client of
+// r if captured, with the user name sent if any.
+func (p *Proxy) captureAuthFailure(r *http.Request) {
+	if !p.DebugCaptures.active() {
+		return
+	}
+	attempted, _, _ := parseBasicProxyAuth(r.Header.Get("Proxy-Authorization"))
+	p.logCaptured(clientIP(requestAddr(r.RemoteAddr)), "", "Captured authentication failure",
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.Bool("credentials", r.Header.Get("Proxy-Authorization") != ""),
+		zap.String("attemptedUser", attempted))
+}
+
+// captureResponse logs the outcome of the forwarded request r of user if
+// captured.
+func (p *Proxy) captureResponse(r *http.Request, user string, w *captureResponseWriter, start time.Time) {
+	p.logCaptured(clientIP(requestAddr(r.RemoteAddr)), user, "Captured response",
+		append(phaseTimingsFromContext(r.Context()).fields(),
+			zap.String("host", r.Host),
+			zap.Int("status", w.status),
+			zap.Int64("bytes", w.n),
+			zap.Duration("duration", time.Since(start)))...)
+}
+
+// captureTunnelRefused logs why the tunnel of user to host failed if
+// captured.
+func (p *Proxy) captureTunnelRefused(ctx context.Context, client, user, host string, err error) {
+	if !p.DebugCaptures.active() {
+		return
+	}
+	p.logCaptured(client, user, "Captured tunnel failure",
+		append(phaseTimingsFromContext(ctx).fields(), zap.String("host", host), zap.Error(err))...)
+}
+
+func (p *Proxy) captureTunnelEstablished(ctx context.Context, client ClientInfo, target string) {
+	if !p.DebugCaptures.active() {
+		return
+	}
+	p.logCaptured(client.Addr, client.User, "Captured tunnel established",
+		append(phaseTimingsFromContext(ctx).fields(), zap.String("host", target), zap.Any("metadata", client.Metadata))...)
+}
+
+func (p *Proxy) captureTunnelClosed(ctx context.Context, stats AccessRecord) {
+	if !p.DebugCaptures.active() {
+		return
+	}
+	p.logCaptured(stats.Client, stats.User, "Captured tunnel closed",
+		zap.String("host", stats.Destination),
+		zap.String("requestID", stats.RequestID),
+		zap.Float64("duration", stats.Duration),
+		zap.Int64("bytesUp", stats.BytesUp),
+		zap.Int64("bytesDown", stats.BytesDown),
+		zap.String("reason", stats.Reason))
+}
+
+// captureResponseWriter records the status and size of the response to a
+// captured request.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
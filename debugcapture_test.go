@@ -0,0 +1,211 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestDebugCapturesFind(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name        string
+		givenClient string
+		givenUser   string
+		expected    uint64
+	}{
+		{name: "User", givenClient: "192.0.2.10", givenUser: "alice", expected: 1},
+		{name: "Client", givenClient: "192.0.2.1", expected: 2},
+		{name: "ClientOfOtherUser", givenClient: "192.0.2.1", givenUser: "bob", expected: 2},
+		{name: "Other", givenClient: "192.0.2.10", givenUser: "bob"},
+		{name: "Unauthenticated", givenClient: "192.0.2.10"},
+		{name: "Expired", givenClient: "192.0.2.10", givenUser: "carol"},
+	}
+
+	c := &DebugCaptures{now: func() time.Time { return now }}
+	c.Add(DebugCapture{User: "alice", Expires: now.Add(time.Hour)})
+	c.Add(DebugCapture{Client: "192.0.2.1", Expires: now.Add(time.Hour)})
+	c.Add(DebugCapture{User: "carol", Expires: now})
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, ok := c.find(tc.givenClient, tc.givenUser)
+
+			// Assert
+
+			assert.Equal(t, tc.expected != 0, ok)
+			assert.Equal(t, tc.expected, observed.ID)
+		})
+	}
+}
+
+func TestDebugCaptureRequest(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name            string
+		given           debugCaptureRequest
+		expectedClient  string
+		expectedExpires time.Time
+		expectedError   bool
+	}{
+		{name: "User", given: debugCaptureRequest{User: "alice", TTL: "15m"}, expectedExpires: now.Add(15 * time.Minute)},
+		{name: "Client", given: debugCaptureRequest{Client: "2001:DB8::1", Expires: now.Add(time.Hour)}, expectedClient: "2001:db8::1", expectedExpires: now.Add(time.Hour)},
+		{name: "UserAndClient", given: debugCaptureRequest{User: "alice", Client: "192.0.2.1", TTL: "15m"}, expectedError: true},
+		{name: "InvalidClient", given: debugCaptureRequest{Client: "client.example.com", TTL: "15m"}, expectedError: true},
+		{name: "MissingTTL", given: debugCaptureRequest{User: "alice"}, expectedError: true},
+		{name: "Past", given: debugCaptureRequest{User: "alice", Expires: now.Add(-time.Minute)}, expectedError: true},
+		{name: "TooLong", given: debugCaptureRequest{User: "alice", TTL: "48h"}, expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, err := tc.given.capture(now)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedClient, observed.Client)
+			assert.Equal(t, tc.expectedExpires, observed.Expires)
+		})
+	}
+}
+
+func TestProxyDebugCapture(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	dest := echoListener.Addr().String()
+
+	// Only errors are logged, so captured entries are the only others.
+	var logs lockedBuffer
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	p := newTestProxy()
+	p.Logger = zap.New(zapcore.NewCore(enc, zapcore.AddSync(&logs), zapcore.ErrorLevel))
+	p.AuthUser, p.AuthPass = "alice", "pass"
+	p.DebugCaptures = &DebugCaptures{}
+	p.DebugCaptures.Add(DebugCapture{Client: "127.0.0.1", Expires: time.Now().Add(time.Hour)})
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	tunnel := func(pass string) int {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		auth := base64.StdEncoding.EncodeToString([]byte("alice:" + pass))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", dest, dest, auth)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		if resp.StatusCode == http.StatusOK {
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			_, err = io.ReadFull(br, make([]byte, 4))
+			require.NoError(t, err)
+		}
+		return resp.StatusCode
+	}
+
+	// Act
+
+	failedStatus := tunnel("wrong")
+	status := tunnel("pass")
+	for i := 0; i < 100 && !bytes.Contains(logs.Bytes(), []byte("Captured tunnel closed")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, http.StatusProxyAuthRequired, failedStatus)
+	assert.Equal(t, http.StatusOK, status)
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(string(logs.Bytes())), "\n") {
+		var entry struct {
+			Level, Msg, User, AttemptedUser string
+			Capture                         uint64
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "debug", entry.Level)
+		assert.Equal(t, uint64(1), entry.Capture)
+		if entry.Msg == "Captured authentication failure" {
+			assert.Equal(t, "alice", entry.AttemptedUser)
+		} else {
+			assert.Equal(t, "alice", entry.User)
+		}
+		messages = append(messages, entry.Msg)
+	}
+	assert.Equal(t, []string{"Captured authentication failure", "Captured request", "Captured tunnel established", "Captured tunnel closed"}, messages)
+}
+
+func TestAdminCaptures(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.DebugCaptures = &DebugCaptures{}
+	admin := p.AdminHandler()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	// Act
+
+	added := serve(http.MethodPost, "/captures", `{"client":"192.0.2.1","ttl":"15m","reason":"INC-43"}`)
+	invalid := serve(http.MethodPost, "/captures", `{"client":"192.0.2.1"}`)
+	listed := serve(http.MethodGet, "/captures", "")
+	stopped := serve(http.MethodDelete, "/captures/1", "")
+	missing := serve(http.MethodDelete, "/captures/1", "")
+
+	// Assert
+
+	require.Equal(t, http.StatusCreated, added.Code)
+	var capture DebugCapture
+	require.NoError(t, json.Unmarshal(added.Body.Bytes(), &capture))
+	assert.Equal(t, uint64(1), capture.ID)
+	assert.Equal(t, "192.0.2.1", capture.Client)
+	assert.Equal(t, "INC-43", capture.Reason)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), capture.Expires, time.Minute)
+
+	assert.Equal(t, http.StatusBadRequest, invalid.Code)
+
+	require.Equal(t, http.StatusOK, listed.Code)
+	var captures []DebugCapture
+	require.NoError(t, json.Unmarshal(listed.Body.Bytes(), &captures))
+	require.Len(t, captures, 1)
+	assert.Equal(t, capture.ID, captures[0].ID)
+
+	assert.Equal(t, http.StatusNoContent, stopped.Code)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+	assert.Empty(t, p.DebugCaptures.List())
+	assert.False(t, p.DebugCaptures.active())
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// metricsOtherDestination is the destination label of hosts not counted
+// separately.
+const metricsOtherDestination = "other"
+
+// DestinationGroup counts connections to destination hosts matching any of
+// its host patterns under a single metrics label.
+type DestinationGroup struct {
+	// Name is the destination label of the group.
+	Name string
+	// Hosts are the host patterns of the group, see ResponseHeaderRule.Host
+	// for the syntax.
+	Hosts []string
+}
+
+// DestinationGroups collapses destination hosts into groups for metrics, so
+// the number of destination labels stays bounded while popular destinations
+// stay visible.
+type DestinationGroups struct {
+	// Groups are the groups of hosts. The first matching group applies.
+	Groups []DestinationGroup
+	// ByDomain counts hosts matching no group by their registrable domain,
+	// e.g. both www.example.co.uk and api.example.co.uk as example.co.uk.
+	// Hosts matching no group are counted as "other" otherwise, as are IP
+	// addresses.
+	ByDomain bool
+}
+
+// group returns the destination label of host.
+func (g *DestinationGroups) group(host string) string {
+	if g == nil {
+		return host
+	}
+	for _, group := range g.Groups {
+		for _, pattern := range group.Hosts {
+			if matchHostPattern(pattern, host) {
+				return group.Name
+			}
+		}
+	}
+	if g.ByDomain {
+		if domain := registrableDomain(host); domain != "" {
+			return domain
+		}
+	}
+	return metricsOtherDestination
+}
+
+// multiLabelSuffixes are common public suffixes of more than one label, under
+// which domains are registered at the third level.
+var multiLabelSuffixes = map[string]bool{
+	"ac.uk": true, "co.uk": true, "gov.uk": true, "org.uk": true, "me.uk": true,
+	"com.au": true, "net.au": true, "org.au": true, "edu.au": true, "gov.au": true,
+	"co.nz": true, "org.nz": true, "co.jp": true, "ne.jp": true, "or.jp": true,
+	"co.kr": true, "co.in": true, "co.za": true, "co.il": true, "com.br": true,
+	"com.cn": true, "com.hk": true, "com.mx": true, "com.sg": true, "com.tr": true,
+	"com.tw": true, "com.ar": true,
+}
+
+// registrableDomain returns the registrable domain of the host name host, or
+// an empty string for IP addresses and single labels. Only common public
+// suffixes of more than one label are known, so domains registered under
+// other such suffixes are approximated by their last two labels.
+func registrableDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	n := 2
+	if len(labels) > 2 && multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	if len(labels) < n {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// LoadDestinationGroups reads destination groups from the file at path, one
+// group per line with its name followed by its host patterns, e.g.
+// "aws *.amazonaws.com *.aws.amazon.com". A line holding a single host
+// pattern groups its hosts under the pattern itself. Empty lines and lines
+// starting with # are ignored.
+func LoadDestinationGroups(path string) ([]DestinationGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups []DestinationGroup
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		group, err := parseDestinationGroup(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		groups = append(groups, group)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func parseDestinationGroup(line string) (DestinationGroup, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		host := strings.ToLower(fields[0])
+		return DestinationGroup{Name: host, Hosts: []string{host}}, nil
+	}
+	if fields[0] == metricsOtherDestination {
+		return DestinationGroup{}, fmt.Errorf("reserved group name %q", fields[0])
+	}
+	group := DestinationGroup{Name: fields[0]}
+	for _, host := range fields[1:] {
+		group.Hosts = append(group.Hosts, strings.ToLower(host))
+	}
+	return group, nil
+}
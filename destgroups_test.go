@@ -0,0 +1,103 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadDestinationGroups(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "destgroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "groups")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Cloud\n\naws *.amazonaws.com *.AWS.amazon.com\nAPI.example.com\n"), 0600))
+	reservedPath := filepath.Join(dir, "reserved")
+	require.NoError(t, ioutil.WriteFile(reservedPath, []byte("other *.example.org\n"), 0600))
+
+	// Act
+
+	groups, err := LoadDestinationGroups(path)
+	_, reservedErr := LoadDestinationGroups(reservedPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, []DestinationGroup{
+		{Name: "aws", Hosts: []string{"*.amazonaws.com", "*.aws.amazon.com"}},
+		{Name: "api.example.com", Hosts: []string{"api.example.com"}},
+	}, groups)
+	require.Error(t, reservedErr)
+	assert.Contains(t, reservedErr.Error(), "reserved:1:")
+}
+
+func TestDestinationGroupsGroup(t *testing.T) {
+	groups := []DestinationGroup{
+		{Name: "aws", Hosts: []string{"*.amazonaws.com"}},
+		{Name: "api.example.com", Hosts: []string{"api.example.com"}},
+	}
+
+	cases := []struct {
+		name        string
+		givenGroups *DestinationGroups
+		givenHost   string
+		expected    string
+	}{
+		{name: "Ungrouped", givenHost: "www.example.com", expected: "www.example.com"},
+		{name: "Group", givenGroups: &DestinationGroups{Groups: groups}, givenHost: "s3.eu-west-1.amazonaws.com", expected: "aws"},
+		{name: "Exact", givenGroups: &DestinationGroups{Groups: groups}, givenHost: "api.example.com", expected: "api.example.com"},
+		{name: "Other", givenGroups: &DestinationGroups{Groups: groups}, givenHost: "www.example.com", expected: "other"},
+		{name: "Domain", givenGroups: &DestinationGroups{Groups: groups, ByDomain: true}, givenHost: "www.example.com", expected: "example.com"},
+		{name: "DomainGrouped", givenGroups: &DestinationGroups{Groups: groups, ByDomain: true}, givenHost: "api.example.com", expected: "api.example.com"},
+		{name: "DomainIP", givenGroups: &DestinationGroups{ByDomain: true}, givenHost: "192.0.2.10", expected: "other"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := tc.givenGroups.group(tc.givenHost)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	cases := []struct {
+		name     string
+		given    string
+		expected string
+	}{
+		{name: "Domain", given: "example.com", expected: "example.com"},
+		{name: "Subdomain", given: "a.b.Example.com.", expected: "example.com"},
+		{name: "MultiLabelSuffix", given: "www.example.co.uk", expected: "example.co.uk"},
+		{name: "MultiLabelSuffixOnly", given: "co.uk", expected: "co.uk"},
+		{name: "SingleLabel", given: "localhost", expected: ""},
+		{name: "IPv4", given: "192.0.2.10", expected: ""},
+		{name: "IPv6", given: "2001:db8::1", expected: ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := registrableDomain(tc.given)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
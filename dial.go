@@ -0,0 +1,472 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// deniedAddrError is returned when a destination host resolves to an address
+// within one of the denied IP ranges.
+type deniedAddrError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *deniedAddrError) Error() string {
+	return fmt.Sprintf("destination %s resolves to denied address %s", e.Host, e.IP)
+}
+
+// rateExceededError is returned when the rate of new tunnels to a destination
+// host is exceeded.
+type rateExceededError struct {
+	Host string
+}
+
+func (e *rateExceededError) Error() string {
+	return fmt.Sprintf("connection rate to destination %s exceeded", e.Host)
+}
+
+// ContextDialer connects to addresses. It is implemented by net.Dialer and
+// compatible with proxy.ContextDialer of golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialContext resolves the host of addr and connects to the first reachable
+// resolved address, trying addresses with lower dial latency first if
+// AddrLatencies is set, and restricted to the IP family configured for host by
+// IPFamilyRules. Addresses are tried one after another, or staggered if
+// DialStagger is set, see dialStaggered. If Upstream is set, the connection is made via the upstream
+// proxy instead, see dialUpstream, unless Routes select another way to reach
+// the destination. The destination and its resolved addresses are checked
+// against the ACL and the denied IP ranges before dialing, so a permitted host
+// name can not be used to reach a denied address. Dialing the resolved address
+// rather than the host name ensures the checked and the dialed addresses are
+// the same. Failed dials are retried DialRetries times. Dials to destinations
+// whose circuit is open fail fast, see CircuitBreaker.
+func (p *Proxy) DialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Recent != nil {
+		defer func() {
+			switch err.(type) {
+			case *aclDeniedError, *deniedAddrError:
+				p.Recent.denied(dialUser(ctx), addr, err)
+			}
+		}()
+	}
+
+	acl, aclPort, aclPending, err := p.checkDestHost(ctx, network, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.CircuitBreaker != nil {
+		key := net.JoinHostPort(destinationKey(host), port)
+		if !p.CircuitBreaker.allow(key) {
+			p.Metrics.circuitRejected()
+			p.Logger.Debug("Destination circuit open", zap.String("host", key))
+			return nil, &circuitOpenError{Host: key}
+		}
+		defer func(ctx context.Context) { p.dialed(ctx, key, err) }(ctx)
+	}
+
+	if p.DestDialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.DestDialTimeout)
+		defer cancel()
+	}
+
+	// Routes on host names are evaluated before resolving, so host names
+	// routed to parent proxies are resolved by those.
+	var route *Route
+	var routePort int
+	routePending := false
+	if len(p.Routes) > 0 {
+		if routePort, err = net.LookupPort(network, port); err != nil {
+			return nil, err
+		}
+		var decided bool
+		route, decided = routeFor(p.Routes, host, routePort, nil)
+		route = p.routeVia(ctx, route)
+		if route != nil && route.Action == RouteBlock {
+			p.Logger.Warn("Destination blocked by route", zap.String("host", host), zap.Int("port", routePort))
+			return nil, &aclDeniedError{Host: host, Port: routePort}
+		}
+		routePending = !decided
+	}
+
+	if u := p.upstreamFor(route); u != nil && !routePending {
+		return p.dialUpstream(ctx, u, network, addr, host, acl, aclPort, aclPending)
+	}
+
+	timings := phaseTimingsFromContext(ctx)
+
+	start := time.Now()
+	ips, err := p.lookupIPAddr(ctx, host)
+	timings.observe(phaseDNS, start)
+	if err != nil {
+		p.Metrics.dialError()
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	start = time.Now()
+	if err := p.checkDestAddrs(host, ips, acl, aclPort, aclPending); err != nil {
+		return nil, err
+	}
+	timings.observe(phaseACL, start)
+
+	if routePending {
+		route, _ = routeFor(p.Routes, host, routePort, ips[0].IP)
+		route = p.routeVia(ctx, route)
+		if route != nil && route.Action == RouteBlock {
+			p.Logger.Warn("Destination blocked by route", zap.String("host", host), zap.Int("port", routePort), zap.String("ip", ips[0].IP.String()))
+			return nil, &aclDeniedError{Host: host, Port: routePort}
+		}
+		if u := p.upstreamFor(route); u != nil {
+			return p.dialUpstream(ctx, u, network, addr, host, nil, 0, false)
+		}
+	}
+
+	start = time.Now()
+	defer timings.observe(phaseDial, start)
+
+	if p.AddrLatencies != nil {
+		p.AddrLatencies.Sort(ips)
+	}
+	// Applied after sorting by latency, so a preferred family is always dialed
+	// first.
+	family := ipFamilyFor(p.IPFamilyRules, host)
+	if family != AnyIPFamily {
+		if ips = applyIPFamily(family, ips); len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses of the required IP family found for %s", host)
+		}
+	}
+
+	if p.DialStagger > 0 && family == AnyIPFamily {
+		ips = interleaveIPFamilies(ips)
+	}
+	conn, err := p.dialRetrying(ctx, p.dialerFor(ctx, route), network, host, port, ips)
+	if err != nil {
+		p.Metrics.dialError()
+		return nil, err
+	}
+	p.Metrics.destinationConnected(host)
+	return conn, nil
+}
+
+// checkDestHost checks the destination host and port against the blocklist
+// and the rules of the ACL on host names, so denied hosts are not even
+// resolved. It returns the ACL and the port number if rules on IP ranges
+// remain to be checked against the resolved addresses, see checkDestAddrs.
+func (p *Proxy) checkDestHost(ctx context.Context, network, host, port string) (acl *ACL, aclPort int, aclPending bool, err error) {
+	if p.Blocklist.Contains(host) {
+		p.Logger.Warn("Destination blocklisted", zap.String("host", host))
+		blockedPort, _ := net.LookupPort(network, port)
+		return nil, 0, false, &aclDeniedError{Host: host, Port: blockedPort}
+	}
+
+	acl = p.aclFor(ctx)
+	if acl == nil {
+		return nil, 0, false, nil
+	}
+	if aclPort, err = net.LookupPort(network, port); err != nil {
+		return nil, 0, false, err
+	}
+	allow, decided := acl.decide(host, aclPort, nil)
+	if (!decided || !allow) && p.granted(ctx, host, aclPort) {
+		allow, decided = true, true
+	}
+	if decided && !allow {
+		p.Logger.Warn("Destination denied", zap.String("host", host), zap.Int("port", aclPort))
+		return nil, 0, false, &aclDeniedError{Host: host, Port: aclPort}
+	}
+	return acl, aclPort, !decided, nil
+}
+
+// checkDestAddrs checks the resolved addresses ips of host against the denied
+// IP ranges and, if aclPending is set, the rules of acl on IP ranges.
+func (p *Proxy) checkDestAddrs(host string, ips []net.IPAddr, acl *ACL, aclPort int, aclPending bool) error {
+	for _, ip := range ips {
+		if containsIP(p.DeniedCIDRs, ip.IP) {
+			p.Logger.Warn("Destination address denied", zap.String("host", host), zap.String("ip", ip.IP.String()))
+			return &deniedAddrError{Host: host, IP: ip.IP}
+		}
+		if aclPending {
+			if allow, _ := acl.decide(host, aclPort, ip.IP); !allow {
+				p.Logger.Warn("Destination denied", zap.String("host", host), zap.Int("port", aclPort), zap.String("ip", ip.IP.String()))
+				return &aclDeniedError{Host: host, Port: aclPort}
+			}
+		}
+	}
+	return nil
+}
+
+// dialRetrying dials the addresses ips of host with d, retrying up to
+// DialRetries times with exponential backoff if all of them failed, unless ctx
+// is done.
+func (p *Proxy) dialRetrying(ctx context.Context, d ContextDialer, network, host, port string, ips []net.IPAddr) (net.Conn, error) {
+	backoff := p.DialRetryBackoff
+	for retry := 1; ; retry++ {
+		conn, err := p.dialAddrs(ctx, d, network, host, port, ips)
+		if err == nil || retry > p.DialRetries || ctx.Err() != nil {
+			return conn, err
+		}
+		p.Logger.Debug("Destination dial failed, retrying",
+			zap.String("host", host),
+			zap.Int("retry", retry),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// dialAddrs dials the addresses ips of host with d, staggered if DialStagger
+// is set or one after another otherwise, and returns the first established
+// connection.
+func (p *Proxy) dialAddrs(ctx context.Context, d ContextDialer, network, host, port string, ips []net.IPAddr) (conn net.Conn, err error) {
+	if p.DialStagger > 0 {
+		return p.dialStaggered(ctx, d, network, host, port, ips)
+	}
+	for _, ip := range ips {
+		if conn, err = p.dialAddr(ctx, d, network, host, port, ip.IP); err == nil {
+			break
+		}
+	}
+	return conn, err
+}
+
+// dialAddr connects with d to port at the resolved address ip of host, within
+// DialAttemptTimeout if set.
+func (p *Proxy) dialAddr(ctx context.Context, d ContextDialer, network, host, port string, ip net.IP) (net.Conn, error) {
+	if p.DialAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.DialAttemptTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	if p.AddrLatencies != nil && ctx.Err() != context.Canceled {
+		p.AddrLatencies.Observe(ip, time.Since(start), err != nil)
+	}
+	if err != nil {
+		p.Logger.Debug("Destination address dial failed", zap.String("host", host), zap.String("ip", ip.String()), zap.Error(err))
+	}
+	return conn, err
+}
+
+// dialResult is the outcome of dialing a single address.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialStaggered dials the addresses ips of host with d in order, starting the next
+// attempt once the previous one failed or DialStagger passed without it
+// succeeding (RFC 8305, section 5). The first established connection is
+// returned and all other attempts are canceled, closing connections they
+// establish nonetheless.
+func (p *Proxy) dialStaggered(ctx context.Context, d ContextDialer, network, host, port string, ips []net.IPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next].IP
+		next++
+		pending++
+		go func() {
+			conn, err := p.dialAddr(ctx, d, network, host, port, ip)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	var err error
+	start()
+	for pending > 0 {
+		var stagger *time.Timer
+		var staggered <-chan time.Time
+		if next < len(ips) {
+			stagger = time.NewTimer(p.DialStagger)
+			staggered = stagger.C
+		}
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if stagger != nil {
+					stagger.Stop()
+				}
+				go closeDialed(results, pending)
+				return res.conn, nil
+			}
+			err = res.err
+			if next < len(ips) {
+				start()
+			}
+		case <-staggered:
+			start()
+		}
+		if stagger != nil {
+			stagger.Stop()
+		}
+	}
+	return nil, err
+}
+
+// closeDialed closes the connections of the n pending canceled attempts
+// reporting to results which succeeded nonetheless.
+func closeDialed(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if res := <-results; res.conn != nil {
+			_ = res.conn.Close()
+		}
+	}
+}
+
+// lookupIPAddr resolves host with Resolver, or with the default resolver if
+// Resolver is not set.
+func (p *Proxy) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if p.Resolver != nil {
+		return p.Resolver.LookupIPAddr(ctx, host)
+	}
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
+// dialUpstream connects to addr via the upstream proxy u. Host names are
+// resolved by the upstream proxy, so IP ranges are only checked for IP
+// addresses. UDP destinations are refused, as upstream proxies only tunnel TCP
+// connections.
+func (p *Proxy) dialUpstream(ctx context.Context, u *UpstreamProxy, network, addr, host string, acl *ACL, aclPort int, aclPending bool) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		p.Logger.Info("Refusing UDP destination routed via upstream proxy", zap.String("host", host))
+		return nil, errUpstreamNetwork
+	}
+	if ip := net.ParseIP(host); ip != nil && containsIP(p.DeniedCIDRs, ip) {
+		p.Logger.Warn("Destination address denied", zap.String("host", host), zap.String("ip", ip.String()))
+		return nil, &deniedAddrError{Host: host, IP: ip}
+	}
+	if aclPending && !acl.decideUnresolved(host, aclPort) {
+		p.Logger.Warn("Destination denied", zap.String("host", host), zap.Int("port", aclPort))
+		return nil, &aclDeniedError{Host: host, Port: aclPort}
+	}
+
+	timings := phaseTimingsFromContext(ctx)
+	start := time.Now()
+	conn, err := u.DialContext(ctx, network, addr)
+	timings.observe(phaseDial, start)
+	if err != nil {
+		p.Metrics.dialError()
+		return nil, err
+	}
+	p.Metrics.destinationConnected(host)
+	return conn, nil
+}
+
+// udpViaUpstream reports whether UDP datagrams to addr are routed via a
+// parent proxy, which can not relay them, as far as is known ahead of
+// resolving the host of addr.
+func (p *Proxy) udpViaUpstream(ctx context.Context, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if len(p.Routes) == 0 {
+		return p.Upstream != nil
+	}
+	udpPort, err := net.LookupPort("udp", port)
+	if err != nil {
+		return false
+	}
+	route, decided := routeFor(p.Routes, host, udpPort, nil)
+	return decided && p.upstreamFor(p.routeVia(ctx, route)) != nil
+}
+
+// privateCIDRs are the IP ranges of PrivateCIDRs.
+var privateCIDRs = []string{
+	"0.0.0.0/8",          // "This" network, reaching the host itself
+	"10.0.0.0/8",         // Private (RFC 1918)
+	"100.64.0.0/10",      // Shared address space, e.g. of cloud metadata services
+	"127.0.0.0/8",        // Loopback
+	"169.254.0.0/16",     // Link-local, e.g. cloud metadata at 169.254.169.254
+	"172.16.0.0/12",      // Private (RFC 1918)
+	"192.0.0.0/24",       // IETF protocol assignments, e.g. DS-Lite gateways
+	"192.168.0.0/16",     // Private (RFC 1918)
+	"198.18.0.0/15",      // Benchmarking, used on internal networks
+	"224.0.0.0/4",        // Multicast
+	"255.255.255.255/32", // Limited broadcast
+	"::/128",             // Unspecified
+	"::1/128",            // Loopback
+	"64:ff9b::/96",       // NAT64, embedding any IPv4 address including private ones
+	"fc00::/7",           // Unique local, e.g. cloud metadata at fd00:ec2::254
+	"fe80::/10",          // Link-local
+	"ff00::/8",           // Multicast
+}
+
+// PrivateCIDRs returns the loopback, link-local, private and cloud metadata
+// IP ranges, which destinations must not resolve to unless a proxy is meant
+// to reach internal services, so clients can not use it to attack the
+// network it runs in (SSRF). IPv4 ranges also match the IPv4-mapped IPv6
+// addresses within them.
+func PrivateCIDRs() []*net.IPNet {
+	nets := make([]*net.IPNet, len(privateCIDRs))
+	for i, c := range privateCIDRs {
+		_, nets[i], _ = net.ParseCIDR(c)
+	}
+	return nets
+}
+
+// ParseCIDRs parses a comma-separated list of CIDR ranges.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range SplitList(s) {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SplitList splits a comma-separated list, omitting empty elements.
+func SplitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,426 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name          string
+		givenCIDRs    string
+		expectedNets  []string
+		expectedError bool
+	}{
+		{
+			name:         "Empty",
+			givenCIDRs:   "",
+			expectedNets: nil,
+		},
+		{
+			name:         "Multiple",
+			givenCIDRs:   "10.0.0.0/8, 192.168.1.1/16,::1/128",
+			expectedNets: []string{"10.0.0.0/8", "192.168.0.0/16", "::1/128"},
+		},
+		{
+			name:          "Invalid",
+			givenCIDRs:    "10.0.0.0",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedNets, err := ParseCIDRs(tc.givenCIDRs)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var nets []string
+			for _, n := range observedNets {
+				nets = append(nets, n.String())
+			}
+			assert.Equal(t, tc.expectedNets, nets)
+		})
+	}
+}
+
+func TestDialContextDeniedAddress(t *testing.T) {
+	// Arrange
+
+	denied, err := ParseCIDRs("127.0.0.0/8,::1/128")
+	require.NoError(t, err)
+
+	p := &Proxy{Logger: zap.NewNop(), DeniedCIDRs: denied}
+
+	for _, addr := range []string{"127.0.0.1:80", "localhost:80"} {
+		t.Run(addr, func(t *testing.T) {
+			// Act
+
+			conn, err := p.DialContext(context.Background(), "tcp", addr)
+
+			// Assert
+
+			assert.Nil(t, conn)
+			require.IsType(t, &deniedAddrError{}, err)
+			assert.True(t, err.(*deniedAddrError).IP.IsLoopback())
+			assert.Equal(t, strings.Split(addr, ":")[0], err.(*deniedAddrError).Host)
+		})
+	}
+}
+
+// recordingDialer records the addresses it dials.
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestDialContextDialer(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	_, port, err := net.SplitHostPort(echoListener.Addr().String())
+	require.NoError(t, err)
+
+	d := &recordingDialer{}
+	p := newTestProxy()
+	p.Dialer = d
+	p.IPFamilyRules = []IPFamilyRule{{Host: "localhost", Family: IPv4Only}}
+
+	// Act
+
+	conn, err := p.DialContext(context.Background(), "tcp", "localhost:"+port)
+
+	// Assert
+
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []string{"127.0.0.1:" + port}, d.addrs, "resolved addresses are dialed")
+}
+
+func TestProxyConnectDeniedAddress(t *testing.T) {
+	// Arrange
+
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer destListener.Close()
+
+	denied, err := ParseCIDRs("127.0.0.0/8")
+	require.NoError(t, err)
+
+	p := &Proxy{Logger: zap.NewNop(), DeniedCIDRs: denied}
+
+	req := httptest.NewRequest(http.MethodConnect, destListener.Addr().String(), nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, req)
+
+	// Assert
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// scriptedDialer fails dials to the addresses in refused at once, never
+// completes dials to the addresses in blackholed until they are canceled,
+// and connects to all other addresses.
+type scriptedDialer struct {
+	refused    map[string]bool
+	blackholed map[string]bool
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *scriptedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	switch {
+	case d.refused[addr]:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	case d.blackholed[addr]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestDialStaggered(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenStagger  time.Duration
+		givenDialer   *scriptedDialer
+		expectedAddrs []string
+	}{
+		{
+			name:          "Blackholed",
+			givenStagger:  10 * time.Millisecond,
+			givenDialer:   &scriptedDialer{blackholed: map[string]bool{"[2001:db8::1]:443": true}},
+			expectedAddrs: []string{"[2001:db8::1]:443", "192.0.2.1:443"},
+		},
+		{
+			name:          "Refused",
+			givenStagger:  time.Hour,
+			givenDialer:   &scriptedDialer{refused: map[string]bool{"[2001:db8::1]:443": true}},
+			expectedAddrs: []string{"[2001:db8::1]:443", "192.0.2.1:443"},
+		},
+		{
+			name:          "Connected",
+			givenStagger:  time.Hour,
+			givenDialer:   &scriptedDialer{},
+			expectedAddrs: []string{"[2001:db8::1]:443"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.Dialer = tc.givenDialer
+			p.DialStagger = tc.givenStagger
+			ips := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::2")}}
+
+			// Act
+
+			conn, err := p.dialStaggered(context.Background(), p.dialerFor(context.Background(), nil), "tcp", "example.com", "443", ips)
+
+			// Assert
+
+			require.NoError(t, err)
+			conn.Close()
+			tc.givenDialer.mu.Lock()
+			defer tc.givenDialer.mu.Unlock()
+			assert.Equal(t, tc.expectedAddrs, tc.givenDialer.addrs)
+		})
+	}
+}
+
+func TestDialStaggeredFailed(t *testing.T) {
+	// Arrange
+
+	d := &scriptedDialer{refused: map[string]bool{"192.0.2.1:443": true, "192.0.2.2:443": true}}
+	p := newTestProxy()
+	p.Dialer = d
+	p.DialStagger = time.Hour
+
+	// Act
+
+	conn, err := p.dialStaggered(context.Background(), p.dialerFor(context.Background(), nil), "tcp", "example.com", "443", []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("192.0.2.2")}})
+
+	// Assert
+
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+	assert.Len(t, d.addrs, 2)
+}
+
+func TestDialAddrAttemptTimeout(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.Dialer = &scriptedDialer{blackholed: map[string]bool{"192.0.2.1:443": true}}
+	p.DialAttemptTimeout = 10 * time.Millisecond
+
+	// Act
+
+	conn, err := p.dialAddr(context.Background(), p.dialerFor(context.Background(), nil), "tcp", "example.com", "443", net.ParseIP("192.0.2.1"))
+
+	// Assert
+
+	assert.Nil(t, conn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// flakyDialer fails the first failures dials and connects afterwards.
+type flakyDialer struct {
+	failures int
+	dials    int
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials++
+	if d.dials <= d.failures {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestDialRetrying(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenFailures int
+		expectedDials int
+		expectedError bool
+	}{
+		{name: "Connected", expectedDials: 1},
+		{name: "Retried", givenFailures: 2, expectedDials: 3},
+		{name: "Failed", givenFailures: 3, expectedDials: 3, expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			d := &flakyDialer{failures: tc.givenFailures}
+			p := newTestProxy()
+			p.DialStagger = 0
+			p.DialRetries = 2
+			p.DialRetryBackoff = time.Millisecond
+
+			// Act
+
+			conn, err := p.dialRetrying(context.Background(), d, "tcp", "example.com", "443", []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}})
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				conn.Close()
+			}
+			assert.Equal(t, tc.expectedDials, d.dials)
+		})
+	}
+}
+
+func TestDialRetryingCanceled(t *testing.T) {
+	// Arrange
+
+	d := &flakyDialer{failures: 1}
+	p := newTestProxy()
+	p.DialRetries = 2
+	p.DialRetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Act
+
+	_, err := p.dialRetrying(ctx, d, "tcp", "example.com", "443", []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}})
+
+	// Assert
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, d.dials, "no retry once the dial is canceled")
+}
+
+func TestPrivateCIDRs(t *testing.T) {
+	cases := []struct {
+		givenIP        string
+		expectedDenied bool
+	}{
+		{givenIP: "127.0.0.1", expectedDenied: true},
+		{givenIP: "0.0.0.0", expectedDenied: true},
+		{givenIP: "0.1.2.3", expectedDenied: true},
+		{givenIP: "10.1.2.3", expectedDenied: true},
+		{givenIP: "172.31.255.255", expectedDenied: true},
+		{givenIP: "192.168.1.1", expectedDenied: true},
+		{givenIP: "192.0.0.170", expectedDenied: true},
+		{givenIP: "198.18.0.1", expectedDenied: true},
+		{givenIP: "198.19.255.255", expectedDenied: true},
+		{givenIP: "224.0.0.1", expectedDenied: true},
+		{givenIP: "239.255.255.250", expectedDenied: true},
+		{givenIP: "255.255.255.255", expectedDenied: true},
+		{givenIP: "169.254.169.254", expectedDenied: true},
+		{givenIP: "100.100.100.200", expectedDenied: true},
+		{givenIP: "::1", expectedDenied: true},
+		{givenIP: "::ffff:127.0.0.1", expectedDenied: true},
+		{givenIP: "fd00:ec2::254", expectedDenied: true},
+		{givenIP: "fe80::1", expectedDenied: true},
+		{givenIP: "ff02::1", expectedDenied: true},
+		{givenIP: "64:ff9b::a9fe:a9fe", expectedDenied: true},
+		{givenIP: "172.32.0.1", expectedDenied: false},
+		{givenIP: "192.0.2.1", expectedDenied: false},
+		{givenIP: "198.20.0.1", expectedDenied: false},
+		{givenIP: "223.255.255.255", expectedDenied: false},
+		{givenIP: "2001:db8::1", expectedDenied: false},
+	}
+
+	nets := PrivateCIDRs()
+	for _, tc := range cases {
+		t.Run(tc.givenIP, func(t *testing.T) {
+			// Act
+
+			observed := containsIP(nets, net.ParseIP(tc.givenIP))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedDenied, observed)
+		})
+	}
+}
+
+func TestNewDeniesPrivateAddresses(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	_, port, err := net.SplitHostPort(echoListener.Addr().String())
+	require.NoError(t, err)
+
+	p := New(zap.NewNop())
+
+	// Act
+
+	conn, err := p.DialContext(context.Background(), "tcp", "localhost:"+port)
+
+	// Assert
+
+	assert.Nil(t, conn)
+	assert.IsType(t, &deniedAddrError{}, err)
+}
+
+func TestDialContextUDPRoutedUpstream(t *testing.T) {
+	// Arrange
+
+	upstream, err := ParseUpstreamProxy("http://127.0.0.1:1")
+	require.NoError(t, err)
+	_, cidr, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	p := newTestProxy()
+	p.Routes = []Route{{CIDR: cidr, Action: RouteUpstream, Upstream: upstream}}
+
+	// Act
+
+	_, err = p.DialContext(context.Background(), "udp", "192.0.2.1:53")
+
+	// Assert
+
+	assert.Equal(t, errUpstreamNetwork, err)
+	assert.True(t, p.udpViaUpstream(context.Background(), "192.0.2.1:53"))
+	assert.False(t, p.udpViaUpstream(context.Background(), "198.51.100.1:53"))
+}
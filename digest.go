@@ -0,0 +1,331 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// digestPrefix is the prefix of Proxy-Authorization headers holding
+	// Digest credentials.
+	digestPrefix = "Digest "
+	// defaultDigestNonceTTL is the lifetime of Digest nonces if
+	// DigestAuth.NonceTTL is zero.
+	defaultDigestNonceTTL = 5 * time.Minute
+	// digestMinPrune is the number of nonces tracked before expired ones are
+	// first pruned.
+	digestMinPrune = 1024
+)
+
+// DigestCredentials provide the hashes Digest authentication is checked
+// against, as Digest clients send a hash of their password rather than the
+// password itself.
+type DigestCredentials interface {
+	// HA1 returns the hex encoded MD5 hash of "user:realm:password", or
+	// ErrInvalidCredentials if user has no password in realm.
+	HA1(ctx context.Context, user, realm string) (string, error)
+}
+
+// HA1 implements DigestCredentials.
+func (a *StaticAuthenticator) HA1(ctx context.Context, user, realm string) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) != 1 {
+		return "", ErrInvalidCredentials
+	}
+	return digestHA1(user, realm, a.Pass), nil
+}
+
+func digestHA1(user, realm, pass string) string {
+	return md5Hex(user + ":" + realm + ":" + pass)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// DigestAuth authenticates clients via HTTP Digest authentication (RFC 7616)
+// with the MD5 algorithm and "auth" quality of protection, so clients
+// refusing to send Basic credentials over plaintext can authenticate. Nonces
+// are issued statelessly and expire after NonceTTL; the nonce count of every
+// nonce must increase with every request, so captured credentials can not be
+// replayed.
+type DigestAuth struct {
+	Credentials DigestCredentials
+	// NonceTTL is the lifetime of nonces, 5 minutes if zero. Clients sending
+	// an expired nonce are challenged with a fresh one marked stale, which
+	// they retry with without prompting their users.
+	NonceTTL time.Duration
+
+	now func() time.Time
+
+	keyOnce sync.Once
+	key     []byte
+
+	mu sync.Mutex
+	// counts are the last nonce counts of the nonces in use.
+	counts  map[string]uint64
+	pruneAt int
+}
+
+func (a *DigestAuth) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+func (a *DigestAuth) nonceTTL() time.Duration {
+	if a.NonceTTL <= 0 {
+		return defaultDigestNonceTTL
+	}
+	return a.NonceTTL
+}
+
+// nonceKey returns the key nonces are signed with, generated once.
+func (a *DigestAuth) nonceKey() []byte {
+	a.keyOnce.Do(func() {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			panic(err)
+		}
+	})
+	return a.key
+}
+
+// nonce returns a fresh nonce, holding the time it was issued and a MAC of
+// it.
+func (a *DigestAuth) nonce() string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(a.clock().UnixNano()))
+	mac := hmac.New(sha256.New, a.nonceKey())
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// checkNonce reports whether nonce was issued by a, and whether it expired.
+func (a *DigestAuth) checkNonce(nonce string) (valid, stale bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, a.nonceKey())
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return true, !a.clock().Before(issued.Add(a.nonceTTL()))
+}
+
+// challenge returns the value of the Proxy-Authenticate header challenging
+// clients in realm, marked stale if the credentials of r were only refused
+// for their expired nonce.
+func (a *DigestAuth) challenge(r *http.Request, realm string) string {
+	stale := false
+	if authz := r.Header.Get("Proxy-Authorization"); strings.HasPrefix(authz, digestPrefix) {
+		if params, err := parseDigestParams(authz[len(digestPrefix):]); err == nil {
+			valid, expired := a.checkNonce(params["nonce"])
+			stale = valid && expired
+		}
+	}
+	c := `Digest realm="` + realmReplacer.Replace(realm) + `", qop="auth", algorithm=MD5, nonce="` + a.nonce() + `"`
+	if stale {
+		c += ", stale=true"
+	}
+	return c
+}
+
+// authenticate checks the Digest credentials creds of r in realm, and
+// returns the authenticated user.
+func (a *DigestAuth) authenticate(ctx context.Context, r *http.Request, creds, realm string) (string, error) {
+	params, err := parseDigestParams(creds)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	user, nonce, nc, cnonce := params["username"], params["nonce"], params["nc"], params["cnonce"]
+	if params["realm"] != realm || params["qop"] != "auth" || cnonce == "" ||
+		(params["algorithm"] != "" && !strings.EqualFold(params["algorithm"], "MD5")) {
+		return "", ErrInvalidCredentials
+	}
+	// CONNECT requests hold the authority and plain HTTP requests the
+	// absolute URL as request target, which the client must have hashed.
+	if params["uri"] != r.RequestURI {
+		return "", ErrInvalidCredentials
+	}
+	if valid, stale := a.checkNonce(nonce); !valid || stale {
+		return "", ErrInvalidCredentials
+	}
+	count, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil || len(nc) != 8 {
+		return "", ErrInvalidCredentials
+	}
+
+	ha1, err := a.Credentials.HA1(ctx, user, realm)
+	if err != nil {
+		return "", err
+	}
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	if subtle.ConstantTimeCompare([]byte(params["response"]), []byte(expected)) != 1 {
+		return "", ErrInvalidCredentials
+	}
+	// The nonce count is only recorded for valid credentials, so others
+	// can not burn the counts of a nonce in use.
+	if !a.useNonce(nonce, count) {
+		return "", ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// useNonce records count as the last nonce count of nonce, and reports
+// whether it is greater than the previous one.
+func (a *DigestAuth) useNonce(nonce string, count uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.counts == nil {
+		a.counts = map[string]uint64{}
+	}
+	last, ok := a.counts[nonce]
+	if ok && count <= last {
+		return false
+	}
+	if !ok && len(a.counts) >= a.pruneAt {
+		for n := range a.counts {
+			if _, stale := a.checkNonce(n); stale {
+				delete(a.counts, n)
+			}
+		}
+		a.pruneAt = 2 * len(a.counts)
+		if a.pruneAt < digestMinPrune {
+			a.pruneAt = digestMinPrune
+		}
+	}
+	a.counts[nonce] = count
+	return true
+}
+
+// parseDigestParams parses the comma-separated parameters of Digest
+// credentials, whose values may be quoted.
+func parseDigestParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed parameter %q", s)
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated value of %q", name)
+			}
+			value, s = b.String(), s[j+1:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value, s = strings.TrimSpace(s[:j]), s[j:]
+		}
+		params[name] = value
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, fmt.Errorf("malformed parameters after %q", name)
+		}
+	}
+	return params, nil
+}
+
+// HtdigestCredentials provides the password hashes of the users of an
+// htdigest file as created by Apache's htdigest, for Digest authentication.
+type HtdigestCredentials struct {
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+// LoadHtdigest reads the users, realms and password hashes of the htdigest
+// file at path, one "user:realm:hash" entry per line. Lines starting with
+// '#' are ignored.
+func LoadHtdigest(path string) (*HtdigestCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &HtdigestCredentials{hashes: map[string]string{}}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, n)
+		}
+		if _, err := hex.DecodeString(fields[2]); err != nil || len(fields[2]) != 2*md5.Size {
+			return nil, fmt.Errorf("%s:%d: malformed password hash of user %q", path, n, fields[0])
+		}
+		c.hashes[fields[0]+":"+fields[1]] = strings.ToLower(fields[2])
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload replaces the users of c with the users of the htdigest file at
+// path. If reading the file fails, the current users are kept.
+func (c *HtdigestCredentials) Reload(path string) error {
+	loaded, err := LoadHtdigest(path)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hashes = loaded.hashes
+	return nil
+}
+
+// HA1 implements DigestCredentials.
+func (c *HtdigestCredentials) HA1(ctx context.Context, user, realm string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	hash, ok := c.hashes[user+":"+realm]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	return hash, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// digestAuthz returns Digest credentials of user with pass for a request of
+// method to uri.
+func digestAuthz(user, pass, realm, method, uri, nonce string, nc int) string {
+	ncHex := fmt.Sprintf("%08x", nc)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(digestHA1(user, realm, pass) + ":" + nonce + ":" + ncHex + ":0a4f113b:auth:" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="0a4f113b", response="%s", algorithm=MD5`,
+		user, realm, nonce, uri, ncHex, response)
+}
+
+func TestParseDigestParams(t *testing.T) {
+	cases := []struct {
+		name           string
+		given          string
+		expectedParams map[string]string
+		expectedError  bool
+	}{
+		{
+			name:           "Params",
+			given:          `username="Mufasa", Realm="a \"b\", c", nc=00000001,qop=auth`,
+			expectedParams: map[string]string{"username": "Mufasa", "realm": `a "b", c`, "nc": "00000001", "qop": "auth"},
+		},
+		{name: "Unterminated", given: `username="Mufasa`, expectedError: true},
+		{name: "MissingValue", given: `username`, expectedError: true},
+		{name: "MissingComma", given: `username="a" realm="b"`, expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, err := parseDigestParams(tc.given)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedParams, observed)
+		})
+	}
+}
+
+func TestLoadHtdigest(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "htdigest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htdigest")
+	entry := "alice:proxy:" + digestHA1("alice", "proxy", "secret")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Users\n"+entry+"\n"), 0600))
+	invalidPath := filepath.Join(dir, "invalid")
+	require.NoError(t, ioutil.WriteFile(invalidPath, []byte(entry+"\nbob:proxy:plaintext\n"), 0600))
+
+	// Act
+
+	c, err := LoadHtdigest(path)
+	_, invalidErr := LoadHtdigest(invalidPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	ha1, err := c.HA1(context.Background(), "alice", "proxy")
+	require.NoError(t, err)
+	assert.Equal(t, digestHA1("alice", "proxy", "secret"), ha1)
+	_, err = c.HA1(context.Background(), "alice", "other")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	require.Error(t, invalidErr)
+	assert.Contains(t, invalidErr.Error(), "invalid:2:")
+}
+
+func TestServeHTTPDigest(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	p.Digest = &DigestAuth{
+		Credentials: &StaticAuthenticator{User: "alice", Pass: "secret"},
+		now:         func() time.Time { return now },
+	}
+	p.AuthSchemes = []string{AuthSchemeDigest}
+
+	serve := func(authz string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, destServer.URL, nil)
+		if authz != "" {
+			r.Header.Set("Proxy-Authorization", authz)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	nonceOf := func(w *httptest.ResponseRecorder) string {
+		challenge := w.Header().Get("Proxy-Authenticate")
+		require.True(t, strings.HasPrefix(challenge, digestPrefix), challenge)
+		params, err := parseDigestParams(challenge[len(digestPrefix):])
+		require.NoError(t, err)
+		assert.Equal(t, "proxy", params["realm"])
+		assert.Equal(t, "auth", params["qop"])
+		return params["nonce"]
+	}
+
+	// Act
+
+	challenged := serve("")
+	nonce := nonceOf(challenged)
+	first := serve(digestAuthz("alice", "secret", "proxy", http.MethodGet, destServer.URL, nonce, 1))
+	replayed := serve(digestAuthz("alice", "secret", "proxy", http.MethodGet, destServer.URL, nonce, 1))
+	second := serve(digestAuthz("alice", "secret", "proxy", http.MethodGet, destServer.URL, nonce, 2))
+	wrongPass := serve(digestAuthz("alice", "wrong", "proxy", http.MethodGet, destServer.URL, nonce, 3))
+	otherURI := serve(digestAuthz("alice", "secret", "proxy", http.MethodGet, destServer.URL+"/other", nonce, 4))
+	basic := serve("Basic YWxpY2U6c2VjcmV0")
+	now = now.Add(defaultDigestNonceTTL)
+	expired := serve(digestAuthz("alice", "secret", "proxy", http.MethodGet, destServer.URL, nonce, 5))
+
+	// Assert
+
+	assert.Equal(t, http.StatusProxyAuthRequired, challenged.Code)
+	assert.Len(t, challenged.Header()["Proxy-Authenticate"], 1, "only Digest is offered")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "dummy-response", first.Body.String())
+	assert.Equal(t, http.StatusProxyAuthRequired, replayed.Code)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, http.StatusProxyAuthRequired, wrongPass.Code)
+	assert.Equal(t, http.StatusProxyAuthRequired, otherURI.Code)
+	assert.Equal(t, http.StatusProxyAuthRequired, basic.Code)
+	assert.Equal(t, http.StatusProxyAuthRequired, expired.Code)
+	assert.NotEqual(t, nonce, nonceOf(expired))
+	assert.Contains(t, expired.Header().Get("Proxy-Authenticate"), "stale=true")
+	assert.NotContains(t, wrongPass.Header().Get("Proxy-Authenticate"), "stale=true")
+}
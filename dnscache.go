@@ -0,0 +1,120 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dnsCacheRecord is a cached answer of a DNSClient as saved to disk.
+type dnsCacheRecord struct {
+	Name    string    `json:"name"`
+	Type    uint16    `json:"type"`
+	IPs     []string  `json:"ips"`
+	Expires time.Time `json:"expires"`
+}
+
+// SaveCache writes the cached answers of c to the file at path, replacing it
+// atomically, so they can be served stale after a restart.
+func (c *DNSClient) SaveCache(path string) error {
+	c.mu.Lock()
+	now := c.clock()
+	records := make([]dnsCacheRecord, 0, len(c.cache))
+	for key, entry := range c.cache {
+		if !now.Before(entry.expires.Add(c.StaleTTL)) {
+			continue
+		}
+		rec := dnsCacheRecord{Name: key.name, Type: key.qtype, Expires: entry.expires}
+		for _, ip := range entry.ips {
+			rec.IPs = append(rec.IPs, ip.IP.String())
+		}
+		records = append(records, rec)
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic writes b to the file at path via a temporary file renamed
+// to path, so readers never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCache adds the answers saved to the file at path by SaveCache to the
+// cache of c, skipping those too old to be served even stale.
+func (c *DNSClient) LoadCache(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var records []dnsCacheRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	for _, rec := range records {
+		if !now.Before(rec.Expires.Add(c.StaleTTL)) {
+			continue
+		}
+		entry := dnsCacheEntry{expires: rec.Expires}
+		for _, s := range rec.IPs {
+			ip := net.ParseIP(s)
+			if rec.Type == dnsTypeA {
+				ip = ip.To4()
+			}
+			if ip != nil {
+				entry.ips = append(entry.ips, net.IPAddr{IP: ip})
+			}
+		}
+		if len(entry.ips) > 0 {
+			c.store(dnsCacheKey{name: rec.Name, qtype: rec.Type}, entry)
+		}
+	}
+	return nil
+}
+
+// PersistCache saves the cache of c to the file at path every interval until
+// stop is closed.
+func (c *DNSClient) PersistCache(logger *zap.Logger, path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.SaveCache(path); err != nil {
+				logger.Error("Saving DNS cache failed", zap.String("path", path), zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSClientSaveLoadCache(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "dnscache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.json")
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	saved := &DNSClient{StaleTTL: time.Hour, now: clock}
+	saved.cache = map[dnsCacheKey]dnsCacheEntry{
+		{name: "fresh.example.com.", qtype: dnsTypeA}: {
+			ips:     []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}},
+			expires: now.Add(time.Minute),
+		},
+		{name: "fresh.example.com.", qtype: dnsTypeAAAA}: {
+			ips:     []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}},
+			expires: now.Add(time.Minute),
+		},
+		{name: "stale.example.com.", qtype: dnsTypeA}: {
+			ips:     []net.IPAddr{{IP: net.ParseIP("192.0.2.2").To4()}},
+			expires: now.Add(-time.Minute),
+		},
+		{name: "gone.example.com.", qtype: dnsTypeA}: {
+			ips:     []net.IPAddr{{IP: net.ParseIP("192.0.2.3").To4()}},
+			expires: now.Add(-2 * time.Hour),
+		},
+	}
+	require.NoError(t, saved.SaveCache(path))
+
+	// Act
+
+	loaded := &DNSClient{StaleTTL: time.Hour, now: clock}
+	err = loaded.LoadCache(path)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Len(t, loaded.cache, 3)
+	assert.NotContains(t, loaded.cache, dnsCacheKey{name: "gone.example.com.", qtype: dnsTypeA})
+
+	// Without servers, cached answers are served fresh or stale.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fresh, err := loaded.LookupIPAddr(ctx, "fresh.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}, {IP: net.ParseIP("2001:db8::1")}}, sortedIPAddrs(fresh))
+	stale, err := loaded.LookupIPAddr(ctx, "stale.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.2").To4()}}, stale)
+}
+
+// sortedIPAddrs returns ips with IPv4 addresses first.
+func sortedIPAddrs(ips []net.IPAddr) []net.IPAddr {
+	var sorted []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() == nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,500 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS protocol constants.
+//
+// See: https://tools.ietf.org/html/rfc1035 and
+// https://tools.ietf.org/html/rfc8484
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+
+	dnsRcodeNameError = 3
+
+	dnsMessageType = "application/dns-message"
+
+	// maxDNSMessageSize is the maximum size of DNS messages over TCP, TLS
+	// and HTTPS.
+	maxDNSMessageSize = 65535
+
+	// maxDNSCacheEntries is the number of cached answers after which the
+	// cache is cleared.
+	maxDNSCacheEntries = 10000
+
+	// dnsStaleRetry is how long stale answers are served without querying
+	// the servers again after failing to refresh them.
+	//
+	// See: https://tools.ietf.org/html/rfc8767#section-5
+	dnsStaleRetry = 30 * time.Second
+
+	// dnsPrefetchHits is the number of times a cached answer must have been
+	// served to be prefetched, so only answers of hot names are.
+	dnsPrefetchHits = 2
+
+	// dnsPrefetchTimeout is the timeout of refreshing an answer in the
+	// background.
+	dnsPrefetchTimeout = 5 * time.Second
+)
+
+// errMalformedDNSMessage is returned for responses of DNS servers which can
+// not be parsed.
+var errMalformedDNSMessage = errors.New("dns: malformed message")
+
+// DNSClient resolves host names by querying DNS servers directly instead of
+// using the resolver of the system, caching answers as long as their TTL
+// permits. Servers are given as "host:port" for plain DNS over UDP, falling
+// back to TCP for truncated answers, "tls://host:port" for DNS over TLS and
+// "https://host/path" for DNS over HTTPS, with ports defaulting to 53 and 853.
+//
+// With StaleTTL set, expired answers are served stale as of RFC 8767 while
+// none of the servers answer, so destinations keep resolving through outages
+// of the servers. With Prefetch set, answers of names looked up repeatedly are
+// refreshed in the background shortly before they expire, so bursts of
+// requests to popular destinations do not wait for their answers expiring.
+type DNSClient struct {
+	// Servers are the DNS servers, which are tried in order until one
+	// answers.
+	Servers []string
+	// TLSConfig, if set, configures connections to DNS over TLS servers.
+	TLSConfig *tls.Config
+	// HTTPClient, if set, sends queries to DNS over HTTPS servers instead of
+	// http.DefaultClient.
+	HTTPClient *http.Client
+	// StaleTTL is how long answers are kept past their TTL to be served if
+	// refreshing them fails, not at all if zero.
+	StaleTTL time.Duration
+	// Prefetch is how long before their expiry answers served repeatedly
+	// are refreshed in the background, not at all if zero.
+	Prefetch time.Duration
+
+	mu    sync.Mutex
+	now   func() time.Time
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IPAddr
+	expires time.Time
+	// retry is the time until which the entry is served stale without
+	// querying the servers.
+	retry time.Time
+	// hits is the number of times the entry was served before its expiry.
+	hits int
+	// prefetching is set once the entry is refreshed in the background.
+	prefetching bool
+}
+
+// LookupIPAddr looks up the IPv4 and IPv6 addresses of host.
+func (c *DNSClient) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, ".")) + "."
+
+	type answer struct {
+		ips []net.IPAddr
+		err error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			ips, err := c.lookup(ctx, name, qtype)
+			answers <- answer{ips: ips, err: err}
+		}(qtype)
+	}
+
+	var ips []net.IPAddr
+	var err error
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		ips = append(ips, a.ips...)
+	}
+	// Either address family suffices.
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host}
+	}
+	return nil, err
+}
+
+// lookup returns the addresses of type qtype of the fully qualified name,
+// from the cache if possible.
+func (c *DNSClient) lookup(ctx context.Context, name string, qtype uint16) ([]net.IPAddr, error) {
+	key := dnsCacheKey{name: name, qtype: qtype}
+	c.mu.Lock()
+	now := c.clock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		if c.prefetchDue(key, now) {
+			go c.prefetch(key)
+		}
+		return entry.ips, nil
+	}
+	stale := ok && now.Before(entry.expires.Add(c.StaleTTL))
+	if stale && now.Before(entry.retry) {
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := c.query(ctx, name, qtype)
+	if err == errDNSNameError {
+		c.mu.Lock()
+		delete(c.cache, key)
+		c.mu.Unlock()
+		return nil, &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(name, ".")}
+	} else if err != nil {
+		if !stale {
+			return nil, err
+		}
+		entry.retry = now.Add(dnsStaleRetry)
+		c.mu.Lock()
+		c.store(key, entry)
+		c.mu.Unlock()
+		return entry.ips, nil
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		c.store(key, dnsCacheEntry{ips: ips, expires: now.Add(time.Duration(ttl) * time.Second)})
+		c.mu.Unlock()
+	}
+	return ips, nil
+}
+
+// prefetchDue counts a hit of the cached answer under key served at now, and
+// reports whether it is to be refreshed in the background, which it is then
+// marked as, see Prefetch.
+func (c *DNSClient) prefetchDue(key dnsCacheKey, now time.Time) bool {
+	if c.Prefetch <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[key]
+	if !ok {
+		return false
+	}
+	entry.hits++
+	due := !entry.prefetching && entry.hits >= dnsPrefetchHits && entry.expires.Sub(now) <= c.Prefetch
+	if due {
+		entry.prefetching = true
+	}
+	c.cache[key] = entry
+	return due
+}
+
+// prefetch refreshes the cached answer under key. If refreshing fails, the
+// answer is kept until it expires, when lookups query the servers again.
+func (c *DNSClient) prefetch(key dnsCacheKey) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsPrefetchTimeout)
+	defer cancel()
+	ips, ttl, err := c.query(ctx, key.name, key.qtype)
+	if err != nil || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.store(key, dnsCacheEntry{ips: ips, expires: c.clock().Add(time.Duration(ttl) * time.Second)})
+	c.mu.Unlock()
+}
+
+// query asks the servers in order for the addresses of type qtype of the
+// fully qualified name and returns the answer of the first server answering,
+// with its TTL.
+func (c *DNSClient) query(ctx context.Context, name string, qtype uint16) ([]net.IPAddr, uint32, error) {
+	if len(c.Servers) == 0 {
+		return nil, 0, errors.New("dns: no servers")
+	}
+	query, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp []byte
+	for _, server := range c.Servers {
+		if resp, err = c.exchange(ctx, server, query); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(resp, id, qtype)
+}
+
+// clock returns the current time. c.mu must be held.
+func (c *DNSClient) clock() time.Time {
+	if c.now == nil {
+		c.now = time.Now
+	}
+	return c.now()
+}
+
+// store caches entry under key, first evicting entries too old to be served
+// even stale if the cache is full, and clearing it if still full. c.mu must
+// be held.
+func (c *DNSClient) store(key dnsCacheKey, entry dnsCacheEntry) {
+	if c.cache == nil {
+		c.cache = map[dnsCacheKey]dnsCacheEntry{}
+	}
+	if _, ok := c.cache[key]; !ok && len(c.cache) >= maxDNSCacheEntries {
+		now := c.clock()
+		for k, e := range c.cache {
+			if !now.Before(e.expires.Add(c.StaleTTL)) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxDNSCacheEntries {
+			c.cache = map[dnsCacheKey]dnsCacheEntry{}
+		}
+	}
+	c.cache[key] = entry
+}
+
+// exchange sends query to server and returns the response.
+func (c *DNSClient) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		return c.exchangeHTTPS(ctx, server, query)
+	case strings.HasPrefix(server, "tls://"):
+		addr := withDefaultPort(strings.TrimPrefix(server, "tls://"), "853")
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		return exchangeStream(ctx, tls.Client(conn, config), query)
+	default:
+		addr := withDefaultPort(strings.TrimPrefix(server, "udp://"), "53")
+		resp, err := exchangeUDP(ctx, addr, query)
+		if err != nil || binary.BigEndian.Uint16(resp[2:4])&dnsFlagTruncated == 0 {
+			return resp, err
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return exchangeStream(ctx, conn, query)
+	}
+}
+
+func (c *DNSClient) exchangeHTTPS(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: %s answered %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1232)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// Responses of other queries, e.g. late responses of earlier
+		// queries or spoofing attempts, are skipped.
+		if n >= 12 && bytes.Equal(b[:2], query[:2]) {
+			return b[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends query over conn with the framing of DNS over TCP and
+// closes conn.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, errMalformedDNSMessage
+	}
+	return resp, nil
+}
+
+// withDefaultPort returns addr with port appended unless addr has a port.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// newDNSQuery returns a recursive query for the addresses of type qtype of the
+// fully qualified name, and its ID.
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	msg := []byte{id[0], id[1], dnsFlagRecursion >> 8, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	if len(name) > 254 {
+		return nil, 0, fmt.Errorf("dns: name %q too long", name)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("dns: malformed name %q", name)
+		}
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, binary.BigEndian.Uint16(id[:]), nil
+}
+
+// errDNSNameError is returned for responses reporting that a name does not
+// exist.
+var errDNSNameError = errors.New("dns: name does not exist")
+
+// parseDNSResponse returns the addresses of type qtype in the answer section
+// of the response msg to the query with id, and the lowest TTL of them.
+func parseDNSResponse(msg []byte, id, qtype uint16) ([]net.IPAddr, uint32, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:2]) != id {
+		return nil, 0, errMalformedDNSMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&dnsFlagResponse == 0 {
+		return nil, 0, errMalformedDNSMessage
+	}
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case dnsRcodeNameError:
+		return nil, 0, errDNSNameError
+	default:
+		return nil, 0, fmt.Errorf("dns: server failure with rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	answers := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+4 > len(msg) {
+			return nil, 0, errMalformedDNSMessage
+		}
+		off += 4
+	}
+
+	var ips []net.IPAddr
+	var ttl uint32
+	for i := 0; i < answers; i++ {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+10 > len(msg) {
+			return nil, 0, errMalformedDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		class := binary.BigEndian.Uint16(msg[off+2 : off+4])
+		rttl := binary.BigEndian.Uint32(msg[off+4 : off+8])
+		n := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+n > len(msg) {
+			return nil, 0, errMalformedDNSMessage
+		}
+		// Records of aliases are skipped, as recursive servers include the
+		// addresses of their targets.
+		if rtype == qtype && class == dnsClassIN && (n == net.IPv4len || n == net.IPv6len) {
+			ips = append(ips, net.IPAddr{IP: net.IP(append([]byte{}, msg[off:off+n]...))})
+			if len(ips) == 1 || rttl < ttl {
+				ttl = rttl
+			}
+		}
+		off += n
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset following the name at off in msg.
+func skipDNSName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			// Compression pointers end names.
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, false
+}
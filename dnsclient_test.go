@@ -0,0 +1,280 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dnsAnswer returns the response to query with the given rcode, answering
+// queries for A records with ips.
+func dnsAnswer(query []byte, rcode uint16, ttl uint32, ips ...string) []byte {
+	qtype := binary.BigEndian.Uint16(query[len(query)-4:])
+	resp := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(resp[2:4], dnsFlagResponse|dnsFlagRecursion|rcode)
+
+	var answers uint16
+	if qtype == dnsTypeA {
+		// An alias record precedes the addresses, as for CDN hosted names.
+		resp = append(resp, 0xc0, 12, 0, 5, 0, dnsClassIN, 0, 0, 0, 60, 0, 2, 0xc0, 12)
+		answers++
+		for _, ip := range ips {
+			resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, dnsClassIN)
+			resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl), 0, 4)
+			resp = append(resp, net.ParseIP(ip).To4()...)
+			answers++
+		}
+	}
+	binary.BigEndian.PutUint16(resp[6:8], answers)
+	return resp
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, id, err := newDNSQuery("www.example.com.", dnsTypeA)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name          string
+		givenResponse []byte
+		givenID       uint16
+		expectedIPs   []net.IPAddr
+		expectedTTL   uint32
+		expectedErr   error
+	}{
+		{
+			name:          "Addresses",
+			givenResponse: dnsAnswer(query, 0, 300, "192.0.2.1", "192.0.2.2"),
+			givenID:       id,
+			expectedIPs:   []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}, {IP: net.ParseIP("192.0.2.2").To4()}},
+			expectedTTL:   300,
+		},
+		{
+			name:          "NameError",
+			givenResponse: dnsAnswer(query, dnsRcodeNameError, 0),
+			givenID:       id,
+			expectedErr:   errDNSNameError,
+		},
+		{
+			name:          "OtherID",
+			givenResponse: dnsAnswer(query, 0, 300, "192.0.2.1"),
+			givenID:       id + 1,
+			expectedErr:   errMalformedDNSMessage,
+		},
+		{
+			name:          "Query",
+			givenResponse: query,
+			givenID:       id,
+			expectedErr:   errMalformedDNSMessage,
+		},
+		{
+			name:          "Truncated",
+			givenResponse: dnsAnswer(query, 0, 300, "192.0.2.1")[:len(query)+20],
+			givenID:       id,
+			expectedErr:   errMalformedDNSMessage,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedIPs, observedTTL, err := parseDNSResponse(tc.givenResponse, tc.givenID, dnsTypeA)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedErr, err)
+			assert.Equal(t, tc.expectedIPs, observedIPs)
+			assert.Equal(t, tc.expectedTTL, observedTTL)
+		})
+	}
+}
+
+func TestDNSClientCache(t *testing.T) {
+	// Arrange
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	var queries int32
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			server.WriteTo(dnsAnswer(b[:n], 0, 60, "192.0.2.1"), addr)
+		}
+	}()
+
+	now := time.Now()
+	c := &DNSClient{
+		Servers: []string{server.LocalAddr().String()},
+		now:     func() time.Time { return now },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Act
+
+	first, err := c.LookupIPAddr(ctx, "www.example.com")
+	require.NoError(t, err)
+	second, err := c.LookupIPAddr(ctx, "WWW.example.com.")
+	require.NoError(t, err)
+	cachedQueries := atomic.LoadInt32(&queries)
+	now = now.Add(time.Minute)
+	_, err = c.LookupIPAddr(ctx, "www.example.com")
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}}, first)
+	assert.Equal(t, first, second)
+	// Empty AAAA answers have no TTL and are not cached.
+	assert.Equal(t, int32(3), cachedQueries)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&queries), "expired answers are queried again")
+}
+
+func TestDNSClientHTTPS(t *testing.T) {
+	// Arrange
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rcode := uint16(0)
+		if r.URL.Path == "/missing" {
+			rcode = dnsRcodeNameError
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(dnsAnswer(query, rcode, 60, "192.0.2.1"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Act
+
+	ips, err := (&DNSClient{Servers: []string{server.URL + "/dns-query"}, HTTPClient: server.Client()}).LookupIPAddr(ctx, "www.example.com")
+	_, missingErr := (&DNSClient{Servers: []string{server.URL + "/missing"}, HTTPClient: server.Client()}).LookupIPAddr(ctx, "www.example.com")
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}}, ips)
+	require.IsType(t, &net.DNSError{}, missingErr)
+	assert.Equal(t, "no such host", missingErr.(*net.DNSError).Err)
+}
+
+func TestDNSClientServeStale(t *testing.T) {
+	// Arrange
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			server.WriteTo(dnsAnswer(b[:n], 0, 60, "192.0.2.1"), addr)
+		}
+	}()
+
+	now := time.Now()
+	c := &DNSClient{
+		Servers:  []string{server.LocalAddr().String()},
+		StaleTTL: time.Hour,
+		now:      func() time.Time { return now },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = c.LookupIPAddr(ctx, "www.example.com")
+	require.NoError(t, err)
+
+	// Act
+
+	server.Close()
+	now = now.Add(time.Minute + dnsStaleRetry)
+	stale, staleErr := c.LookupIPAddr(ctx, "www.example.com")
+	now = now.Add(time.Hour)
+	_, expiredErr := c.LookupIPAddr(ctx, "www.example.com")
+
+	// Assert
+
+	require.NoError(t, staleErr)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}}, stale)
+	assert.Error(t, expiredErr, "answers are not served stale past StaleTTL")
+}
+
+func TestDNSClientPrefetch(t *testing.T) {
+	// Arrange
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	var queries int32
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			server.WriteTo(dnsAnswer(b[:n], 0, 60, "192.0.2.1"), addr)
+		}
+	}()
+
+	now := time.Now()
+	c := &DNSClient{
+		Servers:  []string{server.LocalAddr().String()},
+		Prefetch: 10 * time.Second,
+		now:      func() time.Time { return now },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = c.LookupIPAddr(ctx, "www.example.com")
+	require.NoError(t, err)
+	now = now.Add(55 * time.Second)
+
+	// Act
+
+	for i := 0; i < dnsPrefetchHits+1; i++ {
+		_, err = c.LookupIPAddr(ctx, "www.example.com")
+		require.NoError(t, err)
+	}
+
+	// Empty AAAA answers are not cached and queried on every lookup.
+	expectedQueries := int32(2 + dnsPrefetchHits + 1 + 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && atomic.LoadInt32(&queries) < expectedQueries {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Assert
+
+	assert.Equal(t, expectedQueries, atomic.LoadInt32(&queries), "hot answers are prefetched once")
+	c.mu.Lock()
+	entry := c.cache[dnsCacheKey{name: "www.example.com.", qtype: dnsTypeA}]
+	c.mu.Unlock()
+	assert.Equal(t, now.Add(time.Minute), entry.expires, "prefetched answers are cached anew")
+	assert.False(t, entry.prefetching)
+}
@@ -0,0 +1,15 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+// Package forwardingproxy implements a forwarding HTTP/S proxy, tunneling
+// CONNECT requests and forwarding plain HTTP requests to their destinations.
+//
+// A Proxy is an http.Handler, so it can be served by any http.Server or
+// embedded into another service:
+//
+//	p := forwardingproxy.New(logger)
+//	p.AuthUser, p.AuthPass = "user", "pass"
+//	log.Fatal(http.ListenAndServe(":8080", p))
+//
+// The forwardingproxy command in cmd/forwardingproxy configures a Proxy from
+// command line flags.
+package forwardingproxy
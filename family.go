@@ -0,0 +1,150 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IPFamily restricts or orders the address families dialed for a destination.
+type IPFamily int
+
+// IP families of IPFamilyRule.
+const (
+	// AnyIPFamily dials addresses in the order returned by the resolver.
+	AnyIPFamily IPFamily = iota
+	// IPv4Only dials IPv4 addresses only.
+	IPv4Only
+	// IPv6Only dials IPv6 addresses only.
+	IPv6Only
+	// PreferIPv4 dials IPv4 addresses before IPv6 addresses.
+	PreferIPv4
+	// PreferIPv6 dials IPv6 addresses before IPv4 addresses.
+	PreferIPv6
+)
+
+var ipFamilyNames = map[string]IPFamily{
+	"any":         AnyIPFamily,
+	"ipv4":        IPv4Only,
+	"ipv6":        IPv6Only,
+	"prefer-ipv4": PreferIPv4,
+	"prefer-ipv6": PreferIPv6,
+}
+
+// IPFamilyRule selects the address families dialed for destination hosts
+// matching Host, e.g. to avoid origins with broken AAAA records.
+type IPFamilyRule struct {
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	Host   string
+	Family IPFamily
+}
+
+// LoadIPFamilyRules reads IP family rules from the file at path. Each
+// non-empty line not starting with '#' holds a host pattern followed by one of
+// "any", "ipv4", "ipv6", "prefer-ipv4" or "prefer-ipv6", e.g.:
+//
+//	*.example.com ipv4
+func LoadIPFamilyRules(path string) ([]IPFamilyRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []IPFamilyRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseIPFamilyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseIPFamilyRule(line string) (IPFamilyRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return IPFamilyRule{}, fmt.Errorf("malformed rule %q", line)
+	}
+	family, ok := ipFamilyNames[strings.ToLower(fields[1])]
+	if !ok {
+		return IPFamilyRule{}, fmt.Errorf("unknown IP family %q", fields[1])
+	}
+	return IPFamilyRule{Host: strings.ToLower(fields[0]), Family: family}, nil
+}
+
+// ipFamilyFor returns the family of the first rule matching host.
+func ipFamilyFor(rules []IPFamilyRule, host string) IPFamily {
+	for _, rule := range rules {
+		if matchHostPattern(rule.Host, host) {
+			return rule.Family
+		}
+	}
+	return AnyIPFamily
+}
+
+// applyIPFamily filters or reorders ips according to family. The relative
+// order of addresses of the same family is kept.
+func applyIPFamily(family IPFamily, ips []net.IPAddr) []net.IPAddr {
+	switch family {
+	case IPv4Only, IPv6Only:
+		filtered := ips[:0:0]
+		for _, ip := range ips {
+			if isIPv4(ip.IP) == (family == IPv4Only) {
+				filtered = append(filtered, ip)
+			}
+		}
+		return filtered
+	case PreferIPv4, PreferIPv6:
+		sort.SliceStable(ips, func(i, j int) bool {
+			return isIPv4(ips[i].IP) == (family == PreferIPv4) && isIPv4(ips[j].IP) != (family == PreferIPv4)
+		})
+	}
+	return ips
+}
+
+// interleaveIPFamilies reorders ips to alternate between IP families,
+// starting with the family of the first address (RFC 8305, section 4). The
+// relative order of addresses of the same family is kept.
+func interleaveIPFamilies(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) == 0 {
+		return ips
+	}
+	first := isIPv4(ips[0].IP)
+	var same, other []net.IPAddr
+	for _, ip := range ips {
+		if isIPv4(ip.IP) == first {
+			same = append(same, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	interleaved := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(same) || i < len(other); i++ {
+		if i < len(same) {
+			interleaved = append(interleaved, same[i])
+		}
+		if i < len(other) {
+			interleaved = append(interleaved, other[i])
+		}
+	}
+	return interleaved
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
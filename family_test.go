@@ -0,0 +1,193 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPFamilyRule(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name          string
+		givenLine     string
+		expectedRule  IPFamilyRule
+		expectedError bool
+	}{
+		{
+			name:         "Valid",
+			givenLine:    "*.Example.com  Prefer-IPv6",
+			expectedRule: IPFamilyRule{Host: "*.example.com", Family: PreferIPv6},
+		},
+		{
+			name:          "MissingFamily",
+			givenLine:     "example.com",
+			expectedError: true,
+		},
+		{
+			name:          "UnknownFamily",
+			givenLine:     "example.com ipv5",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedRule, err := parseIPFamilyRule(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRule, observedRule)
+		})
+	}
+}
+
+func TestIPFamilyFor(t *testing.T) {
+	// Arrange
+
+	rules := []IPFamilyRule{
+		{Host: "broken.example.com", Family: IPv4Only},
+		{Host: "*.example.com", Family: PreferIPv6},
+	}
+
+	// Act & Assert
+
+	assert.Equal(t, IPv4Only, ipFamilyFor(rules, "broken.example.com:443"))
+	assert.Equal(t, PreferIPv6, ipFamilyFor(rules, "www.example.com"))
+	assert.Equal(t, AnyIPFamily, ipFamilyFor(rules, "example.org"))
+}
+
+func TestApplyIPFamily(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name        string
+		givenFamily IPFamily
+		expectedIPs []string
+	}{
+		{
+			name:        "Any",
+			givenFamily: AnyIPFamily,
+			expectedIPs: []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		},
+		{
+			name:        "IPv4Only",
+			givenFamily: IPv4Only,
+			expectedIPs: []string{"192.0.2.1", "192.0.2.2"},
+		},
+		{
+			name:        "IPv6Only",
+			givenFamily: IPv6Only,
+			expectedIPs: []string{"2001:db8::1", "2001:db8::2"},
+		},
+		{
+			name:        "PreferIPv4",
+			givenFamily: PreferIPv4,
+			expectedIPs: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"},
+		},
+		{
+			name:        "PreferIPv6",
+			givenFamily: PreferIPv6,
+			expectedIPs: []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ips []net.IPAddr
+			for _, ip := range []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"} {
+				ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+
+			// Act
+
+			observedIPs := applyIPFamily(tc.givenFamily, ips)
+
+			// Assert
+
+			var observed []string
+			for _, ip := range observedIPs {
+				observed = append(observed, ip.IP.String())
+			}
+			assert.Equal(t, tc.expectedIPs, observed)
+		})
+	}
+}
+
+func TestInterleaveIPFamilies(t *testing.T) {
+	cases := []struct {
+		givenIPs    []string
+		expectedIPs []string
+	}{
+		{
+			givenIPs:    []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"},
+			expectedIPs: []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"},
+		},
+		{
+			givenIPs:    []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"},
+			expectedIPs: []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"},
+		},
+		{
+			givenIPs:    []string{"192.0.2.1", "192.0.2.2"},
+			expectedIPs: []string{"192.0.2.1", "192.0.2.2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(strings.Join(tc.givenIPs, ","), func(t *testing.T) {
+			// Arrange
+
+			var ips []net.IPAddr
+			for _, ip := range tc.givenIPs {
+				ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+
+			// Act
+
+			observedIPs := interleaveIPFamilies(ips)
+
+			// Assert
+
+			var observed []string
+			for _, ip := range observedIPs {
+				observed = append(observed, ip.IP.String())
+			}
+			assert.Equal(t, tc.expectedIPs, observed)
+		})
+	}
+}
+
+func TestDialContextIPFamily(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	_, port, err := net.SplitHostPort(echoListener.Addr().String())
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.IPFamilyRules = []IPFamilyRule{{Host: "127.0.0.1", Family: IPv6Only}}
+
+	// Act
+
+	_, err = p.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+
+	// Assert
+
+	assert.Error(t, err)
+}
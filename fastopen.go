@@ -0,0 +1,32 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+)
+
+type fastOpenKey struct{}
+
+// withFastOpen returns ctx letting connections dialed with it be opened with
+// TCP Fast Open.
+func withFastOpen(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fastOpenKey{}, true)
+}
+
+// fastOpenFromContext reports whether connections dialed with ctx may be
+// opened with TCP Fast Open.
+func fastOpenFromContext(ctx context.Context) bool {
+	fastOpen, _ := ctx.Value(fastOpenKey{}).(bool)
+	return fastOpen
+}
+
+// fastOpenDialer returns a dialer opening connections with TCP Fast Open where
+// the platform supports it, sending the first data written, e.g. a TLS
+// ClientHello, along with the SYN to origins that handed out a Fast Open
+// cookie before. Elsewhere, and towards origins without a cookie, connections
+// are opened normally.
+func fastOpenDialer() *net.Dialer {
+	return &net.Dialer{Control: fastOpenControl}
+}
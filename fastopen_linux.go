@@ -0,0 +1,22 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+//go:build linux
+// +build linux
+
+package forwardingproxy
+
+import (
+	"syscall"
+)
+
+// tcpFastOpenConnect is the TCP_FASTOPEN_CONNECT socket option of Linux 4.11
+// and later, deferring the SYN of connect until the first write.
+const tcpFastOpenConnect = 30
+
+// fastOpenControl enables TCP Fast Open on the socket c is about to connect.
+// Kernels not supporting it connect normally.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
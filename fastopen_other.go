@@ -0,0 +1,16 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+//go:build !linux
+// +build !linux
+
+package forwardingproxy
+
+import (
+	"syscall"
+)
+
+// fastOpenControl connects normally, as TCP Fast Open is only supported on
+// Linux.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptorFastOpen(t *testing.T) {
+	cases := []struct {
+		name      string
+		givenHost string
+		expected  bool
+	}{
+		{name: "Subdomain", givenHost: "api.example.com:443", expected: true},
+		{name: "Exact", givenHost: "example.org:443", expected: true},
+		{name: "Other", givenHost: "example.net:443"},
+	}
+
+	i := &Interceptor{FastOpenHosts: []string{"*.example.com", "example.org"}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := i.fastOpen(tc.givenHost)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestFastOpenDialer(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	ctx := withFastOpen(context.Background())
+	require.True(t, fastOpenFromContext(ctx))
+	require.False(t, fastOpenFromContext(context.Background()))
+
+	// Act
+
+	conn, err := fastOpenDialer().DialContext(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(conn, echoed)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed), "the data sent early arrives")
+}
@@ -0,0 +1,309 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Filter inspects, modifies or denies the requests and responses of
+// intercepted traffic, see Interceptor.Filters. Filters may replace bodies
+// with readers inspecting or modifying them while they stream, rather than
+// buffering them. Such readers can deny the rest of a body by failing with a
+// *FilterError: requests are then refused with 403 Forbidden if no response
+// has been received yet, while responses being relayed already are aborted.
+type Filter interface {
+	// FilterRequest is called with every decrypted request before it is
+	// forwarded, with r.URL holding the destination. It may modify r,
+	// including replacing r.Body. Requests for which it returns an error
+	// are refused with 403 Forbidden.
+	FilterRequest(r *http.Request) error
+	// FilterResponse is called with every response to an intercepted
+	// request before it is relayed. It may modify resp, including replacing
+	// resp.Body. Responses for which it returns an error are replaced with
+	// a block page.
+	FilterResponse(resp *http.Response) error
+}
+
+// FilterError is the error filters deny requests and responses with.
+type FilterError struct {
+	Reason string
+}
+
+func (e *FilterError) Error() string {
+	return e.Reason
+}
+
+// ContentTypeFilter denies bodies by their media type, see
+// Interceptor.BlockedContentTypes for the syntax. Both the Content-Type of
+// bodies and the type sniffed from their first bytes are checked, except for
+// encoded bodies and event streams, which are only checked by their declared
+// type.
+type ContentTypeFilter struct {
+	// BlockedRequests are the media types of request bodies to deny, e.g.
+	// uploads of archives.
+	BlockedRequests []string
+	// BlockedResponses are the media types of response bodies to deny.
+	BlockedResponses []string
+}
+
+// FilterRequest denies requests whose body is of a blocked type.
+func (f *ContentTypeFilter) FilterRequest(r *http.Request) error {
+	if len(f.BlockedRequests) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	var contentType string
+	r.Body, contentType = blockedBodyType(f.BlockedRequests, r.Header, r.Body)
+	if contentType != "" {
+		return &FilterError{Reason: fmt.Sprintf("request body of type %s not allowed", contentType)}
+	}
+	return nil
+}
+
+// FilterResponse denies responses whose body is of a blocked type.
+func (f *ContentTypeFilter) FilterResponse(resp *http.Response) error {
+	if len(f.BlockedResponses) == 0 || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	var contentType string
+	resp.Body, contentType = blockedBodyType(f.BlockedResponses, resp.Header, resp.Body)
+	if contentType != "" {
+		return &FilterError{Reason: fmt.Sprintf("response body of type %s not allowed", contentType)}
+	}
+	return nil
+}
+
+// blockedBodyType returns the type of a body with header if it matches any
+// of blocked, or "", and a body reading all of body including any bytes
+// sniffed.
+func blockedBodyType(blocked []string, header http.Header, body io.ReadCloser) (io.ReadCloser, string) {
+	declared, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	declared = strings.ToLower(declared)
+	if matchAnyContentType(blocked, declared) {
+		return body, declared
+	}
+	encoding := header.Get("Content-Encoding")
+	if (encoding != "" && encoding != "identity") || declared == "text/event-stream" {
+		return body, ""
+	}
+	body, sniffed := sniffBody(body)
+	if matchAnyContentType(blocked, sniffed) {
+		return body, sniffed
+	}
+	return body, ""
+}
+
+func matchAnyContentType(patterns []string, contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matchContentType(strings.ToLower(pattern), contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// BodySizeFilter denies bodies larger than a maximum size. Bodies declaring a
+// larger Content-Length are denied up front, while bodies of unknown length
+// are denied once the maximum is exceeded while streaming.
+type BodySizeFilter struct {
+	// MaxRequestSize is the maximum number of bytes of request bodies, or
+	// zero for no limit.
+	MaxRequestSize int64
+	// MaxResponseSize is the maximum number of bytes of response bodies, or
+	// zero for no limit.
+	MaxResponseSize int64
+}
+
+// FilterRequest denies requests whose body is larger than MaxRequestSize.
+func (f *BodySizeFilter) FilterRequest(r *http.Request) error {
+	if f.MaxRequestSize <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if r.ContentLength > f.MaxRequestSize {
+		return bodyTooLarge("request", f.MaxRequestSize)
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, kind: "request", max: f.MaxRequestSize, n: f.MaxRequestSize}
+	return nil
+}
+
+// FilterResponse denies responses whose body is larger than
+// MaxResponseSize.
+func (f *BodySizeFilter) FilterResponse(resp *http.Response) error {
+	if f.MaxResponseSize <= 0 || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if resp.ContentLength > f.MaxResponseSize {
+		return bodyTooLarge("response", f.MaxResponseSize)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, kind: "response", max: f.MaxResponseSize, n: f.MaxResponseSize}
+	return nil
+}
+
+func bodyTooLarge(kind string, max int64) error {
+	return &FilterError{Reason: fmt.Sprintf("%s body exceeds %d bytes", kind, max)}
+}
+
+// limitedBody fails with a *FilterError once more than max bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	kind string
+	max  int64
+	// n is the number of bytes left to read.
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, bodyTooLarge(b.kind, b.max)
+	}
+	// One byte more than left is read, to tell bodies of exactly max bytes
+	// from larger ones.
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n + int(b.n), bodyTooLarge(b.kind, b.max)
+	}
+	return n, err
+}
+
+// URLFilter denies requests whose URL, e.g.
+// "https://www.example.com/path?query", matches any of Patterns.
+type URLFilter struct {
+	Patterns []*regexp.Regexp
+}
+
+// LoadURLFilter reads the patterns of a URL filter from the file at path.
+// Each non-empty line not starting with '#' holds a regular expression, e.g.:
+//
+//	^https://[^/]+/wp-admin/
+//	\.(exe|msi)(\?|$)
+func LoadURLFilter(path string) (*URLFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	uf := &URLFilter{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		uf.Patterns = append(uf.Patterns, re)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return uf, nil
+}
+
+// FilterRequest denies requests whose URL matches any of Patterns.
+func (f *URLFilter) FilterRequest(r *http.Request) error {
+	u := r.URL.String()
+	for _, re := range f.Patterns {
+		if re.MatchString(u) {
+			return &FilterError{Reason: fmt.Sprintf("URL matches %q", re.String())}
+		}
+	}
+	return nil
+}
+
+// FilterResponse passes all responses.
+func (f *URLFilter) FilterResponse(resp *http.Response) error {
+	return nil
+}
+
+// filterChain applies the filters of an interceptor to the requests and
+// responses of an intercepted destination.
+type filterChain struct {
+	logger  *zap.Logger
+	filters []Filter
+	host    string
+	user    string
+}
+
+type filterChainKey struct{}
+
+func withFilterChain(ctx context.Context, fc *filterChain) context.Context {
+	return context.WithValue(ctx, filterChainKey{}, fc)
+}
+
+// filterChainFromContext returns the filter chain of ctx, or nil.
+func filterChainFromContext(ctx context.Context) *filterChain {
+	fc, _ := ctx.Value(filterChainKey{}).(*filterChain)
+	return fc
+}
+
+// filterRequest applies the filters to r in order, stopping at the first
+// one denying it.
+func (fc *filterChain) filterRequest(r *http.Request) error {
+	for _, f := range fc.filters {
+		if err := f.FilterRequest(r); err != nil {
+			fc.logger.Warn("Intercepted request refused by filter",
+				zap.String("host", fc.host),
+				zap.String("user", fc.user),
+				zap.String("path", r.URL.Path),
+				zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+var filterBlockPageTemplate = template.Must(template.New("filter").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Response blocked</title></head>
+<body>
+<h1>Response blocked</h1>
+<p>The response of {{.Host}} was blocked: {{.Reason}}.</p>
+</body>
+</html>
+`))
+
+// filterResponse applies the filters to resp in order, replacing it with a
+// block page at the first one denying it.
+func (fc *filterChain) filterResponse(resp *http.Response) error {
+	for _, f := range fc.filters {
+		err := f.FilterResponse(resp)
+		if err == nil {
+			continue
+		}
+		fc.logger.Warn("Intercepted response blocked by filter",
+			zap.String("host", fc.host),
+			zap.String("user", fc.user),
+			zap.String("path", resp.Request.URL.Path),
+			zap.Error(err))
+
+		var page bytes.Buffer
+		if err := filterBlockPageTemplate.Execute(&page, struct{ Host, Reason string }{fc.host, err.Error()}); err != nil {
+			return err
+		}
+		replaceWithBlockPage(resp, &page)
+		return nil
+	}
+	return nil
+}
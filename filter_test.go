@@ -0,0 +1,282 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentTypeFilter(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenType     string
+		givenEncoding string
+		givenBody     string
+		expectedError bool
+	}{
+		{name: "Allowed", givenType: "text/plain", givenBody: "hello"},
+		{name: "DeclaredType", givenType: "Application/Zip", givenBody: "hello", expectedError: true},
+		{name: "SniffedArchive", givenType: "text/plain", givenBody: "PK\x03\x04\x14\x00\x00\x00", expectedError: true},
+		{name: "EncodedNotSniffed", givenType: "text/plain", givenEncoding: "gzip", givenBody: "PK\x03\x04\x14\x00\x00\x00"},
+	}
+
+	f := &ContentTypeFilter{
+		BlockedRequests:  []string{"application/zip"},
+		BlockedResponses: []string{"application/zip"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			header := http.Header{}
+			if tc.givenType != "" {
+				header.Set("Content-Type", tc.givenType)
+			}
+			if tc.givenEncoding != "" {
+				header.Set("Content-Encoding", tc.givenEncoding)
+			}
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/upload", strings.NewReader(tc.givenBody))
+			req.Header = header
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       ioutil.NopCloser(strings.NewReader(tc.givenBody)),
+				Request:    httptest.NewRequest(http.MethodGet, "https://example.com/download", nil),
+			}
+
+			// Act
+
+			reqErr := f.FilterRequest(req)
+			respErr := f.FilterResponse(resp)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, reqErr != nil, "%v", reqErr)
+			assert.Equal(t, tc.expectedError, respErr != nil, "%v", respErr)
+			if tc.expectedError {
+				return
+			}
+			reqBody, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.givenBody, string(reqBody), "sniffed bytes are still forwarded")
+			respBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.givenBody, string(respBody), "sniffed bytes are still relayed")
+		})
+	}
+}
+
+func TestBodySizeFilter(t *testing.T) {
+	cases := []struct {
+		name              string
+		givenLength       int64
+		givenBody         string
+		expectedError     bool
+		expectedReadError bool
+	}{
+		{name: "Declared", givenLength: 4, givenBody: "ping"},
+		{name: "DeclaredTooLarge", givenLength: 5, givenBody: "pings", expectedError: true},
+		{name: "Streamed", givenLength: -1, givenBody: "ping"},
+		{name: "StreamedTooLarge", givenLength: -1, givenBody: "pings", expectedReadError: true},
+	}
+
+	f := &BodySizeFilter{MaxRequestSize: 4}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/upload", strings.NewReader(tc.givenBody))
+			req.ContentLength = tc.givenLength
+
+			// Act
+
+			err := f.FilterRequest(req)
+
+			// Assert
+
+			if tc.expectedError {
+				_, ok := err.(*FilterError)
+				assert.True(t, ok, "%v", err)
+				return
+			}
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(req.Body)
+			if tc.expectedReadError {
+				_, ok := err.(*FilterError)
+				assert.True(t, ok, "%v", err)
+				assert.Equal(t, "ping", string(body), "bytes up to the maximum are read")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.givenBody, string(body))
+		})
+	}
+}
+
+func TestURLFilter(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenURL      string
+		expectedError bool
+	}{
+		{name: "Allowed", givenURL: "https://www.example.com/index.html"},
+		{name: "Path", givenURL: "https://www.example.com/wp-admin/", expectedError: true},
+		{name: "Query", givenURL: "https://www.example.com/file.exe?v=1", expectedError: true},
+	}
+
+	f := &URLFilter{Patterns: []*regexp.Regexp{
+		regexp.MustCompile(`^https://[^/]+/wp-admin/`),
+		regexp.MustCompile(`\.(exe|msi)(\?|$)`),
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			err := f.FilterRequest(httptest.NewRequest(http.MethodGet, tc.givenURL, nil))
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestLoadURLFilter(t *testing.T) {
+	// Arrange
+
+	f, err := ioutil.TempFile("", "urlfilter")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("# Admin pages\n^https://[^/]+/wp-admin/\n\n(unclosed\n")
+	require.NoError(t, err)
+
+	// Act
+
+	_, err = LoadURLFilter(f.Name())
+
+	// Assert
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), f.Name()+":4:")
+}
+
+func TestInterceptFilters(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		if r.URL.Path == "/large" {
+			fmt.Fprint(w, strings.Repeat("x", 64))
+			return
+		}
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	// Proxy server
+
+	ca := newTestCA(t)
+	interceptor, err := NewInterceptor(ca, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	interceptor.Filters = []Filter{
+		&URLFilter{Patterns: []*regexp.Regexp{regexp.MustCompile(`/blocked$`)}},
+		&BodySizeFilter{MaxRequestSize: 16, MaxResponseSize: 32},
+	}
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	transport.TLSClientConfig = &tls.Config{RootCAs: destPool}
+	p.ForwardingHTTPProxy.Transport = transport
+	p.Interceptor = interceptor
+
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(interceptor.ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caPool},
+	}}
+
+	cases := []struct {
+		name           string
+		givenPath      string
+		givenBody      string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Forwarded",
+			givenPath:      "/",
+			givenBody:      "ping",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "dummy-response",
+		},
+		{
+			name:           "URLRefused",
+			givenPath:      "/blocked",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "URL matches \"/blocked$\"\n",
+		},
+		{
+			name:           "StreamedRequestTooLarge",
+			givenPath:      "/",
+			givenBody:      strings.Repeat("x", 17),
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "request body exceeds 16 bytes\n",
+		},
+		{
+			name:           "ResponseTooLarge",
+			givenPath:      "/large",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "response body exceeds 32 bytes",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			// The body is streamed and of unknown length, so it is only
+			// denied while being forwarded.
+			body := ioutil.NopCloser(bytes.NewBufferString(tc.givenBody))
+			resp, err := client.Post(destServer.URL+tc.givenPath, "text/plain", body)
+
+			// Assert
+
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			observed, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Contains(t, string(observed), tc.expectedBody)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// viaPseudonym identifies the proxy in Via headers.
+const viaPseudonym = "forwardingproxy"
+
+// NewForwardingTransport returns a transport for forwarding plain HTTP
+// requests, which dials destinations via dial and keeps idle connections to
+// them for reuse. Unlike http.DefaultTransport it never uses a proxy itself.
+// Intercepted destinations are presented the client certificates of
+// Interceptor.ClientCerts.
+func NewForwardingTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error), responseHeaderTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{GetClientCertificate: getOriginClientCertificate},
+	}
+}
+
+// addVia appends the proxy to the Via header of a message received with the
+// given protocol version.
+//
+// See: https://tools.ietf.org/html/rfc7230#section-5.7.1
+func addVia(h http.Header, protoMajor, protoMinor int) {
+	via := strconv.Itoa(protoMajor) + "." + strconv.Itoa(protoMinor) + " " + viaPseudonym
+	if prior := h.Get("Via"); prior != "" {
+		via = prior + ", " + via
+	}
+	h.Set("Via", via)
+}
+
+// isDeniedAddrError reports whether err, possibly wrapped by the transport,
+// is returned because the destination is denied.
+func isDeniedAddrError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	switch err.(type) {
+	case *deniedAddrError, *aclDeniedError:
+		return true
+	}
+	return false
+}
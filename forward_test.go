@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyForwardsHTTP(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	var newConns int32
+	destServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "1.1 forwardingproxy", r.Header.Get("Via"))
+		assert.Equal(t, "127.0.0.1", r.Header.Get("X-Forwarded-For"))
+		assert.Empty(t, r.Header.Get("X-Hop"))
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+
+		w.Header().Set("Via", "1.0 origin-cache")
+		_, _ = io.WriteString(w, "dummy-response")
+	}))
+	destServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	destServer.Start()
+	defer destServer.Close()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyServerURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyServerURL)}}
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, destServer.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "value")
+		req.Header.Set("Proxy-Authorization", "Basic foo")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+
+		// Act
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		// Assert
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "dummy-response", string(b))
+		assert.Equal(t, "1.0 origin-cache, 1.1 forwardingproxy", resp.Header.Get("Via"))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&newConns), "connections to destination are reused")
+}
+
+func TestProxyForwardsHTTPDeniedAddress(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("denied destination reached")
+	}))
+	defer destServer.Close()
+
+	denied, err := ParseCIDRs("127.0.0.0/8")
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.DeniedCIDRs = denied
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+
+	req := httptest.NewRequest(http.MethodGet, destServer.URL, nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, req)
+
+	// Assert
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAddVia(t *testing.T) {
+	// Arrange
+
+	h := http.Header{}
+
+	// Act
+
+	addVia(h, 1, 0)
+	addVia(h, 1, 1)
+
+	// Assert
+
+	assert.Equal(t, "1.0 forwardingproxy, 1.1 forwardingproxy", h.Get("Via"))
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxGeoIPCacheSize bounds the countries cached per database record. Country
+// databases hold a few hundred records, city databases many more.
+const maxGeoIPCacheSize = 10000
+
+// GeoIP looks up the countries of IP addresses in a MaxMind DB file, such as
+// GeoLite2-Country.mmdb, reloading it once it changes.
+type GeoIP struct {
+	logger *zap.Logger
+	path   string
+
+	mu      sync.RWMutex
+	db      *mmdb
+	modTime time.Time
+	// countries caches the countries of records by their offset.
+	countries map[uint]string
+}
+
+// NewGeoIP returns a GeoIP for the MaxMind DB file at path, failing if it
+// can not be loaded.
+func NewGeoIP(logger *zap.Logger, path string) (*GeoIP, error) {
+	g := &GeoIP{logger: logger, path: path}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload loads the database file. The current database is kept if loading
+// fails.
+func (g *GeoIP) Reload() error {
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return err
+	}
+	db, err := parseMMDB(b)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.db, g.modTime = db, fi.ModTime()
+	g.countries = make(map[uint]string)
+	return nil
+}
+
+// Watch checks the database file for changes every interval until stop is
+// closed, and reloads it once it changed.
+func (g *GeoIP) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(g.path)
+		if err != nil {
+			g.logger.Warn("Checking GeoIP database for changes failed", zap.Error(err))
+			continue
+		}
+		g.mu.RLock()
+		changed := !fi.ModTime().Equal(g.modTime)
+		g.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := g.Reload(); err != nil {
+			g.logger.Error("Reloading GeoIP database failed", zap.String("path", g.path), zap.Error(err))
+			continue
+		}
+		g.logger.Info("GeoIP database reloaded", zap.String("path", g.path))
+	}
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of ip, falling
+// back to the country its network is registered in, or "" if unknown.
+func (g *GeoIP) Country(ip net.IP) string {
+	if g == nil || ip == nil {
+		return ""
+	}
+	g.mu.RLock()
+	db, countries := g.db, g.countries
+	offset, ok := db.lookup(ip)
+	if !ok {
+		g.mu.RUnlock()
+		return ""
+	}
+	country, cached := countries[offset]
+	g.mu.RUnlock()
+	if cached {
+		return country
+	}
+
+	v, err := db.decode(offset)
+	if err != nil {
+		g.logger.Warn("Decoding GeoIP record failed", zap.String("ip", ip.String()), zap.Error(err))
+		return ""
+	}
+	country = recordCountry(v, "country")
+	if country == "" {
+		country = recordCountry(v, "registered_country")
+	}
+
+	g.mu.Lock()
+	// The database may have been reloaded meanwhile.
+	if g.db == db && len(g.countries) < maxGeoIPCacheSize {
+		g.countries[offset] = country
+	}
+	g.mu.Unlock()
+	return country
+}
+
+// recordCountry returns the ISO code of the country under key of the
+// database record v.
+func recordCountry(v interface{}, key string) string {
+	m, _ := v.(map[string]interface{})
+	c, _ := m[key].(map[string]interface{})
+	code, _ := c["iso_code"].(string)
+	return strings.ToUpper(code)
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// mmdbStringField returns s encoded as MaxMind DB string.
+func mmdbStringField(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+// buildTestMMDB returns a MaxMind DB with 24 bit records of ipVersion mapping
+// the networks to their countries.
+func buildTestMMDB(t *testing.T, ipVersion int, networks map[string]string) []byte {
+	// Records of nodes are 0 if empty, the index of the next node if
+	// positive and the index of the data if negative.
+	nodes := [][2]int{{}}
+	var data [][]byte
+	for cidr, country := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ip := []byte(n.IP)
+		ones, _ := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 == nil && ipVersion == 4 {
+			continue
+		} else if ip4 != nil && ipVersion == 6 {
+			ip, ones = append(make([]byte, 12), ip4...), ones+96
+		}
+
+		var rec []byte
+		rec = append(rec, mmdbMap<<5|1)
+		rec = append(rec, mmdbStringField("country")...)
+		rec = append(rec, mmdbMap<<5|1)
+		rec = append(rec, mmdbStringField("iso_code")...)
+		rec = append(rec, mmdbStringField(country)...)
+		data = append(data, rec)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -len(data)
+				break
+			}
+			if nodes[node][bit] == 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var offsets []int
+	var section []byte
+	for _, rec := range data {
+		offsets = append(offsets, len(section))
+		section = append(section, rec...)
+	}
+	var b []byte
+	for _, node := range nodes {
+		for _, r := range node {
+			v := len(nodes)
+			switch {
+			case r > 0:
+				v = r
+			case r < 0:
+				v = len(nodes) + mmdbDataSeparator + offsets[-r-1]
+			}
+			b = append(b, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	b = append(b, make([]byte, mmdbDataSeparator)...)
+	b = append(b, section...)
+
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, mmdbMap<<5|3)
+	b = append(b, mmdbStringField("node_count")...)
+	b = append(b, mmdbUint32<<5|4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(nodes)))
+	b = append(b, mmdbStringField("record_size")...)
+	b = append(b, mmdbUint16<<5|1, 24)
+	b = append(b, mmdbStringField("ip_version")...)
+	b = append(b, mmdbUint16<<5|1, byte(ipVersion))
+	return b
+}
+
+// writeTestGeoIP writes a MaxMind DB mapping networks to countries to a file
+// in dir and returns its path.
+func writeTestGeoIP(t *testing.T, dir string, networks map[string]string) string {
+	path := filepath.Join(dir, "countries.mmdb")
+	require.NoError(t, ioutil.WriteFile(path, buildTestMMDB(t, 6, networks), 0644))
+	return path
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	networks := map[string]string{
+		"192.0.2.0/24":  "se",
+		"198.51.0.0/16": "KP",
+		"2001:db8::/32": "NO",
+	}
+
+	cases := []struct {
+		name     string
+		givenIP  string
+		expected string
+	}{
+		{
+			name:     "IPv4",
+			givenIP:  "192.0.2.10",
+			expected: "SE",
+		},
+		{
+			name:     "IPv4Network",
+			givenIP:  "198.51.100.1",
+			expected: "KP",
+		},
+		{
+			name:     "IPv6",
+			givenIP:  "2001:db8::1",
+			expected: "NO",
+		},
+		{
+			name:    "Unknown",
+			givenIP: "203.0.113.1",
+		},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		// Arrange
+
+		db, err := parseMMDB(buildTestMMDB(t, ipVersion, networks))
+		require.NoError(t, err)
+		g := &GeoIP{logger: zap.NewNop(), db: db, countries: make(map[uint]string)}
+
+		for _, tc := range cases {
+			t.Run(fmt.Sprintf("IPv%dDB/%s", ipVersion, tc.name), func(t *testing.T) {
+				// IPv4 databases hold no IPv6 networks.
+				expected := tc.expected
+				if ipVersion == 4 && net.ParseIP(tc.givenIP).To4() == nil {
+					expected = ""
+				}
+
+				// Act
+
+				observed := g.Country(net.ParseIP(tc.givenIP))
+
+				// Assert
+
+				assert.Equal(t, expected, observed)
+			})
+		}
+	}
+}
+
+func TestGeoIPWatch(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTestGeoIP(t, dir, map[string]string{"192.0.2.0/24": "SE"})
+	g, err := NewGeoIP(zap.NewNop(), path)
+	require.NoError(t, err)
+	ip := net.ParseIP("192.0.2.10")
+	require.Equal(t, "SE", g.Country(ip))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.Watch(10*time.Millisecond, stop)
+
+	// Act
+
+	writeTestGeoIP(t, dir, map[string]string{"192.0.2.0/24": "NO"})
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	var observed string
+	for i := 0; i < 100; i++ {
+		if observed = g.Country(ip); observed == "NO" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, "NO", observed)
+}
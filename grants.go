@@ -0,0 +1,149 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Grant temporarily lets a user reach a destination regardless of the ACL,
+// e.g. for exceptions approved until the end of the day.
+type Grant struct {
+	ID uint64 `json:"id"`
+	// User is the authenticated user granted access, or "*" for all
+	// clients.
+	User string `json:"user"`
+	// Host is a host pattern of the destinations granted, see
+	// ResponseHeaderRule.Host for the syntax.
+	Host string `json:"host"`
+	// Port is the port of the destinations granted, any port if zero.
+	Port    int       `json:"port,omitempty"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Grants are the temporary grants overlaying the ACLs of a proxy. Grants
+// allow destinations the ACL denies, but neither blocklisted destinations nor
+// destinations resolving to denied IP ranges. Expired grants are removed.
+type Grants struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	lastID uint64
+	grants []Grant
+}
+
+func (g *Grants) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
+// Add adds grant, whose ID is assigned, and returns it.
+func (g *Grants) Add(grant Grant) Grant {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.lastID++
+	grant.ID = g.lastID
+	g.grants = append(g.removeExpired(), grant)
+	return grant
+}
+
+// Revoke removes the grant id and reports whether it existed.
+func (g *Grants) Revoke(id uint64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, grant := range g.grants {
+		if grant.ID == id {
+			g.grants = append(g.grants[:i], g.grants[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the grants not expired yet, ordered by ID.
+func (g *Grants) List() []Grant {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.grants = g.removeExpired()
+	grants := make([]Grant, len(g.grants))
+	copy(grants, g.grants)
+	sort.Slice(grants, func(i, j int) bool { return grants[i].ID < grants[j].ID })
+	return grants
+}
+
+// removeExpired returns the grants of g not expired yet, reusing the slice.
+func (g *Grants) removeExpired() []Grant {
+	now := g.clock()
+	grants := g.grants[:0]
+	for _, grant := range g.grants {
+		if now.Before(grant.Expires) {
+			grants = append(grants, grant)
+		}
+	}
+	return grants
+}
+
+// find returns the grant letting user reach host and port, if any.
+func (g *Grants) find(user, host string, port int) (Grant, bool) {
+	if g == nil {
+		return Grant{}, false
+	}
+	return g.findAt(user, host, port, g.clock())
+}
+
+// findAt returns the grant letting user reach host and port at now, if any.
+func (g *Grants) findAt(user, host string, port int, now time.Time) (Grant, bool) {
+	if g == nil {
+		return Grant{}, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, grant := range g.grants {
+		if (grant.User == "*" || grant.User == user) &&
+			(grant.Port == 0 || grant.Port == port) &&
+			now.Before(grant.Expires) && matchHostPattern(grant.Host, host) {
+			return grant, true
+		}
+	}
+	return Grant{}, false
+}
+
+// granted reports whether a grant lets the user of ctx reach host and port
+// regardless of the ACL.
+func (p *Proxy) granted(ctx context.Context, host string, port int) bool {
+	user := dialUser(ctx)
+	grant, ok := p.Grants.find(user, host, port)
+	if ok {
+		p.Logger.Info("Destination allowed by grant",
+			zap.Uint64("grant", grant.ID), zap.String("user", user), zap.String("host", host), zap.Int("port", port))
+	}
+	return ok
+}
+
+type dialUserKey struct{}
+
+// withDialUser returns ctx holding the authenticated user dials are made
+// for, if p has grants or canary routes checking it or keeps recent events.
+func (p *Proxy) withDialUser(ctx context.Context, user string) context.Context {
+	if p.Grants == nil && !p.canaryRoutes() && p.Recent == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, dialUserKey{}, user)
+}
+
+// dialUser returns the user of ctx, see withDialUser.
+func dialUser(ctx context.Context) string {
+	user, _ := ctx.Value(dialUserKey{}).(string)
+	return user
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrantsFind(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		givenUser string
+		givenHost string
+		givenPort int
+		expected  uint64
+	}{
+		{name: "User", givenUser: "alice", givenHost: "blocked.example.com", givenPort: 443, expected: 1},
+		{name: "OtherUser", givenUser: "bob", givenHost: "blocked.example.com", givenPort: 443},
+		{name: "OtherPort", givenUser: "alice", givenHost: "blocked.example.com", givenPort: 80},
+		{name: "AllClients", givenHost: "a.example.org", givenPort: 80, expected: 2},
+		{name: "Expired", givenUser: "alice", givenHost: "expired.example.com", givenPort: 443},
+	}
+
+	g := &Grants{now: func() time.Time { return now }}
+	g.Add(Grant{User: "alice", Host: "blocked.example.com", Port: 443, Expires: now.Add(time.Hour)})
+	g.Add(Grant{User: "*", Host: "*.example.org", Expires: now.Add(time.Hour)})
+	g.Add(Grant{User: "alice", Host: "expired.example.com", Expires: now})
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, ok := g.find(tc.givenUser, tc.givenHost, tc.givenPort)
+
+			// Assert
+
+			assert.Equal(t, tc.expected != 0, ok)
+			assert.Equal(t, tc.expected, observed.ID)
+		})
+	}
+}
+
+func TestProxyGrantOverridesACL(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	dest := echoListener.Addr().String()
+
+	rule, err := parseACLRule("deny *")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name           string
+		givenGrant     *Grant
+		expectedStatus int
+	}{
+		{
+			name:           "Denied",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Granted",
+			givenGrant:     &Grant{User: "user", Host: "127.0.0.1", Expires: time.Now().Add(time.Hour)},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "GrantedOtherUser",
+			givenGrant:     &Grant{User: "other", Host: "127.0.0.1", Expires: time.Now().Add(time.Hour)},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProxy()
+			p.AuthUser = "user"
+			p.AuthPass = "pass"
+			p.ACL = &ACL{Rules: []ACLRule{rule}}
+			p.Grants = &Grants{}
+			if tc.givenGrant != nil {
+				p.Grants.Add(*tc.givenGrant)
+			}
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// Act
+
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", dest, dest)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+			require.NoError(t, err)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestAdminGrants(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.Grants = &Grants{}
+	admin := p.AdminHandler()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	// Act
+
+	added := serve(http.MethodPost, "/grants", `{"user":"alice","host":"Blocked.example.com","port":443,"ttl":"2h","reason":"INC-42"}`)
+	invalid := serve(http.MethodPost, "/grants", `{"user":"alice","host":"blocked.example.com"}`)
+	listed := serve(http.MethodGet, "/grants", "")
+	revoked := serve(http.MethodDelete, "/grants/1", "")
+	missing := serve(http.MethodDelete, "/grants/1", "")
+
+	// Assert
+
+	require.Equal(t, http.StatusCreated, added.Code)
+	var grant Grant
+	require.NoError(t, json.Unmarshal(added.Body.Bytes(), &grant))
+	assert.Equal(t, uint64(1), grant.ID)
+	assert.Equal(t, "blocked.example.com", grant.Host)
+	assert.Equal(t, 443, grant.Port)
+	assert.Equal(t, "INC-42", grant.Reason)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), grant.Expires, time.Minute)
+
+	assert.Equal(t, http.StatusBadRequest, invalid.Code)
+
+	require.Equal(t, http.StatusOK, listed.Code)
+	var grants []Grant
+	require.NoError(t, json.Unmarshal(listed.Body.Bytes(), &grants))
+	require.Len(t, grants, 1)
+	assert.Equal(t, grant.ID, grants[0].ID)
+
+	assert.Equal(t, http.StatusNoContent, revoked.Code)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+	assert.Empty(t, p.Grants.List())
+}
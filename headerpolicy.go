@@ -0,0 +1,293 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AnonymityMode decides which headers revealing clients and the proxy are
+// sent with forwarded plain HTTP requests.
+type AnonymityMode string
+
+const (
+	// AnonymityTransparent adds the proxy to the Via header and the client
+	// IP to the X-Forwarded-For header.
+	AnonymityTransparent AnonymityMode = "transparent"
+	// AnonymityAnonymous adds the proxy to the Via header but removes all
+	// headers revealing clients.
+	AnonymityAnonymous AnonymityMode = "anonymous"
+	// AnonymityElite removes all headers revealing clients or proxies, so
+	// requests appear as sent by the proxy itself.
+	AnonymityElite AnonymityMode = "elite"
+)
+
+// ParseAnonymityMode parses the name of an anonymity mode.
+func ParseAnonymityMode(s string) (AnonymityMode, error) {
+	switch mode := AnonymityMode(strings.ToLower(s)); mode {
+	case AnonymityTransparent, AnonymityAnonymous, AnonymityElite:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown anonymity mode %q", s)
+	}
+}
+
+// clientHeaders reveal the clients of proxies, or the addresses of clients
+// announced by earlier proxies.
+var clientHeaders = []string{
+	"Client-Ip",
+	"Forwarded",
+	"True-Client-Ip",
+	"X-Client-Ip",
+	"X-Forwarded-For",
+	"X-Real-Ip",
+}
+
+// proxyHeaders reveal that requests went through proxies.
+var proxyHeaders = []string{
+	"Via",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Server",
+	"X-Proxy-Id",
+}
+
+// HeaderPolicy rewrites the headers of forwarded plain HTTP requests. Policies
+// of the proxy, of listeners and of users apply in that order, each one
+// removing and setting headers after the ones before.
+type HeaderPolicy struct {
+	// Anonymity decides which headers revealing clients and the proxy are
+	// sent. The mode of the most specific policy setting one applies, or
+	// AnonymityTransparent if none does.
+	Anonymity AnonymityMode
+	// Remove are the names of headers removed from requests.
+	Remove []string
+	// Set are headers set in requests, replacing any sent by clients.
+	Set http.Header
+}
+
+// HeaderPolicies are the header policies read from a file, see
+// LoadHeaderPolicies.
+type HeaderPolicies struct {
+	// Default, if set, applies to all requests.
+	Default *HeaderPolicy
+	// Listeners are the policies of the requests received on listeners by
+	// their address.
+	Listeners map[string]*HeaderPolicy
+	// Users are the policies of the requests of users by their name.
+	Users map[string]*HeaderPolicy
+}
+
+// LoadHeaderPolicies reads header policies from the file at path. Each
+// non-empty line not starting with '#' holds a selector, "*" for all
+// requests, "listener=ADDR" or "user=NAME", followed by a directive adding to
+// the policy of the selector: an anonymity mode, the name of a header to
+// remove or a header to set, e.g.:
+//
+//	listener=:3129  anonymity elite
+//	*               anonymity anonymous
+//	user=alice      remove Cookie
+//	user=alice      set X-Team: payments
+func LoadHeaderPolicies(path string) (*HeaderPolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hps := &HeaderPolicies{
+		Listeners: map[string]*HeaderPolicy{},
+		Users:     map[string]*HeaderPolicy{},
+	}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := hps.parse(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return hps, nil
+}
+
+func (hps *HeaderPolicies) parse(line string) error {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("missing directive in %q", line)
+	}
+	selector := fields[0]
+	fields = strings.SplitN(strings.TrimSpace(fields[1]), " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("missing argument in %q", line)
+	}
+	directive, arg := strings.ToLower(fields[0]), strings.TrimSpace(fields[1])
+
+	var hp *HeaderPolicy
+	switch {
+	case selector == "*":
+		if hps.Default == nil {
+			hps.Default = &HeaderPolicy{}
+		}
+		hp = hps.Default
+	case strings.HasPrefix(selector, "listener="):
+		addr := strings.TrimPrefix(selector, "listener=")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("malformed address %q", addr)
+		}
+		hp = hps.Listeners[addr]
+		if hp == nil {
+			hp = &HeaderPolicy{}
+			hps.Listeners[addr] = hp
+		}
+	case strings.HasPrefix(selector, "user="):
+		user := strings.TrimPrefix(selector, "user=")
+		if user == "" {
+			return fmt.Errorf("empty user in %q", line)
+		}
+		hp = hps.Users[user]
+		if hp == nil {
+			hp = &HeaderPolicy{}
+			hps.Users[user] = hp
+		}
+	default:
+		return fmt.Errorf("unknown selector %q", selector)
+	}
+
+	switch directive {
+	case "anonymity":
+		mode, err := ParseAnonymityMode(arg)
+		if err != nil {
+			return err
+		}
+		hp.Anonymity = mode
+	case "remove":
+		name := http.CanonicalHeaderKey(arg)
+		if isHopByHopHeader(name) {
+			return fmt.Errorf("hop-by-hop header %q can not be removed", name)
+		}
+		hp.Remove = append(hp.Remove, name)
+	case "set":
+		c := strings.IndexByte(arg, ':')
+		if c <= 0 {
+			return fmt.Errorf("malformed header %q", arg)
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(arg[:c]))
+		if isHopByHopHeader(name) {
+			return fmt.Errorf("hop-by-hop header %q can not be set", name)
+		}
+		if hp.Set == nil {
+			hp.Set = http.Header{}
+		}
+		hp.Set.Add(name, strings.TrimSpace(arg[c+1:]))
+	default:
+		return fmt.Errorf("unknown directive %q", directive)
+	}
+	return nil
+}
+
+type headerPolicyKey struct{}
+
+func withHeaderPolicy(ctx context.Context, hp *HeaderPolicy) context.Context {
+	if hp == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, headerPolicyKey{}, hp)
+}
+
+// headerPolicyFromContext returns the header policy of ctx, or nil.
+func headerPolicyFromContext(ctx context.Context) *HeaderPolicy {
+	hp, _ := ctx.Value(headerPolicyKey{}).(*HeaderPolicy)
+	return hp
+}
+
+// headerPolicyFor returns the policies of the proxy, the listener of ctx and
+// user merged into one, or nil if none applies.
+func (p *Proxy) headerPolicyFor(ctx context.Context, user string) *HeaderPolicy {
+	var policies []*HeaderPolicy
+	if p.HeaderPolicy != nil {
+		policies = append(policies, p.HeaderPolicy)
+	}
+	if lp := listenerPolicyFromContext(ctx); lp != nil && lp.HeaderPolicy != nil {
+		policies = append(policies, lp.HeaderPolicy)
+	}
+	if hp := p.UserHeaderPolicies[user]; hp != nil && user != "" {
+		policies = append(policies, hp)
+	}
+	switch len(policies) {
+	case 0:
+		return nil
+	case 1:
+		return policies[0]
+	}
+
+	merged := &HeaderPolicy{Set: http.Header{}}
+	for _, hp := range policies {
+		if hp.Anonymity != "" {
+			merged.Anonymity = hp.Anonymity
+		}
+		for _, name := range hp.Remove {
+			merged.Set.Del(name)
+			merged.Remove = append(merged.Remove, name)
+		}
+		for name, values := range hp.Set {
+			merged.Set[name] = values
+		}
+	}
+	return merged
+}
+
+// mode returns the anonymity mode of hp, which may be nil.
+func (hp *HeaderPolicy) mode() AnonymityMode {
+	if hp == nil || hp.Anonymity == "" {
+		return AnonymityTransparent
+	}
+	return hp.Anonymity
+}
+
+// apply removes the headers revealing clients and proxies its mode does not
+// send from h, and then the headers of Remove, and sets the ones of Set.
+func (hp *HeaderPolicy) apply(h http.Header) {
+	switch hp.mode() {
+	case AnonymityAnonymous:
+		deleteHeaders(h, clientHeaders)
+	case AnonymityElite:
+		deleteHeaders(h, clientHeaders)
+		deleteHeaders(h, proxyHeaders)
+	}
+	if hp == nil {
+		return
+	}
+	deleteHeaders(h, hp.Remove)
+	for name, values := range hp.Set {
+		h[name] = append([]string(nil), values...)
+	}
+}
+
+// forwarded adds the headers of the proxy to h of a request received with
+// the given protocol version, and reports whether the client IP is to be
+// added to X-Forwarded-For.
+func (hp *HeaderPolicy) forwarded(h http.Header, protoMajor, protoMinor int) bool {
+	mode := hp.mode()
+	if mode != AnonymityElite {
+		addVia(h, protoMajor, protoMinor)
+	}
+	return mode == AnonymityTransparent
+}
+
+func deleteHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		h.Del(name)
+	}
+}
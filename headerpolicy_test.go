@@ -0,0 +1,184 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHeaderPolicies(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenLines    string
+		expected      *HeaderPolicies
+		expectedError bool
+	}{
+		{
+			name: "Valid",
+			givenLines: "# Hide clients\n* anonymity Anonymous\n\nlistener=:3129 anonymity elite\n" +
+				"user=alice remove cookie\nuser=alice  set X-Team: payments\n",
+			expected: &HeaderPolicies{
+				Default:   &HeaderPolicy{Anonymity: AnonymityAnonymous},
+				Listeners: map[string]*HeaderPolicy{":3129": {Anonymity: AnonymityElite}},
+				Users: map[string]*HeaderPolicy{"alice": {
+					Remove: []string{"Cookie"},
+					Set:    http.Header{"X-Team": {"payments"}},
+				}},
+			},
+		},
+		{name: "UnknownMode", givenLines: "* anonymity invisible\n", expectedError: true},
+		{name: "UnknownSelector", givenLines: "group=admins remove Cookie\n", expectedError: true},
+		{name: "MalformedAddress", givenLines: "listener=3129 anonymity elite\n", expectedError: true},
+		{name: "MalformedHeader", givenLines: "user=alice set X-Team\n", expectedError: true},
+		{name: "HopByHopHeader", givenLines: "* remove Connection\n", expectedError: true},
+		{name: "MissingArgument", givenLines: "* anonymity\n", expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			f, err := ioutil.TempFile("", "headerpolicies")
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.WriteString(tc.givenLines)
+			require.NoError(t, err)
+
+			// Act
+
+			observed, err := LoadHeaderPolicies(f.Name())
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestHeaderPolicyFor(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.HeaderPolicy = &HeaderPolicy{
+		Anonymity: AnonymityAnonymous,
+		Set:       http.Header{"X-Env": {"prod"}, "X-Team": {"platform"}},
+	}
+	p.UserHeaderPolicies = map[string]*HeaderPolicy{
+		"alice": {Remove: []string{"X-Env"}, Set: http.Header{"X-Team": {"payments"}}},
+	}
+	ctx := withListenerPolicy(context.Background(), &ListenerPolicy{HeaderPolicy: &HeaderPolicy{Anonymity: AnonymityElite}})
+
+	// Act
+
+	observed := p.headerPolicyFor(ctx, "alice")
+	anonymous := p.headerPolicyFor(context.Background(), "bob")
+
+	// Assert
+
+	assert.Equal(t, &HeaderPolicy{
+		Anonymity: AnonymityElite,
+		Remove:    []string{"X-Env"},
+		Set:       http.Header{"X-Team": {"payments"}},
+	}, observed)
+	assert.Equal(t, p.HeaderPolicy, anonymous)
+}
+
+func TestProxyHeaderPolicy(t *testing.T) {
+	cases := []struct {
+		name                string
+		givenPolicy         *HeaderPolicy
+		expectedVia         string
+		expectedForwardedIP string
+		expectedRealIP      string
+		expectedTeam        string
+	}{
+		{
+			name:                "Transparent",
+			expectedVia:         "1.0 cache, 1.1 forwardingproxy",
+			expectedForwardedIP: "192.0.2.1, 127.0.0.1",
+			expectedRealIP:      "192.0.2.1",
+			expectedTeam:        "spoofed",
+		},
+		{
+			name:         "Anonymous",
+			givenPolicy:  &HeaderPolicy{Anonymity: AnonymityAnonymous},
+			expectedVia:  "1.0 cache, 1.1 forwardingproxy",
+			expectedTeam: "spoofed",
+		},
+		{
+			name:         "Elite",
+			givenPolicy:  &HeaderPolicy{Anonymity: AnonymityElite},
+			expectedTeam: "spoofed",
+		},
+		{
+			name: "Custom",
+			givenPolicy: &HeaderPolicy{
+				Anonymity: AnonymityElite,
+				Remove:    []string{"X-Real-Ip"},
+				Set:       http.Header{"X-Team": {"payments"}},
+			},
+			expectedTeam: "payments",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			// Destination server
+
+			received := make(chan http.Header, 1)
+			destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}))
+			defer destServer.Close()
+
+			// Proxy server
+
+			p := newTestProxy()
+			p.HeaderPolicy = tc.givenPolicy
+			p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+			p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			proxyServerURL, err := url.Parse(proxyServer.URL)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyServerURL)}}
+
+			req, err := http.NewRequest(http.MethodGet, destServer.URL, nil)
+			require.NoError(t, err)
+			req.Header.Set("Via", "1.0 cache")
+			req.Header.Set("X-Forwarded-For", "192.0.2.1")
+			req.Header.Set("X-Real-Ip", "192.0.2.1")
+			req.Header.Set("X-Team", "spoofed")
+
+			// Act
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			// Assert
+
+			header := <-received
+			assert.Equal(t, tc.expectedVia, header.Get("Via"))
+			assert.Equal(t, tc.expectedForwardedIP, header.Get("X-Forwarded-For"))
+			assert.Equal(t, tc.expectedRealIP, header.Get("X-Real-Ip"))
+			assert.Equal(t, tc.expectedTeam, header.Get("X-Team"))
+		})
+	}
+}
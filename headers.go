@@ -0,0 +1,127 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// hopByHopHeaders are the headers which are meaningful only for a single
+// transport-level connection and must not be forwarded by proxies.
+//
+// See: https://tools.ietf.org/html/rfc7230#section-6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ResponseHeaderRule injects Header into responses of plain HTTP requests
+// whose destination host matches Host.
+type ResponseHeaderRule struct {
+	// Host is either an exact host name, a wildcard pattern such as
+	// "*.example.com" matching all subdomains, or "*" matching any host.
+	Host   string
+	Header http.Header
+}
+
+// LoadResponseHeaderRules reads response header rules from the file at path.
+// Each non-empty line not starting with '#' holds a host pattern followed by
+// a header, e.g.:
+//
+//	*.example.com X-Corp-Proxy: traffic is monitored
+func LoadResponseHeaderRules(path string) ([]ResponseHeaderRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ResponseHeaderRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseResponseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseResponseHeaderRule(line string) (ResponseHeaderRule, error) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return ResponseHeaderRule{}, fmt.Errorf("missing header in rule %q", line)
+	}
+	host, header := fields[0], strings.TrimSpace(fields[1])
+	c := strings.IndexByte(header, ':')
+	if c <= 0 {
+		return ResponseHeaderRule{}, fmt.Errorf("malformed header %q", header)
+	}
+	name := http.CanonicalHeaderKey(strings.TrimSpace(header[:c]))
+	if isHopByHopHeader(name) {
+		return ResponseHeaderRule{}, fmt.Errorf("hop-by-hop header %q can not be injected", name)
+	}
+	h := http.Header{}
+	h.Add(name, strings.TrimSpace(header[c+1:]))
+	return ResponseHeaderRule{Host: strings.ToLower(host), Header: h}, nil
+}
+
+// injectResponseHeaders adds the headers of all rules matching host to h.
+func injectResponseHeaders(rules []ResponseHeaderRule, host string, h http.Header) {
+	for _, rule := range rules {
+		if !matchHostPattern(rule.Host, host) {
+			continue
+		}
+		for name, values := range rule.Header {
+			for _, v := range values {
+				h.Add(name, v)
+			}
+		}
+	}
+}
+
+// matchHostPattern reports whether host, optionally including a port,
+// matches pattern. See ResponseHeaderRule.Host for the pattern syntax.
+func matchHostPattern(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return host == pattern
+	}
+}
+
+func isHopByHopHeader(name string) bool {
+	for _, h := range hopByHopHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name          string
+		givenPattern  string
+		givenHost     string
+		expectedMatch bool
+	}{
+		{
+			name:          "Exact",
+			givenPattern:  "example.com",
+			givenHost:     "example.com",
+			expectedMatch: true,
+		},
+		{
+			name:          "ExactWithPort",
+			givenPattern:  "example.com",
+			givenHost:     "Example.COM:8080",
+			expectedMatch: true,
+		},
+		{
+			name:          "ExactMismatch",
+			givenPattern:  "example.com",
+			givenHost:     "www.example.com",
+			expectedMatch: false,
+		},
+		{
+			name:          "Wildcard",
+			givenPattern:  "*.example.com",
+			givenHost:     "a.b.example.com",
+			expectedMatch: true,
+		},
+		{
+			name:          "WildcardApex",
+			givenPattern:  "*.example.com",
+			givenHost:     "example.com",
+			expectedMatch: false,
+		},
+		{
+			name:          "WildcardSuffixOnly",
+			givenPattern:  "*.example.com",
+			givenHost:     "badexample.com",
+			expectedMatch: false,
+		},
+		{
+			name:          "Any",
+			givenPattern:  "*",
+			givenHost:     "127.0.0.1:80",
+			expectedMatch: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedMatch := matchHostPattern(tc.givenPattern, tc.givenHost)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedMatch, observedMatch)
+		})
+	}
+}
+
+func TestParseResponseHeaderRule(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name          string
+		givenLine     string
+		expectedRule  ResponseHeaderRule
+		expectedError bool
+	}{
+		{
+			name:      "Valid",
+			givenLine: "*.Example.com x-corp-proxy:  monitored ",
+			expectedRule: ResponseHeaderRule{
+				Host:   "*.example.com",
+				Header: http.Header{"X-Corp-Proxy": {"monitored"}},
+			},
+		},
+		{
+			name:          "MissingHeader",
+			givenLine:     "example.com",
+			expectedError: true,
+		},
+		{
+			name:          "MalformedHeader",
+			givenLine:     "example.com X-Corp-Proxy",
+			expectedError: true,
+		},
+		{
+			name:          "HopByHopHeader",
+			givenLine:     "example.com connection: close",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedRule, err := parseResponseHeaderRule(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRule, observedRule)
+		})
+	}
+}
+
+func TestForwardingHTTPProxyInjectsResponseHeaders(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Origin", "origin")
+	}))
+	defer destServer.Close()
+
+	destServerURL, err := url.Parse(destServer.URL)
+	require.NoError(t, err)
+
+	// Proxy server
+
+	rules := []ResponseHeaderRule{
+		{Host: "*", Header: http.Header{"X-Corp-Proxy": {"monitored"}}},
+		{Host: destServerURL.Hostname(), Header: http.Header{"X-Origin": {"proxy"}}},
+		{Host: "*.example.com", Header: http.Header{"X-Unrelated": {"value"}}},
+	}
+	proxyServer := httptest.NewServer(NewForwardingHTTPProxy(nil, rules))
+	defer proxyServer.Close()
+
+	proxyServerURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyServerURL),
+		},
+	}
+
+	// Act
+
+	resp, err := client.Get(destServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Assert
+
+	assert.Equal(t, "monitored", resp.Header.Get("X-Corp-Proxy"))
+	assert.Equal(t, []string{"origin", "proxy"}, resp.Header["X-Origin"])
+	assert.Empty(t, resp.Header.Get("X-Unrelated"))
+	assert.Empty(t, resp.Header.Get("X-Internal"))
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// ClientInfo describes the client of a request or tunnel passed to hooks.
+type ClientInfo struct {
+	// Addr is the IP address of the client.
+	Addr string
+	// User is the authenticated user, or "" if authentication is disabled.
+	User string
+	// Metadata is the metadata sent by SOCKS clients, if any.
+	Metadata map[string]string
+}
+
+// Hooks are extension points into the life cycle of plain HTTP requests and
+// tunnels, e.g. to implement custom policies, billing or tracing without
+// modifying the proxy. All hooks are optional and must be safe for
+// concurrent use.
+//
+// The quotas of EgressBudget and UserPolicies, the per-user destination and
+// app policies, Accounting and DebugCaptures are hooks themselves, which run ahead of
+// Proxy.Hooks. The ACL is checked when dialing destinations instead, as its
+// rules on IP ranges need the resolved addresses.
+type Hooks struct {
+	// OnConnect is called for every plain HTTP request and tunnel once the
+	// client is authenticated, before target, the host and port of the
+	// destination, is dialed. Returning an error refuses the request or
+	// tunnel, see RefusalError.
+	OnConnect func(ctx context.Context, client ClientInfo, target string) error
+	// OnTunnelEstablished is called once the tunnel to target is
+	// established, before any data is relayed.
+	OnTunnelEstablished func(ctx context.Context, client ClientInfo, target string)
+	// OnTunnelClosed is called once a tunnel is closed, with the stats also
+	// recorded in the access log.
+	OnTunnelClosed func(ctx context.Context, stats AccessRecord)
+}
+
+// RefusalError is returned by OnConnect hooks to refuse HTTP clients with
+// StatusCode, answered with the status text only. Other errors refuse HTTP
+// clients with 403 Forbidden and the error message. SOCKS clients are
+// refused with a "connection not allowed" reply either way.
+type RefusalError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *RefusalError) Error() string {
+	return e.Err.Error()
+}
+
+// hookLists returns the built-in hooks followed by Hooks.
+func (p *Proxy) hookLists() [2][]Hooks {
+	p.hooksOnce.Do(func() {
+		p.builtinHooks = []Hooks{
+			{OnConnect: p.checkQuota},
+			{OnConnect: p.checkUserPolicy},
+			{OnTunnelClosed: p.Accounting.record},
+			{OnTunnelEstablished: p.captureTunnelEstablished, OnTunnelClosed: p.captureTunnelClosed},
+		}
+	})
+	return [2][]Hooks{p.builtinHooks, p.Hooks}
+}
+
+// onConnect calls the OnConnect hooks until one refuses the request or
+// tunnel of client to target.
+func (p *Proxy) onConnect(ctx context.Context, client ClientInfo, target string) error {
+	for _, hooks := range p.hookLists() {
+		for _, h := range hooks {
+			if h.OnConnect == nil {
+				continue
+			}
+			if err := h.OnConnect(ctx, client, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// onTunnelEstablished calls the OnTunnelEstablished hooks.
+func (p *Proxy) onTunnelEstablished(ctx context.Context, client ClientInfo, target string) {
+	for _, hooks := range p.hookLists() {
+		for _, h := range hooks {
+			if h.OnTunnelEstablished != nil {
+				h.OnTunnelEstablished(ctx, client, target)
+			}
+		}
+	}
+}
+
+// onTunnelClosed calls the OnTunnelClosed hooks.
+func (p *Proxy) onTunnelClosed(ctx context.Context, stats AccessRecord) {
+	for _, hooks := range p.hookLists() {
+		for _, h := range hooks {
+			if h.OnTunnelClosed != nil {
+				h.OnTunnelClosed(ctx, stats)
+			}
+		}
+	}
+}
+
+// connectHTTP calls the OnConnect hooks for the request r of user to target
+// and answers r if a hook refuses it. It reports whether r may proceed.
+func (p *Proxy) connectHTTP(w http.ResponseWriter, r *http.Request, user, target string) bool {
+	client := ClientInfo{Addr: clientIP(requestAddr(r.RemoteAddr)), User: user}
+	err := p.onConnect(r.Context(), client, target)
+	if err == nil {
+		return true
+	}
+	if re, ok := err.(*RefusalError); ok {
+		http.Error(w, http.StatusText(re.StatusCode), re.StatusCode)
+	} else {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHooks(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	var mu sync.Mutex
+	var established []string
+	var closed []AccessRecord
+	p := newTestProxy()
+	p.Hooks = []Hooks{{
+		OnConnect: func(ctx context.Context, client ClientInfo, target string) error {
+			switch target {
+			case "billing.example.com:443":
+				return &RefusalError{StatusCode: http.StatusPaymentRequired, Err: errors.New("not paid")}
+			case "secret.example.com:443":
+				return errors.New("secret destination")
+			}
+			return nil
+		},
+		OnTunnelEstablished: func(ctx context.Context, client ClientInfo, target string) {
+			mu.Lock()
+			defer mu.Unlock()
+			established = append(established, client.Addr+" "+target)
+		},
+		OnTunnelClosed: func(ctx context.Context, stats AccessRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, stats)
+		},
+	}}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	connect := func(target string) (net.Conn, *bufio.Reader, int) {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		return conn, br, resp.StatusCode
+	}
+
+	// Act
+
+	conn, br, status := connect(destAddr)
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	conn.Close()
+	refused, _, refusedStatus := connect("billing.example.com:443")
+	refused.Close()
+	denied, _, deniedStatus := connect("secret.example.com:443")
+	denied.Close()
+
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(closed)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusPaymentRequired, refusedStatus)
+	assert.Equal(t, http.StatusForbidden, deniedStatus)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"127.0.0.1 " + destAddr}, established)
+	require.Len(t, closed, 1)
+	assert.Equal(t, destAddr, closed[0].Destination)
+	assert.Equal(t, int64(4), closed[0].BytesUp)
+	assert.Equal(t, int64(4), closed[0].BytesDown)
+}
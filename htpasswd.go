@@ -0,0 +1,413 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	htpasswdAPR1Prefix   = "$apr1$"
+	htpasswdSHAPrefix    = "{SHA}"
+	htpasswdSHA256Prefix = "$5$"
+	htpasswdSHA512Prefix = "$6$"
+)
+
+// htpasswdDummyHash is the bcrypt hash of a random password, which unknown
+// users are checked against, so they take as long to authenticate as known
+// users and user names can not be probed by timing.
+const htpasswdDummyHash = "$2y$05$2ZXBz2PVywkqQFAH3xund.G8COqpuZmhnTD0cqc814TnisqfcU0oC"
+
+// htpasswdBcryptPrefixes are the prefixes of bcrypt hashes, "$2y$" as created
+// by htpasswd -B.
+var htpasswdBcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+// HtpasswdAuthenticator authenticates clients against the users of an
+// htpasswd file. Passwords hashed with Apache's MD5 ("$apr1$", the default of
+// htpasswd), SHA-1 ("{SHA}"), SHA-256 or SHA-512 crypt ("$5$" and "$6$", as
+// created by htpasswd -2 and -5 or mkpasswd) and bcrypt ("$2y$", as created by
+// htpasswd -B) are supported.
+type HtpasswdAuthenticator struct {
+	path string
+
+	mu      sync.RWMutex
+	hashes  map[string]string
+	modTime time.Time
+}
+
+// LoadHtpasswd reads the users and password hashes of the htpasswd file at
+// path. Lines starting with '#' are ignored.
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &HtpasswdAuthenticator{path: path, hashes: map[string]string{}, modTime: fi.ModTime()}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c := strings.IndexByte(line, ':')
+		if c <= 0 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, n)
+		}
+		user, hash := line[:c], line[c+1:]
+		if !supportedHtpasswdHash(hash) {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash of user %q", path, n, user)
+		}
+		a.hashes[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload replaces the users of a with the users of the htpasswd file at
+// path, which is watched from then on. If reading the file fails, the current
+// users and file are kept.
+func (a *HtpasswdAuthenticator) Reload(path string) error {
+	loaded, err := LoadHtpasswd(path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.path, a.hashes, a.modTime = path, loaded.hashes, loaded.modTime
+	return nil
+}
+
+// Watch checks the htpasswd file a was last loaded from for changes every
+// interval until stop is closed, and reloads it once it changed, so users can
+// be added and passwords changed without a restart.
+func (a *HtpasswdAuthenticator) Watch(logger *zap.Logger, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		a.mu.RLock()
+		path, modTime := a.path, a.modTime
+		a.mu.RUnlock()
+		fi, err := os.Stat(path)
+		if err != nil {
+			logger.Warn("Checking htpasswd file for changes failed", zap.Error(err))
+			continue
+		}
+		if fi.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := a.Reload(path); err != nil {
+			logger.Error("Reloading htpasswd file failed", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		logger.Info("Htpasswd file reloaded", zap.String("path", path))
+	}
+}
+
+// Authenticate implements Authenticator.
+func (a *HtpasswdAuthenticator) Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error) {
+	a.mu.RLock()
+	hash, ok := a.hashes[user]
+	a.mu.RUnlock()
+	if !ok {
+		checkHtpasswd(pass, htpasswdDummyHash)
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	if !checkHtpasswd(pass, hash) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: user}, nil
+}
+
+func supportedHtpasswdHash(hash string) bool {
+	for _, prefix := range []string{htpasswdAPR1Prefix, htpasswdSHAPrefix, htpasswdSHA256Prefix, htpasswdSHA512Prefix} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return isBcryptHash(hash)
+}
+
+func isBcryptHash(hash string) bool {
+	for _, prefix := range htpasswdBcryptPrefixes {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHtpasswd reports whether password matches hash, comparing them in
+// constant time.
+func checkHtpasswd(password, hash string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(htpasswdHash(password, hash)), []byte(hash)) == 1
+}
+
+// htpasswdHash returns the hash of password with the scheme and salt of hash.
+func htpasswdHash(password, hash string) string {
+	switch {
+	case strings.HasPrefix(hash, htpasswdSHAPrefix):
+		sum := sha1.Sum([]byte(password))
+		return htpasswdSHAPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, htpasswdSHA256Prefix):
+		return shaCrypt(sha256.New, htpasswdSHA256Prefix, sha256CryptOrder, password, strings.TrimPrefix(hash, htpasswdSHA256Prefix))
+	case strings.HasPrefix(hash, htpasswdSHA512Prefix):
+		return shaCrypt(sha512.New, htpasswdSHA512Prefix, sha512CryptOrder, password, strings.TrimPrefix(hash, htpasswdSHA512Prefix))
+	default:
+		salt := strings.TrimPrefix(hash, htpasswdAPR1Prefix)
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		return apr1(password, salt)
+	}
+}
+
+// apr1Alphabet is the alphabet of the base64 variant of crypt(3) hashes.
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 returns the Apache MD5 hash of password with salt.
+//
+// See: https://httpd.apache.org/docs/2.4/misc/password_encryptions.html
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(htpasswdAPR1Prefix + salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	// The rounds only slow down brute forcing.
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	b := []byte(htpasswdAPR1Prefix + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b = append(b, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return string(b)
+}
+
+const (
+	shaCryptRoundsPrefix  = "rounds="
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+// sha256CryptOrder and sha512CryptOrder are the orders in which the bytes of
+// the final digests of SHA-256 and SHA-512 crypt are encoded, three bytes at a
+// time.
+var (
+	sha256CryptOrder = []int{
+		20, 10, 0, 11, 1, 21, 2, 22, 12, 23, 13, 3, 14, 4, 24, 5, 25, 15,
+		26, 16, 6, 17, 7, 27, 8, 28, 18, 29, 19, 9, 30, 31,
+	}
+	sha512CryptOrder = []int{
+		42, 21, 0, 1, 43, 22, 23, 2, 44, 45, 24, 3, 4, 46, 25, 26, 5, 47,
+		48, 27, 6, 7, 49, 28, 29, 8, 50, 51, 30, 9, 10, 52, 31, 32, 11, 53,
+		54, 33, 12, 13, 55, 34, 35, 14, 56, 57, 36, 15, 16, 58, 37, 38, 17, 59,
+		60, 39, 18, 19, 61, 40, 41, 20, 62, 63,
+	}
+)
+
+// shaCrypt returns the SHA-256 or SHA-512 crypt hash of password with the
+// settings of hash, the rounds, if given, and the salt following prefix.
+//
+// See: https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(newHash func() hash.Hash, prefix string, order []int, password, settings string) string {
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if strings.HasPrefix(settings, shaCryptRoundsPrefix) {
+		if i := strings.IndexByte(settings, '$'); i >= 0 {
+			if n, err := strconv.Atoi(settings[len(shaCryptRoundsPrefix):i]); err == nil {
+				rounds, customRounds = n, true
+				if rounds < shaCryptMinRounds {
+					rounds = shaCryptMinRounds
+				} else if rounds > shaCryptMaxRounds {
+					rounds = shaCryptMaxRounds
+				}
+				settings = settings[i+1:]
+			}
+		}
+	}
+	salt := settings
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	pw, sb := []byte(password), []byte(salt)
+
+	// repeat returns n bytes of sum repeated.
+	repeat := func(sum []byte, n int) []byte {
+		b := make([]byte, 0, n)
+		for len(b)+len(sum) <= n {
+			b = append(b, sum...)
+		}
+		return append(b, sum[:n-len(b)]...)
+	}
+
+	alt := newHash()
+	alt.Write(pw)
+	alt.Write(sb)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := newHash()
+	h.Write(pw)
+	h.Write(sb)
+	h.Write(repeat(altSum, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(altSum)
+		} else {
+			h.Write(pw)
+		}
+	}
+	sum := h.Sum(nil)
+
+	dp := newHash()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeat(dp.Sum(nil), len(pw))
+
+	ds := newHash()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(sb)
+	}
+	s := repeat(ds.Sum(nil), len(sb))
+
+	// The rounds only slow down brute forcing.
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(p)
+		}
+		sum = h.Sum(nil)
+	}
+
+	b := []byte(prefix)
+	if customRounds {
+		b = append(b, shaCryptRoundsPrefix+strconv.Itoa(rounds)+"$"...)
+	}
+	b = append(b, salt+"$"...)
+	for i := 0; i < len(order); i += 3 {
+		// The last group holds the remaining one or two bytes.
+		end := i + 3
+		if end > len(order) {
+			end = len(order)
+		}
+		var v uint
+		n := 0
+		for _, j := range order[i:end] {
+			v |= uint(sum[j]) << uint(8*n)
+			n++
+		}
+		for n++; n > 0; n-- {
+			b = append(b, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,263 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAPR1(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name         string
+		givenPass    string
+		givenSalt    string
+		expectedHash string
+	}{
+		{
+			name:         "Short",
+			givenPass:    "myPassword",
+			givenSalt:    "r31.....",
+			expectedHash: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+		},
+		{
+			name:         "SpecialCharacters",
+			givenPass:    "p@ss:w0rd",
+			givenSalt:    "abcdefgh",
+			expectedHash: "$apr1$abcdefgh$MbEluLWKUabdhHWRIScTG.",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedHash := apr1(tc.givenPass, tc.givenSalt)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedHash, observedHash)
+		})
+	}
+}
+
+func TestSHACrypt(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name         string
+		givenHash    string
+		expectedHash string
+	}{
+		{
+			name:         "SHA256",
+			givenHash:    "$5$saltstring",
+			expectedHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		},
+		{
+			name:         "SHA512",
+			givenHash:    "$6$saltstring",
+			expectedHash: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			name:         "RoundsAndLongSalt",
+			givenHash:    "$5$rounds=10000$saltstringsaltstring",
+			expectedHash: "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+		},
+		{
+			name:         "MinimumRounds",
+			givenHash:    "$6$rounds=10$roundstoolow",
+			expectedHash: "$6$rounds=1000$roundstoolow$VTiyBzzTJoDUzG2edg6tTfnH44buhC6xQa2y1SRnr1w/dVOBbXKE612uZFeIlMGZ8MgLiap2x5mD5IOra0fN00",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedHash := htpasswdHash("Hello world!", tc.givenHash)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedHash, observedHash)
+		})
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	// Arrange
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("# Users\nmd5:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\nsha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"sha512:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n" +
+		"bcrypt:$2y$05$tNzFsYfNzM3GToHSrz1DkusUOGi.ZCSyXC/TDwR0bbRi8hYmfoJY2\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := LoadHtpasswd(f.Name())
+	require.NoError(t, err)
+
+	cases := []struct {
+		name          string
+		givenUser     string
+		givenPass     string
+		expectedError error
+	}{
+		{
+			name:      "MD5",
+			givenUser: "md5",
+			givenPass: "myPassword",
+		},
+		{
+			name:      "SHA",
+			givenUser: "sha",
+			givenPass: "secret",
+		},
+		{
+			name:      "SHA512Crypt",
+			givenUser: "sha512",
+			givenPass: "Hello world!",
+		},
+		{
+			name:      "Bcrypt",
+			givenUser: "bcrypt",
+			givenPass: "myPassword",
+		},
+		{
+			name:          "InvalidBcryptPass",
+			givenUser:     "bcrypt",
+			givenPass:     "secret",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "InvalidPass",
+			givenUser:     "md5",
+			givenPass:     "secret",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "UnknownUser",
+			givenUser:     "unknown",
+			givenPass:     "secret",
+			expectedError: ErrInvalidCredentials,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedIdentity, err := a.Authenticate(context.Background(), tc.givenUser, tc.givenPass, nil)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, err)
+			if err == nil {
+				assert.Equal(t, Identity{User: tc.givenUser}, observedIdentity)
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswdUnsupportedHash(t *testing.T) {
+	// Arrange
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("crypt:rqXexS6ZhobKA\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Act
+
+	_, err = LoadHtpasswd(f.Name())
+
+	// Assert
+
+	assert.Error(t, err)
+}
+
+func TestHtpasswdWatch(t *testing.T) {
+	// Arrange
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := LoadHtpasswd(f.Name())
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.Watch(zap.NewNop(), 10*time.Millisecond, stop)
+
+	// Act
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("md5:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n"), 0600))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(f.Name(), later, later))
+
+	// Assert
+
+	authenticate := func() error {
+		_, err := a.Authenticate(context.Background(), "md5", "myPassword", nil)
+		return err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for authenticate() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, authenticate())
+	_, err = a.Authenticate(context.Background(), "sha", "secret", nil)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestHtpasswdWatchReloadedPath(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	require.NoError(t, ioutil.WriteFile(oldPath, []byte("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(newPath, []byte("md5:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n"), 0600))
+
+	a, err := LoadHtpasswd(oldPath)
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.Watch(zap.NewNop(), 10*time.Millisecond, stop)
+
+	// Act
+
+	require.NoError(t, a.Reload(newPath))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(newPath, later, later))
+	time.Sleep(100 * time.Millisecond)
+
+	// Assert
+
+	_, err = a.Authenticate(context.Background(), "md5", "myPassword", nil)
+	assert.NoError(t, err, "the reloaded file is watched instead of the one loaded first")
+	_, err = a.Authenticate(context.Background(), "sha", "secret", nil)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// errStreamingUnsupported is returned by acceptStream if responses can not be
+// flushed.
+var errStreamingUnsupported = errors.New("streaming not supported")
+
+// streamConn is the client side of a tunnel over an HTTP/2 stream, which,
+// unlike an HTTP/1 connection, can not be hijacked.
+type streamConn struct {
+	net.Conn
+	remote requestAddr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// requestAddr is the remote address of a request.
+type requestAddr string
+
+func (requestAddr) Network() string  { return "tcp" }
+func (a requestAddr) String() string { return string(a) }
+
+// acceptStream answers the HTTP/2 CONNECT request r and returns the client
+// side of its tunnel, reading from the request body and writing to the
+// response, which is flushed after every write. The handler of r must call
+// wait before returning, which returns once conn is closed, as the response
+// must not be written to afterwards.
+func (p *Proxy) acceptStream(w http.ResponseWriter, r *http.Request) (conn net.Conn, wait func(), err error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, nil, errStreamingUnsupported
+	}
+	if p.ProxyAgent != "" {
+		w.Header().Set("Proxy-Agent", p.ProxyAgent)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The tunnel uses one end of a pipe, which supports deadlines unlike
+	// the stream, while the other end is copied from the request body and
+	// to the response. Either copy ending closes the pipe, ending the
+	// tunnel.
+	local, remote := net.Pipe()
+	upstreamDone := make(chan struct{})
+	downstreamDone := make(chan struct{})
+	go func() {
+		defer close(upstreamDone)
+		_, _ = io.Copy(remote, r.Body)
+		_ = remote.Close()
+	}()
+	go func() {
+		defer close(downstreamDone)
+		b := make([]byte, 32*1024)
+		for {
+			n, err := remote.Read(b)
+			if n > 0 {
+				if _, werr := w.Write(b[:n]); werr != nil {
+					break
+				}
+				flusher.Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		_ = remote.Close()
+	}()
+
+	wait = func() {
+		<-downstreamDone
+		_ = r.Body.Close()
+		<-upstreamDone
+	}
+	return &streamConn{Conn: local, remote: requestAddr(r.RemoteAddr)}, wait, nil
+}
+
+// relayStream relays the tunnel of the HTTP/2 CONNECT request r to destConn
+// until the tunnel is closed.
+func (p *Proxy) relayStream(w http.ResponseWriter, r *http.Request, destConn net.Conn, host, user string, userTunnel *userTunnel) {
+	clientConn, wait, err := p.acceptStream(w, r)
+	if err != nil {
+		p.Logger.Error("Streaming not supported")
+		_ = destConn.Close()
+		userTunnel.close()
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	defer wait()
+
+	if p.checksSNI() {
+		hello, err := p.checkTunnelSNI(clientConn, clientConn, host, user)
+		if err != nil {
+			p.captureTunnelRefused(r.Context(), clientIP(requestAddr(r.RemoteAddr)), user, host, err)
+			_ = clientConn.Close()
+			_ = destConn.Close()
+			userTunnel.close()
+			return
+		}
+		clientConn = &bufferedConn{Conn: clientConn, r: io.MultiReader(bytes.NewReader(hello), clientConn)}
+	}
+	if err = p.sendProxyHeader(destConn, clientConn.RemoteAddr()); err != nil {
+		p.Logger.Error("Writing PROXY protocol header failed", zap.Error(err))
+		_ = clientConn.Close()
+		_ = destConn.Close()
+		userTunnel.close()
+		return
+	}
+
+	p.relay(r.Context(), clientConn, destConn, host, user, nil, userTunnel, p.tunnelTimeouts(r))
+}
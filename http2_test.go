@@ -0,0 +1,73 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamRecorder is a ResponseWriter of an HTTP/2 stream, which can be
+// flushed but not hijacked. The response body is written to w.
+type streamRecorder struct {
+	header  http.Header
+	code    int
+	w       io.Writer
+	flushes int32
+}
+
+func (r *streamRecorder) Header() http.Header         { return r.header }
+func (r *streamRecorder) WriteHeader(code int)        { r.code = code }
+func (r *streamRecorder) Write(b []byte) (int, error) { return r.w.Write(b) }
+func (r *streamRecorder) Flush()                      { atomic.AddInt32(&r.flushes, 1) }
+
+func TestProxyConnectHTTP2(t *testing.T) {
+	// Arrange
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+
+	p := newTestProxy()
+	p.ProxyAgent = "forwardingproxy"
+
+	bodyReader, bodyWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	req := httptest.NewRequest(http.MethodConnect, destListener.Addr().String(), bodyReader)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	w := &streamRecorder{header: http.Header{}, w: respWriter}
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		p.ServeHTTP(w, req)
+	}()
+
+	// Act
+
+	_, err := bodyWriter.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(respReader, echoed)
+	require.NoError(t, err)
+	bodyWriter.Close()
+	<-served
+	// The tunnel is accounted for once both directions ended.
+	for i := 0; i < 100 && len(p.tunnels.list()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, "forwardingproxy", w.header.Get("Proxy-Agent"))
+	assert.Equal(t, "hello", string(echoed))
+	assert.True(t, atomic.LoadInt32(&w.flushes) >= 2, "response is flushed after the status and every write")
+	assert.Empty(t, p.tunnels.list(), "tunnel is closed once the client ended the stream")
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentitySignerApply(t *testing.T) {
+	// Arrange
+
+	now := time.Unix(1528000000, 0)
+	s := &IdentitySigner{
+		Header: "X-Proxy-Identity",
+		Key:    []byte("secret"),
+		Hosts:  []string{"*.internal.example.com"},
+		Issuer: "forwardingproxy",
+		TTL:    time.Minute,
+		now:    func() time.Time { return now },
+	}
+
+	cases := []struct {
+		name          string
+		givenURL      string
+		givenUser     string
+		expectedToken bool
+	}{
+		{
+			name:          "Internal",
+			givenURL:      "http://app.internal.example.com:8080/",
+			givenUser:     "alice",
+			expectedToken: true,
+		},
+		{
+			name:          "External",
+			givenURL:      "http://example.com/",
+			givenUser:     "alice",
+			expectedToken: false,
+		},
+		{
+			name:          "Unauthenticated",
+			givenURL:      "http://app.internal.example.com/",
+			givenUser:     "",
+			expectedToken: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.givenURL, nil)
+			req.Header.Set("X-Proxy-Identity", "spoofed")
+
+			// Act
+
+			err := s.Apply(req, tc.givenUser)
+
+			// Assert
+
+			require.NoError(t, err)
+			token := req.Header.Get("X-Proxy-Identity")
+			if !tc.expectedToken {
+				assert.Empty(t, token)
+				return
+			}
+
+			parts := strings.Split(token, ".")
+			require.Len(t, parts, 3)
+
+			mac := hmac.New(sha256.New, []byte("secret"))
+			_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+			assert.Equal(t, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), parts[2])
+
+			b, err := base64.RawURLEncoding.DecodeString(parts[1])
+			require.NoError(t, err)
+			var claims identityClaims
+			require.NoError(t, json.Unmarshal(b, &claims))
+			assert.Equal(t, identityClaims{
+				Issuer:    "forwardingproxy",
+				Subject:   "alice",
+				Audience:  "app.internal.example.com",
+				IssuedAt:  1528000000,
+				ExpiresAt: 1528000060,
+			}, claims)
+		})
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxIPRangesSize bounds the size of published IP range documents, the
+	// service tags of Azure being the largest at several megabytes.
+	maxIPRangesSize = 64 << 20
+
+	// ipRangesFetchTimeout bounds refreshing the IP ranges of all providers.
+	ipRangesFetchTimeout = 5 * time.Minute
+)
+
+// ipRangeProvider is a cloud provider publishing its IP ranges at URL, empty
+// if the URL changes and must be configured, in a format parsed by parse.
+type ipRangeProvider struct {
+	URL   string
+	parse func(provider string, r io.Reader) (map[string][]*net.IPNet, error)
+}
+
+// ipRangeProviders are the providers of IP range sets by name.
+var ipRangeProviders = map[string]ipRangeProvider{
+	"aws":    {URL: "https://ip-ranges.amazonaws.com/ip-ranges.json", parse: parseAWSIPRanges},
+	"azure":  {parse: parseAzureIPRanges},
+	"gcp":    {URL: "https://www.gstatic.com/ipranges/cloud.json", parse: parseGCPIPRanges},
+	"github": {URL: "https://api.github.com/meta", parse: parseGitHubIPRanges},
+}
+
+// IPRangeSource is a cloud provider whose published IP ranges are fetched
+// from URL.
+type IPRangeSource struct {
+	Provider string
+	URL      string
+}
+
+// ParseIPRangeSources parses cloud providers such as "aws", or "azure="
+// followed by the URL of its service tags file, which changes weekly. The
+// providers are "aws", "azure", "gcp" and "github", of which all but "azure"
+// default to the URL their ranges are published at.
+func ParseIPRangeSources(providers []string) ([]IPRangeSource, error) {
+	var sources []IPRangeSource
+	for _, s := range providers {
+		name, url := s, ""
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			name, url = s[:i], s[i+1:]
+		}
+		name = strings.ToLower(name)
+		provider, ok := ipRangeProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown IP range provider %q", name)
+		}
+		if url == "" {
+			url = provider.URL
+		}
+		if url == "" {
+			return nil, fmt.Errorf("IP range provider %q requires a URL", name)
+		}
+		sources = append(sources, IPRangeSource{Provider: name, URL: url})
+	}
+	return sources, nil
+}
+
+// IPRangeSets holds named sets of the IP ranges published by cloud
+// providers, which ACL rules on "ipset:" match destinations against, e.g.
+// "aws.s3" for the ranges of Amazon S3. The sets of a provider are named
+// after it and, separated by dots, its services and regions in lower case:
+//
+//	aws, aws.{service}, aws.{service}.{region}, e.g. aws.s3.eu-west-1
+//	azure, azure.{service tag}, e.g. azure.storage.westeurope
+//	gcp, gcp.{scope}, e.g. gcp.europe-west1
+//	github, github.{service}, e.g. github.actions
+//
+// Sets are fetched again via Watch, keeping the sets of providers failing to
+// be fetched.
+type IPRangeSets struct {
+	Logger  *zap.Logger
+	Sources []IPRangeSource
+	// Client fetches the published IP ranges.
+	Client *http.Client
+	// CachePath, if set, is the file the sets are saved to once fetched,
+	// and loaded from via LoadCache, so rules on sets apply even if the
+	// providers can not be reached at startup.
+	CachePath string
+
+	mu   sync.RWMutex
+	sets map[string][]*net.IPNet
+}
+
+// contains reports whether the set name holds ip, which is false if s is nil
+// or the set unknown.
+func (s *IPRangeSets) contains(name string, ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, n := range s.sets[name] {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasProvider reports whether the ranges of the provider of the set name are
+// fetched.
+func (s *IPRangeSets) HasProvider(name string) bool {
+	provider := ipSetProvider(name)
+	for _, source := range s.Sources {
+		if source.Provider == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh fetches the IP ranges of all sources, logging the sets which
+// changed, and saves them to CachePath. Sources failing to be fetched keep
+// their current sets, and the errors are returned once all were fetched.
+func (s *IPRangeSets) Refresh(ctx context.Context) error {
+	s.mu.RLock()
+	old := s.sets
+	s.mu.RUnlock()
+
+	sets := map[string][]*net.IPNet{}
+	var errs []string
+	for _, source := range s.Sources {
+		fetched, err := s.fetch(ctx, source)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source.Provider, err))
+			for name, nets := range old {
+				if ipSetProvider(name) == source.Provider {
+					sets[name] = nets
+				}
+			}
+			continue
+		}
+		for name, nets := range fetched {
+			sets[name] = nets
+		}
+	}
+	s.logChanges(old, sets)
+
+	s.mu.Lock()
+	s.sets = sets
+	s.mu.Unlock()
+
+	if s.CachePath != "" && len(errs) < len(s.Sources) {
+		if err := s.saveCache(sets); err != nil {
+			errs = append(errs, fmt.Sprintf("saving cache: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("fetching IP ranges failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Watch refreshes the sets every interval until stop is closed.
+func (s *IPRangeSets) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ipRangesFetchTimeout)
+		if err := s.Refresh(ctx); err != nil {
+			s.Logger.Warn("Refreshing IP range sets failed", zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// LoadCache loads the sets saved to CachePath, of the providers of Sources
+// only.
+func (s *IPRangeSets) LoadCache() error {
+	b, err := ioutil.ReadFile(s.CachePath)
+	if err != nil {
+		return err
+	}
+	var cached map[string][]string
+	if err := json.Unmarshal(b, &cached); err != nil {
+		return fmt.Errorf("%s: %v", s.CachePath, err)
+	}
+	sets := map[string][]*net.IPNet{}
+	for name, cidrs := range cached {
+		if !s.HasProvider(name) {
+			continue
+		}
+		for _, cidr := range cidrs {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("%s: %v", s.CachePath, err)
+			}
+			sets[name] = append(sets[name], n)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sets = sets
+	return nil
+}
+
+func (s *IPRangeSets) saveCache(sets map[string][]*net.IPNet) error {
+	cached := make(map[string][]string, len(sets))
+	for name, nets := range sets {
+		cached[name] = ipNetStrings(nets)
+	}
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.CachePath, b)
+}
+
+// fetch fetches and parses the IP ranges of source.
+func (s *IPRangeSets) fetch(ctx context.Context, source IPRangeSource) (map[string][]*net.IPNet, error) {
+	req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ipRangeProviders[source.Provider].parse(source.Provider, io.LimitReader(resp.Body, maxIPRangesSize))
+}
+
+// logChanges logs the sets of sets added, removed or changed since old.
+func (s *IPRangeSets) logChanges(old, sets map[string][]*net.IPNet) {
+	if old == nil {
+		s.Logger.Info("IP range sets loaded", zap.Int("sets", len(sets)))
+		return
+	}
+	for name, nets := range sets {
+		added, removed := diffIPNets(old[name], nets)
+		if added > 0 || removed > 0 {
+			s.Logger.Info("IP range set changed", zap.String("set", name),
+				zap.Int("ranges", len(nets)), zap.Int("added", added), zap.Int("removed", removed))
+		}
+	}
+	for name, nets := range old {
+		if _, ok := sets[name]; !ok {
+			s.Logger.Info("IP range set removed", zap.String("set", name), zap.Int("ranges", len(nets)))
+		}
+	}
+}
+
+// diffIPNets returns the number of ranges of b not in a, and of a not in b.
+func diffIPNets(a, b []*net.IPNet) (added, removed int) {
+	in := make(map[string]bool, len(a))
+	for _, n := range a {
+		in[n.String()] = true
+	}
+	for _, n := range b {
+		if !in[n.String()] {
+			added++
+		}
+		delete(in, n.String())
+	}
+	return added, len(in)
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	sort.Strings(s)
+	return s
+}
+
+// ipSetProvider returns the provider of the set name.
+func ipSetProvider(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// validIPSetName reports whether name can name an IP range set.
+func validIPSetName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ipSetBuilder adds ranges to named sets, skipping duplicates, as ranges
+// are often listed per service and again for the whole provider.
+type ipSetBuilder struct {
+	sets map[string][]*net.IPNet
+	// seen holds the names and ranges added, separated by a space.
+	seen map[string]bool
+}
+
+func newIPSetBuilder() *ipSetBuilder {
+	return &ipSetBuilder{sets: map[string][]*net.IPNet{}, seen: map[string]bool{}}
+}
+
+// add adds the range cidr to the sets of names, which are lowercased and
+// stripped of spaces.
+func (b *ipSetBuilder) add(cidr string, names ...string) error {
+	_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.Replace(name, " ", "", -1))
+		if key := name + " " + n.String(); !b.seen[key] {
+			b.seen[key] = true
+			b.sets[name] = append(b.sets[name], n)
+		}
+	}
+	return nil
+}
+
+// parseAWSIPRanges parses the ip-ranges.json of AWS.
+func parseAWSIPRanges(provider string, r io.Reader) (map[string][]*net.IPNet, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	b := newIPSetBuilder()
+	add := func(cidr, service, region string) error {
+		service = provider + "." + service
+		return b.add(cidr, provider, service, service+"."+region)
+	}
+	for _, p := range doc.Prefixes {
+		if err := add(p.IPPrefix, p.Service, p.Region); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range doc.IPv6Prefixes {
+		if err := add(p.IPv6Prefix, p.Service, p.Region); err != nil {
+			return nil, err
+		}
+	}
+	return b.sets, nil
+}
+
+// parseGCPIPRanges parses the cloud.json of Google Cloud.
+func parseGCPIPRanges(provider string, r io.Reader) (map[string][]*net.IPNet, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	b := newIPSetBuilder()
+	for _, p := range doc.Prefixes {
+		cidr := p.IPv4Prefix
+		if cidr == "" {
+			cidr = p.IPv6Prefix
+		}
+		if err := b.add(cidr, provider, provider+"."+p.Scope); err != nil {
+			return nil, err
+		}
+	}
+	return b.sets, nil
+}
+
+// parseAzureIPRanges parses the service tags file of Azure.
+func parseAzureIPRanges(provider string, r io.Reader) (map[string][]*net.IPNet, error) {
+	var doc struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	b := newIPSetBuilder()
+	for _, v := range doc.Values {
+		for _, cidr := range v.Properties.AddressPrefixes {
+			if err := b.add(cidr, provider, provider+"."+v.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.sets, nil
+}
+
+// parseGitHubIPRanges parses the meta API response of GitHub, whose lists of
+// IP ranges are the services of GitHub. Other fields are skipped.
+func parseGitHubIPRanges(provider string, r io.Reader) (map[string][]*net.IPNet, error) {
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	b := newIPSetBuilder()
+fields:
+	for field, raw := range doc {
+		var cidrs []string
+		if json.Unmarshal(raw, &cidrs) != nil {
+			continue
+		}
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				continue fields
+			}
+		}
+		for _, cidr := range cidrs {
+			if err := b.add(cidr, provider, provider+"."+field); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.sets, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseIPRangeSources(t *testing.T) {
+	cases := []struct {
+		name            string
+		givenProviders  []string
+		expectedSources []IPRangeSource
+		expectedError   bool
+	}{
+		{
+			name:           "Defaults",
+			givenProviders: []string{"AWS", "github"},
+			expectedSources: []IPRangeSource{
+				{Provider: "aws", URL: "https://ip-ranges.amazonaws.com/ip-ranges.json"},
+				{Provider: "github", URL: "https://api.github.com/meta"},
+			},
+		},
+		{
+			name:            "URL",
+			givenProviders:  []string{"azure=https://example.com/ServiceTags_Public.json"},
+			expectedSources: []IPRangeSource{{Provider: "azure", URL: "https://example.com/ServiceTags_Public.json"}},
+		},
+		{
+			name:           "MissingURL",
+			givenProviders: []string{"azure"},
+			expectedError:  true,
+		},
+		{
+			name:           "UnknownProvider",
+			givenProviders: []string{"oracle"},
+			expectedError:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, err := ParseIPRangeSources(tc.givenProviders)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedSources, observed)
+		})
+	}
+}
+
+func TestIPRangeSetsParse(t *testing.T) {
+	cases := []struct {
+		name           string
+		givenProvider  string
+		givenDoc       string
+		expectedRanges map[string][]string
+	}{
+		{
+			name:          "AWS",
+			givenProvider: "aws",
+			givenDoc: `{"prefixes": [
+				{"ip_prefix": "192.0.2.0/24", "region": "eu-west-1", "service": "AMAZON"},
+				{"ip_prefix": "192.0.2.0/24", "region": "eu-west-1", "service": "S3"}],
+				"ipv6_prefixes": [{"ipv6_prefix": "2001:db8::/32", "region": "us-east-1", "service": "S3"}]}`,
+			expectedRanges: map[string][]string{
+				"aws":                  {"192.0.2.0/24", "2001:db8::/32"},
+				"aws.amazon":           {"192.0.2.0/24"},
+				"aws.amazon.eu-west-1": {"192.0.2.0/24"},
+				"aws.s3":               {"192.0.2.0/24", "2001:db8::/32"},
+				"aws.s3.eu-west-1":     {"192.0.2.0/24"},
+				"aws.s3.us-east-1":     {"2001:db8::/32"},
+			},
+		},
+		{
+			name:          "GCP",
+			givenProvider: "gcp",
+			givenDoc: `{"prefixes": [
+				{"ipv4Prefix": "198.51.100.0/24", "service": "Google Cloud", "scope": "europe-west1"},
+				{"ipv6Prefix": "2001:db8::/32", "service": "Google Cloud", "scope": "us-east1"}]}`,
+			expectedRanges: map[string][]string{
+				"gcp":              {"198.51.100.0/24", "2001:db8::/32"},
+				"gcp.europe-west1": {"198.51.100.0/24"},
+				"gcp.us-east1":     {"2001:db8::/32"},
+			},
+		},
+		{
+			name:          "Azure",
+			givenProvider: "azure",
+			givenDoc: `{"values": [
+				{"name": "AzureCloud", "properties": {"addressPrefixes": ["203.0.113.0/24", "198.51.100.0/24"]}},
+				{"name": "Storage.WestEurope", "properties": {"addressPrefixes": ["203.0.113.0/24"]}}]}`,
+			expectedRanges: map[string][]string{
+				"azure":                    {"198.51.100.0/24", "203.0.113.0/24"},
+				"azure.azurecloud":         {"198.51.100.0/24", "203.0.113.0/24"},
+				"azure.storage.westeurope": {"203.0.113.0/24"},
+			},
+		},
+		{
+			name:          "GitHub",
+			givenProvider: "github",
+			givenDoc: `{"verifiable_password_authentication": true,
+				"ssh_keys": ["ssh-ed25519 AAAA"],
+				"hooks": ["192.0.2.0/24"],
+				"actions": ["192.0.2.0/24", "2001:db8::/32"]}`,
+			expectedRanges: map[string][]string{
+				"github":         {"192.0.2.0/24", "2001:db8::/32"},
+				"github.actions": {"192.0.2.0/24", "2001:db8::/32"},
+				"github.hooks":   {"192.0.2.0/24"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			sets, err := ipRangeProviders[tc.givenProvider].parse(tc.givenProvider, strings.NewReader(tc.givenDoc))
+
+			// Assert
+
+			require.NoError(t, err)
+			observed := map[string][]string{}
+			for name, nets := range sets {
+				observed[name] = ipNetStrings(nets)
+			}
+			assert.Equal(t, tc.expectedRanges, observed)
+		})
+	}
+}
+
+func TestIPRangeSetsRefresh(t *testing.T) {
+	// Arrange
+
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 && r.URL.Path == "/gcp" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/aws":
+			fmt.Fprint(w, `{"prefixes": [{"ip_prefix": "192.0.2.0/24", "region": "eu-west-1", "service": "S3"}]}`)
+		case "/gcp":
+			fmt.Fprint(w, `{"prefixes": [{"ipv4Prefix": "198.51.100.0/24", "scope": "europe-west1"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ipsets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &IPRangeSets{
+		Logger:    zap.NewNop(),
+		Sources:   []IPRangeSource{{Provider: "aws", URL: server.URL + "/aws"}, {Provider: "gcp", URL: server.URL + "/gcp"}},
+		Client:    server.Client(),
+		CachePath: filepath.Join(dir, "ipsets.json"),
+	}
+
+	// Act & Assert
+
+	require.NoError(t, s.Refresh(context.Background()))
+	assert.True(t, s.contains("aws.s3", net.ParseIP("192.0.2.7")))
+	assert.False(t, s.contains("aws.s3", net.ParseIP("198.51.100.7")))
+	assert.True(t, s.contains("gcp", net.ParseIP("198.51.100.7")))
+	assert.False(t, s.contains("azure", net.ParseIP("198.51.100.7")))
+	assert.False(t, (*IPRangeSets)(nil).contains("aws", net.ParseIP("192.0.2.7")))
+
+	atomic.StoreInt32(&failing, 1)
+	assert.Error(t, s.Refresh(context.Background()))
+	assert.True(t, s.contains("gcp", net.ParseIP("198.51.100.7")), "failing providers keep their sets")
+
+	cached := &IPRangeSets{Sources: []IPRangeSource{{Provider: "gcp"}}, CachePath: s.CachePath}
+	require.NoError(t, cached.LoadCache())
+	assert.True(t, cached.contains("gcp.europe-west1", net.ParseIP("198.51.100.7")))
+	assert.False(t, cached.contains("aws", net.ParseIP("192.0.2.7")), "sets of other providers are not loaded")
+}
+
+func TestACLDecideIPSet(t *testing.T) {
+	// Arrange
+
+	_, n, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	acl := &ACL{IPSets: &IPRangeSets{sets: map[string][]*net.IPNet{"aws.s3": {n}}}}
+	for _, line := range []string{
+		"allow ipset:aws.s3:443",
+		"deny *",
+	} {
+		rule, err := parseACLRule(line)
+		require.NoError(t, err)
+		acl.Rules = append(acl.Rules, rule)
+	}
+
+	// Act & Assert
+
+	_, decided := acl.decide("s3.example.com", 443, nil)
+	assert.False(t, decided)
+	allow, _ := acl.decide("s3.example.com", 443, net.ParseIP("192.0.2.7"))
+	assert.True(t, allow)
+	allow, _ = acl.decide("s3.example.com", 80, net.ParseIP("192.0.2.7"))
+	assert.False(t, allow)
+	allow, _ = acl.decide("other.example.com", 443, net.ParseIP("198.51.100.7"))
+	assert.False(t, allow)
+}
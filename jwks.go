@@ -0,0 +1,229 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// minKeySetRefresh bounds how often a key set is fetched for tokens of
+	// unknown keys, so such tokens can not hammer the JWKS endpoint.
+	minKeySetRefresh = 10 * time.Second
+
+	// maxKeySetSize bounds the size of JWKS documents.
+	maxKeySetSize = 1 << 20
+
+	// keySetFetchTimeout bounds fetches of key sets, which are not bound to
+	// the requests waiting for them.
+	keySetFetchTimeout = time.Minute
+)
+
+// KeySet holds the public keys verifying bearer tokens, fetched from a JWKS
+// endpoint. Keys are fetched again once Refresh elapsed, and for tokens
+// signed by unknown keys, e.g. as keys were rotated, at most every 10
+// seconds. Concurrent lookups share a single fetch, which is not bound to the
+// requests waiting for it. RSA and P-256 keys are supported.
+type KeySet struct {
+	// URL is the URL of the JWKS endpoint.
+	URL string
+	// Client fetches the keys.
+	Client *http.Client
+	// Refresh is the duration after which keys are fetched again, at least
+	// 10 seconds.
+	Refresh time.Duration
+
+	mu      sync.Mutex
+	now     func() time.Time
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// err is the error of the last fetch, if it failed.
+	err error
+	// fetching is closed once the fetch in progress completed, nil if none
+	// is.
+	fetching chan struct{}
+}
+
+// NewKeySet returns a key set fetching keys from url with client, refreshed
+// every refresh.
+func NewKeySet(url string, client *http.Client, refresh time.Duration) *KeySet {
+	return &KeySet{URL: url, Client: client, Refresh: refresh, now: time.Now}
+}
+
+// keySetError is returned when the keys of a key set could not be fetched.
+type keySetError struct {
+	URL string
+	Err error
+}
+
+func (e *keySetError) Error() string {
+	return fmt.Sprintf("fetching keys from %s failed: %v", e.URL, e.Err)
+}
+
+// key returns the key with the ID kid, fetching the keys if they are stale
+// or kid is unknown. It returns the error of ctx if ctx is done before the
+// keys were fetched.
+func (ks *KeySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	now := ks.now()
+	key, ok := ks.keys[kid]
+	refresh := ks.Refresh
+	if refresh < minKeySetRefresh {
+		refresh = minKeySetRefresh
+	}
+	// Lookups of unknown keys also wait for fetches in progress, which may
+	// have been started for them.
+	if age := now.Sub(ks.fetched); age >= refresh || !ok && (age >= minKeySetRefresh || ks.fetching != nil) {
+		done := ks.startFetch(now)
+		ks.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ks.mu.Lock()
+		key, ok = ks.keys[kid]
+	}
+	err := ks.err
+	ks.mu.Unlock()
+
+	if ok {
+		// Known keys remain usable while the endpoint fails.
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, &tokenError{"unknown key"}
+}
+
+// startFetch starts fetching the keys in the background unless a fetch is in
+// progress already, and returns a channel closed once the keys were fetched.
+// It must be called with ks.mu held.
+func (ks *KeySet) startFetch(now time.Time) <-chan struct{} {
+	if ks.fetching != nil {
+		return ks.fetching
+	}
+	done := make(chan struct{})
+	ks.fetching, ks.fetched = done, now
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), keySetFetchTimeout)
+		keys, err := ks.fetch(ctx)
+		cancel()
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		if err != nil {
+			ks.err = &keySetError{URL: ks.URL, Err: err}
+		} else {
+			ks.keys, ks.err = keys, nil
+		}
+		ks.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+// Probe fetches the keys of the key set, which are then used for tokens.
+func (ks *KeySet) Probe(ctx context.Context) error {
+	keys, err := ks.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys, ks.fetched, ks.err = keys, ks.now(), nil
+	return nil
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetch fetches the keys by ID. Keys of unsupported types or not used for
+// signatures are skipped.
+func (ks *KeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, ks.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ks.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxKeySetSize)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, ok := jwk.publicKey(); ok {
+			keys[jwk.KeyID] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA or P-256 public key of jwk.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, bool) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, false
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, false
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, true
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, false
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, false
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, false
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, false
+		}
+		return key, true
+	}
+	return nil, false
+}
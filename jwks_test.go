@@ -0,0 +1,136 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwkOf returns the JSON web key of pub with the ID kid.
+func jwkOf(kid string, pub crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": enc(pub.N.Bytes()), "e": enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": enc(pub.X.Bytes()), "y": enc(pub.Y.Bytes())}
+	}
+	return nil
+}
+
+func TestKeySetKey(t *testing.T) {
+	// Arrange
+
+	now := time.Unix(1528000000, 0)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys := []interface{}{jwkOf("a", &ecKey.PublicKey), map[string]string{"kty": "oct", "kid": "secret"}}
+	fetches := 0
+	failing := false
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	ks := NewKeySet(jwks.URL, jwks.Client(), time.Hour)
+	ks.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Act & Assert
+
+	key, err := ks.key(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, &ecKey.PublicKey, key)
+	_, err = ks.key(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, fetches, "keys are cached")
+
+	_, err = ks.key(ctx, "secret")
+	assert.IsType(t, &tokenError{}, err, "unsupported keys are skipped")
+	assert.Equal(t, 1, fetches, "unknown keys are fetched at most every minKeySetRefresh")
+
+	keys = append(keys, jwkOf("b", &ecKey.PublicKey))
+	now = now.Add(minKeySetRefresh)
+	_, err = ks.key(ctx, "b")
+	require.NoError(t, err, "rotated keys are fetched")
+	assert.Equal(t, 2, fetches)
+
+	failing = true
+	now = now.Add(time.Hour)
+	_, err = ks.key(ctx, "a")
+	assert.NoError(t, err, "known keys remain usable while fetching fails")
+	_, err = ks.key(ctx, "c")
+	assert.IsType(t, &keySetError{}, err)
+	assert.Equal(t, 3, fetches)
+}
+
+func TestKeySetConcurrentFetch(t *testing.T) {
+	// Arrange
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var fetches int32
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{jwkOf("a", &ecKey.PublicKey)}})
+	}))
+	defer jwks.Close()
+
+	ks := NewKeySet(jwks.URL, jwks.Client(), 0)
+
+	// Act
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	canceledErr := make(chan error, 1)
+	go func() {
+		_, err := ks.key(canceledCtx, "a")
+		canceledErr <- err
+	}()
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ks.key(context.Background(), "a")
+		}(i)
+	}
+	cancel()
+	observedCanceledErr := <-canceledErr
+	close(release)
+	wg.Wait()
+	_, err = ks.key(context.Background(), "a")
+
+	// Assert
+
+	assert.Equal(t, context.Canceled, observedCanceledErr)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, err, "keys are not fetched again within minKeySetRefresh")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyEWMAWeight is the weight of a new sample in the moving average.
+	latencyEWMAWeight = 0.3
+	// latencyFailurePenalty is added to the dial duration of failed dials, so
+	// unreachable addresses are tried last.
+	latencyFailurePenalty = 10 * time.Second
+	// maxLatencyEntries bounds the number of addresses tracked.
+	maxLatencyEntries = 10000
+)
+
+// AddrLatencies maintains an exponentially weighted moving average of dial
+// latencies per destination IP address, so destinations resolving to many
+// addresses, e.g. across regions, can be dialed via the historically fastest
+// address first.
+type AddrLatencies struct {
+	mu    sync.Mutex
+	ewmas map[string]time.Duration
+}
+
+// NewAddrLatencies returns an empty latency table.
+func NewAddrLatencies() *AddrLatencies {
+	return &AddrLatencies{ewmas: map[string]time.Duration{}}
+}
+
+// Observe records the duration of a dial to ip.
+func (l *AddrLatencies) Observe(ip net.IP, d time.Duration, failed bool) {
+	if failed {
+		d += latencyFailurePenalty
+	}
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ewma, ok := l.ewmas[key]
+	if !ok {
+		if len(l.ewmas) >= maxLatencyEntries {
+			// Evict an arbitrary entry, it will be re-learned when needed.
+			for k := range l.ewmas {
+				delete(l.ewmas, k)
+				break
+			}
+		}
+		l.ewmas[key] = d
+		return
+	}
+	l.ewmas[key] = time.Duration(latencyEWMAWeight*float64(d) + (1-latencyEWMAWeight)*float64(ewma))
+}
+
+// Sort orders ips by ascending average dial latency. Addresses without
+// observations are sorted first, so their latency gets learned; otherwise the
+// resolver's order is kept.
+func (l *AddrLatencies) Sort(ips []net.IPAddr) {
+	l.mu.Lock()
+	ewmas := make([]time.Duration, len(ips))
+	for i, ip := range ips {
+		ewmas[i] = l.ewmas[ip.IP.String()]
+	}
+	l.mu.Unlock()
+
+	sort.Stable(byLatency{ips: ips, ewmas: ewmas})
+}
+
+type byLatency struct {
+	ips   []net.IPAddr
+	ewmas []time.Duration
+}
+
+func (b byLatency) Len() int           { return len(b.ips) }
+func (b byLatency) Less(i, j int) bool { return b.ewmas[i] < b.ewmas[j] }
+func (b byLatency) Swap(i, j int) {
+	b.ips[i], b.ips[j] = b.ips[j], b.ips[i]
+	b.ewmas[i], b.ewmas[j] = b.ewmas[j], b.ewmas[i]
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrLatenciesSort(t *testing.T) {
+	// Arrange
+
+	slow, fast, failing, unknown := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")
+
+	l := NewAddrLatencies()
+	l.Observe(slow, 100*time.Millisecond, false)
+	l.Observe(fast, 10*time.Millisecond, false)
+	l.Observe(failing, time.Millisecond, true)
+
+	ips := []net.IPAddr{{IP: failing}, {IP: slow}, {IP: fast}, {IP: unknown}}
+
+	// Act
+
+	l.Sort(ips)
+
+	// Assert
+
+	assert.Equal(t, []net.IPAddr{{IP: unknown}, {IP: fast}, {IP: slow}, {IP: failing}}, ips)
+}
+
+func TestAddrLatenciesObserve(t *testing.T) {
+	// Arrange
+
+	ip := net.ParseIP("10.0.0.1")
+	l := NewAddrLatencies()
+
+	// Act
+
+	l.Observe(ip, 100*time.Millisecond, false)
+	l.Observe(ip, 200*time.Millisecond, false)
+
+	// Assert
+
+	assert.Equal(t, 130*time.Millisecond, l.ewmas[ip.String()])
+}
+
+func TestAddrLatenciesBounded(t *testing.T) {
+	// Arrange
+
+	l := NewAddrLatencies()
+
+	// Act
+
+	for i := 0; i < maxLatencyEntries+10; i++ {
+		l.Observe(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), time.Millisecond, false)
+	}
+
+	// Assert
+
+	assert.Len(t, l.ewmas, maxLatencyEntries)
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LDAP protocol constants.
+//
+// See: https://tools.ietf.org/html/rfc4511
+const (
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+
+	ldapTagBindRequest   = 0x60
+	ldapTagBindResponse  = 0x61
+	ldapTagUnbindRequest = 0x42
+	ldapTagSimpleAuth    = 0x80
+
+	ldapVersion = 3
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	// ldapMaxMessageSize bounds the size of responses read from servers.
+	ldapMaxMessageSize = 1 << 16
+	// ldapMaxCredentialSize bounds the size of user names and passwords
+	// bound with, which no server accepts in any size.
+	ldapMaxCredentialSize = 1 << 10
+)
+
+// LDAPAuthenticator authenticates clients by binding to an LDAP server as the
+// distinguished name of the user with the password of the client.
+type LDAPAuthenticator struct {
+	// Addr is the host and port of the LDAP server.
+	Addr string
+	// BindDN is the distinguished name bound as, with %s replaced by the
+	// escaped user name, e.g. "uid=%s,ou=people,dc=example,dc=com".
+	BindDN string
+	// TLSConfig, if set, is used to connect via TLS (LDAPS).
+	TLSConfig *tls.Config
+	// Timeout bounds the duration of binds, unlimited if zero.
+	Timeout time.Duration
+}
+
+// Authenticate implements Authenticator.
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, user, pass string, r *http.Request) (Identity, error) {
+	// An empty password would make the bind unauthenticated, which most
+	// servers accept for any name. Oversized credentials are refused before
+	// contacting the server.
+	if user == "" || pass == "" || len(user) > ldapMaxCredentialSize || len(pass) > ldapMaxCredentialSize {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+	defer watchConn(ctx, conn)()
+
+	dn := fmt.Sprintf(a.BindDN, escapeDN(user))
+	if err := ldapBind(conn, dn, pass); err != nil {
+		if err == ErrInvalidCredentials {
+			return Identity{}, err
+		}
+		return Identity{}, contextError(ctx, err)
+	}
+	return Identity{User: user}, nil
+}
+
+// Probe connects to the LDAP server, without binding.
+func (a *LDAPAuthenticator) Probe(ctx context.Context) error {
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (a *LDAPAuthenticator) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", a.Addr)
+	if err != nil || a.TLSConfig == nil {
+		return conn, err
+	}
+
+	cfg := a.TLSConfig.Clone()
+	if cfg.ServerName == "" {
+		if cfg.ServerName, _, err = net.SplitHostPort(a.Addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	stop := watchConn(ctx, conn)
+	tlsConn := tls.Client(conn, cfg)
+	err = tlsConn.Handshake()
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	return tlsConn, nil
+}
+
+// ldapBind binds as dn with pass via rw, returning ErrInvalidCredentials if
+// the server rejected the credentials.
+func ldapBind(rw io.ReadWriter, dn, pass string) error {
+	const messageID = 1
+
+	req := berTLV(berTagSequence, berTLV(berTagInteger, []byte{messageID}),
+		berTLV(ldapTagBindRequest,
+			berTLV(berTagInteger, []byte{ldapVersion}),
+			berTLV(berTagOctetString, []byte(dn)),
+			berTLV(ldapTagSimpleAuth, []byte(pass))))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	tag, msg, err := readBER(bufio.NewReader(rw))
+	if err != nil {
+		return err
+	}
+	if tag != berTagSequence {
+		return fmt.Errorf("ldap: unexpected message tag 0x%02x", tag)
+	}
+	if tag, _, msg, err = parseBER(msg); err != nil || tag != berTagInteger {
+		return errors.New("ldap: malformed message ID")
+	}
+	var resp []byte
+	if tag, resp, _, err = parseBER(msg); err != nil || tag != ldapTagBindResponse {
+		return errors.New("ldap: malformed bind response")
+	}
+	var code []byte
+	if tag, code, resp, err = parseBER(resp); err != nil || tag != berTagEnumerated || len(code) != 1 {
+		return errors.New("ldap: malformed result code")
+	}
+
+	// Unbinding only politely announces closing the connection.
+	_, _ = rw.Write(berTLV(berTagSequence, berTLV(berTagInteger, []byte{messageID + 1}), berTLV(ldapTagUnbindRequest)))
+
+	switch code[0] {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return ErrInvalidCredentials
+	}
+	var diagnostic []byte
+	if _, _, resp, err = parseBER(resp); err == nil {
+		_, diagnostic, _, _ = parseBER(resp)
+	}
+	return fmt.Errorf("ldap: bind failed with result code %d: %s", code[0], diagnostic)
+}
+
+// berTLV encodes a BER element with tag and the concatenated contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		// Long form: the number of length bytes followed by the length in
+		// big-endian order.
+		var size int
+		for m := n; m > 0; m >>= 8 {
+			size++
+		}
+		b = append(b, 0x80|byte(size))
+		for i := size - 1; i >= 0; i-- {
+			b = append(b, byte(n>>(8*uint(i))))
+		}
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// readBER reads a single BER element.
+func readBER(r *bufio.Reader) (tag byte, content []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 {
+			return 0, nil, errors.New("ldap: unsupported length encoding")
+		}
+		n = 0
+		for ; size > 0; size-- {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(c)
+		}
+	}
+	if n > ldapMaxMessageSize {
+		return 0, nil, errors.New("ldap: message too large")
+	}
+	content = make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], content, nil
+}
+
+// parseBER parses the first BER element of b and returns the remaining
+// bytes.
+func parseBER(b []byte) (tag byte, content, rest []byte, err error) {
+	errMalformed := errors.New("ldap: malformed element")
+	if len(b) < 2 {
+		return 0, nil, nil, errMalformed
+	}
+	tag, n, i := b[0], int(b[1]), 2
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < i+size {
+			return 0, nil, nil, errMalformed
+		}
+		n = 0
+		for _, c := range b[i : i+size] {
+			n = n<<8 | int(c)
+		}
+		i += size
+	}
+	if len(b)-i < n {
+		return 0, nil, nil, errMalformed
+	}
+	return tag, b[i : i+n], b[i+n:], nil
+}
+
+// escapeDN escapes s for use as an attribute value of a distinguished name.
+//
+// See: https://tools.ietf.org/html/rfc4514#section-2.4
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == '#' || c == ' ') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
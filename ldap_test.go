@@ -0,0 +1,209 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeDN(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name     string
+		given    string
+		expected string
+	}{
+		{
+			name:     "Plain",
+			given:    "john.doe",
+			expected: "john.doe",
+		},
+		{
+			name:     "Special",
+			given:    `a,b+c"d\e<f>g;h=i`,
+			expected: `a\,b\+c\"d\\e\<f\>g\;h\=i`,
+		},
+		{
+			name:     "LeadingAndTrailing",
+			given:    "# x ",
+			expected: `\# x\ `,
+		},
+		{
+			name:     "NUL",
+			given:    "a\x00b",
+			expected: `a\00b`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := escapeDN(tc.given)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestBERTLV(t *testing.T) {
+	cases := []struct {
+		name        string
+		givenLength int
+	}{
+		{name: "Empty", givenLength: 0},
+		{name: "Short", givenLength: 0x7f},
+		{name: "OneLengthByte", givenLength: 0x80},
+		{name: "TwoLengthBytes", givenLength: 0x100},
+		{name: "ThreeLengthBytes", givenLength: 0x10000},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			given := bytes.Repeat([]byte{'x'}, tc.givenLength)
+
+			// Act
+
+			tag, content, rest, err := parseBER(append(berTLV(berTagOctetString, given), 0xff))
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, byte(berTagOctetString), tag)
+			assert.Equal(t, given, content)
+			assert.Equal(t, []byte{0xff}, rest)
+		})
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	// Arrange
+
+	// LDAP server accepting binds as uid=user,dc=example with password
+	// secret, and failing binds as uid=broken,dc=example.
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestLDAPBind(conn)
+		}
+	}()
+
+	a := &LDAPAuthenticator{
+		Addr:    l.Addr().String(),
+		BindDN:  "uid=%s,dc=example",
+		Timeout: 5 * time.Second,
+	}
+
+	cases := []struct {
+		name          string
+		givenUser     string
+		givenPass     string
+		expectedError error
+		expectedFail  bool
+	}{
+		{
+			name:      "Valid",
+			givenUser: "user",
+			givenPass: "secret",
+		},
+		{
+			name:          "InvalidPass",
+			givenUser:     "user",
+			givenPass:     "wrong",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "EmptyPass",
+			givenUser:     "user",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "Injection",
+			givenUser:     "user,dc=example",
+			givenPass:     "secret",
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:          "OversizedPass",
+			givenUser:     "user",
+			givenPass:     strings.Repeat("x", 0x10001),
+			expectedError: ErrInvalidCredentials,
+		},
+		{
+			name:         "ServerFailure",
+			givenUser:    "broken",
+			givenPass:    "secret",
+			expectedFail: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedIdentity, err := a.Authenticate(context.Background(), tc.givenUser, tc.givenPass, nil)
+
+			// Assert
+
+			if tc.expectedFail {
+				require.Error(t, err)
+				assert.NotEqual(t, ErrInvalidCredentials, err)
+				return
+			}
+			assert.Equal(t, tc.expectedError, err)
+			if err == nil {
+				assert.Equal(t, Identity{User: tc.givenUser}, observedIdentity)
+			}
+		})
+	}
+}
+
+// serveTestLDAPBind answers a single bind request on conn.
+func serveTestLDAPBind(conn net.Conn) {
+	defer conn.Close()
+
+	_, msg, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	_, id, msg, _ := parseBER(msg)
+	_, req, _, _ := parseBER(msg)
+	_, _, req, _ = parseBER(req)
+	_, dn, req, _ := parseBER(req)
+	_, pass, _, _ := parseBER(req)
+
+	code := byte(ldapResultInvalidCredentials)
+	switch {
+	case string(dn) == "uid=broken,dc=example":
+		code = 52 // unavailable
+	case string(dn) == "uid=user,dc=example" && string(pass) == "secret":
+		code = ldapResultSuccess
+	}
+	conn.Write(berTLV(berTagSequence, berTLV(berTagInteger, id),
+		berTLV(ldapTagBindResponse,
+			berTLV(berTagEnumerated, []byte{code}),
+			berTLV(berTagOctetString),
+			berTLV(berTagOctetString, []byte("diagnostic")))))
+}
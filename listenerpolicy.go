@@ -0,0 +1,147 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// ListenerPolicy overrides settings of a Proxy for the requests received on
+// one of several listeners, e.g. to serve authenticated clients on a public
+// listener and unauthenticated clients on an internal one.
+type ListenerPolicy struct {
+	// DisableAuth lets clients use the proxy without authenticating.
+	DisableAuth bool
+	// AuthSchemes, if set, are the authentication schemes offered to
+	// clients instead of Proxy.AuthSchemes.
+	AuthSchemes []string
+	// ClientCertAuth, if set, authenticates clients by their TLS client
+	// certificates instead of Proxy.ClientCertAuth, for listeners verifying
+	// client certificates of their own.
+	ClientCertAuth *ClientCertAuth
+	// RequireCertAndCredentials requires clients to present both a verified
+	// TLS client certificate and valid credentials, rather than either, for
+	// zero-trust deployments. Requests are made as the user authenticated by
+	// the credentials.
+	RequireCertAndCredentials bool
+	// ACL, if set, decides which destinations clients may connect to
+	// instead of Proxy.ACL.
+	ACL *ACL
+	// HeaderPolicy, if set, rewrites the headers of plain HTTP requests
+	// after Proxy.HeaderPolicy.
+	HeaderPolicy *HeaderPolicy
+}
+
+type listenerPolicyKey struct{}
+
+// WithListenerPolicy returns a handler serving requests with the settings of
+// p overridden by policy.
+func (p *Proxy) WithListenerPolicy(policy *ListenerPolicy) http.Handler {
+	if policy.ACL != nil {
+		atomic.StoreInt32(&p.listenerACLs, 1)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r.WithContext(withListenerPolicy(r.Context(), policy)))
+	})
+}
+
+func withListenerPolicy(ctx context.Context, policy *ListenerPolicy) context.Context {
+	if policy == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, listenerPolicyKey{}, policy)
+}
+
+// listenerPolicyFromContext returns the listener policy of ctx, or nil.
+func listenerPolicyFromContext(ctx context.Context) *ListenerPolicy {
+	lp, _ := ctx.Value(listenerPolicyKey{}).(*ListenerPolicy)
+	return lp
+}
+
+// authRequiredFor reports whether the client of r must authenticate.
+func (p *Proxy) authRequiredFor(r *http.Request) bool {
+	if lp := listenerPolicyFromContext(r.Context()); lp != nil {
+		if lp.DisableAuth {
+			return false
+		}
+		if lp.ClientCertAuth != nil || lp.RequireCertAndCredentials {
+			return true
+		}
+	}
+	return p.authRequired()
+}
+
+// certUser returns the user authenticated by the TLS client certificate of r,
+// or "" if there is none, and whether valid credentials are required besides
+// the certificate.
+func (p *Proxy) certUser(r *http.Request) (user string, credentials bool) {
+	a := p.ClientCertAuth
+	lp := listenerPolicyFromContext(r.Context())
+	if lp != nil && lp.ClientCertAuth != nil {
+		a = lp.ClientCertAuth
+	}
+	return a.user(r.TLS), lp != nil && lp.RequireCertAndCredentials
+}
+
+// checkACL checks the destination u of a plain HTTP request against the ACL
+// applying to ctx ahead of forwarding it, if any listener has an ACL of its
+// own. Connections to destinations are pooled across listeners, so the ACL
+// checked when dialing a reused connection may have been the one of another
+// listener.
+func (p *Proxy) checkACL(ctx context.Context, u *url.URL) error {
+	acl := p.aclFor(ctx)
+	if acl == nil || atomic.LoadInt32(&p.listenerACLs) == 0 {
+		return nil
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = u.Scheme
+	}
+	return p.checkDestACL(ctx, acl, host, port)
+}
+
+// checkDestACL checks the destination host and port against acl, resolving
+// host if a rule on IP ranges or countries needs its addresses.
+func (p *Proxy) checkDestACL(ctx context.Context, acl *ACL, host, port string) error {
+	aclPort, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return err
+	}
+
+	allow, decided := acl.decide(host, aclPort, nil)
+	if (!decided || !allow) && p.granted(ctx, host, aclPort) {
+		return nil
+	}
+	if !decided && p.Upstream != nil {
+		allow = acl.decideUnresolved(host, aclPort)
+	} else if !decided {
+		ips, err := p.lookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if allow, _ = acl.decide(host, aclPort, ip.IP); !allow {
+				break
+			}
+		}
+	}
+	if !allow {
+		p.Logger.Warn("Destination denied", zap.String("host", host), zap.Int("port", aclPort))
+		return &aclDeniedError{Host: host, Port: aclPort}
+	}
+	return nil
+}
+
+// aclFor returns the ACL applying to destinations dialed with ctx.
+func (p *Proxy) aclFor(ctx context.Context) *ACL {
+	if lp := listenerPolicyFromContext(ctx); lp != nil && lp.ACL != nil {
+		return lp.ACL
+	}
+	return p.ACL
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithListenerPolicy(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	rule, err := parseACLRule("deny 127.0.0.0/8")
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, time.Second)
+
+	internal := p.WithListenerPolicy(&ListenerPolicy{DisableAuth: true})
+	restricted := p.WithListenerPolicy(&ListenerPolicy{DisableAuth: true, ACL: &ACL{Rules: []ACLRule{rule}}})
+
+	// The restricted listener is served last, so the connection to the
+	// destination pooled for the internal listener is available to it.
+	cases := []struct {
+		name           string
+		givenHandler   http.Handler
+		expectedStatus int
+	}{
+		{name: "Default", givenHandler: p, expectedStatus: http.StatusProxyAuthRequired},
+		{name: "Internal", givenHandler: internal, expectedStatus: http.StatusOK},
+		{name: "Restricted", givenHandler: restricted, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, destServer.URL, nil)
+			w := httptest.NewRecorder()
+
+			// Act
+
+			tc.givenHandler.ServeHTTP(w, req)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
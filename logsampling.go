@@ -0,0 +1,95 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// OverloadSampler is a zapcore.Core which samples entries below warning level
+// once their rate exceeds a threshold, so logging does not limit throughput
+// when the proxy handles very high request rates. Warnings and errors are
+// always kept.
+//
+// The sample rate is adjusted every second to the rate of the preceding
+// second: at n times the threshold, a deterministic 1/n of entries is kept.
+type OverloadSampler struct {
+	zapcore.Core
+	state *samplerState
+}
+
+type samplerState struct {
+	// rate and seq are accessed atomically and come first for alignment.
+	rate int64
+	seq  uint64
+
+	threshold int64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int64
+}
+
+// NewOverloadSampler wraps core, sampling entries below warning level above
+// threshold entries per second.
+func NewOverloadSampler(core zapcore.Core, threshold int64) *OverloadSampler {
+	return &OverloadSampler{
+		Core:  core,
+		state: &samplerState{rate: 1, threshold: threshold},
+	}
+}
+
+// SampleRate returns n if currently 1/n of entries below warning level are
+// kept.
+func (s *OverloadSampler) SampleRate() int64 {
+	return atomic.LoadInt64(&s.state.rate)
+}
+
+// With returns a sampler sharing the state of s.
+func (s *OverloadSampler) With(fields []zapcore.Field) zapcore.Core {
+	return &OverloadSampler{Core: s.Core.With(fields), state: s.state}
+}
+
+// Check adds the wrapped core to ce if ent is not dropped by sampling.
+func (s *OverloadSampler) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level >= zapcore.WarnLevel {
+		return s.Core.Check(ent, ce)
+	}
+	rate := s.observe(ent.Time)
+	if rate > 1 && atomic.AddUint64(&s.state.seq, 1)%uint64(rate) != 0 {
+		return ce
+	}
+	return s.Core.Check(ent, ce)
+}
+
+// observe counts an entry logged at t and returns the current sample rate.
+func (s *OverloadSampler) observe(t time.Time) int64 {
+	st := s.state
+	st.mu.Lock()
+	if t.Sub(st.windowStart) < time.Second {
+		st.count++
+		st.mu.Unlock()
+		return atomic.LoadInt64(&st.rate)
+	}
+
+	rate := int64(1)
+	if st.threshold > 0 && t.Sub(st.windowStart) < 2*time.Second && st.count > st.threshold {
+		rate = (st.count + st.threshold - 1) / st.threshold
+	}
+	st.windowStart = t
+	st.count = 1
+	old := atomic.SwapInt64(&st.rate, rate)
+	st.mu.Unlock()
+
+	if old != rate {
+		if ce := s.Core.Check(zapcore.Entry{Level: zapcore.WarnLevel, Time: t, Message: "Log sampling rate changed"}, nil); ce != nil {
+			ce.Write(zap.Int64("rate", rate), zap.Int64("previousRate", old))
+		}
+	}
+	return rate
+}
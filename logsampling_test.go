@@ -0,0 +1,73 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestOverloadSampler(t *testing.T) {
+	// Arrange
+
+	var logs bytes.Buffer
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	sampler := NewOverloadSampler(zapcore.NewCore(enc, zapcore.AddSync(&logs), zapcore.DebugLevel), 10)
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	log := func(t time.Time, level zapcore.Level, msg string) {
+		ent := zapcore.Entry{Level: level, Time: t, Message: msg}
+		if ce := sampler.Check(ent, nil); ce != nil {
+			ce.Write()
+		}
+	}
+
+	// Act & Assert
+
+	// Below threshold, every entry is kept.
+
+	for i := 0; i < 30; i++ {
+		log(start, zapcore.InfoLevel, "first")
+	}
+	assert.Equal(t, int64(1), sampler.SampleRate())
+	assert.Equal(t, 30, strings.Count(logs.String(), `"msg":"first"`))
+
+	// Three times the threshold in the preceding second, every third entry
+	// is kept, but all warnings.
+
+	for i := 0; i < 30; i++ {
+		log(start.Add(time.Second), zapcore.InfoLevel, "second")
+		log(start.Add(time.Second), zapcore.WarnLevel, "warning")
+	}
+	assert.Equal(t, int64(3), sampler.SampleRate())
+	assert.Equal(t, 10, strings.Count(logs.String(), `"msg":"second"`))
+	assert.Equal(t, 30, strings.Count(logs.String(), `"msg":"warning"`))
+	assert.Equal(t, 1, strings.Count(logs.String(), `"msg":"Log sampling rate changed"`))
+
+	// After an idle period, sampling stops.
+
+	log(start.Add(5*time.Second), zapcore.InfoLevel, "third")
+	assert.Equal(t, int64(1), sampler.SampleRate())
+	assert.Equal(t, 1, strings.Count(logs.String(), `"msg":"third"`))
+	assert.Equal(t, 2, strings.Count(logs.String(), `"msg":"Log sampling rate changed"`))
+}
+
+func TestOverloadSamplerWithSharesState(t *testing.T) {
+	// Arrange
+
+	sampler := NewOverloadSampler(zapcore.NewNopCore(), 1)
+
+	// Act
+
+	child := sampler.With([]zapcore.Field{zap.String("key", "value")}).(*OverloadSampler)
+
+	// Assert
+
+	assert.True(t, sampler.state == child.state)
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsMaxDestinations bounds the number of destinations counted
+// separately, so clients can not grow the metrics without bounds. Further
+// destinations are counted as "other".
+const metricsMaxDestinations = 1000
+
+// metricsDurationBuckets are the upper bounds in seconds of the tunnel duration
+// histogram buckets.
+var metricsDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// Kinds of connections counted by Metrics.
+const (
+	connKindConnect = "connect"
+	connKindHTTP    = "http"
+	connKindSOCKS   = "socks"
+)
+
+// Metrics collects operational metrics of a proxy and serves them in the
+// Prometheus text exposition format. All methods of a nil Metrics are no-ops.
+type Metrics struct {
+	// DestinationGroups, if set, collapses destination hosts into groups
+	// counted under a single label. Every host is counted separately
+	// otherwise.
+	DestinationGroups *DestinationGroups
+	// LatencySLOs, if set, are exported along with the other metrics.
+	LatencySLOs *LatencySLOs
+
+	activeTunnels   int64
+	connectConns    uint64
+	httpConns       uint64
+	socksConns      uint64
+	upstreamBytes   uint64
+	downstreamBytes uint64
+	dialErrors      uint64
+	authFailures    uint64
+	openCircuits    int64
+	circuitRejects  uint64
+	rejectedConns   uint64
+
+	mu             sync.Mutex
+	destinations   map[string]uint64
+	clientFailures map[string]uint64
+	durationCounts []uint64
+	durationSum    float64
+	durationCount  uint64
+}
+
+// NewMetrics returns empty metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		destinations:   map[string]uint64{},
+		clientFailures: map[string]uint64{},
+		durationCounts: make([]uint64, len(metricsDurationBuckets)),
+	}
+}
+
+func (m *Metrics) connection(kind string) {
+	if m == nil {
+		return
+	}
+	switch kind {
+	case connKindConnect:
+		atomic.AddUint64(&m.connectConns, 1)
+	case connKindHTTP:
+		atomic.AddUint64(&m.httpConns, 1)
+	case connKindSOCKS:
+		atomic.AddUint64(&m.socksConns, 1)
+	}
+}
+
+func (m *Metrics) authFailure() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.authFailures, 1)
+}
+
+func (m *Metrics) dialError() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.dialErrors, 1)
+}
+
+func (m *Metrics) circuitOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.openCircuits, 1)
+}
+
+func (m *Metrics) circuitClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.openCircuits, -1)
+}
+
+func (m *Metrics) circuitRejected() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.circuitRejects, 1)
+}
+
+func (m *Metrics) connRejected() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.rejectedConns, 1)
+}
+
+// clientFailure counts a tunnel failure of kind reported by a client.
+func (m *Metrics) clientFailure(kind string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clientFailures[kind]++
+}
+
+// destinationConnected counts a connection established to host.
+func (m *Metrics) destinationConnected(host string) {
+	if m == nil {
+		return
+	}
+	host = m.DestinationGroups.group(host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.destinations[host]; !ok && len(m.destinations) >= metricsMaxDestinations {
+		host = metricsOtherDestination
+	}
+	m.destinations[host]++
+}
+
+func (m *Metrics) tunnelOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeTunnels, 1)
+}
+
+func (m *Metrics) tunnelClosed(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeTunnels, -1)
+
+	s := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, le := range metricsDurationBuckets {
+		if s <= le {
+			m.durationCounts[i]++
+		}
+	}
+	m.durationSum += s
+	m.durationCount++
+}
+
+// upstream returns r counting bytes read as sent from clients to
+// destinations.
+func (m *Metrics) upstream(r io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return r
+	}
+	return &countingReadCloser{ReadCloser: r, n: &m.upstreamBytes}
+}
+
+// downstream returns r counting bytes read as sent from destinations to
+// clients.
+func (m *Metrics) downstream(r io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return r
+	}
+	return &countingReadCloser{ReadCloser: r, n: &m.downstreamBytes}
+}
+
+// addUpstream counts n bytes sent from clients to destinations bypassing
+// upstream, e.g. spliced.
+func (m *Metrics) addUpstream(n int64) {
+	if m != nil {
+		atomic.AddUint64(&m.upstreamBytes, uint64(n))
+	}
+}
+
+// addDownstream counts n bytes sent from destinations to clients bypassing
+// downstream.
+func (m *Metrics) addDownstream(n int64) {
+	if m != nil {
+		atomic.AddUint64(&m.downstreamBytes, uint64(n))
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	_ = bw.Flush()
+}
+
+func (m *Metrics) write(w io.Writer) {
+	fmt.Fprintln(w, "# HELP forwardingproxy_active_tunnels Number of established tunnels.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_active_tunnels gauge")
+	fmt.Fprintf(w, "forwardingproxy_active_tunnels %d\n", atomic.LoadInt64(&m.activeTunnels))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_connections_total Number of accepted client requests by kind.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_connections_total counter")
+	fmt.Fprintf(w, "forwardingproxy_connections_total{kind=%q} %d\n", connKindConnect, atomic.LoadUint64(&m.connectConns))
+	fmt.Fprintf(w, "forwardingproxy_connections_total{kind=%q} %d\n", connKindHTTP, atomic.LoadUint64(&m.httpConns))
+	fmt.Fprintf(w, "forwardingproxy_connections_total{kind=%q} %d\n", connKindSOCKS, atomic.LoadUint64(&m.socksConns))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_transferred_bytes_total Number of bytes relayed by direction.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_transferred_bytes_total counter")
+	fmt.Fprintf(w, "forwardingproxy_transferred_bytes_total{direction=\"upstream\"} %d\n", atomic.LoadUint64(&m.upstreamBytes))
+	fmt.Fprintf(w, "forwardingproxy_transferred_bytes_total{direction=\"downstream\"} %d\n", atomic.LoadUint64(&m.downstreamBytes))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_dial_errors_total Number of failed destination dials.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_dial_errors_total counter")
+	fmt.Fprintf(w, "forwardingproxy_dial_errors_total %d\n", atomic.LoadUint64(&m.dialErrors))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_auth_failures_total Number of rejected client credentials.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_auth_failures_total counter")
+	fmt.Fprintf(w, "forwardingproxy_auth_failures_total %d\n", atomic.LoadUint64(&m.authFailures))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_open_circuits Number of destination hosts whose circuit breaker is open or half-open.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_open_circuits gauge")
+	fmt.Fprintf(w, "forwardingproxy_open_circuits %d\n", atomic.LoadInt64(&m.openCircuits))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_circuit_rejections_total Number of destination dials failed fast by open circuit breakers.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_circuit_rejections_total counter")
+	fmt.Fprintf(w, "forwardingproxy_circuit_rejections_total %d\n", atomic.LoadUint64(&m.circuitRejects))
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_rejected_connections_total Number of client connections rejected at the connection limit.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_rejected_connections_total counter")
+	fmt.Fprintf(w, "forwardingproxy_rejected_connections_total %d\n", atomic.LoadUint64(&m.rejectedConns))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_destination_connections_total Number of connections established by destination host.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_destination_connections_total counter")
+	hosts := make([]string, 0, len(m.destinations))
+	for host := range m.destinations {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "forwardingproxy_destination_connections_total{destination=\"%s\"} %d\n", escapeLabelValue(host), m.destinations[host])
+	}
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_client_reported_failures_total Number of tunnel failures reported by clients by kind.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_client_reported_failures_total counter")
+	for _, kind := range failureKinds {
+		fmt.Fprintf(w, "forwardingproxy_client_reported_failures_total{kind=%q} %d\n", kind, m.clientFailures[kind])
+	}
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_tunnel_duration_seconds Duration of closed tunnels.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_tunnel_duration_seconds histogram")
+	for i, le := range metricsDurationBuckets {
+		fmt.Fprintf(w, "forwardingproxy_tunnel_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.durationCounts[i])
+	}
+	fmt.Fprintf(w, "forwardingproxy_tunnel_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "forwardingproxy_tunnel_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "forwardingproxy_tunnel_duration_seconds_count %d\n", m.durationCount)
+
+	m.LatencySLOs.write(w)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+// countingReadCloser adds the number of bytes read to n.
+type countingReadCloser struct {
+	io.ReadCloser
+	n *uint64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddUint64(r.n, uint64(n))
+	return n, err
+}
+
+// countingResponseWriter adds the number of response body bytes written to n.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *uint64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
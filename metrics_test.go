@@ -0,0 +1,137 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsTunnel(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.Metrics = NewMetrics()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+
+	destAddr := destListener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	_, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+
+	activeMetrics := scrapeMetrics(t, p.Metrics)
+
+	require.NoError(t, conn.Close())
+
+	var closedMetrics string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if closedMetrics = scrapeMetrics(t, p.Metrics); strings.Contains(closedMetrics, "forwardingproxy_active_tunnels 0\n") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Contains(t, activeMetrics, "forwardingproxy_active_tunnels 1\n")
+	assert.Contains(t, closedMetrics, "forwardingproxy_active_tunnels 0\n")
+	assert.Contains(t, closedMetrics, `forwardingproxy_connections_total{kind="connect"} 1`+"\n")
+	assert.Contains(t, closedMetrics, `forwardingproxy_transferred_bytes_total{direction="upstream"} 4`+"\n")
+	assert.Contains(t, closedMetrics, `forwardingproxy_transferred_bytes_total{direction="downstream"} 4`+"\n")
+	assert.Contains(t, closedMetrics, `forwardingproxy_destination_connections_total{destination="127.0.0.1"} 1`+"\n")
+	assert.Contains(t, closedMetrics, `forwardingproxy_tunnel_duration_seconds_bucket{le="+Inf"} 1`+"\n")
+	assert.Contains(t, closedMetrics, "forwardingproxy_tunnel_duration_seconds_count 1\n")
+}
+
+func TestMetricsFailures(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.AuthUser, p.AuthPass = "user", "pass"
+	p.Metrics = NewMetrics()
+
+	r := httptest.NewRequest(http.MethodConnect, "127.0.0.1:1", nil)
+
+	// Act
+
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	_, err := p.DialContext(r.Context(), "tcp", "127.0.0.1:1")
+
+	// Assert
+
+	require.Error(t, err)
+	observed := scrapeMetrics(t, p.Metrics)
+	assert.Contains(t, observed, "forwardingproxy_auth_failures_total 1\n")
+	assert.Contains(t, observed, "forwardingproxy_dial_errors_total 1\n")
+	assert.Contains(t, observed, `forwardingproxy_connections_total{kind="connect"} 0`+"\n")
+}
+
+func TestMetricsDestinationLimit(t *testing.T) {
+	// Arrange
+
+	m := NewMetrics()
+
+	// Act
+
+	for i := 0; i < metricsMaxDestinations+2; i++ {
+		m.destinationConnected(fmt.Sprintf("host%d.example.com", i))
+	}
+	m.destinationConnected(`"quoted"\host`)
+
+	// Assert
+
+	assert.Len(t, m.destinations, metricsMaxDestinations+1)
+	observed := scrapeMetrics(t, m)
+	assert.Contains(t, observed, `forwardingproxy_destination_connections_total{destination="host0.example.com"} 1`+"\n")
+	assert.Contains(t, observed, `forwardingproxy_destination_connections_total{destination="other"} 3`+"\n")
+	assert.NotContains(t, observed, "quoted")
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	// Act
+
+	observed := escapeLabelValue("a\"b\\c\nd")
+
+	// Assert
+
+	assert.Equal(t, `a\"b\\c\nd`, observed)
+}
+
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// metricsCounters are the counters of Metrics at one point in time.
+type metricsCounters struct {
+	requests        uint64
+	upstreamBytes   uint64
+	downstreamBytes uint64
+	dialErrors      uint64
+	authFailures    uint64
+}
+
+func (m *Metrics) counters() metricsCounters {
+	return metricsCounters{
+		requests:        atomic.LoadUint64(&m.connectConns) + atomic.LoadUint64(&m.httpConns) + atomic.LoadUint64(&m.socksConns),
+		upstreamBytes:   atomic.LoadUint64(&m.upstreamBytes),
+		downstreamBytes: atomic.LoadUint64(&m.downstreamBytes),
+		dialErrors:      atomic.LoadUint64(&m.dialErrors),
+		authFailures:    atomic.LoadUint64(&m.authFailures),
+	}
+}
+
+// Log logs a line of key metrics every interval until stop is closed, so
+// capacity trends can be derived from the logs of deployments not scraping
+// the metrics. Rates are averages over the last interval.
+func (m *Metrics) Log(logger *zap.Logger, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	prev, last := m.counters(), time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			cur := m.counters()
+			m.logRates(logger, prev, cur, now.Sub(last))
+			prev, last = cur, now
+		}
+	}
+}
+
+// logRates logs the metrics of an interval of duration d from prev to cur.
+func (m *Metrics) logRates(logger *zap.Logger, prev, cur metricsCounters, d time.Duration) {
+	perSecond := func(from, to uint64) float64 {
+		return float64(to-from) / d.Seconds()
+	}
+	// The dial error ratio is relative to the requests of the interval, as
+	// dials are not counted separately.
+	var dialErrorRatio float64
+	if requests := cur.requests - prev.requests; requests > 0 {
+		dialErrorRatio = float64(cur.dialErrors-prev.dialErrors) / float64(requests)
+	}
+	logger.Info("Proxy metrics",
+		zap.Int64("activeTunnels", atomic.LoadInt64(&m.activeTunnels)),
+		zap.Float64("requestsPerSecond", perSecond(prev.requests, cur.requests)),
+		zap.Float64("upstreamBytesPerSecond", perSecond(prev.upstreamBytes, cur.upstreamBytes)),
+		zap.Float64("downstreamBytesPerSecond", perSecond(prev.downstreamBytes, cur.downstreamBytes)),
+		zap.Float64("dialErrorsPerSecond", perSecond(prev.dialErrors, cur.dialErrors)),
+		zap.Float64("dialErrorRatio", dialErrorRatio),
+		zap.Float64("authFailuresPerSecond", perSecond(prev.authFailures, cur.authFailures)))
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsLogRates(t *testing.T) {
+	// Arrange
+
+	var logs bytes.Buffer
+	m := NewMetrics()
+	m.tunnelOpened()
+	prev := m.counters()
+	for i := 0; i < 4; i++ {
+		m.connection(connKindConnect)
+	}
+	m.dialError()
+	m.authFailure()
+	m.upstreamBytes += 2000
+	m.downstreamBytes += 8000
+
+	// Act
+
+	m.logRates(newBufferLogger(&logs), prev, m.counters(), 2*time.Second)
+
+	// Assert
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "Proxy metrics", entry["msg"])
+	assert.Equal(t, float64(1), entry["activeTunnels"])
+	assert.Equal(t, float64(2), entry["requestsPerSecond"])
+	assert.Equal(t, float64(1000), entry["upstreamBytesPerSecond"])
+	assert.Equal(t, float64(4000), entry["downstreamBytesPerSecond"])
+	assert.Equal(t, 0.5, entry["dialErrorsPerSecond"])
+	assert.Equal(t, 0.25, entry["dialErrorRatio"])
+	assert.Equal(t, 0.5, entry["authFailuresPerSecond"])
+}
+
+func TestMetricsLog(t *testing.T) {
+	// Arrange
+
+	var logs syncBuffer
+	m := NewMetrics()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	// Act
+
+	go func() {
+		m.Log(newBufferLogger(&logs), 10*time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+
+	// Assert
+
+	assert.Contains(t, string(logs.Bytes()), `"msg":"Proxy metrics"`)
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxMirroredBodySize bounds the size of request bodies buffered to be
+	// mirrored. Requests with larger bodies are not mirrored.
+	maxMirroredBodySize = 1 << 20
+
+	// maxMirrorsInFlight bounds the number of pending mirrored requests.
+	maxMirrorsInFlight = 100
+)
+
+// MirrorRule mirrors plain HTTP requests whose destination host matches Host
+// to Shadow.
+type MirrorRule struct {
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	Host string
+	// Shadow is the host, optionally including a port, copies of matching
+	// requests are sent to.
+	Shadow string
+}
+
+// LoadMirrorRules reads mirror rules from the file at path. Each non-empty
+// line not starting with '#' holds a host pattern followed by the shadow
+// host, e.g.:
+//
+//	billing.internal.example.com billing-v2.internal.example.com:8080
+func LoadMirrorRules(path string) ([]MirrorRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []MirrorRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed rule %q", path, n, line)
+		}
+		if strings.ContainsAny(fields[1], "/?#@") {
+			return nil, fmt.Errorf("%s:%d: malformed shadow host %q", path, n, fields[1])
+		}
+		rules = append(rules, MirrorRule{Host: strings.ToLower(fields[0]), Shadow: fields[1]})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Mirror sends copies of plain HTTP requests matching its rules to shadow
+// hosts, e.g. to test a migrated internal service with the traffic of the
+// current one. Copies are sent asynchronously and their responses discarded,
+// so shadow hosts can neither slow down nor change the responses to clients.
+// Copies exceeding the maximum number of pending copies are dropped.
+type Mirror struct {
+	// Rules are the mirror rules. The first matching rule applies.
+	Rules []MirrorRule
+	// Transport sends the copies.
+	Transport http.RoundTripper
+	// Timeout bounds the duration of sending a copy and reading its
+	// response.
+	Timeout time.Duration
+
+	inFlight chan struct{}
+}
+
+// NewMirror returns a mirror sending copies of requests matching rules via
+// transport, each within timeout.
+func NewMirror(rules []MirrorRule, transport http.RoundTripper, timeout time.Duration) *Mirror {
+	return &Mirror{Rules: rules, Transport: transport, Timeout: timeout, inFlight: make(chan struct{}, maxMirrorsInFlight)}
+}
+
+// shadowFor returns the shadow host of the first rule matching host.
+func (m *Mirror) shadowFor(host string) (string, bool) {
+	for _, rule := range m.Rules {
+		if matchHostPattern(rule.Host, host) {
+			return rule.Shadow, true
+		}
+	}
+	return "", false
+}
+
+// mirrorRequest sends a copy of r to its shadow host, if r matches a rule of
+// the mirror. The body of r is buffered, leaving r to be forwarded as is.
+func (p *Proxy) mirrorRequest(r *http.Request) {
+	m := p.Mirror
+	if m == nil {
+		return
+	}
+	shadow, ok := m.shadowFor(r.URL.Host)
+	if !ok {
+		return
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		p.Logger.Debug("Mirrored requests pending, dropping copy", zap.String("shadow", shadow))
+		return
+	}
+
+	body, ok := bufferBody(r)
+	if !ok {
+		<-m.inFlight
+		p.Logger.Debug("Request body could not be buffered to be mirrored", zap.String("shadow", shadow))
+		return
+	}
+
+	u := *r.URL
+	u.Host = shadow
+	mr := &http.Request{
+		Method:        r.Method,
+		URL:           &u,
+		Header:        make(http.Header, len(r.Header)),
+		Host:          shadow,
+		ContentLength: int64(len(body)),
+	}
+	for name, values := range r.Header {
+		if !isHopByHopHeader(name) {
+			mr.Header[name] = append([]string(nil), values...)
+		}
+	}
+	for _, field := range r.Header["Connection"] {
+		for _, name := range strings.Split(field, ",") {
+			mr.Header.Del(strings.TrimSpace(name))
+		}
+	}
+	if len(body) > 0 {
+		mr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	go func() {
+		defer func() { <-m.inFlight }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+		defer cancel()
+		resp, err := m.Transport.RoundTrip(mr.WithContext(ctx))
+		if err != nil {
+			p.Logger.Debug("Mirrored request failed", zap.String("shadow", shadow), zap.Error(err))
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+}
+
+// bufferBody reads the body of r into memory and replaces it with a reader of
+// the same data. It reports false if the body exceeds maxMirroredBodySize or
+// could not be read, in which case the remaining body is left unread.
+func bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxMirroredBodySize {
+		return nil, false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMirroredBodySize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil || len(b) > maxMirroredBodySize {
+		return nil, false
+	}
+	return b, true
+}
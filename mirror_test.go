@@ -0,0 +1,109 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMirrorRules(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Billing\n\nBilling.internal.example.com billing-v2.internal.example.com:8080\n"), 0600))
+	malformedPath := filepath.Join(dir, "malformed")
+	require.NoError(t, ioutil.WriteFile(malformedPath, []byte("billing.internal.example.com http://billing-v2.internal.example.com/\n"), 0600))
+
+	// Act
+
+	rules, err := LoadMirrorRules(path)
+	_, malformedErr := LoadMirrorRules(malformedPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, []MirrorRule{{Host: "billing.internal.example.com", Shadow: "billing-v2.internal.example.com:8080"}}, rules)
+	require.Error(t, malformedErr)
+	assert.Contains(t, malformedErr.Error(), "malformed:1:")
+}
+
+func TestProxyMirrorsHTTP(t *testing.T) {
+	// Arrange
+
+	type mirrored struct {
+		host, method, path, body string
+		header                   http.Header
+	}
+	shadowed := make(chan mirrored, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		shadowed <- mirrored{host: r.Host, method: r.Method, path: r.URL.Path, body: string(b), header: r.Header}
+		http.Error(w, "shadow-response", http.StatusInternalServerError)
+	}))
+	defer shadowServer.Close()
+	shadowURL, err := url.Parse(shadowServer.URL)
+	require.NoError(t, err)
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("dummy-response: "), b...))
+	}))
+	defer destServer.Close()
+	destURL, err := url.Parse(destServer.URL)
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	p.Mirror = NewMirror([]MirrorRule{{Host: "localhost", Shadow: shadowURL.Host}}, NewForwardingTransport(p.DialContext, time.Second), time.Second)
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyServerURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyServerURL)}}
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:"+destURL.Port()+"/orders", strings.NewReader("dummy-body"))
+	require.NoError(t, err)
+	req.Header.Set("X-Request", "value")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "value")
+
+	// Act
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "dummy-response: dummy-body", string(b), "response of the destination is returned")
+	select {
+	case m := <-shadowed:
+		assert.Equal(t, shadowURL.Host, m.host)
+		assert.Equal(t, http.MethodPost, m.method)
+		assert.Equal(t, "/orders", m.path)
+		assert.Equal(t, "dummy-body", m.body)
+		assert.Equal(t, "value", m.header.Get("X-Request"))
+		assert.Empty(t, m.header.Get("X-Hop"))
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+}
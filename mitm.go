@@ -0,0 +1,433 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// interceptCertLifetime is the validity of generated leaf certificates.
+	interceptCertLifetime = 24 * time.Hour
+
+	// maxInterceptCerts is the number of cached leaf certificates after
+	// which the cache is cleared.
+	maxInterceptCerts = 1000
+)
+
+// Interceptor terminates the TLS connections of clients tunneling to
+// destinations matching Hosts with certificates generated on the fly and
+// signed by CA, so the decrypted requests can be inspected and filtered. The
+// requests are forwarded to the destinations via TLS like plain HTTP
+// requests. Clients must trust CA.
+type Interceptor struct {
+	// Hosts are the host patterns of destinations to intercept, see
+	// ResponseHeaderRule.Host for the syntax. Tunnels to all other
+	// destinations are relayed untouched.
+	Hosts []string
+	// WildcardDomains are registrable domains, e.g. example.com, for whose
+	// direct subdomains a single wildcard certificate for *.example.com is
+	// generated instead of one certificate per host, cutting generation and
+	// cache size for busy domains. Hosts of other domains get certificates
+	// of their own.
+	WildcardDomains []string
+	// BlockedContentTypes are the media types of responses to refuse, e.g.
+	// "application/x-msdownload" or "video/*" for all video types. Both the
+	// Content-Type of responses and the type sniffed from the first bytes of
+	// their bodies are checked, so mislabeled executables and archives are
+	// blocked too. Blocked responses are replaced with a block page.
+	BlockedContentTypes []string
+	// FastOpenHosts are the host patterns of intercepted destinations whose
+	// connections are opened with TCP Fast Open, saving a round trip to
+	// origins known to support it. Only the TLS ClientHello is sent early,
+	// which is safe to replay, so requests are never sent twice; TLS 1.3
+	// early data is not used.
+	FastOpenHosts []string
+	// Rewrites are the rules substituting strings in the bodies of
+	// responses, e.g. rewriting absolute URLs to route back through the
+	// proxy. Requests to hosts with rules are sent without Accept-Encoding,
+	// so bodies are received unencoded.
+	Rewrites []RewriteRule
+	// MaxRewriteSize is the number of bytes of bodies rewritten,
+	// DefaultMaxRewriteSize if zero. Responses declaring a larger
+	// Content-Length are not rewritten, and bytes beyond it of responses of
+	// unknown length are passed through unchanged.
+	MaxRewriteSize int64
+	// Inspect, if set, is called with every decrypted request before it is
+	// forwarded. Requests for which it returns an error are refused.
+	Inspect func(r *http.Request) error
+	// Filters inspect, modify or deny decrypted requests and their
+	// responses, in order, after Inspect and ahead of BlockedContentTypes
+	// and Rewrites.
+	Filters []Filter
+	// Recorder, if set, records the decrypted requests to selected
+	// destinations which passed Inspect and Filters, for replaying them
+	// later.
+	Recorder *RequestRecorder
+	// Fallbacks, if set, relays tunnels to hosts whose interception failed
+	// untouched for a while.
+	Fallbacks *InterceptFallbacks
+	// ClientCerts are the TLS client certificates presented to
+	// destinations requiring them, the first matching one applying. They
+	// are presented by transports created by NewForwardingTransport only.
+	ClientCerts []OriginClientCert
+
+	ca    *x509.Certificate
+	caKey interface{}
+	key   *ecdsa.PrivateKey
+	now   func() time.Time
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewInterceptor returns an interceptor of destinations matching hosts,
+// generating certificates signed by ca.
+func NewInterceptor(ca tls.Certificate, hosts []string) (*Interceptor, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("missing CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !caCert.IsCA {
+		return nil, errors.New("certificate is not a CA certificate")
+	}
+	// A single key is used for all generated certificates, as generating
+	// keys is expensive and they never leave the proxy.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Interceptor{
+		Hosts: hosts,
+		ca:    caCert,
+		caKey: ca.PrivateKey,
+		key:   key,
+		now:   time.Now,
+		certs: map[string]*tls.Certificate{},
+	}, nil
+}
+
+// intercepts reports whether tunnels to host are intercepted.
+func (i *Interceptor) intercepts(host string) bool {
+	if i.Fallbacks.contains(destinationKey(host)) {
+		return false
+	}
+	for _, pattern := range i.Hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// fastOpen reports whether connections to host are opened with TCP Fast
+// Open.
+func (i *Interceptor) fastOpen(host string) bool {
+	for _, pattern := range i.FastOpenHosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateName returns the name of the certificate for host, and the
+// registrable domain if it is a wildcard name.
+func (i *Interceptor) certificateName(host string) (string, string) {
+	for _, domain := range i.WildcardDomains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		sub := strings.TrimSuffix(host, "."+domain)
+		// Wildcards only match a single label.
+		if host == domain || (sub != host && sub != "" && !strings.Contains(sub, ".")) {
+			return "*." + domain, domain
+		}
+	}
+	return host, ""
+}
+
+// certificate returns a certificate for host, generating it unless a cached
+// one is valid for another hour at least.
+func (i *Interceptor) certificate(host string) (*tls.Certificate, error) {
+	now := i.now()
+	name, domain := i.certificateName(host)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if cert, ok := i.certs[name]; ok && now.Add(time.Hour).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(interceptCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(i.ca.NotAfter) {
+		template.NotAfter = i.ca.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if domain != "" {
+		// The wildcard does not match the domain itself.
+		template.DNSNames = []string{name, domain}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, &i.key.PublicKey, i.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, i.ca.Raw},
+		PrivateKey:  i.key,
+		Leaf:        leaf,
+	}
+
+	if len(i.certs) >= maxInterceptCerts {
+		i.certs = map[string]*tls.Certificate{}
+	}
+	i.certs[name] = cert
+	return cert, nil
+}
+
+// interceptTunnel answers the CONNECT request r to host and serves the
+// requests of the client decrypted with a certificate for host. userTunnel is
+// closed once the client connection is closed.
+func (p *Proxy) interceptTunnel(w http.ResponseWriter, r *http.Request, host, user string, userTunnel *userTunnel) {
+	serving := false
+	defer func() {
+		if !serving {
+			userTunnel.close()
+		}
+	}()
+
+	hostname := destinationKey(host)
+	// Certificates are generated before answering, so failures can still be
+	// reported to the client.
+	if _, err := p.Interceptor.certificate(hostname); err != nil {
+		p.Logger.Error("Generating interception certificate failed", zap.String("host", host), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var clientConn net.Conn
+	if r.ProtoMajor == 2 {
+		conn, wait, err := p.acceptStream(w, r)
+		if err != nil {
+			p.Logger.Error("Streaming not supported")
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		defer wait()
+		clientConn = conn
+	} else {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			p.Logger.Error("Hijacking not supported")
+			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, clientBuf, err := hijacker.Hijack()
+		if err != nil {
+			p.Logger.Error("Hijacking failed", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err = p.writeConnectResponse(conn, r); err != nil {
+			p.Logger.Error("Writing CONNECT response failed", zap.Error(err))
+			_ = conn.Close()
+			return
+		}
+		clientConn = &bufferedConn{Conn: conn, r: clientBuf.Reader}
+	}
+	tunnel := &tunnelConns{client: clientConn, host: host, user: user}
+	if _, ok := p.tunnels.add(r.Context(), tunnel); !ok {
+		p.logHost(zap.InfoLevel, "Refusing tunnel while shutting down", host)
+		_ = clientConn.Close()
+		return
+	}
+	// Deadlines set by the server for the CONNECT request are replaced by the
+	// timeouts of the server below.
+	clientConn.SetDeadline(time.Time{})
+
+	tlsConn := tls.Server(tunnel.countClient(clientConn), &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.Interceptor.certificate(hostname)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if p.Interceptor.Fallbacks != nil {
+		// The handshake is completed ahead of serving, so clients
+		// rejecting the certificate are noticed.
+		if p.ClientReadTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(p.ClientReadTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			if clientHandshakeFailed(err) {
+				p.Interceptor.Fallbacks.add(p.Logger, hostname, "client handshake: "+err.Error())
+			}
+			p.logHost(zap.DebugLevel, "Intercepted TLS handshake failed", host)
+			tunnel.cancel()
+			p.tunnels.remove(tunnel)
+			_ = tlsConn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	serving = true
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, ir *http.Request) {
+			// Decrypted requests are subject to the policy of the listener
+			// of the tunnel.
+			p.handleIntercepted(w, ir.WithContext(p.withDialUser(withListenerPolicy(ir.Context(), listenerPolicyFromContext(r.Context())), user)), host, user)
+		}),
+		ErrorLog:          p.ForwardingHTTPProxy.ErrorLog,
+		ReadHeaderTimeout: p.ClientReadTimeout,
+		IdleTimeout:       p.IdleTimeout,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				tunnel.cancel()
+				p.tunnels.remove(tunnel)
+				userTunnel.close()
+			}
+		},
+	}
+	_ = s.Serve(&singleConnListener{conn: tlsConn})
+}
+
+// handleIntercepted forwards the decrypted request r of a tunnel to host.
+func (p *Proxy) handleIntercepted(w http.ResponseWriter, r *http.Request, host, user string) {
+	r.URL.Scheme = "https"
+	r.URL.Host = host
+	if ce := p.Logger.Check(zap.InfoLevel, "Intercepted request"); ce != nil {
+		ce.Write(zap.String("host", host), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+	}
+	if p.Interceptor.Inspect != nil {
+		if err := p.Interceptor.Inspect(r); err != nil {
+			p.Logger.Warn("Intercepted request refused", zap.String("host", host), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if len(p.Interceptor.Filters) > 0 {
+		fc := &filterChain{
+			logger:  p.Logger,
+			filters: p.Interceptor.Filters,
+			host:    host,
+			user:    user,
+		}
+		if err := fc.filterRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(withFilterChain(r.Context(), fc))
+	}
+	if rr := p.Interceptor.Recorder; rr != nil && rr.records(host) {
+		rr.record(p.Logger, r, user)
+	}
+	if len(p.Interceptor.BlockedContentTypes) > 0 {
+		r = r.WithContext(withContentPolicy(r.Context(), &contentPolicy{
+			logger:  p.Logger,
+			blocked: p.Interceptor.BlockedContentTypes,
+			host:    host,
+			user:    user,
+		}))
+	}
+	if rules := rewriteRules(p.Interceptor.Rewrites, host); len(rules) > 0 {
+		r.Header.Del("Accept-Encoding")
+		maxSize := p.Interceptor.MaxRewriteSize
+		if maxSize <= 0 {
+			maxSize = DefaultMaxRewriteSize
+		}
+		r = r.WithContext(withResponseRewriter(r.Context(), &responseRewriter{
+			logger:  p.Logger,
+			rules:   rules,
+			maxSize: maxSize,
+			host:    host,
+		}))
+	}
+	if p.Interceptor.fastOpen(host) {
+		r = r.WithContext(withFastOpen(r.Context()))
+	}
+	if cert := originClientCert(p.Interceptor.ClientCerts, host); cert != nil {
+		r = r.WithContext(withOriginClientCert(r.Context(), cert))
+	}
+	if p.Interceptor.Fallbacks != nil {
+		r = r.WithContext(withInterceptFallback(r.Context(), &interceptFallback{
+			fallbacks: p.Interceptor.Fallbacks,
+			logger:    p.Logger,
+			host:      destinationKey(host),
+		}))
+	}
+	if name := p.routeServerName(host); name != "" {
+		_, port, _ := net.SplitHostPort(host)
+		p.Logger.Debug("Intercepted request fronted", zap.String("host", host), zap.String("sni", name))
+		r.URL.Host = net.JoinHostPort(name, port)
+	}
+	p.handleHTTP(w, r, user)
+}
+
+// singleConnListener is a listener accepting a single connection.
+type singleConnListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil, errListenerDone
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+// errListenerDone is returned by singleConnListener once its connection has
+// been accepted.
+var errListenerDone = errors.New("listener done")
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "intercepted" }
@@ -0,0 +1,283 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptTunnel(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="https://dummy-host/">dummy-host</a>`)
+			return
+		}
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	// Proxy server
+
+	ca := newTestCA(t)
+	interceptor, err := NewInterceptor(ca, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	interceptor.Inspect = func(r *http.Request) error {
+		if strings.HasPrefix(r.URL.Path, "/blocked") {
+			return errors.New("path blocked")
+		}
+		return nil
+	}
+	rewrite, err := parseRewriteRule("127.0.0.1 text/html s|https://dummy-host/|https://proxied-host/|")
+	require.NoError(t, err)
+	interceptor.Rewrites = []RewriteRule{rewrite}
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	transport.TLSClientConfig = &tls.Config{RootCAs: destPool}
+	p.ForwardingHTTPProxy.Transport = transport
+	p.Interceptor = interceptor
+
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(interceptor.ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caPool},
+	}}
+
+	cases := []struct {
+		name           string
+		givenPath      string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Forwarded",
+			givenPath:      "/",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "dummy-response",
+		},
+		{
+			name:           "Rewritten",
+			givenPath:      "/page",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `<a href="https://proxied-host/">dummy-host</a>`,
+		},
+		{
+			name:           "Refused",
+			givenPath:      "/blocked",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "path blocked\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			resp, err := client.Get(destServer.URL + tc.givenPath)
+
+			// Assert
+
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+			require.NotNil(t, resp.TLS)
+			assert.Equal(t, "127.0.0.1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+		})
+	}
+}
+
+func TestInterceptTunnelRouteServerName(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	hosts := make(chan string, 1)
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+	_, port, err := net.SplitHostPort(destServer.Listener.Addr().String())
+	require.NoError(t, err)
+
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	// Proxy server
+
+	ca := newTestCA(t)
+	interceptor, err := NewInterceptor(ca, []string{"localhost"})
+	require.NoError(t, err)
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	transport.TLSClientConfig = &tls.Config{RootCAs: destPool}
+	p.ForwardingHTTPProxy.Transport = transport
+	p.Interceptor = interceptor
+	// The certificate of the destination server is only valid for its IP
+	// address, so requests only succeed if sent to the server name.
+	p.Routes = []Route{{Host: "localhost", Action: RouteDirect, ServerName: "127.0.0.1"}}
+
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(interceptor.ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caPool},
+	}}
+
+	// Act
+
+	resp, err := client.Get("https://" + net.JoinHostPort("localhost", port) + "/")
+
+	// Assert
+
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "dummy-response", string(body))
+	assert.Equal(t, net.JoinHostPort("localhost", port), <-hosts, "the Host header still names the destination")
+}
+
+func TestInterceptorCertificate(t *testing.T) {
+	// Arrange
+
+	interceptor, err := NewInterceptor(newTestCA(t), []string{"*.example.com"})
+	require.NoError(t, err)
+	now := time.Now()
+	interceptor.now = func() time.Time { return now }
+
+	// Act
+
+	first, err := interceptor.certificate("www.example.com")
+	require.NoError(t, err)
+	cached, err := interceptor.certificate("www.example.com")
+	require.NoError(t, err)
+	now = now.Add(interceptCertLifetime)
+	renewed, err := interceptor.certificate("www.example.com")
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.True(t, first == cached, "certificate is cached")
+	assert.True(t, first != renewed, "certificate is renewed before expiring")
+	assert.Equal(t, []string{"www.example.com"}, first.Leaf.DNSNames)
+	pool := x509.NewCertPool()
+	pool.AddCert(interceptor.ca)
+	_, err = first.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: pool, CurrentTime: now.Add(-interceptCertLifetime)})
+	assert.NoError(t, err)
+	assert.True(t, interceptor.intercepts("www.example.com:443"))
+	assert.False(t, interceptor.intercepts("example.org:443"))
+}
+
+func TestInterceptorWildcardCertificate(t *testing.T) {
+	// Arrange
+
+	interceptor, err := NewInterceptor(newTestCA(t), []string{"*.example.com"})
+	require.NoError(t, err)
+	interceptor.WildcardDomains = []string{"Example.com"}
+
+	// Act
+
+	www, err := interceptor.certificate("www.example.com")
+	require.NoError(t, err)
+	api, err := interceptor.certificate("api.example.com")
+	require.NoError(t, err)
+	apex, err := interceptor.certificate("example.com")
+	require.NoError(t, err)
+	nested, err := interceptor.certificate("a.b.example.com")
+	require.NoError(t, err)
+	other, err := interceptor.certificate("www.example.org")
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.True(t, www == api, "subdomains share the wildcard certificate")
+	assert.True(t, www == apex, "wildcard certificate covers the domain")
+	assert.Equal(t, []string{"*.example.com", "example.com"}, www.Leaf.DNSNames)
+	assert.Equal(t, []string{"a.b.example.com"}, nested.Leaf.DNSNames)
+	assert.Equal(t, []string{"www.example.org"}, other.Leaf.DNSNames)
+	assert.Len(t, interceptor.certs, 3)
+}
+
+func TestNewInterceptorRequiresCA(t *testing.T) {
+	// Arrange
+
+	ca := newTestCA(t)
+	leaf, err := NewInterceptor(ca, nil)
+	require.NoError(t, err)
+	cert, err := leaf.certificate("www.example.com")
+	require.NoError(t, err)
+
+	// Act
+
+	_, err = NewInterceptor(*cert, nil)
+
+	// Assert
+
+	assert.Error(t, err)
+}
+
+// newTestCA returns a self-signed CA certificate.
+func newTestCA(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// InterceptFallbacks relays tunnels to hosts whose interception failed
+// untouched for TTL, so the traffic of clients rejecting the interception CA,
+// e.g. apps pinning certificates, and to origins requiring client
+// certificates keeps flowing. Failing tunnels and requests themselves are
+// not retried, as the client already saw them fail, but their next tunnels
+// are relayed untouched. Hosts are logged and listed for operators to review
+// whether to stop intercepting them.
+type InterceptFallbacks struct {
+	TTL time.Duration
+
+	mu    sync.Mutex
+	now   func() time.Time
+	hosts map[string]InterceptFallback
+}
+
+// InterceptFallback is a host relayed untouched after its interception
+// failed.
+type InterceptFallback struct {
+	Host string `json:"host"`
+	// Reason is why interception failed.
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewInterceptFallbacks returns InterceptFallbacks relaying hosts untouched for
+// ttl.
+func NewInterceptFallbacks(ttl time.Duration) *InterceptFallbacks {
+	return &InterceptFallbacks{TTL: ttl, now: time.Now, hosts: map[string]InterceptFallback{}}
+}
+
+// add relays tunnels to host untouched from now on, as its interception
+// failed for reason.
+func (f *InterceptFallbacks) add(logger *zap.Logger, host, reason string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	now := f.now()
+	_, ok := f.hosts[host]
+	f.hosts[host] = InterceptFallback{Host: host, Reason: reason, Since: now, Expires: now.Add(f.TTL)}
+	f.mu.Unlock()
+	if !ok {
+		logger.Warn("Interception failed, relaying host untouched", zap.String("host", host), zap.String("reason", reason), zap.Duration("ttl", f.TTL))
+	}
+}
+
+// contains reports whether tunnels to host are relayed untouched.
+func (f *InterceptFallbacks) contains(host string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fb, ok := f.hosts[host]
+	if ok && !f.now().Before(fb.Expires) {
+		delete(f.hosts, host)
+		return false
+	}
+	return ok
+}
+
+// List returns the hosts relayed untouched, sorted by host.
+func (f *InterceptFallbacks) List() []InterceptFallback {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	list := []InterceptFallback{}
+	for host, fb := range f.hosts {
+		if !now.Before(fb.Expires) {
+			delete(f.hosts, host)
+			continue
+		}
+		list = append(list, fb)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+// clientHandshakeFailed reports whether err of a TLS handshake with the
+// client of an intercepted tunnel means the client rejected the generated
+// certificate, by sending an alert or closing the connection, rather than
+// timing out.
+func clientHandshakeFailed(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err == io.EOF || strings.Contains(err.Error(), "remote error: tls: ")
+}
+
+// originHandshakeFailed reports whether err of forwarding an intercepted
+// request means the origin refused the TLS handshake, e.g. as it requires a
+// client certificate.
+func originHandshakeFailed(err error) bool {
+	return strings.Contains(err.Error(), "remote error: tls: ")
+}
+
+type interceptFallbackKey struct{}
+
+// interceptFallback falls back to relaying tunnels to host untouched if
+// forwarding an intercepted request to it fails.
+type interceptFallback struct {
+	fallbacks *InterceptFallbacks
+	logger    *zap.Logger
+	host      string
+}
+
+func withInterceptFallback(ctx context.Context, fb *interceptFallback) context.Context {
+	return context.WithValue(ctx, interceptFallbackKey{}, fb)
+}
+
+func interceptFallbackFromContext(ctx context.Context) *interceptFallback {
+	fb, _ := ctx.Value(interceptFallbackKey{}).(*interceptFallback)
+	return fb
+}
+
+// failed falls back for the host of fb if err means the origin refused the
+// TLS handshake.
+func (fb *interceptFallback) failed(err error) {
+	if fb != nil && originHandshakeFailed(err) {
+		fb.fallbacks.add(fb.logger, fb.host, "origin handshake: "+err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInterceptFallbacksExpire(t *testing.T) {
+	// Arrange
+
+	now := time.Now()
+	f := NewInterceptFallbacks(time.Hour)
+	f.now = func() time.Time { return now }
+	f.add(zap.NewNop(), "pinned.example.com", "client handshake: EOF")
+
+	// Act
+
+	contained := f.contains("pinned.example.com")
+	listed := f.List()
+	now = now.Add(time.Hour)
+	expired := f.contains("pinned.example.com")
+
+	// Assert
+
+	assert.True(t, contained)
+	assert.Equal(t, []InterceptFallback{{Host: "pinned.example.com", Reason: "client handshake: EOF", Since: now.Add(-time.Hour), Expires: now}}, listed)
+	assert.False(t, expired)
+	assert.Empty(t, f.List())
+}
+
+// newFallbackTestProxy returns a proxy server intercepting tunnels to
+// 127.0.0.1 with fallbacks, forwarding requests to destinations trusting
+// destPool, and the interceptor.
+func newFallbackTestProxy(t *testing.T, destPool *x509.CertPool) (*httptest.Server, *Interceptor) {
+	interceptor, err := NewInterceptor(newTestCA(t), []string{"127.0.0.1"})
+	require.NoError(t, err)
+	interceptor.Fallbacks = NewInterceptFallbacks(time.Hour)
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	transport.TLSClientConfig = &tls.Config{RootCAs: destPool}
+	p.ForwardingHTTPProxy.Transport = transport
+	p.Interceptor = interceptor
+	return httptest.NewServer(p), interceptor
+}
+
+func TestInterceptFallbackClientRejectsCertificate(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	proxyServer, interceptor := newFallbackTestProxy(t, destPool)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	// The client pins the certificate of the destination, so it rejects the
+	// certificate of the interceptor.
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: destPool},
+		DisableKeepAlives: true,
+	}}
+
+	// Act
+
+	_, interceptedErr := client.Get(destServer.URL)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !interceptor.Fallbacks.contains("127.0.0.1") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := client.Get(destServer.URL)
+
+	// Assert
+
+	assert.Error(t, interceptedErr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	fallbacks := interceptor.Fallbacks.List()
+	require.Len(t, fallbacks, 1)
+	assert.True(t, strings.HasPrefix(fallbacks[0].Reason, "client handshake: "), fallbacks[0].Reason)
+}
+
+func TestInterceptFallbackOriginRequiresClientCertificate(t *testing.T) {
+	// Arrange
+
+	destServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "dummy-response")
+	}))
+	destServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	destServer.StartTLS()
+	defer destServer.Close()
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	proxyServer, interceptor := newFallbackTestProxy(t, destPool)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(interceptor.ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caPool},
+	}}
+
+	// Act
+
+	resp, err := client.Get(destServer.URL)
+
+	// Assert
+
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	fallbacks := interceptor.Fallbacks.List()
+	require.Len(t, fallbacks, 1)
+	assert.Equal(t, "127.0.0.1", fallbacks[0].Host)
+	assert.True(t, strings.HasPrefix(fallbacks[0].Reason, "origin handshake: "), fallbacks[0].Reason)
+}
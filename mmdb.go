@@ -0,0 +1,304 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of MaxMind DB files.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the size of the zero bytes between the search tree and
+// the data section.
+const mmdbDataSeparator = 16
+
+// Data types of MaxMind DB fields.
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdb is a MaxMind DB as used by GeoIP2 and GeoLite2 databases, see
+// https://maxmind.github.io/MaxMind-DB/. It only decodes what looking up
+// countries needs.
+type mmdb struct {
+	b          []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// data is the data section following the search tree.
+	data []byte
+	// ipv4Start is the node of ::/96, where IPv4 addresses start in IPv6
+	// trees.
+	ipv4Start uint
+}
+
+// parseMMDB parses the MaxMind DB b.
+func parseMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("missing MaxMind DB metadata")
+	}
+	meta := b[i+len(mmdbMetadataMarker):]
+	v, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	uintField := func(key string) uint {
+		n, _ := m[key].(uint64)
+		return uint(n)
+	}
+
+	db := &mmdb{
+		b:          b,
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind DB IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	db.data = b[treeSize+mmdbDataSeparator : i]
+
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// lookup returns the offset in the data section of the record of ip, or
+// false if there is none.
+func (db *mmdb) lookup(ip net.IP) (uint, bool) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return 0, false
+	}
+
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return 0, false
+	}
+	offset := node - db.nodeCount - mmdbDataSeparator
+	if offset >= uint(len(db.data)) {
+		return 0, false
+	}
+	return offset, true
+}
+
+// record returns the left record of node if bit is 0, the right one
+// otherwise.
+func (db *mmdb) record(node, bit uint) uint {
+	size := db.recordSize / 4
+	b := db.b[node*size : (node+1)*size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decode decodes the value at offset in the data section.
+func (db *mmdb) decode(offset uint) (interface{}, error) {
+	v, _, err := decodeMMDB(db.data, offset)
+	return v, err
+}
+
+// decodeMMDB decodes the value at offset in the section b, returning it and
+// the offset following it. Maps are decoded as map[string]interface{},
+// arrays as []interface{}, unsigned integers as uint64 and signed ones as
+// int64.
+func decodeMMDB(b []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(b)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := b[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ptr, next, err := decodeMMDBPointer(b, ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := decodeMMDB(b, ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		if offset >= uint(len(b)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(b[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(b)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		ext := uint(0)
+		for _, c := range b[offset : offset+n] {
+			ext = ext<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + ext
+		case 2:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := decodeMMDB(b, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, next, err := decodeMMDB(b, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := decodeMMDB(b, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEnd:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(b)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	field := b[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(field), offset, nil
+	case mmdbBytes:
+		return field, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(field)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(field))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			// 128 bit integers are not needed for countries.
+			return nil, offset, nil
+		}
+		var n uint64
+		for _, c := range field {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range field {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown MaxMind DB data type %d", typ)
+}
+
+// decodeMMDBPointer decodes the pointer with control byte ctrl whose
+// remaining bytes start at offset, returning the offset it points to and the
+// offset following it.
+func decodeMMDBPointer(b []byte, ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if offset+n > uint(len(b)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	ptr := uint(0)
+	if n < 4 {
+		ptr = uint(ctrl & 7)
+	}
+	for _, c := range b[offset : offset+n] {
+		ptr = ptr<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		ptr += 2048
+	case 3:
+		ptr += 526336
+	}
+	return ptr, offset + n, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMMDB(t *testing.T) {
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+
+	cases := []struct {
+		name          string
+		givenData     []byte
+		givenOffset   uint
+		expected      interface{}
+		expectedError bool
+	}{
+		{
+			name:      "String",
+			givenData: []byte{0x42, 'S', 'E'},
+			expected:  "SE",
+		},
+		{
+			name:      "LongString",
+			givenData: append([]byte{0x5e, 0x00, 0x0f}, long...),
+			expected:  string(long),
+		},
+		{
+			name:      "Uint32",
+			givenData: []byte{0xc3, 0x01, 0x00, 0x00},
+			expected:  uint64(65536),
+		},
+		{
+			name:      "ExtendedInt32",
+			givenData: []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe},
+			expected:  int64(-2),
+		},
+		{
+			name:      "Bool",
+			givenData: []byte{0x01, 0x07},
+			expected:  true,
+		},
+		{
+			name: "MapWithPointer",
+			// The key of the map points to the string at offset 0.
+			givenData:   []byte{0x42, 'i', 'd', 0xe1, 0x20, 0x00, 0x42, 'S', 'E'},
+			givenOffset: 3,
+			expected:    map[string]interface{}{"id": "SE"},
+		},
+		{
+			name: "Array",
+			// An array of two strings, after an extended type byte.
+			givenData: []byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'},
+			expected:  []interface{}{"a", "b"},
+		},
+		{
+			name:          "Truncated",
+			givenData:     []byte{0x45, 'S', 'E'},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, _, err := decodeMMDB(tc.givenData, tc.givenOffset)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestParseMMDBErrors(t *testing.T) {
+	_, err := parseMMDB([]byte("not a database"))
+	assert.EqualError(t, err, "missing MaxMind DB metadata")
+}
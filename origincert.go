@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// OriginClientCert is a TLS client certificate presented to intercepted
+// destinations requiring mutual TLS, e.g. corporate APIs.
+type OriginClientCert struct {
+	// Host is the host pattern of destinations the certificate is presented
+	// to, see ResponseHeaderRule.Host for the syntax.
+	Host string
+	// Cert serves the certificate, reloading it once its files change.
+	Cert *CertReloader
+}
+
+// LoadOriginClientCerts reads the client certificates of intercepted
+// destinations from the file at path, one per line as host pattern,
+// certificate file and private key file separated by whitespace, e.g.:
+//
+//	*.corp.example.com /etc/forwardingproxy/corp.crt /etc/forwardingproxy/corp.key
+//
+// The first matching line applies. Empty lines and lines starting with # are
+// ignored.
+func LoadOriginClientCerts(logger *zap.Logger, path string) ([]OriginClientCert, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var certs []OriginClientCert
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed client certificate %q", path, n, line)
+		}
+		cert, err := NewCertReloader(logger, fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		certs = append(certs, OriginClientCert{Host: strings.ToLower(fields[0]), Cert: cert})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// originClientCert returns the client certificate presented to host, or nil
+// if there is none.
+func originClientCert(certs []OriginClientCert, host string) *CertReloader {
+	for _, c := range certs {
+		if matchHostPattern(c.Host, host) {
+			return c.Cert
+		}
+	}
+	return nil
+}
+
+type originClientCertKey struct{}
+
+// withOriginClientCert returns ctx letting TLS connections dialed with it
+// present cert to the destination.
+func withOriginClientCert(ctx context.Context, cert *CertReloader) context.Context {
+	return context.WithValue(ctx, originClientCertKey{}, cert)
+}
+
+// originClientCertFromContext returns the client certificate presented by TLS
+// connections dialed with ctx, or nil if there is none.
+func originClientCertFromContext(ctx context.Context) *CertReloader {
+	cert, _ := ctx.Value(originClientCertKey{}).(*CertReloader)
+	return cert
+}
+
+// getOriginClientCertificate is the tls.Config.GetClientCertificate of the
+// forwarding transport, presenting the client certificate of the request
+// dialing the connection. Connections are pooled per destination, and all
+// requests to a destination present the same certificate, so reused
+// connections present the right one too. Without a certificate the
+// handshake continues without one, leaving the destination to decide.
+func getOriginClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := originClientCertFromContext(cri.Context()); cert != nil {
+		return cert.GetClientCertificate(cri)
+	}
+	return &tls.Certificate{}, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptTunnelOriginClientCert(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "origincert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "corp.crt"), filepath.Join(dir, "corp.key")
+	writeTestCert(t, certPath, keyPath, "corp-client", time.Now())
+	path := filepath.Join(dir, "clientcerts")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Corporate APIs\n127.0.0.1 "+certPath+" "+keyPath+"\n"), 0600))
+	certs, err := LoadOriginClientCerts(nil, path)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name           string
+		givenCerts     []OriginClientCert
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Presented",
+			givenCerts:     certs,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "corp-client",
+		},
+		{
+			name:           "OtherHost",
+			givenCerts:     []OriginClientCert{{Host: "*.corp.example.com", Cert: certs[0].Cert}},
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Bad Gateway\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Destination server
+
+			destServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+			}))
+			destServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			destServer.StartTLS()
+			defer destServer.Close()
+
+			destPool := x509.NewCertPool()
+			destPool.AddCert(destServer.Certificate())
+
+			// Proxy server
+
+			interceptor, err := NewInterceptor(newTestCA(t), []string{"127.0.0.1"})
+			require.NoError(t, err)
+			interceptor.ClientCerts = tc.givenCerts
+
+			p := newTestProxy()
+			p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+			transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+			transport.TLSClientConfig.RootCAs = destPool
+			p.ForwardingHTTPProxy.Transport = transport
+			p.Interceptor = interceptor
+
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			proxyURL, err := url.Parse(proxyServer.URL)
+			require.NoError(t, err)
+
+			caPool := x509.NewCertPool()
+			caPool.AddCert(interceptor.ca)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{RootCAs: caPool},
+			}}
+
+			// Act
+
+			resp, err := client.Get(destServer.URL + "/")
+
+			// Assert
+
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestLoadOriginClientCertsMalformed(t *testing.T) {
+	cases := []struct {
+		name         string
+		givenContent string
+	}{
+		{name: "MissingKey", givenContent: "api.corp.example.com corp.crt\n"},
+		{name: "MissingFiles", givenContent: "api.corp.example.com missing.crt missing.key\n"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			dir, err := ioutil.TempDir("", "origincert")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "clientcerts")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.givenContent), 0600))
+
+			// Act
+
+			_, err = LoadOriginClientCerts(nil, path)
+
+			// Assert
+
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pacPath and wpadPath are the paths serving the PAC file, the latter
+	// being the one WPAD clients request it from.
+	pacPath  = "/proxy.pac"
+	wpadPath = "/wpad.dat"
+
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// PAC serves a proxy auto-config file directing browsers and operating
+// systems to the proxy for all destinations but those bypassing it. It serves
+// the file at /proxy.pac and, for discovery via WPAD, at /wpad.dat.
+//
+// See: https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+type PAC struct {
+	// ProxyAddr is the host and port of the proxy announced. If empty, the
+	// host the PAC file is requested from is announced, which must then be
+	// served by the proxy itself.
+	ProxyAddr string
+	// HTTPS announces the proxy at ProxyAddr as serving TLS. Proxies
+	// announced by the host the PAC file is requested from serve TLS if it
+	// is requested via TLS.
+	HTTPS bool
+	// BypassHosts are host patterns of destinations reached directly, see
+	// ResponseHeaderRule.Host for the syntax.
+	BypassHosts []string
+	// BypassCIDRs are the IPv4 ranges of destinations reached directly,
+	// matching host names resolving into them too.
+	BypassCIDRs []*net.IPNet
+}
+
+// isPACPath reports whether path is one of the paths the PAC file is served
+// at.
+func isPACPath(path string) bool {
+	return path == pacPath || path == wpadPath
+}
+
+func (pac *PAC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isPACPath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr, https := pac.ProxyAddr, pac.HTTPS
+	if addr == "" {
+		https = r.TLS != nil
+		if https {
+			addr = withDefaultPort(r.Host, "443")
+		} else {
+			addr = withDefaultPort(r.Host, "80")
+		}
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(pac.script(addr, https))
+}
+
+// script returns the PAC file announcing the proxy at addr.
+func (pac *PAC) script(addr string, https bool) []byte {
+	var b bytes.Buffer
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	for _, pattern := range pac.BypassHosts {
+		switch {
+		case pattern == "*":
+			b.WriteString("\treturn \"DIRECT\";\n}\n")
+			return b.Bytes()
+		case strings.HasPrefix(pattern, "*."):
+			fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) return \"DIRECT\";\n", strconv.Quote(pattern))
+		default:
+			fmt.Fprintf(&b, "\tif (host == %s) return \"DIRECT\";\n", strconv.Quote(pattern))
+		}
+	}
+	var ranges []*net.IPNet
+	for _, n := range pac.BypassCIDRs {
+		if n.IP.To4() != nil && len(n.Mask) == net.IPv4len {
+			ranges = append(ranges, n)
+		}
+	}
+	if len(ranges) > 0 {
+		// Host names are resolved once for all ranges, failing which they
+		// are reached via the proxy.
+		b.WriteString("\tvar ip = dnsResolve(host);\n")
+		for _, n := range ranges {
+			fmt.Fprintf(&b, "\tif (ip && isInNet(ip, %s, %s)) return \"DIRECT\";\n",
+				strconv.Quote(n.IP.String()), strconv.Quote(net.IP(n.Mask).String()))
+		}
+	}
+	directive := "PROXY "
+	if https {
+		directive = "HTTPS "
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote(directive+addr))
+	return b.Bytes()
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACScript(t *testing.T) {
+	_, private, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	_, v6, err := net.ParseCIDR("fd00::/8")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		givenPAC PAC
+		expected string
+	}{
+		{
+			name:     "NoBypass",
+			givenPAC: PAC{},
+			expected: "function FindProxyForURL(url, host) {\n" +
+				"\thost = host.toLowerCase();\n" +
+				"\treturn \"PROXY proxy.example.com:3128\";\n" +
+				"}\n",
+		},
+		{
+			name: "Bypass",
+			givenPAC: PAC{
+				HTTPS:       true,
+				BypassHosts: []string{"*.internal.example.com", "localhost"},
+				BypassCIDRs: []*net.IPNet{private, v6},
+			},
+			expected: "function FindProxyForURL(url, host) {\n" +
+				"\thost = host.toLowerCase();\n" +
+				"\tif (shExpMatch(host, \"*.internal.example.com\")) return \"DIRECT\";\n" +
+				"\tif (host == \"localhost\") return \"DIRECT\";\n" +
+				"\tvar ip = dnsResolve(host);\n" +
+				"\tif (ip && isInNet(ip, \"10.0.0.0\", \"255.0.0.0\")) return \"DIRECT\";\n" +
+				"\treturn \"HTTPS proxy.example.com:3128\";\n" +
+				"}\n",
+		},
+		{
+			name:     "BypassAll",
+			givenPAC: PAC{BypassHosts: []string{"*"}},
+			expected: "function FindProxyForURL(url, host) {\n" +
+				"\thost = host.toLowerCase();\n" +
+				"\treturn \"DIRECT\";\n" +
+				"}\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := tc.givenPAC.script("proxy.example.com:3128", tc.givenPAC.HTTPS)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, string(observed))
+		})
+	}
+}
+
+func TestProxyServePAC(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.PAC = &PAC{}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+	proxyAddr := proxyServer.Listener.Addr().String()
+
+	cases := []struct {
+		name           string
+		givenMethod    string
+		givenPath      string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "PAC",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/proxy.pac",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "\treturn \"PROXY " + proxyAddr + "\";\n",
+		},
+		{
+			name:           "WPAD",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/wpad.dat",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "\treturn \"PROXY " + proxyAddr + "\";\n",
+		},
+		{
+			name:           "Post",
+			givenMethod:    http.MethodPost,
+			givenPath:      "/proxy.pac",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "OtherPath",
+			givenMethod:    http.MethodGet,
+			givenPath:      "/other",
+			expectedStatus: http.StatusProxyAuthRequired,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.givenMethod, proxyServer.URL+tc.givenPath, nil)
+			require.NoError(t, err)
+
+			// Act
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusOK {
+				assert.Equal(t, pacContentType, resp.Header.Get("Content-Type"))
+				assert.Contains(t, string(body), tc.expectedBody)
+			}
+		})
+	}
+}
+
+func TestProxyServePACThroughProxy(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.PAC = &PAC{}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/proxy.pac", nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, r)
+
+	// Assert
+
+	assert.Equal(t, http.StatusProxyAuthRequired, w.Code, "requests through the proxy are not served")
+}
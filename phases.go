@@ -0,0 +1,148 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// phase is a step in the handling of a request whose duration is tracked, so
+// slow requests can be attributed to a specific phase.
+type phase int
+
+const (
+	phaseAuth phase = iota
+	phaseACL
+	phaseDNS
+	phaseDial
+	phaseFirstByte
+	numPhases
+)
+
+var phaseNames = [numPhases]string{
+	phaseAuth:      "auth",
+	phaseACL:       "acl",
+	phaseDNS:       "dns",
+	phaseDial:      "dial",
+	phaseFirstByte: "firstByte",
+}
+
+// phaseTimings holds the durations of the phases of a single request. The
+// first byte phase lasts from the end of dialing until the first byte was
+// received from the destination.
+//
+// All methods are safe to call on a nil receiver, which records nothing.
+type phaseTimings struct {
+	mu        sync.Mutex
+	start     time.Time
+	durations [numPhases]time.Duration
+	observed  [numPhases]bool
+	// starts are the starts of the first observation of each phase.
+	starts [numPhases]time.Time
+}
+
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{start: time.Now()}
+}
+
+// observe records the duration of ph as the time passed since start.
+func (t *phaseTimings) observe(ph phase, start time.Time) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	t.durations[ph] += d
+	if !t.observed[ph] {
+		t.starts[ph] = start
+	}
+	t.observed[ph] = true
+	t.mu.Unlock()
+}
+
+// duration returns the total duration of ph and whether it was observed.
+func (t *phaseTimings) duration(ph phase) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.durations[ph], t.observed[ph]
+}
+
+// phaseSpan is the start and the duration of an observed phase.
+type phaseSpan struct {
+	phase    phase
+	start    time.Time
+	duration time.Duration
+}
+
+// spans returns the observed phases with the start of their first
+// observation and their total duration.
+func (t *phaseTimings) spans() []phaseSpan {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var spans []phaseSpan
+	for ph, d := range t.durations {
+		if t.observed[ph] {
+			spans = append(spans, phaseSpan{phase: phase(ph), start: t.starts[ph], duration: d})
+		}
+	}
+	return spans
+}
+
+// fields returns the observed phase durations and the total duration since
+// the start of the request as log fields.
+func (t *phaseTimings) fields() []zapcore.Field {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fields := make([]zapcore.Field, 0, numPhases+1)
+	for ph, d := range t.durations {
+		if t.observed[ph] {
+			fields = append(fields, zap.Duration(phaseNames[ph], d))
+		}
+	}
+	return append(fields, zap.Duration("total", time.Since(t.start)))
+}
+
+type phaseTimingsKey struct{}
+
+func withPhaseTimings(ctx context.Context, t *phaseTimings) context.Context {
+	return context.WithValue(ctx, phaseTimingsKey{}, t)
+}
+
+// phaseTimingsFromContext returns the phase timings of ctx, or nil.
+func phaseTimingsFromContext(ctx context.Context) *phaseTimings {
+	t, _ := ctx.Value(phaseTimingsKey{}).(*phaseTimings)
+	return t
+}
+
+// firstByteReader calls onFirstByte once the first byte was read.
+type firstByteReader struct {
+	io.ReadCloser
+	once        sync.Once
+	onFirstByte func()
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.once.Do(r.onFirstByte)
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestPhaseTimingsFields(t *testing.T) {
+	// Arrange
+
+	timings := newPhaseTimings()
+	start := time.Now().Add(-time.Second)
+
+	// Act
+
+	timings.observe(phaseDNS, start)
+	timings.observe(phaseDial, start)
+	fields := timings.fields()
+
+	// Assert
+
+	var keys []string
+	for _, f := range fields {
+		keys = append(keys, f.Key)
+		assert.Equal(t, zapcore.DurationType, f.Type)
+	}
+	assert.True(t, time.Duration(fields[0].Integer) >= time.Second)
+	assert.True(t, time.Duration(fields[1].Integer) >= time.Second)
+	assert.Equal(t, []string{"dns", "dial", "total"}, keys)
+}
+
+func TestPhaseTimingsNil(t *testing.T) {
+	// Arrange
+
+	var timings *phaseTimings
+
+	// Act & Assert
+
+	assert.NotPanics(t, func() { timings.observe(phaseDial, time.Now()) })
+	assert.Nil(t, timings.fields())
+}
+
+func TestProxyLogsRequestPhases(t *testing.T) {
+	// Arrange
+
+	// Destination servers
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	// Proxy server
+
+	var logs syncBuffer
+	p := newTestProxy()
+	p.Logger = newBufferLogger(&logs)
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	p.ForwardingHTTPProxy.Transport = &http.Transport{DialContext: p.DialContext}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyServerURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	// Act
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyServerURL)}}
+	resp, err := client.Get(destServer.URL)
+	require.NoError(t, err)
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", echoListener.Addr())
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	_, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+
+	// Assert
+
+	phaseLogs := 0
+	for _, line := range bytes.Split(logs.Bytes(), []byte("\n")) {
+		if !bytes.Contains(line, []byte(`"msg":"Request phases"`)) {
+			continue
+		}
+		phaseLogs++
+		for _, key := range []string{"auth", "dns", "acl", "dial", "firstByte", "total"} {
+			assert.Contains(t, string(line), `"`+key+`":`)
+		}
+	}
+	assert.Equal(t, 2, phaseLogs)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
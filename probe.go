@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StartupProbe checks that a dependency the proxy requires is reachable.
+type StartupProbe struct {
+	// Name names the dependency, e.g. "upstream".
+	Name string
+	// Check returns an error if the dependency is not reachable.
+	Check func(ctx context.Context) error
+}
+
+// StartupProbes probes the dependencies of the proxy at startup, so the proxy
+// does not silently start in a broken state. Failed probes are retried with
+// exponential backoff.
+type StartupProbes struct {
+	Logger *zap.Logger
+	// Probes are the dependencies to probe, which are probed concurrently.
+	Probes []StartupProbe
+	// Attempts is the number of attempts of each probe, at least one.
+	Attempts int
+	// Backoff is the delay before the first retry of a probe, doubling with
+	// every further retry.
+	Backoff time.Duration
+	// Timeout bounds single attempts, unlimited if zero.
+	Timeout time.Duration
+}
+
+// Run probes all dependencies until they are reachable, all attempts failed
+// or ctx is done. It returns an error naming the unreachable dependencies.
+func (s *StartupProbes) Run(ctx context.Context) error {
+	errs := make([]error, len(s.Probes))
+	var wg sync.WaitGroup
+	for i, probe := range s.Probes {
+		wg.Add(1)
+		go func(i int, probe StartupProbe) {
+			defer wg.Done()
+			errs[i] = s.probe(ctx, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", s.Probes[i].Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unreachable dependencies: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// probe runs the attempts of probe, returning the error of the last one.
+func (s *StartupProbes) probe(ctx context.Context, probe StartupProbe) error {
+	backoff := s.Backoff
+	for attempt := 1; ; attempt++ {
+		err := s.attempt(ctx, probe)
+		if err == nil {
+			s.Logger.Info("Dependency reachable", zap.String("dependency", probe.Name), zap.Int("attempt", attempt))
+			return nil
+		}
+		if attempt >= s.Attempts {
+			return err
+		}
+		s.Logger.Warn("Dependency unreachable, retrying",
+			zap.String("dependency", probe.Name),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (s *StartupProbes) attempt(ctx context.Context, probe StartupProbe) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	return probe.Check(ctx)
+}
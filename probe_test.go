@@ -0,0 +1,76 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStartupProbesRun(t *testing.T) {
+	// Arrange
+
+	flakyAttempts := 0
+	downAttempts := 0
+	s := &StartupProbes{
+		Logger: zap.NewNop(),
+		Probes: []StartupProbe{
+			{Name: "flaky", Check: func(ctx context.Context) error {
+				if flakyAttempts++; flakyAttempts < 3 {
+					return errors.New("connection refused")
+				}
+				return nil
+			}},
+			{Name: "down", Check: func(ctx context.Context) error {
+				downAttempts++
+				return errors.New("connection refused")
+			}},
+			{Name: "slow", Check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+		},
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+		Timeout:  10 * time.Millisecond,
+	}
+
+	// Act
+
+	err := s.Run(context.Background())
+
+	// Assert
+
+	require.Error(t, err)
+	assert.Equal(t, "unreachable dependencies: down: connection refused; slow: context deadline exceeded", err.Error())
+	assert.Equal(t, 3, flakyAttempts)
+	assert.Equal(t, 3, downAttempts)
+}
+
+func TestUpstreamProxyProbe(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	u := &UpstreamProxy{URL: &url.URL{Scheme: "http", Host: addr}}
+
+	// Act
+
+	upErr := u.Probe(context.Background())
+	l.Close()
+	downErr := u.Probe(context.Background())
+
+	// Assert
+
+	assert.NoError(t, upErr)
+	assert.Error(t, downErr)
+}
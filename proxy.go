@@ -4,79 +4,569 @@
 
 // $ openssl req -newkey rsa:2048 -nodes -keyout server.key -new -x509 -sha256 -days 3650 -out server.pem
 
-package main
+package forwardingproxy
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // Proxy is a HTTPS forward proxy.
 type Proxy struct {
-	Logger              *zap.Logger
-	AuthUser            string
-	AuthPass            string
+	Logger   *zap.Logger
+	AuthUser string
+	AuthPass string
+	// Realm is the realm of the challenges sent to clients failing to
+	// authenticate, "proxy" if empty.
+	Realm string
+	// Authenticator, if set, checks the credentials of clients instead of
+	// AuthUser and AuthPass.
+	Authenticator Authenticator
+	// Digest, if set, authenticates clients sending Digest credentials.
+	Digest *DigestAuth
+	// HandshakeAuthenticators, if set, authenticate clients via
+	// connection-oriented schemes such as NTLM or Negotiate.
+	HandshakeAuthenticators []HandshakeAuthenticator
+	// AuthSchemes, if set, are the names of the authentication schemes
+	// offered to clients among the enabled ones, e.g. AuthSchemeDigest to
+	// refuse Basic credentials sent over plaintext. All enabled schemes are
+	// offered if empty. Listener policies may offer others.
+	AuthSchemes []string
+	// ClientCertAuth, if set, authenticates clients presenting a verified TLS
+	// client certificate by their certificate, ahead of their credentials.
+	ClientCertAuth *ClientCertAuth
+	// TokenAuth, if set, authenticates clients sending a bearer token by
+	// their token.
+	TokenAuth *TokenAuth
+	// ReauthPolicy, if set, forces authenticated clients to authenticate
+	// afresh periodically.
+	ReauthPolicy        *ReauthPolicy
 	ForwardingHTTPProxy *httputil.ReverseProxy
 	DestDialTimeout     time.Duration
 	DestReadTimeout     time.Duration
 	DestWriteTimeout    time.Duration
 	ClientReadTimeout   time.Duration
 	ClientWriteTimeout  time.Duration
+	// IdleTimeout is the duration without data relayed in either direction
+	// after which tunnels are closed, unlimited if zero.
+	IdleTimeout time.Duration
+	// HeartbeatIdleTimeout, if non-zero, replaces IdleTimeout for tunnels
+	// carrying heartbeat traffic, such as WebSocket or chat connections
+	// exchanging tiny frames every now and then, so they are not closed by
+	// an idle timeout meant for bulk transfers. Tunnels are classified once
+	// they relayed a few small frames in a row, each a while after the data
+	// before it, and stay classified.
+	HeartbeatIdleTimeout time.Duration
+	// IdleCloseGrace, if non-zero, is the duration idle tunnels wait for
+	// the client and the destination to close their side after sending them
+	// a FIN, before closing the tunnel for good. Which of them responded is
+	// recorded in the access log.
+	IdleCloseGrace time.Duration
+	// MaxTunnelLifetime is the duration after which tunnels are closed
+	// regardless of activity, unlimited if zero.
+	MaxTunnelLifetime time.Duration
+	// Resolver, if set, resolves destination host names instead of the
+	// default resolver.
+	Resolver *Resolver
+	// DeniedCIDRs are the IP ranges destinations must not resolve to.
+	DeniedCIDRs []*net.IPNet
+	// TrustedClientCIDRs are the client IP ranges trusted to request tunnel
+	// timeouts via the X-Proxy-Idle-Timeout header in addition to
+	// authenticated clients.
+	TrustedClientCIDRs []*net.IPNet
+	// MaxRequestedIdleTimeout is the upper bound of tunnel timeouts trusted
+	// clients can request. Requesting timeouts is disabled if zero.
+	MaxRequestedIdleTimeout time.Duration
+	// AllowedClientCIDRs are the client IP ranges allowed to use the proxy
+	// at all. Clients from all IP ranges are allowed if empty.
+	AllowedClientCIDRs []*net.IPNet
+	// AllowedClientCountries are the ISO 3166-1 alpha-2 codes of the
+	// countries clients are allowed to use the proxy from, as looked up in
+	// GeoIP. Clients from all countries are allowed if empty.
+	AllowedClientCountries []string
+	// GeoIP looks up the countries of clients for AllowedClientCountries.
+	GeoIP *GeoIP
+	// ClientRateLimiter, if set, limits the rate of HTTP requests and SOCKS
+	// connections per client IP ahead of authentication.
+	ClientRateLimiter *RateLimiter
+	// AddrLatencies, if set, is used to dial the historically fastest
+	// address of destinations first.
+	AddrLatencies *AddrLatencies
+	// Dialer, if set, connects to the resolved addresses of destinations
+	// instead of a net.Dialer, e.g. to bind a source address or to route
+	// tunnels over a VPN or SSH connection. Connections to Upstream are made
+	// with UpstreamProxy.Dialer.
+	Dialer ContextDialer
+	// DialAttemptTimeout bounds dialing a single resolved address of a
+	// destination, so a black-holed address does not use up DestDialTimeout
+	// before the next address is tried. Unbounded if zero.
+	DialAttemptTimeout time.Duration
+	// DialStagger is the delay after which the next resolved address of a
+	// destination is dialed while earlier attempts are still pending, with
+	// addresses of both IP families alternating unless IPFamilyRules order
+	// them, as in Happy Eyeballs (RFC 8305). Addresses are dialed one after
+	// another if zero.
+	DialStagger time.Duration
+	// DialRetries is the number of times dialing the resolved addresses of
+	// a destination is retried once all of them failed, within
+	// DestDialTimeout. Dials via parent proxies are not retried.
+	DialRetries int
+	// DialRetryBackoff is the delay before the first retry of a dial,
+	// doubling with every further retry.
+	DialRetryBackoff time.Duration
+	// Upstream, if set, is the parent proxy connections to destinations are
+	// made through.
+	Upstream *UpstreamProxy
+	// Routes select per destination whether it is dialed directly, via a
+	// specific parent proxy, from specific source addresses or blocked.
+	// The first matching route applies. Destinations matching no route are
+	// reached via Upstream if set, or dialed directly otherwise.
+	Routes []Route
+	// Blocklist, if set, denies destinations matching any of its patterns
+	// before the ACL is evaluated.
+	Blocklist *Blocklist
+	// ACL, if set, decides which destinations clients may connect to.
+	ACL *ACL
+	// IPFamilyRules restricts or orders the IP families dialed per
+	// destination host. The first matching rule applies.
+	IPFamilyRules []IPFamilyRule
+	// DestRateLimiter, if set, limits the rate of new tunnels per destination
+	// host across all clients.
+	DestRateLimiter *RateLimiter
+	// CircuitBreaker, if set, fails dials to destination hosts fast after
+	// consecutive dial failures.
+	CircuitBreaker *CircuitBreaker
+	// EgressBudget, if set, limits the bytes sent per time window.
+	EgressBudget *EgressBudget
+	// UserPolicies, if set, limits the tunnels, traffic and destinations of
+	// authenticated users.
+	UserPolicies *UserPolicies
+	// SOCKSPolicy, if set, enables SOCKS commands and restricts them to
+	// users and destinations. Only CONNECT is enabled, for all clients, if
+	// nil.
+	SOCKSPolicy *SOCKSPolicy
+	// SOCKSRequireHostnames, if set, refuses SOCKS CONNECT requests and UDP
+	// datagrams to IP addresses, so destinations must be given by host name
+	// and resolved by the proxy, as by socks5h clients, and can not evade
+	// ACL rules on host names.
+	SOCKSRequireHostnames bool
+	// TunnelCap, if set, limits the concurrent tunnels across all clients,
+	// favoring clients holding few tunnels near the limit.
+	TunnelCap *TunnelCap
+	// RetryAfter is the delay clients refused at the tunnel cap are asked to
+	// retry after via the Retry-After header, omitted if zero.
+	RetryAfter time.Duration
+	// ConnLimit, if set, is the limit of the listeners serving p, reported
+	// and changed via the admin API only.
+	ConnLimit *ConnLimit
+	// Grants, if set, temporarily let users reach destinations the ACL
+	// denies.
+	Grants *Grants
+	// DebugCaptures, if set, logs the metadata of the requests and tunnels
+	// of captured users and clients verbosely.
+	DebugCaptures *DebugCaptures
+	// Tracer, if set, exports spans of requests and their tunnels.
+	Tracer *Tracer
+	// Throttle, if set, limits the bandwidth of tunnels, except of those
+	// routed by unthrottled routes, see Route.Unthrottled.
+	Throttle *Throttle
+	// RelayBufferSize is the size of the pooled buffers relaying tunnel
+	// data, and of the chunks spliced, DefaultRelayBufferSize if zero.
+	RelayBufferSize int
+	// Splice lets the kernel relay tunnels between TCP connections without
+	// copying their data through user space, where supported, i.e. on Linux.
+	// Tunnels are copied regardless if throttled, subject to EgressBudget,
+	// recorded in Transcripts or dumped by TunnelDumps.
+	Splice bool
+	// AccessLog, if set, records every tunnel once closed.
+	AccessLog *AccessLog
+	// Recent, if set, keeps the last closed tunnels and denied destinations
+	// for the admin API.
+	Recent *RecentEvents
+	// Transcripts, if set, records a metadata transcript of every tunnel
+	// once closed.
+	Transcripts *Transcripts
+	// TunnelDumps, if set, dumps the raw bytes of the tunnels selected via
+	// the admin API.
+	TunnelDumps *TunnelDumps
+	// AdminToken, if set, is the bearer token the admin API requires of
+	// requests, see RequireAdminToken.
+	AdminToken string
+	// AdminTokens, if set, are further bearer tokens of the admin API by
+	// their scope, e.g. read-only tokens for dashboards.
+	AdminTokens map[string]AdminScope
+	// Accounting, if set, exports the usage of every tunnel once closed.
+	Accounting *Accounting
+	// Metrics, if set, collects operational metrics.
+	Metrics *Metrics
+	// LatencySLOs, if set, tracks the latency objectives of critical
+	// destinations.
+	LatencySLOs *LatencySLOs
+	// IdentitySigner, if set, asserts the authenticated user towards internal
+	// destinations of plain HTTP requests.
+	IdentitySigner *IdentitySigner
+	// ClientCertForwarder, if set, forwards the TLS client certificates of
+	// clients towards internal destinations of plain HTTP requests.
+	ClientCertForwarder *ClientCertForwarder
+	// SigningRules sign plain HTTP requests to matching destinations with
+	// AWS Signature Version 4. The first matching rule applies.
+	SigningRules []SigningRule
+	// Mirror, if set, sends copies of matching plain HTTP requests to
+	// shadow hosts.
+	Mirror *Mirror
+	// Interceptor, if set, decrypts tunnels to matching destinations to
+	// forward their requests like plain HTTP requests.
+	Interceptor *Interceptor
+	// StrictPassthrough guarantees that tunnels are relayed byte for byte
+	// without inspecting their data, for environments prohibiting any
+	// inspection. Interceptor and SNIPolicy are ignored if set.
+	StrictPassthrough bool
+	// SNIPolicy, if set, refuses tunnels whose TLS server name does not
+	// match their destination.
+	SNIPolicy *SNIPolicy
+	// HeaderPolicy, if set, rewrites the headers of all plain HTTP requests
+	// forwarded, e.g. to hide the addresses of clients.
+	HeaderPolicy *HeaderPolicy
+	// UserHeaderPolicies rewrite the headers of the plain HTTP requests of
+	// users by their name, after HeaderPolicy and the policy of the
+	// listener.
+	UserHeaderPolicies map[string]*HeaderPolicy
+	// ProxyAgent, if set, is sent as Proxy-Agent header in responses to
+	// CONNECT requests.
+	ProxyAgent string
+	// SendProxyProtocol is the version of the PROXY protocol header sent to
+	// destinations of tunnels ahead of the tunneled data, announcing the
+	// address of the client. No header is sent if zero.
+	SendProxyProtocol int
+	// UsageHost, if set, is the host name under which the proxy itself
+	// serves authenticated users their usage at /me/usage, e.g.
+	// http://proxy.internal/me/usage requested through the proxy, and
+	// accepts reports of tunnel failures observed by clients at
+	// /me/failures.
+	UsageHost string
+	// PAC, if set, serves a proxy auto-config file to requests for
+	// /proxy.pac and /wpad.dat made to the proxy itself rather than through
+	// it, without authentication, as browsers fetch it without credentials.
+	PAC *PAC
+	// Hooks are called along the life cycle of plain HTTP requests and
+	// tunnels, in order.
+	Hooks []Hooks
+
+	// destConns, if set, tracks the destination connections of tunnels. It
+	// is only set by tests asserting connections are not leaked.
+	destConns *connTracker
+	// tunnels tracks the open tunnels.
+	tunnels tunnelRegistry
+	// listenerACLs is non-zero once any listener policy has an ACL.
+	listenerACLs int32
+
+	authOnce   sync.Once
+	authHeader string
+	// connCredentials caches the credentials authenticated per client
+	// connection, see ConnState.
+	connCredentials connCredentials
+
+	hooksOnce    sync.Once
+	builtinHooks []Hooks
+
+	connectRespOnce sync.Once
+	connectResp10   []byte
+	connectResp11   []byte
+
+	// relayBufSize, accessed atomically, overrides RelayBufferSize if
+	// positive, see SetRelayBufferSize.
+	relayBufSize int32
+	relayBufs    sync.Pool
+}
+
+// Default timeouts and dial stagger of proxies returned by New.
+const (
+	DefaultDestDialTimeout    = 10 * time.Second
+	DefaultDestReadTimeout    = 5 * time.Second
+	DefaultDestWriteTimeout   = 5 * time.Second
+	DefaultClientReadTimeout  = 5 * time.Second
+	DefaultClientWriteTimeout = 5 * time.Second
+	DefaultIdleTimeout        = time.Minute
+	DefaultDialStagger        = 250 * time.Millisecond
+)
+
+// New returns a proxy without authentication logging to logger, with default
+// timeouts, denying destinations resolving to PrivateCIDRs and forwarding
+// plain HTTP requests via DialContext, so they are subject to the same address
+// checks as tunnels. The fields of the returned
+// proxy can be changed before it starts serving; ForwardingHTTPProxy keeps
+// DefaultDestReadTimeout as response header timeout though.
+func New(logger *zap.Logger) *Proxy {
+	p := &Proxy{
+		Logger:              logger,
+		ForwardingHTTPProxy: NewForwardingHTTPProxy(zap.NewStdLog(logger), nil),
+		DestDialTimeout:     DefaultDestDialTimeout,
+		DestReadTimeout:     DefaultDestReadTimeout,
+		DestWriteTimeout:    DefaultDestWriteTimeout,
+		ClientReadTimeout:   DefaultClientReadTimeout,
+		ClientWriteTimeout:  DefaultClientWriteTimeout,
+		IdleTimeout:         DefaultIdleTimeout,
+		DialStagger:         DefaultDialStagger,
+		DeniedCIDRs:         PrivateCIDRs(),
+	}
+	p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, DefaultDestReadTimeout)
+	return p
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.Logger.Info("Incoming request", zap.String("host", r.Host))
+	defer p.recoverHandler()
 
-	if p.AuthUser != "" && p.AuthPass != "" {
-		user, pass, ok := parseBasicProxyAuth(r.Header.Get("Proxy-Authorization"))
-		if !ok || user != p.AuthUser || pass != p.AuthPass {
-			p.Logger.Warn("Authorization attempt with invalid credentials")
-			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
-			return
+	p.logHost(zap.InfoLevel, "Incoming request", r.Host)
+
+	switch p.admitClient(r.RemoteAddr) {
+	case errClientNotAllowed:
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	case errClientRateLimited:
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	if p.PAC != nil && r.Method != http.MethodConnect && r.URL.Host == "" && isPACPath(r.URL.Path) {
+		p.PAC.ServeHTTP(w, r)
+		return
+	}
+
+	timings := newPhaseTimings()
+	r = r.WithContext(withPhaseTimings(r.Context(), timings))
+	span := p.Tracer.start(r.Method, timings.start, r.Header.Get(traceparentHeader), timings)
+	if span != nil {
+		span.setAttr("http.request.method", r.Method)
+		span.setAttr("client.address", clientIP(requestAddr(r.RemoteAddr)))
+		r = r.WithContext(withSpan(r.Context(), span))
+		defer span.end()
+	}
+
+	user, ok := p.authorize(r)
+	if !ok {
+		span.setIntAttr("http.response.status_code", http.StatusProxyAuthRequired)
+		p.Metrics.authFailure()
+		p.Logger.Warn("Authorization attempt with invalid credentials")
+		p.captureAuthFailure(r)
+		p.challenge(w, r)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	timings.observe(phaseAuth, timings.start)
+	if user != "" {
+		span.setAttr("enduser.id", user)
+	}
+	p.captureRequest(r, user)
+	if p.Grants != nil {
+		r = r.WithContext(p.withDialUser(r.Context(), user))
+	}
+
+	if !p.ReauthPolicy.allow(user, r.Method == http.MethodConnect) {
+		p.Logger.Info("Forcing re-authentication", zap.String("user", user))
+		// The challenge prompts clients for credentials, e.g. browsers ask
+		// their users again rather than silently resending cached ones.
+		p.challenge(w, r)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+
+	// Usage is served ahead of the limits, so users can see why they are
+	// refused.
+	if p.UsageHost != "" && r.Method != http.MethodConnect && destinationKey(r.Host) == p.UsageHost {
+		if r.URL.Path == failureReportPath {
+			p.serveFailureReport(w, r, user)
+		} else {
+			p.serveUsage(w, r, user)
 		}
+		return
 	}
 
+	if isConnectUDP(r) {
+		p.Metrics.connection(connKindConnect)
+		p.handleConnectUDP(w, r, user)
+		return
+	}
 	if r.URL.Scheme == "http" {
-		p.handleHTTP(w, r)
+		p.Metrics.connection(connKindHTTP)
+		if !p.connectHTTP(w, r, user, r.URL.Host) {
+			return
+		}
+		p.handleHTTP(w, r, user)
 	} else {
-		p.handleTunneling(w, r)
+		p.Metrics.connection(connKindConnect)
+		p.handleTunneling(w, r, user)
 	}
 }
 
-func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	p.Logger.Debug("Got HTTP request", zap.String("host", r.Host))
+func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request, user string) {
+	p.logHost(zap.DebugLevel, "Got HTTP request", r.Host)
+	r.Header.Del(idleTimeoutHeader)
+	span := spanFromContext(r.Context())
+	span.setDestination(r.URL.Host)
+	if err := p.checkACL(r.Context(), r.URL); err != nil {
+		if _, ok := err.(*aclDeniedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if hp := p.headerPolicyFor(r.Context(), user); hp != nil {
+		hp.apply(r.Header)
+		r = r.WithContext(withHeaderPolicy(r.Context(), hp))
+	}
+	if p.IdentitySigner != nil {
+		if err := p.IdentitySigner.Apply(r, user); err != nil {
+			p.Logger.Error("Signing identity failed", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.ClientCertForwarder != nil {
+		p.ClientCertForwarder.Apply(r)
+	}
+	if err := signRequest(p.SigningRules, r); err != nil {
+		if err == errSignedBodyTooLarge {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		p.Logger.Error("Signing request failed", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	// The destination continues the trace of the request from the span of
+	// the proxy.
+	if span != nil {
+		r.Header.Set(traceparentHeader, span.traceparent())
+	}
+	// Upgrades are relayed as tunnels, as the transport of the reverse
+	// proxy can not switch protocols.
+	if protocol := upgradeType(r); protocol != "" {
+		p.handleUpgrade(w, r, user, protocol)
+		return
+	}
+	p.mirrorRequest(r)
+	if span != nil {
+		w = &statusResponseWriter{ResponseWriter: w, span: span}
+	}
+	if p.Metrics != nil {
+		w = &countingResponseWriter{ResponseWriter: w, n: &p.Metrics.downstreamBytes}
+		if r.ContentLength != 0 {
+			r.Body = p.Metrics.upstream(r.Body)
+		}
+	}
+	if p.EgressBudget != nil {
+		w = &budgetResponseWriter{ResponseWriter: w, budget: p.EgressBudget, user: user}
+		if r.ContentLength != 0 {
+			r.Body = &budgetReadCloser{ReadCloser: r.Body, budget: p.EgressBudget, user: user}
+		}
+	}
+
+	timings := phaseTimingsFromContext(r.Context())
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			start = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			timings.observe(phaseFirstByte, start)
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	if _, ok := p.DebugCaptures.find(clientIP(requestAddr(r.RemoteAddr)), user); ok {
+		captured := &captureResponseWriter{ResponseWriter: w}
+		defer p.captureResponse(r, user, captured, time.Now())
+		w = captured
+	}
 	p.ForwardingHTTPProxy.ServeHTTP(w, r)
+
+	p.logPhases(timings, r.Host)
+	p.LatencySLOs.observe(r.Host, timings)
 }
 
-func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request, user string) {
 	if r.Method != http.MethodConnect {
 		p.Logger.Info("Method not allowed", zap.String("method", r.Method))
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	p.Logger.Debug("Connecting", zap.String("host", r.Host))
+	host, ok := connectTarget(r)
+	if !ok {
+		p.Logger.Info("Invalid CONNECT target", zap.String("target", r.RequestURI))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	spanFromContext(r.Context()).setDestination(host)
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		r = r.WithContext(withRequestID(r.Context(), id))
+	}
 
-	destConn, err := net.DialTimeout("tcp", r.Host, p.DestDialTimeout)
-	if err != nil {
-		p.Logger.Error("Destination dial failed", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	if !p.connectHTTP(w, r, user, host) {
+		return
+	}
+	userTunnel, err := p.openTunnel(user, clientIP(requestAddr(r.RemoteAddr)))
+	if err == errTunnelCapReached {
+		if v := retryAfterValue(p.RetryAfter); v != "" {
+			w.Header().Set("Retry-After", v)
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 		return
 	}
+	setup := &tunnelSetup{userTunnel: userTunnel}
+	defer setup.release()
 
-	p.Logger.Debug("Connected", zap.String("host", r.Host))
+	if !p.StrictPassthrough && p.Interceptor != nil && p.Interceptor.intercepts(host) {
+		setup.handOver()
+		p.interceptTunnel(w, r, host, user, userTunnel)
+		return
+	}
+
+	destConn, err := p.dialTunnel(r.Context(), "tcp", host)
+	if err != nil {
+		spanFromContext(r.Context()).fail(err)
+		p.captureTunnelRefused(r.Context(), clientIP(requestAddr(r.RemoteAddr)), user, host, err)
+		switch err.(type) {
+		case *deniedAddrError:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		case *aclDeniedError:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case *rateExceededError:
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	setup.destConn = destConn
 
-	w.WriteHeader(http.StatusOK)
+	// HTTP/2 streams can not be hijacked, so their tunnels are relayed over
+	// the request and response bodies instead.
+	if r.ProtoMajor == 2 {
+		setup.handOver()
+		p.relayStream(w, r, destConn, host, user, userTunnel)
+		return
+	}
 
-	p.Logger.Debug("Hijacking", zap.String("host", r.Host))
+	p.logHost(zap.DebugLevel, "Hijacking", host)
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -84,29 +574,366 @@ func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		p.Logger.Error("Hijacking failed", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	setup.clientConn = clientConn
 
-	p.Logger.Debug("Hijacked connection", zap.String("host", r.Host))
+	p.logHost(zap.DebugLevel, "Hijacked connection", host)
 
-	now := time.Now()
-	clientConn.SetReadDeadline(now.Add(p.ClientReadTimeout))
-	clientConn.SetWriteDeadline(now.Add(p.ClientWriteTimeout))
-	destConn.SetReadDeadline(now.Add(p.DestReadTimeout))
-	destConn.SetWriteDeadline(now.Add(p.DestWriteTimeout))
+	// The status line is written on the raw connection rather than through
+	// the ResponseWriter, as the latter may add Content-Length or
+	// Transfer-Encoding headers which are not allowed in a successful
+	// response to CONNECT (RFC 7231, section 4.3.6).
+	if err = p.writeConnectResponse(clientConn, r); err != nil {
+		p.Logger.Error("Writing CONNECT response failed", zap.Error(err))
+		return
+	}
+	var hello []byte
+	if p.checksSNI() {
+		if hello, err = p.checkTunnelSNI(clientConn, clientBuf.Reader, host, user); err != nil {
+			p.captureTunnelRefused(r.Context(), clientIP(requestAddr(r.RemoteAddr)), user, host, err)
+			return
+		}
+	}
+	if err = p.sendProxyHeader(destConn, clientConn.RemoteAddr()); err != nil {
+		p.Logger.Error("Writing PROXY protocol header failed", zap.Error(err))
+		return
+	}
 
-	go transfer(destConn, clientConn)
-	go transfer(clientConn, destConn)
+	// Forward any bytes the client sent ahead of the response, e.g. an
+	// eagerly sent TLS ClientHello, that were buffered by the server, after
+	// those read checking the SNI.
+	if n := clientBuf.Reader.Buffered(); n > 0 || len(hello) > 0 {
+		b, _ := clientBuf.Reader.Peek(n)
+		b = append(hello, b...)
+		n = len(b)
+		if _, err = destConn.Write(b); err != nil {
+			p.Logger.Error("Forwarding buffered client data failed", zap.Error(err))
+			return
+		}
+		if p.EgressBudget != nil {
+			p.EgressBudget.Add(user, int64(n))
+		}
+	}
+
+	setup.handOver()
+	p.relay(r.Context(), clientConn, destConn, host, user, nil, userTunnel, p.tunnelTimeouts(r))
 }
 
-func transfer(dest io.WriteCloser, src io.ReadCloser) {
-	defer func() { _ = dest.Close() }()
-	defer func() { _ = src.Close() }()
-	_, _ = io.Copy(dest, src)
+// dialTunnel connects to the destination host of a tunnel via network, "tcp"
+// or "udp", unless the rate of new tunnels to host is exceeded.
+func (p *Proxy) dialTunnel(ctx context.Context, network, host string) (net.Conn, error) {
+	if p.DestRateLimiter != nil && !p.DestRateLimiter.Allow(destinationKey(host)) {
+		p.Logger.Warn("Destination connection rate exceeded", zap.String("host", host))
+		return nil, &rateExceededError{Host: host}
+	}
+
+	p.logHost(zap.DebugLevel, "Connecting", host)
+
+	destConn, err := p.DialContext(ctx, network, host)
+	if err != nil {
+		if _, open := err.(*circuitOpenError); !open && !isDeniedAddrError(err) {
+			p.Logger.Error("Destination dial failed", append(phaseTimingsFromContext(ctx).fields(), zap.Error(err))...)
+		}
+		return nil, err
+	}
+
+	p.logHost(zap.DebugLevel, "Connected", host)
+
+	return p.destConns.track(destConn), nil
+}
+
+// sendProxyHeader writes a PROXY protocol header announcing client to
+// destConn if enabled.
+func (p *Proxy) sendProxyHeader(destConn net.Conn, client net.Addr) error {
+	if p.SendProxyProtocol == 0 {
+		return nil
+	}
+	return writeProxyHeader(destConn, p.SendProxyProtocol, client, destConn.RemoteAddr())
+}
+
+// relay applies timeouts to both connections of a tunnel to host and starts
+// copying data between them in both directions. The connections are closed
+// once either direction ends, or immediately if p is shutting down or ctx,
+// the context of the request of the tunnel, is done already, and userTunnel
+// is closed along with them. metadata sent by the client, if any, is
+// recorded in the access log.
+func (p *Proxy) relay(ctx context.Context, clientConn, destConn net.Conn, host, user string, metadata map[string]string, userTunnel *userTunnel, timeouts tunnelTimeouts) {
+	if err := ctx.Err(); err != nil {
+		p.Logger.Info("Refusing tunnel of canceled request", zap.String("host", host), zap.Error(err))
+		_ = clientConn.Close()
+		_ = destConn.Close()
+		userTunnel.close()
+		return
+	}
+	timings := phaseTimingsFromContext(ctx)
+
+	tunnel := &tunnelConns{client: clientConn, dest: destConn, host: host, user: user}
+	if _, ok := p.tunnels.add(ctx, tunnel); !ok {
+		p.logHost(zap.InfoLevel, "Refusing tunnel while shutting down", host)
+		_ = clientConn.Close()
+		_ = destConn.Close()
+		userTunnel.close()
+		return
+	}
+	span := spanFromContext(ctx)
+	span.tunnel()
+
+	start := time.Now()
+	activity := newTunnelActivity(timeouts, start)
+	clientConn = &activityConn{Conn: tunnel.countClient(clientConn), activity: activity, writeTimeout: timeouts.ClientWrite}
+	destConn = &activityConn{Conn: destConn, activity: activity, writeTimeout: timeouts.DestWrite}
+
+	destReader := &firstByteReader{
+		ReadCloser: destConn,
+		onFirstByte: func() {
+			timings.observe(phaseFirstByte, start)
+			p.logPhases(timings, host)
+			p.LatencySLOs.observe(host, timings)
+		},
+	}
+
+	var throttle *tunnelThrottle
+	if !p.routeUnthrottled(host) {
+		throttle = p.Throttle.open(user)
+	}
+	transcript := p.Transcripts.open(start)
+
+	// The tunnel is closed once either direction ended, for the reason it
+	// ended, which ends the other direction too. It is accounted for once
+	// both directions ended.
+	p.Metrics.tunnelOpened()
+	rec := &AccessRecord{Client: clientIP(clientConn.RemoteAddr()), User: user, RequestID: requestIDFromContext(ctx), Metadata: metadata, Destination: host, Start: start}
+	p.onTunnelEstablished(ctx, ClientInfo{Addr: rec.Client, User: user, Metadata: metadata}, host)
+	dump := p.TunnelDumps.open(tunnel.id, rec)
+	ended := func(eofReason string) func(error) {
+		return func(err error) {
+			reason := terminationReason(err, eofReason, activity)
+			if reason == reasonIdleTimeout && p.IdleCloseGrace > 0 {
+				tunnel.closeIdle(p.IdleCloseGrace)
+				return
+			}
+			tunnel.closeFor(reason)
+		}
+	}
+	remaining := int32(2)
+	done := func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			d := time.Since(start)
+			throttle.close()
+			userTunnel.close()
+			rec.Reason = tunnel.reason
+			rec.GracefulClose = tunnel.graceful
+			rec.Duration = d.Seconds()
+			p.TunnelDumps.close(dump, rec)
+			p.accountTunnel(ctx, rec, d, transcript)
+			span.endTunnel(*rec)
+			p.tunnels.remove(tunnel)
+		}
+	}
+	if spliceClient, spliceDest := p.spliceable(tunnel, throttle, transcript, dump); spliceClient != nil {
+		go func() {
+			rec.BytesUp = p.splice(spliceDest, spliceClient, activity, timeouts.DestWrite, p.splicedUpstream(tunnel), ended(reasonClientClosed))
+			done()
+		}()
+		go func() {
+			rec.BytesDown = p.splice(spliceClient, spliceDest, activity, timeouts.ClientWrite, p.splicedDownstream(tunnel, destReader.onFirstByte), ended(reasonDestinationClosed))
+			done()
+		}()
+		return
+	}
+	go func() {
+		rec.BytesUp = p.transfer(destConn, dump.upstream(transcript.upstream(p.Metrics.upstream(clientConn))), user, throttle, ended(reasonClientClosed))
+		done()
+	}()
+	go func() {
+		rec.BytesDown = p.transfer(clientConn, dump.downstream(transcript.downstream(p.Metrics.downstream(destReader))), user, throttle, ended(reasonDestinationClosed))
+		done()
+	}()
+}
+
+// accountTunnel accounts for the tunnel of rec closed after d, whose
+// transcript is recorded by transcript, in the metrics, the access log, the
+// transcripts and the OnTunnelClosed hooks, which include Accounting.
+func (p *Proxy) accountTunnel(ctx context.Context, rec *AccessRecord, d time.Duration, transcript *tunnelTranscript) {
+	p.Metrics.tunnelClosed(d)
+	p.AccessLog.log(rec)
+	p.Recent.tunnelClosed(rec)
+	p.Transcripts.record(transcript, rec)
+	p.onTunnelClosed(ctx, *rec)
+}
+
+// connectTarget returns the host and port to connect to for the CONNECT
+// request r. The target is taken from the request URI, as HTTP/1.0 clients
+// may not send a Host header, falling back to the Host header.
+func connectTarget(r *http.Request) (string, bool) {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil || h == "" || port == "" {
+		return "", false
+	}
+	return host, true
+}
+
+// destinationKey returns the normalized host name of the host and port
+// hostport.
+func destinationKey(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// writeConnectResponse writes a "200 Connection Established" response to conn,
+// using the protocol version of the request r.
+func (p *Proxy) writeConnectResponse(conn net.Conn, r *http.Request) error {
+	p.connectRespOnce.Do(func() {
+		h := "200 Connection Established\r\n"
+		if p.ProxyAgent != "" {
+			h += "Proxy-Agent: " + p.ProxyAgent + "\r\n"
+		}
+		h += "\r\n"
+		p.connectResp10 = []byte("HTTP/1.0 " + h)
+		p.connectResp11 = []byte("HTTP/1.1 " + h)
+	})
+	resp := p.connectResp11
+	if r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		resp = p.connectResp10
+	}
+	_, err := conn.Write(resp)
+	return err
+}
+
+// logHost logs msg with the given host at level. Unlike calling the logger
+// directly, it does not allocate if level is disabled.
+func (p *Proxy) logHost(level zapcore.Level, msg, host string) {
+	if ce := p.Logger.Check(level, msg); ce != nil {
+		ce.Write(zap.String("host", host))
+	}
+}
+
+// logPhases logs the phase durations of a request to host.
+func (p *Proxy) logPhases(timings *phaseTimings, host string) {
+	if ce := p.Logger.Check(zap.InfoLevel, "Request phases"); ce != nil {
+		ce.Write(append(timings.fields(), zap.String("host", host))...)
+	}
+}
+
+// transfer copies src to dest until either fails or src is closed, and
+// returns the number of bytes copied. ended is called with the error ending
+// the copy, and must close both connections.
+func (p *Proxy) transfer(dest io.Writer, src io.Reader, user string, throttle *tunnelThrottle, ended func(error)) (n int64) {
+	// Panics end the transfer like errors, once recovered.
+	err := errRelayPanicked
+	defer func() { ended(err) }()
+	defer p.recoverRelay()
+	var w io.Writer = dest
+	if p.EgressBudget != nil {
+		w = &budgetWriter{w: w, budget: p.EgressBudget, user: user}
+	}
+	if throttle != nil {
+		w = &throttledWriter{w: w, throttle: throttle}
+	}
+	buf := p.relayBuffer()
+	defer p.putRelayBuffer(buf)
+	n, err = io.CopyBuffer(w, src, *buf)
+	return n
+}
+
+// authorize checks the proxy credentials of r if authentication is enabled,
+// and returns the authenticated user.
+func (p *Proxy) authorize(r *http.Request) (user string, ok bool) {
+	if !p.authRequiredFor(r) {
+		return "", true
+	}
+	if user, credentials := p.certUser(r); credentials {
+		if user == "" {
+			return "", false
+		}
+	} else if user != "" {
+		return user, true
+	}
+
+	authz := r.Header.Get("Proxy-Authorization")
+	if p.TokenAuth != nil && strings.HasPrefix(authz, bearerPrefix) && p.offersScheme(r, AuthSchemeBearer) {
+		return p.authenticateToken(r.Context(), authz[len(bearerPrefix):])
+	}
+	if p.Digest != nil && strings.HasPrefix(authz, digestPrefix) && p.offersScheme(r, AuthSchemeDigest) {
+		return p.authenticateDigest(r, authz[len(digestPrefix):])
+	}
+	if len(p.HandshakeAuthenticators) > 0 {
+		if user, ok, handled := p.authenticateHandshake(r, authz); handled {
+			return user, ok
+		}
+	}
+	if !p.offersScheme(r, AuthSchemeBasic) {
+		return "", false
+	}
+	if p.Authenticator == nil && p.staticAuth() {
+		// Comparing the header with the encoded credentials avoids decoding
+		// the header, and thus allocations, for the common case of clients
+		// sending valid credentials.
+		p.authOnce.Do(func() {
+			p.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(p.AuthUser+":"+p.AuthPass))
+		})
+		if subtle.ConstantTimeCompare([]byte(authz), []byte(p.authHeader)) == 1 {
+			return p.AuthUser, true
+		}
+	}
+
+	user, pass, ok := parseBasicProxyAuth(authz)
+	if !ok {
+		return "", false
+	}
+	if cached, ok := p.connCredentials.lookup(r.RemoteAddr, authz); ok {
+		return cached, true
+	}
+	user, ok = p.authenticate(r.Context(), user, pass, r)
+	if ok {
+		p.connCredentials.store(r.RemoteAddr, authz, user)
+	}
+	return user, ok
+}
+
+// authRequired reports whether clients must authenticate.
+func (p *Proxy) authRequired() bool {
+	return p.basicAuth() || p.ClientCertAuth != nil || p.TokenAuth != nil || p.Digest != nil ||
+		len(p.HandshakeAuthenticators) > 0
+}
+
+// staticAuth reports whether clients authenticate with AuthUser and
+// AuthPass.
+func (p *Proxy) staticAuth() bool {
+	return p.AuthUser != "" && p.AuthPass != ""
+}
+
+// authenticate checks user and pass with Authenticator, or against AuthUser
+// and AuthPass if it is not set, and returns the authenticated user.
+func (p *Proxy) authenticate(ctx context.Context, user, pass string, r *http.Request) (string, bool) {
+	a := p.Authenticator
+	if a == nil {
+		// Clients authenticating by certificate only have no credentials.
+		if !p.staticAuth() {
+			return "", false
+		}
+		a = &StaticAuthenticator{User: p.AuthUser, Pass: p.AuthPass}
+	}
+	id, err := a.Authenticate(ctx, user, pass, r)
+	if err != nil {
+		if err != ErrInvalidCredentials {
+			p.Logger.Error("Authentication failed", zap.String("user", user), zap.Error(err))
+		}
+		return "", false
+	}
+	return id.User, true
 }
 
 // parseBasicProxyAuth parses an HTTP Basic Authorization string.
@@ -130,20 +957,77 @@ func parseBasicProxyAuth(authz string) (username, password string, ok bool) {
 
 // NewForwardingHTTPProxy retuns a new reverse proxy that takes an incoming
 // request and sends it to another server, proxying the response back to the
-// client.
+// client. Responses for destinations matching any of headerRules get the
+// headers of those rules added.
+//
+// Hop-by-hop headers are removed and an X-Forwarded-For header is added by the
+// reverse proxy, and a Via header is added to both the forwarded request and
+// response, unless the header policy of the request hides them.
 //
 // See: https://golang.org/pkg/net/http/httputil/#ReverseProxy
-func NewForwardingHTTPProxy(logger *log.Logger) *httputil.ReverseProxy {
+func NewForwardingHTTPProxy(logger *log.Logger, headerRules []ResponseHeaderRule) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
 		if _, ok := req.Header["User-Agent"]; !ok {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
 		}
+		if !headerPolicyFromContext(req.Context()).forwarded(req.Header, req.ProtoMajor, req.ProtoMinor) {
+			// A nil value keeps the reverse proxy from adding the header.
+			req.Header["X-Forwarded-For"] = nil
+		}
+	}
+	modifyResponse := func(resp *http.Response) error {
+		if fc := filterChainFromContext(resp.Request.Context()); fc != nil {
+			if err := fc.filterResponse(resp); err != nil {
+				return err
+			}
+		}
+		if rw := responseRewriterFromContext(resp.Request.Context()); rw != nil {
+			rw.apply(resp)
+		}
+		if cp := contentPolicyFromContext(resp.Request.Context()); cp != nil {
+			if err := cp.apply(resp); err != nil {
+				return err
+			}
+		}
+		addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		// Hop-by-hop headers are already removed at this point, and rules
+		// are not allowed to contain any.
+		injectResponseHeaders(headerRules, resp.Request.URL.Host, resp.Header)
+		return nil
+	}
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
+		spanFromContext(r.Context()).fail(err)
+		interceptFallbackFromContext(r.Context()).failed(err)
+		// Request bodies denied by filters while being forwarded.
+		if fe, ok := err.(*FilterError); ok {
+			http.Error(w, fe.Error(), http.StatusForbidden)
+			return
+		}
+		if _, ok := err.(*circuitOpenError); ok {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if isDeniedAddrError(err) {
+			if opErr, ok := err.(*net.OpError); ok {
+				err = opErr.Err
+			}
+			if _, ok := err.(*aclDeniedError); ok {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if logger != nil {
+			logger.Printf("http: proxy error: %v", err)
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 	}
-	// TODO:(alesr) Use timeouts specified via flags to customize the default
-	// transport used by the reverse proxy.
 	return &httputil.ReverseProxy{
-		ErrorLog: logger,
-		Director: director,
+		ErrorLog:       logger,
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
 	}
 }
@@ -1,18 +1,25 @@
 // Copyright (C) 2018 Betalo AB - All Rights Reserved
 
-package main
+package forwardingproxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestParseBasicProxyAuth(t *testing.T) {
@@ -68,7 +75,7 @@ func TestNewForwardingHTTPProxy(t *testing.T) {
 
 	// Proxy server
 
-	forwardingHTTPProxy := NewForwardingHTTPProxy(nil)
+	forwardingHTTPProxy := NewForwardingHTTPProxy(nil, nil)
 	proxyServer := httptest.NewServer(forwardingHTTPProxy)
 	defer proxyServer.Close()
 
@@ -112,3 +119,304 @@ func TestNewForwardingHTTPProxy(t *testing.T) {
 
 	assert.Equal(t, "dummy-response", strings.TrimSpace(string(b)))
 }
+
+func TestNew(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	cases := []struct {
+		name               string
+		givenDeniedCIDRs   string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Permitted",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Denied",
+			givenDeniedCIDRs:   "127.0.0.0/8",
+			expectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Proxy server
+
+			p := New(zap.NewNop())
+			deniedCIDRs, err := ParseCIDRs(tc.givenDeniedCIDRs)
+			require.NoError(t, err)
+			p.DeniedCIDRs = deniedCIDRs
+
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			proxyServerURL, err := url.Parse(proxyServer.URL)
+			require.NoError(t, err)
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(proxyServerURL),
+				},
+			}
+
+			// Act
+
+			resp, err := client.Get(destServer.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			// Assert
+
+			assert.Equal(t, DefaultDestDialTimeout, p.DestDialTimeout)
+			assert.Equal(t, tc.expectedStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestProxyConnect(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.ProxyAgent = "forwardingproxy"
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	destAddr := destListener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, "200 Connection Established", resp.Status)
+	assert.Equal(t, "forwardingproxy", resp.Header.Get("Proxy-Agent"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Empty(t, resp.TransferEncoding)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestProxyConnectHTTP10(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	proxyServer := httptest.NewServer(newTestProxy())
+	defer proxyServer.Close()
+
+	cases := []struct {
+		name               string
+		givenRequest       string
+		expectedStatusLine string
+		expectedRelay      bool
+	}{
+		{
+			name:               "WithoutHost",
+			givenRequest:       "CONNECT " + destAddr + " HTTP/1.0\r\n\r\n",
+			expectedStatusLine: "HTTP/1.0 200 Connection Established\r\n",
+			expectedRelay:      true,
+		},
+		{
+			name:               "WithHost",
+			givenRequest:       "CONNECT " + destAddr + " HTTP/1.0\r\nHost: " + destAddr + "\r\n\r\n",
+			expectedStatusLine: "HTTP/1.0 200 Connection Established\r\n",
+			expectedRelay:      true,
+		},
+		{
+			name:               "MissingPort",
+			givenRequest:       "CONNECT example.com HTTP/1.0\r\n\r\n",
+			expectedStatusLine: "HTTP/1.0 400 Bad Request\r\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// Act
+
+			_, err = io.WriteString(conn, tc.givenRequest)
+			require.NoError(t, err)
+
+			br := bufio.NewReader(conn)
+			statusLine, err := br.ReadString('\n')
+			require.NoError(t, err)
+
+			var headers []string
+			for {
+				line, err := br.ReadString('\n')
+				require.NoError(t, err)
+				if line == "\r\n" {
+					break
+				}
+				headers = append(headers, strings.ToLower(line))
+			}
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatusLine, statusLine)
+			for _, h := range headers {
+				assert.False(t, strings.HasPrefix(h, "transfer-encoding:"), "unexpected header %q", h)
+			}
+
+			if tc.expectedRelay {
+				_, err = conn.Write([]byte("ping"))
+				require.NoError(t, err)
+
+				b := make([]byte, 4)
+				_, err = io.ReadFull(br, b)
+				require.NoError(t, err)
+				assert.Equal(t, "ping", string(b))
+			}
+		})
+	}
+}
+
+func TestProxyConnectStrictPassthrough(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	interceptor, err := NewInterceptor(newTestCA(t), []string{"*"})
+	require.NoError(t, err)
+	p := newTestProxy()
+	p.Interceptor = interceptor
+	p.StrictPassthrough = true
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// A TLS record header followed by every byte value, sent along with the
+	// CONNECT request like an eager ClientHello.
+	data := []byte{0x16, 0x03, 0x01, 0x02, 0x00}
+	for i := 0; i < 64<<10; i++ {
+		data = append(data, byte(i), byte(i>>8))
+	}
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Act
+
+	go func() {
+		_, _ = conn.Write(append([]byte("CONNECT "+destAddr+" HTTP/1.1\r\nHost: "+destAddr+"\r\n\r\n"), data...))
+	}()
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	echoed := make([]byte, len(data))
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, bytes.Equal(data, echoed), "tunneled data is relayed unchanged")
+}
+
+func TestRelayCanceledContext(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	clientConn, client := net.Pipe()
+	defer client.Close()
+	destConn, dest := net.Pipe()
+	defer dest.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Act
+
+	p.relay(ctx, clientConn, destConn, "example.com:443", "", nil, nil, p.defaultTunnelTimeouts())
+
+	// Assert
+
+	_, clientErr := client.Read(make([]byte, 1))
+	_, destErr := dest.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, clientErr)
+	assert.Equal(t, io.EOF, destErr)
+	assert.Empty(t, p.tunnels.list())
+}
+
+// startEchoServer starts a TCP server on a random local port echoing all data
+// back to the client.
+func startEchoServer(t testing.TB) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+// newTestProxy returns a proxy without authentication and with timeouts
+// suitable for tests.
+func newTestProxy() *Proxy {
+	return &Proxy{
+		Logger:             zap.NewNop(),
+		DestDialTimeout:    time.Second,
+		DestReadTimeout:    time.Second,
+		DestWriteTimeout:   time.Second,
+		ClientReadTimeout:  time.Second,
+		ClientWriteTimeout: time.Second,
+		IdleTimeout:        time.Second,
+		destConns:          &connTracker{},
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxProxyHeaderV1Size is the maximum size of PROXY protocol v1 headers
+	// including the trailing CRLF.
+	maxProxyHeaderV1Size = 107
+
+	// DefaultProxyHeaderTimeout is the timeout of reading PROXY protocol
+	// headers of listeners without HeaderTimeout.
+	DefaultProxyHeaderTimeout = 5 * time.Second
+)
+
+// proxyHeaderV2Sig is the signature starting PROXY protocol v2 headers.
+var proxyHeaderV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errMalformedProxyHeader is returned when reading PROXY protocol headers
+// that are not valid.
+var errMalformedProxyHeader = errors.New("proxyproto: malformed header")
+
+// errProxyListenerClosed is returned when accepting connections from closed
+// ProxyProtocolListeners.
+var errProxyListenerClosed = errors.New("proxyproto: listener closed")
+
+// ProxyProtocolListener accepts connections starting with a PROXY protocol v1
+// or v2 header, as sent by load balancers such as HAProxy or AWS NLB, and
+// reports the client address of the header as remote address of accepted
+// connections, so the real client IP is subject to logging, trusted ranges
+// and rate limits.
+type ProxyProtocolListener struct {
+	net.Listener
+	// TrustedCIDRs are the IP ranges of the load balancers, whose
+	// connections must start with a header. Headers of connections from all
+	// other addresses are not parsed, so clients can not spoof their
+	// address. All connections must start with a header if empty.
+	TrustedCIDRs []*net.IPNet
+	// HeaderTimeout is the timeout of reading the header,
+	// DefaultProxyHeaderTimeout if zero.
+	HeaderTimeout time.Duration
+
+	once      sync.Once
+	closeOnce sync.Once
+	accepted  chan proxyAccept
+	closed    chan struct{}
+}
+
+// proxyAccept is the result of accepting a connection.
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept implements net.Listener. The headers are read in the background,
+// each by its own goroutine, so slow clients do not block accepting other
+// connections, and connections are only returned once their header was read.
+// Connections without a valid header within HeaderTimeout are closed.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	l.once.Do(l.init)
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.closed:
+		return nil, errProxyListenerClosed
+	}
+}
+
+// Close implements net.Listener.
+func (l *ProxyProtocolListener) Close() error {
+	l.once.Do(l.init)
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *ProxyProtocolListener) init() {
+	l.accepted = make(chan proxyAccept)
+	l.closed = make(chan struct{})
+	go l.acceptLoop()
+}
+
+// acceptLoop accepts connections until l is closed, handing over the ones
+// not to read a header of and errors directly, as Accept is called.
+func (l *ProxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil && l.hasHeader(conn) {
+			go l.readHeader(conn)
+			continue
+		}
+		select {
+		case l.accepted <- proxyAccept{conn: conn, err: err}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// hasHeader returns whether conn must start with a header.
+func (l *ProxyProtocolListener) hasHeader(conn net.Conn) bool {
+	if len(l.TrustedCIDRs) == 0 {
+		return true
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && containsIP(l.TrustedCIDRs, addr.IP)
+}
+
+// readHeader reads the header of conn and hands it over to Accept, or closes
+// it if the header is not valid or l is closed meanwhile.
+func (l *ProxyProtocolListener) readHeader(conn net.Conn) {
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	remoteAddr, err := readProxyHeader(r)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.accepted <- proxyAccept{conn: &proxyProtocolConn{Conn: conn, r: r, remoteAddr: remoteAddr}}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// proxyProtocolConn is a connection whose PROXY protocol header was read.
+type proxyProtocolConn struct {
+	net.Conn
+	// r holds the data read after the header.
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, the address of the
+// load balancer for local connections and unknown protocols.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns
+// the client address it holds, or nil for local connections and unknown
+// protocols.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyHeaderV2Sig))
+	if err == nil && bytes.Equal(sig, proxyHeaderV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	if len(sig) < 6 || string(sig[:6]) != "PROXY " {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errMalformedProxyHeader
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyHeaderV1Size {
+			return nil, errMalformedProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errMalformedProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errMalformedProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errMalformedProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errMalformedProxyHeader
+	}
+	// Only TCP over IPv4 and IPv6 are supported, trailing TLVs are ignored.
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errMalformedProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errMalformedProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// writeProxyHeader writes a PROXY protocol header of the given version with
+// the addresses of client and dest to w.
+func writeProxyHeader(w io.Writer, version int, client, dest net.Addr) error {
+	src, _ := client.(*net.TCPAddr)
+	dst, _ := dest.(*net.TCPAddr)
+	ipv4 := src != nil && dst != nil && src.IP.To4() != nil && dst.IP.To4() != nil
+	ipv6 := src != nil && dst != nil && !ipv4 && src.IP.To4() == nil && dst.IP.To4() == nil
+
+	switch version {
+	case 1:
+		var err error
+		switch {
+		case ipv4:
+			_, err = fmt.Fprintf(w, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		case ipv6:
+			_, err = fmt.Fprintf(w, "PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		default:
+			_, err = io.WriteString(w, "PROXY UNKNOWN\r\n")
+		}
+		return err
+	case 2:
+		hdr := append([]byte{}, proxyHeaderV2Sig...)
+		var body []byte
+		switch {
+		case ipv4:
+			hdr = append(hdr, 0x21, 0x11)
+			body = append(append(body, src.IP.To4()...), dst.IP.To4()...)
+		case ipv6:
+			hdr = append(hdr, 0x21, 0x21)
+			body = append(append(body, src.IP.To16()...), dst.IP.To16()...)
+		default:
+			hdr = append(hdr, 0x21, 0x00)
+		}
+		if body != nil {
+			body = append(body, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+		}
+		hdr = append(hdr, byte(len(body)>>8), byte(len(body)))
+		_, err := w.Write(append(hdr, body...))
+		return err
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
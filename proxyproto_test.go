@@ -0,0 +1,204 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		name         string
+		givenHeader  string
+		expectedAddr string
+		expectedErr  bool
+	}{
+		{
+			name:         "V1TCP4",
+			givenHeader:  "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expectedAddr: "192.0.2.1:56324",
+		},
+		{
+			name:         "V1TCP6",
+			givenHeader:  "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			expectedAddr: "[2001:db8::1]:56324",
+		},
+		{
+			name:        "V1Unknown",
+			givenHeader: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:         "V2TCP4",
+			givenHeader:  "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0f\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x01\xbb\x03\x00\x00",
+			expectedAddr: "192.0.2.1:56324",
+		},
+		{
+			name:        "V2Local",
+			givenHeader: "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		},
+		{
+			name:        "V1FamilyMismatch",
+			givenHeader: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n",
+			expectedErr: true,
+		},
+		{
+			name:        "V1TooLong",
+			givenHeader: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+			expectedErr: true,
+		},
+		{
+			name:        "V2UnknownCommand",
+			givenHeader: "\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00",
+			expectedErr: true,
+		},
+		{
+			name:        "Missing",
+			givenHeader: "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedAddr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.givenHeader + "data")))
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tc.expectedAddr == "" {
+				assert.Nil(t, observedAddr)
+			} else {
+				require.NotNil(t, observedAddr)
+				assert.Equal(t, tc.expectedAddr, observedAddr.String())
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dest := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	for _, version := range []int{1, 2} {
+		// Arrange
+
+		var buf bytes.Buffer
+
+		// Act
+
+		err := writeProxyHeader(&buf, version, client, dest)
+
+		// Assert
+
+		require.NoError(t, err)
+		addr, err := readProxyHeader(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		assert.Equal(t, client.String(), addr.String(), "version %d", version)
+		assert.Zero(t, buf.Len())
+	}
+
+	assert.Error(t, writeProxyHeader(ioutil.Discard, 3, client, dest))
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cases := []struct {
+		name             string
+		givenTrusted     string
+		expectedRemoteIP string
+		expectedData     string
+	}{
+		{name: "Trusted", givenTrusted: "127.0.0.0/8", expectedRemoteIP: "192.0.2.1", expectedData: "ping"},
+		// Headers of untrusted clients are not parsed.
+		{name: "Untrusted", givenTrusted: "10.0.0.0/8", expectedRemoteIP: "127.0.0.1", expectedData: "PROX"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			trusted, err := ParseCIDRs(tc.givenTrusted)
+			require.NoError(t, err)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			pl := &ProxyProtocolListener{Listener: l, TrustedCIDRs: trusted}
+			defer pl.Close()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			_, err = io.WriteString(client, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping")
+			require.NoError(t, err)
+
+			// Act
+
+			conn, err := pl.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			remoteIP := clientIP(conn.RemoteAddr())
+			b := make([]byte, 4)
+			_, err = io.ReadFull(conn, b)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRemoteIP, remoteIP)
+			assert.Equal(t, tc.expectedData, string(b))
+		})
+	}
+}
+
+func TestProxyProtocolListenerSlowHeader(t *testing.T) {
+	// Arrange
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl := &ProxyProtocolListener{Listener: l, HeaderTimeout: time.Minute}
+	defer pl.Close()
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+	malformed, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer malformed.Close()
+	_, err = io.WriteString(malformed, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = io.WriteString(client, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	require.NoError(t, err)
+
+	// Act
+
+	conn, err := pl.Accept()
+
+	// Assert
+
+	require.NoError(t, err, "the silent connection does not block accepting")
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1", clientIP(conn.RemoteAddr()))
+	malformed.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = malformed.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "connections without a valid header are closed")
+
+	require.NoError(t, pl.Close())
+	_, err = pl.Accept()
+	assert.Error(t, err)
+}
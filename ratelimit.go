@@ -0,0 +1,83 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimiterKeys is the number of keys after which idle buckets are
+// removed.
+const maxRateLimiterKeys = 10000
+
+// RateLimiter limits the rate of events per key using a token bucket per key.
+type RateLimiter struct {
+	// Rate is the number of events per second.
+	Rate float64
+	// Burst is the maximum number of events exceeding Rate at once.
+	Burst int
+
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate events per second and key,
+// with bursts of up to burst events.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst, now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+// SetRate changes the rate and burst of l, applying to the buckets of all
+// keys.
+func (l *RateLimiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.Rate, l.Burst = rate, burst
+}
+
+// Allow reports whether an event for key may happen now, and if so consumes a
+// token of its bucket.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimiterKeys {
+			l.removeFull(now)
+		}
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// removeFull removes the buckets which have been refilled completely, as they
+// are equivalent to new buckets. It must be called with l.mu held.
+func (l *RateLimiter) removeFull(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// Arrange
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(2, 2)
+	l.now = func() time.Time { return now }
+
+	// Act & Assert
+
+	assert.True(t, l.Allow("a"))
+	assert.True(t, l.Allow("a"))
+	assert.False(t, l.Allow("a"))
+	assert.True(t, l.Allow("b"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow("a"))
+	assert.False(t, l.Allow("a"))
+
+	now = now.Add(time.Hour)
+	assert.True(t, l.Allow("a"))
+	assert.True(t, l.Allow("a"))
+	assert.False(t, l.Allow("a"))
+}
+
+func TestRateLimiterRemovesFullBuckets(t *testing.T) {
+	// Arrange
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxRateLimiterKeys; i++ {
+		l.Allow(fmt.Sprint(i))
+	}
+	now = now.Add(time.Second)
+
+	// Act
+
+	l.Allow("new")
+
+	// Assert
+
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestProxyConnectDestinationRateExceeded(t *testing.T) {
+	// Arrange
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+
+	p := newTestProxy()
+	p.DestRateLimiter = NewRateLimiter(1, 1)
+	p.DestRateLimiter.Allow(destinationKey(destListener.Addr().String()))
+
+	req := httptest.NewRequest(http.MethodConnect, destListener.Addr().String(), nil)
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, req)
+
+	// Assert
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
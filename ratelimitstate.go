@@ -0,0 +1,87 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tokenBucketState is a token bucket of a RateLimiter as saved to disk.
+type tokenBucketState struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// SaveState writes the buckets of l which have not been refilled completely
+// to the file at path, replacing it atomically, so clients and destinations
+// exceeding their rates are not let through by a restart.
+func (l *RateLimiter) SaveState(path string) error {
+	l.mu.Lock()
+	now := l.now()
+	state := map[string]tokenBucketState{}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate < float64(l.Burst) {
+			state[key] = tokenBucketState{Tokens: b.tokens, Last: b.last}
+		}
+	}
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// LoadState restores the buckets saved to the file at path by SaveState.
+// Buckets keep refilling while the proxy is down, so buckets refilled
+// completely meanwhile are not restored.
+func (l *RateLimiter) LoadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var state map[string]tokenBucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for key, s := range state {
+		if s.Last.After(now) {
+			s.Last = now
+		}
+		if s.Tokens > float64(l.Burst) {
+			s.Tokens = float64(l.Burst)
+		}
+		if s.Tokens+now.Sub(s.Last).Seconds()*l.Rate >= float64(l.Burst) {
+			continue
+		}
+		l.buckets[key] = &tokenBucket{tokens: s.Tokens, last: s.Last}
+	}
+	return nil
+}
+
+// PersistState saves the buckets of l to the file at path every interval
+// until stop is closed.
+func (l *RateLimiter) PersistState(logger *zap.Logger, path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.SaveState(path); err != nil {
+				logger.Error("Saving rate limiter state failed", zap.String("path", path), zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterSaveLoadState(t *testing.T) {
+	cases := []struct {
+		name            string
+		givenElapsed    time.Duration
+		expectedAllowed bool
+		expectedBuckets int
+	}{
+		{name: "Exhausted", givenElapsed: 500 * time.Millisecond, expectedAllowed: false, expectedBuckets: 1},
+		{name: "Refilled", givenElapsed: 5 * time.Second, expectedAllowed: true, expectedBuckets: 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			dir, err := ioutil.TempDir("", "ratelimitstate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "ratelimit.json")
+
+			now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+			clock := func() time.Time { return now }
+			saved := NewRateLimiter(1, 2)
+			saved.now = clock
+			require.True(t, saved.Allow("10.0.0.1"))
+			require.True(t, saved.Allow("10.0.0.1"))
+			require.False(t, saved.Allow("10.0.0.1"))
+			// Full buckets are not saved.
+			saved.buckets["10.0.0.2"] = &tokenBucket{tokens: 2, last: now}
+			require.NoError(t, saved.SaveState(path))
+
+			// Act
+
+			now = now.Add(tc.givenElapsed)
+			loaded := NewRateLimiter(1, 2)
+			loaded.now = clock
+			err = loaded.LoadState(path)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Len(t, loaded.buckets, tc.expectedBuckets)
+			assert.Equal(t, tc.expectedAllowed, loaded.Allow("10.0.0.1"))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// maxReauthSessions is the number of sessions after which ended sessions are
+// removed.
+const maxReauthSessions = 10000
+
+// ReauthPolicy forces clients to authenticate afresh once the session of a
+// user ends, by refusing a single request with 407 Proxy Authentication
+// Required. The next request authenticated successfully starts a new session.
+type ReauthPolicy struct {
+	// MaxAge is the duration after which sessions end, unlimited if zero.
+	MaxAge time.Duration
+	// MaxTunnels is the number of tunnels after which sessions end,
+	// unlimited if zero.
+	MaxTunnels int
+
+	mu       sync.Mutex
+	now      func() time.Time
+	sessions map[string]*authSession
+}
+
+// authSession is the session of an authenticated user.
+type authSession struct {
+	start   time.Time
+	tunnels int
+}
+
+// allow reports whether the session of user permits a request, which opens a
+// tunnel if tunnel is set, or whether the user must authenticate afresh.
+// Unauthenticated requests and nil policies permit all requests.
+func (p *ReauthPolicy) allow(user string, tunnel bool) bool {
+	if p == nil || user == "" {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.now == nil {
+		p.now = time.Now
+	}
+	now := p.now()
+	s, ok := p.sessions[user]
+	if !ok {
+		if p.sessions == nil {
+			p.sessions = map[string]*authSession{}
+		}
+		if len(p.sessions) >= maxReauthSessions {
+			p.removeEnded(now)
+		}
+		s = &authSession{start: now}
+		p.sessions[user] = s
+	}
+	if p.ended(s, now) {
+		delete(p.sessions, user)
+		return false
+	}
+	if tunnel {
+		s.tunnels++
+	}
+	return true
+}
+
+// ended reports whether s has ended at now. It must be called with p.mu held.
+func (p *ReauthPolicy) ended(s *authSession, now time.Time) bool {
+	return (p.MaxAge > 0 && now.Sub(s.start) >= p.MaxAge) ||
+		(p.MaxTunnels > 0 && s.tunnels >= p.MaxTunnels)
+}
+
+// removeEnded removes the sessions which have ended. It must be called with
+// p.mu held.
+func (p *ReauthPolicy) removeEnded(now time.Time) {
+	for user, s := range p.sessions {
+		if p.ended(s, now) {
+			delete(p.sessions, user)
+		}
+	}
+}
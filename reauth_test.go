@@ -0,0 +1,59 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReauthPolicyAllow(t *testing.T) {
+	// Arrange
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := &ReauthPolicy{MaxAge: time.Hour, MaxTunnels: 2}
+	p.now = func() time.Time { return now }
+
+	// Act & Assert
+
+	assert.True(t, p.allow("alice", true))
+	assert.True(t, p.allow("alice", false), "plain HTTP requests do not count as tunnels")
+	assert.True(t, p.allow("alice", true))
+	assert.False(t, p.allow("alice", true), "session ends after two tunnels")
+	assert.True(t, p.allow("alice", true), "next request starts a new session")
+
+	now = now.Add(time.Hour)
+	assert.False(t, p.allow("alice", false), "session ends after an hour")
+	assert.True(t, p.allow("alice", false))
+
+	assert.True(t, p.allow("", true), "unauthenticated requests are permitted")
+	assert.True(t, (*ReauthPolicy)(nil).allow("alice", true))
+}
+
+func TestProxyForcesReauth(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.ReauthPolicy = &ReauthPolicy{MaxTunnels: 1}
+	p.ReauthPolicy.allow("user", true)
+
+	r := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.SetBasicAuth("user", "pass")
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	w := httptest.NewRecorder()
+
+	// Act
+
+	p.ServeHTTP(w, r)
+
+	// Assert
+
+	assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+	assert.Equal(t, `Basic realm="proxy"`, w.Header().Get("Proxy-Authenticate"))
+}
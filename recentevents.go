@@ -0,0 +1,93 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of recent events.
+const (
+	recentTunnel = "tunnel"
+	recentDenied = "denied"
+)
+
+// RecentEvents keeps the last events of the proxy in memory, closed tunnels
+// and denied destinations, so operators can see what just happened via the
+// admin API without a log pipeline.
+type RecentEvents struct {
+	mu     sync.Mutex
+	events []RecentEvent
+	// next is the index the next event is stored at once events is full.
+	next int
+}
+
+// RecentEvent is an event kept by RecentEvents.
+type RecentEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is "tunnel" for closed tunnels and "denied" for destinations
+	// denied by the blocklist, the ACL, the denied IP ranges or a route.
+	Kind string `json:"kind"`
+	// Client is the IP address of the client of tunnels.
+	Client      string `json:"client,omitempty"`
+	User        string `json:"user,omitempty"`
+	Destination string `json:"destination"`
+	// BytesUp and BytesDown are the bytes relayed by tunnels.
+	BytesUp   int64 `json:"bytes_up,omitempty"`
+	BytesDown int64 `json:"bytes_down,omitempty"`
+	// Reason is why tunnels were closed, see AccessRecord.Reason, or why
+	// destinations were denied.
+	Reason string `json:"reason"`
+}
+
+// NewRecentEvents returns RecentEvents keeping the last size events.
+func NewRecentEvents(size int) *RecentEvents {
+	return &RecentEvents{events: make([]RecentEvent, 0, size)}
+}
+
+func (re *RecentEvents) add(ev RecentEvent) {
+	if re == nil || cap(re.events) == 0 {
+		return
+	}
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if len(re.events) < cap(re.events) {
+		re.events = append(re.events, ev)
+		return
+	}
+	re.events[re.next] = ev
+	re.next = (re.next + 1) % len(re.events)
+}
+
+func (re *RecentEvents) tunnelClosed(rec *AccessRecord) {
+	re.add(RecentEvent{
+		Time:        time.Now(),
+		Kind:        recentTunnel,
+		Client:      rec.Client,
+		User:        rec.User,
+		Destination: rec.Destination,
+		BytesUp:     rec.BytesUp,
+		BytesDown:   rec.BytesDown,
+		Reason:      rec.Reason,
+	})
+}
+
+func (re *RecentEvents) denied(user, destination string, err error) {
+	re.add(RecentEvent{
+		Time:        time.Now(),
+		Kind:        recentDenied,
+		User:        user,
+		Destination: destination,
+		Reason:      err.Error(),
+	})
+}
+
+// List returns the events kept, oldest first.
+func (re *RecentEvents) List() []RecentEvent {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	list := make([]RecentEvent, 0, len(re.events))
+	list = append(list, re.events[re.next:]...)
+	return append(list, re.events[:re.next]...)
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentEvents(t *testing.T) {
+	cases := []struct {
+		name                 string
+		givenSize            int
+		givenEvents          int
+		expectedDestinations []string
+	}{
+		{name: "Empty", givenSize: 3, expectedDestinations: []string{}},
+		{name: "NotFull", givenSize: 3, givenEvents: 2, expectedDestinations: []string{"dest0", "dest1"}},
+		{name: "Wrapped", givenSize: 3, givenEvents: 5, expectedDestinations: []string{"dest2", "dest3", "dest4"}},
+		{name: "Disabled", givenEvents: 2, expectedDestinations: []string{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			re := NewRecentEvents(tc.givenSize)
+
+			// Act
+
+			for i := 0; i < tc.givenEvents; i++ {
+				re.tunnelClosed(&AccessRecord{Destination: fmt.Sprintf("dest%d", i)})
+			}
+			observed := re.List()
+
+			// Assert
+
+			destinations := []string{}
+			for _, ev := range observed {
+				assert.Equal(t, recentTunnel, ev.Kind)
+				destinations = append(destinations, ev.Destination)
+			}
+			assert.Equal(t, tc.expectedDestinations, destinations)
+		})
+	}
+}
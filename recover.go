@@ -0,0 +1,40 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// errRelayPanicked ends transfers of tunnels whose relay panicked.
+var errRelayPanicked = errors.New("relay panicked")
+
+// recoverHandler recovers a panic of a request handler and logs it with its
+// stack trace. The panic is then re-raised as http.ErrAbortHandler, which
+// makes the server close the affected client connection without logging the
+// panic a second time.
+//
+// It must be called directly via defer.
+func (p *Proxy) recoverHandler() {
+	if v := recover(); v != nil {
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+		p.Logger.Error("Handler panicked", zap.Any("panic", v), zap.Stack("stack"))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// recoverRelay recovers a panic of a relay goroutine and logs it with its
+// stack trace, so that a single broken tunnel does not crash the proxy. The
+// caller is responsible for closing the tunnel's connections.
+//
+// It must be called directly via defer.
+func (p *Proxy) recoverRelay() {
+	if v := recover(); v != nil {
+		p.Logger.Error("Relay panicked", zap.Any("panic", v), zap.Stack("stack"))
+	}
+}
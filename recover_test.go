@@ -0,0 +1,47 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type panickingReader struct{}
+
+func (panickingReader) Read(b []byte) (int, error) { panic("read") }
+
+func TestTransferRecoversPanic(t *testing.T) {
+	// Arrange
+
+	p := &Proxy{Logger: zap.NewNop()}
+	var endedErr error
+
+	// Act
+
+	assert.NotPanics(t, func() {
+		p.transfer(ioutil.Discard, panickingReader{}, "", nil, func(err error) { endedErr = err })
+	})
+
+	// Assert
+
+	assert.Equal(t, errRelayPanicked, endedErr, "tunnel is closed")
+}
+
+func TestServeHTTPRecoversPanic(t *testing.T) {
+	// Arrange
+
+	// A proxy without forwarding HTTP proxy panics on plain HTTP requests.
+	p := &Proxy{Logger: zap.NewNop()}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	w := httptest.NewRecorder()
+
+	// Act & Assert
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { p.ServeHTTP(w, req) })
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRelayBufferSize is the size of the buffers relaying tunnel data of
+// proxies without RelayBufferSize.
+const DefaultRelayBufferSize = 32 << 10
+
+// spliceSupported reports whether net.TCPConn.ReadFrom moves data between TCP
+// connections within the kernel, via splice(2), rather than copying it
+// through a buffer allocated per call.
+const spliceSupported = runtime.GOOS == "linux"
+
+// Bounds of the relay buffer size set via SetRelayBufferSize.
+const (
+	MinRelayBufferSize = 1 << 10
+	MaxRelayBufferSize = 4 << 20
+)
+
+func (p *Proxy) relayBufferSize() int {
+	if size := atomic.LoadInt32(&p.relayBufSize); size > 0 {
+		return int(size)
+	}
+	if p.RelayBufferSize > 0 {
+		return p.RelayBufferSize
+	}
+	return DefaultRelayBufferSize
+}
+
+// SetRelayBufferSize changes RelayBufferSize while p is serving. Tunnels
+// relaying data already keep their buffers, while pooled buffers of the
+// previous size are dropped.
+func (p *Proxy) SetRelayBufferSize(size int) {
+	atomic.StoreInt32(&p.relayBufSize, int32(size))
+}
+
+// relayBuffer returns a buffer for relaying tunnel data from the pool of p,
+// which must be returned to it via putRelayBuffer.
+func (p *Proxy) relayBuffer() *[]byte {
+	size := p.relayBufferSize()
+	for {
+		b, _ := p.relayBufs.Get().(*[]byte)
+		if b == nil {
+			buf := make([]byte, size)
+			return &buf
+		}
+		if len(*b) == size {
+			return b
+		}
+	}
+}
+
+func (p *Proxy) putRelayBuffer(b *[]byte) {
+	if len(*b) == p.relayBufferSize() {
+		p.relayBufs.Put(b)
+	}
+}
+
+// splicedConn returns the TCP connection underlying c if data can be relayed
+// from and to it directly, bypassing c.
+func splicedConn(c net.Conn) *net.TCPConn {
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc
+		case *trackedConn:
+			c = cc.Conn
+		case *connLimitConn:
+			c = cc.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// splice relays src to dest like transfer, letting the kernel move the data
+// between the connections. Data is relayed in chunks of the relay buffer
+// size, after each of which the deadlines of activity are refreshed and
+// count is called with the number of bytes relayed.
+func (p *Proxy) splice(dest, src *net.TCPConn, activity *tunnelActivity, writeTimeout time.Duration, count func(int64), ended func(error)) (n int64) {
+	err := errRelayPanicked
+	defer func() { ended(err) }()
+	defer p.recoverRelay()
+	size := int64(p.relayBufferSize())
+	for {
+		if err = src.SetReadDeadline(activity.readDeadline()); err != nil {
+			return n
+		}
+		writeDeadline := activity.writeDeadline(writeTimeout)
+		if err = dest.SetWriteDeadline(writeDeadline); err != nil {
+			return n
+		}
+		var m int64
+		m, err = dest.ReadFrom(&io.LimitedReader{R: src, N: size})
+		if m > 0 {
+			n += m
+			activity.touch(int(m))
+			count(m)
+		}
+		if err == nil {
+			// Fewer bytes than requested are relayed at EOF only.
+			if m < size {
+				return n
+			}
+			continue
+		}
+		// The read timed out, but data was relayed in the other direction
+		// since the read started.
+		writeTimedOut := !writeDeadline.IsZero() && !time.Now().Before(writeDeadline)
+		if isTimeout(err) && !writeTimedOut && time.Now().Before(activity.readDeadline()) {
+			continue
+		}
+		return n
+	}
+}
+
+// splicedUpstream returns the function counting bytes spliced from the client
+// of t to its destination.
+func (p *Proxy) splicedUpstream(t *tunnelConns) func(int64) {
+	return func(n int64) {
+		atomic.AddUint64(&t.bytesUp, uint64(n))
+		p.Metrics.addUpstream(n)
+	}
+}
+
+// splicedDownstream returns the function counting bytes spliced from the
+// destination of t to its client, calling onFirstByte once with the first.
+func (p *Proxy) splicedDownstream(t *tunnelConns, onFirstByte func()) func(int64) {
+	first := true
+	return func(n int64) {
+		if first {
+			first = false
+			onFirstByte()
+		}
+		atomic.AddUint64(&t.bytesDown, uint64(n))
+		p.Metrics.addDownstream(n)
+	}
+}
+
+// spliceable returns the TCP connections of the client and the destination of
+// tunnel t if Splice is set and the data of t can be spliced between them,
+// i.e. t is neither throttled nor recorded, or nil otherwise.
+func (p *Proxy) spliceable(t *tunnelConns, throttle *tunnelThrottle, transcript *tunnelTranscript, dump *tunnelDump) (client, dest *net.TCPConn) {
+	if !p.Splice || !spliceSupported || throttle != nil || transcript != nil || dump != nil || p.EgressBudget != nil {
+		return nil, nil
+	}
+	client, dest = splicedConn(t.client), splicedConn(t.dest)
+	if client == nil || dest == nil {
+		return nil, nil
+	}
+	return client, dest
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRelayCopy(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	payload := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	cases := []struct {
+		name          string
+		givenSplice   bool
+		givenThrottle *Throttle
+	}{
+		{name: "Copied"},
+		{name: "Spliced", givenSplice: true},
+		{name: "SpliceThrottled", givenSplice: true, givenThrottle: &Throttle{ConnRate: 100 << 20}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Proxy server
+
+			p := newTestProxy()
+			p.RelayBufferSize = 4096
+			p.Splice = tc.givenSplice
+			p.Throttle = tc.givenThrottle
+			p.Metrics = NewMetrics()
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			// Act
+
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+			_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+			require.NoError(t, err)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			require.NoError(t, err)
+
+			go func() {
+				_, _ = conn.Write(payload)
+			}()
+			observed := make([]byte, len(payload))
+			_, err = io.ReadFull(br, observed)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.True(t, bytes.Equal(payload, observed), "relayed data differs")
+			assert.Equal(t, uint64(len(payload)), atomic.LoadUint64(&p.Metrics.upstreamBytes))
+			assert.Equal(t, uint64(len(payload)), atomic.LoadUint64(&p.Metrics.downstreamBytes))
+		})
+	}
+}
+
+func TestProxySpliceIdleTimeout(t *testing.T) {
+	// Arrange
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	p := newTestProxy()
+	p.Splice = true
+	p.IdleTimeout = 100 * time.Millisecond
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	_, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	// Act
+
+	start := time.Now()
+	_, err = br.ReadByte()
+
+	// Assert
+
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "idle tunnel closed late")
+}
+
+func TestProxySetRelayBufferSize(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.RelayBufferSize = 4096
+	old := p.relayBuffer()
+
+	// Act
+
+	p.SetRelayBufferSize(8192)
+	p.putRelayBuffer(old)
+	observed := p.relayBuffer()
+
+	// Assert
+
+	assert.Len(t, *old, 4096)
+	assert.Len(t, *observed, 8192, "buffers of the previous size are dropped")
+}
+
+func TestSplicedConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	pipeConn, _ := net.Pipe()
+
+	cases := []struct {
+		name     string
+		given    net.Conn
+		expected net.Conn
+	}{
+		{name: "TCP", given: tcpConn, expected: tcpConn},
+		{name: "Tracked", given: &trackedConn{Conn: &connLimitConn{Conn: tcpConn}}, expected: tcpConn},
+		{name: "Buffered", given: &bufferedConn{Conn: tcpConn}},
+		{name: "Pipe", given: pipeConn},
+		{name: "Nil"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := splicedConn(tc.given)
+
+			// Assert
+
+			if tc.expected == nil {
+				assert.Nil(t, observed)
+				return
+			}
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultMaxRecordedBodySize is the number of bytes of request bodies
+// recorded by a RequestRecorder unless configured otherwise.
+const DefaultMaxRecordedBodySize = 64 << 10
+
+// errRecordTruncated is returned when replaying a recorded request whose body
+// was not recorded completely.
+var errRecordTruncated = errors.New("request body not recorded completely")
+
+// RecordedRequest is an intercepted request as recorded by a RequestRecorder,
+// one JSON object per line.
+type RecordedRequest struct {
+	Time   time.Time   `json:"time"`
+	User   string      `json:"user,omitempty"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+	// Truncated is set if the body exceeded the maximum size recorded or
+	// was not read to its end, in which case the request is not replayed.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// NewRequest returns a request replaying rec. If target is set, the request is
+// sent to its scheme and host instead, e.g. a staging host. Header overrides
+// the recorded header fields, removing those with an empty value, and may
+// override the Host header too.
+func (rec *RecordedRequest) NewRequest(target *url.URL, header http.Header) (*http.Request, error) {
+	if rec.Truncated {
+		return nil, errRecordTruncated
+	}
+	u, err := url.Parse(rec.URL)
+	if err != nil {
+		return nil, err
+	}
+	if target != nil {
+		u.Scheme, u.Host = target.Scheme, target.Host
+	}
+	r, err := http.NewRequest(rec.Method, u.String(), bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range rec.Header {
+		if !isHopByHopHeader(http.CanonicalHeaderKey(name)) && !strings.EqualFold(name, "Content-Length") {
+			r.Header[name] = append([]string(nil), values...)
+		}
+	}
+	for name, values := range header {
+		if len(values) == 0 || values[0] == "" {
+			r.Header.Del(name)
+			continue
+		}
+		r.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+		r.Header.Del("Host")
+	}
+	return r, nil
+}
+
+// LoadRecordedRequests reads the requests recorded in the file at path.
+func LoadRecordedRequests(path string) ([]RecordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []RecordedRequest
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16<<20)
+	for n := 1; s.Scan(); n++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var rec RecordedRequest
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// RequestRecorder records the decrypted requests of intercepted destinations
+// matching Hosts to Writer, for replaying them later while debugging APIs,
+// see RecordedRequest. Recorded requests hold their header fields and body
+// as sent by clients, including credentials.
+type RequestRecorder struct {
+	// Hosts are the host patterns of the destinations whose requests are
+	// recorded, see ResponseHeaderRule.Host for the syntax.
+	Hosts []string
+	// MaxBodySize is the number of bytes of bodies recorded,
+	// DefaultMaxRecordedBodySize if zero. Requests with larger bodies are
+	// recorded as truncated.
+	MaxBodySize int64
+	Writer      io.Writer
+
+	mu sync.Mutex
+}
+
+// records reports whether requests to host are recorded.
+func (rr *RequestRecorder) records(host string) bool {
+	for _, pattern := range rr.Hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// record records r of user once its body has been read, which it replaces.
+func (rr *RequestRecorder) record(logger *zap.Logger, r *http.Request, user string) {
+	rec := &RecordedRequest{
+		Time:   time.Now(),
+		User:   user,
+		Method: r.Method,
+		URL:    r.URL.String(),
+		Header: make(http.Header, len(r.Header)),
+	}
+	for name, values := range r.Header {
+		rec.Header[name] = append([]string(nil), values...)
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		rr.write(logger, rec)
+		return
+	}
+	max := rr.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxRecordedBodySize
+	}
+	r.Body = &recordedBody{ReadCloser: r.Body, rr: rr, logger: logger, rec: rec, max: max, length: r.ContentLength}
+}
+
+func (rr *RequestRecorder) write(logger *zap.Logger, rec *RecordedRequest) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("Encoding recorded request failed", zap.Error(err))
+		return
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if _, err := rr.Writer.Write(append(b, '\n')); err != nil {
+		logger.Error("Writing recorded request failed", zap.Error(err))
+	}
+}
+
+// recordedBody copies up to max bytes of a request body into its record,
+// which is written once the body has been read to its end or closed.
+type recordedBody struct {
+	io.ReadCloser
+	rr     *RequestRecorder
+	logger *zap.Logger
+	rec    *RecordedRequest
+	max    int64
+	// length is the declared length of the body, or -1 if unknown.
+	length int64
+	// n is the number of bytes read.
+	n    int64
+	once sync.Once
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if left := b.max - b.n; left > 0 {
+		if int64(n) < left {
+			left = int64(n)
+		}
+		b.rec.Body = append(b.rec.Body, p[:left]...)
+	}
+	b.n += int64(n)
+	if err != nil {
+		b.done(err != io.EOF)
+	}
+	return n, err
+}
+
+func (b *recordedBody) Close() error {
+	b.done(b.length < 0 || b.n < b.length)
+	return b.ReadCloser.Close()
+}
+
+// done writes the record once, truncated if the body was not read to its end
+// or exceeded max.
+func (b *recordedBody) done(unfinished bool) {
+	b.once.Do(func() {
+		b.rec.Truncated = unfinished || b.n > b.max
+		b.rr.write(b.logger, b.rec)
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRequestRecorder(t *testing.T) {
+	cases := []struct {
+		name              string
+		givenBody         io.Reader
+		givenReadAll      bool
+		expectedBody      string
+		expectedTruncated bool
+	}{
+		{
+			name:         "NoBody",
+			givenReadAll: true,
+		},
+		{
+			name:         "Body",
+			givenBody:    strings.NewReader("ping"),
+			givenReadAll: true,
+			expectedBody: "ping",
+		},
+		{
+			name:              "BodyTooLarge",
+			givenBody:         strings.NewReader("0123456789"),
+			givenReadAll:      true,
+			expectedBody:      "01234567",
+			expectedTruncated: true,
+		},
+		{
+			name:              "BodyUnread",
+			givenBody:         ioutil.NopCloser(strings.NewReader("ping")),
+			expectedTruncated: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			var out bytes.Buffer
+			rr := &RequestRecorder{Hosts: []string{"*.example.com"}, MaxBodySize: 8, Writer: &out}
+			r := httptest.NewRequest(http.MethodPost, "https://api.example.com/v1/items?page=2", tc.givenBody)
+			r.Header.Set("X-Trace", "abc")
+
+			// Act
+
+			rr.record(zap.NewNop(), r, "alice")
+			if tc.givenReadAll {
+				_, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+			}
+			r.Body.Close()
+
+			// Assert
+
+			var observed RecordedRequest
+			require.NoError(t, json.Unmarshal(out.Bytes(), &observed))
+			assert.Equal(t, "alice", observed.User)
+			assert.Equal(t, http.MethodPost, observed.Method)
+			assert.Equal(t, "https://api.example.com/v1/items?page=2", observed.URL)
+			assert.Equal(t, "abc", observed.Header.Get("X-Trace"))
+			assert.Equal(t, tc.expectedBody, string(observed.Body))
+			assert.Equal(t, tc.expectedTruncated, observed.Truncated)
+			assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("\n")), "requests are recorded once")
+		})
+	}
+}
+
+func TestRequestRecorderRecords(t *testing.T) {
+	rr := &RequestRecorder{Hosts: []string{"*.example.com", "api.example.org"}}
+
+	assert.True(t, rr.records("www.example.com:443"))
+	assert.True(t, rr.records("API.example.org:443"))
+	assert.False(t, rr.records("www.example.org:443"))
+}
+
+func TestRecordedRequestNewRequest(t *testing.T) {
+	// Arrange
+
+	rec := &RecordedRequest{
+		Method: http.MethodPut,
+		URL:    "https://api.example.com/v1/items/7",
+		Header: http.Header{
+			"Authorization":  {"Bearer production"},
+			"Connection":     {"keep-alive"},
+			"Content-Length": {"4"},
+			"X-Trace":        {"abc"},
+		},
+		Body: []byte("ping"),
+	}
+	target, err := url.Parse("http://staging.internal:8080")
+	require.NoError(t, err)
+
+	// Act
+
+	r, err := rec.NewRequest(target, http.Header{
+		"Authorization": {"Bearer staging"},
+		"X-Trace":       {""},
+		"Host":          {"api.example.com"},
+	})
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPut, r.Method)
+	assert.Equal(t, "http://staging.internal:8080/v1/items/7", r.URL.String())
+	assert.Equal(t, "api.example.com", r.Host)
+	assert.Equal(t, http.Header{"Authorization": {"Bearer staging"}}, r.Header)
+	assert.Equal(t, int64(4), r.ContentLength)
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(body))
+}
+
+func TestRecordedRequestNewRequestTruncated(t *testing.T) {
+	rec := &RecordedRequest{Method: http.MethodPost, URL: "https://api.example.com/", Truncated: true}
+
+	_, err := rec.NewRequest(nil, nil)
+
+	assert.Equal(t, errRecordTruncated, err)
+}
+
+func TestLoadRecordedRequests(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "forwardingproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "requests.jsonl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"method":"GET","url":"https://a.example.com/"}
+
+{"method":"POST","url":"https://b.example.com/","body":"cGluZw=="}
+`), 0600))
+
+	// Act
+
+	observed, err := LoadRecordedRequests(path)
+
+	// Assert
+
+	require.NoError(t, err)
+	require.Len(t, observed, 2)
+	assert.Equal(t, "https://a.example.com/", observed[0].URL)
+	assert.Equal(t, "ping", string(observed[1].Body))
+}
+
+func TestInterceptRecordsRequests(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, "dummy-response")
+	}))
+	defer destServer.Close()
+
+	destPool := x509.NewCertPool()
+	destPool.AddCert(destServer.Certificate())
+
+	// Proxy server
+
+	var out lockedBuffer
+	ca := newTestCA(t)
+	interceptor, err := NewInterceptor(ca, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	interceptor.Recorder = &RequestRecorder{Hosts: []string{"127.0.0.1"}, Writer: &out}
+
+	p := newTestProxy()
+	p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+	transport := NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+	transport.TLSClientConfig = &tls.Config{RootCAs: destPool}
+	p.ForwardingHTTPProxy.Transport = transport
+	p.Interceptor = interceptor
+
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(interceptor.ca)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: caPool},
+	}}
+
+	// Act
+
+	resp, err := client.Post(destServer.URL+"/upload", "text/plain", strings.NewReader("ping"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && out.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var observed RecordedRequest
+	require.NoError(t, json.Unmarshal(out.Bytes(), &observed))
+	assert.Equal(t, destServer.URL+"/upload", observed.URL)
+	assert.Equal(t, "text/plain", observed.Header.Get("Content-Type"))
+	assert.Equal(t, "ping", string(observed.Body))
+	assert.False(t, observed.Truncated)
+}
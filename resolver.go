@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errResolverBusy is returned for lookups exceeding the queue of a Resolver.
+var errResolverBusy = errors.New("too many pending DNS lookups")
+
+// Resolver resolves destination host names on a bounded pool of workers, so
+// a slow or unavailable DNS server cannot pile up goroutines during traffic
+// spikes. Lookups waiting for a worker are queued up to QueueSize, any
+// further lookups fail immediately.
+type Resolver struct {
+	// Workers is the number of concurrent lookups.
+	Workers int
+	// QueueSize is the number of lookups waiting for a worker.
+	QueueSize int
+	// Timeout bounds single lookups, unlimited if zero.
+	Timeout time.Duration
+	// Client, if set, looks up host names instead of the resolver of the
+	// system.
+	Client *DNSClient
+
+	startOnce sync.Once
+	queue     chan *dnsQuery
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dnsQuery struct {
+	ctx    context.Context
+	host   string
+	result chan dnsResult
+}
+
+type dnsResult struct {
+	ips []net.IPAddr
+	err error
+}
+
+// LookupIPAddr looks up host on a worker of r.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.startOnce.Do(r.start)
+
+	q := &dnsQuery{ctx: ctx, host: host, result: make(chan dnsResult, 1)}
+	select {
+	case r.queue <- q:
+	default:
+		return nil, errResolverBusy
+	}
+
+	select {
+	case res := <-q.result:
+		return res.ips, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Resolver) start() {
+	if r.lookup == nil {
+		r.lookup = net.DefaultResolver.LookupIPAddr
+		if r.Client != nil {
+			r.lookup = r.Client.LookupIPAddr
+		}
+	}
+	r.queue = make(chan *dnsQuery, r.QueueSize)
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+}
+
+func (r *Resolver) work() {
+	for q := range r.queue {
+		// Lookups whose requests have been given up while queued are
+		// skipped.
+		if err := q.ctx.Err(); err != nil {
+			q.result <- dnsResult{err: err}
+			continue
+		}
+		ctx, cancel := q.ctx, context.CancelFunc(func() {})
+		if r.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		}
+		ips, err := r.lookup(ctx, q.host)
+		cancel()
+		q.result <- dnsResult{ips: ips, err: err}
+	}
+}
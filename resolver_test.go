@@ -0,0 +1,77 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolverQueue(t *testing.T) {
+	// Arrange
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	r := &Resolver{
+		Workers:   1,
+		QueueSize: 1,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			started <- struct{}{}
+			<-release
+			return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 1)}}, nil
+		},
+	}
+
+	results := make(chan error, 2)
+	lookup := func() {
+		_, err := r.LookupIPAddr(context.Background(), "example.com")
+		results <- err
+	}
+
+	// Act
+
+	go lookup()
+	<-started
+	go lookup()
+	// Waits for the second lookup to be queued.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(r.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, busyErr := r.LookupIPAddr(context.Background(), "example.com")
+	close(release)
+
+	// Assert
+
+	assert.Equal(t, errResolverBusy, busyErr)
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results)
+}
+
+func TestResolverTimeout(t *testing.T) {
+	// Arrange
+
+	r := &Resolver{
+		Workers:   1,
+		QueueSize: 1,
+		Timeout:   10 * time.Millisecond,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	// Act
+
+	_, err := r.LookupIPAddr(context.Background(), "example.com")
+
+	// Assert
+
+	require.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
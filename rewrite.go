@@ -0,0 +1,279 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRewriteMatch is the length of the longest match of rewrite rules
+	// guaranteed to be found, as bodies are rewritten in a sliding window
+	// rather than buffered as a whole. Longer matches may be missed.
+	maxRewriteMatch = 4096
+
+	// rewriteReadSize is the number of bytes read from bodies at once.
+	rewriteReadSize = 32 << 10
+
+	// DefaultMaxRewriteSize is the number of bytes of bodies rewritten by
+	// interceptors without MaxRewriteSize.
+	DefaultMaxRewriteSize = 10 << 20
+)
+
+// RewriteRule substitutes matches of Pattern in the bodies of responses to
+// intercepted requests whose destination host matches Host and whose content
+// type matches any of ContentTypes.
+type RewriteRule struct {
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	Host string
+	// ContentTypes are the media types of rewritten responses, see
+	// Interceptor.BlockedContentTypes for the syntax.
+	ContentTypes []string
+	// Pattern is the expression whose matches are replaced. It must not
+	// match the empty string, and matches must be at most 4 KiB long.
+	Pattern *regexp.Regexp
+	// Replacement replaces matches, with $1 and ${name} expanded to the
+	// submatches of Pattern unless Literal is set.
+	Replacement string
+	Literal     bool
+}
+
+// LoadRewriteRules reads rewrite rules from the file at path. Each non-empty
+// line not starting with '#' holds a host pattern, comma separated content
+// types and a substitution, either "s|string|replacement|" replacing a
+// string or "r|regexp|replacement|" replacing matches of a regular
+// expression. Any character following the "s" or "r" delimits the parts, and
+// must not occur in them, e.g.:
+//
+//	www.example.com text/html,text/css s|https://cdn.example.com/|https://cdn-mirror.example.com/|
+//	*.example.com   text/html          r#href="http://([a-z.]+)/#href="https://$1/#
+func LoadRewriteRules(path string) ([]RewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []RewriteRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseRewriteRule(line string) (RewriteRule, error) {
+	host, rest := cutField(line)
+	types, expr := cutField(rest)
+	if types == "" || expr == "" {
+		return RewriteRule{}, fmt.Errorf("malformed rule %q", line)
+	}
+	if len(expr) < 2 || (expr[0] != 's' && expr[0] != 'r') {
+		return RewriteRule{}, fmt.Errorf("malformed substitution %q", expr)
+	}
+	parts := strings.Split(expr[2:], expr[1:2])
+	if len(parts) != 3 || parts[0] == "" || parts[2] != "" {
+		return RewriteRule{}, fmt.Errorf("malformed substitution %q", expr)
+	}
+
+	rule := RewriteRule{
+		Host:         strings.ToLower(host),
+		ContentTypes: strings.Split(strings.ToLower(types), ","),
+		Replacement:  parts[1],
+	}
+	if expr[0] == 's' {
+		rule.Pattern = regexp.MustCompile(regexp.QuoteMeta(parts[0]))
+		rule.Literal = true
+		return rule, nil
+	}
+	var err error
+	if rule.Pattern, err = regexp.Compile(parts[0]); err != nil {
+		return RewriteRule{}, err
+	}
+	if rule.Pattern.MatchString("") {
+		return RewriteRule{}, fmt.Errorf("expression %q matches the empty string", parts[0])
+	}
+	return rule, nil
+}
+
+// cutField returns the first whitespace separated field of s and the rest of
+// s following it.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// responseRewriter rewrites the responses to intercepted requests for a host.
+type responseRewriter struct {
+	logger  *zap.Logger
+	rules   []RewriteRule
+	maxSize int64
+	host    string
+}
+
+type responseRewriterKey struct{}
+
+func withResponseRewriter(ctx context.Context, rw *responseRewriter) context.Context {
+	return context.WithValue(ctx, responseRewriterKey{}, rw)
+}
+
+// responseRewriterFromContext returns the response rewriter of ctx, or nil.
+func responseRewriterFromContext(ctx context.Context) *responseRewriter {
+	rw, _ := ctx.Value(responseRewriterKey{}).(*responseRewriter)
+	return rw
+}
+
+// rewriteRules returns the rules of rules matching host.
+func rewriteRules(rules []RewriteRule, host string) []RewriteRule {
+	var matching []RewriteRule
+	for _, rule := range rules {
+		if matchHostPattern(rule.Host, host) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+// apply rewrites the body of resp with the rules matching its content type.
+// Since the length of rewritten bodies is not known in advance, they are
+// sent without Content-Length, i.e. chunked to HTTP/1.1 clients.
+func (rw *responseRewriter) apply(resp *http.Response) {
+	// Partial content can not be rewritten, nor can encoded bodies, which
+	// are requested unencoded from the destination though.
+	encoding := resp.Header.Get("Content-Encoding")
+	if resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodHead || (encoding != "" && encoding != "identity") {
+		return
+	}
+	if resp.ContentLength > rw.maxSize {
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	contentType = strings.ToLower(contentType)
+	// Streams would be delayed by the bytes held back.
+	if contentType == "text/event-stream" {
+		return
+	}
+	var body io.Reader = io.LimitReader(resp.Body, rw.maxSize)
+	rewritten := false
+	for _, rule := range rw.rules {
+		for _, pattern := range rule.ContentTypes {
+			if matchContentType(pattern, contentType) {
+				body = &rewriteReader{r: body, rule: rule}
+				rewritten = true
+				break
+			}
+		}
+	}
+	if !rewritten {
+		return
+	}
+
+	if ce := rw.logger.Check(zap.DebugLevel, "Rewriting intercepted response"); ce != nil {
+		ce.Write(zap.String("host", rw.host), zap.String("path", resp.Request.URL.Path), zap.String("contentType", contentType))
+	}
+	// Bytes beyond maxSize are passed through unchanged.
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(body, resp.Body), resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-MD5")
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+}
+
+// rewriteReader substitutes the matches of rule in the bytes read from r. It
+// keeps the last maxRewriteMatch bytes read unprocessed until more bytes are
+// read, so matches spanning reads are found.
+type rewriteReader struct {
+	r    io.Reader
+	rule RewriteRule
+
+	in  []byte
+	out []byte
+	err error
+}
+
+func (rr *rewriteReader) Read(b []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		if len(rr.in)+rewriteReadSize > cap(rr.in) {
+			in := make([]byte, len(rr.in), len(rr.in)+rewriteReadSize+maxRewriteMatch)
+			copy(in, rr.in)
+			rr.in = in
+		}
+		n, err := rr.r.Read(rr.in[len(rr.in) : len(rr.in)+rewriteReadSize])
+		rr.in = rr.in[:len(rr.in)+n]
+		rr.err = err
+		// Bytes are processed once at least as many bytes as held back
+		// are read, so small reads do not scan the window over and over.
+		if err != nil || len(rr.in) >= 2*maxRewriteMatch {
+			rr.process(err != nil)
+		}
+	}
+	n := copy(b, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// process moves the processed bytes of in to out, substituting matches. All
+// bytes of in are processed if final is set.
+func (rr *rewriteReader) process(final bool) {
+	cut := len(rr.in)
+	if !final {
+		cut -= maxRewriteMatch
+		if cut <= 0 {
+			return
+		}
+	}
+	out := rr.out[:0]
+	end := 0
+	for _, m := range rr.rule.Pattern.FindAllSubmatchIndex(rr.in, -1) {
+		if m[0] >= cut {
+			break
+		}
+		out = append(out, rr.in[end:m[0]]...)
+		if rr.rule.Literal {
+			out = append(out, rr.rule.Replacement...)
+		} else {
+			out = rr.rule.Pattern.Expand(out, []byte(rr.rule.Replacement), rr.in, m)
+		}
+		end = m[1]
+	}
+	if end < cut {
+		out = append(out, rr.in[end:cut]...)
+		end = cut
+	}
+	rr.out = out
+	rr.in = rr.in[:copy(rr.in, rr.in[end:])]
+}
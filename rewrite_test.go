@@ -0,0 +1,267 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	cases := []struct {
+		givenLine    string
+		expectedRule RewriteRule
+		expectedErr  bool
+	}{
+		{
+			givenLine: "www.example.com text/html,Text/CSS s|http://cdn.example.com/|/cdn/|",
+			expectedRule: RewriteRule{
+				Host:         "www.example.com",
+				ContentTypes: []string{"text/html", "text/css"},
+				Pattern:      regexp.MustCompile(`http://cdn\.example\.com/`),
+				Replacement:  "/cdn/",
+				Literal:      true,
+			},
+		},
+		{
+			givenLine: "*.Example.com\ttext/*  r#href=\"http://([a-z.]+)/# href=\"https://$1/#",
+			expectedRule: RewriteRule{
+				Host:         "*.example.com",
+				ContentTypes: []string{"text/*"},
+				Pattern:      regexp.MustCompile(`href="http://([a-z.]+)/`),
+				Replacement:  ` href="https://$1/`,
+			},
+		},
+		{
+			givenLine: "example.com text/html s|secret||",
+			expectedRule: RewriteRule{
+				Host:         "example.com",
+				ContentTypes: []string{"text/html"},
+				Pattern:      regexp.MustCompile(`secret`),
+				Literal:      true,
+			},
+		},
+		{givenLine: "example.com text/html", expectedErr: true},
+		{givenLine: "example.com text/html x|a|b|", expectedErr: true},
+		{givenLine: "example.com text/html s|a|b", expectedErr: true},
+		{givenLine: "example.com text/html s|a|b|c|", expectedErr: true},
+		{givenLine: "example.com text/html s||b|", expectedErr: true},
+		{givenLine: "example.com text/html r|(|b|", expectedErr: true},
+		{givenLine: "example.com text/html r|a*|b|", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.givenLine, func(t *testing.T) {
+			// Act
+
+			observed, err := parseRewriteRule(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRule, observed)
+		})
+	}
+}
+
+func TestRewriteReader(t *testing.T) {
+	literal, err := parseRewriteRule("example.com text/html s|http://example.com/|/proxied/|")
+	require.NoError(t, err)
+	expr, err := parseRewriteRule(`example.com text/html r|id=(\d+)|id=[$1]|`)
+	require.NoError(t, err)
+
+	// Matches straddle the boundaries of reads and of the processed window.
+	long := strings.Repeat("x", rewriteReadSize-10) + "http://example.com/" + strings.Repeat("y", maxRewriteMatch) + "id=42"
+
+	cases := []struct {
+		name         string
+		givenRule    RewriteRule
+		givenBody    string
+		givenOneByte bool
+		expectedBody string
+	}{
+		{
+			name:         "Literal",
+			givenRule:    literal,
+			givenBody:    `<a href="http://example.com/a">http://example.com/b</a>`,
+			expectedBody: `<a href="/proxied/a">/proxied/b</a>`,
+		},
+		{
+			name:         "Expression",
+			givenRule:    expr,
+			givenBody:    "id=1&id=23",
+			expectedBody: "id=[1]&id=[23]",
+		},
+		{
+			name:         "OneByteReads",
+			givenRule:    literal,
+			givenBody:    long,
+			givenOneByte: true,
+			expectedBody: strings.Replace(long, "http://example.com/", "/proxied/", 1),
+		},
+		{
+			name:         "LongBody",
+			givenRule:    expr,
+			givenBody:    long,
+			expectedBody: strings.Replace(long, "id=42", "id=[42]", 1),
+		},
+		{
+			name:      "Empty",
+			givenRule: literal,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			r := strings.NewReader(tc.givenBody)
+			rr := &rewriteReader{r: r, rule: tc.givenRule}
+			if tc.givenOneByte {
+				rr.r = iotest.OneByteReader(r)
+			}
+
+			// Act
+
+			observed, err := ioutil.ReadAll(rr)
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, string(observed))
+		})
+	}
+}
+
+func TestResponseRewriterApply(t *testing.T) {
+	rule, err := parseRewriteRule("example.com text/html s|http://example.com/|/proxied/|")
+	require.NoError(t, err)
+	body := "<a href=\"http://example.com/\">"
+
+	cases := []struct {
+		name            string
+		givenType       string
+		givenEncoding   string
+		givenStatus     int
+		givenMaxSize    int64
+		expectedBody    string
+		expectedRewrite bool
+	}{
+		{
+			name:            "Rewritten",
+			givenType:       "text/html; charset=utf-8",
+			givenStatus:     http.StatusOK,
+			givenMaxSize:    DefaultMaxRewriteSize,
+			expectedBody:    "<a href=\"/proxied/\">",
+			expectedRewrite: true,
+		},
+		{
+			name:         "OtherType",
+			givenType:    "application/json",
+			givenStatus:  http.StatusOK,
+			givenMaxSize: DefaultMaxRewriteSize,
+			expectedBody: body,
+		},
+		{
+			name:          "Encoded",
+			givenType:     "text/html",
+			givenEncoding: "gzip",
+			givenStatus:   http.StatusOK,
+			givenMaxSize:  DefaultMaxRewriteSize,
+			expectedBody:  body,
+		},
+		{
+			name:         "PartialContent",
+			givenType:    "text/html",
+			givenStatus:  http.StatusPartialContent,
+			givenMaxSize: DefaultMaxRewriteSize,
+			expectedBody: body,
+		},
+		{
+			name:         "TooLarge",
+			givenType:    "text/html",
+			givenStatus:  http.StatusOK,
+			givenMaxSize: 10,
+			expectedBody: body,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			rw := &responseRewriter{logger: zap.NewNop(), rules: []RewriteRule{rule}, maxSize: tc.givenMaxSize, host: "example.com"}
+			resp := &http.Response{
+				StatusCode: tc.givenStatus,
+				Header: http.Header{
+					"Content-Type":   {tc.givenType},
+					"Content-Length": {"30"},
+					"Etag":           {`"v1"`},
+				},
+				ContentLength: int64(len(body)),
+				Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+				Request:       httptest.NewRequest(http.MethodGet, "https://example.com/", nil),
+			}
+			if tc.givenEncoding != "" {
+				resp.Header.Set("Content-Encoding", tc.givenEncoding)
+			}
+
+			// Act
+
+			rw.apply(resp)
+
+			// Assert
+
+			observed, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, string(observed))
+			if tc.expectedRewrite {
+				assert.Equal(t, int64(-1), resp.ContentLength)
+				assert.Empty(t, resp.Header.Get("Content-Length"))
+				assert.Equal(t, `W/"v1"`, resp.Header.Get("Etag"))
+				return
+			}
+			assert.Equal(t, int64(len(body)), resp.ContentLength)
+			assert.Equal(t, `"v1"`, resp.Header.Get("Etag"))
+		})
+	}
+}
+
+func TestResponseRewriterMaxSize(t *testing.T) {
+	// Arrange
+
+	rule, err := parseRewriteRule("example.com text/plain s|a|b|")
+	require.NoError(t, err)
+	rw := &responseRewriter{logger: zap.NewNop(), rules: []RewriteRule{rule}, maxSize: 3, host: "example.com"}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(strings.NewReader("aaaaaa")),
+		Request:       httptest.NewRequest(http.MethodGet, "https://example.com/", nil),
+	}
+
+	// Act
+
+	rw.apply(resp)
+	observed, err := ioutil.ReadAll(resp.Body)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, "bbbaaa", string(observed), "bytes beyond the maximum size are passed through")
+}
@@ -0,0 +1,407 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// RouteAction selects how destinations matching a Route are reached.
+type RouteAction int
+
+// Actions of Route.
+const (
+	// RouteDirect dials destinations directly, even if Proxy.Upstream is
+	// set.
+	RouteDirect RouteAction = iota
+	// RouteUpstream connects to destinations via Route.Upstream.
+	RouteUpstream
+	// RouteBind dials destinations directly from one of Route.LocalAddrs.
+	RouteBind
+	// RouteBlock denies destinations.
+	RouteBlock
+)
+
+var routeActionNames = map[string]RouteAction{
+	"direct":   RouteDirect,
+	"upstream": RouteUpstream,
+	"bind":     RouteBind,
+	"block":    RouteBlock,
+}
+
+// Route selects how destinations matching either a host pattern or an IP
+// range, and one of the port ranges, are reached, e.g. to reach internal
+// hosts directly and all others via a parent proxy, or to egress from a
+// dedicated source address per destination.
+type Route struct {
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	// It is empty if CIDR is set.
+	Host string
+	// CIDR is matched against IP address destinations and the first
+	// resolved address of host names.
+	CIDR *net.IPNet
+	// Ports are the port ranges matched, any port if empty.
+	Ports  []PortRange
+	Action RouteAction
+	// Upstream is the parent proxy of RouteUpstream routes.
+	Upstream *UpstreamProxy
+	// LocalAddrs are the source addresses of RouteBind routes. Destination
+	// addresses are dialed from the first source address of the same IP
+	// family.
+	LocalAddrs []net.IP
+	// Canary, if set, routes a share of the users of the route via an
+	// alternate path instead.
+	Canary *RouteCanary
+	// ServerName, if set, is the host intercepted requests to destinations
+	// matching the route are sent to instead, presenting it as TLS server
+	// name, while their Host header still names the destination: domain
+	// fronting, e.g. to reach a service being migrated through the front of
+	// its new platform. Tunnels relayed untouched are not affected.
+	ServerName string
+	// Unthrottled exempts tunnels to destinations matching RouteDirect and
+	// RouteBind routes from Proxy.Throttle, e.g. for internal hosts which
+	// must neither go through the parent proxy nor share its bandwidth.
+	Unthrottled bool
+}
+
+// RouteCanary routes Percent of the users of a route via Upstream, or
+// directly if nil, to validate new egress infrastructure before cutting over
+// to it. Users are selected by a hash of their name, so each user
+// consistently takes the same path; unauthenticated clients take the path of
+// the route.
+type RouteCanary struct {
+	Percent  int
+	Upstream *UpstreamProxy
+}
+
+// selects reports whether the canary routes user.
+func (c *RouteCanary) selects(user string) bool {
+	if user == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	return int(h.Sum32()%100) < c.Percent
+}
+
+// LoadRoutes reads routes from the file at path. Each non-empty line not
+// starting with '#' holds a host pattern or an IP range, optionally followed
+// by a colon and comma-separated ports or port ranges as in LoadACL, and an
+// action: "direct", "block", "upstream" followed by the URL of the parent
+// proxy, or "bind" followed by a source address or the name of the network
+// interface whose addresses to bind. Routes other than "block" may end with a
+// canary, "canary=" followed by the percentage of users and, after a colon,
+// the URL of the parent proxy or "direct" to route them via instead, and with
+// "sni=" followed by the server name of intercepted requests, see
+// Route.ServerName. Routes dialing directly may end with "unthrottled", see
+// Route.Unthrottled, e.g.:
+//
+//	*.corp.example.com direct unthrottled
+//	10.0.0.0/8 bind eth1
+//	[2001:db8::/32] bind 2001:db8::10
+//	*:25 block
+//	legacy.example.com direct sni=front.example.net
+//	* upstream http://proxy.example.com:3128 canary=10:http://proxy-next.example.com:3128
+func LoadRoutes(path string) ([]Route, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var routes []Route
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		route, err := parseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		routes = append(routes, route)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func parseRoute(line string) (Route, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Route{}, fmt.Errorf("malformed route %q", line)
+	}
+
+	var route Route
+	target, ports, err := splitRuleTarget(fields[0])
+	if err != nil {
+		return Route{}, err
+	}
+	if strings.Contains(target, "/") {
+		if _, route.CIDR, err = net.ParseCIDR(target); err != nil {
+			return Route{}, err
+		}
+	} else if target == "" {
+		return Route{}, fmt.Errorf("missing target in route %q", line)
+	} else {
+		route.Host = strings.ToLower(target)
+	}
+	if route.Ports, err = parsePortRanges(ports); err != nil {
+		return Route{}, err
+	}
+
+	action, ok := routeActionNames[strings.ToLower(fields[1])]
+	if !ok {
+		return Route{}, fmt.Errorf("unknown action %q", fields[1])
+	}
+	route.Action = action
+	// Options follow the action and its argument.
+options:
+	for len(fields) > 2 {
+		last := fields[len(fields)-1]
+		switch option := strings.ToLower(last); {
+		case strings.HasPrefix(option, "canary=") && route.Canary == nil:
+			if route.Canary, err = parseRouteCanary(last[len("canary="):]); err != nil {
+				return Route{}, err
+			}
+		case strings.HasPrefix(option, "sni=") && route.ServerName == "":
+			if route.ServerName = option[len("sni="):]; !validHostname(route.ServerName) {
+				return Route{}, fmt.Errorf("invalid server name %q", route.ServerName)
+			}
+		case option == "unthrottled" && !route.Unthrottled:
+			route.Unthrottled = true
+		default:
+			break options
+		}
+		fields = fields[:len(fields)-1]
+	}
+	if action == RouteBlock && (route.Canary != nil || route.ServerName != "") {
+		return Route{}, fmt.Errorf("options of blocking route %q", line)
+	}
+	if route.Unthrottled && (action == RouteUpstream || action == RouteBlock || route.Canary != nil && route.Canary.Upstream != nil) {
+		return Route{}, fmt.Errorf("unthrottled route %q not dialing directly", line)
+	}
+	switch action {
+	case RouteUpstream, RouteBind:
+		if len(fields) != 3 {
+			return Route{}, fmt.Errorf("malformed route %q", line)
+		}
+	default:
+		if len(fields) != 2 {
+			return Route{}, fmt.Errorf("malformed route %q", line)
+		}
+	}
+	switch action {
+	case RouteUpstream:
+		if route.Upstream, err = ParseUpstreamProxy(fields[2]); err != nil {
+			return Route{}, err
+		}
+	case RouteBind:
+		if route.LocalAddrs, err = bindAddrs(fields[2]); err != nil {
+			return Route{}, err
+		}
+	}
+	return route, nil
+}
+
+// parseRouteCanary parses a canary such as "10:http://proxy.example.com:3128"
+// or "5:direct".
+func parseRouteCanary(s string) (*RouteCanary, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed canary %q", s)
+	}
+	percent, err := strconv.Atoi(s[:i])
+	if err != nil || percent < 1 || percent > 100 {
+		return nil, fmt.Errorf("malformed canary percentage %q", s[:i])
+	}
+	c := &RouteCanary{Percent: percent}
+	if via := s[i+1:]; !strings.EqualFold(via, "direct") {
+		if c.Upstream, err = ParseUpstreamProxy(via); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// bindAddrs returns the source address s, or the addresses of the network
+// interface named s.
+func bindAddrs(s string) ([]net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		// Link-local IPv6 addresses can not be bound without a zone.
+		if n, ok := addr.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() {
+			ips = append(ips, n.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses on interface %s", s)
+	}
+	return ips, nil
+}
+
+// routeFor returns the first of routes matching the destination host and
+// port, resolved to ip, or nil if none matches. If ip is nil, i.e. host has
+// not been resolved yet, decided is false if the first possibly matching
+// route is an IP range.
+func routeFor(routes []Route, host string, port int, ip net.IP) (route *Route, decided bool) {
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	for i := range routes {
+		r := &routes[i]
+		if !matchPorts(r.Ports, port) {
+			continue
+		}
+		if r.CIDR != nil {
+			if ip == nil {
+				return nil, false
+			}
+			if r.CIDR.Contains(ip) {
+				return r, true
+			}
+			continue
+		}
+		if matchHostPattern(r.Host, host) {
+			return r, true
+		}
+	}
+	return nil, true
+}
+
+// hostRoute returns the route of the destination host and port, or nil if
+// none matches by host name, without resolving host.
+func (p *Proxy) hostRoute(host string) *Route {
+	if len(p.Routes) == 0 {
+		return nil
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+	route, _ := routeFor(p.Routes, hostname, portNumber, nil)
+	return route
+}
+
+// routeServerName returns the server name intercepted requests to host are
+// sent to, see Route.ServerName, or "" if they are sent to host.
+func (p *Proxy) routeServerName(host string) string {
+	if route := p.hostRoute(host); route != nil {
+		return route.ServerName
+	}
+	return ""
+}
+
+// routeUnthrottled reports whether tunnels to host are exempt from throttling,
+// see Route.Unthrottled.
+func (p *Proxy) routeUnthrottled(host string) bool {
+	route := p.hostRoute(host)
+	return route != nil && route.Unthrottled
+}
+
+// canaryRoutes reports whether any route has a canary.
+func (p *Proxy) canaryRoutes() bool {
+	for i := range p.Routes {
+		if p.Routes[i].Canary != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// routeVia returns the route taken by the user of ctx for destinations
+// matching route: the alternate path of its canary if it selects the user,
+// or route itself.
+func (p *Proxy) routeVia(ctx context.Context, route *Route) *Route {
+	if route == nil || route.Canary == nil {
+		return route
+	}
+	user := dialUser(ctx)
+	if !route.Canary.selects(user) {
+		return route
+	}
+	p.Logger.Debug("Destination routed via canary", zap.String("user", user), zap.Int("percent", route.Canary.Percent))
+	if route.Canary.Upstream == nil {
+		return &Route{Action: RouteDirect}
+	}
+	return &Route{Action: RouteUpstream, Upstream: route.Canary.Upstream}
+}
+
+// upstreamFor returns the parent proxy destinations routed by route are
+// connected to via, or nil if they are dialed directly.
+func (p *Proxy) upstreamFor(route *Route) *UpstreamProxy {
+	if route == nil {
+		return p.Upstream
+	}
+	if route.Action == RouteUpstream {
+		return route.Upstream
+	}
+	return nil
+}
+
+// dialerFor returns the dialer of the resolved addresses of destinations
+// routed by route, using TCP Fast Open if requested by ctx.
+func (p *Proxy) dialerFor(ctx context.Context, route *Route) ContextDialer {
+	if route != nil && route.Action == RouteBind {
+		return bindDialer(route.LocalAddrs)
+	}
+	if p.Dialer != nil {
+		return p.Dialer
+	}
+	if fastOpenFromContext(ctx) {
+		return fastOpenDialer()
+	}
+	return &net.Dialer{}
+}
+
+// bindDialer dials addresses from the first of its source addresses of the
+// same IP family.
+type bindDialer []net.IP
+
+func (d bindDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("can not bind a source address to dial unresolved %s", addr)
+	}
+	for _, local := range d {
+		if isIPv4(local) != isIPv4(ip) {
+			continue
+		}
+		var laddr net.Addr = &net.TCPAddr{IP: local}
+		if strings.HasPrefix(network, "udp") {
+			laddr = &net.UDPAddr{IP: local}
+		}
+		return (&net.Dialer{LocalAddr: laddr}).DialContext(ctx, network, addr)
+	}
+	return nil, fmt.Errorf("no source address of the IP family of %s to bind", ip)
+}
@@ -0,0 +1,412 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	// Arrange
+
+	_, corp, _ := net.ParseCIDR("10.0.0.0/8")
+	_, docs, _ := net.ParseCIDR("2001:db8::/32")
+
+	cases := []struct {
+		name          string
+		givenLine     string
+		expectedRoute Route
+		expectedError bool
+	}{
+		{
+			name:          "Direct",
+			givenLine:     "*.Corp.example.com DIRECT",
+			expectedRoute: Route{Host: "*.corp.example.com", Action: RouteDirect},
+		},
+		{
+			name:          "BlockPorts",
+			givenLine:     "*:25,465-587 block",
+			expectedRoute: Route{Host: "*", Ports: []PortRange{{25, 25}, {465, 587}}, Action: RouteBlock},
+		},
+		{
+			name:          "BindAddress",
+			givenLine:     "10.0.0.0/8 bind 192.0.2.10",
+			expectedRoute: Route{CIDR: corp, Action: RouteBind, LocalAddrs: []net.IP{net.ParseIP("192.0.2.10")}},
+		},
+		{
+			name:          "BindIPv6",
+			givenLine:     "[2001:db8::/32]:443 bind 2001:db8::10",
+			expectedRoute: Route{CIDR: docs, Ports: []PortRange{{443, 443}}, Action: RouteBind, LocalAddrs: []net.IP{net.ParseIP("2001:db8::10")}},
+		},
+		{
+			name:          "UnknownAction",
+			givenLine:     "example.com tunnel",
+			expectedError: true,
+		},
+		{
+			name:          "MissingUpstream",
+			givenLine:     "example.com upstream",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidUpstream",
+			givenLine:     "example.com upstream ftp://proxy.example.com",
+			expectedError: true,
+		},
+		{
+			name:          "UnknownInterface",
+			givenLine:     "example.com bind nonexistent0",
+			expectedError: true,
+		},
+		{
+			name:          "ExtraArgument",
+			givenLine:     "example.com direct 192.0.2.10",
+			expectedError: true,
+		},
+		{
+			name:          "CanaryDirect",
+			givenLine:     "*.corp.example.com direct canary=5:DIRECT",
+			expectedRoute: Route{Host: "*.corp.example.com", Action: RouteDirect, Canary: &RouteCanary{Percent: 5}},
+		},
+		{
+			name:          "ServerName",
+			givenLine:     "legacy.example.com direct sni=Front.example.net canary=5:direct",
+			expectedRoute: Route{Host: "legacy.example.com", Action: RouteDirect, Canary: &RouteCanary{Percent: 5}, ServerName: "front.example.net"},
+		},
+		{
+			name:          "Unthrottled",
+			givenLine:     "*.corp.example.com direct canary=5:direct Unthrottled",
+			expectedRoute: Route{Host: "*.corp.example.com", Action: RouteDirect, Canary: &RouteCanary{Percent: 5}, Unthrottled: true},
+		},
+		{
+			name:          "UnthrottledUpstream",
+			givenLine:     "* upstream http://proxy.example.com:3128 unthrottled",
+			expectedError: true,
+		},
+		{
+			name:          "UnthrottledCanaryUpstream",
+			givenLine:     "* direct unthrottled canary=5:http://proxy.example.com:3128",
+			expectedError: true,
+		},
+		{
+			name:          "ServerNameOfBlock",
+			givenLine:     "legacy.example.com block sni=front.example.net",
+			expectedError: true,
+		},
+		{
+			name:          "InvalidServerName",
+			givenLine:     "legacy.example.com direct sni=front/example",
+			expectedError: true,
+		},
+		{
+			name:          "CanaryOfBlock",
+			givenLine:     "*:25 block canary=10:direct",
+			expectedError: true,
+		},
+		{
+			name:          "CanaryPercentOutOfRange",
+			givenLine:     "* direct canary=101:direct",
+			expectedError: true,
+		},
+		{
+			name:          "CanaryInvalidUpstream",
+			givenLine:     "* direct canary=10:ftp://proxy.example.com",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedRoute, err := parseRoute(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRoute, observedRoute)
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "routes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Internal\n\n*.corp.example.com direct\n* upstream http://proxy.example.com:3128\n"), 0600))
+	invalidPath := filepath.Join(dir, "invalid")
+	require.NoError(t, ioutil.WriteFile(invalidPath, []byte("* direct\n* bind\n"), 0600))
+
+	// Act
+
+	routes, err := LoadRoutes(path)
+	_, invalidErr := LoadRoutes(invalidPath)
+
+	// Assert
+
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	assert.Equal(t, RouteDirect, routes[0].Action)
+	assert.Equal(t, RouteUpstream, routes[1].Action)
+	assert.Equal(t, "proxy.example.com:3128", routes[1].Upstream.addr())
+	require.Error(t, invalidErr)
+	assert.Contains(t, invalidErr.Error(), "invalid:2:")
+}
+
+func TestLoadRoutesBindInterface(t *testing.T) {
+	// Arrange
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	// Act
+
+	route, err := parseRoute("* bind " + loopback)
+
+	// Assert
+
+	require.NoError(t, err)
+	require.NotEmpty(t, route.LocalAddrs)
+	for _, ip := range route.LocalAddrs {
+		assert.True(t, ip.IsLoopback(), ip.String())
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	// Arrange
+
+	_, corp, _ := net.ParseCIDR("10.0.0.0/8")
+	routes := []Route{
+		{Host: "blocked.example.com", Action: RouteBlock},
+		{Host: "*", Ports: []PortRange{{25, 25}}, Action: RouteBlock},
+		{CIDR: corp, Action: RouteDirect},
+		{Host: "*.example.com", Action: RouteUpstream},
+	}
+
+	cases := []struct {
+		name            string
+		givenHost       string
+		givenPort       int
+		givenIP         net.IP
+		expectedRoute   int
+		expectedDecided bool
+	}{
+		{name: "Host", givenHost: "blocked.example.com", givenPort: 443, expectedRoute: 0, expectedDecided: true},
+		{name: "Port", givenHost: "mail.example.org", givenPort: 25, expectedRoute: 1, expectedDecided: true},
+		{name: "IPAddress", givenHost: "10.1.2.3", givenPort: 443, expectedRoute: 2, expectedDecided: true},
+		{name: "Unresolved", givenHost: "www.example.com", givenPort: 443, expectedRoute: -1},
+		{name: "ResolvedInRange", givenHost: "www.example.com", givenPort: 443, givenIP: net.ParseIP("10.1.2.3"), expectedRoute: 2, expectedDecided: true},
+		{name: "ResolvedOutOfRange", givenHost: "www.example.com", givenPort: 443, givenIP: net.ParseIP("192.0.2.10"), expectedRoute: 3, expectedDecided: true},
+		{name: "NoMatch", givenHost: "192.0.2.10", givenPort: 443, expectedRoute: -1, expectedDecided: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedRoute, observedDecided := routeFor(routes, tc.givenHost, tc.givenPort, tc.givenIP)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedDecided, observedDecided)
+			if tc.expectedRoute < 0 {
+				assert.Nil(t, observedRoute)
+				return
+			}
+			assert.True(t, &routes[tc.expectedRoute] == observedRoute)
+		})
+	}
+}
+
+func TestProxyRouteUnthrottled(t *testing.T) {
+	p := newTestProxy()
+	for _, line := range []string{"*.corp.example.com direct unthrottled", "10.0.0.0/8 direct unthrottled", "* direct"} {
+		route, err := parseRoute(line)
+		require.NoError(t, err)
+		p.Routes = append(p.Routes, route)
+	}
+
+	assert.True(t, p.routeUnthrottled("git.corp.example.com:443"))
+	assert.True(t, p.routeUnthrottled("10.1.2.3:443"))
+	assert.False(t, p.routeUnthrottled("example.com:443"))
+	assert.False(t, newTestProxy().routeUnthrottled("git.corp.example.com:443"))
+}
+
+func TestParseRouteCanaryUpstream(t *testing.T) {
+	route, err := parseRoute("* upstream http://proxy-a.example.com:3128 canary=10:http://proxy-b.example.com:3128")
+
+	require.NoError(t, err)
+	assert.Equal(t, "proxy-a.example.com:3128", route.Upstream.URL.Host)
+	require.NotNil(t, route.Canary)
+	assert.Equal(t, 10, route.Canary.Percent)
+	assert.Equal(t, "proxy-b.example.com:3128", route.Canary.Upstream.URL.Host)
+}
+
+func TestRouteCanarySelects(t *testing.T) {
+	// Arrange
+
+	c := &RouteCanary{Percent: 10}
+
+	// Act
+
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		if c.selects(user) {
+			selected++
+			assert.True(t, c.selects(user), "users are selected consistently")
+		}
+	}
+
+	// Assert
+
+	assert.InDelta(t, 100, selected, 40)
+	assert.False(t, c.selects(""), "unauthenticated clients are not selected")
+	assert.True(t, (&RouteCanary{Percent: 100}).selects("alice"))
+}
+
+func TestDialContextRoutes(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	dest := echoListener.Addr().String()
+
+	upstreamServer := httptest.NewServer(newTestProxy())
+	defer upstreamServer.Close()
+	upstreamURL, err := url.Parse(upstreamServer.URL)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name            string
+		givenUser       string
+		givenRoutes     []Route
+		expectedDialer  string
+		expectedLocalIP net.IP
+		expectedError   bool
+	}{
+		{
+			name:           "Unrouted",
+			expectedDialer: "upstream",
+		},
+		{
+			name:           "Direct",
+			givenRoutes:    []Route{{Host: "127.0.0.1", Action: RouteDirect}},
+			expectedDialer: "dialer",
+		},
+		{
+			name:           "Upstream",
+			givenRoutes:    []Route{{Host: "*", Action: RouteUpstream}},
+			expectedDialer: "route",
+		},
+		{
+			name:          "Block",
+			givenRoutes:   []Route{{Host: "*", Action: RouteBlock}},
+			expectedError: true,
+		},
+		{
+			name:           "OtherPort",
+			givenRoutes:    []Route{{Host: "*", Ports: []PortRange{{1, 1}}, Action: RouteBlock}, {Host: "*", Action: RouteDirect}},
+			expectedDialer: "dialer",
+		},
+		{
+			name:            "Bind",
+			givenRoutes:     []Route{{Host: "*", Action: RouteBind, LocalAddrs: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}}},
+			expectedLocalIP: net.ParseIP("127.0.0.1"),
+		},
+		{
+			name:          "BindOtherIPFamily",
+			givenRoutes:   []Route{{Host: "*", Action: RouteBind, LocalAddrs: []net.IP{net.ParseIP("::1")}}},
+			expectedError: true,
+		},
+		{
+			name:           "Canary",
+			givenUser:      "alice",
+			givenRoutes:    []Route{{Host: "*", Action: RouteDirect, Canary: &RouteCanary{Percent: 100}}},
+			expectedDialer: "canary",
+		},
+		{
+			name:           "CanaryUnauthenticated",
+			givenRoutes:    []Route{{Host: "*", Action: RouteDirect, Canary: &RouteCanary{Percent: 100}}},
+			expectedDialer: "dialer",
+		},
+		{
+			name:           "CanaryDirect",
+			givenUser:      "alice",
+			givenRoutes:    []Route{{Host: "*", Action: RouteUpstream, Canary: &RouteCanary{Percent: 100}}},
+			expectedDialer: "dialer",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialers := map[string]*recordingDialer{"dialer": {}, "upstream": {}, "route": {}, "canary": {}}
+			p := newTestProxy()
+			p.Dialer = dialers["dialer"]
+			p.Upstream = &UpstreamProxy{URL: upstreamURL, Dialer: dialers["upstream"]}
+			p.Routes = tc.givenRoutes
+			for i := range p.Routes {
+				if p.Routes[i].Action == RouteUpstream {
+					p.Routes[i].Upstream = &UpstreamProxy{URL: upstreamURL, Dialer: dialers["route"]}
+				}
+				if c := p.Routes[i].Canary; c != nil && p.Routes[i].Action == RouteDirect {
+					c.Upstream = &UpstreamProxy{URL: upstreamURL, Dialer: dialers["canary"]}
+				}
+			}
+
+			// Act
+
+			conn, err := p.DialContext(p.withDialUser(context.Background(), tc.givenUser), "tcp", dest)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				for name, d := range dialers {
+					assert.Empty(t, d.addrs, name)
+				}
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close()
+			for name, d := range dialers {
+				if name == tc.expectedDialer {
+					assert.Len(t, d.addrs, 1, name)
+				} else {
+					assert.Empty(t, d.addrs, name)
+				}
+			}
+			if tc.expectedLocalIP != nil {
+				assert.True(t, tc.expectedLocalIP.Equal(conn.LocalAddr().(*net.TCPAddr).IP))
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+
+	// maxSignedBodySize bounds the size of request bodies buffered to be
+	// hashed for signing.
+	maxSignedBodySize = 10 << 20
+)
+
+// errSignedBodyTooLarge is returned for requests whose body is too large to be
+// signed.
+var errSignedBodyTooLarge = errors.New("request body too large to be signed")
+
+// AWSCredentials are the credentials requests are signed with.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials only.
+	SessionToken string
+}
+
+// AWSCredentialsFromEnv returns the credentials set by the standard AWS
+// environment variables.
+func AWSCredentialsFromEnv() (AWSCredentials, error) {
+	c := AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return AWSCredentials{}, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// SigningRule signs plain HTTP requests whose destination host matches Host
+// with AWS Signature Version 4, so clients without signing support can reach
+// AWS APIs through the proxy.
+type SigningRule struct {
+	// Host is a host pattern, see ResponseHeaderRule.Host for the syntax.
+	Host        string
+	Region      string
+	Service     string
+	Credentials AWSCredentials
+
+	now func() time.Time
+}
+
+// LoadSigningRules reads signing rules from the file at path, all signing
+// with credentials. Each non-empty line not starting with '#' holds a host
+// pattern followed by the AWS region and service, e.g.:
+//
+//	*.execute-api.eu-west-1.amazonaws.com eu-west-1 execute-api
+func LoadSigningRules(path string, credentials AWSCredentials) ([]SigningRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []SigningRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed rule %q", path, n, line)
+		}
+		rules = append(rules, SigningRule{
+			Host:        strings.ToLower(fields[0]),
+			Region:      fields[1],
+			Service:     fields[2],
+			Credentials: credentials,
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// signRequest signs r with the first rule matching its destination host, if
+// any.
+func signRequest(rules []SigningRule, r *http.Request) error {
+	for i := range rules {
+		if matchHostPattern(rules[i].Host, r.URL.Host) {
+			return rules[i].Sign(r)
+		}
+	}
+	return nil
+}
+
+// Sign sets the Authorization header of r to an AWS Signature Version 4
+// signature, replacing any sent by the client. The body of r is buffered to be
+// hashed.
+//
+// See: https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *SigningRule) Sign(r *http.Request) error {
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	now = now.UTC()
+
+	payloadHash, err := hashBody(r)
+	if err != nil {
+		return err
+	}
+
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	if s.Credentials.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+	if s.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Paths are encoded twice for all services but S3.
+	path := r.URL.EscapedPath()
+	if s.Service == "s3" {
+		path = r.URL.Path
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsURIEncode(path, false),
+		canonicalQuery(r.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + now.Format(sigV4TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", sigV4Algorithm+" Credential="+s.Credentials.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+// hashBody returns the hex encoded SHA-256 hash of the body of r, replacing
+// the body with a buffered copy.
+func hashBody(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxSignedBodySize {
+		return "", errSignedBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalQuery returns the query sorted by name and value, with names and
+// values encoded as required by AWS.
+func canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var params [][2]string
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		params = append(params, [2]string{awsURIEncode(queryUnescape(k), true), awsURIEncode(queryUnescape(v), true)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, kv := range params {
+		pairs[i] = kv[0] + "=" + kv[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+func queryUnescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// awsURIEncode percent-encodes all but the unreserved characters of s, and,
+// unless encodeSlash is set, '/'.
+func awsURIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningRuleSign(t *testing.T) {
+	// Arrange
+
+	// Example of https://docs.aws.amazon.com/general/latest/gr/sigv4-signed-request-examples.html
+	rule := &SigningRule{
+		Host:    "iam.amazonaws.com",
+		Region:  "us-east-1",
+		Service: "iam",
+		Credentials: AWSCredentials{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		},
+		now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	// Act
+
+	err := signRequest([]SigningRule{*rule}, r)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, "20150830T123600Z", r.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", r.Header.Get("Authorization"))
+}
+
+func TestSigningRuleSignBody(t *testing.T) {
+	// Arrange
+
+	rule := &SigningRule{Region: "eu-west-1", Service: "s3", Credentials: AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+	}}
+
+	cases := []struct {
+		name          string
+		givenBody     string
+		expectedError error
+	}{
+		{
+			name:      "Buffered",
+			givenBody: "payload",
+		},
+		{
+			name:          "TooLarge",
+			givenBody:     strings.Repeat("a", maxSignedBodySize+1),
+			expectedError: errSignedBodyTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "http://bucket.s3.amazonaws.com/a%20b", strings.NewReader(tc.givenBody))
+
+			// Act
+
+			err := rule.Sign(r)
+
+			// Assert
+
+			if tc.expectedError != nil {
+				assert.Equal(t, tc.expectedError, err)
+				return
+			}
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.givenBody, string(body))
+			assert.Equal(t, "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5", r.Header.Get("X-Amz-Content-Sha256"))
+			assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+			assert.Contains(t, r.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,")
+		})
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenQuery    string
+		expectedQuery string
+	}{
+		{name: "Empty", givenQuery: "", expectedQuery: ""},
+		{name: "SortedByNameAndValue", givenQuery: "b=2&a=x%20y&a=1&c&d=%2F~", expectedQuery: "a=1&a=x%20y&b=2&c=&d=%2F~"},
+		{name: "NamePrefix", givenQuery: "a-b=1&a=2&a.b=3&a0=4", expectedQuery: "a=2&a-b=1&a.b=3&a0=4"},
+		{name: "EncodedNamePrefix", givenQuery: "a%20b=1&a=2", expectedQuery: "a=2&a%20b=1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := canonicalQuery(tc.givenQuery)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedQuery, observed)
+		})
+	}
+}
+
+func TestLoadSigningRules(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "sigv4")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# AWS\n\nSQS.eu-west-1.amazonaws.com eu-west-1 sqs\n"), 0600))
+	malformedPath := filepath.Join(dir, "malformed")
+	require.NoError(t, ioutil.WriteFile(malformedPath, []byte("sqs.eu-west-1.amazonaws.com eu-west-1\n"), 0600))
+
+	credentials := AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}
+
+	// Act
+
+	rules, err := LoadSigningRules(path, credentials)
+	_, malformedErr := LoadSigningRules(malformedPath, credentials)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, []SigningRule{{
+		Host:        "sqs.eu-west-1.amazonaws.com",
+		Region:      "eu-west-1",
+		Service:     "sqs",
+		Credentials: credentials,
+	}}, rules)
+	require.Error(t, malformedErr)
+	assert.Contains(t, malformedErr.Error(), "malformed:1:")
+}
@@ -0,0 +1,427 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Defaults of LatencySLOs.
+const (
+	defaultSLOBurnRate    = 14.4
+	defaultSLOShortWindow = 5 * time.Minute
+	defaultSLOLongWindow  = time.Hour
+	// sloBucketsPerShortWindow is the resolution of the short window, the
+	// windows slide by a fraction of it.
+	sloBucketsPerShortWindow = 5
+)
+
+// Statuses of LatencySLOAlert.
+const (
+	sloAlertFiring   = "firing"
+	sloAlertResolved = "resolved"
+)
+
+// LatencySLO is an objective for the latency of requests to critical
+// destinations, e.g. 99% of the requests to api.partner.com within 300ms.
+// The latency of a request is the duration of dialing the destination plus
+// the duration until its first byte was received. Requests failing before
+// are not counted, as they are covered by the dial error metrics.
+type LatencySLO struct {
+	// Name identifies the objective in metrics and alerts.
+	Name string
+	// Hosts are the host patterns of the destinations, see
+	// ResponseHeaderRule.Host for the syntax.
+	Hosts []string
+	// Threshold is the latency requests meet the objective within.
+	Threshold time.Duration
+	// Objective is the fraction of requests meeting Threshold, e.g. 0.99.
+	Objective float64
+}
+
+// LatencySLOAlert is posted to LatencySLOs.AlertURL once the error budget of
+// an objective burns too fast, and once it does not anymore.
+type LatencySLOAlert struct {
+	SLO string `json:"slo"`
+	// Status is "firing" or "resolved".
+	Status string `json:"status"`
+	// Threshold is the threshold of the objective in seconds.
+	Threshold     float64   `json:"threshold"`
+	Objective     float64   `json:"objective"`
+	ShortBurnRate float64   `json:"short_burn_rate"`
+	LongBurnRate  float64   `json:"long_burn_rate"`
+	Time          time.Time `json:"time"`
+}
+
+// LatencySLOs tracks latency objectives of critical destinations, so
+// regressions of their egress paths are caught quickly. The error budget of
+// an objective is the fraction of requests allowed to exceed its threshold.
+// The burn rate over a window is the fraction of slow requests in the window
+// relative to the error budget, e.g. 1 if the budget is used up exactly over
+// the period of the objective. An alert fires once the burn rate reaches
+// BurnRate over both the short and the long window, so brief spikes do not
+// fire while alerts still resolve quickly.
+type LatencySLOs struct {
+	Logger *zap.Logger
+	SLOs   []LatencySLO
+	// AlertURL, if set, receives alerts posted as JSON objects.
+	AlertURL string
+	// Client posts the alerts, http.DefaultClient if nil.
+	Client *http.Client
+	// BurnRate is the burn rate firing an alert, 14.4 if zero, which uses up
+	// 2% of a 30 day budget within the long window of an hour.
+	BurnRate float64
+	// ShortWindow and LongWindow are the windows the burn rate is evaluated
+	// over, 5 minutes and an hour if zero.
+	ShortWindow time.Duration
+	LongWindow  time.Duration
+
+	now func() time.Time
+
+	once   sync.Once
+	width  time.Duration
+	mu     sync.Mutex
+	states []sloState
+}
+
+// sloState is the state of a single objective.
+type sloState struct {
+	requests     uint64
+	slowRequests uint64
+	// buckets count the requests of the long window in a ring, each during
+	// width from its start.
+	buckets []sloBucket
+	firing  bool
+}
+
+type sloBucket struct {
+	start    time.Time
+	requests uint64
+	slow     uint64
+}
+
+func (s *LatencySLOs) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s *LatencySLOs) shortWindow() time.Duration {
+	if s.ShortWindow <= 0 {
+		return defaultSLOShortWindow
+	}
+	return s.ShortWindow
+}
+
+func (s *LatencySLOs) longWindow() time.Duration {
+	if s.LongWindow <= 0 {
+		return defaultSLOLongWindow
+	}
+	return s.LongWindow
+}
+
+func (s *LatencySLOs) burnRate() float64 {
+	if s.BurnRate <= 0 {
+		return defaultSLOBurnRate
+	}
+	return s.BurnRate
+}
+
+// init allocates the state of the objectives.
+func (s *LatencySLOs) init() {
+	s.once.Do(func() {
+		s.width = s.shortWindow() / sloBucketsPerShortWindow
+		n := int((s.longWindow() + s.width - 1) / s.width)
+		s.states = make([]sloState, len(s.SLOs))
+		for i := range s.states {
+			s.states[i].buckets = make([]sloBucket, n)
+		}
+	})
+}
+
+// observe records the latency of a request to host from timings, if the first
+// byte was received.
+func (s *LatencySLOs) observe(host string, timings *phaseTimings) {
+	if s == nil {
+		return
+	}
+	firstByte, ok := timings.duration(phaseFirstByte)
+	if !ok {
+		return
+	}
+	dial, _ := timings.duration(phaseDial)
+	s.record(host, dial+firstByte)
+}
+
+// record counts a request to host of latency d for the objectives of host.
+func (s *LatencySLOs) record(host string, d time.Duration) {
+	s.init()
+	now := s.clock()
+	start := now.Truncate(s.width)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, slo := range s.SLOs {
+		if !slo.matches(host) {
+			continue
+		}
+		st := &s.states[i]
+		b := &st.buckets[int(start.UnixNano()/int64(s.width))%len(st.buckets)]
+		if !b.start.Equal(start) {
+			*b = sloBucket{start: start}
+		}
+		st.requests++
+		b.requests++
+		if d > slo.Threshold {
+			st.slowRequests++
+			b.slow++
+		}
+	}
+}
+
+func (slo *LatencySLO) matches(host string) bool {
+	for _, pattern := range slo.Hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// burnRates returns the burn rates of the objective i over the short and the
+// long window ending at now. It must be called with s.mu held.
+func (s *LatencySLOs) burnRates(i int, now time.Time) (short, long float64) {
+	budget := 1 - s.SLOs[i].Objective
+	if budget <= 0 {
+		return 0, 0
+	}
+	rate := func(window time.Duration) float64 {
+		// The current bucket is part of the window, which is therefore at
+		// most one bucket width shorter than window.
+		since := now.Truncate(s.width).Add(-window + s.width)
+		var requests, slow uint64
+		for _, b := range s.states[i].buckets {
+			if !b.start.Before(since) && !b.start.After(now) {
+				requests += b.requests
+				slow += b.slow
+			}
+		}
+		if requests == 0 {
+			return 0
+		}
+		return float64(slow) / float64(requests) / budget
+	}
+	return rate(s.shortWindow()), rate(s.longWindow())
+}
+
+// evaluate fires and resolves the alerts of the objectives, logging them and
+// posting them to AlertURL.
+func (s *LatencySLOs) evaluate(ctx context.Context) {
+	s.init()
+	now := s.clock()
+	threshold := s.burnRate()
+
+	var alerts []LatencySLOAlert
+	s.mu.Lock()
+	for i, slo := range s.SLOs {
+		short, long := s.burnRates(i, now)
+		firing := short >= threshold && long >= threshold
+		if firing == s.states[i].firing {
+			continue
+		}
+		s.states[i].firing = firing
+		alert := LatencySLOAlert{
+			SLO:           slo.Name,
+			Status:        sloAlertResolved,
+			Threshold:     slo.Threshold.Seconds(),
+			Objective:     slo.Objective,
+			ShortBurnRate: short,
+			LongBurnRate:  long,
+			Time:          now,
+		}
+		if firing {
+			alert.Status = sloAlertFiring
+		}
+		alerts = append(alerts, alert)
+	}
+	s.mu.Unlock()
+
+	for _, alert := range alerts {
+		fields := []zapcore.Field{
+			zap.String("slo", alert.SLO),
+			zap.Float64("shortBurnRate", alert.ShortBurnRate),
+			zap.Float64("longBurnRate", alert.LongBurnRate),
+		}
+		if alert.Status == sloAlertFiring {
+			s.Logger.Warn("Latency SLO burning error budget", fields...)
+		} else {
+			s.Logger.Info("Latency SLO recovered", fields...)
+		}
+		if s.AlertURL == "" {
+			continue
+		}
+		if err := s.post(ctx, alert); err != nil {
+			s.Logger.Error("Posting latency SLO alert failed", zap.String("slo", alert.SLO), zap.Error(err))
+		}
+	}
+}
+
+func (s *LatencySLOs) post(ctx context.Context, alert LatencySLOAlert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.AlertURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alert webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Run evaluates the objectives every interval until stop is closed.
+func (s *LatencySLOs) Run(interval time.Duration, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.evaluate(ctx)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// write writes the metrics of the objectives in the Prometheus text
+// exposition format.
+func (s *LatencySLOs) write(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.init()
+	now := s.clock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_latency_slo_requests_total Number of requests to the destinations of latency SLOs.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_latency_slo_requests_total counter")
+	for i, slo := range s.SLOs {
+		fmt.Fprintf(w, "forwardingproxy_latency_slo_requests_total{slo=\"%s\"} %d\n", escapeLabelValue(slo.Name), s.states[i].requests)
+	}
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_latency_slo_slow_requests_total Number of requests to the destinations of latency SLOs exceeding their threshold.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_latency_slo_slow_requests_total counter")
+	for i, slo := range s.SLOs {
+		fmt.Fprintf(w, "forwardingproxy_latency_slo_slow_requests_total{slo=\"%s\"} %d\n", escapeLabelValue(slo.Name), s.states[i].slowRequests)
+	}
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_latency_slo_burn_rate Rate of burning the error budget of latency SLOs by window.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_latency_slo_burn_rate gauge")
+	for i, slo := range s.SLOs {
+		short, long := s.burnRates(i, now)
+		fmt.Fprintf(w, "forwardingproxy_latency_slo_burn_rate{slo=\"%s\",window=\"short\"} %g\n", escapeLabelValue(slo.Name), short)
+		fmt.Fprintf(w, "forwardingproxy_latency_slo_burn_rate{slo=\"%s\",window=\"long\"} %g\n", escapeLabelValue(slo.Name), long)
+	}
+
+	fmt.Fprintln(w, "# HELP forwardingproxy_latency_slo_alerting Whether the alert of latency SLOs is firing.")
+	fmt.Fprintln(w, "# TYPE forwardingproxy_latency_slo_alerting gauge")
+	for i, slo := range s.SLOs {
+		firing := 0
+		if s.states[i].firing {
+			firing = 1
+		}
+		fmt.Fprintf(w, "forwardingproxy_latency_slo_alerting{slo=\"%s\"} %d\n", escapeLabelValue(slo.Name), firing)
+	}
+}
+
+// LoadLatencySLOs reads latency objectives from the file at path, one per
+// line with its name, threshold and objective in percent followed by its host
+// patterns, e.g. "partner 300ms 99.5% api.partner.com". Empty lines and lines
+// starting with # are ignored.
+func LoadLatencySLOs(path string) ([]LatencySLO, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var slos []LatencySLO
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		slo, err := parseLatencySLO(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		slos = append(slos, slo)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return slos, nil
+}
+
+func parseLatencySLO(line string) (LatencySLO, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return LatencySLO{}, fmt.Errorf("expected name, threshold, objective and hosts")
+	}
+	threshold, err := time.ParseDuration(fields[1])
+	if err != nil {
+		return LatencySLO{}, err
+	}
+	if threshold <= 0 {
+		return LatencySLO{}, fmt.Errorf("invalid threshold %q", fields[1])
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+	if err != nil || !strings.HasSuffix(fields[2], "%") || percent <= 0 || percent >= 100 {
+		return LatencySLO{}, fmt.Errorf("invalid objective %q", fields[2])
+	}
+	slo := LatencySLO{Name: fields[0], Threshold: threshold, Objective: percent / 100}
+	for _, host := range fields[3:] {
+		slo.Hosts = append(slo.Hosts, strings.ToLower(host))
+	}
+	return slo, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseLatencySLO(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenLine     string
+		expectedSLO   LatencySLO
+		expectedError bool
+	}{
+		{
+			name:        "Valid",
+			givenLine:   "partner 300ms 99.5% api.partner.com *.Partner.example.com",
+			expectedSLO: LatencySLO{Name: "partner", Hosts: []string{"api.partner.com", "*.partner.example.com"}, Threshold: 300 * time.Millisecond, Objective: 0.995},
+		},
+		{name: "MissingHosts", givenLine: "partner 300ms 99%", expectedError: true},
+		{name: "InvalidThreshold", givenLine: "partner fast 99% api.partner.com", expectedError: true},
+		{name: "ObjectiveNotPercent", givenLine: "partner 300ms 0.99 api.partner.com", expectedError: true},
+		{name: "ObjectiveTooHigh", givenLine: "partner 300ms 100% api.partner.com", expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedSLO, err := parseLatencySLO(tc.givenLine)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedSLO.Name, observedSLO.Name)
+			assert.Equal(t, tc.expectedSLO.Hosts, observedSLO.Hosts)
+			assert.Equal(t, tc.expectedSLO.Threshold, observedSLO.Threshold)
+			assert.InDelta(t, tc.expectedSLO.Objective, observedSLO.Objective, 1e-9)
+		})
+	}
+}
+
+func TestLatencySLOsAlerts(t *testing.T) {
+	// Arrange
+
+	var mu sync.Mutex
+	var alerts []LatencySLOAlert
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert LatencySLOAlert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := &LatencySLOs{
+		Logger:   zap.NewNop(),
+		SLOs:     []LatencySLO{{Name: "partner", Hosts: []string{"api.partner.com"}, Threshold: 300 * time.Millisecond, Objective: 0.99}},
+		AlertURL: webhook.URL,
+		now:      func() time.Time { return now },
+	}
+
+	// Act
+
+	// Within the objective for 55 minutes, then 20% slow requests for 5
+	// minutes, burning the budget at 20 over the short window but at less
+	// than 14.4 over the long one.
+	for i := 0; i < 55; i++ {
+		for j := 0; j < 100; j++ {
+			s.record("api.partner.com:443", 100*time.Millisecond)
+		}
+		now = now.Add(time.Minute)
+	}
+	s.record("other.example.com:443", time.Second)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100; j++ {
+			d := 100 * time.Millisecond
+			if j < 20 {
+				d = time.Second
+			}
+			s.record("api.partner.com:443", d)
+		}
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(-time.Minute)
+	s.evaluate(context.Background())
+	spike := len(alerts)
+
+	// Slow requests only for another 10 minutes, burning over both windows.
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		for j := 0; j < 100; j++ {
+			s.record("api.partner.com:443", time.Second)
+		}
+	}
+	s.evaluate(context.Background())
+	s.evaluate(context.Background())
+
+	// Within the objective again for 5 minutes.
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		for j := 0; j < 100; j++ {
+			s.record("api.partner.com:443", 100*time.Millisecond)
+		}
+	}
+	s.evaluate(context.Background())
+
+	var metrics bytes.Buffer
+	s.write(&metrics)
+
+	// Assert
+
+	assert.Equal(t, 0, spike)
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "partner", alerts[0].SLO)
+	assert.Equal(t, sloAlertFiring, alerts[0].Status)
+	assert.Equal(t, 0.3, alerts[0].Threshold)
+	assert.InDelta(t, 100, alerts[0].ShortBurnRate, 1e-6)
+	assert.True(t, alerts[0].LongBurnRate >= 14.4)
+	assert.Equal(t, sloAlertResolved, alerts[1].Status)
+	assert.Equal(t, 0.0, alerts[1].ShortBurnRate)
+	assert.Contains(t, metrics.String(), `forwardingproxy_latency_slo_requests_total{slo="partner"} 7500`)
+	assert.Contains(t, metrics.String(), `forwardingproxy_latency_slo_slow_requests_total{slo="partner"} 1100`)
+	assert.Contains(t, metrics.String(), `forwardingproxy_latency_slo_burn_rate{slo="partner",window="short"} 0`)
+	assert.Contains(t, metrics.String(), `forwardingproxy_latency_slo_alerting{slo="partner"} 0`)
+}
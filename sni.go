@@ -0,0 +1,159 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultSNITimeout is the duration tunnels wait for the ClientHello if
+// SNIPolicy.Timeout is zero.
+const defaultSNITimeout = 5 * time.Second
+
+// maxClientHelloSize bounds the size of ClientHellos read by tunnels.
+const maxClientHelloSize = 1 << 16
+
+// SNIPolicy checks the TLS server name (SNI) of the ClientHello clients open
+// their tunnels with against the destination of the tunnel, to prevent
+// domain fronting: reaching a host the ACL denies through a tunnel to an
+// allowed host served by the same CDN or load balancer. The server name of
+// tunnels to host names must be the host name. Tunnels to IP addresses have
+// no host name to match, so their server name must match Allow instead.
+// Tunnels are refused ahead of relaying any data sent by the client, while
+// the ClientHello is relayed unchanged.
+//
+// ClientHellos offering Encrypted Client Hello (ECH) name the public name of
+// a client-facing server, such as a CDN, instead of the destination, which
+// is encrypted. Their server name only needs to match ECHPublicNames.
+type SNIPolicy struct {
+	// Allow, if set, holds the host patterns of the server names allowed,
+	// see ResponseHeaderRule.Host for the syntax.
+	Allow []string
+	// ECHPublicNames, if set, holds the host patterns of the public names
+	// allowed as server name of ClientHellos offering ECH to any
+	// destination, e.g. cloudflare-ech.com. As the server name reached is
+	// encrypted, clients are trusted with it.
+	ECHPublicNames []string
+	// RequireSNI refuses tunnels not opening with a ClientHello holding a
+	// server name, such as plaintext protocols.
+	RequireSNI bool
+	// Timeout bounds waiting for the ClientHello, 5 seconds if zero.
+	// Clients sending nothing within it, e.g. of protocols the server speaks
+	// first in, are treated as sending no ClientHello.
+	Timeout time.Duration
+}
+
+func (sp *SNIPolicy) timeout() time.Duration {
+	if sp.Timeout <= 0 {
+		return defaultSNITimeout
+	}
+	return sp.Timeout
+}
+
+// check returns an error if the server name sni is not allowed for tunnels
+// to host. sni is empty if the client sent none, and ech is set if the
+// ClientHello offers ECH.
+func (sp *SNIPolicy) check(host, sni string, ech bool) error {
+	if sni == "" {
+		if sp.RequireSNI {
+			return fmt.Errorf("no TLS server name sent")
+		}
+		return nil
+	}
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	if ech && matchAnyHostPattern(sp.ECHPublicNames, sni) {
+		return nil
+	}
+	dest := destinationKey(host)
+	if net.ParseIP(dest) == nil && sni != dest {
+		return fmt.Errorf("TLS server name %q does not match the destination", sni)
+	}
+	if net.ParseIP(dest) != nil && len(sp.Allow) == 0 {
+		return fmt.Errorf("TLS server name %q sent to IP address", sni)
+	}
+	if len(sp.Allow) > 0 && !matchAnyHostPattern(sp.Allow, sni) {
+		return fmt.Errorf("TLS server name %q not allowed", sni)
+	}
+	return nil
+}
+
+func matchAnyHostPattern(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checksSNI reports whether the server names of tunnels are checked.
+func (p *Proxy) checksSNI() bool {
+	return p.SNIPolicy != nil && !p.StrictPassthrough
+}
+
+// checkTunnelSNI reads the ClientHello the client of the tunnel to host
+// opens with from r, reading from clientConn, and checks its server name
+// against SNIPolicy. It returns the bytes read, which must be relayed ahead
+// of any later data, or an error if the tunnel is refused. Tunnels opening
+// with a TLS handshake record but no complete ClientHello are refused, as
+// their server name can not be checked.
+func (p *Proxy) checkTunnelSNI(clientConn net.Conn, r io.Reader, host, user string) ([]byte, error) {
+	_ = clientConn.SetReadDeadline(time.Now().Add(p.SNIPolicy.timeout()))
+	raw, hello := readClientHello(r)
+	_ = clientConn.SetReadDeadline(time.Time{})
+
+	sni := parseClientHelloSNI(hello)
+	_, ech := clientHelloExtension(hello, tlsExtEncryptedClientHello)
+	err := p.SNIPolicy.check(host, sni, ech)
+	if hello == nil && len(raw) > 0 && raw[0] == 0x16 {
+		err = fmt.Errorf("incomplete TLS ClientHello")
+	}
+	if err != nil {
+		p.Logger.Warn("Tunnel refused by SNI policy",
+			zap.String("host", host), zap.String("user", user), zap.String("sni", sni), zap.Bool("ech", ech), zap.Error(err))
+		return nil, err
+	}
+	return raw, nil
+}
+
+// readClientHello reads the TLS records a client opens its tunnel with from
+// r until they hold a complete ClientHello, which may span several records.
+// It returns the bytes read and the ClientHello handshake message, which is
+// nil if the client sent no TLS handshake record first, r failed, or the
+// records hold another message or more than maxClientHelloSize bytes.
+func readClientHello(r io.Reader) (raw, hello []byte) {
+	for len(raw) <= maxClientHelloSize {
+		start := len(raw)
+		raw = append(raw, make([]byte, 5)...)
+		n, _ := io.ReadFull(r, raw[start:])
+		if n < 5 || raw[start] != 0x16 {
+			return raw[:start+n], nil
+		}
+		size := int(binary.BigEndian.Uint16(raw[start+3:]))
+		raw = append(raw, make([]byte, size)...)
+		n, _ = io.ReadFull(r, raw[start+5:])
+		if n < size {
+			return raw[:start+5+n], nil
+		}
+		hello = append(hello, raw[start+5:]...)
+
+		// Handshake: type and length.
+		if len(hello) < 4 {
+			continue
+		}
+		if hello[0] != 0x01 {
+			return raw, nil
+		}
+		if total := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])); len(hello) >= total {
+			return raw, hello[:total]
+		}
+	}
+	return raw, nil
+}
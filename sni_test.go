@@ -0,0 +1,180 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNIPolicyCheck(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenPolicy   SNIPolicy
+		givenHost     string
+		givenSNI      string
+		givenECH      bool
+		expectedError bool
+	}{
+		{name: "Match", givenHost: "www.example.com:443", givenSNI: "WWW.example.com."},
+		{name: "Mismatch", givenHost: "www.example.com:443", givenSNI: "blocked.example.com", expectedError: true},
+		{name: "NoSNI", givenHost: "www.example.com:443"},
+		{name: "NoSNIRequired", givenPolicy: SNIPolicy{RequireSNI: true}, givenHost: "www.example.com:443", expectedError: true},
+		{name: "Allowed", givenPolicy: SNIPolicy{Allow: []string{"*.example.com"}}, givenHost: "www.example.com:443", givenSNI: "www.example.com"},
+		{name: "NotAllowed", givenPolicy: SNIPolicy{Allow: []string{"api.example.com"}}, givenHost: "www.example.com:443", givenSNI: "www.example.com", expectedError: true},
+		{name: "IPAddress", givenHost: "192.0.2.1:443", givenSNI: "www.example.com", expectedError: true},
+		{name: "IPAddressAllowed", givenPolicy: SNIPolicy{Allow: []string{"*.example.com"}}, givenHost: "[2001:db8::1]:443", givenSNI: "www.example.com"},
+		{name: "ECHPublicName", givenPolicy: SNIPolicy{ECHPublicNames: []string{"public.example.net"}}, givenHost: "www.example.com:443", givenSNI: "public.example.net", givenECH: true},
+		{name: "ECHPublicNameToIPAddress", givenPolicy: SNIPolicy{ECHPublicNames: []string{"public.example.net"}}, givenHost: "192.0.2.1:443", givenSNI: "public.example.net", givenECH: true},
+		{name: "ECHUnknownPublicName", givenPolicy: SNIPolicy{ECHPublicNames: []string{"public.example.net"}}, givenHost: "www.example.com:443", givenSNI: "blocked.example.com", givenECH: true, expectedError: true},
+		{name: "PublicNameWithoutECH", givenPolicy: SNIPolicy{ECHPublicNames: []string{"public.example.net"}}, givenHost: "www.example.com:443", givenSNI: "public.example.net", expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			err := tc.givenPolicy.check(tc.givenHost, tc.givenSNI, tc.givenECH)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, err != nil, "%v", err)
+		})
+	}
+}
+
+// splitRecord splits the body of the TLS record b into records of size
+// bytes.
+func splitRecord(b []byte, size int) []byte {
+	var records []byte
+	for body := b[5:]; len(body) > 0; {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		records = append(append(records, b[0], b[1], b[2], byte(n>>8), byte(n)), body[:n]...)
+		body = body[n:]
+	}
+	return records
+}
+
+// withExtension returns the single record ClientHello b with an extension of
+// type typ holding data appended.
+func withExtension(b []byte, typ uint16, data []byte) []byte {
+	// Record header, handshake header, client version and random, then
+	// session ID, cipher suites and compression methods.
+	i := 5 + 4 + 2 + 32
+	i += 1 + int(b[i])
+	i += 2 + int(binary.BigEndian.Uint16(b[i:]))
+	i += 1 + int(b[i])
+
+	ext := append([]byte{byte(typ >> 8), byte(typ), byte(len(data) >> 8), byte(len(data))}, data...)
+	out := append(append([]byte{}, b...), ext...)
+	binary.BigEndian.PutUint16(out[i:], binary.BigEndian.Uint16(out[i:])+uint16(len(ext)))
+	binary.BigEndian.PutUint16(out[3:], binary.BigEndian.Uint16(out[3:])+uint16(len(ext)))
+	n := int(out[6])<<16 | int(out[7])<<8 | int(out[8]) + len(ext)
+	out[6], out[7], out[8] = byte(n>>16), byte(n>>8), byte(n)
+	return out
+}
+
+func TestClientHelloExtension(t *testing.T) {
+	// Arrange
+
+	hello := withExtension(clientHello(t, "public.example.net"), tlsExtEncryptedClientHello, []byte{0, 1, 2, 3})
+
+	// Act
+
+	ech, ok := clientHelloExtension(hello[5:], tlsExtEncryptedClientHello)
+	_, plainOK := clientHelloExtension(clientHello(t, "www.example.com")[5:], tlsExtEncryptedClientHello)
+
+	// Assert
+
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 1, 2, 3}, ech)
+	assert.Equal(t, "public.example.net", parseClientHelloSNI(hello[5:]))
+	assert.False(t, plainOK)
+}
+
+func TestProxySNIPolicy(t *testing.T) {
+	cases := []struct {
+		name            string
+		givenServerName string
+		givenData       []byte
+		expectedRelayed bool
+	}{
+		{name: "Match", givenServerName: "localhost", expectedRelayed: true},
+		{name: "Mismatch", givenServerName: "blocked.example.com"},
+		// ClientHellos split across records are reassembled.
+		{name: "SplitMatch", givenData: splitRecord(clientHello(t, "localhost"), 16), expectedRelayed: true},
+		{name: "SplitMismatch", givenData: splitRecord(clientHello(t, "blocked.example.com"), 16)},
+		{name: "Incomplete", givenData: clientHello(t, "blocked.example.com")[:40]},
+		{name: "Plaintext", givenData: []byte("GET / HTTP/1.1\r\n\r\n"), expectedRelayed: true},
+		// ClientHellos offering ECH are relayed unchanged.
+		{name: "ECHPublicName", givenData: withExtension(clientHello(t, "public.example.net"), tlsExtEncryptedClientHello, []byte{0}), expectedRelayed: true},
+		{name: "PublicNameWithoutECH", givenServerName: "public.example.net"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			destListener := startEchoServer(t)
+			defer destListener.Close()
+			_, port, err := net.SplitHostPort(destListener.Addr().String())
+			require.NoError(t, err)
+			destAddr := net.JoinHostPort("localhost", port)
+
+			p := newTestProxy()
+			p.SNIPolicy = &SNIPolicy{ECHPublicNames: []string{"public.example.net"}, Timeout: time.Second}
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			data := tc.givenData
+			if data == nil {
+				data = clientHello(t, tc.givenServerName)
+			}
+
+			// Act
+
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+			require.NoError(t, err)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			_, err = conn.Write(data)
+			require.NoError(t, err)
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			echoed, err := ioutil.ReadAll(io.LimitReader(br, int64(len(data))))
+
+			// Assert
+
+			if tc.expectedRelayed {
+				require.NoError(t, err)
+				assert.True(t, bytes.Equal(data, echoed))
+				return
+			}
+			assert.Empty(t, echoed)
+			deadline := time.Now().Add(5 * time.Second)
+			for p.destConns.Open() > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(t, int64(0), p.destConns.Open())
+		})
+	}
+}
@@ -0,0 +1,528 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SOCKS5 protocol constants.
+//
+// See: https://tools.ietf.org/html/rfc1928 and
+// https://tools.ietf.org/html/rfc1929
+const (
+	socksVersion     = 0x05
+	socksAuthVersion = 0x01
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodMetadata     = 0x80
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded           = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepNetworkUnreachable  = 0x03
+	socksRepHostUnreachable     = 0x04
+	socksRepConnectionRefused   = 0x05
+	socksRepCommandNotSupported = 0x07
+	socksRepAtypNotSupported    = 0x08
+)
+
+// maxSOCKSMetadata is the maximum number of metadata entries sent by SOCKS
+// clients.
+const maxSOCKSMetadata = 16
+
+// errSOCKSAuth is returned when a SOCKS client fails to authenticate.
+var errSOCKSAuth = errors.New("socks: authentication failed")
+
+// socksRequestError is returned for SOCKS requests which are refused with
+// Rep before the destination is dialed.
+type socksRequestError struct {
+	Rep byte
+	Msg string
+}
+
+func (e *socksRequestError) Error() string {
+	return "socks: " + e.Msg
+}
+
+// ServeSOCKS accepts SOCKS5 connections on l and tunnels them to their
+// destinations. Only the CONNECT command is enabled unless SOCKSPolicy enables
+// BIND and UDP ASSOCIATE too. If authentication is enabled, clients must
+// authenticate with the same credentials as HTTP clients using
+// username/password authentication.
+//
+// Destinations are subject to the same dialing, rate limits, egress budgets
+// and timeouts as HTTP CONNECT tunnels. ServeSOCKS always returns a non-nil
+// error once accepting connections fails, e.g. because l was closed.
+func (p *Proxy) ServeSOCKS(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Back off like net/http.Server does, rather than spinning
+				// while e.g. file descriptors are exhausted.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				p.Logger.Warn("SOCKS accept failed", zap.Error(err), zap.Duration("retryDelay", delay))
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go p.handleSOCKS(conn)
+	}
+}
+
+func (p *Proxy) handleSOCKS(conn net.Conn) {
+	relaying := false
+	defer func() {
+		if !relaying {
+			conn.Close()
+		}
+	}()
+	defer p.recoverRelay()
+
+	// Refused clients are disconnected without a reply, as they are refused
+	// ahead of the method negotiation.
+	if err := p.admitClient(conn.RemoteAddr().String()); err != nil {
+		return
+	}
+
+	// The context of the connection is canceled once it is handed to the
+	// relay or refused, like the context of an HTTP request.
+	timings := newPhaseTimings()
+	ctx, cancel := context.WithCancel(withPhaseTimings(context.Background(), timings))
+	defer cancel()
+	span := p.Tracer.start("SOCKS", timings.start, "", timings)
+	if span != nil {
+		span.setAttr("client.address", clientIP(conn.RemoteAddr()))
+		ctx = withSpan(ctx, span)
+		defer span.end()
+	}
+
+	// The handshake must complete within the client read timeout, so idle
+	// clients can not hold connections open. The deadline is cleared once the
+	// request is read, as checking and dialing the destination may take
+	// longer.
+	if p.ClientReadTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.ClientReadTimeout))
+	}
+
+	user, metadata, err := p.socksAuthenticate(ctx, conn)
+	if err != nil {
+		if err == errSOCKSAuth {
+			p.Metrics.authFailure()
+			p.Logger.Warn("Authorization attempt with invalid credentials", zap.String("protocol", "socks"))
+		} else {
+			p.Logger.Debug("SOCKS handshake failed", zap.Error(err))
+		}
+		return
+	}
+	timings.observe(phaseAuth, timings.start)
+	ctx = p.withDialUser(ctx, user)
+	if user != "" {
+		span.setAttr("enduser.id", user)
+	}
+
+	cmd, host, err := readSOCKSRequest(conn)
+	if err != nil {
+		p.Logger.Debug("SOCKS request failed", zap.Error(err))
+		if re, ok := err.(*socksRequestError); ok {
+			writeSOCKSReply(conn, re.Rep, nil)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	cp, re := p.checkSOCKSCommand(cmd, user)
+	if re != nil {
+		writeSOCKSReply(conn, re.Rep, nil)
+		return
+	}
+	if cmd == socksCmdConnect {
+		if re := p.checkSOCKSHostname(host); re != nil {
+			p.Logger.Debug("SOCKS request refused", zap.Error(re))
+			writeSOCKSReply(conn, re.Rep, nil)
+			return
+		}
+	}
+
+	p.logHost(zap.InfoLevel, "Incoming SOCKS request", host)
+	span.setDestination(host)
+	p.Metrics.connection(connKindSOCKS)
+	if len(metadata) > 0 {
+		if ce := p.Logger.Check(zap.InfoLevel, "SOCKS client metadata"); ce != nil {
+			ce.Write(zap.String("host", host), zap.String("user", user), zap.Any("metadata", metadata))
+		}
+		ctx = withRequestID(ctx, metadata["request_id"])
+	}
+
+	// The destinations of UDP associations are checked per datagram
+	// destination instead.
+	client := ClientInfo{Addr: clientIP(conn.RemoteAddr()), User: user, Metadata: metadata}
+	if cmd != socksCmdUDPAssociate {
+		if err := cp.checkDest(ctx, p, host); err != nil {
+			writeSOCKSReply(conn, socksReplyCode(err), nil)
+			return
+		}
+		if err := p.onConnect(ctx, client, host); err != nil {
+			writeSOCKSReply(conn, socksRepNotAllowed, nil)
+			return
+		}
+	}
+	userTunnel, err := p.openTunnel(user, clientIP(conn.RemoteAddr()))
+	if err != nil {
+		writeSOCKSReply(conn, socksRepNotAllowed, nil)
+		return
+	}
+	defer func() {
+		if !relaying {
+			userTunnel.close()
+		}
+	}()
+
+	switch cmd {
+	case socksCmdBind:
+		relaying = p.socksBind(ctx, conn, host, user, metadata, userTunnel)
+		return
+	case socksCmdUDPAssociate:
+		p.socksUDPAssociate(ctx, conn, client, cp)
+		return
+	}
+
+	destConn, err := p.dialTunnel(ctx, "tcp", host)
+	if err != nil {
+		span.fail(err)
+		p.captureTunnelRefused(ctx, client.Addr, user, host, err)
+		writeSOCKSReply(conn, socksReplyCode(err), nil)
+		return
+	}
+
+	if err := p.sendProxyHeader(destConn, conn.RemoteAddr()); err != nil {
+		p.Logger.Error("Writing PROXY protocol header failed", zap.String("host", host), zap.Error(err))
+		writeSOCKSReply(conn, socksRepGeneralFailure, nil)
+		destConn.Close()
+		return
+	}
+	if p.ClientWriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(p.ClientWriteTimeout))
+	}
+	if err := writeSOCKSReply(conn, socksRepSucceeded, destConn.LocalAddr()); err != nil {
+		p.Logger.Debug("Writing SOCKS reply failed", zap.String("host", host), zap.Error(err))
+		destConn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	clientConn := conn
+	if p.checksSNI() {
+		hello, err := p.checkTunnelSNI(conn, conn, host, user)
+		if err != nil {
+			p.captureTunnelRefused(ctx, client.Addr, user, host, err)
+			destConn.Close()
+			return
+		}
+		clientConn = &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	}
+
+	relaying = true
+	p.relay(ctx, clientConn, destConn, host, user, metadata, userTunnel, p.defaultTunnelTimeouts())
+}
+
+// socksAuthenticate negotiates the authentication method with a SOCKS client
+// and returns the authenticated user and the metadata sent by the client.
+//
+// Besides the methods of RFC 1928, clients may offer the private method 0x80
+// to send metadata such as their app name and the purpose of their traffic,
+// which is preferred if offered. Its subnegotiation extends the
+// username/password subnegotiation of RFC 1929 with a count of entries,
+// followed by each key and value prefixed with their length:
+//
+//	+----+------+----------+------+----------+-------+------+-----+------+-------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  | COUNT | KLEN | KEY | VLEN | VALUE |
+//	+----+------+----------+------+----------+-------+------+-----+------+-------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |   1   |  1   | ... |  1   |  ...  |
+//	+----+------+----------+------+----------+-------+------+-----+------+-------+
+//
+// The credentials are ignored if authentication is disabled.
+func (p *Proxy) socksAuthenticate(ctx context.Context, rw io.ReadWriter) (user string, metadata map[string]string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", nil, err
+	}
+	if hdr[0] != socksVersion {
+		return "", nil, fmt.Errorf("socks: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", nil, err
+	}
+
+	required := byte(socksMethodNoAuth)
+	if p.authRequired() {
+		required = socksMethodUserPass
+	}
+	selected := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodMetadata {
+			selected = m
+			break
+		}
+		if m == required {
+			selected = m
+		}
+	}
+	if selected == socksMethodNoAcceptable {
+		rw.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return "", nil, errors.New("socks: no acceptable authentication method")
+	}
+	if _, err := rw.Write([]byte{socksVersion, selected}); err != nil {
+		return "", nil, err
+	}
+	if selected == socksMethodNoAuth {
+		return "", nil, nil
+	}
+
+	if _, err := io.ReadFull(rw, hdr[:1]); err != nil {
+		return "", nil, err
+	}
+	if hdr[0] != socksAuthVersion {
+		return "", nil, fmt.Errorf("socks: unsupported authentication version %d", hdr[0])
+	}
+	user, err = readSOCKSString(rw)
+	if err != nil {
+		return "", nil, err
+	}
+	pass, err := readSOCKSString(rw)
+	if err != nil {
+		return "", nil, err
+	}
+	if selected == socksMethodMetadata {
+		if metadata, err = readSOCKSMetadata(rw); err != nil {
+			return "", nil, err
+		}
+	}
+	if p.authRequired() {
+		var ok bool
+		if user, ok = p.authenticate(ctx, user, pass, nil); !ok {
+			rw.Write([]byte{socksAuthVersion, 0x01})
+			return "", nil, errSOCKSAuth
+		}
+	} else {
+		user = ""
+	}
+	if _, err := rw.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return "", nil, err
+	}
+	return user, metadata, nil
+}
+
+// readSOCKSMetadata reads the metadata entries of the metadata method.
+func readSOCKSMetadata(r io.Reader) (map[string]string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	if n[0] > maxSOCKSMetadata {
+		return nil, fmt.Errorf("socks: %d metadata entries exceed maximum of %d", n[0], maxSOCKSMetadata)
+	}
+	metadata := make(map[string]string, n[0])
+	for i := 0; i < int(n[0]); i++ {
+		key, err := readSOCKSString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readSOCKSString(r)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// checkSOCKSHostname returns an error refusing addr if it is given as an IP
+// address and SOCKSRequireHostnames is set.
+func (p *Proxy) checkSOCKSHostname(addr string) *socksRequestError {
+	if !p.SOCKSRequireHostnames {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && net.ParseIP(host) == nil {
+		return nil
+	}
+	return &socksRequestError{Rep: socksRepAtypNotSupported, Msg: fmt.Sprintf("destination %s not given by host name", addr)}
+}
+
+// readSOCKSRequest reads a SOCKS request and returns its command and the host
+// and port of its address.
+func readSOCKSRequest(r io.Reader) (byte, string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	if hdr[0] != socksVersion {
+		return 0, "", fmt.Errorf("socks: unsupported version %d", hdr[0])
+	}
+
+	host, err := readSOCKSAddr(r, hdr[3])
+	if err != nil {
+		return 0, "", err
+	}
+
+	// The command is checked once the request was read completely, so the
+	// reply is not mistaken for a response to a partially sent request.
+	switch hdr[1] {
+	case socksCmdConnect, socksCmdBind, socksCmdUDPAssociate:
+	default:
+		return 0, "", &socksRequestError{Rep: socksRepCommandNotSupported, Msg: fmt.Sprintf("unsupported command %d", hdr[1])}
+	}
+
+	return hdr[1], host, nil
+}
+
+// readSOCKSAddr reads an address of type atyp and its port, and returns them
+// as host and port.
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var err error
+		if host, err = readSOCKSString(r); err != nil {
+			return "", err
+		}
+		if !validHostname(host) {
+			return "", &socksRequestError{Rep: socksRepGeneralFailure, Msg: fmt.Sprintf("invalid domain name %q", host)}
+		}
+	default:
+		return "", &socksRequestError{Rep: socksRepAtypNotSupported, Msg: fmt.Sprintf("unsupported address type %d", atyp)}
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// validHostname reports whether host is a non-empty host name of letters,
+// digits, hyphens, underscores and dots, so it can be passed on in requests
+// to other proxies verbatim.
+func validHostname(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// readSOCKSString reads a string prefixed with its length as a single byte.
+func readSOCKSString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeSOCKSReply writes a reply with rep and the bound address addr, which
+// may be nil for failure replies.
+func writeSOCKSReply(w io.Writer, rep byte, addr net.Addr) error {
+	b := make([]byte, 0, 6+net.IPv6len)
+	b = append(b, socksVersion, rep, 0x00)
+	b = appendSOCKSAddr(b, addr)
+	_, err := w.Write(b)
+	return err
+}
+
+// appendSOCKSAddr appends the address type, IP address and port of the TCP or
+// UDP address addr to b, or those of the unspecified IPv4 address if addr is
+// neither.
+func appendSOCKSAddr(b []byte, addr net.Addr) []byte {
+	ip, port := net.IPv4zero.To4(), 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// socksReplyCode maps an error dialing a destination to a SOCKS reply code.
+func socksReplyCode(err error) byte {
+	switch err := err.(type) {
+	case *deniedAddrError, *aclDeniedError, *rateExceededError:
+		return socksRepNotAllowed
+	case *net.DNSError, *circuitOpenError:
+		return socksRepHostUnreachable
+	case *upstreamSOCKSError:
+		return err.Rep
+	case *net.OpError:
+		if err.Timeout() {
+			return socksRepHostUnreachable
+		}
+		if se, ok := err.Err.(*os.SyscallError); ok {
+			switch se.Err {
+			case syscall.ECONNREFUSED:
+				return socksRepConnectionRefused
+			case syscall.ENETUNREACH:
+				return socksRepNetworkUnreachable
+			case syscall.EHOSTUNREACH:
+				return socksRepHostUnreachable
+			}
+		}
+	}
+	return socksRepGeneralFailure
+}
@@ -0,0 +1,335 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSOCKSRequest(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name          string
+		givenRequest  []byte
+		expectedCmd   byte
+		expectedHost  string
+		expectedRep   byte
+		expectedError bool
+	}{
+		{
+			name:         "IPv4",
+			givenRequest: []byte{5, 1, 0, 1, 192, 0, 2, 1, 0x01, 0xbb},
+			expectedCmd:  socksCmdConnect,
+			expectedHost: "192.0.2.1:443",
+		},
+		{
+			name:         "IPv6",
+			givenRequest: []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+			expectedCmd:  socksCmdConnect,
+			expectedHost: "[2001:db8::1]:80",
+		},
+		{
+			name:         "Domain",
+			givenRequest: append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x01, 0xbb),
+			expectedCmd:  socksCmdConnect,
+			expectedHost: "example.com:443",
+		},
+		{
+			name:          "InvalidDomain",
+			givenRequest:  append(append([]byte{5, 1, 0, 3, 24}, "example.com\r\nX-Injected:"...), 0x01, 0xbb),
+			expectedRep:   socksRepGeneralFailure,
+			expectedError: true,
+		},
+		{
+			name:         "UDPAssociate",
+			givenRequest: []byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0},
+			expectedCmd:  socksCmdUDPAssociate,
+			expectedHost: "0.0.0.0:0",
+		},
+		{
+			name:          "UnsupportedCommand",
+			givenRequest:  []byte{5, 9, 0, 1, 192, 0, 2, 1, 0, 80},
+			expectedRep:   socksRepCommandNotSupported,
+			expectedError: true,
+		},
+		{
+			name:          "UnsupportedAddressType",
+			givenRequest:  []byte{5, 1, 0, 9},
+			expectedRep:   socksRepAtypNotSupported,
+			expectedError: true,
+		},
+		{
+			name:          "UnsupportedVersion",
+			givenRequest:  []byte{4, 1, 0, 1, 192, 0, 2, 1, 0, 80},
+			expectedError: true,
+		},
+		{
+			name:          "Truncated",
+			givenRequest:  []byte{5, 1, 0, 1, 192, 0},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observedCmd, observedHost, err := readSOCKSRequest(bytes.NewReader(tc.givenRequest))
+
+			// Assert
+
+			if tc.expectedError {
+				require.Error(t, err)
+				if tc.expectedRep != 0 {
+					re, ok := err.(*socksRequestError)
+					require.True(t, ok)
+					assert.Equal(t, tc.expectedRep, re.Rep)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCmd, observedCmd)
+			assert.Equal(t, tc.expectedHost, observedHost)
+		})
+	}
+}
+
+func TestProxySOCKS(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	echoAddr := echoListener.Addr().(*net.TCPAddr)
+
+	cases := []struct {
+		name               string
+		givenAuth          bool
+		givenDenied        bool
+		givenHostnames     bool
+		givenMethods       []byte
+		givenCredentials   []string
+		givenMetadata      []string
+		givenApps          []string
+		givenCmd           byte
+		expectedMethod     byte
+		expectedAuthStatus byte
+		expectedRep        byte
+	}{
+		{
+			name:           "NoAuth",
+			givenMethods:   []byte{socksMethodNoAuth},
+			givenCmd:       socksCmdConnect,
+			expectedMethod: socksMethodNoAuth,
+			expectedRep:    socksRepSucceeded,
+		},
+		{
+			name:             "UserPass",
+			givenAuth:        true,
+			givenMethods:     []byte{socksMethodNoAuth, socksMethodUserPass},
+			givenCredentials: []string{"user", "pass"},
+			givenCmd:         socksCmdConnect,
+			expectedMethod:   socksMethodUserPass,
+			expectedRep:      socksRepSucceeded,
+		},
+		{
+			name:               "InvalidCredentials",
+			givenAuth:          true,
+			givenMethods:       []byte{socksMethodUserPass},
+			givenCredentials:   []string{"user", "wrong"},
+			expectedMethod:     socksMethodUserPass,
+			expectedAuthStatus: 0x01,
+		},
+		{
+			name:             "Metadata",
+			givenAuth:        true,
+			givenMethods:     []byte{socksMethodUserPass, socksMethodMetadata},
+			givenCredentials: []string{"user", "pass"},
+			givenMetadata:    []string{"app", "backup", "purpose", "nightly"},
+			givenApps:        []string{"backup"},
+			givenCmd:         socksCmdConnect,
+			expectedMethod:   socksMethodMetadata,
+			expectedRep:      socksRepSucceeded,
+		},
+		{
+			name:             "MetadataAppDenied",
+			givenAuth:        true,
+			givenMethods:     []byte{socksMethodMetadata},
+			givenCredentials: []string{"user", "pass"},
+			givenMetadata:    []string{"app", "backup"},
+			givenApps:        []string{"deploy"},
+			givenCmd:         socksCmdConnect,
+			expectedMethod:   socksMethodMetadata,
+			expectedRep:      socksRepNotAllowed,
+		},
+		{
+			name:           "NoAcceptableMethod",
+			givenAuth:      true,
+			givenMethods:   []byte{socksMethodNoAuth},
+			expectedMethod: socksMethodNoAcceptable,
+		},
+		{
+			name:           "DisabledCommand",
+			givenMethods:   []byte{socksMethodNoAuth},
+			givenCmd:       socksCmdBind,
+			expectedMethod: socksMethodNoAuth,
+			expectedRep:    socksRepCommandNotSupported,
+		},
+		{
+			name:           "DeniedAddress",
+			givenDenied:    true,
+			givenMethods:   []byte{socksMethodNoAuth},
+			givenCmd:       socksCmdConnect,
+			expectedMethod: socksMethodNoAuth,
+			expectedRep:    socksRepNotAllowed,
+		},
+		{
+			name:           "AddressNotHostname",
+			givenHostnames: true,
+			givenMethods:   []byte{socksMethodNoAuth},
+			givenCmd:       socksCmdConnect,
+			expectedMethod: socksMethodNoAuth,
+			expectedRep:    socksRepAtypNotSupported,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Proxy server
+
+			p := newTestProxy()
+			if tc.givenAuth {
+				p.AuthUser, p.AuthPass = "user", "pass"
+			}
+			if tc.givenDenied {
+				deniedCIDRs, err := ParseCIDRs("127.0.0.0/8")
+				require.NoError(t, err)
+				p.DeniedCIDRs = deniedCIDRs
+			}
+			p.SOCKSRequireHostnames = tc.givenHostnames
+			if tc.givenApps != nil {
+				p.UserPolicies = &UserPolicies{Policies: map[string]UserPolicy{"user": {Apps: tc.givenApps}}}
+			}
+
+			proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer proxyListener.Close()
+
+			go p.ServeSOCKS(proxyListener)
+
+			conn, err := net.Dial("tcp", proxyListener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			// Act & Assert
+
+			_, err = conn.Write(append([]byte{socksVersion, byte(len(tc.givenMethods))}, tc.givenMethods...))
+			require.NoError(t, err)
+
+			methodReply := make([]byte, 2)
+			_, err = io.ReadFull(conn, methodReply)
+			require.NoError(t, err)
+			assert.Equal(t, []byte{socksVersion, tc.expectedMethod}, methodReply)
+			if tc.expectedMethod == socksMethodNoAcceptable {
+				return
+			}
+
+			if tc.expectedMethod == socksMethodUserPass || tc.expectedMethod == socksMethodMetadata {
+				auth := []byte{socksAuthVersion}
+				for _, s := range tc.givenCredentials {
+					auth = append(append(auth, byte(len(s))), s...)
+				}
+				if tc.expectedMethod == socksMethodMetadata {
+					auth = append(auth, byte(len(tc.givenMetadata)/2))
+					for _, s := range tc.givenMetadata {
+						auth = append(append(auth, byte(len(s))), s...)
+					}
+				}
+				_, err = conn.Write(auth)
+				require.NoError(t, err)
+
+				authReply := make([]byte, 2)
+				_, err = io.ReadFull(conn, authReply)
+				require.NoError(t, err)
+				assert.Equal(t, []byte{socksAuthVersion, tc.expectedAuthStatus}, authReply)
+				if tc.expectedAuthStatus != 0x00 {
+					return
+				}
+			}
+
+			req := []byte{socksVersion, tc.givenCmd, 0x00, socksAtypIPv4}
+			req = append(req, echoAddr.IP.To4()...)
+			req = append(req, byte(echoAddr.Port>>8), byte(echoAddr.Port))
+			_, err = conn.Write(req)
+			require.NoError(t, err)
+
+			reply := make([]byte, 10)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedRep, reply[1])
+			if tc.expectedRep != socksRepSucceeded {
+				return
+			}
+			boundPort := int(reply[8])<<8 | int(reply[9])
+			assert.NotZero(t, boundPort)
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+
+			echo := make([]byte, 4)
+			_, err = io.ReadFull(conn, echo)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(echo))
+		})
+	}
+}
+
+// slowDialer dials after a delay.
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (d slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestProxySOCKSDialOutlastsHandshakeTimeout(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	p := newTestProxy()
+	p.ClientReadTimeout = 100 * time.Millisecond
+	p.Dialer = slowDialer{delay: 300 * time.Millisecond}
+	l := startSOCKSProxy(t, p, "user")
+	defer l.Close()
+
+	// Act
+
+	conn, reply := socksRequest(t, l, "user", socksCmdConnect, appendSOCKSAddr(nil, echoListener.Addr()))
+	defer conn.Close()
+
+	// Assert
+
+	require.Equal(t, byte(socksRepSucceeded), reply[1])
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(conn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultSOCKSBindTimeout bounds waiting for the peer of a BIND request if
+// DestDialTimeout is not set.
+const defaultSOCKSBindTimeout = 2 * time.Minute
+
+// socksBind serves the BIND request of the client conn: it listens for the
+// peer host, replies with the bound address, and relays the connection of the
+// peer once accepted. The peer is checked like the destination of a CONNECT
+// request, and only connections from its resolved addresses are accepted. It
+// reports whether the connections were handed to the relay.
+func (p *Proxy) socksBind(ctx context.Context, conn net.Conn, host, user string, metadata map[string]string, userTunnel *userTunnel) bool {
+	peerIPs, err := p.socksBindPeerAddrs(ctx, host)
+	if err != nil {
+		p.Logger.Info("SOCKS bind peer refused", zap.String("host", host), zap.Error(err))
+		writeSOCKSReply(conn, socksReplyCode(err), nil)
+		return false
+	}
+
+	// The port is bound on the address clients reached the proxy at, which
+	// is the address peers are told to connect to.
+	laddr := &net.TCPAddr{}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = local.IP
+	}
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		p.Logger.Error("SOCKS bind failed", zap.String("host", host), zap.Error(err))
+		writeSOCKSReply(conn, socksRepGeneralFailure, nil)
+		return false
+	}
+	defer l.Close()
+
+	timeout := p.DestDialTimeout
+	if timeout <= 0 {
+		timeout = defaultSOCKSBindTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	l.SetDeadline(deadline)
+	conn.SetDeadline(deadline)
+	if err := writeSOCKSReply(conn, socksRepSucceeded, l.Addr()); err != nil {
+		p.Logger.Debug("Writing SOCKS reply failed", zap.String("host", host), zap.Error(err))
+		return false
+	}
+
+	for {
+		peer, err := l.AcceptTCP()
+		if err != nil {
+			p.Logger.Info("SOCKS bind peer did not connect", zap.String("host", host), zap.Error(err))
+			writeSOCKSReply(conn, socksRepHostUnreachable, nil)
+			return false
+		}
+		// Only the expected peer may connect, so others can not take over
+		// the bound port.
+		peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+		if !containsIPAddr(peerIPs, peerAddr.IP) {
+			p.Logger.Warn("SOCKS bind connection from unexpected peer", zap.String("host", host), zap.String("peer", peerAddr.String()))
+			peer.Close()
+			continue
+		}
+		if err := writeSOCKSReply(conn, socksRepSucceeded, peerAddr); err != nil {
+			p.Logger.Debug("Writing SOCKS reply failed", zap.String("host", host), zap.Error(err))
+			peer.Close()
+			return false
+		}
+		conn.SetDeadline(time.Time{})
+
+		p.relay(ctx, conn, p.destConns.track(peer), host, user, metadata, userTunnel, p.defaultTunnelTimeouts())
+		return true
+	}
+}
+
+// socksBindPeerAddrs resolves the peer host of a BIND request and checks it
+// against the blocklist, the ACL and the denied IP ranges like DialContext.
+// Unspecified addresses are refused, as they would let any peer connect.
+func (p *Proxy) socksBindPeerAddrs(ctx context.Context, host string) ([]net.IPAddr, error) {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	acl, aclPort, aclPending, err := p.checkDestHost(ctx, "tcp", h, port)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IPAddr{{IP: net.ParseIP(h)}}
+	if ips[0].IP == nil {
+		if ips, err = p.lookupIPAddr(ctx, h); err != nil {
+			return nil, err
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", h)
+	}
+	for _, ip := range ips {
+		if ip.IP.IsUnspecified() {
+			return nil, &deniedAddrError{Host: h, IP: ip.IP}
+		}
+	}
+	if err := p.checkDestAddrs(h, ips, acl, aclPort, aclPending); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// containsIPAddr reports whether ips holds ip.
+func containsIPAddr(ips []net.IPAddr, ip net.IP) bool {
+	for _, a := range ips {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
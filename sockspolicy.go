@@ -0,0 +1,96 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// SOCKSPolicy enables the commands of SOCKS clients, each restricted by a
+// policy of its own. Commands without a policy are refused as not supported.
+type SOCKSPolicy struct {
+	Connect      *SOCKSCommandPolicy
+	Bind         *SOCKSCommandPolicy
+	UDPAssociate *SOCKSCommandPolicy
+}
+
+// SOCKSCommandPolicy restricts a SOCKS command to users and destinations.
+type SOCKSCommandPolicy struct {
+	// Users are the authenticated users allowed to use the command, all
+	// clients if empty.
+	Users []string
+	// ACL, if set, decides which destinations the command may be used for,
+	// in addition to the ACL of the proxy. The destinations of BIND are the
+	// peers expected to connect, those of UDP ASSOCIATE the destinations of
+	// datagrams.
+	ACL *ACL
+}
+
+// socksCommandNames names SOCKS commands in logs.
+var socksCommandNames = map[byte]string{
+	socksCmdConnect:      "connect",
+	socksCmdBind:         "bind",
+	socksCmdUDPAssociate: "udpassociate",
+}
+
+// command returns the policy of the SOCKS command cmd and whether cmd is
+// enabled. If sp is nil, only CONNECT is enabled, for all clients.
+func (sp *SOCKSPolicy) command(cmd byte) (*SOCKSCommandPolicy, bool) {
+	if sp == nil {
+		return nil, cmd == socksCmdConnect
+	}
+	var cp *SOCKSCommandPolicy
+	switch cmd {
+	case socksCmdConnect:
+		cp = sp.Connect
+	case socksCmdBind:
+		cp = sp.Bind
+	case socksCmdUDPAssociate:
+		cp = sp.UDPAssociate
+	}
+	return cp, cp != nil
+}
+
+// allowsUser reports whether user may use the command of cp.
+func (cp *SOCKSCommandPolicy) allowsUser(user string) bool {
+	if cp == nil || len(cp.Users) == 0 {
+		return true
+	}
+	for _, u := range cp.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDest checks the destination host of the command of cp against its
+// ACL, if any.
+func (cp *SOCKSCommandPolicy) checkDest(ctx context.Context, p *Proxy, host string) error {
+	if cp == nil || cp.ACL == nil {
+		return nil
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	return p.checkDestACL(ctx, cp.ACL, h, port)
+}
+
+// checkSOCKSCommand returns the policy of the command cmd of user, or an
+// error refusing it.
+func (p *Proxy) checkSOCKSCommand(cmd byte, user string) (*SOCKSCommandPolicy, *socksRequestError) {
+	cp, enabled := p.SOCKSPolicy.command(cmd)
+	if !enabled {
+		p.Logger.Debug("SOCKS command disabled", zap.String("command", socksCommandNames[cmd]))
+		return nil, &socksRequestError{Rep: socksRepCommandNotSupported, Msg: "command disabled"}
+	}
+	if !cp.allowsUser(user) {
+		p.Logger.Info("SOCKS command not allowed", zap.String("command", socksCommandNames[cmd]), zap.String("user", user))
+		return nil, &socksRequestError{Rep: socksRepNotAllowed, Msg: "command not allowed"}
+	}
+	return cp, nil
+}
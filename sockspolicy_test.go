@@ -0,0 +1,310 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSOCKSProxy serves SOCKS clients of p authenticating as user and
+// returns the listener.
+func startSOCKSProxy(t *testing.T, p *Proxy, user string) net.Listener {
+	p.AuthUser, p.AuthPass = user, "pass"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.ServeSOCKS(l)
+	return l
+}
+
+// socksRequest connects to the SOCKS proxy at l as user and sends a request
+// of cmd for dst, an address encoded with its type, returning the connection
+// and the reply.
+func socksRequest(t *testing.T, l net.Listener, user string, cmd byte, dst []byte) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte{socksVersion, 1, socksMethodUserPass})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	require.NoError(t, err)
+	auth := append(append([]byte{socksAuthVersion, byte(len(user))}, user...), 4, 'p', 'a', 's', 's')
+	_, err = conn.Write(auth)
+	require.NoError(t, err)
+	authReply := make([]byte, 2)
+	_, err = io.ReadFull(conn, authReply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x00), authReply[1])
+
+	_, err = conn.Write(append([]byte{socksVersion, cmd, 0x00}, dst...))
+	require.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	return conn, reply
+}
+
+func TestSOCKSCommandPolicy(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	echoAddr := echoListener.Addr().(*net.TCPAddr)
+
+	denyLoopback, err := parseACLRule("deny 127.0.0.0/8")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name        string
+		givenPolicy *SOCKSPolicy
+		givenUser   string
+		givenCmd    byte
+		expectedRep byte
+	}{
+		{
+			name:        "ConnectByDefault",
+			givenUser:   "alice",
+			givenCmd:    socksCmdConnect,
+			expectedRep: socksRepSucceeded,
+		},
+		{
+			name:        "UDPDisabledByDefault",
+			givenUser:   "alice",
+			givenCmd:    socksCmdUDPAssociate,
+			expectedRep: socksRepCommandNotSupported,
+		},
+		{
+			name:        "ConnectDisabled",
+			givenPolicy: &SOCKSPolicy{UDPAssociate: &SOCKSCommandPolicy{}},
+			givenUser:   "alice",
+			givenCmd:    socksCmdConnect,
+			expectedRep: socksRepCommandNotSupported,
+		},
+		{
+			name:        "UDPAllowedUser",
+			givenPolicy: &SOCKSPolicy{UDPAssociate: &SOCKSCommandPolicy{Users: []string{"alice"}}},
+			givenUser:   "alice",
+			givenCmd:    socksCmdUDPAssociate,
+			expectedRep: socksRepSucceeded,
+		},
+		{
+			name:        "UDPOtherUser",
+			givenPolicy: &SOCKSPolicy{UDPAssociate: &SOCKSCommandPolicy{Users: []string{"alice"}}},
+			givenUser:   "bob",
+			givenCmd:    socksCmdUDPAssociate,
+			expectedRep: socksRepNotAllowed,
+		},
+		{
+			name:        "ConnectDeniedByCommandACL",
+			givenPolicy: &SOCKSPolicy{Connect: &SOCKSCommandPolicy{ACL: &ACL{Rules: []ACLRule{denyLoopback}}}},
+			givenUser:   "alice",
+			givenCmd:    socksCmdConnect,
+			expectedRep: socksRepNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.SOCKSPolicy = tc.givenPolicy
+			l := startSOCKSProxy(t, p, tc.givenUser)
+			defer l.Close()
+
+			// Act
+
+			conn, reply := socksRequest(t, l, tc.givenUser, tc.givenCmd, appendSOCKSAddr(nil, echoAddr))
+			defer conn.Close()
+
+			// Assert
+
+			assert.Equal(t, tc.expectedRep, reply[1])
+		})
+	}
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	dest, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer dest.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := dest.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			dest.WriteToUDP(buf[:n], from)
+		}
+	}()
+	destAddr := dest.LocalAddr().(*net.UDPAddr)
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.SOCKSPolicy = &SOCKSPolicy{UDPAssociate: &SOCKSCommandPolicy{}}
+	closed := make(chan AccessRecord, 1)
+	p.Hooks = []Hooks{{OnTunnelClosed: func(ctx context.Context, stats AccessRecord) { closed <- stats }}}
+	l := startSOCKSProxy(t, p, "alice")
+	defer l.Close()
+
+	conn, reply := socksRequest(t, l, "alice", socksCmdUDPAssociate, appendSOCKSAddr(nil, &net.TCPAddr{IP: net.IPv4zero}))
+	defer conn.Close()
+	require.Equal(t, byte(socksRepSucceeded), reply[1])
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// Act
+
+	datagram := appendSOCKSAddr([]byte{0, 0, 0}, destAddr)
+	_, err = client.Write(append(datagram, "ping"...))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+
+	// Assert
+
+	target, payload, err := parseSOCKSUDPDatagram(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, destAddr.String(), target)
+	assert.Equal(t, "ping", string(payload))
+
+	// Associations are accounted for like tunnels once closed.
+	conn.Close()
+	select {
+	case rec := <-closed:
+		assert.Equal(t, "alice", rec.User)
+		assert.Equal(t, "udp", rec.Destination)
+		assert.Equal(t, int64(4), rec.BytesUp)
+		assert.Equal(t, int64(4), rec.BytesDown)
+	case <-time.After(5 * time.Second):
+		t.Fatal("association not accounted for")
+	}
+}
+
+func TestUDPAssociationExpireTargets(t *testing.T) {
+	// Arrange
+
+	now := time.Now()
+	a := &udpAssociation{targets: map[string]*udpTarget{
+		"192.0.2.1:53": {lastActive: now.Add(-udpTargetIdleTimeout).UnixNano()},
+		"192.0.2.2:53": {lastActive: now.Add(-time.Second).UnixNano()},
+	}}
+
+	// Act
+
+	a.expireTargets()
+
+	// Assert
+
+	assert.Len(t, a.targets, 1)
+	assert.Contains(t, a.targets, "192.0.2.2:53")
+}
+
+func TestSOCKSBind(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.SOCKSPolicy = &SOCKSPolicy{Bind: &SOCKSCommandPolicy{}}
+	l := startSOCKSProxy(t, p, "alice")
+	defer l.Close()
+
+	conn, reply := socksRequest(t, l, "alice", socksCmdBind, appendSOCKSAddr(nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer conn.Close()
+	require.Equal(t, byte(socksRepSucceeded), reply[1])
+	boundAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	// Act
+
+	peer, err := net.DialTCP("tcp", nil, boundAddr)
+	require.NoError(t, err)
+	defer peer.Close()
+	peerReply := make([]byte, 10)
+	_, err = io.ReadFull(conn, peerReply)
+	require.NoError(t, err)
+	_, err = peer.Write([]byte("pong"))
+	require.NoError(t, err)
+	relayed := make([]byte, 4)
+	_, err = io.ReadFull(conn, relayed)
+	require.NoError(t, err)
+
+	// Assert
+
+	assert.Equal(t, byte(socksRepSucceeded), peerReply[1])
+	assert.Equal(t, peer.LocalAddr().(*net.TCPAddr).Port, int(peerReply[8])<<8|int(peerReply[9]))
+	assert.Equal(t, "pong", string(relayed))
+}
+
+func TestSOCKSBindPeer(t *testing.T) {
+	cases := []struct {
+		name        string
+		givenDst    []byte
+		givenDenied string
+		expectedRep byte
+	}{
+		{name: "HostName", givenDst: append([]byte{socksAtypDomain, 9}, "localhost\x00\x00"...), expectedRep: socksRepSucceeded},
+		// Unspecified addresses would let any peer connect.
+		{name: "Unspecified", givenDst: []byte{socksAtypIPv4, 0, 0, 0, 0, 0, 0}, expectedRep: socksRepNotAllowed},
+		{name: "DeniedAddress", givenDst: []byte{socksAtypIPv4, 127, 0, 0, 1, 0, 0}, givenDenied: "127.0.0.0/8", expectedRep: socksRepNotAllowed},
+		{name: "Unresolvable", givenDst: append([]byte{socksAtypDomain, 7}, "invalid\x00\x00"...), expectedRep: socksRepHostUnreachable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.SOCKSPolicy = &SOCKSPolicy{Bind: &SOCKSCommandPolicy{}}
+			if tc.givenDenied != "" {
+				denied, err := ParseCIDRs(tc.givenDenied)
+				require.NoError(t, err)
+				p.DeniedCIDRs = denied
+			}
+			l := startSOCKSProxy(t, p, "alice")
+			defer l.Close()
+
+			// Act
+
+			conn, reply := socksRequest(t, l, "alice", socksCmdBind, tc.givenDst)
+			defer conn.Close()
+
+			// Assert
+
+			require.Equal(t, tc.expectedRep, reply[1])
+			if tc.expectedRep != socksRepSucceeded {
+				return
+			}
+			boundAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+			// Peers other than the resolved ones are disconnected.
+			other, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}).Dial("tcp", boundAddr.String())
+			require.NoError(t, err)
+			defer other.Close()
+			require.NoError(t, other.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = other.Read(make([]byte, 1))
+			assert.Equal(t, io.EOF, err)
+
+			peer, err := net.Dial("tcp", boundAddr.String())
+			require.NoError(t, err)
+			defer peer.Close()
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, byte(socksRepSucceeded), reply[1])
+		})
+	}
+}
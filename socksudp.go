@@ -0,0 +1,318 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxSOCKSUDPTargets bounds the destinations of a UDP association.
+	maxSOCKSUDPTargets = 256
+	// maxUDPDatagram is the size of the largest UDP datagram.
+	maxUDPDatagram = 65535
+	// udpTargetIdleTimeout is the duration after which destinations of a
+	// UDP association no datagrams were relayed from or to are forgotten
+	// once maxSOCKSUDPTargets is reached, like the UDP mappings of a NAT.
+	//
+	// See: https://tools.ietf.org/html/rfc4787#section-4.3
+	udpTargetIdleTimeout = 2 * time.Minute
+)
+
+var errSOCKSUDPTargetDenied = errors.New("socks: UDP destination denied")
+
+// udpAssociation relays the datagrams of a SOCKS UDP association.
+type udpAssociation struct {
+	p      *Proxy
+	pc     *net.UDPConn
+	tunnel *tunnelConns
+	policy *SOCKSCommandPolicy
+	client ClientInfo
+	// transcript records the datagrams relayed, nil without Transcripts.
+	transcript *tunnelTranscript
+
+	// clientAddr is the address of the first datagram of the client, the
+	// only one datagrams are relayed from and to afterwards.
+	clientAddr *net.UDPAddr
+	// targets are the destinations of the client. They are only accessed
+	// by serve.
+	targets map[string]*udpTarget
+	// lastActive is the time of the last datagram relayed in either
+	// direction in Unix nanoseconds, accessed atomically.
+	lastActive int64
+}
+
+// udpTarget is a destination of a UDP association.
+type udpTarget struct {
+	// conn is the connection to the destination, or nil if it is denied.
+	conn net.Conn
+	// lastActive is the time of the last datagram relayed from or to the
+	// destination in Unix nanoseconds, accessed atomically.
+	lastActive int64
+}
+
+func (t *udpTarget) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// socksUDPAssociate serves the UDP ASSOCIATE request of the client conn,
+// relaying datagrams between the client and their destinations until conn is
+// closed. Each destination is checked like the destination of a CONNECT
+// request when the client first sends a datagram to it. Associations are
+// accounted for like tunnels to "udp".
+func (p *Proxy) socksUDPAssociate(ctx context.Context, conn net.Conn, client ClientInfo, policy *SOCKSCommandPolicy) {
+	if p.Upstream != nil && len(p.Routes) == 0 {
+		// Upstream proxies only tunnel TCP connections, and no route
+		// reaches destinations otherwise.
+		p.Logger.Info("Refusing UDP association via upstream proxy", zap.Error(errUpstreamNetwork))
+		writeSOCKSReply(conn, socksRepCommandNotSupported, nil)
+		return
+	}
+	laddr := &net.UDPAddr{}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = local.IP
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		p.Logger.Error("SOCKS UDP associate failed", zap.Error(err))
+		writeSOCKSReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+
+	tunnel := &tunnelConns{client: conn, dest: pc, host: "udp", user: client.User}
+	ctx, ok := p.tunnels.add(ctx, tunnel)
+	if !ok {
+		p.Logger.Info("Refusing UDP association while shutting down")
+		writeSOCKSReply(conn, socksRepGeneralFailure, nil)
+		pc.Close()
+		return
+	}
+	defer p.tunnels.remove(tunnel)
+	if err := writeSOCKSReply(conn, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		p.Logger.Debug("Writing SOCKS reply failed", zap.Error(err))
+		tunnel.closeFor(reasonError)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	p.Metrics.tunnelOpened()
+	start := time.Now()
+	p.onTunnelEstablished(ctx, client, "udp")
+
+	// The association ends once the client closes its connection.
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		tunnel.closeFor(reasonClientClosed)
+	}()
+
+	a := &udpAssociation{
+		p:          p,
+		pc:         pc,
+		tunnel:     tunnel,
+		policy:     policy,
+		client:     client,
+		transcript: p.Transcripts.open(start),
+		targets:    make(map[string]*udpTarget),
+	}
+	a.touch()
+	a.serve(ctx)
+	for _, t := range a.targets {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}
+
+	// Associations are accounted for like tunnels.
+	d := time.Since(start)
+	p.accountTunnel(ctx, &AccessRecord{
+		Client:      client.Addr,
+		User:        client.User,
+		RequestID:   requestIDFromContext(ctx),
+		Metadata:    client.Metadata,
+		Destination: "udp",
+		Start:       start,
+		Duration:    d.Seconds(),
+		BytesUp:     int64(atomic.LoadUint64(&tunnel.bytesUp)),
+		BytesDown:   int64(atomic.LoadUint64(&tunnel.bytesDown)),
+		Reason:      tunnel.reason,
+	}, d, a.transcript)
+	p.Logger.Info("SOCKS UDP association closed",
+		zap.String("client", client.Addr),
+		zap.String("reason", tunnel.reason),
+		zap.Uint64("bytesUp", atomic.LoadUint64(&tunnel.bytesUp)),
+		zap.Uint64("bytesDown", atomic.LoadUint64(&tunnel.bytesDown)))
+}
+
+// serve relays the datagrams of the client to their destinations until the
+// association is closed or idle for longer than IdleTimeout.
+func (a *udpAssociation) serve(ctx context.Context) {
+	clientIP := net.ParseIP(a.client.Addr)
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		if a.p.IdleTimeout > 0 {
+			last := time.Unix(0, atomic.LoadInt64(&a.lastActive))
+			a.pc.SetReadDeadline(last.Add(a.p.IdleTimeout))
+		}
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Datagrams relayed to the client keep the association
+				// open too.
+				if time.Since(time.Unix(0, atomic.LoadInt64(&a.lastActive))) < a.p.IdleTimeout {
+					continue
+				}
+				a.tunnel.closeFor(reasonIdleTimeout)
+			} else {
+				a.tunnel.closeFor(reasonClientClosed)
+			}
+			return
+		}
+		if !from.IP.Equal(clientIP) || (a.clientAddr != nil && from.Port != a.clientAddr.Port) {
+			continue
+		}
+		if a.clientAddr == nil {
+			a.clientAddr = from
+		}
+
+		target, payload, err := parseSOCKSUDPDatagram(buf[:n])
+		if err != nil {
+			a.p.Logger.Debug("Dropping malformed SOCKS UDP datagram", zap.Error(err))
+			continue
+		}
+		if re := a.p.checkSOCKSHostname(target); re != nil {
+			a.p.Logger.Debug("Dropping SOCKS UDP datagram", zap.Error(re))
+			continue
+		}
+		dest, err := a.target(ctx, target)
+		if err != nil {
+			continue
+		}
+		var w io.Writer = dest.conn
+		if a.p.EgressBudget != nil {
+			w = &budgetWriter{w: w, budget: a.p.EgressBudget, user: a.client.User}
+		}
+		if _, err := w.Write(payload); err != nil {
+			a.p.logHost(zap.DebugLevel, "Sending UDP datagram failed", target)
+			continue
+		}
+		atomic.AddUint64(&a.tunnel.bytesUp, uint64(len(payload)))
+		a.transcript.add(true, len(payload))
+		a.touch()
+		dest.touch()
+	}
+}
+
+// target returns the destination target, checking and connecting to it
+// first if the client had not sent datagrams to it yet, or since it was
+// forgotten.
+func (a *udpAssociation) target(ctx context.Context, target string) (*udpTarget, error) {
+	if t, ok := a.targets[target]; ok {
+		if t.conn == nil {
+			return nil, errSOCKSUDPTargetDenied
+		}
+		return t, nil
+	}
+	if len(a.targets) >= maxSOCKSUDPTargets {
+		a.expireTargets()
+	}
+	if len(a.targets) >= maxSOCKSUDPTargets {
+		a.p.logHost(zap.WarnLevel, "SOCKS UDP association destination limit reached", target)
+		return nil, errSOCKSUDPTargetDenied
+	}
+
+	t := &udpTarget{}
+	t.touch()
+	a.targets[target] = t
+	c, err := a.dial(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = c
+	go a.relayReplies(t)
+	return t, nil
+}
+
+// expireTargets forgets the destinations idle for longer than
+// udpTargetIdleTimeout, closing their connections.
+func (a *udpAssociation) expireTargets() {
+	for target, t := range a.targets {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActive))) < udpTargetIdleTimeout {
+			continue
+		}
+		if t.conn != nil {
+			t.conn.Close()
+		}
+		delete(a.targets, target)
+	}
+}
+
+func (a *udpAssociation) dial(ctx context.Context, target string) (net.Conn, error) {
+	if a.p.udpViaUpstream(ctx, target) {
+		a.p.Logger.Info("SOCKS UDP destination refused", zap.String("host", target), zap.Error(errUpstreamNetwork))
+		return nil, errUpstreamNetwork
+	}
+	if err := a.policy.checkDest(ctx, a.p, target); err != nil {
+		return nil, err
+	}
+	if err := a.p.onConnect(ctx, a.client, target); err != nil {
+		return nil, err
+	}
+	c, err := a.p.DialContext(ctx, "udp", target)
+	if err != nil {
+		a.p.Logger.Info("SOCKS UDP destination refused", zap.String("host", target), zap.Error(err))
+		return nil, err
+	}
+	return c, nil
+}
+
+// relayReplies relays the datagrams received from the destination t to the
+// client until its connection is closed.
+func (a *udpAssociation) relayReplies(t *udpTarget) {
+	c := t.conn
+	hdr := appendSOCKSAddr([]byte{0, 0, 0}, c.RemoteAddr())
+	buf := make([]byte, len(hdr)+maxUDPDatagram)
+	copy(buf, hdr)
+	for {
+		n, err := c.Read(buf[len(hdr):])
+		if err != nil {
+			return
+		}
+		if _, err := a.pc.WriteToUDP(buf[:len(hdr)+n], a.clientAddr); err != nil {
+			return
+		}
+		atomic.AddUint64(&a.tunnel.bytesDown, uint64(n))
+		a.transcript.add(false, n)
+		a.touch()
+		t.touch()
+	}
+}
+
+func (a *udpAssociation) touch() {
+	atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+}
+
+// parseSOCKSUDPDatagram returns the destination host and port and the
+// payload of the SOCKS UDP datagram b. Fragmented datagrams are not
+// supported.
+func parseSOCKSUDPDatagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("socks: truncated UDP datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("socks: fragmented UDP datagram")
+	}
+	r := bytes.NewReader(b[4:])
+	target, err := readSOCKSAddr(r, b[3])
+	if err != nil {
+		return "", nil, err
+	}
+	return target, b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize is the maximum number of bytes written at once by
+// throttled tunnels, smoothing out bursts of large reads.
+const throttleChunkSize = 4096
+
+// Throttle limits the bandwidth of tunnels per tunnel, per authenticated user,
+// per bandwidth pool of users and globally, in bytes per second relayed in
+// either direction. Tunnels are slowed down by the most restrictive of these
+// limits. Each limit allows bursts of up to one second worth of data.
+type Throttle struct {
+	// ConnRate is the rate per tunnel, unlimited if zero.
+	ConnRate int64
+	// UserRate is the rate of all tunnels of a user, unlimited if zero.
+	// Unauthenticated tunnels are only subject to the other rates.
+	UserRate int64
+	// TotalRate is the rate of all tunnels, unlimited if zero.
+	TotalRate int64
+	// Pools are the bandwidth pools of authenticated users, applying on top
+	// of UserRate.
+	Pools []BandwidthPool
+
+	mu    sync.Mutex
+	now   func() time.Time
+	total *byteBucket
+	users map[string]*userBucket
+	pools map[string]*userBucket
+}
+
+// userBucket is the bucket of a user or pool, shared by its open tunnels.
+type userBucket struct {
+	bucket  *byteBucket
+	tunnels int
+}
+
+// byteBucket is a token bucket of bytes. Its tokens may become negative, as
+// bytes are reserved ahead of waiting for them.
+type byteBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int64, now time.Time) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// reserve takes n bytes from b and returns the duration to wait until they
+// are available. Buckets without rate are unlimited.
+func (b *byteBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *byteBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(rate)
+}
+
+// SetRates changes the rates of t. The user and total rates apply to open
+// tunnels as well, unless they were unlimited when these were opened, while
+// the rate per tunnel applies to new tunnels only.
+func (t *Throttle) SetRates(connRate, userRate, totalRate int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ConnRate, t.UserRate, t.TotalRate = connRate, userRate, totalRate
+	for _, ub := range t.users {
+		ub.bucket.setRate(userRate)
+	}
+	if t.total != nil {
+		t.total.setRate(totalRate)
+	}
+}
+
+// userStatus returns the rate of user and reports whether the tunnels of the
+// user are currently being slowed down. It returns zeros if t is nil.
+func (t *Throttle) userStatus(user string) (int64, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.now == nil {
+		t.now = time.Now
+	}
+	ub := t.users[user]
+	// Reserving no bytes only refills the bucket.
+	return t.UserRate, ub != nil && ub.bucket.reserve(0, t.now()) > 0
+}
+
+// tunnelThrottle is the throttle of a single tunnel, shared by both of its
+// directions.
+type tunnelThrottle struct {
+	throttle *Throttle
+	user     string
+	pool     string
+	buckets  []*byteBucket
+}
+
+// open returns the throttle of a new tunnel of user, or nil if t is nil. The
+// tunnel throttle must be closed once the tunnel is closed.
+func (t *Throttle) open(user string) *tunnelThrottle {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.now == nil {
+		t.now = time.Now
+	}
+	now := t.now()
+	tt := &tunnelThrottle{throttle: t}
+	if t.ConnRate > 0 {
+		tt.buckets = append(tt.buckets, newByteBucket(t.ConnRate, now))
+	}
+	if t.UserRate > 0 && user != "" {
+		if t.users == nil {
+			t.users = map[string]*userBucket{}
+		}
+		ub, ok := t.users[user]
+		if !ok {
+			ub = &userBucket{bucket: newByteBucket(t.UserRate, now)}
+			t.users[user] = ub
+		}
+		ub.tunnels++
+		tt.user = user
+		tt.buckets = append(tt.buckets, ub.bucket)
+	}
+	if pool := t.poolOf(user); pool != nil && user != "" {
+		if t.pools == nil {
+			t.pools = map[string]*userBucket{}
+		}
+		pb, ok := t.pools[pool.Name]
+		if !ok {
+			pb = &userBucket{bucket: newByteBucket(pool.Rate, now)}
+			t.pools[pool.Name] = pb
+		}
+		pb.tunnels++
+		tt.pool = pool.Name
+		tt.buckets = append(tt.buckets, pb.bucket)
+	}
+	if t.TotalRate > 0 {
+		if t.total == nil {
+			t.total = newByteBucket(t.TotalRate, now)
+		}
+		tt.buckets = append(tt.buckets, t.total)
+	}
+	return tt
+}
+
+// close releases the buckets of the user and pool of tt once the last tunnel
+// of the user or pool is closed.
+func (tt *tunnelThrottle) close() {
+	if tt == nil || (tt.user == "" && tt.pool == "") {
+		return
+	}
+	t := tt.throttle
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ub := t.users[tt.user]; tt.user != "" && ub != nil {
+		if ub.tunnels--; ub.tunnels == 0 {
+			delete(t.users, tt.user)
+		}
+	}
+	if pb := t.pools[tt.pool]; tt.pool != "" && pb != nil {
+		if pb.tunnels--; pb.tunnels == 0 {
+			delete(t.pools, tt.pool)
+		}
+	}
+}
+
+// wait blocks until n bytes may be relayed.
+func (tt *tunnelThrottle) wait(n int) {
+	now := tt.throttle.now()
+	var delay time.Duration
+	for _, b := range tt.buckets {
+		if d := b.reserve(n, now); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledWriter writes to w no faster than allowed by throttle.
+type throttledWriter struct {
+	w        io.Writer
+	throttle *tunnelThrottle
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		w.throttle.wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
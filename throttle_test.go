@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteBucketReserve(t *testing.T) {
+	// Arrange
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	b := newByteBucket(1000, now)
+
+	// Act & Assert
+
+	assert.Equal(t, time.Duration(0), b.reserve(1000, now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(500, now))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), b.reserve(500, now))
+
+	// Unused bandwidth accumulates up to one second worth of data.
+	now = now.Add(time.Hour)
+	assert.Equal(t, 1500*time.Millisecond, b.reserve(2500, now))
+}
+
+func TestThrottleOpen(t *testing.T) {
+	// Arrange
+
+	th := &Throttle{ConnRate: 100, UserRate: 200, TotalRate: 300}
+
+	// Act
+
+	alice1 := th.open("alice")
+	alice2 := th.open("alice")
+	anonymous := th.open("")
+
+	// Assert
+
+	require.Len(t, alice1.buckets, 3)
+	require.Len(t, alice2.buckets, 3)
+	require.Len(t, anonymous.buckets, 2)
+	assert.True(t, alice1.buckets[0] != alice2.buckets[0], "connection buckets are per tunnel")
+	assert.True(t, alice1.buckets[1] == alice2.buckets[1], "user buckets are shared")
+	assert.True(t, alice1.buckets[2] == anonymous.buckets[1], "total bucket is shared")
+
+	alice1.close()
+	assert.Len(t, th.users, 1)
+	alice2.close()
+	anonymous.close()
+	assert.Empty(t, th.users)
+
+	assert.Nil(t, (*Throttle)(nil).open("alice"))
+}
+
+func TestThrottleSetRates(t *testing.T) {
+	// Arrange
+
+	th := &Throttle{ConnRate: 100, UserRate: 200, TotalRate: 300}
+	open := th.open("alice")
+
+	// Act
+
+	th.SetRates(1000, 2000, 0)
+
+	// Assert
+
+	assert.Equal(t, float64(100), open.buckets[0].rate, "open tunnels keep their rate")
+	assert.Equal(t, float64(2000), open.buckets[1].rate)
+	assert.Equal(t, time.Duration(0), open.buckets[2].reserve(1000, th.now()), "total rate is unlimited")
+	assert.Len(t, th.open("bob").buckets, 2, "new tunnels skip the disabled total rate")
+}
+
+func TestThrottledWriter(t *testing.T) {
+	// Arrange
+
+	var buf bytes.Buffer
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	th := &Throttle{TotalRate: 1 << 30, now: func() time.Time { return now }}
+	w := &throttledWriter{w: &buf, throttle: th.open("")}
+	given := bytes.Repeat([]byte("a"), 3*throttleChunkSize+1)
+
+	// Act
+
+	n, err := w.Write(given)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, len(given), n)
+	assert.Equal(t, given, buf.Bytes())
+	assert.InDelta(t, float64(1<<30-len(given)), th.total.tokens, 1)
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// idleTimeoutHeader is the request header trusted clients can use to request
+// a tunnel timeout deviating from the configured defaults, e.g. for long
+// running downloads. Its value is either a duration such as "15m" or a number
+// of seconds.
+const idleTimeoutHeader = "X-Proxy-Idle-Timeout"
+
+const (
+	// heartbeatFrameSize is the maximum bytes of heartbeat frames, leaving
+	// room for the TLS record overhead of tiny WebSocket frames.
+	heartbeatFrameSize = 512
+
+	// heartbeatMinInterval is the minimum duration since the data before a
+	// small frame to count it as heartbeat, so replies arriving right after a
+	// heartbeat are not counted.
+	heartbeatMinInterval = time.Second
+
+	// heartbeatFrames is the number of heartbeat frames in a row after which
+	// a tunnel is classified as heartbeat tunnel.
+	heartbeatFrames = 3
+)
+
+// tunnelTimeouts holds the timeouts applied to a tunnel.
+type tunnelTimeouts struct {
+	// Idle is the duration without data relayed in either direction after
+	// which the tunnel is closed, unlimited if zero.
+	Idle time.Duration
+	// HeartbeatIdle replaces Idle once the tunnel is classified as heartbeat
+	// tunnel, disabling the classification if zero.
+	HeartbeatIdle time.Duration
+	// ClientWrite and DestWrite bound single writes to either side.
+	ClientWrite time.Duration
+	DestWrite   time.Duration
+	// MaxLifetime is the duration after which the tunnel is closed
+	// regardless of activity, unlimited if zero.
+	MaxLifetime time.Duration
+}
+
+// tunnelTimeouts returns the timeouts for the tunnel requested by r. These are
+// the configured defaults, unless a trusted client requested a different idle
+// timeout via idleTimeoutHeader, which is capped at MaxRequestedIdleTimeout.
+func (p *Proxy) tunnelTimeouts(r *http.Request) tunnelTimeouts {
+	t := p.defaultTunnelTimeouts()
+
+	v := r.Header.Get(idleTimeoutHeader)
+	if v == "" || p.MaxRequestedIdleTimeout <= 0 {
+		return t
+	}
+	if !p.isTrustedClient(r) {
+		p.Logger.Info("Ignoring idle timeout requested by untrusted client", zap.String("remote", r.RemoteAddr))
+		return t
+	}
+	d, err := parseIdleTimeout(v)
+	if err != nil || d <= 0 {
+		p.Logger.Info("Ignoring invalid requested idle timeout", zap.String("value", v))
+		return t
+	}
+	if d > p.MaxRequestedIdleTimeout {
+		d = p.MaxRequestedIdleTimeout
+	}
+
+	p.Logger.Debug("Using requested idle timeout", zap.String("host", r.Host), zap.Duration("timeout", d))
+	// Requested timeouts apply to heartbeat traffic too.
+	t.Idle = d
+	t.HeartbeatIdle = 0
+	return t
+}
+
+// defaultTunnelTimeouts returns the configured tunnel timeouts.
+func (p *Proxy) defaultTunnelTimeouts() tunnelTimeouts {
+	return tunnelTimeouts{
+		Idle:          p.IdleTimeout,
+		HeartbeatIdle: p.HeartbeatIdleTimeout,
+		ClientWrite:   p.ClientWriteTimeout,
+		DestWrite:     p.DestWriteTimeout,
+		MaxLifetime:   p.MaxTunnelLifetime,
+	}
+}
+
+// isTrustedClient reports whether the client of r is either authenticated or
+// connecting from one of the trusted IP ranges. Requests only reach the
+// handlers when authentication succeeded, thus any client is authenticated if
+// authentication is enabled.
+func (p *Proxy) isTrustedClient(r *http.Request) bool {
+	if p.authRequiredFor(r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(p.TrustedClientCIDRs, ip)
+}
+
+func parseIdleTimeout(v string) (time.Duration, error) {
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// tunnelActivity tracks the activity of a tunnel shared by both of its
+// directions, so that a tunnel relaying data in a single direction is not
+// considered idle. Tunnels relaying heartbeatFrames small frames in a row,
+// each at least heartbeatMinInterval after the data before it, are classified
+// as heartbeat tunnels and become idle after heartbeatIdle instead of idle.
+type tunnelActivity struct {
+	idle          time.Duration
+	heartbeatIdle time.Duration
+	// end is the end of the lifetime of the tunnel, zero if unlimited.
+	end time.Time
+	// last is the time of the last data relayed in Unix nanoseconds.
+	last int64
+	// heartbeats is the number of heartbeat frames relayed in a row.
+	heartbeats int32
+
+	now func() time.Time
+}
+
+func newTunnelActivity(timeouts tunnelTimeouts, now time.Time) *tunnelActivity {
+	a := &tunnelActivity{idle: timeouts.Idle, heartbeatIdle: timeouts.HeartbeatIdle, last: now.UnixNano()}
+	if timeouts.MaxLifetime > 0 {
+		a.end = now.Add(timeouts.MaxLifetime)
+	}
+	return a
+}
+
+func (a *tunnelActivity) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// touch records that n bytes were relayed.
+func (a *tunnelActivity) touch(n int) {
+	now := a.clock().UnixNano()
+	last := atomic.SwapInt64(&a.last, now)
+	if a.heartbeatIdle <= 0 || a.heartbeat() {
+		return
+	}
+	switch {
+	case n > heartbeatFrameSize:
+		atomic.StoreInt32(&a.heartbeats, 0)
+	case time.Duration(now-last) >= heartbeatMinInterval:
+		atomic.AddInt32(&a.heartbeats, 1)
+	}
+}
+
+// heartbeat reports whether the tunnel is classified as heartbeat tunnel.
+func (a *tunnelActivity) heartbeat() bool {
+	return atomic.LoadInt32(&a.heartbeats) >= heartbeatFrames
+}
+
+// readDeadline returns the time at which the tunnel becomes idle, capped at
+// the end of its lifetime.
+func (a *tunnelActivity) readDeadline() time.Time {
+	if a.idle <= 0 {
+		return a.end
+	}
+	idle := a.idle
+	if a.heartbeatIdle > 0 && a.heartbeat() {
+		idle = a.heartbeatIdle
+	}
+	return a.capped(time.Unix(0, atomic.LoadInt64(&a.last)).Add(idle))
+}
+
+// writeDeadline returns the deadline of a write starting now bounded by
+// timeout.
+func (a *tunnelActivity) writeDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return a.end
+	}
+	return a.capped(a.clock().Add(timeout))
+}
+
+func (a *tunnelActivity) capped(t time.Time) time.Time {
+	if !a.end.IsZero() && a.end.Before(t) {
+		return a.end
+	}
+	return t
+}
+
+// activityConn refreshes the deadlines of Conn with every read and write, so
+// tunnels are only closed once idle in both directions, or once their
+// lifetime ended.
+type activityConn struct {
+	net.Conn
+	activity     *tunnelActivity
+	writeTimeout time.Duration
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	for {
+		if err := c.Conn.SetReadDeadline(c.activity.readDeadline()); err != nil {
+			return 0, err
+		}
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.activity.touch(n)
+		}
+		// The read timed out, but data was relayed in the other direction
+		// since the read started.
+		if n == 0 && isTimeout(err) && c.activity.clock().Before(c.activity.readDeadline()) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(c.activity.writeDeadline(c.writeTimeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.activity.touch(n)
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
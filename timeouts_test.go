@@ -0,0 +1,261 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTunnelTimeouts(t *testing.T) {
+	// Arrange
+
+	trusted, err := ParseCIDRs("10.0.0.0/8")
+	require.NoError(t, err)
+
+	defaults := tunnelTimeouts{
+		Idle:        1 * time.Second,
+		ClientWrite: 2 * time.Second,
+		DestWrite:   3 * time.Second,
+		MaxLifetime: 4 * time.Second,
+	}
+
+	cases := []struct {
+		name             string
+		givenAuth        bool
+		givenRemoteAddr  string
+		givenHeader      string
+		givenMaxTimeout  time.Duration
+		expectedTimeouts tunnelTimeouts
+	}{
+		{
+			name:             "NoHeader",
+			givenRemoteAddr:  "10.0.0.1:1234",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: defaults,
+		},
+		{
+			name:             "Disabled",
+			givenRemoteAddr:  "10.0.0.1:1234",
+			givenHeader:      "10m",
+			expectedTimeouts: defaults,
+		},
+		{
+			name:             "Untrusted",
+			givenRemoteAddr:  "192.168.0.1:1234",
+			givenHeader:      "10m",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: defaults,
+		},
+		{
+			name:             "TrustedIP",
+			givenRemoteAddr:  "10.0.0.1:1234",
+			givenHeader:      "10m",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: tunnelTimeouts{Idle: 10 * time.Minute, ClientWrite: 2 * time.Second, DestWrite: 3 * time.Second, MaxLifetime: 4 * time.Second},
+		},
+		{
+			name:             "Authenticated",
+			givenAuth:        true,
+			givenRemoteAddr:  "192.168.0.1:1234",
+			givenHeader:      "600",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: tunnelTimeouts{Idle: 10 * time.Minute, ClientWrite: 2 * time.Second, DestWrite: 3 * time.Second, MaxLifetime: 4 * time.Second},
+		},
+		{
+			name:             "Capped",
+			givenRemoteAddr:  "10.0.0.1:1234",
+			givenHeader:      "2h",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: tunnelTimeouts{Idle: time.Hour, ClientWrite: 2 * time.Second, DestWrite: 3 * time.Second, MaxLifetime: 4 * time.Second},
+		},
+		{
+			name:             "Invalid",
+			givenRemoteAddr:  "10.0.0.1:1234",
+			givenHeader:      "forever",
+			givenMaxTimeout:  time.Hour,
+			expectedTimeouts: defaults,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{
+				Logger:                  zap.NewNop(),
+				IdleTimeout:             defaults.Idle,
+				ClientWriteTimeout:      defaults.ClientWrite,
+				DestWriteTimeout:        defaults.DestWrite,
+				MaxTunnelLifetime:       defaults.MaxLifetime,
+				TrustedClientCIDRs:      trusted,
+				MaxRequestedIdleTimeout: tc.givenMaxTimeout,
+			}
+			if tc.givenAuth {
+				p.AuthUser, p.AuthPass = "user", "pass"
+			}
+
+			req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			req.RemoteAddr = tc.givenRemoteAddr
+			if tc.givenHeader != "" {
+				req.Header.Set(idleTimeoutHeader, tc.givenHeader)
+			}
+
+			// Act
+
+			observedTimeouts := p.tunnelTimeouts(req)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedTimeouts, observedTimeouts)
+		})
+	}
+}
+
+func TestActivityConnRead(t *testing.T) {
+	// Arrange
+
+	cases := []struct {
+		name           string
+		givenTimeouts  tunnelTimeouts
+		givenActiveFor time.Duration
+		expectedAfter  time.Duration
+	}{
+		{
+			name:          "Idle",
+			givenTimeouts: tunnelTimeouts{Idle: 100 * time.Millisecond},
+			expectedAfter: 100 * time.Millisecond,
+		},
+		{
+			name:           "ActiveInOtherDirection",
+			givenTimeouts:  tunnelTimeouts{Idle: 100 * time.Millisecond},
+			givenActiveFor: 300 * time.Millisecond,
+			expectedAfter:  390 * time.Millisecond,
+		},
+		{
+			name:           "MaxLifetime",
+			givenTimeouts:  tunnelTimeouts{Idle: 100 * time.Millisecond, MaxLifetime: 200 * time.Millisecond},
+			givenActiveFor: 300 * time.Millisecond,
+			expectedAfter:  200 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Unix(1500000000, 0)
+			now := start
+			activity := newTunnelActivity(tc.givenTimeouts, start)
+			activity.now = func() time.Time { return now }
+			// Waiting for the read deadline passes fake time, during which
+			// data is relayed in the other direction every 10ms for
+			// givenActiveFor.
+			conn := &activityConn{Conn: &deadlineConn{wait: func(deadline time.Time) {
+				for now.Before(deadline) {
+					now = now.Add(10 * time.Millisecond)
+					if now.Sub(start) < tc.givenActiveFor {
+						activity.touch(1)
+					}
+				}
+			}}, activity: activity}
+
+			// Act
+
+			_, err := conn.Read(make([]byte, 1))
+
+			// Assert
+
+			assert.True(t, isTimeout(err), "expected timeout, got %v", err)
+			assert.Equal(t, tc.expectedAfter, now.Sub(start))
+		})
+	}
+}
+
+func TestTunnelActivityHeartbeat(t *testing.T) {
+	cases := []struct {
+		name          string
+		givenTimeouts tunnelTimeouts
+		givenFrames   []int
+		givenInterval time.Duration
+		expectedIdle  time.Duration
+	}{
+		{
+			name:          "Heartbeats",
+			givenTimeouts: tunnelTimeouts{Idle: time.Minute, HeartbeatIdle: 10 * time.Minute},
+			givenFrames:   []int{6, 6, 6},
+			givenInterval: 30 * time.Second,
+			expectedIdle:  10 * time.Minute,
+		},
+		{
+			name:          "Disabled",
+			givenTimeouts: tunnelTimeouts{Idle: time.Minute},
+			givenFrames:   []int{6, 6, 6},
+			givenInterval: 30 * time.Second,
+			expectedIdle:  time.Minute,
+		},
+		{
+			name:          "TooFrequent",
+			givenTimeouts: tunnelTimeouts{Idle: time.Minute, HeartbeatIdle: 10 * time.Minute},
+			givenFrames:   []int{6, 6, 6},
+			givenInterval: 10 * time.Millisecond,
+			expectedIdle:  time.Minute,
+		},
+		{
+			name:          "Bulk",
+			givenTimeouts: tunnelTimeouts{Idle: time.Minute, HeartbeatIdle: 10 * time.Minute},
+			givenFrames:   []int{6, 6, 32 << 10, 6},
+			givenInterval: 30 * time.Second,
+			expectedIdle:  time.Minute,
+		},
+		{
+			name:          "StaysClassified",
+			givenTimeouts: tunnelTimeouts{Idle: time.Minute, HeartbeatIdle: 10 * time.Minute},
+			givenFrames:   []int{6, 6, 6, 32 << 10},
+			givenInterval: 30 * time.Second,
+			expectedIdle:  10 * time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			now := time.Unix(1500000000, 0)
+			activity := newTunnelActivity(tc.givenTimeouts, now)
+			activity.now = func() time.Time { return now }
+
+			// Act
+
+			for _, n := range tc.givenFrames {
+				now = now.Add(tc.givenInterval)
+				activity.touch(n)
+			}
+
+			// Assert
+
+			assert.Equal(t, now.Add(tc.expectedIdle), activity.readDeadline())
+		})
+	}
+}
+
+// deadlineConn is a connection whose reads wait for the read deadline and
+// time out.
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+	wait     func(deadline time.Time)
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.wait(c.deadline)
+	return 0, timeoutError{}
+}
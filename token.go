@@ -0,0 +1,242 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bearerPrefix is the prefix of Proxy-Authorization headers holding bearer
+// tokens.
+const bearerPrefix = "Bearer "
+
+// tokenError is returned when a bearer token is not valid, as opposed to its
+// keys failing to be fetched.
+type tokenError struct {
+	Reason string
+}
+
+func (e *tokenError) Error() string {
+	return "invalid token: " + e.Reason
+}
+
+// TokenAuth authenticates clients by JWTs sent as bearer tokens, i.e.
+// "Proxy-Authorization: Bearer <token>", so short-lived credentials can be
+// issued to clients instead of static passwords. HS256 tokens are verified
+// with Key, RS256 and ES256 tokens with the keys of KeySet. Tokens must hold
+// an "exp" claim.
+type TokenAuth struct {
+	// Key is the HMAC-SHA256 key verifying HS256 tokens, which are refused
+	// if empty.
+	Key []byte
+	// KeySet holds the keys verifying RS256 and ES256 tokens, which are
+	// refused if nil.
+	KeySet *KeySet
+	// Issuer, if set, is the required "iss" claim.
+	Issuer string
+	// Audience, if set, is required among the "aud" claim.
+	Audience string
+	// UserClaim is the claim holding the user, "sub" if empty.
+	UserClaim string
+	// ScopeUsers, if set, maps scopes to users. Tokens then authenticate as
+	// the user of the first of their scopes with a user, so the user
+	// policies and ACLs of that user apply, and tokens without such a scope
+	// are refused. Scopes are read from the space-separated "scope" claim or
+	// the "scp" claim.
+	ScopeUsers map[string]string
+	// Leeway is the clock skew tolerated in checking the "exp" and "nbf"
+	// claims.
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+type tokenHeader struct {
+	Alg   string `json:"alg"`
+	KeyID string `json:"kid"`
+}
+
+// authenticate verifies token and returns the user it authenticates.
+func (a *TokenAuth) authenticate(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", &tokenError{"malformed"}
+	}
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return "", &tokenError{"malformed header"}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", &tokenError{"malformed signature"}
+	}
+	if err := a.verify(ctx, header, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return "", &tokenError{"malformed claims"}
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return "", err
+	}
+	if len(a.ScopeUsers) > 0 {
+		for _, scope := range tokenScopes(claims) {
+			if user, ok := a.ScopeUsers[scope]; ok {
+				return user, nil
+			}
+		}
+		return "", &tokenError{"no scope granting access"}
+	}
+	userClaim := a.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	user, _ := claims[userClaim].(string)
+	if user == "" {
+		return "", &tokenError{"missing " + userClaim + " claim"}
+	}
+	return user, nil
+}
+
+// verify verifies the signature sig of signingInput with the key for header.
+// The algorithm must match the kind of key, so public keys are never used as
+// HMAC keys.
+func (a *TokenAuth) verify(ctx context.Context, header tokenHeader, signingInput string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch header.Alg {
+	case "HS256":
+		if len(a.Key) == 0 {
+			return &tokenError{"HS256 not accepted"}
+		}
+		mac := hmac.New(sha256.New, a.Key)
+		_, _ = mac.Write([]byte(signingInput))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return &tokenError{"bad signature"}
+		}
+		return nil
+	case "RS256", "ES256":
+		if a.KeySet == nil {
+			return &tokenError{header.Alg + " not accepted"}
+		}
+		key, err := a.KeySet.key(ctx, header.KeyID)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg == "ES256" && len(sig) == 64 &&
+				ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return nil
+			}
+		}
+		return &tokenError{"bad signature"}
+	}
+	return &tokenError{"unsupported algorithm " + header.Alg}
+}
+
+// checkClaims checks the expiry, issuer and audience claims.
+func (a *TokenAuth) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return &tokenError{"missing exp claim"}
+	}
+	if now.Add(-a.Leeway).After(time.Unix(int64(exp), 0)) {
+		return &tokenError{"expired"}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return &tokenError{"not valid yet"}
+	}
+	if a.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.Issuer {
+			return &tokenError{"wrong issuer"}
+		}
+	}
+	if a.Audience != "" && !containsString(claimStrings(claims["aud"]), a.Audience) {
+		return &tokenError{"wrong audience"}
+	}
+	return nil
+}
+
+// tokenScopes returns the scopes of claims.
+func tokenScopes(claims map[string]interface{}) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	if scp, ok := claims["scp"].(string); ok {
+		return strings.Fields(scp)
+	}
+	return claimStrings(claims["scp"])
+}
+
+// claimStrings returns the strings of a claim holding a string or an array
+// of strings.
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		var l []string
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				l = append(l, s)
+			}
+		}
+		return l
+	}
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeTokenPart decodes the base64url encoded JSON part of a token into v.
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// authenticateToken authenticates a client by its bearer token with
+// TokenAuth and returns the authenticated user.
+func (p *Proxy) authenticateToken(ctx context.Context, token string) (string, bool) {
+	user, err := p.TokenAuth.authenticate(ctx, token)
+	if err != nil {
+		if _, ok := err.(*tokenError); ok {
+			p.Logger.Debug("Bearer token refused", zap.Error(err))
+		} else {
+			p.Logger.Error("Authentication failed", zap.Error(err))
+		}
+		return "", false
+	}
+	return user, true
+}
@@ -0,0 +1,270 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signToken returns a token of claims signed with key, a []byte for HS256,
+// an *rsa.PrivateKey for RS256 or an *ecdsa.PrivateKey for ES256.
+func signToken(t *testing.T, kid string, key interface{}, claims map[string]interface{}) string {
+	alg := "HS256"
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestTokenAuthAuthenticate(t *testing.T) {
+	// Arrange
+
+	now := time.Unix(1528000000, 0)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{
+			jwkOf("rsa", &rsaKey.PublicKey),
+			jwkOf("ec", &ecKey.PublicKey),
+		}})
+	}))
+	defer jwks.Close()
+
+	keySet := NewKeySet(jwks.URL, jwks.Client(), time.Hour)
+	keySet.now = func() time.Time { return now }
+	a := &TokenAuth{
+		Key:      []byte("secret"),
+		KeySet:   keySet,
+		Issuer:   "https://idp.example.com",
+		Audience: "proxy",
+		Leeway:   time.Minute,
+		now:      func() time.Time { return now },
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": []string{"other", "proxy"},
+			"sub": "alice",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	cases := []struct {
+		name             string
+		givenToken       string
+		givenScopeUsers  map[string]string
+		expectedUser     string
+		expectedRejected bool
+	}{
+		{
+			name:         "HS256",
+			givenToken:   signToken(t, "", []byte("secret"), claims(nil)),
+			expectedUser: "alice",
+		},
+		{
+			name:         "RS256",
+			givenToken:   signToken(t, "rsa", rsaKey, claims(nil)),
+			expectedUser: "alice",
+		},
+		{
+			name:         "ES256",
+			givenToken:   signToken(t, "ec", ecKey, claims(nil)),
+			expectedUser: "alice",
+		},
+		{
+			name:             "BadSignature",
+			givenToken:       signToken(t, "", []byte("guessed"), claims(nil)),
+			expectedRejected: true,
+		},
+		{
+			name:             "KeyOfOtherAlgorithm",
+			givenToken:       signToken(t, "rsa", ecKey, claims(nil)),
+			expectedRejected: true,
+		},
+		{
+			name:             "UnknownKey",
+			givenToken:       signToken(t, "unknown", rsaKey, claims(nil)),
+			expectedRejected: true,
+		},
+		{
+			name:         "ExpiredWithinLeeway",
+			givenToken:   signToken(t, "", []byte("secret"), claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})),
+			expectedUser: "alice",
+		},
+		{
+			name:             "Expired",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+			expectedRejected: true,
+		},
+		{
+			name:             "NoExpiry",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"exp": nil})),
+			expectedRejected: true,
+		},
+		{
+			name:             "NotValidYet",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})),
+			expectedRejected: true,
+		},
+		{
+			name:             "WrongIssuer",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			expectedRejected: true,
+		},
+		{
+			name:             "WrongAudience",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"aud": "other"})),
+			expectedRejected: true,
+		},
+		{
+			name:             "NoSubject",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"sub": nil})),
+			expectedRejected: true,
+		},
+		{
+			name:            "Scope",
+			givenToken:      signToken(t, "", []byte("secret"), claims(map[string]interface{}{"scope": "openid proxy:ci"})),
+			givenScopeUsers: map[string]string{"proxy:admin": "admin", "proxy:ci": "ci"},
+			expectedUser:    "ci",
+		},
+		{
+			name:            "ScopeArray",
+			givenToken:      signToken(t, "", []byte("secret"), claims(map[string]interface{}{"scp": []string{"proxy:admin"}})),
+			givenScopeUsers: map[string]string{"proxy:admin": "admin", "proxy:ci": "ci"},
+			expectedUser:    "admin",
+		},
+		{
+			name:             "NoScope",
+			givenToken:       signToken(t, "", []byte("secret"), claims(map[string]interface{}{"scope": "openid"})),
+			givenScopeUsers:  map[string]string{"proxy:ci": "ci"},
+			expectedRejected: true,
+		},
+		{
+			name:             "Malformed",
+			givenToken:       "not-a-token",
+			expectedRejected: true,
+		},
+		{
+			name:             "None",
+			givenToken:       base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","exp":9999999999}`)) + ".",
+			expectedRejected: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a.ScopeUsers = tc.givenScopeUsers
+
+			// Act
+
+			user, err := a.authenticate(context.Background(), tc.givenToken)
+
+			// Assert
+
+			if tc.expectedRejected {
+				require.Error(t, err)
+				assert.IsType(t, &tokenError{}, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedUser, user)
+		})
+	}
+}
+
+func TestProxyConnectBearerToken(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.TokenAuth = &TokenAuth{Key: []byte("secret")}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	connect := func(authz string) int {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n", destAddr, destAddr, authz)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	// Act
+
+	validStatus := connect("Bearer " + signToken(t, "", []byte("secret"), map[string]interface{}{"sub": "alice", "exp": exp}))
+	invalidStatus := connect("Bearer " + signToken(t, "", []byte("guessed"), map[string]interface{}{"sub": "alice", "exp": exp}))
+	basicStatus := connect("Basic dXNlcjpwYXNz")
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, validStatus)
+	assert.Equal(t, http.StatusProxyAuthRequired, invalidStatus)
+	assert.Equal(t, http.StatusProxyAuthRequired, basicStatus)
+}
@@ -0,0 +1,517 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of Tracer.
+const (
+	DefaultTraceServiceName = "forwardingproxy"
+
+	defaultTraceBatchSize  = 512
+	defaultTraceMaxPending = 2048
+)
+
+// traceparentHeader carries the W3C trace context of requests.
+//
+// See: https://www.w3.org/TR/trace-context/
+const traceparentHeader = "Traceparent"
+
+// Span kinds and status codes of OTLP.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+)
+
+// Tracer exports a span per CONNECT request, forwarded request and SOCKS
+// connection to an OpenTelemetry collector via OTLP over HTTP, with child
+// spans for the phases of the request and the tunnel relayed. Spans are
+// batched like usage records by Accounting, but spans failing to export are
+// dropped rather than retried.
+//
+// Requests carrying a sampled W3C trace context continue its trace, and
+// forwarded requests carry the trace context of their span. Requests whose
+// trace context is not sampled are not traced.
+type Tracer struct {
+	Logger *zap.Logger
+	// Endpoint is the URL of the OTLP/HTTP traces endpoint of the collector,
+	// e.g. "http://collector:4318/v1/traces".
+	Endpoint string
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName is the service.name resource attribute of the spans,
+	// DefaultTraceServiceName if empty.
+	ServiceName string
+	// Client posts the spans, http.DefaultClient if nil.
+	Client *http.Client
+	// BatchSize is the number of pending spans triggering an export, 512 if
+	// zero.
+	BatchSize int
+	// FlushInterval is the interval of exporting pending spans regardless
+	// of their number, as run by Run.
+	FlushInterval time.Duration
+	// MaxPending bounds the spans kept while exports are slow, dropping the
+	// oldest ones, 2048 if zero.
+	MaxPending int
+
+	mu      sync.Mutex
+	pending []otlpSpan
+	full    chan struct{}
+
+	// flushMu serializes exports.
+	flushMu sync.Mutex
+}
+
+// The OTLP/HTTP JSON encoding, whose field names are mandated by the
+// protocol.
+//
+// See: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string         `json:"traceId"`
+		SpanID       string         `json:"spanId"`
+		ParentSpanID string         `json:"parentSpanId,omitempty"`
+		Name         string         `json:"name"`
+		Kind         int            `json:"kind"`
+		Start        string         `json:"startTimeUnixNano"`
+		End          string         `json:"endTimeUnixNano"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+		Status       *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	// otlpValue holds either a string or an integer, the latter encoded as
+	// a decimal string.
+	otlpValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{String: &value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpValue{Int: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// span is a span of a request in progress. All methods are safe to call on a
+// nil receiver, which traces nothing.
+type span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	timings  *phaseTimings
+
+	mu          sync.Mutex
+	attrs       []otlpKeyValue
+	err         string
+	tunnelStart time.Time
+	ended       bool
+}
+
+// start starts the span of a request named name, started at start, which
+// continues the trace of traceparent, if any. It returns nil if t is nil or
+// traceparent is not sampled.
+func (t *Tracer) start(name string, start time.Time, traceparent string, timings *phaseTimings) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: name, start: start, timings: timings}
+	if traceparent != "" {
+		traceID, parentID, sampled, ok := parseTraceparent(traceparent)
+		if ok && !sampled {
+			return nil
+		}
+		if ok {
+			s.traceID, s.parentID = traceID, parentID
+		}
+	}
+	if s.traceID == ([16]byte{}) {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+// parseTraceparent parses the W3C traceparent header value v.
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == ([16]byte{}) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceparent returns the W3C traceparent header value of s.
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// setAttr sets the string attribute key of s.
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, stringAttr(key, value))
+	s.mu.Unlock()
+}
+
+// setIntAttr sets the integer attribute key of s.
+func (s *span) setIntAttr(key string, value int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, intAttr(key, value))
+	s.mu.Unlock()
+}
+
+// setDestination sets the attributes of the destination host and port
+// hostport.
+func (s *span) setDestination(hostport string) {
+	if s == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		s.setAttr("server.address", hostport)
+		return
+	}
+	s.setAttr("server.address", host)
+	if n, err := strconv.Atoi(port); err == nil {
+		s.setIntAttr("server.port", int64(n))
+	}
+}
+
+// fail marks s as failed for err.
+func (s *span) fail(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// tunnel marks the request of s as relaying a tunnel, so s ends with the
+// tunnel, by endTunnel, rather than with the request.
+func (s *span) tunnel() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.tunnelStart = time.Now()
+	s.mu.Unlock()
+}
+
+// end ends s unless its request relays a tunnel.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	tunneled := !s.tunnelStart.IsZero()
+	s.mu.Unlock()
+	if !tunneled {
+		s.finish(time.Now(), nil)
+	}
+}
+
+// endTunnel ends s once the tunnel of stats was closed, with its bytes and
+// close reason.
+func (s *span) endTunnel(stats AccessRecord) {
+	if s == nil {
+		return
+	}
+	s.setIntAttr("tunnel.bytes_up", stats.BytesUp)
+	s.setIntAttr("tunnel.bytes_down", stats.BytesDown)
+	s.setAttr("tunnel.close_reason", stats.Reason)
+	now := time.Now()
+	s.mu.Lock()
+	tunnel := otlpSpan{
+		Name:  "tunnel",
+		Start: unixNano(s.tunnelStart),
+		End:   unixNano(now),
+	}
+	s.mu.Unlock()
+	s.finish(now, []otlpSpan{tunnel})
+}
+
+// finish queues s, ended at end, along with the spans of its phases and
+// children, once.
+func (s *span) finish(end time.Time, children []otlpSpan) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	traceID := hex.EncodeToString(s.traceID[:])
+	id := hex.EncodeToString(s.id[:])
+	spans := []otlpSpan{{
+		TraceID:    traceID,
+		SpanID:     id,
+		Name:       s.name,
+		Kind:       otlpSpanKindServer,
+		Start:      unixNano(s.start),
+		End:        unixNano(end),
+		Attributes: append([]otlpKeyValue(nil), s.attrs...),
+	}}
+	if s.parentID != ([8]byte{}) {
+		spans[0].ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		spans[0].Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+	}
+	s.mu.Unlock()
+
+	for _, ps := range s.timings.spans() {
+		children = append(children, otlpSpan{
+			Name:  phaseNames[ps.phase],
+			Start: unixNano(ps.start),
+			End:   unixNano(ps.start.Add(ps.duration)),
+		})
+	}
+	for _, child := range children {
+		child.TraceID = traceID
+		child.ParentSpanID = id
+		child.Kind = otlpSpanKindInternal
+		var childID [8]byte
+		_, _ = rand.Read(childID[:])
+		child.SpanID = hex.EncodeToString(childID[:])
+		spans = append(spans, child)
+	}
+	s.tracer.queue(spans)
+}
+
+// queue queues spans for export.
+func (t *Tracer) queue(spans []otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.init()
+	pending := append(t.pending, spans...)
+	if n := t.maxPending(); len(pending) > n {
+		pending = pending[len(pending)-n:]
+	}
+	t.pending = pending
+	batchSize := t.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTraceBatchSize
+	}
+	if len(t.pending) >= batchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) maxPending() int {
+	if t.MaxPending <= 0 {
+		return defaultTraceMaxPending
+	}
+	return t.MaxPending
+}
+
+// init allocates the channel signaling complete batches. It must be called
+// with t.mu held.
+func (t *Tracer) init() {
+	if t.full == nil {
+		t.full = make(chan struct{}, 1)
+	}
+}
+
+// Run exports pending spans once a batch is complete or FlushInterval
+// passed, until stop is closed. Spans of requests ended later are exported by
+// Flush.
+func (t *Tracer) Run(stop <-chan struct{}) {
+	t.mu.Lock()
+	t.init()
+	full := t.full
+	t.mu.Unlock()
+
+	var tick <-chan time.Time
+	if t.FlushInterval > 0 {
+		ticker := time.NewTicker(t.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-full:
+		case <-tick:
+		}
+		ctx := context.Background()
+		if t.FlushInterval > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t.FlushInterval)
+			_ = t.Flush(ctx)
+			cancel()
+		} else {
+			_ = t.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports all pending spans, logging and returning the error of a
+// failed export, whose spans are dropped.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	if err := t.export(ctx, spans); err != nil {
+		t.Logger.Warn("Exporting spans failed", zap.Int("spans", len(spans)), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// export posts spans to Endpoint.
+func (t *Tracer) export(ctx context.Context, spans []otlpSpan) error {
+	serviceName := t.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultTraceServiceName
+	}
+	b, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{stringAttr("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "forwardingproxy"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFromContext returns the span of ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// statusResponseWriter records the status code of forwarded responses on
+// their span.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	span *span
+	once sync.Once
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.once.Do(func() { w.span.setIntAttr("http.response.status_code", int64(code)) })
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { w.span.setIntAttr("http.response.status_code", http.StatusOK) })
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeCollector records the spans exported to it.
+type fakeCollector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var traces otlpTraces
+	if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+// span returns the span named name.
+func (c *fakeCollector) span(name string) (otlpSpan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+// spanAttr returns the value of the attribute key of s.
+func spanAttr(s otlpSpan, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key != key {
+			continue
+		}
+		if kv.Value.String != nil {
+			return *kv.Value.String
+		}
+		if kv.Value.Int != nil {
+			return *kv.Value.Int
+		}
+	}
+	return ""
+}
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		name            string
+		given           string
+		expectedSampled bool
+		expectedOK      bool
+	}{
+		{name: "Sampled", given: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectedSampled: true, expectedOK: true},
+		{name: "Unsampled", given: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", expectedOK: true},
+		{name: "FutureVersion", given: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectedSampled: true, expectedOK: true},
+		{name: "InvalidVersion", given: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "ZeroTraceID", given: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "ShortSpanID", given: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba9-01"},
+		{name: "NotHex", given: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			_, _, sampled, ok := parseTraceparent(tc.given)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedSampled, sampled)
+		})
+	}
+}
+
+func TestProxyTraceTunnel(t *testing.T) {
+	// Arrange
+
+	collector := &fakeCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	dest := echoListener.Addr().String()
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.Tracer = &Tracer{Logger: zap.NewNop(), Endpoint: collectorServer.URL}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// Act
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", dest, dest)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	var connect otlpSpan
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		require.NoError(t, p.Tracer.Flush(context.Background()))
+		connect, ok = collector.span(http.MethodConnect)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	require.True(t, ok)
+	assert.Nil(t, connect.Status)
+	assert.Equal(t, "user", spanAttr(connect, "enduser.id"))
+	assert.Equal(t, "127.0.0.1", spanAttr(connect, "server.address"))
+	assert.Equal(t, "4", spanAttr(connect, "tunnel.bytes_up"))
+	assert.Equal(t, "4", spanAttr(connect, "tunnel.bytes_down"))
+	assert.Equal(t, reasonClientClosed, spanAttr(connect, "tunnel.close_reason"))
+	for _, name := range []string{"auth", "dial", "tunnel"} {
+		child, ok := collector.span(name)
+		require.True(t, ok, name)
+		assert.Equal(t, connect.TraceID, child.TraceID, name)
+		assert.Equal(t, connect.SpanID, child.ParentSpanID, name)
+	}
+}
+
+func TestProxyTraceForwarded(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	cases := []struct {
+		name               string
+		givenTraceparent   string
+		expectedTraced     bool
+		expectedParentSpan string
+	}{
+		{
+			name:           "NoTraceContext",
+			expectedTraced: true,
+		},
+		{
+			name:               "Sampled",
+			givenTraceparent:   "00-" + traceID + "-" + spanID + "-01",
+			expectedTraced:     true,
+			expectedParentSpan: spanID,
+		},
+		{
+			name:             "Unsampled",
+			givenTraceparent: "00-" + traceID + "-" + spanID + "-00",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			collector := &fakeCollector{}
+			collectorServer := httptest.NewServer(collector)
+			defer collectorServer.Close()
+
+			var received string
+			destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Get(traceparentHeader)
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			defer destServer.Close()
+
+			p := newTestProxy()
+			p.ForwardingHTTPProxy = NewForwardingHTTPProxy(nil, nil)
+			p.ForwardingHTTPProxy.Transport = NewForwardingTransport(p.DialContext, p.DestReadTimeout)
+			p.Tracer = &Tracer{Logger: zap.NewNop(), Endpoint: collectorServer.URL}
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+			proxyURL, err := url.Parse(proxyServer.URL)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			req, err := http.NewRequest(http.MethodGet, destServer.URL, nil)
+			require.NoError(t, err)
+			if tc.givenTraceparent != "" {
+				req.Header.Set(traceparentHeader, tc.givenTraceparent)
+			}
+
+			// Act
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			proxyServer.Close()
+			require.NoError(t, p.Tracer.Flush(context.Background()))
+
+			// Assert
+
+			observed, ok := collector.span(http.MethodGet)
+			require.Equal(t, tc.expectedTraced, ok)
+			if !tc.expectedTraced {
+				assert.Equal(t, tc.givenTraceparent, received)
+				return
+			}
+			if tc.givenTraceparent != "" {
+				assert.Equal(t, traceID, observed.TraceID)
+			}
+			assert.Equal(t, tc.expectedParentSpan, observed.ParentSpanID)
+			assert.Equal(t, "418", spanAttr(observed, "http.response.status_code"))
+			assert.Equal(t, "00-"+observed.TraceID+"-"+observed.SpanID+"-01", received)
+		})
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownPollInterval is the interval of checking whether all tunnels have
+// been closed while shutting down.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// connTracker counts open connections, so tests can assert every opened
+// connection is eventually closed. open is its first word and connTracker is
+// always allocated, so open is 64-bit aligned for atomic access on 32-bit
+// platforms.
+type connTracker struct {
+	open int64
+}
+
+// track returns conn wrapped such that closing it is accounted for. If t is
+// nil, conn is returned as is.
+func (t *connTracker) track(conn net.Conn) net.Conn {
+	if t == nil {
+		return conn
+	}
+	atomic.AddInt64(&t.open, 1)
+	return &trackedConn{Conn: conn, tracker: t}
+}
+
+// Open returns the number of tracked connections not closed yet.
+func (t *connTracker) Open() int64 {
+	return atomic.LoadInt64(&t.open)
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.tracker.open, -1) })
+	return c.Conn.Close()
+}
+
+// tunnelSetup holds the resources of a tunnel being set up: the user tunnel
+// counted for it and, once dialed and hijacked, its destination and client
+// connections. Its release is deferred as soon as the user tunnel is opened,
+// so every return and panic ahead of relaying closes the connections and
+// stops counting the tunnel, unless they were handed over.
+type tunnelSetup struct {
+	userTunnel *userTunnel
+	destConn   net.Conn
+	clientConn net.Conn
+	handedOver bool
+}
+
+// handOver passes the resources on to the relay of the tunnel, which
+// releases them once the tunnel is closed.
+func (s *tunnelSetup) handOver() {
+	s.handedOver = true
+}
+
+// release closes the connections and the user tunnel of s unless handed
+// over.
+func (s *tunnelSetup) release() {
+	if s.handedOver {
+		return
+	}
+	if s.clientConn != nil {
+		_ = s.clientConn.Close()
+	}
+	if s.destConn != nil {
+		_ = s.destConn.Close()
+	}
+	s.userTunnel.close()
+}
+
+// tunnelRegistry tracks the open tunnels of a proxy, so they can be drained
+// on shutdown and listed and closed via the admin API.
+type tunnelRegistry struct {
+	mu       sync.Mutex
+	draining bool
+	lastID   uint64
+	tunnels  map[*tunnelConns]struct{}
+}
+
+// tunnelConns are the connections of a tunnel to host and its authenticated
+// user. Dest is nil for intercepted tunnels.
+type tunnelConns struct {
+	client, dest net.Conn
+	host, user   string
+
+	// id, start and cancel are set when the tunnel is registered.
+	id     uint64
+	start  time.Time
+	cancel context.CancelFunc
+	// bytesUp and bytesDown count the bytes received from and sent to the
+	// client, accessed atomically.
+	bytesUp, bytesDown uint64
+
+	closeOnce sync.Once
+	// reason is why the tunnel was closed, set once closed.
+	reason string
+	// graceful is the outcome of closing the idle tunnel gracefully, see
+	// AccessRecord.GracefulClose.
+	graceful string
+}
+
+// closeFor closes the connections of t for reason and cancels its context,
+// unless t has been closed already. Both copies of a tunnel end once its
+// connections are closed, so the first reason closing a tunnel is recorded.
+func (t *tunnelConns) closeFor(reason string) {
+	t.closeOnce.Do(func() {
+		t.reason = reason
+		t.close()
+	})
+}
+
+// closeIdle closes the idle tunnel t like closeFor, after half-closing its
+// connections and waiting up to grace for the client and the destination to
+// close their side too, so they see an orderly end of the tunnel rather than
+// a connection failing mid-request. Concurrent calls of closeFor wait for it.
+func (t *tunnelConns) closeIdle(grace time.Duration) {
+	t.closeOnce.Do(func() {
+		t.reason = reasonIdleTimeout
+		deadline := time.Now().Add(grace)
+		var clientClosed, destClosed bool
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientClosed = closeWriteAndWait(t.client, deadline)
+		}()
+		if t.dest != nil {
+			destClosed = closeWriteAndWait(t.dest, deadline)
+		}
+		wg.Wait()
+		switch {
+		case clientClosed && destClosed:
+			t.graceful = gracefulBoth
+		case clientClosed:
+			t.graceful = gracefulClient
+		case destClosed:
+			t.graceful = gracefulDestination
+		default:
+			t.graceful = gracefulNone
+		}
+		t.close()
+	})
+}
+
+func (t *tunnelConns) close() {
+	_ = t.client.Close()
+	if t.dest != nil {
+		_ = t.dest.Close()
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// Outcomes of closing idle tunnels gracefully, naming the peers which closed
+// their side within the grace period.
+const (
+	gracefulBoth        = "both"
+	gracefulClient      = "client"
+	gracefulDestination = "destination"
+	gracefulNone        = "none"
+)
+
+// closeWriteAndWait half-closes conn, sending a FIN or, for TLS connections,
+// a close_notify alert, and discards data read from conn until the peer
+// closed its side too or deadline passed. It reports whether the peer closed
+// its side. Connections which cannot be half-closed are left as they are.
+func closeWriteAndWait(conn net.Conn, deadline time.Time) bool {
+	var err error
+	if tc, ok := conn.(*tls.Conn); ok {
+		err = tc.CloseWrite()
+	} else if tcp := splicedConn(conn); tcp != nil {
+		err = tcp.CloseWrite()
+	} else {
+		return false
+	}
+	if err != nil || conn.SetReadDeadline(deadline) != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, conn)
+	return err == nil
+}
+
+// countClient returns the client connection conn of t counting the bytes
+// transferred.
+func (t *tunnelConns) countClient(conn net.Conn) net.Conn {
+	return &countingConn{Conn: conn, read: &t.bytesUp, written: &t.bytesDown}
+}
+
+// countingConn adds the number of bytes read and written to read and
+// written.
+type countingConn struct {
+	net.Conn
+	read, written *uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.read, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.written, uint64(n))
+	return n, err
+}
+
+// add registers a tunnel serving the request of ctx, unless the proxy is
+// shutting down. It returns the context of the tunnel, which holds the values
+// of ctx but outlives its request, and is canceled once the tunnel is closed.
+func (r *tunnelRegistry) add(ctx context.Context, t *tunnelConns) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.draining {
+		return nil, false
+	}
+	if r.tunnels == nil {
+		r.tunnels = map[*tunnelConns]struct{}{}
+	}
+	r.lastID++
+	t.id = r.lastID
+	t.start = time.Now()
+	ctx, t.cancel = context.WithCancel(withValues(context.Background(), ctx))
+	r.tunnels[t] = struct{}{}
+	return ctx, true
+}
+
+func (r *tunnelRegistry) remove(t *tunnelConns) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tunnels, t)
+}
+
+// count returns the number of open tunnels of user.
+func (r *tunnelRegistry) count(user string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for t := range r.tunnels {
+		if t.user == user {
+			n++
+		}
+	}
+	return n
+}
+
+// list returns the open tunnels ordered by id.
+func (r *tunnelRegistry) list() []*tunnelConns {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tunnels := make([]*tunnelConns, 0, len(r.tunnels))
+	for t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].id < tunnels[j].id })
+	return tunnels
+}
+
+// close closes the connections of the open tunnel id, and reports whether it
+// was open.
+func (r *tunnelRegistry) close(id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for t := range r.tunnels {
+		if t.id == id {
+			t.closeFor(reasonClosed)
+			return true
+		}
+	}
+	return false
+}
+
+// drain refuses new tunnels and returns the number of open tunnels.
+func (r *tunnelRegistry) drain() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+	return len(r.tunnels)
+}
+
+// closeAll closes the connections of all open tunnels.
+func (r *tunnelRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for t := range r.tunnels {
+		t.closeFor(reasonShutdown)
+	}
+}
+
+// Shutdown gracefully shuts down the tunnels of p: new tunnels are refused,
+// and open tunnels are waited for until closed by either side or until ctx
+// is done. Tunnels still open then are closed, and the error of ctx is
+// returned.
+//
+// Listeners are not closed by Shutdown. They must be closed before, e.g. by
+// shutting down the http.Server serving p, which does not wait for tunnels.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if p.tunnels.drain() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.tunnels.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnTracker(t *testing.T) {
+	// Arrange
+
+	tracker := &connTracker{}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// Act
+
+	conn := tracker.track(c1)
+	open := tracker.Open()
+	_ = conn.Close()
+	_ = conn.Close()
+
+	// Assert
+
+	assert.Equal(t, int64(1), open)
+	assert.Equal(t, int64(0), tracker.Open())
+}
+
+// TestTunnelsDoNotLeakConnections asserts that the destination connection of
+// every tunnel is closed when the tunnel ends, however it ends.
+func TestTunnelsDoNotLeakConnections(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping leak test in short mode")
+	}
+
+	// Arrange
+
+	// Destination servers
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	closingListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer closingListener.Close()
+	go func() {
+		for {
+			conn, err := closingListener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.IdleTimeout = 200 * time.Millisecond
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// connect opens a tunnel to dest. It is called from multiple goroutines and
+	// thus must not use require.
+	connect := func(dest net.Listener) (net.Conn, *bufio.Reader, bool) {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		if !assert.NoError(t, err) {
+			return nil, nil, false
+		}
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", dest.Addr())
+		br := bufio.NewReader(conn)
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		}
+		if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			_ = conn.Close()
+			return nil, nil, false
+		}
+		return conn, br, true
+	}
+
+	scenarios := map[string]func(){
+		"ClientCloses": func() {
+			conn, br, ok := connect(echoListener)
+			if !ok {
+				return
+			}
+			defer conn.Close()
+			_, err := conn.Write([]byte("ping"))
+			if assert.NoError(t, err) {
+				_, err = io.ReadFull(br, make([]byte, 4))
+				assert.NoError(t, err)
+			}
+		},
+		"ClientClosesWithoutReading": func() {
+			conn, _, ok := connect(echoListener)
+			if !ok {
+				return
+			}
+			_, _ = conn.Write([]byte("ping"))
+			_ = conn.Close()
+		},
+		"DestinationCloses": func() {
+			conn, br, ok := connect(closingListener)
+			if !ok {
+				return
+			}
+			_, _ = br.ReadByte()
+			_ = conn.Close()
+		},
+		"Timeout": func() {
+			conn, br, ok := connect(echoListener)
+			if !ok {
+				return
+			}
+			_, _ = br.ReadByte()
+			_ = conn.Close()
+		},
+	}
+
+	// Act
+
+	var wg sync.WaitGroup
+	for i := 0; i < 25; i++ {
+		for _, scenario := range scenarios {
+			wg.Add(1)
+			go func(scenario func()) {
+				defer wg.Done()
+				scenario()
+			}(scenario)
+		}
+	}
+	wg.Wait()
+
+	// Assert
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.destConns.Open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(0), p.destConns.Open(), "leaked destination connections")
+}
+
+// failingHijacker is a ResponseWriter whose Hijack fails.
+type failingHijacker struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("dummy-error")
+}
+
+// TestTunnelSetupFailuresReleaseResources asserts that tunnels failing ahead
+// of relaying close their destination connection and stop counting.
+func TestTunnelSetupFailuresReleaseResources(t *testing.T) {
+	cases := []struct {
+		name         string
+		givenWriter  func(*httptest.ResponseRecorder) http.ResponseWriter
+		expectedCode int
+	}{
+		{name: "HijackingNotSupported", givenWriter: func(w *httptest.ResponseRecorder) http.ResponseWriter { return w }, expectedCode: http.StatusInternalServerError},
+		{name: "HijackingFails", givenWriter: func(w *httptest.ResponseRecorder) http.ResponseWriter { return failingHijacker{w} }, expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			echoListener := startEchoServer(t)
+			defer echoListener.Close()
+
+			p := newTestProxy()
+			p.TunnelCap = NewTunnelCap(1)
+
+			// Act
+
+			var codes []int
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				p.ServeHTTP(tc.givenWriter(w), httptest.NewRequest(http.MethodConnect, echoListener.Addr().String(), nil))
+				codes = append(codes, w.Code)
+			}
+
+			// Assert
+
+			assert.Equal(t, []int{tc.expectedCode, tc.expectedCode}, codes, "the tunnel cap is released")
+			assert.Equal(t, int64(0), p.destConns.Open(), "leaked destination connections")
+		})
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	cases := []struct {
+		name          string
+		givenClose    bool
+		expectedError error
+	}{
+		{
+			name:       "Drained",
+			givenClose: true,
+		},
+		{
+			name:          "ForceClosed",
+			expectedError: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Proxy server
+
+			p := newTestProxy()
+			proxyServer := httptest.NewServer(p)
+			defer proxyServer.Close()
+
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", echoListener.Addr())
+			require.NoError(t, err)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			// Act
+
+			shutdownErr := make(chan error, 1)
+			go func() { shutdownErr <- p.Shutdown(ctx) }()
+
+			// The tunnel keeps working while draining.
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			_, err = io.ReadFull(br, make([]byte, 4))
+			require.NoError(t, err)
+			if tc.givenClose {
+				require.NoError(t, conn.Close())
+			}
+
+			// Assert
+
+			assert.Equal(t, tc.expectedError, <-shutdownErr)
+			_, err = br.ReadByte()
+			assert.Error(t, err, "tunnel is closed")
+
+			// New tunnels are refused.
+			conn2, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn2.Close()
+			_, err = fmt.Fprintf(conn2, "CONNECT %s HTTP/1.1\r\n\r\n", echoListener.Addr())
+			require.NoError(t, err)
+			br2 := bufio.NewReader(conn2)
+			_, _ = http.ReadResponse(br2, &http.Request{Method: http.MethodConnect})
+			_, err = br2.ReadByte()
+			assert.Error(t, err, "new tunnel is closed")
+		})
+	}
+}
+
+// closeCountingConn counts how often it is closed.
+type closeCountingConn struct {
+	net.Conn
+	closes int32
+}
+
+func (c *closeCountingConn) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	return c.Conn.Close()
+}
+
+func TestTunnelCloseReasons(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	cases := []struct {
+		name           string
+		givenClose     func(p *Proxy, client net.Conn)
+		expectedReason string
+	}{
+		{
+			name:           "ClientClosed",
+			givenClose:     func(p *Proxy, client net.Conn) { client.Close() },
+			expectedReason: reasonClientClosed,
+		},
+		{
+			name:           "Admin",
+			givenClose:     func(p *Proxy, client net.Conn) { p.tunnels.close(p.tunnels.list()[0].id) },
+			expectedReason: reasonClosed,
+		},
+		{
+			name:           "Shutdown",
+			givenClose:     func(p *Proxy, client net.Conn) { p.tunnels.closeAll() },
+			expectedReason: reasonShutdown,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs lockedBuffer
+			p := newTestProxy()
+			p.AccessLog = &AccessLog{Writer: &logs}
+
+			destConn, err := net.Dial("tcp", echoListener.Addr().String())
+			require.NoError(t, err)
+			countingDest := &closeCountingConn{Conn: destConn}
+			clientConn, client := net.Pipe()
+			countingClient := &closeCountingConn{Conn: clientConn}
+			defer client.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			p.relay(ctx, countingClient, countingDest, echoListener.Addr().String(), "", nil, nil, p.defaultTunnelTimeouts())
+			// The tunnel outlives the request it was opened for.
+			cancel()
+			_, err = client.Write([]byte("ping"))
+			require.NoError(t, err)
+			_, err = io.ReadFull(client, make([]byte, 4))
+			require.NoError(t, err)
+
+			// Act
+
+			tc.givenClose(p, client)
+
+			// Assert
+
+			for deadline := time.Now().Add(time.Second); (logs.Len() == 0 || len(p.tunnels.list()) > 0) && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			var rec AccessRecord
+			require.NoError(t, json.Unmarshal(logs.Bytes(), &rec))
+			assert.Equal(t, tc.expectedReason, rec.Reason)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&countingClient.closes), "client connection closed once")
+			assert.Equal(t, int32(1), atomic.LoadInt32(&countingDest.closes), "destination connection closed once")
+			assert.Empty(t, p.tunnels.list())
+		})
+	}
+}
+
+type testContextKey struct{}
+
+func TestTunnelRegistryContext(t *testing.T) {
+	// Arrange
+
+	var r tunnelRegistry
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tunnel := &tunnelConns{client: c1}
+	reqCtx, cancelReq := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "value"))
+
+	// Act
+
+	ctx, ok := r.add(reqCtx, tunnel)
+	cancelReq()
+	errBeforeClose := ctx.Err()
+	tunnel.closeFor(reasonClosed)
+	tunnel.closeFor(reasonShutdown)
+
+	// Assert
+
+	require.True(t, ok)
+	assert.Equal(t, "value", ctx.Value(testContextKey{}))
+	assert.NoError(t, errBeforeClose, "tunnel outlives its request")
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.Equal(t, reasonClosed, tunnel.reason, "first reason is recorded")
+}
+
+func TestRelayIdleCloseGrace(t *testing.T) {
+	// Arrange
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	cases := []struct {
+		name             string
+		givenClientClose bool
+		expectedGraceful string
+	}{
+		{name: "Both", givenClientClose: true, expectedGraceful: gracefulBoth},
+		{name: "ClientUnresponsive", givenClientClose: false, expectedGraceful: gracefulDestination},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs lockedBuffer
+			p := newTestProxy()
+			p.AccessLog = &AccessLog{Writer: &logs}
+			p.IdleTimeout = 50 * time.Millisecond
+			p.IdleCloseGrace = 200 * time.Millisecond
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			client, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			clientConn, err := l.Accept()
+			require.NoError(t, err)
+			destConn, err := net.Dial("tcp", echoListener.Addr().String())
+			require.NoError(t, err)
+
+			p.relay(context.Background(), clientConn, destConn, echoListener.Addr().String(), "", nil, nil, p.defaultTunnelTimeouts())
+
+			// Act
+
+			_, err = io.Copy(ioutil.Discard, client)
+			require.NoError(t, err, "client sees an orderly end of the tunnel")
+			if tc.givenClientClose {
+				client.Close()
+			}
+
+			// Assert
+
+			for deadline := time.Now().Add(time.Second); logs.Len() == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			var rec AccessRecord
+			require.NoError(t, json.Unmarshal(logs.Bytes(), &rec))
+			assert.Equal(t, reasonIdleTimeout, rec.Reason)
+			assert.Equal(t, tc.expectedGraceful, rec.GracefulClose)
+		})
+	}
+}
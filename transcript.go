@@ -0,0 +1,281 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxTranscriptIntervals bounds the intervals recorded per tunnel. Bytes of
+// later intervals are counted in the last one, and the transcript marked as
+// truncated.
+const maxTranscriptIntervals = 10000
+
+// Transcripts records a metadata transcript of every tunnel once it is
+// closed, for audits requiring more than the access log without capturing
+// any payload: the TLS server name (SNI) sent by the client, and the bytes
+// relayed per interval with traffic, whose start times mark the bursts of the
+// tunnel.
+type Transcripts struct {
+	// Writer receives transcripts as JSON lines. It should only ever append,
+	// such as a RotatingFile, whose MaxBackups and MaxAge are the retention
+	// policy of transcripts.
+	Writer io.Writer
+	// Interval is the duration of the intervals bytes are counted in.
+	Interval time.Duration
+
+	mu sync.Mutex
+}
+
+// Transcript is the metadata transcript of a tunnel.
+type Transcript struct {
+	Client      string `json:"client"`
+	User        string `json:"user,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+	Destination string `json:"destination"`
+	// SNI is the server name of the TLS ClientHello the client sent first,
+	// if any.
+	SNI      string    `json:"sni,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	Reason   string    `json:"reason"`
+	// Intervals are the intervals with traffic, in order.
+	Intervals []TranscriptInterval `json:"intervals"`
+	// Truncated is set if the tunnel had more intervals with traffic than
+	// recorded.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// TranscriptInterval counts the bytes relayed in an interval of a tunnel.
+type TranscriptInterval struct {
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// tunnelTranscript records the transcript of an open tunnel.
+type tunnelTranscript struct {
+	interval time.Duration
+	start    time.Time
+
+	mu         sync.Mutex
+	t          Transcript
+	lastIndex  int64
+	sniChecked bool
+}
+
+// open starts the transcript of a tunnel opened at start, or returns nil if
+// t is nil.
+func (t *Transcripts) open(start time.Time) *tunnelTranscript {
+	if t == nil {
+		return nil
+	}
+	interval := t.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &tunnelTranscript{interval: interval, start: start, lastIndex: -1}
+}
+
+// record writes the transcript tt of the closed tunnel of rec.
+func (t *Transcripts) record(tt *tunnelTranscript, rec *AccessRecord) {
+	if t == nil {
+		return
+	}
+	tt.mu.Lock()
+	tr := tt.t
+	tt.mu.Unlock()
+
+	tr.Client = rec.Client
+	tr.User = rec.User
+	tr.RequestID = rec.RequestID
+	tr.Destination = rec.Destination
+	tr.Start = rec.Start
+	tr.Duration = rec.Duration
+	tr.Reason = rec.Reason
+	if tr.Intervals == nil {
+		tr.Intervals = []TranscriptInterval{}
+	}
+	b, err := json.Marshal(tr)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	_, _ = t.Writer.Write(append(b, '\n'))
+	t.mu.Unlock()
+}
+
+// add counts n bytes relayed now, to the destination if up is set. It does
+// nothing if tt is nil.
+func (tt *tunnelTranscript) add(up bool, n int) {
+	if tt == nil {
+		return
+	}
+	now := time.Now()
+	index := int64(now.Sub(tt.start) / tt.interval)
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if index > tt.lastIndex {
+		if len(tt.t.Intervals) < maxTranscriptIntervals {
+			tt.t.Intervals = append(tt.t.Intervals, TranscriptInterval{Start: tt.start.Add(time.Duration(index) * tt.interval)})
+		} else {
+			tt.t.Truncated = true
+		}
+		tt.lastIndex = index
+	}
+	last := &tt.t.Intervals[len(tt.t.Intervals)-1]
+	if up {
+		last.BytesUp += int64(n)
+	} else {
+		last.BytesDown += int64(n)
+	}
+}
+
+// checkSNI records the server name of b if it is the first data sent by the
+// client and starts with a TLS ClientHello.
+func (tt *tunnelTranscript) checkSNI(b []byte) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.sniChecked {
+		return
+	}
+	tt.sniChecked = true
+	tt.t.SNI = parseSNI(b)
+}
+
+// upstream returns r recording bytes read as sent from the client, or r if
+// tt is nil.
+func (tt *tunnelTranscript) upstream(r io.ReadCloser) io.ReadCloser {
+	if tt == nil {
+		return r
+	}
+	return &transcriptReader{ReadCloser: r, tt: tt, up: true}
+}
+
+// downstream returns r recording bytes read as sent from the destination, or
+// r if tt is nil.
+func (tt *tunnelTranscript) downstream(r io.ReadCloser) io.ReadCloser {
+	if tt == nil {
+		return r
+	}
+	return &transcriptReader{ReadCloser: r, tt: tt}
+}
+
+type transcriptReader struct {
+	io.ReadCloser
+	tt *tunnelTranscript
+	up bool
+}
+
+func (r *transcriptReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		if r.up {
+			r.tt.checkSNI(b[:n])
+		}
+		r.tt.add(r.up, n)
+	}
+	return n, err
+}
+
+// parseSNI returns the server name of the TLS ClientHello b starts with, or
+// "" if there is none or it is not complete within the first record of b.
+func parseSNI(b []byte) string {
+	// TLS record: handshake content type, version and length.
+	if len(b) < 5 || b[0] != 0x16 {
+		return ""
+	}
+	return parseClientHelloSNI(b[5:])
+}
+
+// TLS extensions of ClientHellos.
+const (
+	tlsExtServerName = 0x0000
+	// tlsExtEncryptedClientHello is the extension of Encrypted Client Hello
+	// (ECH), which carries the encrypted inner ClientHello.
+	//
+	// See: https://datatracker.ietf.org/doc/draft-ietf-tls-esni/
+	tlsExtEncryptedClientHello = 0xfe0d
+)
+
+// parseClientHelloSNI returns the server name of the ClientHello handshake
+// message b starts with, or "" if there is none or it is not complete within
+// b. Of ClientHellos offering ECH, it is the public name of the client-facing
+// server rather than the name of the destination.
+func parseClientHelloSNI(b []byte) string {
+	ext, ok := clientHelloExtension(b, tlsExtServerName)
+	// server_name: list length, then entries of name type and name.
+	if !ok || len(ext) < 2+3 || ext[2] != 0 {
+		return ""
+	}
+	name := ext[5:]
+	if n := int(binary.BigEndian.Uint16(ext[3:])); n <= len(name) {
+		return string(name[:n])
+	}
+	return ""
+}
+
+// clientHelloExtension returns the data of the extension of type typ of the
+// ClientHello handshake message b starts with, and whether it has one.
+func clientHelloExtension(b []byte, typ uint16) ([]byte, bool) {
+	// Handshake: ClientHello type and length, then client version and
+	// random.
+	if len(b) < 4+2+32 || b[0] != 0x01 {
+		return nil, false
+	}
+	b = b[4+2+32:]
+
+	// Session ID, cipher suites and compression methods.
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return nil, false
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return nil, false
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return nil, false
+	}
+
+	if len(b) < 2 {
+		return nil, false
+	}
+	exts := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(exts) {
+		exts = exts[:n]
+	}
+	for len(exts) >= 4 {
+		extType, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if n > len(exts) {
+			return nil, false
+		}
+		if extType == typ {
+			return exts[:n], true
+		}
+		exts = exts[n:]
+	}
+	return nil, false
+}
+
+// skipVector skips a vector of b with a length prefix of size bytes.
+func skipVector(b []byte, size int) ([]byte, bool) {
+	if len(b) < size {
+		return nil, false
+	}
+	n := int(b[0])
+	if size == 2 {
+		n = int(binary.BigEndian.Uint16(b))
+	}
+	if len(b) < size+n {
+		return nil, false
+	}
+	return b[size+n:], true
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello returns the first data a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	b := make([]byte, 4096)
+	n, err := server.Read(b)
+	require.NoError(t, err)
+	return b[:n]
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+
+	cases := []struct {
+		name     string
+		given    []byte
+		expected string
+	}{
+		{
+			name:     "ClientHello",
+			given:    hello,
+			expected: "www.example.com",
+		},
+		{
+			name:  "Truncated",
+			given: hello[:40],
+		},
+		{
+			name:  "PlainHTTP",
+			given: []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"),
+		},
+		{
+			name:  "Empty",
+			given: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed := parseSNI(tc.given)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestProxyTranscripts(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	var buf lockedBuffer
+	p := newTestProxy()
+	p.Transcripts = &Transcripts{Writer: &buf, Interval: time.Hour}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	hello := clientHello(t, "www.example.com")
+
+	// Act
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write(hello)
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, len(hello)))
+	require.NoError(t, err)
+	conn.Close()
+
+	var line string
+	for i := 0; i < 100; i++ {
+		buf.mu.Lock()
+		line = buf.buf.String()
+		buf.mu.Unlock()
+		if line != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+
+	require.True(t, strings.HasSuffix(line, "\n"))
+	var tr Transcript
+	require.NoError(t, json.Unmarshal([]byte(line), &tr))
+	assert.Equal(t, "127.0.0.1", tr.Client)
+	assert.Equal(t, destAddr, tr.Destination)
+	assert.Equal(t, "www.example.com", tr.SNI)
+	require.Len(t, tr.Intervals, 1)
+	assert.Equal(t, int64(len(hello)), tr.Intervals[0].BytesUp)
+	assert.Equal(t, int64(len(hello)), tr.Intervals[0].BytesDown)
+	assert.False(t, tr.Truncated)
+}
+
+func TestTunnelTranscriptIntervals(t *testing.T) {
+	// Arrange
+
+	start := time.Now()
+	tt := (&Transcripts{Interval: 10 * time.Millisecond}).open(start)
+
+	// Act
+
+	tt.add(true, 3)
+	tt.add(false, 5)
+	time.Sleep(20 * time.Millisecond)
+	tt.add(true, 7)
+
+	// Assert
+
+	require.Len(t, tt.t.Intervals, 2)
+	assert.Equal(t, int64(3), tt.t.Intervals[0].BytesUp)
+	assert.Equal(t, int64(5), tt.t.Intervals[0].BytesDown)
+	assert.Equal(t, int64(7), tt.t.Intervals[1].BytesUp)
+	assert.True(t, tt.t.Intervals[1].Start.After(tt.t.Intervals[0].Start))
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Errors returned by openTunnel.
+var (
+	errUserTunnelLimit  = errors.New("user tunnel limit reached")
+	errTunnelCapReached = errors.New("tunnel cap reached")
+)
+
+// TunnelCap limits the concurrent tunnels across all clients. Rather than
+// admitting tunnels first come, first served until the limit is reached, the
+// tunnels beyond FairShare are only admitted for clients holding fewer than
+// the average number of tunnels of all clients holding tunnels, so clients
+// holding many tunnels can not crowd out the others. Clients are users, or
+// client IP addresses if unauthenticated. Max and FairShare are changed via
+// SetMax once tunnels are opened.
+type TunnelCap struct {
+	// Max is the number of concurrent tunnels.
+	Max int
+	// FairShare is the number of concurrent tunnels from which on tunnels
+	// are admitted fairly.
+	FairShare int
+
+	mu      sync.Mutex
+	open    int
+	clients map[string]int
+}
+
+// NewTunnelCap returns a cap of max concurrent tunnels, admitting tunnels
+// fairly from 90% of max on.
+func NewTunnelCap(max int) *TunnelCap {
+	return &TunnelCap{Max: max, FairShare: max * 9 / 10, clients: map[string]int{}}
+}
+
+// Limit returns Max.
+func (c *TunnelCap) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Max
+}
+
+// SetMax changes Max to max, admitting tunnels fairly from 90% of max on.
+// Lowering Max below the number of open tunnels closes none of them, but
+// admits no new tunnels until enough have closed.
+func (c *TunnelCap) SetMax(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Max, c.FairShare = max, max*9/10
+}
+
+// admit counts a new tunnel of client, or reports false if the cap is
+// reached or client holds its share of the tunnels near the cap.
+func (c *TunnelCap) admit(client string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open >= c.Max {
+		return false
+	}
+	// Clients holding at least the average number of tunnels are refused,
+	// while clients without tunnels are always admitted.
+	if n := c.clients[client]; c.open >= c.FairShare && n > 0 && n*len(c.clients) >= c.open {
+		return false
+	}
+	c.open++
+	c.clients[client]++
+	return true
+}
+
+// release stops counting a tunnel of client.
+func (c *TunnelCap) release(client string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.open--
+	if c.clients[client]--; c.clients[client] <= 0 {
+		delete(c.clients, client)
+	}
+}
+
+// openTunnel counts a new tunnel of user from the client IP address client
+// towards the concurrent tunnels of user and the tunnel cap. It returns
+// errUserTunnelLimit or errTunnelCapReached if the tunnel is refused. The
+// returned tunnel must be closed once the tunnel is closed.
+func (p *Proxy) openTunnel(user, client string) (*userTunnel, error) {
+	ut, ok := p.UserPolicies.openTunnel(user)
+	if !ok {
+		p.Logger.Warn("User tunnel limit reached", zap.String("user", user))
+		return nil, errUserTunnelLimit
+	}
+	if p.TunnelCap == nil {
+		return ut, nil
+	}
+
+	key := user
+	if key == "" {
+		key = client
+	}
+	if !p.TunnelCap.admit(key) {
+		ut.close()
+		p.Logger.Warn("Tunnel cap reached", zap.String("user", user), zap.String("client", client))
+		return nil, errTunnelCapReached
+	}
+	if ut == nil {
+		ut = &userTunnel{}
+	}
+	ut.cap, ut.capKey = p.TunnelCap, key
+	return ut, nil
+}
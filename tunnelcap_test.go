@@ -0,0 +1,113 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelCap(t *testing.T) {
+	// Arrange
+
+	c := NewTunnelCap(10)
+
+	// Act & Assert
+
+	for i := 0; i < 6; i++ {
+		require.True(t, c.admit("heavy"))
+	}
+	for i := 0; i < 3; i++ {
+		require.True(t, c.admit("light"))
+	}
+	assert.False(t, c.admit("heavy"), "clients above the average are refused near the cap")
+	assert.True(t, c.admit("light"), "clients below the average are admitted near the cap")
+	assert.False(t, c.admit("new"), "all clients are refused at the cap")
+
+	c.release("light")
+	assert.True(t, c.admit("new"), "clients without tunnels are admitted near the cap")
+
+	for i := 0; i < 6; i++ {
+		c.release("heavy")
+	}
+	assert.True(t, c.admit("heavy"))
+	assert.Equal(t, 5, c.open)
+	assert.Equal(t, map[string]int{"heavy": 1, "light": 3, "new": 1}, c.clients)
+
+	assert.True(t, (*TunnelCap)(nil).admit("heavy"))
+}
+
+func TestTunnelCapSetMax(t *testing.T) {
+	// Arrange
+
+	c := NewTunnelCap(2)
+	require.True(t, c.admit("alice"))
+	require.True(t, c.admit("bob"))
+
+	// Act & Assert
+
+	c.SetMax(1)
+	assert.Equal(t, 1, c.Limit())
+	c.release("alice")
+	assert.False(t, c.admit("alice"), "open tunnels count towards the lowered cap")
+
+	c.SetMax(10)
+	assert.Equal(t, 9, c.FairShare)
+	assert.True(t, c.admit("alice"))
+}
+
+func TestProxyConnectTunnelCap(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.TunnelCap = NewTunnelCap(1)
+	p.RetryAfter = 1500 * time.Millisecond
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	connect := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		return conn, resp
+	}
+
+	// Act
+
+	first, firstResp := connect()
+	second, secondResp := connect()
+	second.Close()
+	first.Close()
+	for i := 0; i < 100 && !p.TunnelCap.admit("probe"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.TunnelCap.release("probe")
+	third, thirdResp := connect()
+	third.Close()
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, firstResp.StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, secondResp.StatusCode)
+	assert.Equal(t, "2", secondResp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, thirdResp.StatusCode)
+}
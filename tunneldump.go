@@ -0,0 +1,349 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxTunnelDumpTTL bounds the lifetime of tunnel dumps. It is shorter than
+// MaxDebugCaptureTTL, as dumps hold the payloads of tunnels.
+const MaxTunnelDumpTTL = time.Hour
+
+// Types of the records of tunnel dumps, see TunnelDumps.
+const (
+	TunnelDumpOpened = 'O'
+	TunnelDumpUp     = 'U'
+	TunnelDumpDown   = 'D'
+	TunnelDumpClosed = 'C'
+)
+
+// tunnelDumpHeaderSize is the size of the header of tunnel dump records.
+const tunnelDumpHeaderSize = 1 + 8 + 8 + 4
+
+// TunnelDump selects the tunnels whose raw bytes are dumped: the tunnels of
+// User to destinations matching Host. Either may be empty to select the
+// tunnels of any user or to any destination, but not both.
+type TunnelDump struct {
+	ID   uint64 `json:"id"`
+	User string `json:"user,omitempty"`
+	// Host is a host pattern of the destinations dumped, see
+	// ResponseHeaderRule.Host for the syntax.
+	Host    string    `json:"host,omitempty"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// TunnelDumpMetadata is the payload of the records of opened and closed
+// tunnels, as JSON. Closed records also hold the outcome of the tunnel.
+type TunnelDumpMetadata struct {
+	// Dump is the ID of the dump the tunnel was selected by.
+	Dump        uint64    `json:"dump"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Destination string    `json:"destination"`
+	Start       time.Time `json:"start"`
+	Duration    float64   `json:"duration,omitempty"`
+	BytesUp     int64     `json:"bytes_up,omitempty"`
+	BytesDown   int64     `json:"bytes_down,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	// Truncated is set if the tunnel relayed more than
+	// TunnelDumps.MaxTunnelBytes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// TunnelDumpRecord is a record of a tunnel dump.
+type TunnelDumpRecord struct {
+	Type    byte
+	Tunnel  uint64
+	Time    time.Time
+	Payload []byte
+}
+
+// TunnelDumps writes the raw bytes relayed by the tunnels selected by its
+// dumps, so operators can diagnose protocol issues of specific clients
+// without capturing packets on the proxy host. Dumps are added via the admin
+// API, see Proxy.AdminHandler, and expire like debug captures. Intercepted
+// tunnels are not dumped.
+//
+// Writer receives one record per chunk of bytes relayed, framed as
+//
+//	type     1 byte, TunnelDumpOpened, TunnelDumpUp, TunnelDumpDown or TunnelDumpClosed
+//	tunnel   8 bytes, the tunnel ID as listed by the admin API
+//	time     8 bytes, in nanoseconds since the Unix epoch
+//	length   4 bytes, the length of the payload
+//	payload  the bytes relayed, or the TunnelDumpMetadata of opened and closed tunnels
+//
+// with integers in big-endian byte order, see ReadTunnelDumpRecord. Records
+// are written whole, so rotating files, such as a RotatingFile, are only
+// rotated between them, though the records of a tunnel may span files.
+type TunnelDumps struct {
+	Writer io.Writer
+	// ACL, if set, decides which destinations may be dumped at all, e.g. to
+	// never dump destinations carrying personal data. Rules on IP ranges
+	// and countries only match destinations given as IP addresses.
+	ACL *ACL
+	// MaxTunnelBytes bounds the bytes dumped per tunnel, unlimited if zero.
+	// Later bytes are relayed but not dumped, and the tunnel is marked as
+	// truncated.
+	MaxTunnelBytes int64
+
+	// n is the number of dumps, accessed atomically, so tunnels are not
+	// serialized on mu while nothing is dumped.
+	n int32
+
+	mu     sync.Mutex
+	now    func() time.Time
+	lastID uint64
+	dumps  []TunnelDump
+
+	writeMu sync.Mutex
+}
+
+func (d *TunnelDumps) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// Add adds dump, whose ID is assigned, and returns it.
+func (d *TunnelDumps) Add(dump TunnelDump) TunnelDump {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastID++
+	dump.ID = d.lastID
+	d.setDumps(append(d.removeExpired(), dump))
+	return dump
+}
+
+// Stop removes the dump id and reports whether it existed. Tunnels already
+// dumped by it are dumped until closed.
+func (d *TunnelDumps) Stop(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, dump := range d.dumps {
+		if dump.ID == id {
+			d.setDumps(append(d.dumps[:i], d.dumps[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the dumps not expired yet, ordered by ID.
+func (d *TunnelDumps) List() []TunnelDump {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setDumps(d.removeExpired())
+	dumps := make([]TunnelDump, len(d.dumps))
+	copy(dumps, d.dumps)
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].ID < dumps[j].ID })
+	return dumps
+}
+
+func (d *TunnelDumps) setDumps(dumps []TunnelDump) {
+	d.dumps = dumps
+	atomic.StoreInt32(&d.n, int32(len(dumps)))
+}
+
+// removeExpired returns the dumps of d not expired yet, reusing the slice.
+func (d *TunnelDumps) removeExpired() []TunnelDump {
+	now := d.clock()
+	dumps := d.dumps[:0]
+	for _, dump := range d.dumps {
+		if now.Before(dump.Expires) {
+			dumps = append(dumps, dump)
+		}
+	}
+	return dumps
+}
+
+// find returns the dump selecting the tunnel of user to host, if any and
+// the ACL allows dumping host.
+func (d *TunnelDumps) find(user, host string) (TunnelDump, bool) {
+	if d == nil || atomic.LoadInt32(&d.n) == 0 {
+		return TunnelDump{}, false
+	}
+	h, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return TunnelDump{}, false
+	}
+	port, _ := strconv.Atoi(portStr)
+	if d.ACL != nil && !d.ACL.decideUnresolved(h, port) {
+		return TunnelDump{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock()
+	for _, dump := range d.dumps {
+		if (dump.User == "" || dump.User == user) && (dump.Host == "" || matchHostPattern(dump.Host, h)) &&
+			now.Before(dump.Expires) {
+			return dump, true
+		}
+	}
+	return TunnelDump{}, false
+}
+
+// open starts dumping the tunnel id of rec if selected by a dump, or returns
+// nil.
+func (d *TunnelDumps) open(id uint64, rec *AccessRecord) *tunnelDump {
+	dump, ok := d.find(rec.User, rec.Destination)
+	if !ok {
+		return nil
+	}
+	td := &tunnelDump{dumps: d, id: id, dump: dump.ID, remaining: d.MaxTunnelBytes}
+	d.writeMetadata(TunnelDumpOpened, id, td.metadata(rec))
+	return td
+}
+
+// close writes the closed record of the dumped tunnel td of rec.
+func (d *TunnelDumps) close(td *tunnelDump, rec *AccessRecord) {
+	if td == nil {
+		return
+	}
+	m := td.metadata(rec)
+	m.Duration = rec.Duration
+	m.BytesUp = rec.BytesUp
+	m.BytesDown = rec.BytesDown
+	m.Reason = rec.Reason
+	td.mu.Lock()
+	m.Truncated = td.truncated
+	td.mu.Unlock()
+	d.writeMetadata(TunnelDumpClosed, td.id, m)
+}
+
+func (d *TunnelDumps) writeMetadata(typ byte, id uint64, m TunnelDumpMetadata) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	d.write(typ, id, b)
+}
+
+// write writes a record of type typ of the tunnel id holding payload.
+func (d *TunnelDumps) write(typ byte, id uint64, payload []byte) {
+	b := make([]byte, tunnelDumpHeaderSize, tunnelDumpHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:], id)
+	binary.BigEndian.PutUint64(b[9:], uint64(d.clock().UnixNano()))
+	binary.BigEndian.PutUint32(b[17:], uint32(len(payload)))
+	b = append(b, payload...)
+
+	d.writeMu.Lock()
+	_, _ = d.Writer.Write(b)
+	d.writeMu.Unlock()
+}
+
+// ReadTunnelDumpRecord reads the next record from r holding tunnel dumps, see
+// TunnelDumps. It returns io.EOF if r ends ahead of a record.
+func ReadTunnelDumpRecord(r io.Reader) (TunnelDumpRecord, error) {
+	var h [tunnelDumpHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return TunnelDumpRecord{}, errors.New("truncated tunnel dump record")
+		}
+		return TunnelDumpRecord{}, err
+	}
+	rec := TunnelDumpRecord{
+		Type:    h[0],
+		Tunnel:  binary.BigEndian.Uint64(h[1:]),
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(h[9:]))),
+		Payload: make([]byte, binary.BigEndian.Uint32(h[17:])),
+	}
+	if _, err := io.ReadFull(r, rec.Payload); err != nil {
+		return TunnelDumpRecord{}, errors.New("truncated tunnel dump record")
+	}
+	return rec, nil
+}
+
+// tunnelDump dumps an open tunnel.
+type tunnelDump struct {
+	dumps *TunnelDumps
+	id    uint64
+	dump  uint64
+
+	mu sync.Mutex
+	// remaining is the number of bytes left to dump if MaxTunnelBytes is
+	// set.
+	remaining int64
+	truncated bool
+}
+
+func (td *tunnelDump) metadata(rec *AccessRecord) TunnelDumpMetadata {
+	return TunnelDumpMetadata{
+		Dump:        td.dump,
+		Client:      rec.Client,
+		User:        rec.User,
+		RequestID:   rec.RequestID,
+		Destination: rec.Destination,
+		Start:       rec.Start,
+	}
+}
+
+// add dumps b as relayed upstream if up is set, else downstream.
+func (td *tunnelDump) add(up bool, b []byte) {
+	if td.dumps.MaxTunnelBytes > 0 {
+		td.mu.Lock()
+		if int64(len(b)) > td.remaining {
+			b = b[:td.remaining]
+			td.truncated = true
+		}
+		td.remaining -= int64(len(b))
+		td.mu.Unlock()
+		if len(b) == 0 {
+			return
+		}
+	}
+	typ := byte(TunnelDumpDown)
+	if up {
+		typ = TunnelDumpUp
+	}
+	td.dumps.write(typ, td.id, b)
+}
+
+// upstream returns r dumping bytes read as sent from the client, or r if td
+// is nil.
+func (td *tunnelDump) upstream(r io.ReadCloser) io.ReadCloser {
+	if td == nil {
+		return r
+	}
+	return &tunnelDumpReader{ReadCloser: r, td: td, up: true}
+}
+
+// downstream returns r dumping bytes read as sent from the destination, or
+// r if td is nil.
+func (td *tunnelDump) downstream(r io.ReadCloser) io.ReadCloser {
+	if td == nil {
+		return r
+	}
+	return &tunnelDumpReader{ReadCloser: r, td: td}
+}
+
+type tunnelDumpReader struct {
+	io.ReadCloser
+	td *tunnelDump
+	up bool
+}
+
+func (r *tunnelDumpReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.td.add(r.up, b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelDumpsFind(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		givenUser string
+		givenHost string
+		expected  uint64
+	}{
+		{name: "User", givenUser: "alice", givenHost: "example.com:443", expected: 1},
+		{name: "Host", givenUser: "bob", givenHost: "api.partner.com:443", expected: 2},
+		{name: "UserAndHost", givenUser: "carol", givenHost: "example.com:443", expected: 3},
+		{name: "UserAndOtherHost", givenUser: "carol", givenHost: "other.example.com:443"},
+		{name: "DeniedByACL", givenUser: "alice", givenHost: "bank.example.com:443"},
+		{name: "Other", givenUser: "bob", givenHost: "example.com:443"},
+		{name: "Expired", givenUser: "dave", givenHost: "example.com:443"},
+	}
+
+	d := &TunnelDumps{
+		ACL: &ACL{Rules: []ACLRule{{Host: "bank.example.com"}}},
+		now: func() time.Time { return now },
+	}
+	d.Add(TunnelDump{User: "alice", Expires: now.Add(time.Hour)})
+	d.Add(TunnelDump{Host: "*.partner.com", Expires: now.Add(time.Hour)})
+	d.Add(TunnelDump{User: "carol", Host: "example.com", Expires: now.Add(time.Hour)})
+	d.Add(TunnelDump{User: "dave", Expires: now})
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, ok := d.find(tc.givenUser, tc.givenHost)
+
+			// Assert
+
+			assert.Equal(t, tc.expected != 0, ok)
+			assert.Equal(t, tc.expected, observed.ID)
+		})
+	}
+}
+
+func TestTunnelDumpRequest(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name            string
+		given           tunnelDumpRequest
+		expectedHost    string
+		expectedExpires time.Time
+		expectedError   bool
+	}{
+		{name: "User", given: tunnelDumpRequest{User: "alice", TTL: "15m"}, expectedExpires: now.Add(15 * time.Minute)},
+		{name: "Host", given: tunnelDumpRequest{Host: "API.example.com", Expires: now.Add(time.Hour)}, expectedHost: "api.example.com", expectedExpires: now.Add(time.Hour)},
+		{name: "Neither", given: tunnelDumpRequest{TTL: "15m"}, expectedError: true},
+		{name: "MissingTTL", given: tunnelDumpRequest{User: "alice"}, expectedError: true},
+		{name: "Past", given: tunnelDumpRequest{User: "alice", Expires: now.Add(-time.Minute)}, expectedError: true},
+		{name: "TooLong", given: tunnelDumpRequest{User: "alice", TTL: "2h"}, expectedError: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+
+			observed, err := tc.given.dump(now)
+
+			// Assert
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHost, observed.Host)
+			assert.Equal(t, tc.expectedExpires, observed.Expires)
+		})
+	}
+}
+
+func TestProxyTunnelDumps(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	var buf lockedBuffer
+	p := newTestProxy()
+	p.TunnelDumps = &TunnelDumps{Writer: &buf, MaxTunnelBytes: 6}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	admin := p.AdminHandler()
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	// Act
+
+	added := serve(http.MethodPost, "/dumps", `{"host":"127.0.0.1","ttl":"15m","reason":"INC-44"}`)
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", destAddr, destAddr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	var records []TunnelDumpRecord
+	for i := 0; i < 100; i++ {
+		buf.mu.Lock()
+		r := bytes.NewReader(buf.buf.Bytes())
+		buf.mu.Unlock()
+		records = records[:0]
+		for {
+			rec, err := ReadTunnelDumpRecord(r)
+			if err != nil {
+				require.Equal(t, io.EOF, err)
+				break
+			}
+			records = append(records, rec)
+		}
+		if len(records) > 0 && records[len(records)-1].Type == TunnelDumpClosed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listed := serve(http.MethodGet, "/dumps", "")
+	stopped := serve(http.MethodDelete, "/dumps/1", "")
+	missing := serve(http.MethodDelete, "/dumps/1", "")
+
+	// Assert
+
+	assert.Equal(t, http.StatusCreated, added.Code)
+	require.Len(t, records, 4)
+	assert.Equal(t, byte(TunnelDumpOpened), records[0].Type)
+	var opened TunnelDumpMetadata
+	require.NoError(t, json.Unmarshal(records[0].Payload, &opened))
+	assert.Equal(t, uint64(1), opened.Dump)
+	assert.Equal(t, "127.0.0.1", opened.Client)
+	assert.Equal(t, destAddr, opened.Destination)
+	assert.Equal(t, byte(TunnelDumpUp), records[1].Type)
+	assert.Equal(t, "ping", string(records[1].Payload))
+	assert.Equal(t, byte(TunnelDumpDown), records[2].Type)
+	assert.Equal(t, "pi", string(records[2].Payload), "dumps are truncated at MaxTunnelBytes")
+	var closed TunnelDumpMetadata
+	require.NoError(t, json.Unmarshal(records[3].Payload, &closed))
+	assert.Equal(t, int64(4), closed.BytesUp)
+	assert.Equal(t, int64(4), closed.BytesDown)
+	assert.True(t, closed.Truncated)
+	for _, rec := range records {
+		assert.Equal(t, records[0].Tunnel, rec.Tunnel)
+	}
+
+	var dumps []TunnelDump
+	require.NoError(t, json.Unmarshal(listed.Body.Bytes(), &dumps))
+	require.Len(t, dumps, 1)
+	assert.Equal(t, "INC-44", dumps[0].Reason)
+	assert.Equal(t, http.StatusNoContent, stopped.Code)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// upgradeType returns the protocol a plain HTTP request r asks to upgrade
+// to, e.g. "websocket", or "" if r does not ask to upgrade.
+//
+// See: https://tools.ietf.org/html/rfc7230#section-6.7
+func upgradeType(r *http.Request) string {
+	if r.ProtoMajor != 1 || !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.ToLower(r.Header.Get("Upgrade"))
+}
+
+// headerContainsToken reports whether any of the comma separated values of
+// the header name in h equals token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from h, including
+// those listed in its Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// handleUpgrade forwards the plain HTTP request r asking to upgrade to
+// protocol, e.g. a WebSocket handshake, and relays the connections of the
+// client and the destination as a tunnel once the destination switches
+// protocols. Other responses are forwarded as they are.
+func (p *Proxy) handleUpgrade(w http.ResponseWriter, r *http.Request, user, protocol string) {
+	host := r.URL.Host
+	if r.URL.Scheme == "https" {
+		host = withDefaultPort(host, "443")
+	} else {
+		host = withDefaultPort(host, "80")
+	}
+	if !p.connectHTTP(w, r, user, host) {
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.Logger.Error("Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	userTunnel, err := p.openTunnel(user, clientIP(requestAddr(r.RemoteAddr)))
+	if err == errTunnelCapReached {
+		if v := retryAfterValue(p.RetryAfter); v != "" {
+			w.Header().Set("Retry-After", v)
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	setup := &tunnelSetup{userTunnel: userTunnel}
+	defer setup.release()
+
+	destConn, err := p.dialTunnel(r.Context(), "tcp", host)
+	if err != nil {
+		switch err.(type) {
+		case *deniedAddrError:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		case *aclDeniedError:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case *rateExceededError:
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return
+	}
+	if r.URL.Scheme == "https" {
+		config := &tls.Config{}
+		if t, ok := p.ForwardingHTTPProxy.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = destinationKey(host)
+		}
+		// The handshake is not bound to the context of r.
+		if cert := originClientCertFromContext(r.Context()); cert != nil {
+			config.GetClientCertificate = cert.GetClientCertificate
+		}
+		destConn = tls.Client(destConn, config)
+	}
+	setup.destConn = destConn
+
+	outreq := new(http.Request)
+	*outreq = *r
+	outreq.Header = http.Header{}
+	for name, values := range r.Header {
+		outreq.Header[name] = values
+	}
+	removeHopByHopHeaders(outreq.Header)
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		outreq.Header.Set("User-Agent", "")
+	}
+	addIP := headerPolicyFromContext(r.Context()).forwarded(outreq.Header, r.ProtoMajor, r.ProtoMinor)
+	if ip := clientIP(requestAddr(r.RemoteAddr)); ip != "" && addIP {
+		if prior := outreq.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+	if p.DestReadTimeout > 0 {
+		destConn.SetReadDeadline(time.Now().Add(p.DestReadTimeout))
+	}
+	if err := outreq.Write(destConn); err != nil {
+		p.logHost(zap.InfoLevel, "Forwarding upgrade request failed", host)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	destBuf := bufio.NewReader(destConn)
+	resp, err := http.ReadResponse(destBuf, outreq)
+	if err != nil {
+		p.logHost(zap.InfoLevel, "Reading upgrade response failed", host)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	// Destinations refusing to switch protocols answer like to any other
+	// request.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		removeHopByHopHeaders(resp.Header)
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), protocol) {
+		p.Logger.Info("Destination switched to other protocol than requested",
+			zap.String("host", host),
+			zap.String("requested", protocol),
+			zap.String("upgrade", resp.Header.Get("Upgrade")))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		p.Logger.Error("Hijacking failed", zap.Error(err))
+		return
+	}
+	setup.clientConn = clientConn
+	upgrade := resp.Header.Get("Upgrade")
+	removeHopByHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := clientConn.Write(head.Bytes()); err != nil {
+		p.Logger.Error("Writing upgrade response failed", zap.Error(err))
+		return
+	}
+	// The tunnel is subject to the timeouts of tunnels from here on.
+	destConn.SetReadDeadline(time.Time{})
+	setup.handOver()
+	p.relay(r.Context(),
+		&bufferedConn{Conn: clientConn, r: clientBuf.Reader},
+		&bufferedConn{Conn: destConn, r: destBuf},
+		host, user, nil, userTunnel, p.tunnelTimeouts(r))
+}
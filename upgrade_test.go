@@ -0,0 +1,138 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeType(t *testing.T) {
+	cases := []struct {
+		name     string
+		given    http.Header
+		expected string
+	}{
+		{
+			name:     "WebSocket",
+			given:    http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"WebSocket"}},
+			expected: "websocket",
+		},
+		{
+			name:  "NoConnectionToken",
+			given: http.Header{"Connection": {"keep-alive"}, "Upgrade": {"websocket"}},
+		},
+		{
+			name:  "Plain",
+			given: http.Header{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			r.Header = tc.given
+
+			// Act
+
+			observed := upgradeType(r)
+
+			// Assert
+
+			assert.Equal(t, tc.expected, observed)
+		})
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Proxy-Authorization") != "" {
+			http.Error(w, "upgrade required", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(conn, buf)
+	}))
+	defer destServer.Close()
+	destAddr := destServer.Listener.Addr().String()
+
+	// Proxy server
+
+	p := newTestProxy()
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	cases := []struct {
+		name           string
+		givenUpgrade   string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Switched",
+			givenUpgrade:   "websocket",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedBody:   "ping",
+		},
+		{
+			name:           "Refused",
+			givenUpgrade:   "h2c",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "upgrade required\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			// Act
+
+			_, err = fmt.Fprintf(conn, "GET http://%s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", destAddr, destAddr, tc.givenUpgrade)
+			require.NoError(t, err)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+			require.NoError(t, err)
+			var body []byte
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				_, err = conn.Write([]byte("ping"))
+				require.NoError(t, err)
+				body = make([]byte, 4)
+				_, err = io.ReadFull(br, body)
+			} else {
+				body, err = ioutil.ReadAll(resp.Body)
+			}
+
+			// Assert
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Contains(t, resp.Header.Get("Via"), viaPseudonym)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// usagePath is the path under Proxy.UsageHost serving usage reports.
+const usagePath = "/me/usage"
+
+// usageReport is the usage of an authenticated user. Limits are zero if
+// unlimited.
+type usageReport struct {
+	User string `json:"user"`
+	// BytesConsumed is the number of bytes of the current egress budget
+	// window, and ByteLimit the lowest of the budget and policy limits.
+	BytesConsumed int64      `json:"bytes_consumed"`
+	ByteLimit     int64      `json:"byte_limit,omitempty"`
+	WindowEnd     *time.Time `json:"window_end,omitempty"`
+	// QuotaExhausted reports whether new requests are refused until the
+	// window ends.
+	QuotaExhausted bool `json:"quota_exhausted"`
+	ActiveTunnels  int  `json:"active_tunnels"`
+	MaxTunnels     int  `json:"max_tunnels,omitempty"`
+	// RateLimit is the bandwidth of all tunnels of the user in bytes per
+	// second, and Throttled reports whether they are being slowed down.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+	Throttled bool  `json:"throttled"`
+}
+
+var usageTemplate = template.Must(template.New("usage").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Proxy usage of {{.User}}</title></head>
+<body>
+<h1>Proxy usage of {{.User}}</h1>
+<table>
+<tr><th>Bytes consumed</th><td>{{.BytesConsumed}}{{if .ByteLimit}} of {{.ByteLimit}}{{end}}{{if .QuotaExhausted}} (exhausted){{end}}</td></tr>
+{{- if .WindowEnd}}
+<tr><th>Window end</th><td>{{.WindowEnd.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{- end}}
+<tr><th>Active tunnels</th><td>{{.ActiveTunnels}}{{if .MaxTunnels}} of {{.MaxTunnels}}{{end}}</td></tr>
+<tr><th>Rate limit</th><td>{{if .RateLimit}}{{.RateLimit}} bytes/s{{if .Throttled}} (throttled){{end}}{{else}}none{{end}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// serveUsage answers the request r of user to UsageHost with the usage of the
+// user, as HTML for browsers and as JSON otherwise.
+func (p *Proxy) serveUsage(w http.ResponseWriter, r *http.Request, user string) {
+	if r.URL.Path != usagePath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if user == "" {
+		http.Error(w, "Usage is only reported to authenticated users", http.StatusForbidden)
+		return
+	}
+
+	report := p.usage(user)
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := usageTemplate.Execute(w, report); err != nil {
+			p.Logger.Warn("Writing usage failed", zap.Error(err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		p.Logger.Warn("Writing usage failed", zap.Error(err))
+	}
+}
+
+// usage returns the usage of user.
+func (p *Proxy) usage(user string) *usageReport {
+	report := &usageReport{User: user, ActiveTunnels: p.tunnels.count(user)}
+
+	consumed, limit, windowEnd := p.EgressBudget.usage(user)
+	policy, _ := p.UserPolicies.usage(user)
+	if policy.MaxBytes > 0 && (limit <= 0 || policy.MaxBytes < limit) {
+		limit = policy.MaxBytes
+	}
+	if p.EgressBudget != nil {
+		report.BytesConsumed = consumed
+		report.ByteLimit = limit
+		report.WindowEnd = &windowEnd
+		report.QuotaExhausted = !p.EgressBudget.Allow(user) || !p.UserPolicies.allowBytes(user, consumed)
+	}
+	report.MaxTunnels = policy.MaxTunnels
+
+	report.RateLimit, report.Throttled = p.Throttle.userStatus(user)
+	return report
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServeUsage(t *testing.T) {
+	cases := []struct {
+		name             string
+		givenURL         string
+		givenAccept      string
+		givenAuth        bool
+		expectedStatus   int
+		expectedType     string
+		expectedContains string
+	}{
+		{
+			name:             "JSON",
+			givenURL:         "http://proxy.internal/me/usage",
+			givenAuth:        true,
+			expectedStatus:   http.StatusOK,
+			expectedType:     "application/json",
+			expectedContains: `"bytes_consumed":150`,
+		},
+		{
+			name:             "HTML",
+			givenURL:         "http://Proxy.Internal/me/usage",
+			givenAccept:      "text/html,application/xhtml+xml",
+			givenAuth:        true,
+			expectedStatus:   http.StatusOK,
+			expectedType:     "text/html; charset=utf-8",
+			expectedContains: "<td>150 of 100 (exhausted)</td>",
+		},
+		{
+			name:           "OtherPath",
+			givenURL:       "http://proxy.internal/admin",
+			givenAuth:      true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Unauthenticated",
+			givenURL:       "http://proxy.internal/me/usage",
+			expectedStatus: http.StatusProxyAuthRequired,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+
+			p := newTestProxy()
+			p.AuthUser = "user"
+			p.AuthPass = "pass"
+			p.UsageHost = "proxy.internal"
+			p.EgressBudget = &EgressBudget{Logger: zap.NewNop(), Window: time.Hour, UserLimit: 100}
+			p.EgressBudget.Add("user", 150)
+
+			req := httptest.NewRequest(http.MethodGet, tc.givenURL, nil)
+			if tc.givenAccept != "" {
+				req.Header.Set("Accept", tc.givenAccept)
+			}
+			if tc.givenAuth {
+				req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+			}
+			w := httptest.NewRecorder()
+
+			// Act
+
+			p.ServeHTTP(w, req)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedType != "" {
+				assert.Equal(t, tc.expectedType, w.Header().Get("Content-Type"))
+			}
+			assert.Contains(t, w.Body.String(), tc.expectedContains)
+		})
+	}
+}
+
+func TestProxyUsage(t *testing.T) {
+	// Arrange
+
+	p := newTestProxy()
+	p.EgressBudget = &EgressBudget{Logger: zap.NewNop(), Window: time.Hour, UserLimit: 1000}
+	p.UserPolicies = &UserPolicies{Policies: map[string]UserPolicy{
+		"alice": {MaxTunnels: 2, MaxBytes: 500},
+	}}
+	now := time.Now()
+	p.Throttle = &Throttle{UserRate: 100, now: func() time.Time { return now }}
+	p.EgressBudget.Add("alice", 200)
+	p.tunnels.add(context.Background(), &tunnelConns{user: "alice"})
+	p.tunnels.add(context.Background(), &tunnelConns{user: "bob"})
+	tt := p.Throttle.open("alice")
+	defer tt.close()
+	tt.buckets[0].reserve(300, now)
+
+	// Act
+
+	report := p.usage("alice")
+
+	// Assert
+
+	b, err := json.Marshal(report)
+	require.NoError(t, err)
+	var observed map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &observed))
+	assert.Equal(t, "alice", observed["user"])
+	assert.Equal(t, float64(200), observed["bytes_consumed"])
+	assert.Equal(t, float64(500), observed["byte_limit"], "lowest limit applies")
+	assert.Equal(t, false, observed["quota_exhausted"])
+	assert.Equal(t, float64(1), observed["active_tunnels"])
+	assert.Equal(t, float64(2), observed["max_tunnels"])
+	assert.Equal(t, float64(100), observed["rate_limit"])
+	assert.Equal(t, true, observed["throttled"])
+	assert.Contains(t, observed, "window_end")
+}
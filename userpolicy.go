@@ -0,0 +1,329 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// defaultPolicyUser is the user name of the policy applying to users without
+// a policy of their own.
+const defaultPolicyUser = "*"
+
+// UserPolicy limits the tunnels, traffic and destinations of an
+// authenticated user.
+type UserPolicy struct {
+	// MaxTunnels is the number of concurrent tunnels, unlimited if zero.
+	MaxTunnels int
+	// MaxBytes is the number of bytes per egress budget window, unlimited if
+	// zero. Bytes are only counted if Proxy.EgressBudget is set.
+	MaxBytes int64
+	// Destinations are the host patterns of allowed destinations, see
+	// ResponseHeaderRule.Host for the syntax. All destinations are allowed if
+	// empty.
+	Destinations []string
+	// Apps are the app names SOCKS clients of the user may announce in
+	// their metadata. Clients announcing other apps are refused, while
+	// clients without an app name are not affected. All apps are allowed if
+	// empty.
+	Apps []string
+}
+
+// UserPolicies enforces the policies of authenticated users. Unauthenticated
+// clients are not subject to any policy.
+type UserPolicies struct {
+	// Policies are the policies by user name. The policy of user "*"
+	// applies to users without a policy of their own.
+	Policies map[string]UserPolicy
+	// Counter, if set, counts the open tunnels of users instead of the
+	// memory of the proxy, e.g. in a store shared by several proxy
+	// instances enforcing the same limits.
+	Counter TunnelCounter
+
+	mu      sync.Mutex
+	tunnels memoryTunnelCounter
+}
+
+// TunnelCounter counts the open tunnels of users. It must be safe for
+// concurrent use.
+type TunnelCounter interface {
+	// Acquire counts a new tunnel of user unless user has max open tunnels,
+	// unlimited if max is zero, and reports whether it was counted.
+	Acquire(user string, max int) bool
+	// Release stops counting a tunnel of user counted by Acquire.
+	Release(user string)
+	// Count returns the number of open tunnels of user.
+	Count(user string) int
+}
+
+// memoryTunnelCounter is the TunnelCounter of UserPolicies without Counter.
+type memoryTunnelCounter struct {
+	mu      sync.Mutex
+	tunnels map[string]int
+}
+
+func (c *memoryTunnelCounter) Acquire(user string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if max > 0 && c.tunnels[user] >= max {
+		return false
+	}
+	if c.tunnels == nil {
+		c.tunnels = map[string]int{}
+	}
+	c.tunnels[user]++
+	return true
+}
+
+func (c *memoryTunnelCounter) Release(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tunnels[user]--; c.tunnels[user] <= 0 {
+		delete(c.tunnels, user)
+	}
+}
+
+func (c *memoryTunnelCounter) Count(user string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tunnels[user]
+}
+
+// counter returns the TunnelCounter of ps.
+func (ps *UserPolicies) counter() TunnelCounter {
+	if ps.Counter != nil {
+		return ps.Counter
+	}
+	return &ps.tunnels
+}
+
+// userPolicyDeniedError is returned when a destination is not allowed by the
+// policy of a user.
+type userPolicyDeniedError struct {
+	User string
+	Host string
+}
+
+func (e *userPolicyDeniedError) Error() string {
+	return fmt.Sprintf("destination %s not allowed for user %s", e.Host, e.User)
+}
+
+// LoadUserPolicies reads user policies from the file at path. Each non-empty
+// line not starting with '#' holds a user name, or "*" for all other users,
+// followed by the limits of the user, e.g.:
+//
+//	alice maxtunnels=20 maxbytes=10737418240 destinations=*.example.com,example.org
+//	ci    apps=backup,deploy
+//	*     maxtunnels=5 destinations=*.example.com
+func LoadUserPolicies(path string) (*UserPolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ps := &UserPolicies{Policies: map[string]UserPolicy{}}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, policy, err := parseUserPolicy(line)
+		if err == nil {
+			if _, ok := ps.Policies[user]; ok {
+				err = fmt.Errorf("duplicate policy of user %q", user)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		ps.Policies[user] = policy
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func parseUserPolicy(line string) (string, UserPolicy, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", UserPolicy{}, fmt.Errorf("malformed policy %q", line)
+	}
+
+	var policy UserPolicy
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return "", UserPolicy{}, fmt.Errorf("malformed setting %q", field)
+		}
+		key, value := strings.ToLower(field[:i]), field[i+1:]
+		var err error
+		switch key {
+		case "maxtunnels":
+			policy.MaxTunnels, err = strconv.Atoi(value)
+		case "maxbytes":
+			policy.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "destinations":
+			for _, pattern := range SplitList(value) {
+				policy.Destinations = append(policy.Destinations, strings.ToLower(pattern))
+			}
+		case "apps":
+			policy.Apps = SplitList(value)
+		default:
+			return "", UserPolicy{}, fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return "", UserPolicy{}, fmt.Errorf("malformed value of %s: %v", key, err)
+		}
+	}
+	return fields[0], policy, nil
+}
+
+// SetPolicies replaces the policies of ps, e.g. after the policy file
+// changed. Open tunnels keep counting towards the new limits.
+func (ps *UserPolicies) SetPolicies(policies map[string]UserPolicy) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.Policies = policies
+}
+
+// policy returns the policy of user. It must be called with ps.mu held.
+func (ps *UserPolicies) policy(user string) (UserPolicy, bool) {
+	if policy, ok := ps.Policies[user]; ok {
+		return policy, true
+	}
+	policy, ok := ps.Policies[defaultPolicyUser]
+	return policy, ok
+}
+
+// checkUserPolicy is the OnConnect hook refusing destinations and apps the
+// policy of the user of client does not allow.
+func (p *Proxy) checkUserPolicy(ctx context.Context, client ClientInfo, target string) error {
+	if err := p.UserPolicies.allowDestination(client.User, target); err != nil {
+		p.Logger.Info("Destination not allowed for user", zap.String("user", client.User), zap.String("host", target))
+		return err
+	}
+	if err := p.UserPolicies.allowApp(client.User, client.Metadata["app"]); err != nil {
+		p.Logger.Info("App not allowed for user", zap.String("user", client.User), zap.String("app", client.Metadata["app"]))
+		return err
+	}
+	return nil
+}
+
+// allowDestination returns an error if user may not connect to host.
+func (ps *UserPolicies) allowDestination(user, host string) error {
+	if ps == nil || user == "" {
+		return nil
+	}
+	ps.mu.Lock()
+	policy, ok := ps.policy(user)
+	ps.mu.Unlock()
+
+	if !ok || len(policy.Destinations) == 0 {
+		return nil
+	}
+	for _, pattern := range policy.Destinations {
+		if matchHostPattern(pattern, host) {
+			return nil
+		}
+	}
+	return &userPolicyDeniedError{User: user, Host: host}
+}
+
+// allowApp returns an error if clients of user may not announce app.
+func (ps *UserPolicies) allowApp(user, app string) error {
+	if ps == nil || user == "" || app == "" {
+		return nil
+	}
+	ps.mu.Lock()
+	policy, ok := ps.policy(user)
+	ps.mu.Unlock()
+
+	if !ok || len(policy.Apps) == 0 {
+		return nil
+	}
+	for _, a := range policy.Apps {
+		if a == app {
+			return nil
+		}
+	}
+	return fmt.Errorf("app %s not allowed for user %s", app, user)
+}
+
+// allowBytes reports whether user may send more bytes after consumed bytes in
+// the current egress budget window.
+func (ps *UserPolicies) allowBytes(user string, consumed int64) bool {
+	if ps == nil || user == "" {
+		return true
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	policy, _ := ps.policy(user)
+	return policy.MaxBytes <= 0 || consumed < policy.MaxBytes
+}
+
+// usage returns the policy of user and the number of its open tunnels. It
+// returns zeros if ps is nil.
+func (ps *UserPolicies) usage(user string) (UserPolicy, int) {
+	if ps == nil {
+		return UserPolicy{}, 0
+	}
+	ps.mu.Lock()
+	policy, _ := ps.policy(user)
+	ps.mu.Unlock()
+
+	return policy, ps.counter().Count(user)
+}
+
+// userTunnel is a tunnel counted towards the concurrent tunnels of a user and
+// the tunnel cap.
+type userTunnel struct {
+	policies *UserPolicies
+	user     string
+	cap      *TunnelCap
+	capKey   string
+}
+
+// openTunnel counts a new tunnel of user and returns it, or reports false if
+// the user has reached the maximum of concurrent tunnels. The returned tunnel
+// must be closed once the tunnel is closed.
+func (ps *UserPolicies) openTunnel(user string) (*userTunnel, bool) {
+	if ps == nil || user == "" {
+		return nil, true
+	}
+	ps.mu.Lock()
+	policy, _ := ps.policy(user)
+	ps.mu.Unlock()
+
+	if !ps.counter().Acquire(user, policy.MaxTunnels) {
+		return nil, false
+	}
+	return &userTunnel{policies: ps, user: user}, true
+}
+
+// close stops counting ut.
+func (ut *userTunnel) close() {
+	if ut == nil {
+		return
+	}
+	ut.cap.release(ut.capKey)
+	if ut.policies == nil {
+		return
+	}
+	ut.policies.counter().Release(ut.user)
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUserPolicies(t *testing.T) {
+	// Arrange
+
+	dir, err := ioutil.TempDir("", "userpolicies")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policies")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# Users\nalice maxtunnels=2 maxbytes=1000 destinations=*.Example.com,example.org\nci apps=backup,deploy\n* maxtunnels=1\n"), 0600))
+
+	cases := []struct {
+		name          string
+		givenContents string
+	}{
+		{name: "MissingSettings", givenContents: "alice\n"},
+		{name: "MalformedSetting", givenContents: "alice maxtunnels\n"},
+		{name: "UnknownSetting", givenContents: "alice maxconns=1\n"},
+		{name: "MalformedValue", givenContents: "alice maxbytes=1k\n"},
+		{name: "Duplicate", givenContents: "alice maxtunnels=1\nalice maxbytes=1\n"},
+	}
+
+	// Act
+
+	ps, err := LoadUserPolicies(path)
+
+	// Assert
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]UserPolicy{
+		"alice": {MaxTunnels: 2, MaxBytes: 1000, Destinations: []string{"*.example.com", "example.org"}},
+		"ci":    {Apps: []string{"backup", "deploy"}},
+		"*":     {MaxTunnels: 1},
+	}, ps.Policies)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			malformedPath := filepath.Join(dir, tc.name)
+			require.NoError(t, ioutil.WriteFile(malformedPath, []byte(tc.givenContents), 0600))
+
+			// Act
+
+			_, err := LoadUserPolicies(malformedPath)
+
+			// Assert
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.name+":")
+		})
+	}
+}
+
+func TestUserPolicies(t *testing.T) {
+	// Arrange
+
+	ps := &UserPolicies{Policies: map[string]UserPolicy{
+		"alice": {MaxTunnels: 2, MaxBytes: 1000, Destinations: []string{"*.example.com"}},
+		"*":     {MaxTunnels: 1},
+	}}
+
+	// Act & Assert
+
+	assert.NoError(t, ps.allowDestination("alice", "www.example.com:443"))
+	assert.Error(t, ps.allowDestination("alice", "example.org:443"))
+	assert.NoError(t, ps.allowDestination("bob", "example.org:443"))
+	assert.NoError(t, ps.allowDestination("", "example.org:443"))
+
+	assert.True(t, ps.allowBytes("alice", 999))
+	assert.False(t, ps.allowBytes("alice", 1000))
+	assert.True(t, ps.allowBytes("bob", 1000))
+
+	alice1, ok := ps.openTunnel("alice")
+	require.True(t, ok)
+	_, ok = ps.openTunnel("alice")
+	require.True(t, ok)
+	_, ok = ps.openTunnel("alice")
+	assert.False(t, ok, "alice is limited to two tunnels")
+	_, ok = ps.openTunnel("bob")
+	assert.True(t, ok, "default policy applies to bob")
+	_, ok = ps.openTunnel("bob")
+	assert.False(t, ok)
+
+	alice1.close()
+	_, ok = ps.openTunnel("alice")
+	assert.True(t, ok, "closed tunnels do not count")
+
+	anonymous, ok := ps.openTunnel("")
+	assert.True(t, ok)
+	assert.Nil(t, anonymous)
+	_, ok = (*UserPolicies)(nil).openTunnel("alice")
+	assert.True(t, ok)
+}
+
+func TestUserPoliciesSharedCounter(t *testing.T) {
+	// Arrange
+
+	counter := &memoryTunnelCounter{}
+	policies := map[string]UserPolicy{"alice": {MaxTunnels: 1}}
+	ps1 := &UserPolicies{Policies: policies, Counter: counter}
+	ps2 := &UserPolicies{Policies: policies, Counter: counter}
+
+	// Act & Assert
+
+	ut, ok := ps1.openTunnel("alice")
+	require.True(t, ok)
+	_, ok = ps2.openTunnel("alice")
+	assert.False(t, ok, "tunnels of other instances count")
+	_, open := ps2.usage("alice")
+	assert.Equal(t, 1, open)
+
+	ut.close()
+	_, ok = ps2.openTunnel("alice")
+	assert.True(t, ok)
+}
+
+func TestProxyConnectUserPolicies(t *testing.T) {
+	// Arrange
+
+	// Destination server
+
+	destListener := startEchoServer(t)
+	defer destListener.Close()
+	destAddr := destListener.Addr().String()
+
+	// Proxy server
+
+	p := newTestProxy()
+	p.AuthUser = "user"
+	p.AuthPass = "pass"
+	p.UserPolicies = &UserPolicies{Policies: map[string]UserPolicy{
+		"user": {MaxTunnels: 1, Destinations: []string{"127.0.0.1"}},
+	}}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	connect := func(target string) (net.Conn, int) {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", target, target)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		return conn, resp.StatusCode
+	}
+
+	// Act
+
+	first, firstStatus := connect(destAddr)
+	defer first.Close()
+	second, secondStatus := connect(destAddr)
+	second.Close()
+	denied, deniedStatus := connect("example.com:443")
+	denied.Close()
+
+	// Assert
+
+	assert.Equal(t, http.StatusOK, firstStatus)
+	assert.Equal(t, http.StatusTooManyRequests, secondStatus)
+	assert.Equal(t, http.StatusForbidden, deniedStatus)
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// xfccHeader is the header holding the client certificates of requests, as
+// named by Envoy.
+const xfccHeader = "X-Forwarded-Client-Cert"
+
+// ClientCertForwarder forwards the verified TLS client certificates of
+// clients towards internal destinations of plain HTTP requests via the
+// X-Forwarded-Client-Cert header in the format of Envoy, holding the SHA-256
+// hash, the subject and the URI and DNS subject alternative names of the
+// certificate, so internal services can make per-client decisions, e.g.:
+//
+//	Hash=0f3c...;Subject="CN=build-agent,O=Example";URI=spiffe://example.com/ci;DNS=ci.example.com
+type ClientCertForwarder struct {
+	// Hosts are the host patterns of internal destinations certificates
+	// are forwarded to, see ResponseHeaderRule.Host for the syntax.
+	Hosts []string
+}
+
+// Apply removes any X-Forwarded-Client-Cert header from r and, if the client
+// of r presented a verified certificate and the destination of r is
+// internal, adds one describing it.
+func (f *ClientCertForwarder) Apply(r *http.Request) {
+	r.Header.Del(xfccHeader)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || !matchAnyHostPattern(f.Hosts, r.URL.Host) {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	hash := sha256.Sum256(cert.Raw)
+	elements := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Subject=" + xfccValue(cert.Subject.String()),
+	}
+	for _, uri := range cert.URIs {
+		elements = append(elements, "URI="+xfccValue(uri.String()))
+	}
+	for _, name := range cert.DNSNames {
+		elements = append(elements, "DNS="+xfccValue(name))
+	}
+	r.Header.Set(xfccHeader, strings.Join(elements, ";"))
+}
+
+// xfccValue returns s as value of an X-Forwarded-Client-Cert element, quoted
+// with quotes escaped if it holds separators or quotes, as done by Envoy.
+func xfccValue(s string) string {
+	if !strings.ContainsAny(s, `,;="`) {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2018 Betalo AB - All Rights Reserved
+
+package forwardingproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCertForwarderApply(t *testing.T) {
+	// Arrange
+
+	spiffe, _ := url.Parse("spiffe://example.com/ci")
+	cert := &x509.Certificate{
+		Raw:      []byte("dummy-certificate"),
+		Subject:  pkix.Name{CommonName: "build-agent", Organization: []string{"Example, Inc."}},
+		URIs:     []*url.URL{spiffe},
+		DNSNames: []string{"ci.example.com", "ci.example.net"},
+	}
+	hash := sha256.Sum256(cert.Raw)
+
+	cases := []struct {
+		name        string
+		givenURL    string
+		givenTLS    *tls.ConnectionState
+		expectedXFC string
+	}{
+		{
+			name:        "Internal",
+			givenURL:    "http://billing.internal.example.com:8080/",
+			givenTLS:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expectedXFC: "Hash=" + hex.EncodeToString(hash[:]) + `;Subject="CN=build-agent,O=Example\, Inc.";URI=spiffe://example.com/ci;DNS=ci.example.com;DNS=ci.example.net`,
+		},
+		{
+			name:     "External",
+			givenURL: "http://example.com/",
+			givenTLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		},
+		{
+			name:     "NoCertificate",
+			givenURL: "http://billing.internal.example.com/",
+			givenTLS: &tls.ConnectionState{},
+		},
+		{
+			name:     "Plaintext",
+			givenURL: "http://billing.internal.example.com/",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &ClientCertForwarder{Hosts: []string{"*.internal.example.com"}}
+			r := httptest.NewRequest(http.MethodGet, tc.givenURL, nil)
+			r.TLS = tc.givenTLS
+			r.Header.Set("X-Forwarded-Client-Cert", "Hash=forged")
+
+			// Act
+
+			f.Apply(r)
+
+			// Assert
+
+			assert.Equal(t, tc.expectedXFC, r.Header.Get("X-Forwarded-Client-Cert"))
+		})
+	}
+}
+
+func TestXFCCValue(t *testing.T) {
+	assert.Equal(t, "ci.example.com", xfccValue("ci.example.com"))
+	assert.Equal(t, `"CN=a,O=b"`, xfccValue("CN=a,O=b"))
+	assert.Equal(t, `"CN=\"a\""`, xfccValue(`CN="a"`))
+}